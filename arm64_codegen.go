@@ -30,6 +30,8 @@ type ARM64CodeGen struct {
 	usesArenas        bool                         // Track if program uses any arena blocks
 	currentAssignName string                       // Name of variable being assigned (for lambda self-reference)
 	deferredExprs     [][]Expression               // Stack of deferred expressions per scope (LIFO order)
+	heldLocks         []heldLock                   // Stack of mutexes held by enclosing lock blocks
+	usesSync          bool                         // Track if program uses mutexes, rwlocks, condvars or queues
 }
 
 // ARM64LambdaFunc represents a lambda function for ARM64
@@ -186,10 +188,11 @@ func (acg *ARM64CodeGen) CompileProgram(program *Program) error {
 	// fcvtzs w0, d0
 	acg.out.out.writer.WriteBytes([]byte{0x00, 0x00, 0x78, 0x1e})
 
-	// For static Linux builds, exit with syscall instead of returning
-	if acg.eb.target.OS() == OSLinux && !acg.eb.useDynamicLinking {
-		// mov x8, #93 (sys_exit on ARM64 Linux)
-		acg.out.out.writer.WriteBytes([]byte{0xa8, 0x0b, 0x80, 0xd2})
+	// For static Linux and FreeBSD builds, exit with syscall instead of returning
+	if (acg.eb.target.OS() == OSLinux || acg.eb.target.OS() == OSFreeBSD) && !acg.eb.useDynamicLinking {
+		if err := acg.out.MovImm64("x8", sysNum(acg.eb.target, "SYS_EXIT")); err != nil {
+			return err
+		}
 		// svc #0
 		acg.out.out.writer.WriteBytes([]byte{0x01, 0x00, 0x00, 0xd4})
 		// Don't return here - continue to generate lambdas and helpers
@@ -227,6 +230,13 @@ func (acg *ARM64CodeGen) CompileProgram(program *Program) error {
 		return err
 	}
 
+	// Generate mutex/rwlock/condvar/queue runtime if any sync primitive is used
+	if acg.usesSync {
+		if err := acg.generateSyncRuntime(); err != nil {
+			return err
+		}
+	}
+
 	if VerboseMode {
 		fmt.Fprintf(os.Stderr, "DEBUG: CompileProgram completed successfully\n")
 	}
@@ -245,6 +255,8 @@ func (acg *ARM64CodeGen) compileStatement(stmt Statement) error {
 		return acg.compileExpression(s.Expr)
 	case *AssignStmt:
 		return acg.compileAssignment(s)
+	case *MapUpdateStmt:
+		return acg.compileMapUpdate(s)
 	case *LoopStmt:
 		return acg.compileLoopStatement(s)
 	case *CStructDecl:
@@ -265,6 +277,8 @@ func (acg *ARM64CodeGen) compileStatement(stmt Statement) error {
 		currentScope := len(acg.deferredExprs) - 1
 		acg.deferredExprs[currentScope] = append(acg.deferredExprs[currentScope], s.Call)
 		return nil
+	case *LockStmt:
+		return acg.compileLockStmt(s)
 	case *SpawnStmt:
 		// Process spawning with fork()
 		// Full implementation needs process management
@@ -289,6 +303,52 @@ func (acg *ARM64CodeGen) compileStatement(stmt Statement) error {
 	}
 }
 
+// compileMapUpdate compiles a list element update: list[index] <- value
+func (acg *ARM64CodeGen) compileMapUpdate(stmt *MapUpdateStmt) error {
+	if acg.getExprType(&IdentExpr{Name: stmt.MapName}) != "list" {
+		return fmt.Errorf("map updates are not yet supported on ARM64: %s", stmt.MapName)
+	}
+
+	// Compile value and save it (maintain 16-byte stack alignment)
+	if err := acg.compileExpression(stmt.Value); err != nil {
+		return err
+	}
+	acg.out.SubImm64("sp", "sp", 16)
+	if err := acg.out.StrImm64Double("d0", "sp", 0); err != nil {
+		return err
+	}
+
+	// Compile index and save it as an integer
+	if err := acg.compileExpression(stmt.Index); err != nil {
+		return err
+	}
+	// fcvtzs x0, d0
+	acg.out.out.writer.WriteBytes([]byte{0x00, 0x00, 0x78, 0x9e})
+	if err := acg.out.StrImm64("x0", "sp", 8); err != nil {
+		return err
+	}
+
+	// Load the list pointer: fcvtzs x0, d0
+	if err := acg.compileExpression(&IdentExpr{Name: stmt.MapName}); err != nil {
+		return err
+	}
+	acg.out.out.writer.WriteBytes([]byte{0x00, 0x00, 0x78, 0x9e})
+
+	// x0 = list + 8 + index*8 (skip the count)
+	if err := acg.out.LdrImm64("x1", "sp", 8); err != nil {
+		return err
+	}
+	acg.out.AddImm64("x0", "x0", 8)
+	acg.out.out.writer.WriteBytes([]byte{0x00, 0x0c, 0x01, 0x8b}) // add x0, x0, x1, lsl #3
+
+	// Store the value
+	if err := acg.out.LdrImm64Double("d0", "sp", 0); err != nil {
+		return err
+	}
+	acg.out.AddImm64("sp", "sp", 16)
+	return acg.out.StrImm64Double("d0", "x0", 0)
+}
+
 // compileJumpStatement compiles jump statements (ret, @label)
 func (acg *ARM64CodeGen) compileJumpStatement(stmt *JumpStmt) error {
 	// Handle function return: ret with Label=0
@@ -300,6 +360,9 @@ func (acg *ARM64CodeGen) compileJumpStatement(stmt *JumpStmt) error {
 			}
 			// d0 now contains return value
 		}
+		if err := acg.releaseHeldLocks(-1); err != nil {
+			return err
+		}
 
 		// Restore frame pointer and link register, then return
 		if err := acg.out.LdrImm64("x30", "sp", 8); err != nil {
@@ -1564,6 +1627,9 @@ func (acg *ARM64CodeGen) compileExpression(expr Expression) error {
 		return acg.compileExpression(&NumberExpr{Value: 0.0})
 
 	case *CastExpr:
+		if _, ok := parseCallbackType(e.Type); ok {
+			return fmt.Errorf("callback casts (as fn(...)) are not yet supported in ARM64")
+		}
 		// For now, just compile the expression being cast
 		// Actual type casting would be more complex
 		return acg.compileExpression(e.Expr)
@@ -1718,7 +1784,9 @@ func (acg *ARM64CodeGen) compileMatchExpr(expr *MatchExpr) error {
 
 	var endJumpPositions []int
 
-	for _, clause := range expr.Clauses {
+	for _, i := range profileClauseOrder(expr) {
+		clause := expr.Clauses[i]
+
 		// Load condition from stack to d0
 		if err := acg.out.LdrImm64Double("d0", "sp", 0); err != nil {
 			return err
@@ -2125,6 +2193,13 @@ func (acg *ARM64CodeGen) compileCall(call *CallExpr) error {
 			},
 		}
 		return acg.compileCFunctionCall("dlclose", call.Args, sig)
+	case "mutex", "rwlock", "condvar", "queue", "chan",
+		"mutex_lock", "mutex_unlock",
+		"rwlock_read", "rwlock_read_unlock", "rwlock_write", "rwlock_write_unlock",
+		"condvar_wait", "condvar_signal", "condvar_broadcast",
+		"queue_push", "queue_pop", "queue_close", "close":
+		// Synchronization primitives (see sync.go and arm64_sync.go)
+		return acg.compileSyncBuiltin(call)
 	case "dlerror":
 		// dlerror()
 		sig := &CFunctionSignature{
@@ -2385,7 +2460,7 @@ func (acg *ARM64CodeGen) compilePrint(call *CallExpr) error {
 			acg.out.out.writer.WriteBytes([]byte{0x01, 0x10, 0x00, 0xd4}) // svc #0x80
 		} else {
 			// Linux: syscall number in x8, svc #0
-			if err := acg.out.MovImm64("x8", 64); err != nil { // write syscall = 64
+			if err := acg.out.MovImm64("x8", sysNum(acg.eb.target, "SYS_WRITE")); err != nil {
 				return err
 			}
 			acg.out.out.writer.WriteBytes([]byte{0x01, 0x00, 0x00, 0xd4}) // svc #0
@@ -2529,7 +2604,7 @@ func (acg *ARM64CodeGen) compilePrintln(call *CallExpr) error {
 			acg.out.out.writer.WriteBytes([]byte{0x01, 0x10, 0x00, 0xd4}) // svc #0x80
 		} else {
 			// Linux: syscall number in x8, svc #0
-			if err := acg.out.MovImm64("x8", 64); err != nil { // write syscall = 64
+			if err := acg.out.MovImm64("x8", sysNum(acg.eb.target, "SYS_WRITE")); err != nil {
 				return err
 			}
 			acg.out.out.writer.WriteBytes([]byte{0x01, 0x00, 0x00, 0xd4}) // svc #0
@@ -2586,7 +2661,7 @@ func (acg *ARM64CodeGen) compilePrintln(call *CallExpr) error {
 		}
 		acg.out.out.writer.WriteBytes([]byte{0x01, 0x10, 0x00, 0xd4}) // svc #0x80
 	} else {
-		if err := acg.out.MovImm64("x8", 64); err != nil {
+		if err := acg.out.MovImm64("x8", sysNum(acg.eb.target, "SYS_WRITE")); err != nil {
 			return err
 		}
 		acg.out.out.writer.WriteBytes([]byte{0x01, 0x00, 0x00, 0xd4}) // svc #0
@@ -2635,7 +2710,7 @@ func (acg *ARM64CodeGen) compilePrintln(call *CallExpr) error {
 		}
 		acg.out.out.writer.WriteBytes([]byte{0x01, 0x10, 0x00, 0xd4}) // svc #0x80
 	} else {
-		if err := acg.out.MovImm64("x8", 64); err != nil {
+		if err := acg.out.MovImm64("x8", sysNum(acg.eb.target, "SYS_WRITE")); err != nil {
 			return err
 		}
 		acg.out.out.writer.WriteBytes([]byte{0x01, 0x00, 0x00, 0xd4}) // svc #0
@@ -2686,7 +2761,7 @@ func (acg *ARM64CodeGen) compileEprint(call *CallExpr) error {
 				}
 				acg.out.out.writer.WriteBytes([]byte{0x01, 0x10, 0x00, 0xd4}) // svc #0x80
 			} else {
-				if err := acg.out.MovImm64("x8", 64); err != nil { // write syscall = 64
+				if err := acg.out.MovImm64("x8", sysNum(acg.eb.target, "SYS_WRITE")); err != nil {
 					return err
 				}
 				acg.out.out.writer.WriteBytes([]byte{0x01, 0x00, 0x00, 0xd4}) // svc #0
@@ -2734,7 +2809,7 @@ func (acg *ARM64CodeGen) compileEprint(call *CallExpr) error {
 			}
 			acg.out.out.writer.WriteBytes([]byte{0x01, 0x10, 0x00, 0xd4}) // svc #0x80
 		} else {
-			if err := acg.out.MovImm64("x8", 64); err != nil { // write syscall = 64
+			if err := acg.out.MovImm64("x8", sysNum(acg.eb.target, "SYS_WRITE")); err != nil {
 				return err
 			}
 			acg.out.out.writer.WriteBytes([]byte{0x01, 0x00, 0x00, 0xd4}) // svc #0
@@ -2783,7 +2858,7 @@ func (acg *ARM64CodeGen) compileEprint(call *CallExpr) error {
 			}
 			acg.out.out.writer.WriteBytes([]byte{0x01, 0x10, 0x00, 0xd4}) // svc #0x80
 		} else {
-			if err := acg.out.MovImm64("x8", 64); err != nil { // write syscall = 64
+			if err := acg.out.MovImm64("x8", sysNum(acg.eb.target, "SYS_WRITE")); err != nil {
 				return err
 			}
 			acg.out.out.writer.WriteBytes([]byte{0x01, 0x00, 0x00, 0xd4}) // svc #0
@@ -2819,7 +2894,7 @@ func (acg *ARM64CodeGen) compileEprint(call *CallExpr) error {
 				}
 				acg.out.out.writer.WriteBytes([]byte{0x01, 0x10, 0x00, 0xd4}) // svc #0x80
 			} else {
-				if err := acg.out.MovImm64("x8", 64); err != nil {
+				if err := acg.out.MovImm64("x8", sysNum(acg.eb.target, "SYS_WRITE")); err != nil {
 					return err
 				}
 				acg.out.out.writer.WriteBytes([]byte{0x01, 0x00, 0x00, 0xd4}) // svc #0
@@ -2905,6 +2980,14 @@ func (acg *ARM64CodeGen) compileRangeExprLoop(stmt *LoopStmt, rangeExpr *RangeEx
 		return err
 	}
 
+	// SIMD auto-vectorization: process pairs of elements with NEON first,
+	// the scalar loop below handles the rest
+	if kernel := acg.planNEONKernel(stmt); kernel != nil {
+		if err := acg.emitNEONLoop(kernel, startOffset, limitOffset, iterOffset); err != nil {
+			return err
+		}
+	}
+
 	// Loop start label
 	loopStartPos := acg.eb.text.Len()
 
@@ -3221,10 +3304,11 @@ callExit:
 		return nil
 	}
 
-	// For static Linux builds, use Linux ARM64 exit syscall
+	// For static builds, use the exit syscall
 	if !acg.eb.useDynamicLinking {
-		// mov x8, #93 (sys_exit on ARM64 Linux)
-		acg.out.out.writer.WriteBytes([]byte{0xa8, 0x0b, 0x80, 0xd2})
+		if err := acg.out.MovImm64("x8", sysNum(acg.eb.target, "SYS_EXIT")); err != nil {
+			return err
+		}
 		// svc #0
 		acg.out.out.writer.WriteBytes([]byte{0x01, 0x00, 0x00, 0xd4})
 		return nil
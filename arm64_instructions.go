@@ -1080,8 +1080,114 @@ func (a *ARM64Out) FcmpScalar64(op1, op2 string) error {
 	return nil
 }
 
+// NEON vector instructions on two float64 lanes (the .2D arrangement)
+
+// neonVec3 encodes a three-register NEON instruction: op Vd.2D, Vn.2D, Vm.2D
+func (a *ARM64Out) neonVec3(base uint32, dest, op1, op2 string) error {
+	rd, ok := arm64FPRegs[dest]
+	if !ok {
+		return fmt.Errorf("invalid ARM64 FP register: %s", dest)
+	}
+	rn, ok := arm64FPRegs[op1]
+	if !ok {
+		return fmt.Errorf("invalid ARM64 FP register: %s", op1)
+	}
+	rm, ok := arm64FPRegs[op2]
+	if !ok {
+		return fmt.Errorf("invalid ARM64 FP register: %s", op2)
+	}
+	a.encodeInstr(base | (rm << 16) | (rn << 5) | rd)
+	return nil
+}
+
+// neonVec2 encodes a two-register NEON instruction: op Vd.2D, Vn.2D
+func (a *ARM64Out) neonVec2(base uint32, dest, src string) error {
+	rd, ok := arm64FPRegs[dest]
+	if !ok {
+		return fmt.Errorf("invalid ARM64 FP register: %s", dest)
+	}
+	rn, ok := arm64FPRegs[src]
+	if !ok {
+		return fmt.Errorf("invalid ARM64 FP register: %s", src)
+	}
+	a.encodeInstr(base | (rn << 5) | rd)
+	return nil
+}
+
+// FADD (vector): FADD Vd.2D, Vn.2D, Vm.2D
+func (a *ARM64Out) FaddVec2D(dest, op1, op2 string) error {
+	return a.neonVec3(0x4e60d400, dest, op1, op2)
+}
+
+// FSUB (vector): FSUB Vd.2D, Vn.2D, Vm.2D
+func (a *ARM64Out) FsubVec2D(dest, op1, op2 string) error {
+	return a.neonVec3(0x4ee0d400, dest, op1, op2)
+}
+
+// FMUL (vector): FMUL Vd.2D, Vn.2D, Vm.2D
+func (a *ARM64Out) FmulVec2D(dest, op1, op2 string) error {
+	return a.neonVec3(0x6e60dc00, dest, op1, op2)
+}
+
+// FDIV (vector): FDIV Vd.2D, Vn.2D, Vm.2D
+func (a *ARM64Out) FdivVec2D(dest, op1, op2 string) error {
+	return a.neonVec3(0x6e60fc00, dest, op1, op2)
+}
+
+// FMLA (vector): FMLA Vd.2D, Vn.2D, Vm.2D (d = d + n*m, fused)
+func (a *ARM64Out) FmlaVec2D(dest, op1, op2 string) error {
+	return a.neonVec3(0x4e60cc00, dest, op1, op2)
+}
+
+// MOV (vector): MOV Vd.16B, Vn.16B (alias of ORR Vd.16B, Vn.16B, Vn.16B)
+func (a *ARM64Out) MovVec(dest, src string) error {
+	return a.neonVec3(0x4ea01c00, dest, src, src)
+}
+
+// FSQRT (vector): FSQRT Vd.2D, Vn.2D
+func (a *ARM64Out) FsqrtVec2D(dest, src string) error {
+	return a.neonVec2(0x6ee1f800, dest, src)
+}
+
+// FNEG (vector): FNEG Vd.2D, Vn.2D
+func (a *ARM64Out) FnegVec2D(dest, src string) error {
+	return a.neonVec2(0x6ee0f800, dest, src)
+}
+
+// DUP (element): DUP Vd.2D, Vn.D[0] (broadcast the low lane)
+func (a *ARM64Out) DupVec2D(dest, src string) error {
+	return a.neonVec2(0x4e080400, dest, src)
+}
+
+// LD1 (single structure): LD1 {Vt.2D}, [Xn]
+func (a *ARM64Out) Ld1Vec2D(dest, base string) error {
+	rt, ok := arm64FPRegs[dest]
+	if !ok {
+		return fmt.Errorf("invalid ARM64 FP register: %s", dest)
+	}
+	rn, ok := arm64GPRegs[base]
+	if !ok {
+		return fmt.Errorf("invalid ARM64 register: %s", base)
+	}
+	a.encodeInstr(0x4c407c00 | (rn << 5) | rt)
+	return nil
+}
+
+// ST1 (single structure): ST1 {Vt.2D}, [Xn]
+func (a *ARM64Out) St1Vec2D(src, base string) error {
+	rt, ok := arm64FPRegs[src]
+	if !ok {
+		return fmt.Errorf("invalid ARM64 FP register: %s", src)
+	}
+	rn, ok := arm64GPRegs[base]
+	if !ok {
+		return fmt.Errorf("invalid ARM64 register: %s", base)
+	}
+	a.encodeInstr(0x4c007c00 | (rn << 5) | rt)
+	return nil
+}
+
 // Future enhancements:
-// - SIMD/NEON vector instructions (for parallel operations)
 // - Advanced addressing modes (pre/post-index)
 // - Atomic operations (LDXR, STXR, CAS, etc.)
 // - More conversion instructions (FCVT between precisions)
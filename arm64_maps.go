@@ -0,0 +1,393 @@
+// Completion: 80% - Swiss table hash map runtime (ARM64 NEON), not called by the ARM64 backend yet
+package main
+
+// arm64_maps.go - ARM64 implementation of the hash map runtime (see maps_runtime.go)
+//
+// The same functions on the same layout as the x86-64 runtime, with the
+// arguments in x0-x2 and d0 and the result in x0:
+//
+//	_vibe67_map_find(x0 = table, x1 = key) -> x0 = &value, or 0
+//	_vibe67_map_set(x0 = &table, x1 = key, d0 = value)
+//	_vibe67_map_delete(x0 = table, x1 = key) -> x0 = 1 if the key was there
+//
+// A group is probed with NEON: CMEQ compares the 16 control bytes with the
+// tag, and SHRN narrows the byte mask to a nibble per control byte, which
+// fits in a general purpose register. The runtime clobbers x0-x13 and v0-v1,
+// and _vibe67_map_set and _vibe67_map_grow save the x19-x24 they use.
+
+// ARM64 registers of the map runtime that the sync runtime does not name
+const (
+	a64X6  = 6
+	a64X19 = 19
+	a64X20 = 20
+	a64X21 = 21
+	a64X22 = 22
+	a64X23 = 23
+	a64X24 = 24
+)
+
+// generateMapRuntime emits the ARM64 hash map functions
+func (acg *ARM64CodeGen) generateMapRuntime() error {
+	acg.generateMapFind()
+	acg.generateMapDelete()
+	if err := acg.generateMapSet(); err != nil {
+		return err
+	}
+	acg.generateMapPlace()
+	return acg.generateMapGrow()
+}
+
+// a64MapHash computes mapHash(x1) into x2, clobbering x9
+func (acg *ARM64CodeGen) a64MapHash() {
+	acg.a64MovImm(a64X9, mapHashMultiplier&0xffff)
+	acg.out.encodeInstr(0xf2a00000 | (mapHashMultiplier>>16&0xffff)<<5 | a64X9) // movk x9, #imm, lsl #16
+	acg.out.encodeInstr(0xf2c00000 | (mapHashMultiplier>>32&0xffff)<<5 | a64X9) // movk x9, #imm, lsl #32
+	acg.out.encodeInstr(0xf2e00000 | (mapHashMultiplier>>48&0xffff)<<5 | a64X9) // movk x9, #imm, lsl #48
+	acg.out.encodeInstr(0x9b007c00 | a64X9<<16 | a64X1<<5 | a64X2)              // mul x2, x1, x9
+	acg.out.encodeInstr(0xca408000 | a64X2<<16 | a64X2<<5 | a64X2)              // eor x2, x2, x2, lsr #32
+}
+
+// a64MapTag sets x3 to the tag of the hash in x2 and x4 to the group mask of
+// the table in x0, and reduces x2 to the first group
+func (acg *ARM64CodeGen) a64MapTag() {
+	acg.out.encodeInstr(0xd379fc00 | a64X2<<5 | a64X3) // lsr x3, x2, #57
+	acg.out.encodeInstr(0xb2790000 | a64X3<<5 | a64X3) // orr x3, x3, #mapFullTag
+	acg.a64Ldr(a64X5, a64X0, 8)
+	acg.a64AddImm(a64X4, a64X5, -1)
+	acg.out.encodeInstr(0x8a000000 | a64X4<<16 | a64X2<<5 | a64X2) // and x2, x2, x4
+}
+
+// a64MapGroup points x6 at the control word of group index in the table in x0
+func (acg *ARM64CodeGen) a64MapGroup(index uint32) {
+	acg.a64MovImm(a64X9, mapGroupSize)
+	acg.out.encodeInstr(0x9b000000 | a64X9<<16 | a64X0<<10 | index<<5 | a64X6) // madd x6, index, x9, x0
+	acg.a64AddImm(a64X6, a64X6, mapHeaderSize)
+}
+
+// a64MapMatches leaves in x7 one bit per slot of the group at x6 whose
+// control byte equals the bytes of v1, or is zero when zero is set
+func (acg *ARM64CodeGen) a64MapMatches(zero bool) {
+	acg.out.encodeInstr(0x3dc00000 | a64X6<<5) // ldr q0, [x6]
+	if zero {
+		acg.out.encodeInstr(0x4e209800) // cmeq v0.16b, v0.16b, #0
+	} else {
+		acg.out.encodeInstr(0x6e218c00) // cmeq v0.16b, v0.16b, v1.16b
+	}
+	acg.out.encodeInstr(0x0f0c8400)                    // shrn v0.8b, v0.8h, #4
+	acg.out.encodeInstr(0x9e660000 | a64X7)            // fmov x7, d0
+	acg.out.encodeInstr(0x9201e000 | a64X7<<5 | a64X7) // and x7, x7, #0x8888888888888888
+	acg.out.encodeInstr(0x9240dc00 | a64X7<<5 | a64X7) // and x7, x7, #0x00ffffffffffffff (mapSlotMask)
+}
+
+// a64MapLowestSlot sets x9 to the slot of the lowest bit of x7
+func (acg *ARM64CodeGen) a64MapLowestSlot() {
+	acg.out.encodeInstr(0xdac00000 | a64X7<<5 | a64X9) // rbit x9, x7
+	acg.out.encodeInstr(0xdac01000 | a64X9<<5 | a64X9) // clz x9, x9
+	acg.out.encodeInstr(0xd342fc00 | a64X9<<5 | a64X9) // lsr x9, x9, #2
+}
+
+// a64MapProbeStart hashes x1, broadcasts its tag to all bytes of v1 and
+// sets x2 to the first group, x4 to the group mask and x5 to the number of
+// groups. x0 must not be 0.
+func (acg *ARM64CodeGen) a64MapProbeStart() {
+	acg.a64MapHash()
+	acg.a64MapTag()
+	acg.out.encodeInstr(0x4e010c00 | a64X3<<5 | 1) // dup v1.16b, w3
+}
+
+// a64MapProbeGroup looks for the key in x1 in the group x2. It branches to
+// the returned position with x6 at the group and x10 at the matching slot,
+// and falls through when the key is not in the group or any later one.
+// missBranches are the branches to patch to the miss path.
+func (acg *ARM64CodeGen) a64MapProbeGroup() (found int, missBranches []int) {
+	loopStart := acg.syncPos()
+	acg.a64MapGroup(a64X2)
+	acg.a64MapMatches(false)
+
+	// Compare the keys of the matching slots, lowest first
+	matchLoop := acg.syncPos()
+	noMatch := acg.syncBranchForward(a64CBZ | a64X7)
+	acg.a64MapLowestSlot()
+	acg.out.encodeInstr(0x8b001000 | a64X9<<16 | a64X6<<5 | a64X10) // add x10, x6, x9, lsl #4
+	acg.a64Ldr(a64X11, a64X10, mapControlSize)
+	acg.a64CmpReg(a64X11, a64X1)
+	found = acg.syncBranchForward(a64BEQ)
+	acg.a64AddImm(a64X9, a64X7, -1)
+	acg.out.encodeInstr(0x8a000000 | a64X9<<16 | a64X7<<5 | a64X7) // and x7, x7, x9
+	acg.syncBranchBack(a64B, matchLoop)
+
+	// Stop at a group that nothing overflowed from, or after all groups
+	acg.syncPatchHere(noMatch)
+	acg.out.encodeInstr(0x39400000 | mapOverflowByte<<10 | a64X6<<5 | a64X9) // ldrb w9, [x6, #mapOverflowByte]
+	missBranches = append(missBranches, acg.syncBranchForward(a64CBZ|a64X9))
+	acg.a64AddImm(a64X2, a64X2, 1)
+	acg.out.encodeInstr(0x8a000000 | a64X4<<16 | a64X2<<5 | a64X2) // and x2, x2, x4
+	acg.out.encodeInstr(0xf1000400 | a64X5<<5 | a64X5)             // subs x5, x5, #1
+	acg.syncBranchBack(a64BNE, loopStart)
+	return found, missBranches
+}
+
+// generateMapFind emits _vibe67_map_find(x0 = table, x1 = key) -> x0
+func (acg *ARM64CodeGen) generateMapFind() {
+	acg.eb.MarkLabel("_vibe67_map_find")
+	empty := acg.syncBranchForward(a64CBZ | a64X0)
+	acg.a64MapProbeStart()
+	found, missBranches := acg.a64MapProbeGroup()
+
+	// Not found
+	acg.syncPatchHere(empty)
+	for _, pos := range missBranches {
+		acg.syncPatchHere(pos)
+	}
+	acg.a64MovReg(a64X0, a64XZR)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// Found: return the address of the value
+	acg.syncPatchHere(found)
+	acg.a64AddImm(a64X0, a64X10, mapControlSize+8)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+}
+
+// generateMapDelete emits _vibe67_map_delete(x0 = table, x1 = key) -> x0
+func (acg *ARM64CodeGen) generateMapDelete() {
+	acg.eb.MarkLabel("_vibe67_map_delete")
+	empty := acg.syncBranchForward(a64CBZ | a64X0)
+	acg.a64MapProbeStart()
+	acg.a64MovReg(a64X12, a64X2) // x12 = first group of the key
+	found, missBranches := acg.a64MapProbeGroup()
+
+	// Not found
+	acg.syncPatchHere(empty)
+	for _, pos := range missBranches {
+		acg.syncPatchHere(pos)
+	}
+	acg.a64MovReg(a64X0, a64XZR)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// Found: empty the slot
+	acg.syncPatchHere(found)
+	acg.out.encodeInstr(0x38206800 | a64X9<<16 | a64X6<<5 | a64XZR) // strb wzr, [x6, x9]
+	acg.a64Str(a64XZR, a64X10, mapControlSize)
+	acg.a64Str(a64XZR, a64X10, mapControlSize+8)
+	acg.a64Ldr(a64X9, a64X0, 0)
+	acg.a64AddImm(a64X9, a64X9, -1)
+	acg.a64Str(a64X9, a64X0, 0)
+
+	// The groups from the first one up to this one no longer overflow
+	// because of the key
+	fixLoop := acg.syncPos()
+	acg.a64CmpReg(a64X12, a64X2)
+	done := acg.syncBranchForward(a64BEQ)
+	acg.a64MapGroup(a64X12)
+	acg.out.encodeInstr(0x39400000 | mapOverflowByte<<10 | a64X6<<5 | a64X9) // ldrb w9, [x6, #mapOverflowByte]
+	acg.a64CmpImm(a64X9, mapOverflowMax)
+	saturated := acg.syncBranchForward(a64BEQ)
+	acg.a64AddImm(a64X9, a64X9, -1)
+	acg.out.encodeInstr(0x39000000 | mapOverflowByte<<10 | a64X6<<5 | a64X9) // strb w9, [x6, #mapOverflowByte]
+	acg.syncPatchHere(saturated)
+	acg.a64AddImm(a64X12, a64X12, 1)
+	acg.out.encodeInstr(0x8a000000 | a64X4<<16 | a64X12<<5 | a64X12) // and x12, x12, x4
+	acg.syncBranchBack(a64B, fixLoop)
+
+	acg.syncPatchHere(done)
+	acg.a64MovImm(a64X0, 1)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+}
+
+// generateMapSet emits _vibe67_map_set(x0 = &table, x1 = key, d0 = value)
+func (acg *ARM64CodeGen) generateMapSet() error {
+	acg.eb.MarkLabel("_vibe67_map_set")
+	acg.out.encodeInstr(0xa9bd7bfd) // stp x29, x30, [sp, #-48]!
+	acg.out.encodeInstr(0xa90153f3) // stp x19, x20, [sp, #16]
+	acg.out.encodeInstr(0xf90013f5) // str x21, [sp, #32]
+	acg.a64MovReg(a64X19, a64X0)
+	acg.a64MovReg(a64X20, a64X1)
+	acg.out.encodeInstr(0x9e660000 | a64X21) // fmov x21, d0
+
+	// Replace the value of a key that is already there
+	acg.a64Ldr(a64X0, a64X19, 0)
+	if err := acg.eb.GenerateCallInstruction("_vibe67_map_find"); err != nil {
+		return err
+	}
+	insert := acg.syncBranchForward(a64CBZ | a64X0)
+	acg.a64Str(a64X21, a64X0, 0)
+	done := acg.syncBranchForward(a64B)
+
+	// Grow before the table gets more than 7/8 full
+	acg.syncPatchHere(insert)
+	acg.a64Ldr(a64X0, a64X19, 0)
+	grow := acg.syncBranchForward(a64CBZ | a64X0)
+	acg.a64Ldr(a64X9, a64X0, 0)
+	acg.a64AddImm(a64X9, a64X9, 1)
+	acg.out.encodeInstr(0xd37df000 | a64X9<<5 | a64X9) // lsl x9, x9, #3
+	acg.a64Ldr(a64X10, a64X0, 8)
+	acg.a64MovImm(a64X11, mapMaxLoad)
+	acg.out.encodeInstr(0x9b007c00 | a64X11<<16 | a64X10<<5 | a64X10) // mul x10, x10, x11
+	acg.a64CmpReg(a64X9, a64X10)
+	place := acg.syncBranchForward(a64BLS)
+	acg.syncPatchHere(grow)
+	acg.a64MovReg(a64X0, a64X19)
+	if err := acg.eb.GenerateCallInstruction("_vibe67_map_grow"); err != nil {
+		return err
+	}
+
+	acg.syncPatchHere(place)
+	acg.a64Ldr(a64X0, a64X19, 0)
+	acg.a64MovReg(a64X1, a64X20)
+	acg.a64MovReg(a64X2, a64X21)
+	if err := acg.eb.GenerateCallInstruction("_vibe67_map_place"); err != nil {
+		return err
+	}
+
+	acg.syncPatchHere(done)
+	acg.out.encodeInstr(0xf94013f5) // ldr x21, [sp, #32]
+	acg.out.encodeInstr(0xa94153f3) // ldp x19, x20, [sp, #16]
+	acg.out.encodeInstr(0xa8c37bfd) // ldp x29, x30, [sp], #48
+	acg.out.encodeInstr(0xd65f03c0) // ret
+	return nil
+}
+
+// generateMapPlace emits _vibe67_map_place(x0 = table, x1 = key, x2 = value
+// bits), which puts a new key into the first empty slot along its probe path
+func (acg *ARM64CodeGen) generateMapPlace() {
+	acg.eb.MarkLabel("_vibe67_map_place")
+	acg.a64MovReg(a64X13, a64X2)
+	acg.a64MapHash()
+	acg.a64MapTag()
+
+	loopStart := acg.syncPos()
+	acg.a64MapGroup(a64X2)
+	acg.a64MapMatches(true)
+	empty := acg.syncBranchForward(a64CBNZ | a64X7)
+
+	// The group is full: count the overflow and try the next one
+	acg.out.encodeInstr(0x39400000 | mapOverflowByte<<10 | a64X6<<5 | a64X9) // ldrb w9, [x6, #mapOverflowByte]
+	acg.a64CmpImm(a64X9, mapOverflowMax)
+	saturated := acg.syncBranchForward(a64BEQ)
+	acg.a64AddImm(a64X9, a64X9, 1)
+	acg.out.encodeInstr(0x39000000 | mapOverflowByte<<10 | a64X6<<5 | a64X9) // strb w9, [x6, #mapOverflowByte]
+	acg.syncPatchHere(saturated)
+	acg.a64AddImm(a64X2, a64X2, 1)
+	acg.out.encodeInstr(0x8a000000 | a64X4<<16 | a64X2<<5 | a64X2) // and x2, x2, x4
+	acg.syncBranchBack(a64B, loopStart)
+
+	// Fill the lowest empty slot
+	acg.syncPatchHere(empty)
+	acg.a64MapLowestSlot()
+	acg.out.encodeInstr(0x38206800 | a64X9<<16 | a64X6<<5 | a64X3)  // strb w3, [x6, x9]
+	acg.out.encodeInstr(0x8b001000 | a64X9<<16 | a64X6<<5 | a64X10) // add x10, x6, x9, lsl #4
+	acg.a64Str(a64X1, a64X10, mapControlSize)
+	acg.a64Str(a64X13, a64X10, mapControlSize+8)
+	acg.a64Ldr(a64X9, a64X0, 0)
+	acg.a64AddImm(a64X9, a64X9, 1)
+	acg.a64Str(a64X9, a64X0, 0)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+}
+
+// a64MapTableSize sets dst to the bytes of a table with the number of groups
+// in register groups, clobbering x11
+func (acg *ARM64CodeGen) a64MapTableSize(dst, groups uint32) {
+	acg.a64MovImm(a64X11, mapGroupSize)
+	acg.out.encodeInstr(0x9b007c00 | a64X11<<16 | groups<<5 | dst) // mul dst, groups, x11
+	acg.a64AddImm(dst, dst, mapHeaderSize)
+}
+
+// generateMapGrow emits _vibe67_map_grow(x0 = &table), which replaces the
+// table with one with twice the groups (or the first table)
+func (acg *ARM64CodeGen) generateMapGrow() error {
+	acg.eb.MarkLabel("_vibe67_map_grow")
+	acg.out.encodeInstr(0xa9bc7bfd) // stp x29, x30, [sp, #-64]!
+	acg.out.encodeInstr(0xa90153f3) // stp x19, x20, [sp, #16]
+	acg.out.encodeInstr(0xa9025bf5) // stp x21, x22, [sp, #32]
+	acg.out.encodeInstr(0xa90363f7) // stp x23, x24, [sp, #48]
+	acg.a64MovReg(a64X19, a64X0)
+	acg.a64Ldr(a64X20, a64X19, 0) // x20 = old table
+
+	// x21 = groups in the new table
+	acg.a64MovImm(a64X21, mapMinGroups)
+	first := acg.syncBranchForward(a64CBZ | a64X20)
+	acg.a64Ldr(a64X21, a64X20, 8)
+	acg.a64MovImm(a64X9, mapGrowthFactor)
+	acg.out.encodeInstr(0x9b007c00 | a64X9<<16 | a64X21<<5 | a64X21) // mul x21, x21, x9
+	acg.syncPatchHere(first)
+
+	// Allocate and clear the new table
+	acg.a64MapTableSize(a64X22, a64X21)
+	if acg.eb.target.OS() == OSLinux {
+		// mmap(NULL, size, PROT_READ|PROT_WRITE, MAP_PRIVATE|MAP_ANONYMOUS, -1, 0)
+		acg.a64MovReg(a64X0, a64XZR)
+		acg.a64MovReg(a64X1, a64X22)
+		acg.a64MovImm(a64X2, 3)
+		acg.a64MovImm(a64X3, 0x22)
+		acg.out.encodeInstr(0x92800004) // mov x4, #-1
+		acg.a64MovReg(a64X5, a64XZR)
+		acg.a64MovImm(a64X8, 222) // sys_mmap
+		acg.out.encodeInstr(0xd4000001)
+	} else {
+		acg.a64MovReg(a64X0, a64X22)
+		if err := acg.eb.GenerateCallInstruction("malloc"); err != nil {
+			return err
+		}
+		acg.a64MovReg(a64X1, a64X22)
+		acg.a64MovReg(a64X2, a64X0)
+		loop := acg.syncPos()
+		done := acg.syncBranchForward(a64CBZ | a64X1)
+		acg.out.encodeInstr(0xf800845f) // str xzr, [x2], #8
+		acg.a64AddImm(a64X1, a64X1, -8)
+		acg.syncBranchBack(a64B, loop)
+		acg.syncPatchHere(done)
+	}
+	acg.a64Str(a64X21, a64X0, 8)
+	acg.a64Str(a64X0, a64X19, 0)
+	acg.a64MovReg(a64X22, a64X0) // x22 = new table
+	done := acg.syncBranchForward(a64CBZ | a64X20)
+
+	// Reinsert the entries of the old table in memory order
+	acg.a64Ldr(a64X9, a64X20, 8)
+	acg.a64MapTableSize(a64X23, a64X9)
+	acg.out.encodeInstr(0x8b000000 | a64X20<<16 | a64X23<<5 | a64X23) // add x23, x23, x20 (end of the old groups)
+	acg.a64AddImm(a64X24, a64X20, mapHeaderSize)
+	groupLoop := acg.syncPos()
+	acg.a64CmpReg(a64X24, a64X23)
+	free := acg.syncBranchForward(a64BHS)
+	acg.a64MovReg(a64X19, a64XZR)
+	slotLoop := acg.syncPos()
+	acg.a64CmpImm(a64X19, mapGroupSlots)
+	nextGroup := acg.syncBranchForward(a64BEQ)
+	acg.out.encodeInstr(0x38606800 | a64X19<<16 | a64X24<<5 | a64X9) // ldrb w9, [x24, x19]
+	empty := acg.syncBranchForward(a64CBZ | a64X9)
+	acg.out.encodeInstr(0x8b001000 | a64X19<<16 | a64X24<<5 | a64X10) // add x10, x24, x19, lsl #4
+	acg.a64MovReg(a64X0, a64X22)
+	acg.a64Ldr(a64X1, a64X10, mapControlSize)
+	acg.a64Ldr(a64X2, a64X10, mapControlSize+8)
+	if err := acg.eb.GenerateCallInstruction("_vibe67_map_place"); err != nil {
+		return err
+	}
+	acg.syncPatchHere(empty)
+	acg.a64AddImm(a64X19, a64X19, 1)
+	acg.syncBranchBack(a64B, slotLoop)
+	acg.syncPatchHere(nextGroup)
+	acg.a64AddImm(a64X24, a64X24, mapGroupSize)
+	acg.syncBranchBack(a64B, groupLoop)
+
+	// Release the old table
+	acg.syncPatchHere(free)
+	acg.a64MovReg(a64X0, a64X20)
+	if acg.eb.target.OS() == OSLinux {
+		// munmap(old table, size)
+		acg.a64Ldr(a64X9, a64X20, 8)
+		acg.a64MapTableSize(a64X1, a64X9)
+		acg.a64MovImm(a64X8, 215) // sys_munmap
+		acg.out.encodeInstr(0xd4000001)
+	} else if err := acg.eb.GenerateCallInstruction("free"); err != nil {
+		return err
+	}
+
+	acg.syncPatchHere(done)
+	acg.out.encodeInstr(0xa94363f7) // ldp x23, x24, [sp, #48]
+	acg.out.encodeInstr(0xa9425bf5) // ldp x21, x22, [sp, #32]
+	acg.out.encodeInstr(0xa94153f3) // ldp x19, x20, [sp, #16]
+	acg.out.encodeInstr(0xa8c47bfd) // ldp x29, x30, [sp], #64
+	acg.out.encodeInstr(0xd65f03c0) // ret
+	return nil
+}
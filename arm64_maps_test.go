@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"testing"
+)
+
+// a64Machine interprets the AArch64 instructions that the map runtime and
+// runARM64MapOps emit, with the Linux mmap, munmap, write and exit calls, so
+// the runtime can be checked on any host
+type a64Machine struct {
+	t       *testing.T
+	x       [31]uint64
+	sp, pc  uint64
+	v       [32][16]byte
+	n, z, c bool
+	vf      bool
+	regions []a64Region
+	heap    uint64
+	live    map[uint64]uint64 // mmapped address -> size
+	out     []byte
+	exited  bool
+}
+
+type a64Region struct {
+	base uint64
+	data []byte
+}
+
+const (
+	a64CodeBase  = 0x400000
+	a64StackBase = 0x7ff00000
+	a64HeapBase  = 0x10000000
+)
+
+func newA64Machine(t *testing.T, code []byte) *a64Machine {
+	return &a64Machine{
+		t: t,
+		regions: []a64Region{
+			{a64CodeBase, code},
+			{a64StackBase, make([]byte, 1<<16)},
+			{a64HeapBase, make([]byte, 16<<20)},
+		},
+		sp:   a64StackBase + 1<<16,
+		pc:   a64CodeBase,
+		heap: a64HeapBase,
+		live: make(map[uint64]uint64),
+	}
+}
+
+// mem returns the n bytes at addr
+func (m *a64Machine) mem(addr, n uint64) []byte {
+	for _, r := range m.regions {
+		if addr >= r.base && addr+n <= r.base+uint64(len(r.data)) {
+			return r.data[addr-r.base : addr-r.base+n]
+		}
+	}
+	m.t.Fatalf("access of %d bytes at %#x, pc %#x", n, addr, m.pc)
+	return nil
+}
+
+// reg reads Xr with 31 as XZR, regSP with 31 as SP
+func (m *a64Machine) reg(r uint32) uint64 {
+	if r == 31 {
+		return 0
+	}
+	return m.x[r]
+}
+
+func (m *a64Machine) regSP(r uint32) uint64 {
+	if r == 31 {
+		return m.sp
+	}
+	return m.x[r]
+}
+
+func (m *a64Machine) setReg(r uint32, v uint64) {
+	if r != 31 {
+		m.x[r] = v
+	}
+}
+
+func (m *a64Machine) setRegSP(r uint32, v uint64) {
+	if r == 31 {
+		m.sp = v
+		return
+	}
+	m.x[r] = v
+}
+
+// cond evaluates a condition code
+func (m *a64Machine) cond(cc uint32) bool {
+	var r bool
+	switch cc >> 1 {
+	case 0:
+		r = m.z
+	case 1:
+		r = m.c
+	case 2:
+		r = m.n
+	case 3:
+		r = m.vf
+	case 4:
+		r = m.c && !m.z
+	case 5:
+		r = m.n == m.vf
+	case 6:
+		r = m.n == m.vf && !m.z
+	case 7:
+		return true
+	}
+	if cc&1 == 1 {
+		return !r
+	}
+	return r
+}
+
+// shifted applies the shift of a shifted register operand
+func shifted(v uint64, kind, amount uint32) uint64 {
+	switch kind {
+	case 0:
+		return v << amount
+	case 1:
+		return v >> amount
+	case 2:
+		return uint64(int64(v) >> amount)
+	}
+	return bits.RotateLeft64(v, -int(amount))
+}
+
+// a64BitMask decodes the N:immr:imms field of a 64-bit logical immediate
+func a64BitMask(n, immr, imms uint32) uint64 {
+	esize := uint32(1) << (bits.Len32(n<<6|^imms&0x3f) - 1)
+	s, r := imms&(esize-1), immr&(esize-1)
+	elem := uint64(1)<<(s+1) - 1
+	if esize == 64 {
+		elem = bits.RotateLeft64(elem, -int(r))
+	} else if r > 0 {
+		elem = (elem>>r | elem<<(esize-r)) & (uint64(1)<<esize - 1)
+	}
+	mask := uint64(0)
+	for i := uint32(0); i < 64; i += esize {
+		mask |= elem << i
+	}
+	return mask
+}
+
+// signExtend extends the low width bits of v
+func signExtend(v uint32, width uint) int64 {
+	return int64(int32(v<<(32-width)) >> (32 - width))
+}
+
+// run executes from pc until exit
+func (m *a64Machine) run() {
+	for steps := 0; !m.exited; steps++ {
+		if steps > 50_000_000 {
+			m.t.Fatalf("no exit after %d instructions, pc %#x", steps, m.pc)
+		}
+		m.step()
+	}
+}
+
+func (m *a64Machine) step() {
+	le := binary.LittleEndian
+	i := le.Uint32(m.mem(m.pc, 4))
+	d, n, t2, mr := i&31, i>>5&31, i>>10&31, i>>16&31
+	next := m.pc + 4
+	switch {
+	case i&0x7c000000 == 0x14000000: // b, bl
+		if i>>31 == 1 {
+			m.x[30] = next
+		}
+		next = m.pc + uint64(signExtend(i&0x3ffffff, 26)*4)
+	case i&0xff000010 == 0x54000000: // b.cond
+		if m.cond(i & 15) {
+			next = m.pc + uint64(signExtend(i>>5&0x7ffff, 19)*4)
+		}
+	case i&0xfe000000 == 0xb4000000: // cbz, cbnz
+		if (m.reg(d) == 0) == (i&0x01000000 == 0) {
+			next = m.pc + uint64(signExtend(i>>5&0x7ffff, 19)*4)
+		}
+	case i == 0xd65f03c0: // ret
+		next = m.x[30]
+	case i == 0xd4000001: // svc #0
+		m.syscall()
+	case i&0xff800000 == 0xd2800000: // movz
+		m.setReg(d, uint64(i>>5&0xffff)<<(16*(i>>21&3)))
+	case i&0xff800000 == 0x92800000: // movn
+		m.setReg(d, ^(uint64(i>>5&0xffff) << (16 * (i >> 21 & 3))))
+	case i&0xff800000 == 0xf2800000: // movk
+		shift := 16 * (i >> 21 & 3)
+		m.setReg(d, m.reg(d)&^(0xffff<<shift)|uint64(i>>5&0xffff)<<shift)
+	case i&0xbf800000 == 0x91000000: // add, sub (immediate)
+		imm := uint64(i >> 10 & 0xfff)
+		if i&0x00400000 != 0 {
+			imm <<= 12
+		}
+		if i&0x40000000 != 0 {
+			imm = -imm
+		}
+		m.setRegSP(d, m.regSP(n)+imm)
+	case i&0xff800000 == 0xf1000000: // subs (immediate)
+		m.setReg(d, m.subs(m.regSP(n), uint64(i>>10&0xfff)))
+	case i&0xff200000 == 0x8b000000, i&0xff200000 == 0xcb000000, i&0xff200000 == 0xeb000000,
+		i&0xff200000 == 0x8a000000, i&0xff200000 == 0xaa000000, i&0xff200000 == 0xca000000: // shifted register
+		a, b := m.reg(n), shifted(m.reg(mr), i>>22&3, i>>10&63)
+		switch i >> 24 {
+		case 0x8b:
+			m.setReg(d, a+b)
+		case 0xcb:
+			m.setReg(d, a-b)
+		case 0xeb:
+			m.setReg(d, m.subs(a, b))
+		case 0x8a:
+			m.setReg(d, a&b)
+		case 0xaa:
+			m.setReg(d, a|b)
+		case 0xca:
+			m.setReg(d, a^b)
+		}
+	case i&0xff800000 == 0x92000000, i&0xff800000 == 0xb2000000: // and, orr (immediate)
+		imm := a64BitMask(i>>22&1, i>>16&63, i>>10&63)
+		if i>>24 == 0x92 {
+			m.setRegSP(d, m.reg(n)&imm)
+		} else {
+			m.setRegSP(d, m.reg(n)|imm)
+		}
+	case i&0xffc00000 == 0xd3400000: // ubfm (lsl, lsr)
+		immr, imms := i>>16&63, i>>10&63
+		src := m.reg(n)
+		if imms >= immr {
+			m.setReg(d, src>>immr&(uint64(1)<<(imms-immr+1)-1))
+		} else {
+			m.setReg(d, (src&(uint64(1)<<(imms+1)-1))<<(64-immr))
+		}
+	case i&0xffe08000 == 0x9b000000: // madd
+		m.setReg(d, m.reg(t2)+m.reg(n)*m.reg(mr))
+	case i&0xfffffc00 == 0xdac00000: // rbit
+		m.setReg(d, bits.Reverse64(m.reg(n)))
+	case i&0xfffffc00 == 0xdac01000: // clz
+		m.setReg(d, uint64(bits.LeadingZeros64(m.reg(n))))
+	case i&0xffc00000 == 0xf9400000: // ldr x
+		m.setReg(d, le.Uint64(m.mem(m.regSP(n)+uint64(i>>10&0xfff)*8, 8)))
+	case i&0xffc00000 == 0xf9000000: // str x
+		le.PutUint64(m.mem(m.regSP(n)+uint64(i>>10&0xfff)*8, 8), m.reg(d))
+	case i&0xffc00000 == 0x39400000: // ldrb (immediate)
+		m.setReg(d, uint64(m.mem(m.regSP(n)+uint64(i>>10&0xfff), 1)[0]))
+	case i&0xffc00000 == 0x39000000: // strb (immediate)
+		m.mem(m.regSP(n)+uint64(i>>10&0xfff), 1)[0] = byte(m.reg(d))
+	case i&0xffe0fc00 == 0x38606800: // ldrb (register)
+		m.setReg(d, uint64(m.mem(m.regSP(n)+m.reg(mr), 1)[0]))
+	case i&0xffe0fc00 == 0x38206800: // strb (register)
+		m.mem(m.regSP(n)+m.reg(mr), 1)[0] = byte(m.reg(d))
+	case i&0xffc00000 == 0x3dc00000: // ldr q
+		copy(m.v[d][:], m.mem(m.regSP(n)+uint64(i>>10&0xfff)*16, 16))
+	case i&0xfe400000 == 0xa8400000, i&0xfe400000 == 0xa8000000: // ldp, stp
+		offset := uint64(signExtend(i>>15&0x7f, 7) * 8)
+		addr := m.regSP(n)
+		mode := i >> 23 & 3 // 1 post-index, 2 offset, 3 pre-index
+		if mode != 1 {
+			addr += offset
+		}
+		if i&0x00400000 != 0 {
+			m.setReg(d, le.Uint64(m.mem(addr, 8)))
+			m.setReg(t2, le.Uint64(m.mem(addr+8, 8)))
+		} else {
+			le.PutUint64(m.mem(addr, 8), m.reg(d))
+			le.PutUint64(m.mem(addr+8, 8), m.reg(t2))
+		}
+		switch mode {
+		case 1:
+			m.setRegSP(n, addr+offset)
+		case 3:
+			m.setRegSP(n, addr)
+		}
+	case i&0xfffffc00 == 0x4e010c00: // dup vd.16b, wn
+		for b := range m.v[d] {
+			m.v[d][b] = byte(m.reg(n))
+		}
+	case i&0xffe0fc00 == 0x6e208c00, i&0xfffffc00 == 0x4e209800: // cmeq .16b (register, zero)
+		var other [16]byte
+		if i>>24 == 0x6e {
+			other = m.v[mr]
+		}
+		var r [16]byte
+		for b := range r {
+			if m.v[n][b] == other[b] {
+				r[b] = 0xff
+			}
+		}
+		m.v[d] = r
+	case i&0xfffffc00 == 0x0f0c8400: // shrn vd.8b, vn.8h, #4
+		var r [16]byte
+		for h := range 8 {
+			r[h] = byte(le.Uint16(m.v[n][2*h:]) >> 4)
+		}
+		m.v[d] = r
+	case i&0xfffffc00 == 0x9e660000: // fmov xd, dn
+		m.setReg(d, le.Uint64(m.v[n][:8]))
+	case i&0xfffffc00 == 0x9e670000: // fmov dd, xn
+		m.v[d] = [16]byte{}
+		le.PutUint64(m.v[d][:8], m.reg(n))
+	default:
+		m.t.Fatalf("unsupported instruction %#08x at %#x", i, m.pc)
+	}
+	m.pc = next
+}
+
+// subs returns a - b and sets the flags
+func (m *a64Machine) subs(a, b uint64) uint64 {
+	r := a - b
+	m.n, m.z, m.c = int64(r) < 0, r == 0, a >= b
+	m.vf = int64((a^b)&(a^r)) < 0
+	return r
+}
+
+func (m *a64Machine) syscall() {
+	const page = 4096
+	switch m.x[8] {
+	case 222: // mmap
+		size := (m.x[1] + page - 1) &^ (page - 1)
+		addr := m.heap
+		m.heap += size
+		clear(m.mem(addr, size))
+		m.live[addr] = size
+		m.x[0] = addr
+	case 215: // munmap
+		size := (m.x[1] + page - 1) &^ (page - 1)
+		if m.live[m.x[0]] != size {
+			m.t.Fatalf("munmap(%#x, %d) of memory that was not mapped with that size", m.x[0], m.x[1])
+		}
+		delete(m.live, m.x[0])
+		for b := range m.mem(m.x[0], size) {
+			m.mem(m.x[0], size)[b] = 0xaa // catch reads after the free
+		}
+		m.x[0] = 0
+	case 64: // write
+		m.out = append(m.out, m.mem(m.x[1], m.x[2])...)
+		m.x[0] = m.x[2]
+	case 93: // exit
+		m.exited = true
+	default:
+		m.t.Fatalf("unsupported syscall %d", m.x[8])
+	}
+}
+
+// runARM64MapOps is runMapOps for the ARM64 runtime, run by a64Machine
+func runARM64MapOps(t *testing.T, ops []mapOp) ([]uint64, []byte) {
+	t.Helper()
+	eb, err := NewWithPlatform(Platform{OS: OSLinux, Arch: ArchARM64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acg := NewARM64CodeGen(eb, nil)
+	movImm64 := func(reg string, imm uint64) {
+		if err := acg.out.MovImm64(reg, imm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call := func(name string) {
+		if err := eb.GenerateCallInstruction(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syscall := func(number uint16) {
+		acg.a64MovImm(a64X8, number)
+		acg.out.encodeInstr(0xd4000001) // svc #0
+	}
+
+	// x19 points at the table pointer, which the results follow
+	acg.a64MovReg(a64X0, a64XZR)
+	movImm64("x1", uint64(16+8*len(ops)))
+	acg.a64MovImm(a64X2, 3)
+	acg.a64MovImm(a64X3, 0x22)
+	acg.out.encodeInstr(0x92800004) // mov x4, #-1
+	acg.a64MovReg(a64X5, a64XZR)
+	syscall(222)
+	acg.a64MovReg(a64X19, a64X0)
+	for i, op := range ops {
+		result := 16 + 8*i
+		switch op.kind {
+		case 's':
+			acg.a64MovReg(a64X0, a64X19)
+			movImm64("x1", op.key)
+			movImm64("x9", math.Float64bits(op.value))
+			acg.out.encodeInstr(0x9e670000 | a64X9<<5) // fmov d0, x9
+			call("_vibe67_map_set")
+			acg.a64Str(a64XZR, a64X19, result)
+		case 'g':
+			acg.a64Ldr(a64X0, a64X19, 0)
+			movImm64("x1", op.key)
+			call("_vibe67_map_find")
+			movImm64("x9", mapMissing)
+			missing := acg.syncBranchForward(a64CBZ | a64X0)
+			acg.a64Ldr(a64X9, a64X0, 0)
+			acg.syncPatchHere(missing)
+			acg.a64Str(a64X9, a64X19, result)
+		case 'd':
+			acg.a64Ldr(a64X0, a64X19, 0)
+			movImm64("x1", op.key)
+			call("_vibe67_map_delete")
+			acg.a64Str(a64X0, a64X19, result)
+		}
+	}
+
+	// write(1, results), write(1, table), exit(0)
+	acg.a64MovImm(a64X0, 1)
+	acg.a64AddImm(a64X1, a64X19, 16)
+	movImm64("x2", uint64(8*len(ops)))
+	syscall(64)
+	acg.a64Ldr(a64X1, a64X19, 0)
+	noTable := acg.syncBranchForward(a64CBZ | a64X1)
+	acg.a64Ldr(a64X9, a64X1, 8)
+	acg.a64MapTableSize(a64X2, a64X9)
+	acg.a64MovImm(a64X0, 1)
+	syscall(64)
+	acg.syncPatchHere(noTable)
+	acg.a64MovImm(a64X0, 0)
+	syscall(93)
+
+	if err := acg.generateMapRuntime(); err != nil {
+		t.Fatal(err)
+	}
+	eb.PatchCallSites(a64CodeBase)
+
+	m := newA64Machine(t, eb.text.Bytes())
+	m.run()
+	if len(m.out) < 8*len(ops) {
+		t.Fatalf("got %d bytes of output for %d operations", len(m.out), len(ops))
+	}
+	results := make([]uint64, len(ops))
+	for i := range results {
+		results[i] = binary.LittleEndian.Uint64(m.out[8*i:])
+	}
+	return results, m.out[8*len(ops):]
+}
@@ -0,0 +1,550 @@
+// Completion: 85% - Runtime complete, loop jumps out of lock blocks pending ARM64 loop jump support
+package main
+
+// arm64_sync.go - ARM64 implementation of the sync primitives (see sync.go)
+//
+// Atomic updates use LDAXR/STLXR retry loops so that no ARMv8.1 LSE instructions
+// are required. The runtime functions take their arguments in x0/x1, return in x0
+// and only clobber the caller-saved registers x0-x15, like any libc call.
+
+// ARM64 register numbers used by the sync runtime
+const (
+	a64X0  = 0
+	a64X1  = 1
+	a64X2  = 2
+	a64X3  = 3
+	a64X4  = 4
+	a64X5  = 5
+	a64X7  = 7  // queue value
+	a64X8  = 8  // syscall number
+	a64X9  = 9  // mutex address
+	a64X10 = 10 // scratch
+	a64X11 = 11 // scratch
+	a64X12 = 12 // exclusive store status
+	a64X13 = 13 // condvar address
+	a64X14 = 14 // condvar sequence
+	a64X15 = 15 // object pointer
+	a64XZR = 31
+)
+
+// compileSyncBuiltin compiles a call to one of the syncBuiltins
+func (acg *ARM64CodeGen) compileSyncBuiltin(call *CallExpr) error {
+	b := syncBuiltins[call.Function]
+	if err := checkSyncArgs(call, b); err != nil {
+		return err
+	}
+	acg.usesSync = true
+
+	// Evaluate arguments left to right, keeping the raw bits on the stack
+	for _, arg := range call.Args {
+		if err := acg.compileExpression(arg); err != nil {
+			return err
+		}
+		acg.out.encodeInstr(0xfc1f0fe0) // str d0, [sp, #-16]!
+	}
+	for i := len(call.Args) - 1; i >= 0; i-- {
+		acg.out.encodeInstr(0xf84107e0 | uint32(i)) // ldr xN, [sp], #16
+	}
+
+	if b.numericArg {
+		if len(call.Args) == 0 {
+			if err := acg.out.MovImm64("x0", 1); err != nil {
+				return err
+			}
+		} else {
+			acg.out.encodeInstr(0x9e670000) // fmov d0, x0
+			acg.out.encodeInstr(0x9e780000) // fcvtzs x0, d0
+		}
+	}
+	if b.allocSize > 0 {
+		if err := acg.out.MovImm64("x0", uint64(b.allocSize)); err != nil {
+			return err
+		}
+	}
+
+	if err := acg.eb.GenerateCallInstruction(b.symbol); err != nil {
+		return err
+	}
+
+	switch b.result {
+	case syncResultZero:
+		acg.out.encodeInstr(0x9e6703e0) // fmov d0, xzr
+	case syncResultNumber:
+		acg.out.encodeInstr(0x9e620000) // scvtf d0, x0
+	case syncResultPointer:
+		acg.out.encodeInstr(0x9e670000) // fmov d0, x0
+	}
+	return nil
+}
+
+// compileLockStmt compiles lock m { ... }
+func (acg *ARM64CodeGen) compileLockStmt(stmt *LockStmt) error {
+	if err := acg.compileSyncBuiltin(&CallExpr{Function: "mutex_lock", Args: []Expression{stmt.Mutex}}); err != nil {
+		return err
+	}
+	acg.heldLocks = append(acg.heldLocks, heldLock{mutex: stmt.Mutex, loopDepth: len(acg.activeLoops)})
+
+	acg.pushDeferScope()
+	for _, bodyStmt := range stmt.Body {
+		if err := acg.compileStatement(bodyStmt); err != nil {
+			return err
+		}
+	}
+	if err := acg.popDeferScope(); err != nil {
+		return err
+	}
+
+	acg.heldLocks = acg.heldLocks[:len(acg.heldLocks)-1]
+	return acg.compileSyncBuiltin(&CallExpr{Function: "mutex_unlock", Args: []Expression{stmt.Mutex}})
+}
+
+// releaseHeldLocks unlocks every held lock taken inside more than minLoopDepth
+// active loops, innermost first, preserving d0
+func (acg *ARM64CodeGen) releaseHeldLocks(minLoopDepth int) error {
+	if len(acg.heldLocks) == 0 {
+		return nil
+	}
+	acg.out.encodeInstr(0xfc1f0fe0) // str d0, [sp, #-16]!
+	for i := len(acg.heldLocks) - 1; i >= 0; i-- {
+		if acg.heldLocks[i].loopDepth > minLoopDepth {
+			call := &CallExpr{Function: "mutex_unlock", Args: []Expression{acg.heldLocks[i].mutex}}
+			if err := acg.compileSyncBuiltin(call); err != nil {
+				return err
+			}
+		}
+	}
+	acg.out.encodeInstr(0xfc4107e0) // ldr d0, [sp], #16
+	return nil
+}
+
+// syncPos returns the current text offset
+func (acg *ARM64CodeGen) syncPos() int {
+	return acg.eb.text.Len()
+}
+
+// syncBranchBack emits a B, B.cond, CBZ or CBNZ to an earlier position.
+// base is the instruction without its offset field.
+func (acg *ARM64CodeGen) syncBranchBack(base uint32, target int) {
+	acg.out.encodeInstr(syncBranchOffset(base, target-acg.syncPos()))
+}
+
+// syncBranchForward emits a branch with a zero offset and returns its position for syncPatchHere
+func (acg *ARM64CodeGen) syncBranchForward(base uint32) int {
+	pos := acg.syncPos()
+	acg.out.encodeInstr(base)
+	return pos
+}
+
+// syncPatchHere points the branch at pos to the current position
+func (acg *ARM64CodeGen) syncPatchHere(pos int) {
+	textBytes := acg.eb.text.Bytes()
+	instr := uint32(textBytes[pos]) | uint32(textBytes[pos+1])<<8 |
+		uint32(textBytes[pos+2])<<16 | uint32(textBytes[pos+3])<<24
+	instr = syncBranchOffset(instr, acg.syncPos()-pos)
+	textBytes[pos] = byte(instr)
+	textBytes[pos+1] = byte(instr >> 8)
+	textBytes[pos+2] = byte(instr >> 16)
+	textBytes[pos+3] = byte(instr >> 24)
+}
+
+// syncBranchOffset fills in the offset field of B (imm26) or B.cond/CBZ/CBNZ (imm19)
+func syncBranchOffset(instr uint32, offset int) uint32 {
+	imm := uint32(int32(offset) >> 2)
+	if instr&0xfc000000 == 0x14000000 {
+		return instr&0xfc000000 | imm&0x3ffffff
+	}
+	return instr&^(0x7ffff<<5) | (imm&0x7ffff)<<5
+}
+
+// Branch instruction templates (offset field zero)
+const (
+	a64B    = 0x14000000
+	a64BEQ  = 0x54000000
+	a64BNE  = 0x54000001
+	a64BHS  = 0x54000002
+	a64BLS  = 0x54000009
+	a64BGE  = 0x5400000a
+	a64BLT  = 0x5400000b
+	a64CBZ  = 0xb4000000 // | Xt
+	a64CBNZ = 0xb5000000 // | Xt
+	a64CBNW = 0x35000000 // cbnz Wt
+)
+
+func (acg *ARM64CodeGen) a64Ldaxr(t, n uint32) { acg.out.encodeInstr(0xc85ffc00 | n<<5 | t) }
+
+func (acg *ARM64CodeGen) a64Stlxr(s, t, n uint32) {
+	acg.out.encodeInstr(0xc800fc00 | s<<16 | n<<5 | t)
+}
+
+func (acg *ARM64CodeGen) a64Ldr(t, n uint32, offset int) {
+	acg.out.encodeInstr(0xf9400000 | uint32(offset/8)<<10 | n<<5 | t)
+}
+
+func (acg *ARM64CodeGen) a64Str(t, n uint32, offset int) {
+	acg.out.encodeInstr(0xf9000000 | uint32(offset/8)<<10 | n<<5 | t)
+}
+
+func (acg *ARM64CodeGen) a64AddImm(d, n uint32, imm int) {
+	if imm < 0 {
+		acg.out.encodeInstr(0xd1000000 | uint32(-imm)<<10 | n<<5 | d) // sub
+		return
+	}
+	acg.out.encodeInstr(0x91000000 | uint32(imm)<<10 | n<<5 | d)
+}
+
+func (acg *ARM64CodeGen) a64MovImm(d uint32, imm uint16) {
+	acg.out.encodeInstr(0xd2800000 | uint32(imm)<<5 | d) // movz
+}
+
+func (acg *ARM64CodeGen) a64MovReg(d, m uint32) {
+	acg.out.encodeInstr(0xaa0003e0 | m<<16 | d) // orr xd, xzr, xm
+}
+
+func (acg *ARM64CodeGen) a64CmpReg(n, m uint32) {
+	acg.out.encodeInstr(0xeb00001f | m<<16 | n<<5) // subs xzr, xn, xm
+}
+
+func (acg *ARM64CodeGen) a64CmpImm(n uint32, imm int) {
+	acg.out.encodeInstr(0xf100001f | uint32(imm)<<10 | n<<5) // subs xzr, xn, #imm
+}
+
+// a64Futex emits futex(addr, op, val) on Linux, or YIELD elsewhere
+// op is futexWait (val taken from register valReg) or futexWake (count)
+func (acg *ARM64CodeGen) a64Futex(addr uint32, op int, valReg uint32, count int) {
+	if acg.eb.target.OS() != OSLinux {
+		if op == futexWait {
+			acg.out.encodeInstr(0xd503203f) // yield
+		}
+		return
+	}
+	acg.a64MovReg(a64X0, addr)
+	acg.a64MovImm(a64X1, uint16(op))
+	if op == futexWait {
+		acg.a64MovReg(a64X2, valReg)
+	} else if count == futexWakeAll {
+		acg.out.encodeInstr(0x12b00002) // mov w2, #0x7fffffff
+	} else {
+		acg.a64MovImm(a64X2, uint16(count))
+	}
+	acg.a64MovReg(a64X3, a64XZR) // no timeout
+	acg.a64MovImm(a64X8, 98)     // sys_futex
+	acg.out.encodeInstr(0xd4000001)
+}
+
+// a64AtomicAdd adds delta to [addr] and leaves the old value in x10
+func (acg *ARM64CodeGen) a64AtomicAdd(addr uint32, delta int) {
+	retry := acg.syncPos()
+	acg.a64Ldaxr(a64X10, addr)
+	acg.a64AddImm(a64X11, a64X10, delta)
+	acg.a64Stlxr(a64X12, a64X11, addr)
+	acg.syncBranchBack(a64CBNW|a64X12, retry)
+}
+
+// a64Swap stores the value of register src to [addr] and leaves the old value in x10
+func (acg *ARM64CodeGen) a64Swap(addr, src uint32) {
+	retry := acg.syncPos()
+	acg.a64Ldaxr(a64X10, addr)
+	acg.a64Stlxr(a64X12, src, addr)
+	acg.syncBranchBack(a64CBNW|a64X12, retry)
+}
+
+// a64MutexAcquire locks the mutex whose address is in x9 (see emitMutexAcquire)
+func (acg *ARM64CodeGen) a64MutexAcquire(contended bool) {
+	var fastDone int
+	slow := -1
+	if !contended {
+		retry := acg.syncPos()
+		acg.a64Ldaxr(a64X10, a64X9)
+		slow = acg.syncBranchForward(a64CBNZ | a64X10)
+		acg.a64MovImm(a64X11, 1)
+		acg.a64Stlxr(a64X12, a64X11, a64X9)
+		acg.syncBranchBack(a64CBNW|a64X12, retry)
+		fastDone = acg.syncBranchForward(a64B)
+		acg.syncPatchHere(slow)
+		acg.out.encodeInstr(0xd5033f5f) // clrex
+	}
+	loop := acg.syncPos()
+	acg.a64MovImm(a64X11, 2)
+	acg.a64Swap(a64X9, a64X11)
+	done := acg.syncBranchForward(a64CBZ | a64X10)
+	acg.a64Futex(a64X9, futexWait, a64X11, 0)
+	acg.syncBranchBack(a64B, loop)
+	acg.syncPatchHere(done)
+	if !contended {
+		acg.syncPatchHere(fastDone)
+	}
+}
+
+// a64MutexRelease unlocks the mutex whose address is in x9
+func (acg *ARM64CodeGen) a64MutexRelease() {
+	acg.a64Swap(a64X9, a64XZR)
+	acg.a64CmpImm(a64X10, 2)
+	done := acg.syncBranchForward(a64BNE)
+	acg.a64Futex(a64X9, futexWake, 0, 1)
+	acg.syncPatchHere(done)
+}
+
+// a64CondvarWait waits on the condvar in x13 with the mutex in x9 held
+func (acg *ARM64CodeGen) a64CondvarWait() {
+	acg.a64Ldr(a64X14, a64X13, 0)
+	acg.a64MutexRelease()
+	acg.a64Futex(a64X13, futexWait, a64X14, 0)
+	acg.a64MutexAcquire(true)
+}
+
+// a64CondvarNotify wakes up to count waiters of the condvar in x13
+func (acg *ARM64CodeGen) a64CondvarNotify(count int) {
+	acg.a64AtomicAdd(a64X13, 1)
+	acg.a64Futex(a64X13, futexWake, 0, count)
+}
+
+// a64RWLockWait sleeps until the rwlock in x15 changes from the value in x10
+func (acg *ARM64CodeGen) a64RWLockWait() {
+	acg.out.encodeInstr(0xd5033f5f) // clrex
+	acg.a64MovReg(a64X14, a64X10)
+	acg.a64AddImm(a64X13, a64X15, rwlockWaitersOffset)
+	acg.a64AtomicAdd(a64X13, 1)
+	acg.a64Futex(a64X15, futexWait, a64X14, 0)
+	acg.a64AtomicAdd(a64X13, -1)
+}
+
+// a64RWLockWakeWaiters wakes all threads blocked on the rwlock in x15, if any
+func (acg *ARM64CodeGen) a64RWLockWakeWaiters() {
+	acg.a64Ldr(a64X10, a64X15, rwlockWaitersOffset)
+	done := acg.syncBranchForward(a64CBZ | a64X10)
+	acg.a64Futex(a64X15, futexWake, 0, futexWakeAll)
+	acg.syncPatchHere(done)
+}
+
+// a64QueueWrap reduces x10 modulo the capacity of the queue in x15
+func (acg *ARM64CodeGen) a64QueueWrap() {
+	acg.a64Ldr(a64X11, a64X15, queueCapOffset)
+	acg.out.encodeInstr(0x9ac00800 | a64X11<<16 | a64X10<<5 | a64X12)              // udiv x12, x10, x11
+	acg.out.encodeInstr(0x9b008000 | a64X11<<16 | a64X10<<10 | a64X12<<5 | a64X10) // msub x10, x12, x11, x10
+}
+
+// a64QueueSlot leaves the address of slots[x10 % capacity] of the queue in x15 in x10
+func (acg *ARM64CodeGen) a64QueueSlot() {
+	acg.a64QueueWrap()
+	acg.out.encodeInstr(0x8b000000 | a64X10<<16 | 3<<10 | a64X15<<5 | a64X10) // add x10, x15, x10, lsl #3
+	acg.a64AddImm(a64X10, a64X10, queueSlotsOffset)
+}
+
+// generateSyncRuntime emits the ARM64 sync runtime functions
+func (acg *ARM64CodeGen) generateSyncRuntime() error {
+	// _vibe67_sync_new(x0=size) -> x0 = zeroed memory with a stable address
+	acg.eb.MarkLabel("_vibe67_sync_new")
+	if acg.eb.target.OS() == OSLinux {
+		// mmap(NULL, size, PROT_READ|PROT_WRITE, MAP_SHARED|MAP_ANONYMOUS, -1, 0)
+		acg.a64MovReg(a64X1, a64X0)
+		acg.a64MovReg(a64X0, a64XZR)
+		acg.a64MovImm(a64X2, 3)
+		acg.a64MovImm(a64X3, mmapSharedAnonymous)
+		acg.out.encodeInstr(0x92800004) // mov x4, #-1
+		acg.a64MovReg(a64X5, a64XZR)
+		acg.a64MovImm(a64X8, 222) // sys_mmap
+		acg.out.encodeInstr(0xd4000001)
+	} else {
+		acg.out.encodeInstr(0xa9be7bfd) // stp x29, x30, [sp, #-32]!
+		acg.out.encodeInstr(0xf9000be0) // str x0, [sp, #16]
+		if err := acg.eb.GenerateCallInstruction("malloc"); err != nil {
+			return err
+		}
+		acg.out.encodeInstr(0xf9400be1) // ldr x1, [sp, #16]
+		acg.a64MovReg(a64X2, a64X0)
+		loop := acg.syncPos()
+		done := acg.syncBranchForward(a64CBZ | a64X1)
+		acg.out.encodeInstr(0xf800845f) // str xzr, [x2], #8
+		acg.a64AddImm(a64X1, a64X1, -8)
+		acg.syncBranchBack(a64B, loop)
+		acg.syncPatchHere(done)
+		acg.out.encodeInstr(0xa8c27bfd) // ldp x29, x30, [sp], #32
+	}
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_queue_new(x0=capacity) -> x0 = queue
+	acg.eb.MarkLabel("_vibe67_queue_new")
+	acg.out.encodeInstr(0xa9be7bfd) // stp x29, x30, [sp, #-32]!
+	acg.a64CmpImm(a64X0, 1)
+	capOK := acg.syncBranchForward(a64BGE)
+	acg.a64MovImm(a64X0, 1) // unbuffered channels get one slot
+	acg.syncPatchHere(capOK)
+	acg.out.encodeInstr(0xf9000be0) // str x0, [sp, #16]
+	acg.out.encodeInstr(0xd37df000) // lsl x0, x0, #3
+	acg.a64AddImm(a64X0, a64X0, queueSlotsOffset)
+	if err := acg.eb.GenerateCallInstruction("_vibe67_sync_new"); err != nil {
+		return err
+	}
+	acg.out.encodeInstr(0xf9400be1) // ldr x1, [sp, #16]
+	acg.a64Str(a64X1, a64X0, queueCapOffset)
+	acg.out.encodeInstr(0xa8c27bfd) // ldp x29, x30, [sp], #32
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_mutex_lock(x0=mutex)
+	acg.eb.MarkLabel("_vibe67_mutex_lock")
+	acg.a64MovReg(a64X9, a64X0)
+	acg.a64MutexAcquire(false)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_mutex_unlock(x0=mutex)
+	acg.eb.MarkLabel("_vibe67_mutex_unlock")
+	acg.a64MovReg(a64X9, a64X0)
+	acg.a64MutexRelease()
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_rwlock_rlock(x0=rwlock)
+	acg.eb.MarkLabel("_vibe67_rwlock_rlock")
+	acg.a64MovReg(a64X15, a64X0)
+	retry := acg.syncPos()
+	acg.a64Ldaxr(a64X10, a64X15)
+	acg.a64CmpImm(a64X10, 0)
+	wait := acg.syncBranchForward(a64BLT)
+	acg.a64AddImm(a64X11, a64X10, 1)
+	acg.a64Stlxr(a64X12, a64X11, a64X15)
+	acg.syncBranchBack(a64CBNW|a64X12, retry)
+	done := acg.syncBranchForward(a64B)
+	acg.syncPatchHere(wait)
+	acg.a64RWLockWait()
+	acg.syncBranchBack(a64B, retry)
+	acg.syncPatchHere(done)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_rwlock_runlock(x0=rwlock)
+	acg.eb.MarkLabel("_vibe67_rwlock_runlock")
+	acg.a64MovReg(a64X15, a64X0)
+	acg.a64AtomicAdd(a64X15, -1)
+	acg.a64CmpImm(a64X10, 1)
+	done = acg.syncBranchForward(a64BNE)
+	acg.a64RWLockWakeWaiters()
+	acg.syncPatchHere(done)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_rwlock_wlock(x0=rwlock)
+	acg.eb.MarkLabel("_vibe67_rwlock_wlock")
+	acg.a64MovReg(a64X15, a64X0)
+	retry = acg.syncPos()
+	acg.a64Ldaxr(a64X10, a64X15)
+	wait = acg.syncBranchForward(a64CBNZ | a64X10)
+	acg.out.encodeInstr(0x9280000b) // mov x11, #-1
+	acg.a64Stlxr(a64X12, a64X11, a64X15)
+	acg.syncBranchBack(a64CBNW|a64X12, retry)
+	done = acg.syncBranchForward(a64B)
+	acg.syncPatchHere(wait)
+	acg.a64RWLockWait()
+	acg.syncBranchBack(a64B, retry)
+	acg.syncPatchHere(done)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_rwlock_wunlock(x0=rwlock)
+	acg.eb.MarkLabel("_vibe67_rwlock_wunlock")
+	acg.a64MovReg(a64X15, a64X0)
+	acg.a64Swap(a64X15, a64XZR)
+	acg.a64RWLockWakeWaiters()
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_condvar_wait(x0=condvar, x1=mutex)
+	acg.eb.MarkLabel("_vibe67_condvar_wait")
+	acg.a64MovReg(a64X13, a64X0)
+	acg.a64MovReg(a64X9, a64X1)
+	acg.a64CondvarWait()
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_condvar_signal(x0=condvar)
+	acg.eb.MarkLabel("_vibe67_condvar_signal")
+	acg.a64MovReg(a64X13, a64X0)
+	acg.a64CondvarNotify(1)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_condvar_broadcast(x0=condvar)
+	acg.eb.MarkLabel("_vibe67_condvar_broadcast")
+	acg.a64MovReg(a64X13, a64X0)
+	acg.a64CondvarNotify(futexWakeAll)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_queue_push(x0=queue, x1=value) -> x0 = 1 if pushed, 0 if the queue is closed
+	acg.eb.MarkLabel("_vibe67_queue_push")
+	acg.a64MovReg(a64X15, a64X0)
+	acg.a64MovReg(a64X7, a64X1)
+	acg.a64AddImm(a64X9, a64X15, queueMutexOffset)
+	acg.a64MutexAcquire(false)
+	loop := acg.syncPos()
+	acg.a64Ldr(a64X10, a64X15, queueClosedOffset)
+	closed := acg.syncBranchForward(a64CBNZ | a64X10)
+	acg.a64Ldr(a64X10, a64X15, queueCountOffset)
+	acg.a64Ldr(a64X11, a64X15, queueCapOffset)
+	acg.a64CmpReg(a64X10, a64X11)
+	space := acg.syncBranchForward(a64BLT)
+	acg.a64AddImm(a64X13, a64X15, queueNotFullOffset)
+	acg.a64CondvarWait()
+	acg.syncBranchBack(a64B, loop)
+	acg.syncPatchHere(space)
+	acg.a64Ldr(a64X10, a64X15, queueHeadOffset)
+	acg.a64Ldr(a64X11, a64X15, queueCountOffset)
+	acg.out.encodeInstr(0x8b000000 | a64X11<<16 | a64X10<<5 | a64X10) // add x10, x10, x11
+	acg.a64QueueSlot()
+	acg.a64Str(a64X7, a64X10, 0)
+	acg.a64Ldr(a64X10, a64X15, queueCountOffset)
+	acg.a64AddImm(a64X10, a64X10, 1)
+	acg.a64Str(a64X10, a64X15, queueCountOffset)
+	acg.a64MutexRelease()
+	acg.a64AddImm(a64X13, a64X15, queueNotEmptyOffset)
+	acg.a64CondvarNotify(1)
+	acg.a64MovImm(a64X0, 1)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+	acg.syncPatchHere(closed)
+	acg.a64MutexRelease()
+	acg.a64MovImm(a64X0, 0)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_queue_pop(x0=queue) -> x0 = value, or the "cls" error NaN once closed and drained
+	acg.eb.MarkLabel("_vibe67_queue_pop")
+	acg.a64MovReg(a64X15, a64X0)
+	acg.a64AddImm(a64X9, a64X15, queueMutexOffset)
+	acg.a64MutexAcquire(false)
+	loop = acg.syncPos()
+	acg.a64Ldr(a64X10, a64X15, queueCountOffset)
+	item := acg.syncBranchForward(a64CBNZ | a64X10)
+	acg.a64Ldr(a64X10, a64X15, queueClosedOffset)
+	closed = acg.syncBranchForward(a64CBNZ | a64X10)
+	acg.a64AddImm(a64X13, a64X15, queueNotEmptyOffset)
+	acg.a64CondvarWait()
+	acg.syncBranchBack(a64B, loop)
+	acg.syncPatchHere(item)
+	acg.a64Ldr(a64X10, a64X15, queueHeadOffset)
+	acg.a64QueueSlot()
+	acg.a64Ldr(a64X7, a64X10, 0)
+	acg.a64Ldr(a64X10, a64X15, queueHeadOffset)
+	acg.a64AddImm(a64X10, a64X10, 1)
+	acg.a64QueueWrap()
+	acg.a64Str(a64X10, a64X15, queueHeadOffset)
+	acg.a64Ldr(a64X10, a64X15, queueCountOffset)
+	acg.a64AddImm(a64X10, a64X10, -1)
+	acg.a64Str(a64X10, a64X15, queueCountOffset)
+	acg.a64MutexRelease()
+	acg.a64AddImm(a64X13, a64X15, queueNotFullOffset)
+	acg.a64CondvarNotify(1)
+	acg.a64MovReg(a64X0, a64X7)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+	acg.syncPatchHere(closed)
+	acg.a64MutexRelease()
+	if err := acg.out.MovImm64("x0", queueClosedError); err != nil {
+		return err
+	}
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	// _vibe67_queue_close(x0=queue)
+	acg.eb.MarkLabel("_vibe67_queue_close")
+	acg.a64MovReg(a64X15, a64X0)
+	acg.a64AddImm(a64X9, a64X15, queueMutexOffset)
+	acg.a64MutexAcquire(false)
+	acg.a64MovImm(a64X10, 1)
+	acg.a64Str(a64X10, a64X15, queueClosedOffset)
+	acg.a64MutexRelease()
+	acg.a64AddImm(a64X13, a64X15, queueNotEmptyOffset)
+	acg.a64CondvarNotify(futexWakeAll)
+	acg.a64AddImm(a64X13, a64X15, queueNotFullOffset)
+	acg.a64CondvarNotify(futexWakeAll)
+	acg.out.encodeInstr(0xd65f03c0) // ret
+
+	return nil
+}
@@ -41,6 +41,7 @@ type AssignStmt struct {
 	IsReuseMutable bool        // true when = is used to update existing mutable variable
 	Precision      string      // Legacy type annotation: "b64", "f32", etc. (empty if none)
 	TypeAnnotation *Vibe67Type // Type annotation: num, str, cstring, cptr, etc. (nil if none)
+	IsHot          bool        // true for hot function definitions (called through the hot function table)
 }
 
 type MultipleAssignStmt struct {
@@ -71,6 +72,9 @@ func (a *AssignStmt) String() string {
 		op = ":="
 	}
 	result := a.Name
+	if a.IsHot {
+		result = "hot " + result
+	}
 	if a.Precision != "" {
 		result += ":" + a.Precision
 	}
@@ -131,6 +135,8 @@ type CImportStmt struct {
 	Library string // C library name: "sdl3", "raylib", "sqlite3", or .so filename: "libmylib.so"
 	Alias   string // Namespace alias: "sdl", "rl", "sql"
 	SoPath  string // Optional: full path to .so file for custom libraries (e.g., "/tmp/libmylib.so")
+
+	Prototypes map[string]*CFunctionSignature // set in modules from vibe67 bindgen, which need no headers
 }
 
 func (c *CImportStmt) String() string {
@@ -271,6 +277,7 @@ type LoopStmt struct {
 	Reducer       *LambdaExpr // Optional reduction lambda for parallel loops: | a,b | { a + b }
 	Vectorized    bool        // Whether this loop has been marked for SIMD vectorization
 	VectorWidth   int         // Elements per SIMD vector (e.g., 4 for AVX doubles, 8 for AVX floats)
+	ProfileKey    string      // Name of the loop's counters in profiles (see profile.go)
 }
 
 type WhileStmt struct {
@@ -555,6 +562,7 @@ type MatchExpr struct {
 	Clauses         []*MatchClause
 	DefaultExpr     Expression
 	DefaultExplicit bool
+	ProfileKey      string // Name of the match's counters in profiles (see profile.go)
 }
 
 func (m *MatchExpr) String() string {
@@ -1113,6 +1121,28 @@ type DeferStmt struct {
 func (d *DeferStmt) String() string { return "defer " + d.Call.String() }
 func (d *DeferStmt) statementNode() {}
 
+// LockStmt represents a mutex-guarded block: lock m { ... }
+// The mutex is released on every exit path (block end, ret, loop break/continue)
+type LockStmt struct {
+	Mutex Expression  // Mutex handle created with mutex()
+	Body  []Statement // Statements executed while the mutex is held
+}
+
+func (l *LockStmt) String() string {
+	var out strings.Builder
+	out.WriteString("lock ")
+	out.WriteString(l.Mutex.String())
+	out.WriteString(" {\n")
+	for _, stmt := range l.Body {
+		out.WriteString("  ")
+		out.WriteString(stmt.String())
+		out.WriteString("\n")
+	}
+	out.WriteString("}")
+	return out.String()
+}
+func (l *LockStmt) statementNode() {}
+
 // SpawnStmt represents a vibe67ped process: vibe67 expr [ | params | block ]
 // Creates a new process via fork() and optionally waits for result
 type SpawnStmt struct {
@@ -80,3 +80,89 @@ func (o *Out) lockXaddMemRegX86(base string, offset int, reg string) {
 		fmt.Fprintf(os.Stderr, "OK\n")
 	}
 }
+
+// XchgMemReg emits XCHG [base+offset], reg
+// XCHG with a memory operand is implicitly locked on x86
+// Result: reg gets old value from memory, memory gets reg
+func (o *Out) XchgMemReg(base string, offset int, reg string) {
+	switch o.target.Arch() {
+	case ArchX86_64:
+		if VerboseMode {
+			fmt.Fprintf(os.Stderr, "xchg [%s+%d], %s: ", base, offset, reg)
+		}
+		o.atomicMemRegX86(nil, []byte{0x87}, base, offset, reg)
+	case ArchARM64:
+		compilerError("XCHG not supported on ARM64 (use SWP or LDAXR/STLXR instead)")
+	case ArchRiscv64:
+		compilerError("XCHG not supported on RISC-V (use AMOSWAP instead)")
+	}
+}
+
+// LockCmpxchgMemReg emits LOCK CMPXCHG [base+offset], reg
+// If [base+offset] == rax, then [base+offset] := reg and ZF := 1
+// Otherwise, rax := [base+offset] and ZF := 0
+func (o *Out) LockCmpxchgMemReg(base string, offset int, reg string) {
+	switch o.target.Arch() {
+	case ArchX86_64:
+		if VerboseMode {
+			fmt.Fprintf(os.Stderr, "lock cmpxchg [%s+%d], %s: ", base, offset, reg)
+		}
+		o.atomicMemRegX86([]byte{0xF0}, []byte{0x0F, 0xB1}, base, offset, reg)
+	case ArchARM64:
+		compilerError("LOCK CMPXCHG not supported on ARM64 (use CAS or LDAXR/STLXR instead)")
+	case ArchRiscv64:
+		compilerError("LOCK CMPXCHG not supported on RISC-V (use LR/SC instead)")
+	}
+}
+
+// atomicMemRegX86 emits a 64-bit [prefix] REX.W opcode [base+offset], reg instruction
+func (o *Out) atomicMemRegX86(prefix, opcode []byte, base string, offset int, reg string) {
+	baseReg, _ := GetRegister(o.target.Arch(), base)
+	srcReg, _ := GetRegister(o.target.Arch(), reg)
+
+	for _, b := range prefix {
+		o.Write(b)
+	}
+
+	rex := uint8(0x48)
+	if baseReg.Encoding >= 8 {
+		rex |= 0x01
+	}
+	if srcReg.Encoding >= 8 {
+		rex |= 0x04
+	}
+	o.Write(rex)
+
+	for _, b := range opcode {
+		o.Write(b)
+	}
+
+	baseEncoding := baseReg.Encoding & 7
+	srcEncoding := srcReg.Encoding & 7
+
+	if offset == 0 && baseEncoding != 5 {
+		o.Write((srcEncoding << 3) | baseEncoding)
+		if baseEncoding == 4 {
+			o.Write(0x24)
+		}
+	} else if offset >= -128 && offset <= 127 {
+		o.Write(0x40 | (srcEncoding << 3) | baseEncoding)
+		if baseEncoding == 4 {
+			o.Write(0x24)
+		}
+		o.Write(uint8(int8(offset)))
+	} else {
+		o.Write(0x80 | (srcEncoding << 3) | baseEncoding)
+		if baseEncoding == 4 {
+			o.Write(0x24)
+		}
+		o.Write(uint8(offset))
+		o.Write(uint8(offset >> 8))
+		o.Write(uint8(offset >> 16))
+		o.Write(uint8(offset >> 24))
+	}
+
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "OK\n")
+	}
+}
@@ -7,6 +7,10 @@ type CodeGenerator interface {
 	MovRegToReg(dst, src string)
 	MovImmToReg(dst, imm string)
 	MovRegToXmm(dst, src string)
+	MovXmmToReg(dst, src string)
+	MovXmmToMem(src, base string, offset int32)
+	MovMemToXmm(dst, base string, offset int32)
+	LeaSymbolToReg(dst, symbol string)
 
 	// Arithmetic operations
 	AddRegToReg(dst, src string)
@@ -37,18 +41,19 @@ type CodeGenerator interface {
 	DivpdXmm(dst, src string)
 	Ucomisd(dst, src string)
 	Cvtsi2sd(dst, src string)
+	Cvttsd2si(dst, src string)
 
-	// System operations
+	// Calls and system operations
+	CallRelative(offset int32)
 	Ret()
 	Syscall()
 }
 
 // NewCodeGenerator creates a code generator backend for the given architecture
-// Returns nil for x86_64 since it uses legacy methods in Out
 func NewCodeGenerator(arch Arch, writer Writer, eb *ExecutableBuilder) CodeGenerator {
 	switch arch {
 	case ArchX86_64:
-		return nil // x86_64 uses legacy methods in mov.go, add.go, etc.
+		return NewX86_64Backend(writer, eb) // built on the methods in mov.go, add.go, etc.
 	case ArchARM64:
 		return NewARM64Backend(writer, eb)
 	case ArchRiscv64:
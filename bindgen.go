@@ -0,0 +1,635 @@
+// Completion: 80% - vibe67 bindgen: C headers and libraries to checked-in modules
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// bindgen.go - generates vibe67 modules that bind C libraries
+//
+// `vibe67 bindgen zlib` (a pkg-config name) or `vibe67 bindgen foo.h
+// libfoo.so` writes a module with the library's constants, its structs as
+// cstructs, and one wrapper per function that casts every argument and
+// the result to its C type:
+//
+//	// int deflateEnd(z_streamp strm)
+//	deflateEnd = (strm) -> { ret c_z.deflateEnd(strm as cptr) as int32 }
+//
+// Functions returning pointers give an error value instead of NULL, so
+// callers can write `stream = gzopen(path, "rb") or! { ... }`.
+//
+// The module is meant to be checked in. When it is imported, the compiler
+// reads the C prototypes back from the casts (addBindingPrototypes)
+// instead of parsing the library's headers, so a build neither depends on
+// the headers installed nor pays for parsing them.
+
+// bindgenMarker starts the first line of every generated module
+const bindgenMarker = "// Code generated by vibe67 bindgen"
+
+// vibe67Keywords are the words the lexer reserves, which C names can collide with
+var vibe67Keywords = map[string]bool{
+	"in": true, "and": true, "or": true, "not": true, "ret": true, "err": true,
+	"fun": true, "break": true, "continue": true, "foreach": true, "malloc": true,
+	"free": true, "val": true, "use": true, "import": true, "export": true,
+	"as": true, "unsafe": true, "syscall": true, "arena": true, "defer": true,
+	"lock": true, "max": true, "inf": true, "cstruct": true, "packed": true,
+	"aligned": true, "alias": true, "spawn": true, "has": true, "class": true,
+	"shadow": true, "hot": true, "yes": true, "no": true, "bool": true, "xor": true,
+}
+
+var (
+	cIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	cWord       = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+)
+
+// cmdBindgen generates bindings for a library or header
+func cmdBindgen(ctx *CommandContext, args []string) error {
+	usage := fmt.Errorf("usage: vibe67 bindgen <library|header.h> [shared library] [-o output.v67]")
+	var inputs []string
+	outputPath := ctx.OutputPath
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-o" && i+1 < len(args) {
+			outputPath = args[i+1]
+			i++
+		} else if strings.HasPrefix(args[i], "-") {
+			return usage
+		} else {
+			inputs = append(inputs, args[i])
+		}
+	}
+	if len(inputs) == 0 || len(inputs) > 2 {
+		return usage
+	}
+
+	// A header path, or a pkg-config name that leads to one
+	cm := NewCFFIManager()
+	source := inputs[0]
+	header, libName, soPath := source, "", ""
+	var includes []string
+	if _, err := os.Stat(source); err != nil || !strings.HasSuffix(source, ".h") {
+		includes, err = getPkgConfigIncludes(source)
+		if err != nil {
+			return fmt.Errorf("%s is neither a header nor a pkg-config package: %v", source, err)
+		}
+		includes = cIncludePaths(includes...)
+		header = findMainHeader(source, includes)
+		if header == "" {
+			return fmt.Errorf("no header found for %s in %s", source, strings.Join(includes, ", "))
+		}
+		libName = source
+		soPath = pkgConfigLibrary(source)
+	} else {
+		libName = strings.TrimSuffix(filepath.Base(source), ".h")
+		includes = cIncludePaths(filepath.Dir(header))
+	}
+	if len(inputs) == 2 {
+		soPath = inputs[1]
+	}
+
+	// The library's own headers give the #define constants and the names
+	// that belong to it. The preprocessed header, if a C preprocessor is
+	// installed, gives the declarations that macros hide from the parser
+	// (ZEXTERN int ZEXPORT deflate OF((z_streamp strm, int flush))).
+	declared := make(map[string]bool)
+	for _, path := range bindgenHeaders(header) {
+		if err := cm.ParseHeader(path); err != nil {
+			return err
+		}
+		if content, err := os.ReadFile(path); err == nil {
+			for _, word := range cWord.FindAllString(string(content), -1) {
+				declared[word] = true
+			}
+		}
+	}
+	if preprocessed, err := preprocessHeader(header, includes); err == nil {
+		err = cm.ParseHeader(preprocessed)
+		os.Remove(preprocessed)
+		if err != nil {
+			return err
+		}
+	} else if ctx.Verbose {
+		fmt.Fprintf(os.Stderr, "Not preprocessing %s: %v\n", header, err)
+	}
+
+	// With the library, only what it exports is bound
+	soName := "lib" + strings.TrimPrefix(libName, "lib") + ".so"
+	functions := cm.GetAllFunctions()
+	if soPath != "" {
+		if err := cm.ParseSharedObjectExports(libName, soPath); err != nil {
+			return err
+		}
+		functions = make(map[string]*CFunction)
+		for _, fn := range cm.GetLibraryFunctions(libName) {
+			functions[fn.Name] = fn
+		}
+		soName = sharedObjectName(soPath)
+	}
+
+	module := generateBindings(cm, filepath.Base(header), soName, functions, declared)
+	if outputPath == "" {
+		_, err := os.Stdout.Write(module)
+		return err
+	}
+	if err := os.WriteFile(outputPath, module, 0644); err != nil {
+		return err
+	}
+	if !ctx.Quiet {
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", outputPath)
+	}
+	return nil
+}
+
+// bindgenHeaders lists a header and the headers it includes from its own
+// directory. A header directly in a system include directory only brings
+// along the ones it includes with quotes, not the rest of libc.
+func bindgenHeaders(header string) []string {
+	dir := filepath.Dir(header)
+	system := false
+	for _, path := range cIncludePaths("/usr/include", "/usr/local/include") {
+		if filepath.Clean(path) == filepath.Clean(dir) {
+			system = true
+		}
+	}
+
+	include := regexp.MustCompile(`^\s*#\s*include\s+([<"])([^>"]+)[>"]`)
+	var headers []string
+	seen := make(map[string]bool)
+	var visit func(path string)
+	visit = func(path string) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		headers = append(headers, path)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			m := include.FindStringSubmatch(line)
+			if m == nil || (system && m[1] == "<") {
+				continue
+			}
+			for _, base := range []string{filepath.Dir(path), dir, filepath.Dir(dir)} {
+				candidate := filepath.Join(base, m[2])
+				if rel, err := filepath.Rel(dir, candidate); err != nil || strings.HasPrefix(rel, "..") {
+					continue // outside the library's directory
+				}
+				if _, err := os.Stat(candidate); err == nil {
+					visit(candidate)
+					break
+				}
+			}
+		}
+	}
+	visit(header)
+	return headers
+}
+
+// preprocessHeader runs the C preprocessor over a header, into a
+// temporary file the caller removes
+func preprocessHeader(header string, includes []string) (string, error) {
+	cpp, err := exec.LookPath("cpp")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"-P"}
+	for _, dir := range includes {
+		args = append(args, "-I"+dir)
+	}
+	output, err := exec.Command(cpp, append(args, header)...).Output()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "vibe67-bindgen-*.h")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(output); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// pkgConfigLibrary finds the shared library of a pkg-config package
+func pkgConfigLibrary(pkgName string) string {
+	output, err := exec.Command("pkg-config", "--libs", pkgName).Output()
+	if err != nil {
+		return ""
+	}
+	var dirs []string
+	soName := ""
+	for _, flag := range strings.Fields(string(output)) {
+		if strings.HasPrefix(flag, "-L") {
+			dirs = append(dirs, strings.TrimPrefix(flag, "-L"))
+		} else if strings.HasPrefix(flag, "-l") && soName == "" {
+			soName = "lib" + strings.TrimPrefix(flag, "-l") + ".so"
+		}
+	}
+	if soName == "" {
+		return ""
+	}
+	for _, dir := range dirs {
+		if path := filepath.Join(dir, soName); fileExists(path) {
+			return path
+		}
+	}
+
+	// The linker cache also has libraries without a development symlink
+	if ldOutput, err := exec.Command("ldconfig", "-p").Output(); err == nil {
+		for _, line := range strings.Split(string(ldOutput), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && strings.HasPrefix(fields[0], soName) {
+				if _, path, ok := strings.Cut(line, "=>"); ok {
+					return strings.TrimSpace(path)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// sharedObjectName is the name a program should load a library by: its
+// DT_SONAME (libz.so.1), or else its file name
+func sharedObjectName(path string) string {
+	if f, err := elf.Open(path); err == nil {
+		defer f.Close()
+		if names, err := f.DynString(elf.DT_SONAME); err == nil && len(names) > 0 {
+			return names[0]
+		}
+	}
+	return filepath.Base(path)
+}
+
+// bindgen turns parsed C declarations into vibe67 source
+type bindgen struct {
+	header   *CHeaderConstants
+	layout   *cLayout
+	alias    string
+	declared map[string]bool     // the words of the library's headers
+	structs  map[*CRecord]string // records emitted as cstructs
+}
+
+// generateBindings writes the module for the functions of a library,
+// sorted by name so that regenerating it gives a readable diff. Only
+// names that occur in the library's headers are bound, which leaves out
+// what the preprocessor brought in from libc.
+func generateBindings(cm *CFFIManager, source, soName string, functions map[string]*CFunction, declared map[string]bool) []byte {
+	name := strings.TrimPrefix(soName, "lib")
+	if i := strings.Index(name, ".so"); i > 0 {
+		name = name[:i]
+	}
+	name = regexp.MustCompile(`[^A-Za-z0-9_]`).ReplaceAllString(name, "_")
+	g := &bindgen{
+		header:   cm.headerConstants,
+		layout:   &cLayout{header: cm.headerConstants, active: make(map[*CRecord]bool), fullArrays: true},
+		alias:    "c_" + name,
+		declared: declared,
+		structs:  make(map[*CRecord]string),
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s from %s; DO NOT EDIT.\n\n", bindgenMarker, source)
+	fmt.Fprintf(&b, "export *\nimport %q as %s\n", soName, g.alias)
+
+	var constants []string
+	for name := range g.header.Constants {
+		if bindable(name) && g.declared[name] {
+			constants = append(constants, name)
+		}
+	}
+	sort.Strings(constants)
+	if len(constants) > 0 {
+		b.WriteString("\n// Constants\n\n")
+		for _, name := range constants {
+			fmt.Fprintf(&b, "%s = %d\n", name, g.header.Constants[name])
+		}
+	}
+
+	if structs := g.generateStructs(); structs != "" {
+		b.WriteString("\n// Structs\n")
+		b.WriteString(structs)
+	}
+
+	var names []string
+	for name := range functions {
+		if !strings.HasPrefix(name, "_") && g.declared[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		b.WriteString("\n// Functions\n")
+		for _, name := range names {
+			b.WriteString("\n")
+			b.WriteString(g.generateFunction(functions[name]))
+		}
+	}
+	return b.Bytes()
+}
+
+// bindable reports whether a C name can be used as a vibe67 name
+func bindable(name string) bool {
+	return cIdentifier.MatchString(name) && !strings.HasPrefix(name, "_") && !vibe67Keywords[name]
+}
+
+// generateStructs declares a cstruct for every struct the headers define,
+// under its typedef name if it has one. Unions, bitfields and other
+// layouts that cstruct fields cannot reproduce are only noted.
+func (g *bindgen) generateStructs() string {
+	type candidate struct {
+		name string
+		ref  CTypeRef
+	}
+	var candidates []candidate
+	for name, ref := range g.header.Typedefs {
+		if ref.Pointers == 0 && len(ref.Array) == 0 && g.layout.isRecord(ref) {
+			candidates = append(candidates, candidate{name, ref})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].name < candidates[j].name })
+	var tags []string
+	for key := range g.header.Records {
+		tags = append(tags, key)
+	}
+	sort.Strings(tags)
+	for _, key := range tags {
+		candidates = append(candidates, candidate{key[strings.Index(key, " ")+1:], CTypeRef{Name: key}})
+	}
+
+	var b strings.Builder
+	for _, c := range candidates {
+		record := g.record(c.ref)
+		if record == nil || !bindable(c.name) || !g.declared[c.name] {
+			continue
+		}
+		if _, done := g.structs[record]; done {
+			continue // the tag of a typedef'd struct
+		}
+		decl, err := g.layout.layoutStruct(c.name, c.ref)
+		if err != nil {
+			fmt.Fprintf(&b, "\n// %s: %v\n", c.name, err)
+			g.structs[record] = ""
+			continue
+		}
+		text, ok := cstructSource(decl, record.Packed)
+		if !ok {
+			kind := "struct"
+			if record.Union {
+				kind = "union"
+			}
+			fmt.Fprintf(&b, "\n// %s is a %s of %d bytes that no cstruct can lay out\n", c.name, kind, decl.Size)
+			g.structs[record] = ""
+			continue
+		}
+		b.WriteString("\n" + text)
+		g.structs[record] = c.name
+	}
+	return b.String()
+}
+
+// record returns the struct or union body a type names, through typedefs
+func (g *bindgen) record(ref CTypeRef) *CRecord {
+	for depth := 0; depth < 32; depth++ {
+		if ref.Pointers > 0 || len(ref.Array) > 0 {
+			return nil
+		}
+		if ref.Record != nil {
+			return ref.Record
+		}
+		if record, ok := g.header.Records[ref.Name]; ok {
+			return record
+		}
+		next, ok := g.header.Typedefs[ref.Name]
+		if !ok {
+			return nil
+		}
+		ref = next
+	}
+	return nil
+}
+
+// cstructSource writes a cstruct declaration with the flattened fields of
+// decl, if the cstruct lays them out at the same offsets
+func cstructSource(decl *CStructDecl, packed bool) (string, bool) {
+	check := &CStructDecl{Name: decl.Name, Packed: packed}
+	seen := make(map[string]bool)
+	for _, f := range decl.Fields {
+		name := strings.ReplaceAll(f.Name, ".", "_")
+		if vibe67Keywords[name] {
+			name += "_"
+		}
+		if seen[name] || !cIdentifier.MatchString(name) {
+			return "", false
+		}
+		seen[name] = true
+		check.Fields = append(check.Fields, CStructField{Name: name, Type: f.Type})
+	}
+	check.CalculateStructLayout()
+	if check.Size != decl.Size {
+		return "", false
+	}
+	for i, f := range check.Fields {
+		if f.Offset != decl.Fields[i].Offset {
+			return "", false
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("cstruct " + decl.Name)
+	if packed {
+		b.WriteString(" packed")
+	}
+	b.WriteString(" {\n")
+	for i, f := range check.Fields {
+		b.WriteString("    " + f.Name + " as " + f.Type)
+		if i < len(check.Fields)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("}\n")
+	return b.String(), true
+}
+
+// generateFunction writes the wrapper of a C function, or a comment on
+// why there is none
+func (g *bindgen) generateFunction(fn *CFunction) string {
+	var params []string
+	for _, p := range fn.Params {
+		params = append(params, strings.TrimSpace(strings.ReplaceAll(p.Type, " *", "*")+" "+p.Name))
+	}
+	if fn.Variadic {
+		params = append(params, "...")
+	}
+	prototype := fmt.Sprintf("%s %s(%s)", strings.ReplaceAll(fn.ReturnType, " *", "*"), fn.Name, strings.Join(params, ", "))
+	skip := func(reason string) string {
+		return fmt.Sprintf("// %s\n// skipped: %s\n", prototype, reason)
+	}
+
+	switch {
+	case !bindable(fn.Name):
+		return skip("the name is reserved in vibe67")
+	case fn.Variadic:
+		return skip("variadic, call " + g.alias + "." + fn.Name + " directly")
+	case len(fn.Params) > 6:
+		return skip("vibe67 functions take at most 6 parameters")
+	}
+
+	result, ok := g.cast(fn.ReturnType)
+	if !ok {
+		return skip("unsupported return type " + fn.ReturnType)
+	}
+	if result == "cstr" {
+		result = "cptr" // a returned string stays a C pointer
+	}
+	var names, args []string
+	taken := map[string]bool{g.alias: true, "error": true, fn.Name: true}
+	for i, p := range fn.Params {
+		cast, ok := g.cast(p.Type)
+		if !ok || cast == "" {
+			return skip("unsupported parameter type " + p.Type)
+		}
+		name := p.Name
+		if !bindable(name) || taken[name] {
+			name = fmt.Sprintf("arg%d", i)
+		}
+		taken[name] = true
+		names = append(names, name)
+		args = append(args, name+" as "+cast)
+	}
+
+	call := fmt.Sprintf("%s.%s(%s)", g.alias, fn.Name, strings.Join(args, ", "))
+	var body string
+	switch {
+	case result == "":
+		body = call
+	case result == "cptr":
+		body = "ret " + call + " as cptr or! error(\"nil\")"
+	default:
+		body = "ret " + call + " as " + result
+	}
+	return fmt.Sprintf("// %s\n%s = (%s) -> { %s }\n", prototype, fn.Name, strings.Join(names, ", "), body)
+}
+
+// cast returns the type a value of a C type is cast to, "" for void
+func (g *bindgen) cast(cType string) (string, bool) {
+	pointers := strings.Count(cType, "*")
+	var words []string
+	isConst := false
+	for _, word := range strings.Fields(strings.ReplaceAll(cType, "*", " ")) {
+		switch word {
+		case "const":
+			isConst = true
+		case "volatile", "restrict", "__restrict", "register":
+		default:
+			words = append(words, word)
+		}
+	}
+	base := strings.Join(words, " ")
+
+	switch {
+	case pointers == 1 && isConst && base == "char":
+		return "cstr", true
+	case pointers > 0 || base == "pointer": // "pointer" comes from DWARF
+		return "cptr", true
+	case base == "void":
+		return "", true
+	case base == "float" || base == "double":
+		return base, true
+	case strings.HasPrefix(base, "enum"):
+		return "int32", true
+	}
+	if typ, _, ok := cPrimitive(base); ok {
+		return typ, true
+	}
+	if record := g.record(CTypeRef{Name: base}); record != nil {
+		name := g.structs[record]
+		return name, name != ""
+	}
+	if ref, ok := g.header.Typedefs[base]; ok {
+		if ref.Pointers > 0 {
+			return "cptr", true
+		}
+		if len(ref.Array) == 0 && ref.Record == nil {
+			return g.cast(ref.Name)
+		}
+	}
+	return "", false
+}
+
+// addBindingPrototypes gives the C imports of a module from vibe67
+// bindgen the prototypes its wrappers were generated from: every argument
+// of a call is cast to its C type, and so is the result
+func addBindingPrototypes(program *Program) {
+	imports := make(map[string]*CImportStmt)
+	for _, stmt := range program.Statements {
+		if cImport, ok := stmt.(*CImportStmt); ok {
+			cImport.Prototypes = make(map[string]*CFunctionSignature)
+			imports[cImport.Alias] = cImport
+		}
+	}
+	if len(imports) == 0 {
+		return
+	}
+
+	results := make(map[*CallExpr]string)
+	walkProfileSites(reflect.ValueOf(program), "", func(node interface{}, _ string) string {
+		switch n := node.(type) {
+		case *CastExpr:
+			if call, ok := n.Expr.(*CallExpr); ok {
+				results[call] = n.Type
+			}
+		case *CallExpr:
+			alias, name, ok := strings.Cut(n.Function, ".")
+			cImport := imports[alias]
+			if !ok || cImport == nil {
+				break
+			}
+			sig := &CFunctionSignature{ReturnType: bindingCType(results[n])}
+			for _, arg := range n.Args {
+				var param CFunctionParam
+				if cast, ok := arg.(*CastExpr); ok {
+					param.Type = bindingCType(cast.Type)
+				}
+				sig.Params = append(sig.Params, param)
+			}
+			cImport.Prototypes[name] = sig
+		}
+		return ""
+	})
+}
+
+// bindingCType is the C type of a cast in a generated module
+func bindingCType(cast string) string {
+	switch cast {
+	case "":
+		return "void"
+	case "cstr":
+		return "const char*"
+	case "cptr":
+		return "void*"
+	case "float", "double":
+		return cast
+	}
+	if strings.HasPrefix(cast, "int") || strings.HasPrefix(cast, "uint") {
+		return cast + "_t"
+	}
+	return cast // a cstruct passed by value
+}
@@ -0,0 +1,316 @@
+// Completion: 70% - Relocatable objects and shared libraries from vibe67 code (x86-64 Linux)
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Library builds
+//
+// -buildmode=obj writes an ELF relocatable object (.o) and -buildmode=shared
+// a shared library (.so) instead of an executable, so that C and C++
+// programs can call vibe67 code. The functions that the main file names in
+// its export statement (every top-level function but main for `export *`)
+// become C functions of the same name, declared in a header that is written
+// next to the output: libgame.so gets libgame.h.
+//
+// Every vibe67 number is a float64, so an exported function takes and
+// returns double. Each gets a C entry point like a callback cast does (see
+// callbacks.go), which saves the registers C expects to be preserved and
+// calls the lambda.
+//
+// There is no entry point. The top-level statements run once, in an
+// initializer that the dynamic loader calls through .init_array when the
+// library is loaded, or the C runtime before main when the object is
+// linked into a program. main is not called.
+//
+// The code is generated twice like for a dynamic executable, but the second
+// pass gets an initializer in place of the entry code and the exported
+// entry points after the runtime. The result is a libraryImage: .text and
+// .data plus the references in .text that are left to the linker (see
+// elf_library.go). Generated code may write to constants it defines, as
+// the executable maps everything writable, so the read-only constants go
+// into .data too.
+
+const (
+	BuildModeExe    = "exe"
+	BuildModeObj    = "obj"
+	BuildModeShared = "shared"
+
+	libraryInitLabel   = "_vibe67_library_init"
+	libraryExportLabel = "_vibe67_export_" // followed by the function's name
+)
+
+// BuildMode is what the compiler writes (-buildmode): exe, obj or shared
+var BuildMode = BuildModeExe
+
+// checkBuildMode reports whether BuildMode can be built for the platform
+func checkBuildMode(platform Platform) error {
+	switch BuildMode {
+	case BuildModeExe:
+		return nil
+	case BuildModeObj, BuildModeShared:
+		if platform.Arch != ArchX86_64 || platform.OS != OSLinux {
+			return fmt.Errorf("-buildmode=%s is only supported for amd64-linux, not %s-%s", BuildMode, platform.Arch.String(), platform.OS.String())
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown -buildmode %q (use exe, obj or shared)", BuildMode)
+}
+
+// libraryExport is a function a library build makes callable from C
+type libraryExport struct {
+	Name   string
+	Params []string
+}
+
+// libraryExports lists the functions the main file exports, sorted by name.
+// It is called before the imports are merged into the program, so that
+// `export *` does not take in the functions of imported modules.
+func libraryExports(program *Program) ([]libraryExport, error) {
+	lambdas := make(map[string]*LambdaExpr)
+	var names []string
+	for _, stmt := range program.Statements {
+		assign, ok := stmt.(*AssignStmt)
+		if !ok {
+			continue
+		}
+		switch value := assign.Value.(type) {
+		case *LambdaExpr:
+			lambdas[assign.Name] = value
+			if assign.Name != "main" {
+				names = append(names, assign.Name)
+			}
+		case *PatternLambdaExpr, *MultiLambdaExpr:
+			lambdas[assign.Name] = nil
+		}
+	}
+
+	if program.ExportMode != "*" {
+		if len(program.ExportedFuncs) == 0 {
+			return nil, fmt.Errorf("-buildmode=%s needs an export statement naming the functions to export", BuildMode)
+		}
+		names = program.ExportedFuncs
+	}
+
+	seen := make(map[string]bool)
+	var exports []libraryExport
+	for _, name := range names {
+		lambda, ok := lambdas[name]
+		switch {
+		case seen[name]:
+			continue
+		case !ok:
+			return nil, fmt.Errorf("cannot export %s: not a function defined in this file", name)
+		case lambda == nil:
+			return nil, fmt.Errorf("cannot export %s: pattern-matching functions have no fixed parameter list", name)
+		case lambda.VariadicParam != "":
+			return nil, fmt.Errorf("cannot export %s: variadic functions cannot be called from C", name)
+		case len(lambda.Params) > callbackMaxParams:
+			return nil, fmt.Errorf("cannot export %s: it takes %d parameters, at most %d are supported", name, len(lambda.Params), callbackMaxParams)
+		}
+		seen[name] = true
+		exports = append(exports, libraryExport{Name: name, Params: lambda.Params})
+	}
+	sort.Slice(exports, func(i, j int) bool { return exports[i].Name < exports[j].Name })
+	return exports, nil
+}
+
+// libraryHeaderPath gives the header written next to a library, which
+// replaces the output's extension with .h
+func libraryHeaderPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".h"
+}
+
+// libraryHeader declares the exported functions for C and C++
+func libraryHeader(outputPath string, exports []libraryExport) string {
+	base := filepath.Base(outputPath)
+	guard := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, strings.TrimSuffix(base, filepath.Ext(base))) + "_H"
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "// Code generated by vibe67 for %s; DO NOT EDIT.\n\n", base)
+	fmt.Fprintf(&sb, "#ifndef %s\n#define %s\n\n", guard, guard)
+	sb.WriteString("#ifdef __cplusplus\nextern \"C\" {\n#endif\n\n")
+	for _, export := range exports {
+		params := "void"
+		if len(export.Params) > 0 {
+			params = "double " + strings.Join(export.Params, ", double ")
+		}
+		fmt.Fprintf(&sb, "double %s(%s);\n", export.Name, params)
+	}
+	sb.WriteString("\n#ifdef __cplusplus\n}\n#endif\n\n#endif\n")
+	return sb.String()
+}
+
+// writeLibrary is writeELF for -buildmode=obj and -buildmode=shared
+func (fc *C67Compiler) writeLibrary(program *Program, outputPath string) error {
+	if err := checkBuildMode(Platform{Arch: fc.eb.target.Arch(), OS: fc.eb.target.OS()}); err != nil {
+		return err
+	}
+	if len(fc.staticArchives) > 0 {
+		return fmt.Errorf("-buildmode=%s cannot link C archives; link them with the program that uses the library", BuildMode)
+	}
+	fc.eb.useDynamicLinking = true
+	for cacheName := range fc.memoCaches {
+		fc.eb.DefineWritable(cacheName, "\x00\x00\x00\x00\x00\x00\x00\x00")
+	}
+
+	fc.resetForRegeneration()
+
+	// The initializer is called from C, so it saves the registers C
+	// expects to be preserved. Five pushes leave rsp where _start has it.
+	saved := []string{"rbx", "r12", "r13", "r14", "r15"}
+	fc.eb.MarkLabel(libraryInitLabel)
+	for _, reg := range saved {
+		fc.out.PushReg(reg)
+	}
+	fc.out.PushReg("rbp")
+	fc.out.MovRegToReg("rbp", "rsp")
+	fc.out.SubImmFromReg("rsp", StackSlotSize)
+	fc.emitCPUFeatureDetection()
+	fc.arenaInitCallOffset = fc.eb.text.Len()
+	fc.out.Emit([]byte{0x90, 0x90, 0x90, 0x90, 0x90}) // 5 NOPs as placeholder
+	fc.initHotFunctionTable()
+
+	if err := fc.regenerateTopLevel(program); err != nil {
+		return err
+	}
+
+	fc.out.MovRegToReg("rsp", "rbp")
+	fc.out.PopReg("rbp")
+	for i := len(saved) - 1; i >= 0; i-- {
+		fc.out.PopReg(saved[i])
+	}
+	fc.out.Ret()
+
+	fc.generatePatternLambdaFunctions()
+	fc.generateRuntimeHelpers()
+
+	// The C entry points of the exported functions
+	cc := GetCallingConvention(fc.eb.target)
+	var symbols []librarySymbol
+	for _, export := range fc.exports {
+		if _, ok := fc.eb.labels[export.Name]; !ok {
+			return fmt.Errorf("cannot export %s: the function was not compiled", export.Name)
+		}
+		ct := &CallbackType{Params: make([]string, len(export.Params)), Return: "double"}
+		for i := range ct.Params {
+			ct.Params[i] = "double"
+		}
+		start := fc.eb.text.Len()
+		fc.generateCEntry(libraryExportLabel+export.Name, ct, cc, func() {
+			fc.out.XorRegWithReg("r15", "r15") // no environment
+			fc.out.CallSymbol(export.Name)
+		})
+		symbols = append(symbols, librarySymbol{name: export.Name, offset: start, size: fc.eb.text.Len() - start})
+	}
+
+	img, err := fc.libraryImage(symbols)
+	if err != nil {
+		return err
+	}
+
+	var content []byte
+	if BuildMode == BuildModeShared {
+		img.soname = filepath.Base(outputPath)
+		img.needed = append([]string{"libc.so.6"}, fc.neededCLibraries()...)
+		for _, name := range img.imports {
+			if libmFunctions[name] {
+				img.needed = append(img.needed, "libm.so.6")
+				break
+			}
+		}
+		content = img.sharedObject()
+	} else {
+		content = img.relocatableObject()
+	}
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "Library: %d bytes of code, %d bytes of data, exports %d functions, imports %v\n",
+			len(img.text), len(img.data), len(img.exports), img.imports)
+	}
+
+	if err := os.WriteFile(outputPath, content, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(libraryHeaderPath(outputPath), []byte(libraryHeader(outputPath, fc.exports)), 0o644)
+}
+
+// libraryImage lays out the constants in .data and resolves the references
+// within the generated code, collecting the rest for the linker
+func (fc *C67Compiler) libraryImage(exports []librarySymbol) (*libraryImage, error) {
+	img := &libraryImage{
+		text:    append([]byte(nil), fc.eb.text.Bytes()...),
+		init:    fc.eb.labels[libraryInitLabel],
+		exports: exports,
+	}
+
+	// Read-only constants first, then the writable ones
+	var readOnly, writable []string
+	for name, c := range fc.eb.consts {
+		switch {
+		case c.writable:
+			writable = append(writable, name)
+		case c.value != "":
+			readOnly = append(readOnly, name)
+		}
+	}
+	sort.Strings(readOnly)
+	sort.Strings(writable)
+	dataOffsets := make(map[string]int)
+	for _, name := range append(readOnly, writable...) {
+		for len(img.data)%8 != 0 {
+			img.data = append(img.data, 0)
+		}
+		dataOffsets[name] = len(img.data)
+		img.data = append(img.data, fc.eb.consts[name].value...)
+	}
+
+	putRel32 := func(pos, target int) {
+		disp := uint32(int32(target - (pos + 4)))
+		img.text[pos], img.text[pos+1], img.text[pos+2], img.text[pos+3] = byte(disp), byte(disp>>8), byte(disp>>16), byte(disp>>24)
+	}
+
+	for _, reloc := range fc.eb.pcRelocations {
+		pos := int(reloc.offset)
+		if label, ok := fc.eb.labels[reloc.symbolName]; ok {
+			putRel32(pos, label)
+		} else if offset, ok := dataOffsets[reloc.symbolName]; ok {
+			img.dataRefs = append(img.dataRefs, libraryRef{offset: pos, target: offset})
+		} else {
+			return nil, fmt.Errorf("undefined symbol %s referenced from the generated code", reloc.symbolName)
+		}
+	}
+
+	imports := make(map[string]bool)
+	for _, patch := range fc.eb.callPatches {
+		pos := patch.position
+		funcName := strings.TrimSuffix(patch.targetName, "$stub")
+		label, ok := fc.eb.labels[patch.targetName]
+		if !ok && funcName != patch.targetName && !fc.eb.externalCalls[funcName] {
+			label, ok = fc.eb.labels[funcName]
+		}
+		if ok {
+			putRel32(pos, label)
+			continue
+		}
+		img.calls = append(img.calls, libraryRef{offset: pos, symbol: funcName})
+		imports[funcName] = true
+	}
+	for name := range imports {
+		img.imports = append(img.imports, name)
+	}
+	sort.Strings(img.imports)
+	return img, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLibraryBuildModes(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.Skip("needs x86-64 Linux")
+	}
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "game", "game.v67")
+	if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+		t.Fatal(err)
+	}
+	code := `import "c" as c
+export add scale hyp
+factor := 2.5
+add = (a, b) -> a + b
+scale = x -> x * factor
+hyp = (x, y) -> c.sqrt(x * x + y * y)
+helper = x -> x
+printf("game loaded\n")
+`
+	if err := os.WriteFile(src, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mainC := filepath.Join(dir, "main.c")
+	// The generated header is included with -include
+	if err := os.WriteFile(mainC, []byte(`#include <stdio.h>
+int main(void) {
+	fflush(stdout);
+	printf("%g %g %g\n", add(1, 2), scale(4), hyp(3, 4));
+	return 0;
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := "game loaded\n3 10 5\n"
+
+	defer func(mode string) { BuildMode = mode }(BuildMode)
+	platform := Platform{OS: OSLinux, Arch: ArchX86_64}
+
+	BuildMode = BuildModeShared
+	lib := filepath.Join(dir, "lib", "libgame.so")
+	if err := os.MkdirAll(filepath.Dir(lib), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompileC67WithOptions(src, lib, platform, 0, false, false); err != nil {
+		t.Fatal(err)
+	}
+	header, err := os.ReadFile(libraryHeaderPath(lib))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range []string{"double add(double a, double b);", "double scale(double x);", `extern "C"`} {
+		if !strings.Contains(string(header), decl) {
+			t.Errorf("header lacks %s:\n%s", decl, header)
+		}
+	}
+	if strings.Contains(string(header), "helper") {
+		t.Errorf("header declares a function that is not exported:\n%s", header)
+	}
+
+	f, err := elf.Open(lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syms, err := f.DynamicSymbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported []string
+	for _, s := range syms {
+		if s.Section != elf.SHN_UNDEF {
+			exported = append(exported, s.Name)
+		}
+	}
+	sort.Strings(exported)
+	if got := strings.Join(exported, " "); got != "add hyp scale" {
+		t.Errorf("exported symbols = %s, want add hyp scale", got)
+	}
+	libs, err := f.ImportedLibraries()
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(libs, " "); got != "libc.so.6 libm.so.6" {
+		t.Errorf("needed libraries = %s", got)
+	}
+
+	exe := filepath.Join(dir, "main_shared")
+	if out, err := exec.Command("gcc", "-o", exe, "-include", filepath.Join(dir, "lib", "libgame.h"), mainC, "-L", filepath.Dir(lib), "-lgame").CombinedOutput(); err != nil {
+		t.Fatalf("gcc: %v\n%s", err, out)
+	}
+	cmd := exec.Command(exe)
+	cmd.Env = append(os.Environ(), "LD_LIBRARY_PATH="+filepath.Dir(lib))
+	if out, err := cmd.CombinedOutput(); err != nil || string(out) != want {
+		t.Errorf("shared library: got %q (%v), want %q", out, err, want)
+	}
+
+	BuildMode = BuildModeObj
+	obj := filepath.Join(dir, "obj", "game.o")
+	if err := os.MkdirAll(filepath.Dir(obj), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompileC67WithOptions(src, obj, platform, 0, false, false); err != nil {
+		t.Fatal(err)
+	}
+	f, err = elf.Open(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != elf.ET_REL {
+		t.Errorf("object type = %v, want ET_REL", f.Type)
+	}
+	f.Close()
+
+	exe = filepath.Join(dir, "main_obj")
+	if out, err := exec.Command("gcc", "-o", exe, "-include", filepath.Join(dir, "obj", "game.h"), mainC, obj, "-lm").CombinedOutput(); err != nil {
+		t.Fatalf("gcc: %v\n%s", err, out)
+	}
+	if out, err := exec.Command(exe).CombinedOutput(); err != nil || string(out) != want {
+		t.Errorf("object: got %q (%v), want %q", out, err, want)
+	}
+}
+
+func TestLibraryExports(t *testing.T) {
+	defer func(mode string) { BuildMode = mode }(BuildMode)
+	BuildMode = BuildModeShared
+	tests := []struct {
+		code string
+		want string // exported names, or the start of the error
+	}{
+		{"export *\nf = x -> x\ng = (a, b) -> a\nmain = () -> 0\nn := 1\n", "f g"},
+		{"export g\nf = x -> x\ng = () -> 1\n", "g"},
+		{"f = x -> x\n", "-buildmode=shared needs an export statement"},
+		{"export n\nn := 1\n", "cannot export n: not a function"},
+		{"export missing\nf = x -> x\n", "cannot export missing: not a function"},
+	}
+	for _, tt := range tests {
+		exports, err := libraryExports(parseSource(tt.code, "lib.v67"))
+		var got string
+		if err != nil {
+			got = err.Error()
+		} else {
+			var names []string
+			for _, e := range exports {
+				names = append(names, e.Name)
+			}
+			got = strings.Join(names, " ")
+		}
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
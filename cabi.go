@@ -0,0 +1,228 @@
+// Completion: 75% - cstructs by value and variadic arguments in C calls (System V AMD64 and Microsoft x64)
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Aggregates in C calls
+//
+// A cstruct value is the address of its memory. When a C function takes or
+// returns a cstruct by value, compileCFunctionCall moves the bytes instead:
+//
+// System V AMD64: a struct of at most 16 bytes whose fields are all aligned
+// is split into eightbytes. An eightbyte holding only float32/float64
+// fields is SSE and goes in the next xmm register, any other is INTEGER and
+// goes in the next general register. If the registers left cannot take all
+// eightbytes, or the struct is larger or packed out of alignment (MEMORY),
+// the whole struct is copied onto the stack. Results come back the same way
+// in rax/rdx and xmm0/xmm1, or through memory whose address the caller
+// passes in rdi and the callee returns in rax.
+//
+// Microsoft x64: a struct of 1, 2, 4 or 8 bytes travels as an integer in
+// the argument's slot and comes back in rax. Any other struct is copied by
+// the caller and passed as a pointer to the copy, and is returned through
+// memory whose address the caller passes in the first slot.
+//
+// Results are copied into arena memory, so the cstruct returned by a call
+// lives as long as the current arena.
+
+type abiClass int
+
+const (
+	abiInteger abiClass = iota
+	abiSSE
+)
+
+// StructPassing is how a cstruct crosses a C call by value
+type StructPassing struct {
+	Decl  *CStructDecl
+	Words []abiClass // classes of the eightbytes; nil when passed in memory
+	ByRef bool       // Microsoft x64: passed as a pointer to a copy
+}
+
+// InRegisters reports whether the struct can travel in registers
+func (p StructPassing) InRegisters() bool {
+	return p.Words != nil
+}
+
+// Slots is the number of 8-byte words the argument takes before the call
+func (p StructPassing) Slots() int {
+	if p.Words != nil {
+		return len(p.Words)
+	}
+	if p.ByRef {
+		return 1
+	}
+	return (p.Decl.Size + 7) / 8
+}
+
+// RegisterCounts returns how many general and xmm registers the struct needs
+func (p StructPassing) RegisterCounts() (ints, sses int) {
+	for _, class := range p.Words {
+		if class == abiSSE {
+			sses++
+		} else {
+			ints++
+		}
+	}
+	return ints, sses
+}
+
+// classifyStruct applies the aggregate rules of the target's ABI
+func classifyStruct(decl *CStructDecl, windows bool) StructPassing {
+	p := StructPassing{Decl: decl}
+	if windows {
+		switch decl.Size {
+		case 1, 2, 4, 8:
+			p.Words = []abiClass{abiInteger}
+		default:
+			p.ByRef = true
+		}
+		return p
+	}
+
+	if decl.Size == 0 || decl.Size > 16 {
+		return p
+	}
+	words := make([]abiClass, (decl.Size+7)/8)
+	seen := make([]bool, len(words))
+	for _, f := range decl.Fields {
+		if f.Size == 0 || f.Offset%f.Size != 0 {
+			return p // unaligned fields make it MEMORY
+		}
+		w := f.Offset / 8
+		class := abiInteger
+		if f.Type == "float32" || f.Type == "float64" {
+			class = abiSSE
+		}
+		if !seen[w] {
+			words[w] = class
+			seen[w] = true
+		} else if class == abiInteger {
+			words[w] = abiInteger
+		}
+	}
+	p.Words = words
+	return p
+}
+
+// cstructByValue returns the cstruct a C type names, or nil for pointers
+// and other types: "Vector2", "struct Vector2", "const Color" and
+// "sdl.SDL_FRect" all name a cstruct
+func (fc *C67Compiler) cstructByValue(ctype string) *CStructDecl {
+	if ctype == "" || isPointerType(ctype) {
+		return nil
+	}
+	name := strings.TrimSpace(ctype)
+	name = strings.TrimSpace(strings.TrimPrefix(name, "const "))
+	name = strings.TrimSpace(strings.TrimPrefix(name, "struct "))
+	name = strings.TrimSpace(strings.TrimPrefix(name, "union "))
+	return fc.cstructs[name]
+}
+
+// storeStructArg copies the cstruct at rsi into its words of the temporary
+// area at rbx, or for a struct passed by reference into its copy, storing
+// the copy's address as the argument
+func (fc *C67Compiler) storeStructArg(p *StructPassing, word, copyOffset int) {
+	if p.ByRef {
+		fc.copyStructBytes("rbx", copyOffset, "rsi", 0, p.Decl.Size)
+		fc.out.LeaMemToReg("rax", "rbx", copyOffset)
+		fc.out.MovRegToMem("rax", "rbx", word)
+		return
+	}
+	fc.copyStructBytes("rbx", word, "rsi", 0, p.Decl.Size)
+}
+
+// loadStructResult leaves in xmm0 the address of the cstruct a C call
+// returned, copying a result returned in registers into arena memory
+func (fc *C67Compiler) loadStructResult(decl *CStructDecl, p StructPassing, hidden bool) {
+	if !hidden {
+		// Keep rax, rdx, xmm0 and xmm1 while allocating
+		fc.out.SubImmFromReg("rsp", 32)
+		fc.out.MovRegToMem("rax", "rsp", 0)
+		fc.out.MovRegToMem("rdx", "rsp", 8)
+		fc.out.MovXmmToMem("xmm0", "rsp", 16)
+		fc.out.MovXmmToMem("xmm1", "rsp", 24)
+		fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", len(p.Words)*8))
+		fc.callArenaAlloc()
+		intReg, sseReg := 0, 0
+		for k, class := range p.Words {
+			var saved int
+			if class == abiSSE {
+				saved = 16 + 8*sseReg
+				sseReg++
+			} else {
+				saved = 8 * intReg
+				intReg++
+			}
+			fc.out.MovMemToReg("r11", "rsp", saved)
+			fc.out.MovRegToMem("r11", "rax", 8*k)
+		}
+		fc.out.AddImmToReg("rsp", 32)
+	}
+	fc.out.Cvtsi2sd("xmm0", "rax")
+}
+
+// copyStructBytes copies size bytes from [src+srcOffset] to
+// [dst+dstOffset] through r11
+func (fc *C67Compiler) copyStructBytes(dst string, dstOffset int, src string, srcOffset int, size int) {
+	for done := 0; done < size; {
+		switch rest := size - done; {
+		case rest >= 8:
+			fc.out.MovMemToReg("r11", src, srcOffset+done)
+			fc.out.MovRegToMem("r11", dst, dstOffset+done)
+			done += 8
+		case rest >= 4:
+			fc.out.MovU32MemToReg("r11", src, srcOffset+done)
+			fc.out.MovU32RegToMem("r11", dst, dstOffset+done)
+			done += 4
+		case rest >= 2:
+			fc.out.MovU16MemToReg("r11", src, srcOffset+done)
+			fc.out.MovU16RegToMem("r11", dst, dstOffset+done)
+			done += 2
+		default:
+			fc.out.MovU8MemToReg("r11", src, srcOffset+done)
+			fc.out.MovU8RegToMem("r11", dst, dstOffset+done)
+			done++
+		}
+	}
+}
+
+// printfArgKinds returns the kind of argument each conversion of a printf
+// format reads: 'i' for integers and characters, 'f' for floating point,
+// 's' for strings and 'p' for pointers. A '*' width or precision reads an
+// integer of its own.
+func printfArgKinds(format string) []byte {
+	var kinds []byte
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+	conversion:
+		for i++; i < len(format); i++ {
+			switch c := format[i]; {
+			case c == '*':
+				kinds = append(kinds, 'i')
+			case strings.IndexByte("-+ #0123456789.'hlLqjzt", c) >= 0:
+				// flags, width, precision and length modifiers
+			case strings.IndexByte("diouxXc", c) >= 0:
+				kinds = append(kinds, 'i')
+				break conversion
+			case strings.IndexByte("fFeEgGaA", c) >= 0:
+				kinds = append(kinds, 'f')
+				break conversion
+			case c == 's':
+				kinds = append(kinds, 's')
+				break conversion
+			case c == 'p' || c == 'n':
+				kinds = append(kinds, 'p')
+				break conversion
+			default:
+				break conversion // "%%" and unknown conversions
+			}
+		}
+	}
+	return kinds
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestClassifyStruct(t *testing.T) {
+	layout := func(packed bool, types ...string) *CStructDecl {
+		decl := &CStructDecl{Name: "S", Packed: packed}
+		for _, typ := range types {
+			decl.Fields = append(decl.Fields, CStructField{Name: typ, Type: typ})
+		}
+		decl.CalculateStructLayout()
+		return decl
+	}
+	I, S := abiInteger, abiSSE
+	tests := []struct {
+		name     string
+		decl     *CStructDecl
+		sysv     []abiClass
+		winByRef bool
+	}{
+		{"Color", layout(false, "uint8", "uint8", "uint8", "uint8"), []abiClass{I}, false},
+		{"Vector2", layout(false, "float32", "float32"), []abiClass{S}, false},
+		{"SDL_FRect", layout(false, "float32", "float32", "float32", "float32"), []abiClass{S, S}, true},
+		{"int and float", layout(false, "int32", "float32"), []abiClass{I}, false},
+		{"long and double", layout(false, "int64", "float64"), []abiClass{I, S}, true},
+		{"three doubles", layout(false, "float64", "float64", "float64"), nil, true},
+		{"packed", layout(true, "uint8", "int32"), nil, true},
+	}
+	for _, tt := range tests {
+		if got := classifyStruct(tt.decl, false); !reflect.DeepEqual(got.Words, tt.sysv) {
+			t.Errorf("%s: System V classes %v, want %v", tt.name, got.Words, tt.sysv)
+		}
+		if got := classifyStruct(tt.decl, true); got.ByRef != tt.winByRef {
+			t.Errorf("%s: Windows by reference = %v, want %v", tt.name, got.ByRef, tt.winByRef)
+		}
+	}
+
+	raylib := CreateRaylibDefinition()
+	for _, name := range []string{"Color", "Vector2"} {
+		if p := classifyStruct(raylib.Structs[name], false); !p.InRegisters() {
+			t.Errorf("raylib %s should travel in registers", name)
+		}
+	}
+}
+
+func TestCStructsByValue(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.Skip("needs an x86-64 Linux shared library")
+	}
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sv.c")
+	lib := filepath.Join(dir, "libsv.so")
+	if err := os.WriteFile(src, []byte(`typedef struct { float x, y; } Vec2;
+typedef struct { unsigned char r, g, b, a; } Color;
+typedef struct { double x, y, z; } Vec3;
+typedef struct { long id; double w; } Mixed;
+int color_sum(Color c) { return c.r + c.g + c.b + c.a; }
+double vec3_dot(Vec3 a, Vec3 b) { return a.x*b.x + a.y*b.y + a.z*b.z; }
+Vec3 vec3_scale(Vec3 a, double s) { Vec3 r = {a.x*s, a.y*s, a.z*s}; return r; }
+Mixed mixed_make(long id, double w) { Mixed m = {id, w}; return m; }
+double mixed_weigh(int k, Mixed m, double f) { return k * m.id + m.w * f; }
+double vec2_after(double a, double b, double c, double d, double e, double f, double g, double h, Vec2 v) { return a+b+c+d+e+f+g+h + v.x * 100 + v.y * 1000; }
+long color_after(long a, long b, long c, long d, long e, long f, Color k, long g) { return a+b+c+d+e+f + k.r * 100 + g * 1000; }
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-g", "-shared", "-fPIC", "-o", lib, src).CombinedOutput(); err != nil {
+		t.Fatalf("gcc: %v\n%s", err, out)
+	}
+	t.Setenv("LD_LIBRARY_PATH", dir)
+
+	code := `import "` + lib + `" as sv
+import "c" as c
+cstruct Vec2 {
+    x as float32,
+    y as float32
+}
+cstruct Color {
+    r as uint8,
+    g as uint8,
+    b as uint8,
+    a as uint8
+}
+cstruct Vec3 {
+    x as float64,
+    y as float64,
+    z as float64
+}
+cstruct Mixed {
+    id as int64,
+    w as float64
+}
+col = c.malloc(4)
+write_u8(col, 0, 10)
+write_u8(col, 1, 20)
+write_u8(col, 2, 30)
+write_u8(col, 3, 40)
+printf("%v\n", sv.color_sum(col))
+v = c.malloc(24)
+write_f64(v, 0, 1.0)
+write_f64(v, 1, 2.0)
+write_f64(v, 2, 3.0)
+printf("%v\n", sv.vec3_dot(v, v))
+w = sv.vec3_scale(v, 2.0)
+printf("%v %v %v\n", read_f64(w, 0), read_f64(w, 1), read_f64(w, 2))
+printf("%v\n", sv.vec3_dot(w, v as Vec3))
+m = sv.mixed_make(7, 0.5)
+printf("%v %v\n", read_i64(m, 0), read_f64(m, 1))
+printf("%v\n", sv.mixed_weigh(2, m, 4.0))
+a = c.malloc(8)
+write_f32(a, 0, 1.5)
+write_f32(a, 1, 2.0)
+printf("%v\n", sv.vec2_after(1, 2, 3, 4, 5, 6, 7, 8, a))
+printf("%v\n", sv.color_after(1, 2, 3, 4, 5, 6, col, 7))
+`
+	want := strings.Join([]string{
+		"100.000000",
+		"14.000000",
+		"2.000000 4.000000 6.000000",
+		"28.000000",
+		"7.000000 0.500000",
+		"16.000000",
+		"2186.000000",
+		"8021.000000",
+	}, "\n") + "\n"
+	if got := compileAndRun(t, code); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPrintfArgKinds(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"%d %s\n", "is"},
+		{"%5.2f|%-8lu|%llx", "fii"},
+		{"100%% %c", "i"},
+		{"%*d %.*s", "iiis"},
+		{"%p %e %G %a", "pfff"},
+		{"no conversions", ""},
+	}
+	for _, tt := range tests {
+		if got := string(printfArgKinds(tt.format)); got != tt.want {
+			t.Errorf("printfArgKinds(%q) = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestVariadicCCalls(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.Skip("needs an x86-64 Linux shared library")
+	}
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "va.c")
+	lib := filepath.Join(dir, "libva.so")
+	if err := os.WriteFile(src, []byte(`#include <stdarg.h>
+float va_half(float x) { return x / 2; }
+double va_sum(int n, ...) { va_list ap; va_start(ap, n); double s = 0; for (int i = 0; i < n; i++) s += va_arg(ap, double); va_end(ap); return s; }
+long va_isum(int n, ...) { va_list ap; va_start(ap, n); long s = 0; for (int i = 0; i < n; i++) s += va_arg(ap, long); va_end(ap); return s; }
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-g", "-shared", "-fPIC", "-o", lib, src).CombinedOutput(); err != nil {
+		t.Fatalf("gcc: %v\n%s", err, out)
+	}
+	t.Setenv("LD_LIBRARY_PATH", dir)
+
+	code := `import "` + lib + `" as va
+import "c" as c
+printf("%v\n", va.va_half(5.0))
+printf("%v\n", va.va_sum(10, 1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0))
+printf("%v\n", va.va_isum(7, 1 as int64, 2 as int64, 3 as int64, 4 as int64, 5 as int64, 6 as int64, 7 as int64))
+x = 2.5
+n = 42
+c.printf("%f %d\n", x, n)
+c.printf("%d %d %d %d %d %d %d %.1f %s\n", 1, 2, 3, 4, 5, 6, 7, 8.5, "str")
+c.printf("%.2f %.2f %.2f %.2f %.2f %.2f %.2f %.2f %.2f %.2f\n", 1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0)
+c.printf("%*d|%5.1f|%%|%c\n", 4, 7, 3.14159, 65)
+c.fflush(0)
+`
+	want := strings.Join([]string{
+		"2.500000",
+		"55.000000",
+		"28.000000",
+		"2.500000 42",
+		"1 2 3 4 5 6 7 8.5 str",
+		"1.00 2.00 3.00 4.00 5.00 6.00 7.00 8.00 9.00 10.00",
+		"   7|  3.1|%|A",
+	}, "\n") + "\n"
+	if got := compileAndRun(t, code); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,463 @@
+// Completion: 70% - C callbacks from lambdas on x86-64 (System V and Windows x64)
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// C callbacks
+//
+// `f as fn(cptr, cptr) -> int32` turns the lambda f into a C function
+// pointer that libraries such as qsort, SDL_AddEventWatch or an audio
+// callback can call. The return type defaults to void when the arrow is
+// left out.
+//
+// Each callback type gets one trampoline, _vibe67_callback_<n>, that is
+// entered with r11 pointing at a closure object [func_ptr, env_ptr]. It
+// reads the C arguments as the target's CallingConvention passes them,
+// converts each to a float64, calls the lambda with the arguments in
+// xmm0-xmm5 and its environment in r15, and converts the float64 result
+// back to the declared C return type.
+//
+// C has nowhere to pass a closure, so each cast site also gets a pool of
+// callbackPoolSize thunks in .text and a writable table of the closures
+// they stand for. Thunk i loads entry i of the table into r11 and jumps to
+// the trampoline. The cast asks _vibe67_callback_thunk for the thunk that
+// already serves the closure, or claims a free one, so a site can hand out
+// callbackPoolSize distinct closures. Thunks are never released; when the
+// pool is exhausted the cast returns NULL, which `or!` can catch. The
+// claim is not synchronised, so casts should happen on one thread.
+//
+// Integer arguments wider than 53 bits and uint64 results above 2^63 lose
+// precision, as they do for other C calls. cstr arguments arrive as
+// pointers; read them with the read_* functions.
+
+const (
+	callbackPoolSize  = 32 // thunks per cast site
+	callbackThunkSize = 32 // bytes per thunk, padded with int3
+	callbackMaxParams = 6  // lambdas take their arguments in xmm0-xmm5
+)
+
+// CallbackType is the C signature of a callback cast
+type CallbackType struct {
+	Params []string
+	Return string
+}
+
+// String gives the form stored in CastExpr.Type, e.g. fn(cptr,cptr)->int32
+func (ct *CallbackType) String() string {
+	return "fn(" + strings.Join(ct.Params, ",") + ")->" + ct.Return
+}
+
+// parseCallbackType reads a CastExpr.Type written by parseCallbackCastType
+func parseCallbackType(typ string) (*CallbackType, bool) {
+	if !strings.HasPrefix(typ, "fn(") {
+		return nil, false
+	}
+	params, ret, ok := strings.Cut(typ[len("fn("):], ")->")
+	if !ok {
+		return nil, false
+	}
+	ct := &CallbackType{Return: ret}
+	if params != "" {
+		ct.Params = strings.Split(params, ",")
+	}
+	return ct, true
+}
+
+// cTypeLayout gives the kind ('i' signed, 'u' unsigned or pointer, 'f'
+// float) and size in bytes of a C scalar type. long is 4 bytes on Windows.
+func cTypeLayout(typ string, windows bool) (kind byte, size int, ok bool) {
+	switch typ {
+	case "int8", "char":
+		return 'i', 1, true
+	case "uint8", "uchar", "bool":
+		return 'u', 1, true
+	case "int16", "short":
+		return 'i', 2, true
+	case "uint16", "ushort":
+		return 'u', 2, true
+	case "int32", "int":
+		return 'i', 4, true
+	case "uint32", "uint":
+		return 'u', 4, true
+	case "long":
+		if windows {
+			return 'i', 4, true
+		}
+		return 'i', 8, true
+	case "ulong":
+		if windows {
+			return 'u', 4, true
+		}
+		return 'u', 8, true
+	case "int64", "ssize_t", "ptrdiff_t":
+		return 'i', 8, true
+	case "uint64", "size_t", "cptr", "cstr", "ptr":
+		return 'u', 8, true
+	case "float", "float32":
+		return 'f', 4, true
+	case "double", "float64", "number":
+		return 'f', 8, true
+	}
+	return 0, 0, false
+}
+
+// parseCallbackCastType parses `fn(T, ...) -> R` after `as`, leaving the
+// parser on the last token of the type
+func (p *Parser) parseCallbackCastType() string {
+	ct := &CallbackType{Return: "void"}
+	p.nextToken() // skip 'fn'
+	for p.peek.Type != TOKEN_RPAREN {
+		p.nextToken()
+		if p.current.Type != TOKEN_IDENT {
+			p.error("expected C type in callback parameter list")
+		}
+		if _, _, ok := cTypeLayout(p.current.Value, false); !ok {
+			p.error(fmt.Sprintf("unsupported callback parameter type '%s'", p.current.Value))
+		}
+		ct.Params = append(ct.Params, p.current.Value)
+		if p.peek.Type == TOKEN_COMMA {
+			p.nextToken()
+		} else if p.peek.Type != TOKEN_RPAREN {
+			p.error("expected ',' or ')' in callback parameter list")
+		}
+	}
+	p.nextToken() // ')'
+	if len(ct.Params) > callbackMaxParams {
+		p.error(fmt.Sprintf("callbacks take at most %d parameters", callbackMaxParams))
+	}
+	if p.peek.Type == TOKEN_ARROW {
+		p.nextToken()
+		p.nextToken()
+		if p.current.Type != TOKEN_IDENT {
+			p.error("expected C return type after '->'")
+		}
+		if _, _, ok := cTypeLayout(p.current.Value, false); !ok && p.current.Value != "void" {
+			p.error(fmt.Sprintf("unsupported callback return type '%s'", p.current.Value))
+		}
+		ct.Return = p.current.Value
+	}
+	return ct.String()
+}
+
+// Callbacks records the callback cast sites and their trampolines
+type Callbacks struct {
+	sites      map[*CastExpr]int
+	siteTypes  []int // trampoline of each site
+	trampoline map[string]int
+	types      []*CallbackType
+}
+
+func newCallbacks() *Callbacks {
+	return &Callbacks{sites: make(map[*CastExpr]int), trampoline: make(map[string]int)}
+}
+
+// site returns the index of a cast site, registering it on first use
+func (cb *Callbacks) site(expr *CastExpr, ct *CallbackType) int {
+	if n, ok := cb.sites[expr]; ok {
+		return n
+	}
+	t, ok := cb.trampoline[ct.String()]
+	if !ok {
+		t = len(cb.types)
+		cb.trampoline[ct.String()] = t
+		cb.types = append(cb.types, ct)
+	}
+	n := len(cb.siteTypes)
+	cb.sites[expr] = n
+	cb.siteTypes = append(cb.siteTypes, t)
+	return n
+}
+
+func callbackSlots(site int) string  { return fmt.Sprintf("_vibe67_callback_slots_%d", site) }
+func callbackThunks(site int) string { return fmt.Sprintf("_vibe67_callback_thunks_%d", site) }
+func callbackSite(site int) string   { return fmt.Sprintf("_vibe67_callback_site_%d", site) }
+func callbackTrampoline(t int) string {
+	return fmt.Sprintf("_vibe67_callback_%d", t)
+}
+
+// compileCallbackCast leaves in xmm0 a C function pointer that calls the
+// lambda, or NULL when the site has run out of thunks
+func (fc *C67Compiler) compileCallbackCast(expr *CastExpr, ct *CallbackType) {
+	if fc.eb.target.Arch() != ArchX86_64 {
+		compilerError("callback casts (as fn(...)) are only supported on x86-64")
+	}
+
+	// Named top-level lambdas have no variable; use their static closure
+	arity := -1
+	switch e := expr.Expr.(type) {
+	case *IdentExpr:
+		if _, isVar := fc.variables[e.Name]; !isVar && fc.lambdaVars[e.Name] {
+			if sig, ok := fc.functionSignatures[e.Name]; ok && !sig.IsVariadic {
+				arity = sig.ParamCount
+			}
+			fc.trackFunctionCall(e.Name)
+			fc.loadStaticClosure(e.Name)
+		} else {
+			fc.compileExpression(e)
+		}
+	case *LambdaExpr:
+		if e.VariadicParam == "" {
+			arity = len(e.Params)
+		}
+		fc.compileExpression(e)
+	default:
+		fc.compileExpression(e)
+	}
+	if arity >= 0 && arity != len(ct.Params) {
+		compilerError("callback type %s has %d parameters but the lambda takes %d", ct, len(ct.Params), arity)
+	}
+
+	site := fc.callbacks.site(expr, ct)
+	fc.eb.DefineWritable(callbackSlots(site), strings.Repeat("\x00", 8*callbackPoolSize))
+	fc.out.MovqXmmToReg("rdx", "xmm0")
+	fc.out.LeaSymbolToReg("rdi", callbackSlots(site))
+	fc.trackFunctionCall("_vibe67_callback_thunk")
+	fc.out.CallSymbol(callbackSite(site))
+	fc.out.Cvtsi2sd("xmm0", "rax")
+}
+
+// loadStaticClosure leaves in xmm0 a pointer to the closure object of a
+// lambda without captures: [func_ptr, NULL]
+func (fc *C67Compiler) loadStaticClosure(funcName string) {
+	closureLabel := fmt.Sprintf("closure_%s", funcName)
+
+	// We can't statically encode a function pointer, so we'll do it at runtime
+	// Create a placeholder in .data (writable!) for the closure object
+	// We need writable memory because we initialize it at runtime
+	fc.eb.DefineWritable(closureLabel, strings.Repeat("\x00", 16))
+
+	// At runtime, initialize the closure object with function pointer
+	fc.out.LeaSymbolToReg("r12", closureLabel) // r12 = closure object address
+	fc.out.LeaSymbolToReg("rax", funcName)     // rax = function pointer
+	fc.out.MovRegToMem("rax", "r12", 0)        // Store func ptr at offset 0
+	// Offset 8 is already 0 (NULL environment) from the zeroed data
+
+	// Return closure object pointer as float64 in xmm0
+	fc.out.SubImmFromReg("rsp", 16)
+	fc.out.MovRegToMem("r12", "rsp", 0)
+	fc.out.MovMemToXmm("xmm0", "rsp", 0)
+	fc.out.AddImmToReg("rsp", 16)
+}
+
+// generateCallbacks emits the thunk lookup, one trampoline per callback
+// type and the thunks of every cast site
+func (fc *C67Compiler) generateCallbacks() {
+	fc.generateCallbackThunkLookup()
+	cc := GetCallingConvention(fc.eb.target)
+	for t, ct := range fc.callbacks.types {
+		fc.generateCallbackTrampoline(callbackTrampoline(t), ct, cc)
+	}
+	for site, t := range fc.callbacks.siteTypes {
+		fc.generateCallbackThunks(callbackSite(site), callbackThunks(site), callbackSlots(site), callbackTrampoline(t))
+	}
+}
+
+// generateCallbackThunkLookup emits _vibe67_callback_thunk(rdi = slots,
+// rsi = thunks, rdx = closure), which returns in rax the thunk whose slot
+// holds the closure, claiming the first empty slot if none does, or NULL
+func (fc *C67Compiler) generateCallbackThunkLookup() {
+	fc.eb.MarkLabel("_vibe67_callback_thunk")
+	fc.out.TestRegReg("rdx", "rdx")
+	noClosure := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.XorRegWithReg("rcx", "rcx")
+
+	loop := fc.eb.text.Len()
+	fc.out.CmpRegToImm("rcx", callbackPoolSize)
+	exhausted := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpGreaterOrEqual, 0)
+	fc.out.MovMemToReg("rax", "rdi", 0)
+	fc.out.CmpRegToReg("rax", "rdx")
+	same := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.TestRegReg("rax", "rax")
+	empty := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.AddImmToReg("rdi", 8)
+	fc.out.AddImmToReg("rsi", callbackThunkSize)
+	fc.out.IncReg("rcx")
+	back := fc.eb.text.Len()
+	fc.out.JumpUnconditional(int32(loop - (back + 5)))
+
+	fc.patchJumpOffset(empty+2, fc.eb.text.Len())
+	fc.out.MovRegToMem("rdx", "rdi", 0)
+	fc.patchJumpOffset(same+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("rax", "rsi")
+	fc.out.Ret()
+
+	fc.patchJumpOffset(noClosure+2, fc.eb.text.Len())
+	fc.patchJumpOffset(exhausted+2, fc.eb.text.Len())
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.out.Ret()
+}
+
+// generateCallbackThunks emits the pool of a cast site, where thunk i jumps
+// to the trampoline with r11 = slots[i], and the site's entry point, which
+// is _vibe67_callback_thunk with rsi set to the pool. The cast calls the
+// entry point rather than taking the pool's address, because the first
+// pass of a dynamic ELF resolves addresses before the runtime is emitted.
+func (fc *C67Compiler) generateCallbackThunks(entry, label, slots, trampoline string) {
+	fc.eb.MarkLabel(entry)
+	fc.out.LeaSymbolToReg("rsi", label)
+	lookup := fc.eb.text.Len()
+	fc.out.JumpUnconditional(int32(fc.eb.labels["_vibe67_callback_thunk"] - (lookup + 5)))
+
+	target := fc.eb.labels[trampoline]
+	fc.eb.MarkLabel(label)
+	for i := 0; i < callbackPoolSize; i++ {
+		start := fc.eb.text.Len()
+		fc.out.LeaSymbolToReg("r11", slots)
+		fc.out.MovMemToReg("r11", "r11", 8*i)
+		jump := fc.eb.text.Len()
+		fc.out.JumpUnconditional(int32(target - (jump + 5)))
+		for fc.eb.text.Len() < start+callbackThunkSize {
+			fc.out.Write(0xCC)
+		}
+	}
+}
+
+// generateCallbackTrampoline emits the C entry point of a callback type.
+// It is entered from a thunk with r11 = closure object.
+func (fc *C67Compiler) generateCallbackTrampoline(label string, ct *CallbackType, cc CallingConvention) {
+	fc.generateCEntry(label, ct, cc, func() {
+		fc.out.MovMemToReg("r15", "r11", 8) // environment
+		fc.out.MovMemToReg("rax", "r11", 0)
+		fc.out.CallRegister("rax")
+	})
+}
+
+// generateCEntry emits a function that C can call with the signature ct.
+// It converts the arguments to float64 in xmm0-xmm5, emits call to reach
+// the lambda and converts its result back. r11 is left as the caller set
+// it for call to use.
+func (fc *C67Compiler) generateCEntry(label string, ct *CallbackType, cc CallingConvention, call func()) {
+	_, windows := cc.(*MicrosoftX64)
+	fc.eb.MarkLabel(label)
+	fc.out.PushReg("rbp")
+	fc.out.MovRegToReg("rbp", "rsp")
+
+	// The lambda may use any register, so save all the callee-saved ones
+	var saved, savedXmm []string
+	for _, reg := range cc.GetCalleeSavedRegs() {
+		switch {
+		case reg == "rbp":
+		case isXmmReg(reg):
+			savedXmm = append(savedXmm, reg)
+		default:
+			saved = append(saved, reg)
+			fc.out.PushReg(reg)
+		}
+	}
+
+	// [rsp, rsp+48): arguments as float64, then the saved xmm registers
+	const args = 8 * callbackMaxParams
+	frame := args + 16*len(savedXmm)
+	if (8*len(saved)+frame)%16 != 0 {
+		frame += 8
+	}
+	fc.out.SubImmFromReg("rsp", int64(frame))
+	for i, reg := range savedXmm {
+		fc.out.MovupdXmmToMem(reg, "rsp", args+16*i)
+	}
+
+	// System V numbers integer and float registers separately; Windows x64
+	// gives every argument the slot of its position
+	intArg, floatArg, stackArg := 0, 0, 0
+	for i, typ := range ct.Params {
+		kind, size, _ := cTypeLayout(typ, windows)
+		var reg string
+		switch {
+		case windows && kind == 'f':
+			reg = cc.GetFloatArgReg(i)
+		case windows:
+			reg = cc.GetIntegerArgReg(i)
+		case kind == 'f':
+			reg = cc.GetFloatArgReg(floatArg)
+			floatArg++
+		default:
+			reg = cc.GetIntegerArgReg(intArg)
+			intArg++
+		}
+		base, offset := "rbp", 0
+		if reg == "" {
+			// Above the return address and the caller's shadow space
+			offset = 16 + cc.GetShadowSpaceSize() + 8*stackArg
+			stackArg++
+		}
+		slot := 8 * i
+
+		switch {
+		case kind == 'f' && size == 8 && reg != "":
+			fc.out.MovXmmToMem(reg, "rsp", slot)
+		case kind == 'f' && size == 8:
+			fc.out.MovMemToReg("rax", base, offset)
+			fc.out.MovRegToMem("rax", "rsp", slot)
+		case kind == 'f':
+			if reg != "" {
+				fc.out.Cvtss2sd("xmm15", reg)
+			} else {
+				fc.out.MovU32MemToReg("rax", base, offset)
+				fc.out.MovqRegToXmm("xmm15", "rax")
+				fc.out.Cvtss2sd("xmm15", "xmm15")
+			}
+			fc.out.MovXmmToMem("xmm15", "rsp", slot)
+		default:
+			// Only the low size bytes of an integer argument are defined
+			if reg != "" {
+				fc.out.MovRegToMem(reg, "rsp", slot)
+				base, offset = "rsp", slot
+			}
+			fc.loadCInteger("rax", base, offset, kind, size)
+			fc.out.Cvtsi2sd("xmm15", "rax")
+			fc.out.MovXmmToMem("xmm15", "rsp", slot)
+		}
+	}
+
+	for i := range ct.Params {
+		fc.out.MovMemToXmm(fmt.Sprintf("xmm%d", i), "rsp", 8*i)
+	}
+	call()
+
+	if ct.Return != "void" {
+		kind, size, _ := cTypeLayout(ct.Return, windows)
+		switch {
+		case kind == 'f' && size == 4:
+			fc.out.Cvtsd2ss("xmm0", "xmm0")
+		case kind != 'f':
+			fc.out.Cvttsd2si("rax", "xmm0")
+		}
+	}
+
+	for i, reg := range savedXmm {
+		fc.out.MovupdMemToXmm(reg, "rsp", args+16*i)
+	}
+	fc.out.LeaMemToReg("rsp", "rbp", -8*len(saved))
+	for i := len(saved) - 1; i >= 0; i-- {
+		fc.out.PopReg(saved[i])
+	}
+	fc.out.PopReg("rbp")
+	fc.out.Ret()
+}
+
+// loadCInteger sign- or zero-extends a C integer of size bytes into reg
+func (fc *C67Compiler) loadCInteger(reg, base string, offset int, kind byte, size int) {
+	switch {
+	case size == 1 && kind == 'i':
+		fc.out.MovI8MemToReg(reg, base, offset)
+	case size == 1:
+		fc.out.MovU8MemToReg(reg, base, offset)
+	case size == 2 && kind == 'i':
+		fc.out.MovI16MemToReg(reg, base, offset)
+	case size == 2:
+		fc.out.MovU16MemToReg(reg, base, offset)
+	case size == 4 && kind == 'i':
+		fc.out.MovI32MemToReg(reg, base, offset)
+	case size == 4:
+		fc.out.MovU32MemToReg(reg, base, offset)
+	default:
+		fc.out.MovMemToReg(reg, base, offset)
+	}
+}
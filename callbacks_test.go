@@ -0,0 +1,238 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"math"
+	"runtime"
+	"testing"
+)
+
+func TestParseCallbackType(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"p = f as fn(cptr, cptr) -> int32", "fn(cptr,cptr)->int32"},
+		{"p = f as fn(int, float) -> double", "fn(int,float)->double"},
+		{"p = f as fn(cptr)", "fn(cptr)->void"},
+		{"p = f as fn() -> uint8", "fn()->uint8"},
+	}
+	for _, tt := range tests {
+		program := NewParser(tt.code).ParseProgram()
+		cast := program.Statements[0].(*AssignStmt).Value.(*CastExpr)
+		if cast.Type != tt.want {
+			t.Errorf("%s: type %q, want %q", tt.code, cast.Type, tt.want)
+			continue
+		}
+		ct, ok := parseCallbackType(cast.Type)
+		if !ok || ct.String() != tt.want {
+			t.Errorf("%s: parseCallbackType(%q) = %v, %v", tt.code, cast.Type, ct, ok)
+		}
+	}
+}
+
+// callbackCall is one call through a thunk: the C arguments by register
+// (or stack slot for Windows x64), and the expected raw result
+type callbackCall struct {
+	name   string
+	cc     CallingConvention
+	ct     *CallbackType
+	lambda string // "scale" (xmm0 * env - xmm1) or "sum" (xmm0 + ... + xmm5)
+	regs   map[string]uint64
+	stack  []uint64 // Windows x64 arguments beyond the fourth
+	float  bool     // result in xmm0 rather than rax
+	want   uint64
+}
+
+func TestCallbackTrampolines(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.Skip("runs a static x86-64 Linux executable")
+	}
+	f64 := math.Float64bits
+	f32 := func(f float32) uint64 { return uint64(math.Float32bits(f)) | 0xdead_beef_0000_0000 }
+	sysv, win := &SystemVAMD64{}, &MicrosoftX64{}
+	calls := []callbackCall{
+		// Only the low bytes of narrow integers count
+		{"sysv int32 int8", sysv, &CallbackType{[]string{"int32", "int8"}, "int32"}, "scale",
+			map[string]uint64{"rdi": 0xffff_ffff_0000_0007, "rsi": 0x1234_56fe}, nil, false, 23},
+		{"win int32 int8", win, &CallbackType{[]string{"int32", "int8"}, "int32"}, "scale",
+			map[string]uint64{"rcx": 0xffff_ffff_0000_0007, "rdx": 0x1234_56fe}, nil, false, 23},
+		{"sysv uint16 cptr", sysv, &CallbackType{[]string{"uint16", "cptr"}, "int64"}, "scale",
+			map[string]uint64{"rdi": 0xffff_fffe, "rsi": 4}, nil, false, 3*0xfffe - 4},
+		// Floats widen to float64 and the result narrows back
+		{"sysv double float", sysv, &CallbackType{[]string{"double", "float"}, "float"}, "scale",
+			map[string]uint64{"xmm0": f64(2.5), "xmm1": f32(0.5)}, nil, true, uint64(math.Float32bits(7))},
+		{"win double float", win, &CallbackType{[]string{"double", "float"}, "double"}, "scale",
+			map[string]uint64{"xmm0": f64(2.5), "xmm1": f32(0.5)}, nil, true, f64(7)},
+		// System V counts integer and float registers apart, Windows by position
+		{"sysv int32 double", sysv, &CallbackType{[]string{"int32", "double"}, "int32"}, "scale",
+			map[string]uint64{"rdi": 5, "xmm0": f64(1)}, nil, false, 14},
+		{"win int32 double", win, &CallbackType{[]string{"int32", "double"}, "int32"}, "scale",
+			map[string]uint64{"rcx": 5, "xmm1": f64(1)}, nil, false, 14},
+		{"win stack arguments", win, &CallbackType{[]string{"int", "int", "double", "int", "int", "float"}, "long"}, "sum",
+			map[string]uint64{"rcx": 1, "rdx": 2, "xmm2": f64(3), "r9": 4}, []uint64{5, f32(6)}, false, 21},
+		{"sysv six arguments", sysv, &CallbackType{[]string{"int", "double", "int", "double", "int", "int"}, "uint8"}, "sum",
+			map[string]uint64{"rdi": 1, "xmm0": f64(2), "rsi": 3, "xmm1": f64(4), "rdx": 5, "rcx": 0x1_0000_0006}, nil, false, 21},
+	}
+
+	fc, err := NewC67Compiler(Platform{OS: OSLinux, Arch: ArchX86_64}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setReg := func(reg string, imm uint64) {
+		target := reg
+		if isXmmReg(reg) {
+			target = "rax"
+		}
+		r, _ := GetRegister(ArchX86_64, target)
+		code := []byte{0x48 | byte(r.Encoding>>3), 0xb8 + byte(r.Encoding&7), 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(code[2:], imm)
+		fc.out.Emit(code)
+		if isXmmReg(reg) {
+			fc.out.MovRegToXmm(reg, "rax")
+		}
+	}
+	const canary = 0x0123_4567_89ab_cdef
+	results := len(calls) + 3
+
+	// Fill in the closure objects, then call through a thunk per call
+	frame := (8*results + 15) &^ 15
+	fc.out.SubImmFromReg("rsp", int64(frame))
+	for _, lambda := range []string{"scale", "sum"} {
+		fc.out.LeaSymbolToReg("rcx", "closure_"+lambda)
+		fc.out.LeaSymbolToReg("rax", lambda)
+		fc.out.MovRegToMem("rax", "rcx", 0)
+		fc.out.LeaSymbolToReg("rax", "env")
+		fc.out.MovRegToMem("rax", "rcx", 8)
+	}
+	for i, call := range calls {
+		fc.out.LeaSymbolToReg("rdi", "slots_"+call.name)
+		fc.out.LeaSymbolToReg("rdx", "closure_"+call.lambda)
+		fc.out.CallSymbol("site_" + call.name)
+		fc.out.MovRegToReg("rbx", "rax")
+		if len(call.stack) > 0 {
+			fc.out.SubImmFromReg("rsp", 48)
+			for j, v := range call.stack {
+				setReg("rax", v)
+				fc.out.MovRegToMem("rax", "rsp", 32+8*j)
+			}
+		}
+		for reg, v := range call.regs {
+			setReg(reg, v)
+		}
+		setReg("r12", canary)
+		fc.out.CallRegister("rbx")
+		if len(call.stack) > 0 {
+			fc.out.AddImmToReg("rsp", 48)
+		}
+		if call.float {
+			fc.out.MovqXmmToReg("rax", "xmm0")
+		}
+		fc.out.MovRegToMem("rax", "rsp", 8*i)
+	}
+	fc.out.MovRegToMem("r12", "rsp", 8*len(calls))
+
+	// A second closure gets the next thunk; the first keeps its own
+	n := len(calls)
+	for i, closure := range []string{"closure_sum", "closure_scale"} {
+		fc.out.LeaSymbolToReg("rdi", "slots_"+calls[0].name)
+		fc.out.LeaSymbolToReg("rdx", closure)
+		fc.out.CallSymbol("site_" + calls[0].name)
+		fc.out.LeaSymbolToReg("rcx", "thunks_"+calls[0].name)
+		fc.out.SubRegFromReg("rax", "rcx")
+		fc.out.MovRegToMem("rax", "rsp", 8*(n+1+i))
+	}
+
+	// write(1, results), exit(0)
+	fc.out.MovImmToReg("rdi", "1")
+	fc.out.MovRegToReg("rsi", "rsp")
+	fc.out.MovImmToReg("rdx", "0")
+	fc.out.AddImmToReg("rdx", int64(8*results))
+	fc.out.MovImmToReg("rax", "1")
+	fc.out.Syscall()
+	fc.out.MovImmToReg("rdi", "0")
+	fc.out.MovImmToReg("rax", "60")
+	fc.out.Syscall()
+
+	// The lambdas: xmm0 * [r15] - xmm1, and xmm0 + ... + xmm5
+	fc.eb.MarkLabel("scale")
+	fc.out.Emit([]byte{0xf2, 0x41, 0x0f, 0x10, 0x17}) // movsd xmm2, [r15]
+	fc.out.Emit([]byte{0xf2, 0x0f, 0x59, 0xc2})       // mulsd xmm0, xmm2
+	fc.out.Emit([]byte{0xf2, 0x0f, 0x5c, 0xc1})       // subsd xmm0, xmm1
+	fc.out.Ret()
+	fc.eb.MarkLabel("sum")
+	for _, modrm := range []byte{0xc1, 0xc2, 0xc3, 0xc4, 0xc5} {
+		fc.out.Emit([]byte{0xf2, 0x0f, 0x58, modrm}) // addsd xmm0, xmmN
+	}
+	fc.out.Ret()
+
+	fc.generateCallbackThunkLookup()
+	for _, call := range calls {
+		fc.generateCallbackTrampoline("trampoline_"+call.name, call.ct, call.cc)
+		fc.generateCallbackThunks("site_"+call.name, "thunks_"+call.name, "slots_"+call.name, "trampoline_"+call.name)
+	}
+
+	// Closure objects and slot tables live in the writable text segment
+	fc.eb.MarkLabel("env")
+	fc.out.Emit(binary.LittleEndian.AppendUint64(nil, f64(3)))
+	for _, name := range []string{"closure_scale", "closure_sum"} {
+		fc.eb.MarkLabel(name)
+		fc.out.Emit(make([]byte, 16))
+	}
+	for _, call := range calls {
+		fc.eb.MarkLabel("slots_" + call.name)
+		fc.out.Emit(make([]byte, 8*callbackPoolSize))
+	}
+
+	// The thunks keep their environment next to the code
+	out := runStaticELF(t, fc, "callbacks", elf.PF_R|elf.PF_W|elf.PF_X)
+	if len(out) < 8*results {
+		t.Fatalf("got %d bytes of output, want %d", len(out), 8*results)
+	}
+	le := binary.LittleEndian
+	for i, call := range calls {
+		got := le.Uint64(out[8*i:])
+		if call.float && call.ct.Return == "float" {
+			got &= 0xffff_ffff
+		} else if !call.float && call.ct.Return != "int64" && call.ct.Return != "long" {
+			got = uint64(int64(int32(got)))
+			if call.ct.Return == "uint8" {
+				got &= 0xff
+			}
+		}
+		if got != call.want {
+			t.Errorf("%s: result %#x, want %#x", call.name, got, call.want)
+		}
+	}
+	if got := le.Uint64(out[8*n:]); got != canary {
+		t.Errorf("r12 after the calls = %#x, want %#x", got, uint64(canary))
+	}
+	if got := le.Uint64(out[8*(n+1):]); got != callbackThunkSize {
+		t.Errorf("second closure got thunk at offset %d, want %d", got, callbackThunkSize)
+	}
+	if got := le.Uint64(out[8*(n+2):]); got != 0 {
+		t.Errorf("first closure moved to thunk offset %d, want 0", got)
+	}
+}
+
+func TestCallbackQsort(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("callbacks are only emitted by the x86-64 backend")
+	}
+	code := `import "c" as c
+desc = (a, b) -> read_i32(b, 0) - read_i32(a, 0)
+buf = c.malloc(16)
+write_i32(buf, 0, 3)
+write_i32(buf, 1, 1)
+write_i32(buf, 2, 2)
+c.qsort(buf, 3, 4, desc as fn(cptr, cptr) -> int32)
+printf("%v %v %v\n", read_i32(buf, 0), read_i32(buf, 1), read_i32(buf, 2))
+c.qsort(buf, 3, 4, ((a, b) -> read_i32(a, 0) - read_i32(b, 0)) as fn(cptr, cptr) -> int32)
+printf("%v %v %v\n", read_i32(buf, 0), read_i32(buf, 1), read_i32(buf, 2))
+`
+	want := "3.000000 2.000000 1.000000\n1.000000 2.000000 3.000000\n"
+	if got := compileAndRun(t, code); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
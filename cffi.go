@@ -24,6 +24,18 @@ type CFunctionParam struct {
 type CFunctionSignature struct {
 	ReturnType string           // e.g., "int", "SDL_Window*", "void"
 	Params     []CFunctionParam // function parameters
+	Variadic   bool             // the parameters end in "...", like printf
+}
+
+// newCFunctionSignature makes a signature, turning a trailing "..."
+// parameter into the variadic flag
+func newCFunctionSignature(returnType string, params []CFunctionParam) *CFunctionSignature {
+	sig := &CFunctionSignature{ReturnType: returnType, Params: params}
+	if n := len(params); n > 0 && strings.ReplaceAll(params[n-1].Type, " ", "") == "..." {
+		sig.Params = params[:n-1]
+		sig.Variadic = true
+	}
+	return sig
 }
 
 // CHeaderConstants stores constants and function signatures extracted from C headers
@@ -31,6 +43,8 @@ type CHeaderConstants struct {
 	Constants map[string]int64               // constant name -> value
 	Macros    map[string]string              // macro name -> definition (for simple function-like macros)
 	Functions map[string]*CFunctionSignature // function name -> signature
+	Records   map[string]*CRecord            // "struct Tag" or "union Tag" -> definition
+	Typedefs  map[string]CTypeRef            // typedef name -> aliased type
 }
 
 // NewCHeaderConstants creates a new constants store
@@ -39,12 +53,15 @@ func NewCHeaderConstants() *CHeaderConstants {
 		Constants: make(map[string]int64),
 		Macros:    make(map[string]string),
 		Functions: make(map[string]*CFunctionSignature),
+		Records:   make(map[string]*CRecord),
+		Typedefs:  make(map[string]CTypeRef),
 	}
 }
 
 // ExtractConstantsFromLibrary extracts #define constants from a C library's headers
-// Uses pkg-config to find include paths and parses the main header file
-func ExtractConstantsFromLibrary(libName string) (*CHeaderConstants, error) {
+// Uses pkg-config to find include paths and parses the main header file.
+// The directories in dirs are searched first.
+func ExtractConstantsFromLibrary(libName string, dirs ...string) (*CHeaderConstants, error) {
 	constants := NewCHeaderConstants()
 
 	// Get include paths from pkg-config
@@ -54,10 +71,13 @@ func ExtractConstantsFromLibrary(libName string) (*CHeaderConstants, error) {
 			fmt.Fprintf(os.Stderr, "Warning: pkg-config not available for %s: %v\n", libName, err)
 		}
 		// Fallback to standard paths including local include directory
-		includePaths = []string{"./include", "/usr/include", "/usr/local/include"}
+		includePaths = cIncludePaths("./include", "/usr/include", "/usr/local/include")
+	} else {
+		includePaths = cIncludePaths(includePaths...)
 	}
 
 	// Try to find and parse the main header file
+	includePaths = append(dirs, includePaths...)
 	headerFile := findMainHeader(libName, includePaths)
 	if headerFile == "" {
 		if VerboseMode {
@@ -132,7 +152,7 @@ func getPkgConfigIncludes(libName string) ([]string, error) {
 
 	// If pkg-config succeeded but no -I flags found, use standard include paths
 	if pkgConfigSucceeded {
-		standardPaths := []string{"./include", "/usr/include", "/usr/local/include"}
+		standardPaths := cIncludePaths("./include", "/usr/include", "/usr/local/include")
 		if VerboseMode {
 			fmt.Fprintf(os.Stderr, "No -I flags from pkg-config, using standard paths\n")
 		}
@@ -241,6 +261,12 @@ func parseHeaderFileWithDepth(headerPath string, constants *CHeaderConstants, vi
 	for k, v := range parsedResults.Functions {
 		constants.Functions[k] = v
 	}
+	for k, v := range parsedResults.Records {
+		constants.Records[k] = v
+	}
+	for k, v := range parsedResults.Typedefs {
+		constants.Typedefs[k] = v
+	}
 
 	if VerboseMode {
 		if len(parsedResults.Functions) > 0 {
@@ -283,7 +309,7 @@ func parseIncludesWithDepth(headerPath string, constants *CHeaderConstants, visi
 			// If it's an absolute library include like <SDL3/SDL_init.h>
 			// Try standard include paths
 			if strings.Contains(includedFile, "/") {
-				for _, standardPath := range []string{"./include", "/usr/include", "/usr/local/include"} {
+				for _, standardPath := range cIncludePaths("./include", "/usr/include", "/usr/local/include") {
 					testPath := filepath.Join(standardPath, includedFile)
 					if _, err := os.Stat(testPath); err == nil {
 						includedPath = testPath
@@ -372,7 +398,7 @@ func parseHeaderFileRecursive(headerPath string, constants *CHeaderConstants, vi
 			// If it's an absolute library include like <SDL3/SDL_init.h>
 			// Try standard include paths
 			if strings.Contains(includedFile, "/") {
-				for _, standardPath := range []string{"./include", "/usr/include", "/usr/local/include"} {
+				for _, standardPath := range cIncludePaths("./include", "/usr/include", "/usr/local/include") {
 					testPath := filepath.Join(standardPath, includedFile)
 					if _, err := os.Stat(testPath); err == nil {
 						includedPath = testPath
@@ -401,10 +427,7 @@ func parseHeaderFileRecursive(headerPath string, constants *CHeaderConstants, vi
 			paramsStr := strings.TrimSpace(funcMatches[3])
 
 			// Parse parameters
-			sig := &CFunctionSignature{
-				ReturnType: returnType,
-				Params:     parseFunctionParams(paramsStr),
-			}
+			sig := newCFunctionSignature(returnType, parseFunctionParams(paramsStr))
 
 			constants.Functions[funcName] = sig
 
@@ -704,9 +727,9 @@ func ExtractSymbolsFromSo(soPath string) ([]string, error) {
 
 	var funcSymbols []string
 	for _, sym := range symbols {
-		// Only include function symbols (STT_FUNC)
-		// elf.STT_FUNC = 2
-		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC {
+		// Only include function symbols (STT_FUNC) the library defines;
+		// undefined ones are its own imports
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Section != elf.SHN_UNDEF {
 			funcSymbols = append(funcSymbols, sym.Name)
 		}
 	}
@@ -814,7 +837,7 @@ func tryParseHeaders(libraryName string, additionalPaths []string) map[string]*C
 
 	// Try to parse each header
 	for _, header := range headers {
-		sigs := parseHeaderForFunctions(header, additionalPaths)
+		sigs := parseHeaderForFunctions(header, cIncludePaths(additionalPaths...))
 		for name, sig := range sigs {
 			if _, exists := signatures[name]; !exists {
 				signatures[name] = sig
@@ -933,10 +956,7 @@ func extractFunctionDeclarations(preprocessed string) map[string]*CFunctionSigna
 			}
 		}
 
-		signatures[funcName] = &CFunctionSignature{
-			ReturnType: returnType,
-			Params:     params,
-		}
+		signatures[funcName] = newCFunctionSignature(returnType, params)
 	}
 
 	return signatures
@@ -951,7 +971,12 @@ func ExtractFunctionSignatures(soPath string) (map[string]*CFunctionSignature, e
 		return nil, fmt.Errorf("failed to open ELF file: %v", err)
 	}
 	defer elfFile.Close()
+	return dwarfFunctionSignatures(elfFile)
+}
 
+// dwarfFunctionSignatures reads the function signatures in the DWARF debug
+// info of an ELF file, which can also be an object file from an archive
+func dwarfFunctionSignatures(elfFile *elf.File) (map[string]*CFunctionSignature, error) {
 	// Get DWARF debug info
 	dwarfData, err := elfFile.DWARF()
 	if err != nil {
@@ -1037,6 +1062,11 @@ func parseFunctionEntry(entry *dwarf.Entry, reader *dwarf.Reader, data *dwarf.Da
 			sig.Params = append(sig.Params, param)
 		}
 
+		// A trailing "..." in the prototype
+		if childEntry.Tag == dwarf.TagUnspecifiedParameters {
+			sig.Variadic = true
+		}
+
 		// Skip children of this entry (if any)
 		if childEntry.Children {
 			reader.SkipChildren()
@@ -1061,15 +1091,14 @@ func resolveTypeName(offset dwarf.Offset, data *dwarf.Data) string {
 		if nameAttr := entry.Val(dwarf.AttrName); nameAttr != nil {
 			typeName := nameAttr.(string)
 
-			// Map C types to simplified categories
+			// Map floating-point types to simplified categories; integer
+			// types keep their name ("long unsigned int"), whose width
+			// decides how a result is extended
 			switch {
 			case strings.Contains(typeName, "float"):
 				return "float"
 			case strings.Contains(typeName, "double"):
 				return "double"
-			case strings.Contains(typeName, "int") || strings.Contains(typeName, "long") ||
-				strings.Contains(typeName, "short") || strings.Contains(typeName, "char"):
-				return "int"
 			default:
 				return typeName
 			}
@@ -1081,11 +1110,30 @@ func resolveTypeName(offset dwarf.Offset, data *dwarf.Data) string {
 		return "pointer"
 	}
 
+	// Handle structs and unions, which may be passed by value as cstructs
+	if entry.Tag == dwarf.TagStructType || entry.Tag == dwarf.TagUnionType {
+		kind := "struct"
+		if entry.Tag == dwarf.TagUnionType {
+			kind = "union"
+		}
+		if nameAttr := entry.Val(dwarf.AttrName); nameAttr != nil {
+			return kind + " " + nameAttr.(string)
+		}
+		return kind
+	}
+
 	// Handle typedef
 	if entry.Tag == dwarf.TagTypedef {
 		if typeAttr := entry.Val(dwarf.AttrType); typeAttr != nil {
 			if typeOffset, ok := typeAttr.(dwarf.Offset); ok {
-				return resolveTypeName(typeOffset, data)
+				resolved := resolveTypeName(typeOffset, data)
+				// typedef struct { ... } Vector2 is known by the typedef's name
+				if strings.HasPrefix(resolved, "struct") || strings.HasPrefix(resolved, "union") {
+					if nameAttr := entry.Val(dwarf.AttrName); nameAttr != nil {
+						return nameAttr.(string)
+					}
+				}
+				return resolved
 			}
 		}
 	}
@@ -29,6 +29,7 @@ type CFunction struct {
 	Name       string
 	ReturnType string
 	Params     []CFunctionParam
+	Variadic   bool   // the parameters end in "..."
 	Library    string // Which DLL/SO exports this function
 	Ordinal    uint16 // For Windows PE files
 	RVA        uint32 // Relative Virtual Address (Windows)
@@ -86,10 +87,10 @@ func getDefaultTypeMappings() map[string]string {
 	}
 }
 
-// ParseHeader parses a C header file and extracts constants and function signatures
+// ParseHeader parses a C header file and extracts constants, function
+// signatures, and the structs, unions and typedefs they use
 func (cm *CFFIManager) ParseHeader(filepath string) error {
-	parser := NewCParser()
-	constants, err := parser.ParseFile(filepath)
+	constants, err := ParseCHeaderFile(filepath)
 	if err != nil {
 		return fmt.Errorf("failed to parse header %s: %v", filepath, err)
 	}
@@ -104,6 +105,14 @@ func (cm *CFFIManager) ParseHeader(filepath string) error {
 		cm.headerConstants.Macros[name] = value
 	}
 
+	// Merge types
+	for name, record := range constants.Records {
+		cm.headerConstants.Records[name] = record
+	}
+	for name, ref := range constants.Typedefs {
+		cm.headerConstants.Typedefs[name] = ref
+	}
+
 	// Merge and upgrade function signatures
 	for name, sig := range constants.Functions {
 		cm.headerConstants.Functions[name] = sig
@@ -111,6 +120,7 @@ func (cm *CFFIManager) ParseHeader(filepath string) error {
 			Name:       name,
 			ReturnType: sig.ReturnType,
 			Params:     sig.Params,
+			Variadic:   sig.Variadic,
 		}
 	}
 
@@ -133,6 +143,9 @@ func (cm *CFFIManager) ParseDLLExports(libName, filepath string) error {
 
 	// Match exports with known function signatures from headers
 	for _, export := range exports {
+		if export.Name == "" {
+			continue // exported by ordinal only
+		}
 		if sig, ok := cm.headerConstants.Functions[export.Name]; ok {
 			// We have both header signature and DLL export
 			cm.functions[export.Name] = &CFunction{
@@ -166,6 +179,48 @@ func (cm *CFFIManager) ParseDLLExports(libName, filepath string) error {
 	return nil
 }
 
+// ParseSharedObjectExports is the ELF counterpart of ParseDLLExports. An
+// exported function keeps its header signature; one that no header
+// declares gets its signature from the library's DWARF info, if it was
+// built with -g. Exports with neither are left out, since calling them
+// would mean guessing their types.
+func (cm *CFFIManager) ParseSharedObjectExports(libName, filepath string) error {
+	symbols, err := ExtractSymbolsFromSo(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to parse shared object %s: %v", filepath, err)
+	}
+	dwarfSigs, err := ExtractFunctionSignatures(filepath)
+	if err != nil && VerboseMode {
+		fmt.Fprintf(os.Stderr, "Warning: failed to read DWARF info of %s: %v\n", filepath, err)
+	}
+
+	exports := make([]ExportedFunction, 0, len(symbols))
+	for _, name := range symbols {
+		exports = append(exports, ExportedFunction{Name: name})
+		sig, ok := cm.headerConstants.Functions[name]
+		if !ok {
+			if sig, ok = dwarfSigs[name]; !ok {
+				continue
+			}
+		}
+		cm.functions[name] = &CFunction{
+			Name:       name,
+			ReturnType: sig.ReturnType,
+			Params:     sig.Params,
+			Variadic:   sig.Variadic,
+			Library:    libName,
+		}
+	}
+	cm.dllExports[libName] = exports
+
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "Parsed shared object %s: %d exports, %d matched with headers\n",
+			filepath, len(exports), countMatched(exports, cm.headerConstants.Functions))
+	}
+
+	return nil
+}
+
 // countMatched counts how many exports have matching header signatures
 func countMatched(exports []ExportedFunction, headers map[string]*CFunctionSignature) int {
 	count := 0
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -15,6 +16,7 @@ import (
 // - vibe67 (default: compile current directory or show help)
 // - vibe67 build <file> (compile to executable)
 // - vibe67 run <file> (compile and run immediately)
+// - vibe67 bindgen <library|header> (generate C bindings, see bindgen.go)
 // - vibe67 <file.v67|.vibe67> (shorthand for build)
 //
 // Also supports shebang execution: #!/usr/bin/vibe67
@@ -73,7 +75,8 @@ func RunCLI(args []string, platform Platform, verbose, quiet bool, optTimeout fl
 	switch subcmd {
 	case "build":
 		if len(args) < 2 {
-			return fmt.Errorf("usage: vibe67 build <file.vibe67> [-o output]")
+			// Build the project in the current directory (uses vibe67.toml if present)
+			return cmdBuildDir(ctx, ".")
 		}
 		return cmdBuild(ctx, args[1:])
 
@@ -86,6 +89,12 @@ func RunCLI(args []string, platform Platform, verbose, quiet bool, optTimeout fl
 	case "test":
 		return cmdTest(ctx, args[1:])
 
+	case "mod":
+		return cmdMod(ctx, args[1:])
+
+	case "bindgen":
+		return cmdBindgen(ctx, args[1:])
+
 	case "help", "--help", "-h":
 		return cmdHelp(ctx)
 
@@ -125,6 +134,8 @@ func cmdBuild(ctx *CommandContext, args []string) error {
 		if args[i] == "-o" && i+1 < len(args) {
 			outputPath = args[i+1]
 			i++ // Skip the output filename
+		} else if args[i] == "-offline" || args[i] == "--offline" {
+			OfflineFlag = true
 		} else if !strings.HasPrefix(args[i], "-") {
 			inputFiles = append(inputFiles, args[i])
 		}
@@ -134,6 +145,16 @@ func cmdBuild(ctx *CommandContext, args []string) error {
 		return fmt.Errorf("no input files specified")
 	}
 
+	// A single directory argument builds the project in that directory
+	if len(inputFiles) == 1 {
+		if info, err := os.Stat(inputFiles[0]); err == nil && info.IsDir() {
+			if outputPath != "" {
+				ctx.OutputPath = outputPath
+			}
+			return cmdBuildDir(ctx, inputFiles[0])
+		}
+	}
+
 	// Check all files exist
 	for _, file := range inputFiles {
 		if _, err := os.Stat(file); os.IsNotExist(err) {
@@ -338,7 +359,17 @@ func cmdRunShebang(ctx *CommandContext, scriptPath string, scriptArgs []string)
 
 // cmdBuildDir finds the main .vibe67 file in a directory and compiles it
 // (does not compile test files or library files)
+// If the directory has a vibe67.toml manifest, its entry file, targets and
+// build options are used instead of the flags.
 func cmdBuildDir(ctx *CommandContext, dirPath string) error {
+	manifest, err := ReadManifest(dirPath)
+	if err != nil {
+		return err
+	}
+	if manifest != nil && manifest.Entry != "" {
+		return buildWithManifest(ctx, manifest, filepath.Join(dirPath, manifest.Entry))
+	}
+
 	matches, err := filepath.Glob(filepath.Join(dirPath, "*.vibe67"))
 	if err != nil {
 		return fmt.Errorf("failed to find .vibe67 files: %v", err)
@@ -379,6 +410,10 @@ func cmdBuildDir(ctx *CommandContext, dirPath string) error {
 		return fmt.Errorf("no main function found in .vibe67 files in %s", dirPath)
 	}
 
+	if manifest != nil {
+		return buildWithManifest(ctx, manifest, mainFile)
+	}
+
 	// Compile the main file
 	outputPath := strings.TrimSuffix(filepath.Base(mainFile), ".vibe67")
 	if ctx.Platform.OS == OSWindows {
@@ -406,6 +441,56 @@ func cmdBuildDir(ctx *CommandContext, dirPath string) error {
 	return nil
 }
 
+// buildWithManifest compiles mainFile once for every target in the manifest
+// (or for ctx.Platform if none are listed), with the manifest's build options
+func buildWithManifest(ctx *CommandContext, manifest *Manifest, mainFile string) error {
+	if _, err := os.Stat(mainFile); err != nil {
+		return fmt.Errorf("%s: entry file %s not found", manifest.Path, mainFile)
+	}
+
+	targets := manifest.Targets
+	if len(targets) == 0 {
+		targets = []Platform{ctx.Platform}
+	}
+
+	oldManifest, oldSingleFlag := activeManifest, SingleFlag
+	oldCompress, oldTiny, oldWindows := CompressFlag, TinyFlag, WindowsOptions
+	activeManifest = manifest
+	SingleFlag = false // allow imports from the same directory
+	CompressFlag = CompressFlag || manifest.Compress
+	TinyFlag = TinyFlag || manifest.Tiny
+	WindowsOptions = WindowsOptions.merge(manifest.Windows)
+	defer func() {
+		activeManifest, SingleFlag = oldManifest, oldSingleFlag
+		CompressFlag, TinyFlag, WindowsOptions = oldCompress, oldTiny, oldWindows
+	}()
+
+	if ctx.Verbose {
+		fmt.Fprintf(os.Stderr, "Using manifest %s\n", manifest.Path)
+		if len(manifest.Dependencies) > 0 {
+			fmt.Fprintf(os.Stderr, "Pinned dependencies: %s\n", strings.Join(manifest.DependencyList(), ", "))
+		}
+	}
+
+	fallback := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(mainFile), ".vibe67"), ".v67")
+	for _, platform := range targets {
+		outputPath := manifest.OutputName(fallback, platform)
+		if ctx.OutputPath != "" && len(targets) == 1 {
+			outputPath = ctx.OutputPath
+		}
+		if ctx.Verbose {
+			fmt.Fprintf(os.Stderr, "Building %s -> %s (%s)\n", mainFile, outputPath, platform.FullString())
+		}
+		if err := CompileC67WithOptions(mainFile, outputPath, platform, ctx.OptTimeout, ctx.Verbose, ctx.DepsOnly); err != nil {
+			return fmt.Errorf("compilation of %s for %s failed: %v", mainFile, platform.FullString(), err)
+		}
+		if ctx.Verbose {
+			fmt.Printf("Built: %s\n", outputPath)
+		}
+	}
+	return nil
+}
+
 // cmdTest runs all test_*.vibe67 and *_test.vibe67 files in the current directory
 func cmdTest(ctx *CommandContext, args []string) error {
 	// Determine directory to search (only consider non-flag arguments)
@@ -591,6 +676,68 @@ func cmdTest(ctx *CommandContext, args []string) error {
 	return nil
 }
 
+// cmdMod manages the vibe67.lock file of a project
+func cmdMod(ctx *CommandContext, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: vibe67 mod <tidy|verify|vendor> [directory]")
+	}
+
+	dir := "."
+	if len(args) > 1 {
+		dir = args[1]
+	}
+
+	switch args[0] {
+	case "tidy":
+		lock, err := TidyLockFile(dir, ctx.UpdateDeps)
+		if err != nil {
+			return err
+		}
+		if !ctx.Quiet {
+			repos := make([]string, 0, len(lock.Entries))
+			for repo := range lock.Entries {
+				repos = append(repos, repo)
+			}
+			sort.Strings(repos)
+			for _, repo := range repos {
+				e := lock.Entries[repo]
+				fmt.Printf("%s %s %s\n", e.Repo, e.Version, e.Commit)
+			}
+			fmt.Printf("Wrote %s (%d dependencies)\n", lock.Path, len(lock.Entries))
+		}
+		return nil
+
+	case "vendor":
+		lock, err := VendorModules(dir, ctx.UpdateDeps)
+		if err != nil {
+			return err
+		}
+		if !ctx.Quiet {
+			fmt.Printf("Vendored %d modules into %s\n", len(lock.Entries), filepath.Join(dir, VendorDirName))
+		}
+		return nil
+
+	case "verify":
+		problems, err := VerifyLockFile(dir)
+		if err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			for _, problem := range problems {
+				fmt.Fprintln(os.Stderr, problem)
+			}
+			return fmt.Errorf("%d of the locked modules failed verification", len(problems))
+		}
+		if !ctx.Quiet {
+			fmt.Println("all modules verified")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown mod command: %s (expected tidy, verify or vendor)", args[0])
+	}
+}
+
 // cmdHelp displays usage information
 func cmdHelp(ctx *CommandContext) error {
 	fmt.Printf(`vibe67 - The Vibe67 Compiler (Version 1.5.0)
@@ -600,8 +747,13 @@ USAGE:
 
 COMMANDS:
     build <file.vibe67>      Compile a Vibe67 source file to an executable
+    build [directory]     Build the project in a directory (uses vibe67.toml if present)
     run <file.vibe67>        Compile and run a Vibe67 program immediately
     test [directory]      Run all test_*.vibe67 files (default: current directory)
+    mod tidy [dir]        Pin all Git dependencies in vibe67.lock
+    mod verify [dir]      Check cached dependencies against vibe67.lock
+    mod vendor [dir]      Copy all pinned dependencies into vendor_v67/
+    bindgen <lib|file.h>  Generate a module that binds a C library
     help                  Show this help message
     version               Show version information
 
@@ -619,6 +771,8 @@ FLAGS (can be used with any command):
     --target <platform>    Target platform: amd64-linux, arm64-macos, etc.
     --opt-timeout <secs>   Optimization timeout in seconds (default: 2.0)
     -u, --update-deps      Update dependency repositories from Git
+    -offline               Never access the network (use vendor_v67/ and the cache)
+    --no-cache             Do not use the build cache of parsed modules and executables
     -s, --single           Compile single file only (don't load siblings)
 
 EXAMPLES:
@@ -637,6 +791,18 @@ EXAMPLES:
     vibe67 test
     vibe67 test ./tests
 
+    # Pin dependencies for reproducible builds
+    vibe67 mod tidy
+    vibe67 mod verify
+
+    # Build without network access (e.g. on CI)
+    vibe67 mod vendor
+    vibe67 -offline build main.vibe67
+
+    # Generate bindings to check in (pkg-config name, or header and library)
+    vibe67 bindgen zlib -o zlib.v67
+    vibe67 bindgen include/foo.h lib/libfoo.so -o foo.v67
+
     # Shebang execution (add #!/usr/bin/vibe67 to first line of .vibe67 file)
     chmod +x script.vibe67
     ./script.vibe67 arg1 arg2
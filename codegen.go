@@ -67,6 +67,7 @@ type C67Compiler struct {
 	platform             Platform                      // Target platform (arch + OS)
 	variables            map[string]int                // variable name -> stack offset
 	mutableVars          map[string]bool               // variable name -> is mutable
+	lambdaParams         map[string]bool               // parameters of the lambda being compiled, which hide globals
 	lambdaVars           map[string]bool               // variable name -> is lambda/function
 	parentVariables      map[string]bool               // Track parent-scope vars in parallel loops (use r11 instead of rbp)
 	varTypes             map[string]string             // variable name -> "map" or "list" (legacy)
@@ -77,9 +78,15 @@ type C67Compiler struct {
 	unknownFunctions     map[string]bool               // Track functions called but not defined
 	callOrder            []string                      // Track order of function calls
 	cImports             map[string]string             // Track C imports: alias -> library name
+	cstructs             map[string]*CStructDecl       // cstruct declarations, for by-value C calls
+	cImportStructs       map[string]*CStructDecl       // cstructs from C headers: "alias.Name" and "Name"
 	cLibHandles          map[string]string             // Track library handles: library -> handle var name
 	cConstants           map[string]*CHeaderConstants  // Track C constants: alias -> constants
 	cFunctionLibs        map[string]string             // Track which library each C function belongs to: function -> library
+	staticArchives       map[string]string             // C libraries imported as archives: library -> .a path
+	staticLink           *staticLinker                 // archive members linked into .text (see static_link.go)
+	staticLinkOffset     int                           // where the linked members start in .text
+	exports              []libraryExport               // functions a library build exports (see buildmode.go)
 	stringCounter        int                           // Counter for unique string labels
 	stackOffset          int                           // Current stack offset for variables (logical)
 	maxStackOffset       int                           // Maximum stack offset reached (for frame allocation)
@@ -105,12 +112,21 @@ type C67Compiler struct {
 	importedFunctions    []string                      // Track imported C functions (malloc, free, etc.)
 	cacheEnabledLambdas  map[string]bool               // Track which lambdas use cme
 	deferredExprs        [][]Expression                // Stack of deferred expressions per scope (LIFO order)
+	heldLocks            []heldLock                    // Stack of mutexes held by enclosing lock blocks
+	usesSync             bool                          // Track if program uses mutexes, rwlocks, condvars or queues
 	memoCaches           map[string]bool               // Track memoization caches that need storage allocation
 	currentAssignName    string                        // Name of variable being assigned (for lambda naming)
 	inTailPosition       bool                          // True when compiling expression in tail position
 	hotFunctions         map[string]bool               // Track hot-reloadable functions
 	hotFunctionTable     map[string]int
-	hotTableRodataOffset int
+	profileCounters      map[string]int // Offset of each -profile-generate counter in _vibe67_profile
+	escapes              *EscapeAnalysis
+	scalars              *ScalarAnalysis
+	ownership            *ListOwnership
+	persistent           *PersistentBindings
+	callbacks            *Callbacks
+	stackSlots           map[Expression]int // Allocation site -> distance of its stack slot below rbp
+	lambdaCodeEndOffsets map[string]int
 	tailCallsOptimized   int // Count of tail calls optimized
 	nonTailCalls         int // Count of non-tail recursive calls
 
@@ -221,7 +237,9 @@ func NewC67Compiler(platform Platform, verbose bool) (*C67Compiler, error) {
 		cImports:            make(map[string]string),
 		cLibHandles:         make(map[string]string),
 		cConstants:          make(map[string]*CHeaderConstants),
+		cImportStructs:      make(map[string]*CStructDecl),
 		cFunctionLibs:       make(map[string]string),
+		staticArchives:      make(map[string]string),
 		lambdaOffsets:       make(map[string]int),
 		loopBaseOffsets:     make(map[int]int),
 		cacheEnabledLambdas: make(map[string]bool),
@@ -356,13 +374,13 @@ func (fc *C67Compiler) allocateMemoryPlatform(sizeReg string) {
 			fc.out.PushReg(sizeReg)
 		}
 
-		fc.out.MovImmToReg("rdi", "0")     // addr = NULL
-		fc.out.MovRegToReg("rsi", sizeReg) // length = size
-		fc.out.MovImmToReg("rdx", "3")     // prot = PROT_READ | PROT_WRITE
-		fc.out.MovImmToReg("r10", "34")    // flags = MAP_PRIVATE | MAP_ANONYMOUS
-		fc.out.MovImmToReg("r8", "-1")     // fd = -1
-		fc.out.MovImmToReg("r9", "0")      // offset = 0
-		fc.out.MovImmToReg("rax", "9")     // syscall number for mmap
+		fc.out.MovImmToReg("rdi", "0")                                    // addr = NULL
+		fc.out.MovRegToReg("rsi", sizeReg)                                // length = size
+		fc.out.MovImmToReg("rdx", "3")                                    // prot = PROT_READ | PROT_WRITE
+		fc.out.MovImmToReg("r10", fc.out.SysNum("MAP_PRIVATE_ANONYMOUS")) // flags = MAP_PRIVATE | MAP_ANONYMOUS
+		fc.out.MovImmToReg("r8", "-1")                                    // fd = -1
+		fc.out.MovImmToReg("r9", "0")                                     // offset = 0
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MMAP"))              // syscall number for mmap
 		fc.out.Syscall()
 
 		// Restore size register if we saved it
@@ -382,6 +400,32 @@ func (fc *C67Compiler) processCImports(program *Program) {
 				fmt.Fprintf(os.Stderr, "Registered C import: %s -> %s\n", cImport.Alias, cImport.Library)
 			}
 
+			// A module from vibe67 bindgen brings its prototypes along, so
+			// the library's headers and debug info are not read
+			if cImport.Prototypes != nil {
+				constants := NewCHeaderConstants()
+				constants.Functions = cImport.Prototypes
+				fc.cConstants[cImport.Alias] = constants
+				continue
+			}
+
+			// Archives are linked into the executable (see static_link.go);
+			// members built with -g describe their functions in DWARF
+			if strings.HasSuffix(cImport.SoPath, ".a") {
+				fc.staticArchives[cImport.Library] = cImport.SoPath
+				signatures, err := ArchiveFunctionSignatures(cImport.SoPath)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: failed to read %s: %v\n", cImport.SoPath, err)
+				} else if len(signatures) > 0 {
+					if fc.cConstants[cImport.Alias] == nil {
+						fc.cConstants[cImport.Alias] = NewCHeaderConstants()
+					}
+					for funcName, sig := range signatures {
+						fc.cConstants[cImport.Alias].Functions[funcName] = sig
+					}
+				}
+			}
+
 			// Resolve .so path if not already set (identifier-based imports)
 			if cImport.SoPath == "" {
 				libSoName := cImport.Library
@@ -412,7 +456,7 @@ func (fc *C67Compiler) processCImports(program *Program) {
 			}
 
 			// For .so file imports, extract symbols and function signatures
-			if cImport.SoPath != "" {
+			if cImport.SoPath != "" && !strings.HasSuffix(cImport.SoPath, ".a") {
 				if VerboseMode {
 					fmt.Fprintf(os.Stderr, "Extracting symbols from %s...\n", cImport.SoPath)
 				}
@@ -444,11 +488,7 @@ func (fc *C67Compiler) processCImports(program *Program) {
 				} else if len(signatures) > 0 {
 					// Store signatures for this library
 					if fc.cConstants[cImport.Alias] == nil {
-						fc.cConstants[cImport.Alias] = &CHeaderConstants{
-							Constants: make(map[string]int64),
-							Macros:    make(map[string]string),
-							Functions: make(map[string]*CFunctionSignature),
-						}
+						fc.cConstants[cImport.Alias] = NewCHeaderConstants()
 					}
 					// Merge DWARF signatures into the constants map
 					for funcName, sig := range signatures {
@@ -475,18 +515,24 @@ func (fc *C67Compiler) processCImports(program *Program) {
 			if VerboseMode {
 				fmt.Fprintf(os.Stderr, "Extracting constants and functions from %s headers...\n", cImport.Library)
 			}
-			constants, err := ExtractConstantsFromLibrary(cImport.Library)
+			headerLib, headerDirs := cImport.Library, []string(nil)
+			soIndex := strings.Index(cImport.Library, ".so")
+			if strings.HasSuffix(cImport.Library, ".a") {
+				soIndex = len(cImport.Library) - len(".a")
+			}
+			if cImport.SoPath != "" && soIndex > 0 {
+				// import "./libfoo.so" as foo: look for foo.h next to the library
+				headerLib = strings.TrimPrefix(cImport.Library[:soIndex], "lib")
+				headerDirs = []string{filepath.Dir(cImport.SoPath)}
+			}
+			constants, err := ExtractConstantsFromLibrary(headerLib, headerDirs...)
 			if err != nil {
 				// Non-fatal: constants extraction is optional
 				fmt.Fprintf(os.Stderr, "Warning: failed to extract constants from %s: %v\n", cImport.Library, err)
 			} else {
 				// Ensure cConstants map is initialized
 				if fc.cConstants[cImport.Alias] == nil {
-					fc.cConstants[cImport.Alias] = &CHeaderConstants{
-						Constants: make(map[string]int64),
-						Macros:    make(map[string]string),
-						Functions: make(map[string]*CFunctionSignature),
-					}
+					fc.cConstants[cImport.Alias] = NewCHeaderConstants()
 				}
 				// Merge with existing data (don't overwrite DWARF or builtin signatures!)
 				for k, v := range constants.Constants {
@@ -501,21 +547,26 @@ func (fc *C67Compiler) processCImports(program *Program) {
 						fc.cConstants[cImport.Alias].Functions[k] = v
 					}
 				}
+				for k, v := range constants.Records {
+					fc.cConstants[cImport.Alias].Records[k] = v
+				}
+				for k, v := range constants.Typedefs {
+					fc.cConstants[cImport.Alias].Typedefs[k] = v
+				}
 				if fc.verbose {
 					fmt.Fprintf(os.Stderr, "Extracted %d constants and %d functions from %s\n",
 						len(constants.Constants), len(constants.Functions), cImport.Library)
 				}
 			}
 
+			// Structs and unions from the headers become cstructs (see ctypes.go)
+			fc.importCStructs(cImport)
+
 			// Fallback: Add known library functions from libdef.go if extraction failed/incomplete
 			if cImport.Library == "libc" || cImport.Library == "glibc" {
 				// Ensure cConstants map is initialized
 				if fc.cConstants[cImport.Alias] == nil {
-					fc.cConstants[cImport.Alias] = &CHeaderConstants{
-						Constants: make(map[string]int64),
-						Macros:    make(map[string]string),
-						Functions: make(map[string]*CFunctionSignature),
-					}
+					fc.cConstants[cImport.Alias] = NewCHeaderConstants()
 				}
 
 				// Add built-in glibc function signatures
@@ -533,6 +584,7 @@ func (fc *C67Compiler) processCImports(program *Program) {
 						fc.cConstants[cImport.Alias].Functions[name] = &CFunctionSignature{
 							ReturnType: fn.ReturnType.String(), // Convert CType to string
 							Params:     params,
+							Variadic:   fn.Variadic,
 						}
 					}
 				}
@@ -902,7 +954,6 @@ func (fc *C67Compiler) compileInternal(program *Program, outputPath string, deps
 		}
 		return fc.compileRiscv64(program, outputPath)
 	}
-
 	// Add format strings for printf
 	fc.eb.Define("fmt_str", "%s\x00")
 	fc.eb.Define("fmt_int", "%ld\n\x00")
@@ -944,44 +995,7 @@ func (fc *C67Compiler) compileInternal(program *Program, outputPath string, deps
 		fc.eb.DefineWritable("cpu_has_avx2", "\x00")   // AVX2 support (Haswell 2013+)
 		fc.eb.DefineWritable("cpu_has_popcnt", "\x00") // POPCNT support (Nehalem 2008+)
 		fc.eb.DefineWritable("cpu_has_avx512", "\x00") // AVX-512F support (Skylake-X 2017+)
-		// Check CPUID leaf 1 for FMA and POPCNT
-		fc.out.MovImmToReg("rax", "1")     // CPUID leaf 1
-		fc.out.XorRegWithReg("rcx", "rcx") // subleaf 0
-		fc.out.Emit([]byte{0x0f, 0xa2})    // cpuid
-
-		// Test ECX bit 12 (FMA)
-		fc.out.Emit([]byte{0x0f, 0xba, 0xe1, 0x0c}) // bt ecx, 12
-		fc.out.Emit([]byte{0x0f, 0x92, 0xc0})       // setc al
-		fc.out.LeaSymbolToReg("rbx", "cpu_has_fma")
-		fc.out.MovByteRegToMem("rax", "rbx", 0)
-
-		// Test ECX bit 23 (POPCNT)
-		fc.out.Emit([]byte{0x0f, 0xba, 0xe1, 0x17}) // bt ecx, 23
-		fc.out.Emit([]byte{0x0f, 0x92, 0xc0})       // setc al
-		fc.out.LeaSymbolToReg("rbx", "cpu_has_popcnt")
-		fc.out.MovByteRegToMem("rax", "rbx", 0)
-
-		// Check CPUID leaf 7 for AVX2 and AVX-512
-		fc.out.MovImmToReg("rax", "7")     // CPUID leaf 7
-		fc.out.XorRegWithReg("rcx", "rcx") // subleaf 0
-		fc.out.Emit([]byte{0x0f, 0xa2})    // cpuid
-
-		// Test EBX bit 5 (AVX2)
-		fc.out.Emit([]byte{0x0f, 0xba, 0xe3, 0x05}) // bt ebx, 5
-		fc.out.Emit([]byte{0x0f, 0x92, 0xc0})       // setc al
-		fc.out.LeaSymbolToReg("rbx", "cpu_has_avx2")
-		fc.out.MovByteRegToMem("rax", "rbx", 0)
-
-		// Test EBX bit 16 (AVX512F - foundation)
-		fc.out.Emit([]byte{0x0f, 0xba, 0xe3, 0x10}) // bt ebx, 16
-		fc.out.Emit([]byte{0x0f, 0x92, 0xc0})       // setc al
-		fc.out.LeaSymbolToReg("rbx", "cpu_has_avx512")
-		fc.out.MovByteRegToMem("rax", "rbx", 0)
-
-		// Clear registers used for CPUID
-		fc.out.XorRegWithReg("rax", "rax")
-		fc.out.XorRegWithReg("rbx", "rbx")
-		fc.out.XorRegWithReg("rcx", "rcx")
+		fc.emitCPUFeatureDetection()
 	}
 	// ===== END CPU FEATURE DETECTION =====
 
@@ -1001,6 +1015,14 @@ func (fc *C67Compiler) compileInternal(program *Program, outputPath string, deps
 	}
 	fc.collectingSymbols = false
 
+	// Programs that the SSA IR covers are lowered from it, unless -no-ir is
+	// given. The first pass has reported the errors of the program by now.
+	if !NoIRFlag {
+		if ok, err := fc.compileIR(program, outputPath); ok {
+			return err
+		}
+	}
+
 	// Define arena metadata symbols AFTER symbol collection (when fc.usesArenas is set)
 	// but BEFORE code generation (so PC relocations can reference them)
 	if fc.usesArenas {
@@ -1015,6 +1037,45 @@ func (fc *C67Compiler) compileInternal(program *Program, outputPath string, deps
 		fc.eb.DefineWritable("_global_"+varName, "\x00\x00\x00\x00\x00\x00\x00\x00") // 8 bytes for float64
 	}
 
+	// Hot functions are called through a table of code pointers that --watch can update
+	fc.defineHotFunctionTable(program)
+
+	// -profile-generate counters live in .data and are written to the profile at exit
+	fc.defineProfileCounters(program)
+
+	// Allocations that never leave their function get stack slots (see escape.go)
+	fc.escapes = newEscapeAnalysis(program)
+
+	// Booleans that are only used as numbers are not boxed (see repr.go)
+	fc.scalars = newScalarAnalysis(program)
+
+	// Appends that only the list's own binding can see happen in place (see ownership.go)
+	fc.ownership = newListOwnership(program)
+	if fc.ownership.Used() {
+		// The table of owned lists, NULL until the first push
+		fc.eb.DefineWritable("_vibe67_list_owners", "\x00\x00\x00\x00\x00\x00\x00\x00")
+	}
+
+	// Lists and maps that are edited while others can see them are kept as
+	// tries (see persistent.go)
+	fc.persistent = newPersistentBindings(program, fc.ownership)
+	if fc.persistent.Used() {
+		// The table of owned headers, NULL until the first in-place edit,
+		// and the next and end of the current chunk of nodes
+		fc.eb.DefineWritable("_vibe67_persistent_owners", "\x00\x00\x00\x00\x00\x00\x00\x00")
+		fc.eb.DefineWritable("_vibe67_persistent_heap", strings.Repeat("\x00", 16))
+	}
+
+	// Callback casts hand out C function pointers (see callbacks.go)
+	fc.callbacks = newCallbacks()
+	fc.cstructs = make(map[string]*CStructDecl)
+	for name, decl := range fc.cImportStructs {
+		fc.cstructs[name] = decl
+	}
+	for name, decl := range program.CStructs {
+		fc.cstructs[name] = decl // declared cstructs win over imported ones
+	}
+
 	// Function prologue - set up stack frame for main code
 	fc.out.PushReg("rbp")
 	fc.out.MovRegToReg("rbp", "rsp")
@@ -1056,6 +1117,8 @@ func (fc *C67Compiler) compileInternal(program *Program, outputPath string, deps
 	// We'll patch this later if usesArenas becomes true
 	fc.out.Emit([]byte{0x90, 0x90, 0x90, 0x90, 0x90}) // 5 NOPs as placeholder
 
+	fc.initHotFunctionTable()
+
 	fc.pushDeferScope()
 
 	// Predeclare lambda symbols so closure initialization can reference them
@@ -1150,6 +1213,7 @@ func (fc *C67Compiler) compileInternal(program *Program, outputPath string, deps
 
 	// Restore exit code to rdi
 	fc.out.PopReg("rdi")
+	fc.emitProfileFlush()
 
 	// Always add implicit exit at the end of the program
 	// Even if there's an exit() call in the code, it might be conditional
@@ -1186,8 +1250,8 @@ func (fc *C67Compiler) compileInternal(program *Program, outputPath string, deps
 			fc.callFunction("exit", "")
 		}
 	} else {
-		// Use direct syscall exit on Linux (works with syscall-based printf)
-		fc.out.MovImmToReg("rax", "60") // syscall number for exit
+		// Use direct syscall exit (works with syscall-based printf)
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_EXIT")) // syscall number for exit
 		// exit code is already in rdi (first syscall argument)
 		fc.eb.Emit("syscall") // invoke syscall directly
 	}
@@ -1619,6 +1683,13 @@ func (fc *C67Compiler) collectSymbols(stmt Statement) error {
 
 		// Restore arena depth
 		fc.currentArena = previousArena
+	case *LockStmt:
+		fc.usesSync = true
+		for _, bodyStmt := range s.Body {
+			if err := fc.collectSymbols(bodyStmt); err != nil {
+				return err
+			}
+		}
 	case *CStructDecl:
 		// Cstruct declarations don't allocate runtime stack space
 		// Constants are already registered in parser (Name_SIZEOF, Name_field_OFFSET)
@@ -1875,6 +1946,14 @@ func (fc *C67Compiler) compileStatement(stmt Statement) {
 
 		// Check if it's a global variable
 		if _, isGlobal := fc.globalVars[s.Name]; isGlobal {
+			if fc.ownership.Push(s) {
+				fc.compileListPush(s, "", 0)
+				return
+			}
+			if p := fc.persistentBinding(s.Name); p != nil {
+				fc.compilePersistentAssign(s, p, "", 0)
+				return
+			}
 			// Compile the value
 			fc.currentAssignName = s.Name
 			fc.compileExpression(s.Value)
@@ -1884,6 +1963,9 @@ func (fc *C67Compiler) compileStatement(stmt Statement) {
 			// movsd [rax], xmm0
 			fc.out.LeaSymbolToReg("rax", "_global_"+s.Name)
 			fc.out.MovXmmToMem("xmm0", "rax", 0)
+			if fc.ownership.Releases(s) {
+				fc.releaseListBinding(s.Name, "", 0)
+			}
 		} else {
 			// Local variable
 			offset := fc.variables[s.Name]
@@ -1899,15 +1981,28 @@ func (fc *C67Compiler) compileStatement(stmt Statement) {
 				fc.runtimeStack += 16
 			}
 
-			fc.currentAssignName = s.Name
-			fc.compileExpression(s.Value)
-			fc.currentAssignName = ""
 			// Use r11 for parent variables in parallel loops, rbp for local variables
 			baseReg := "rbp"
 			if fc.parentVariables != nil && fc.parentVariables[s.Name] {
 				baseReg = "r11"
 			}
+			// Calls clobber r11, so parallel loops always copy
+			if baseReg == "rbp" && fc.ownership.Push(s) {
+				fc.compileListPush(s, baseReg, offset)
+				return
+			}
+			if p := fc.persistentBinding(s.Name); p != nil {
+				fc.compilePersistentAssign(s, p, baseReg, offset)
+				return
+			}
+
+			fc.currentAssignName = s.Name
+			fc.compileExpression(s.Value)
+			fc.currentAssignName = ""
 			fc.out.MovXmmToMem("xmm0", baseReg, -offset)
+			if baseReg == "rbp" && fc.ownership.Releases(s) {
+				fc.releaseListBinding(s.Name, baseReg, offset)
+			}
 		}
 
 	case *MultipleAssignStmt:
@@ -2018,6 +2113,10 @@ func (fc *C67Compiler) compileStatement(stmt Statement) {
 		if !isMutable {
 			compilerError("cannot modify immutable list '%s'", s.MapName)
 		}
+		if p := fc.persistentBinding(s.MapName); p != nil {
+			fc.compilePersistentUpdate(s, p)
+			return
+		}
 
 		// Check if this is a list or map
 		varType := fc.varTypes[s.MapName]
@@ -2276,6 +2375,9 @@ func (fc *C67Compiler) compileStatement(stmt Statement) {
 	case *SpawnStmt:
 		fc.compileSpawnStmt(s)
 
+	case *LockStmt:
+		fc.compileLockStmt(s)
+
 	case *CStructDecl:
 		// Cstruct declarations generate no runtime code
 		// Constants are already available via Name_SIZEOF and Name_field_OFFSET
@@ -2441,7 +2543,7 @@ func (fc *C67Compiler) compileArenaExpr(expr *ArenaExpr) {
 func (fc *C67Compiler) compileSpawnStmt(stmt *SpawnStmt) {
 	// Call fork() syscall (57 on x86-64 Linux)
 	// Returns: child gets 0 in rax, parent gets child PID in rax
-	fc.out.MovImmToReg("rax", "57") // fork syscall number
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_FORK")) // fork syscall number
 	fc.out.Syscall()
 
 	// Test if we're in child or parent
@@ -2479,8 +2581,8 @@ func (fc *C67Compiler) compileSpawnStmt(stmt *SpawnStmt) {
 	fc.callFunction("fflush", "")
 
 	// Exit child process with status 0
-	fc.out.MovImmToReg("rax", "60") // exit syscall number
-	fc.out.MovImmToReg("rdi", "0")  // exit status 0
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_EXIT")) // exit syscall number
+	fc.out.MovImmToReg("rdi", "0")                       // exit status 0
 	fc.out.Syscall()
 
 	// Parent continues here
@@ -2634,14 +2736,6 @@ func (fc *C67Compiler) compileWhileStatement(stmt *WhileStmt) {
 }
 
 func (fc *C67Compiler) compileRangeLoop(stmt *LoopStmt, rangeExpr *RangeExpr) {
-	// SIMD AUTO-VECTORIZATION CHECK
-	// Try to vectorize this loop if possible
-	if fc.tryVectorizeLoop(stmt, rangeExpr) {
-		// Loop was successfully vectorized
-		return
-	}
-
-	// Fall back to scalar compilation
 	// REGISTER ALLOCATION OPTIMIZATION:
 	// Use rbx for loop counter, r12 for loop limit
 	// This eliminates memory operations in tight loops (30-40% speedup)
@@ -2761,6 +2855,14 @@ func (fc *C67Compiler) compileRangeLoop(stmt *LoopStmt, rangeExpr *RangeExpr) {
 	// Store limit on stack at rbp-limitOffset
 	fc.out.MovRegToMem("rax", "rbp", -limitOffset)
 
+	fc.emitProfileLoopEntry(stmt.ProfileKey, counterReg, counterOffset, limitOffset)
+
+	// SIMD AUTO-VECTORIZATION
+	// Process full vectors first; the scalar loop below handles the rest
+	if kernel := fc.planVectorKernel(stmt); kernel != nil {
+		fc.emitVectorizedLoop(kernel, counterReg, counterOffset, limitOffset)
+	}
+
 	// Register iterator variable
 	if VerboseMode {
 		fmt.Fprintf(os.Stderr, "DEBUG: Loop iterator '%s' at offset %d (baseOffset=%d, loopStateOffset=%d)\n",
@@ -2926,318 +3028,83 @@ func (fc *C67Compiler) compileRangeLoop(stmt *LoopStmt, rangeExpr *RangeExpr) {
 	fc.activeLoops = fc.activeLoops[:len(fc.activeLoops)-1]
 }
 
-// tryVectorizeLoop attempts to vectorize a simple range loop
-// Returns true if loop was vectorized, false if should fall back to scalar
-func (fc *C67Compiler) tryVectorizeLoop(stmt *LoopStmt, rangeExpr *RangeExpr) bool {
-	// Check if optimizer already marked this loop as vectorizable
-	if !stmt.Vectorized {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "SIMD: Loop not marked as vectorizable by optimizer\n")
-		}
-		return false
-	}
-
-	// Only vectorize on x86-64 with AVX support for now
-	if fc.platform.Arch != ArchX86_64 {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "SIMD: Not x86-64 architecture, skipping vectorization\n")
-		}
-		return false
-	}
-
-	// Only vectorize simple patterns for now:
-	// @ i in range(n) { result[i] <- a[i] + b[i] }
-	if len(stmt.Body) != 1 {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "SIMD: Loop body has %d statements, need exactly 1\n", len(stmt.Body))
-		}
-		return false // Only single-statement loops
-	}
-
-	// Handle both AssignStmt and MapUpdateStmt
-	var binExpr *BinaryExpr
-	var lhsName string
-
-	if assign, ok := stmt.Body[0].(*AssignStmt); ok {
-		// Check if LHS is also an index expression
-		lhsName = assign.Name
-		if !strings.Contains(lhsName, "[") {
-			if VerboseMode {
-				fmt.Fprintf(os.Stderr, "SIMD: LHS is not array access: '%s'\n", lhsName)
-			}
-			return false // LHS must be array access
-		}
-
-		// Check if RHS is a binary expression (a[i] + b[i])
-		var ok bool
-		binExpr, ok = assign.Value.(*BinaryExpr)
-		if !ok {
-			if VerboseMode {
-				fmt.Fprintf(os.Stderr, "SIMD: RHS is not a BinaryExpr: %T\n", assign.Value)
-			}
-			return false // Must be binary operation
-		}
-	} else if mapUpdate, ok := stmt.Body[0].(*MapUpdateStmt); ok {
-		// Array update: result[i] <- value
-		lhsName = mapUpdate.MapName + "[" + stmt.Iterator + "]"
-
-		// Check if value is a binary expression
-		var ok bool
-		binExpr, ok = mapUpdate.Value.(*BinaryExpr)
-		if !ok {
-			if VerboseMode {
-				fmt.Fprintf(os.Stderr, "SIMD: MapUpdate value is not a BinaryExpr: %T\n", mapUpdate.Value)
-			}
-			return false
-		}
-	} else {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "SIMD: Loop body is not AssignStmt or MapUpdateStmt: %T\n", stmt.Body[0])
-		}
-		return false
-	}
-
-	// Support addition, subtraction, and multiplication
-	if binExpr.Operator != "+" && binExpr.Operator != "-" && binExpr.Operator != "*" {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "SIMD: Unsupported operator: %s\n", binExpr.Operator)
-		}
-		return false
-	}
-
-	// Check if both operands are index expressions
-	leftIndex, leftOk := binExpr.Left.(*IndexExpr)
-	rightIndex, rightOk := binExpr.Right.(*IndexExpr)
-	if !leftOk || !rightOk {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "SIMD: Operands are not IndexExpr: left=%T, right=%T\n",
-				binExpr.Left, binExpr.Right)
-		}
-		return false
-	}
-
-	// Verify indices use the loop iterator
-	leftIdxIdent, leftIdxOk := leftIndex.Index.(*IdentExpr)
-	rightIdxIdent, rightIdxOk := rightIndex.Index.(*IdentExpr)
-	if !leftIdxOk || !rightIdxOk {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "SIMD: Indices are not IdentExpr: left=%T, right=%T\n",
-				leftIndex.Index, rightIndex.Index)
-		}
-		return false
-	}
-
-	if leftIdxIdent.Name != stmt.Iterator || rightIdxIdent.Name != stmt.Iterator {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "SIMD: Indices don't match iterator '%s': left='%s', right='%s'\n",
-				stmt.Iterator, leftIdxIdent.Name, rightIdxIdent.Name)
-		}
-		return false // Indices must use loop iterator
-	}
-
-	// Extract base array names
-	leftArray, leftArrayOk := leftIndex.List.(*IdentExpr)
-	rightArray, rightArrayOk := rightIndex.List.(*IdentExpr)
-	if !leftArrayOk || !rightArrayOk {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "SIMD: Array bases are not IdentExpr: left=%T, right=%T\n",
-				leftIndex.List, rightIndex.List)
-		}
-		return false
+// planVectorKernel returns the vector kernel for a range loop, or nil if the
+// loop has to run as scalar code
+func (fc *C67Compiler) planVectorKernel(stmt *LoopStmt) *vectorKernel {
+	if fc.platform.Arch != ArchX86_64 || !stmt.Vectorized {
+		return nil
 	}
-
-	if VerboseMode {
-		fmt.Fprintf(os.Stderr, "SIMD: Vectorizing loop - pattern: %s = %s[i] %s %s[i]\n",
-			lhsName, leftArray.Name, binExpr.Operator, rightArray.Name)
-		fmt.Fprintf(os.Stderr, "SIMD: Vector width: %d elements\n", stmt.VectorWidth)
+	sv := NewSIMDVectorizer(NewSIMDAnalyzer(fc.eb.target), fc.eb.target)
+	kernel, reason := sv.PlanKernel(stmt, fc.getExprType)
+	if kernel == nil && VerboseMode {
+		fmt.Fprintf(os.Stderr, "SIMD: Not vectorizing loop over '%s': %s\n", stmt.Iterator, reason)
 	}
-
-	// Emit vectorized code using the vector width from the optimizer
-	fc.emitVectorizedBinaryOpLoop(stmt, rangeExpr, lhsName, leftArray.Name, rightArray.Name,
-		binExpr.Operator, stmt.VectorWidth)
-
-	// Successfully vectorized
-	return true
+	return kernel
 }
 
-// emitVectorizedBinaryOpLoop emits SIMD code for: result[i] = a[i] OP b[i]
-func (fc *C67Compiler) emitVectorizedBinaryOpLoop(stmt *LoopStmt, rangeExpr *RangeExpr,
-	resultName, leftArrayName, rightArrayName string, operator string, vectorWidth int) {
-
-	if VerboseMode {
-		fmt.Fprintf(os.Stderr, "SIMD: Emitting vectorized loop: %s = %s[i] %s %s[i] (width=%d)\n",
-			resultName, leftArrayName, operator, rightArrayName, vectorWidth)
-	}
-
-	// Get array pointers from variables map
-	// Extract base name from result (might be "result[i]" -> "result")
-	resultBase := strings.Split(resultName, "[")[0]
-	resultOffset, resultExists := fc.variables[resultBase]
-	leftOffset, leftExists := fc.variables[leftArrayName]
-	rightOffset, rightExists := fc.variables[rightArrayName]
-
-	if !resultExists || !leftExists || !rightExists {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "SIMD: Cannot find array variables in symbol table\n")
-			fmt.Fprintf(os.Stderr, "SIMD:   result=%s exists=%v, left=%s exists=%v, right=%s exists=%v\n",
-				resultBase, resultExists, leftArrayName, leftExists, rightArrayName, rightExists)
-		}
-		return
-	}
-
-	// Evaluate and store range start and end
-	fc.compileExpression(rangeExpr.Start)
-	fc.out.Cvttsd2si("rbx", "xmm0") // rbx = loop counter (start)
-
-	fc.compileExpression(rangeExpr.End)
-	fc.out.Cvttsd2si("r12", "xmm0") // r12 = loop limit (end)
-	if rangeExpr.Inclusive {
-		fc.out.IncReg("r12")
-	}
-
-	// Load array base pointers into registers
-	// Arrays are stored as pointers on the stack
-	fc.out.MovMemToReg("rdi", "rbp", -resultOffset) // rdi = result array ptr
-	fc.out.MovMemToReg("rsi", "rbp", -leftOffset)   // rsi = left array ptr
-	fc.out.MovMemToReg("rdx", "rbp", -rightOffset)  // rdx = right array ptr
-
-	// Determine register type based on vector width
-	var regPrefix string
-	if vectorWidth == 8 {
-		regPrefix = "zmm" // AVX-512: 512-bit (8 doubles)
-	} else if vectorWidth == 4 {
-		regPrefix = "ymm" // AVX/AVX2: 256-bit (4 doubles)
-	} else {
-		regPrefix = "xmm" // SSE: 128-bit (2 doubles)
-	}
-
-	// ===== VECTOR LOOP =====
-	// Process vectorWidth elements per iteration
-	vecLoopStart := fc.eb.text.Len()
-
-	// Check if we have at least vectorWidth elements remaining
-	fc.out.MovRegToReg("rax", "r12")
-	fc.out.SubRegFromReg("rax", "rbx") // rax = limit - counter (remaining)
-	fc.out.CmpRegToImm("rax", int64(vectorWidth))
-
-	// Jump to cleanup if remaining < vectorWidth
-	cleanupJump := fc.eb.text.Len()
-	fc.out.JumpConditional(JumpLess, 0) // Placeholder, will patch later
-
-	// Load vectorWidth doubles from left array: reg0 = left[rbx:rbx+vectorWidth]
-	// Offset = rbx * 8 (8 bytes per double)
-	fc.out.MovRegToReg("r10", "rbx")
-	fc.out.ShlRegByImm("r10", 3)     // r10 = rbx * 8
-	fc.out.AddRegToReg("r10", "rsi") // r10 = &left[rbx]
-	fc.out.VMovupdLoadFromMem(regPrefix+"0", "r10", 0)
-
-	// Load vectorWidth doubles from right array: reg1 = right[rbx:rbx+vectorWidth]
-	fc.out.MovRegToReg("r10", "rbx")
-	fc.out.ShlRegByImm("r10", 3)
-	fc.out.AddRegToReg("r10", "rdx") // r10 = &right[rbx]
-	fc.out.VMovupdLoadFromMem(regPrefix+"1", "r10", 0)
-
-	// Vector operation: reg0 = reg0 OP reg1
-	switch operator {
-	case "+":
-		fc.out.VAddPDVectorToVector(regPrefix+"0", regPrefix+"0", regPrefix+"1")
-	case "-":
-		fc.out.VSubPDVectorToVector(regPrefix+"0", regPrefix+"0", regPrefix+"1")
-	case "*":
-		fc.out.VMulPDVectorToVector(regPrefix+"0", regPrefix+"0", regPrefix+"1")
-	}
-
-	// Store result: result[rbx:rbx+vectorWidth] = reg0
-	fc.out.MovRegToReg("r10", "rbx")
-	fc.out.ShlRegByImm("r10", 3)
-	fc.out.AddRegToReg("r10", "rdi") // r10 = &result[rbx]
-	fc.out.VMovupdStoreToMem(regPrefix+"0", "r10", 0)
-
-	// Increment counter by vectorWidth
-	fc.out.AddImmToReg("rbx", int64(vectorWidth))
-
-	// Jump back to vector loop start
-	vecLoopEnd := fc.eb.text.Len()
-	offset := vecLoopStart - vecLoopEnd - 2
-	fc.out.JumpUnconditional(int32(offset))
-
-	// ===== CLEANUP LOOP =====
-	// Process remaining elements one by one
-	cleanupStart := fc.eb.text.Len()
-
-	// Patch the earlier jump to cleanup
-	cleanupJumpTarget := cleanupStart - cleanupJump - 6
-	fc.patchJump(cleanupJump, cleanupJumpTarget)
-
-	// Check if counter >= limit
-	cleanupLoopStart := fc.eb.text.Len()
-	fc.out.CmpRegToReg("rbx", "r12")
-
-	// Jump to done if rbx >= r12
-	doneJump := fc.eb.text.Len()
-	fc.out.JumpConditional(JumpGreaterOrEqual, 0) // Placeholder, will patch later
-
-	// Load one element from left: xmm0 = left[rbx]
-	fc.out.MovRegToReg("r10", "rbx")
-	fc.out.ShlRegByImm("r10", 3)
-	fc.out.AddRegToReg("r10", "rsi")
-	// Load scalar double (use SSE2 movsd)
-	fc.out.Emit([]byte{0xF2, 0x41, 0x0F, 0x10, 0x02}) // movsd xmm0, [r10]
-
-	// Load one element from right: xmm1 = right[rbx]
-	fc.out.MovRegToReg("r10", "rbx")
-	fc.out.ShlRegByImm("r10", 3)
-	fc.out.AddRegToReg("r10", "rdx")
-	fc.out.Emit([]byte{0xF2, 0x41, 0x0F, 0x10, 0x0A}) // movsd xmm1, [r10]
-
-	// Scalar operation: xmm0 = xmm0 OP xmm1
-	switch operator {
-	case "+":
-		fc.out.Emit([]byte{0xF2, 0x0F, 0x58, 0xC1}) // addsd xmm0, xmm1
-	case "-":
-		fc.out.Emit([]byte{0xF2, 0x0F, 0x5C, 0xC1}) // subsd xmm0, xmm1
-	case "*":
-		fc.out.Emit([]byte{0xF2, 0x0F, 0x59, 0xC1}) // mulsd xmm0, xmm1
-	}
-
-	// Store result: result[rbx] = xmm0
-	fc.out.MovRegToReg("r10", "rbx")
-	fc.out.ShlRegByImm("r10", 3)
-	fc.out.AddRegToReg("r10", "rdi")
-	fc.out.Emit([]byte{0xF2, 0x41, 0x0F, 0x11, 0x02}) // movsd [r10], xmm0
-
-	// Increment counter
-	fc.out.IncReg("rbx")
-
-	// Jump back to cleanup loop start
-	cleanupLoopEnd := fc.eb.text.Len()
-	cleanupOffset := cleanupLoopStart - cleanupLoopEnd - 2
-	fc.out.JumpUnconditional(int32(cleanupOffset))
-
-	// ===== DONE =====
-	doneStart := fc.eb.text.Len()
+// emitCPUFeatureDetection sets the cpu_has_* flags from CPUID. AVX2 and
+// AVX-512 also need the OS to save their registers, which XGETBV reports.
+func (fc *C67Compiler) emitCPUFeatureDetection() {
+	// Check CPUID leaf 1 for FMA and POPCNT
+	fc.out.MovImmToReg("rax", "1")     // CPUID leaf 1
+	fc.out.XorRegWithReg("rcx", "rcx") // subleaf 0
+	fc.out.Emit([]byte{0x0f, 0xa2})    // cpuid
+
+	// Test ECX bit 12 (FMA)
+	fc.out.Emit([]byte{0x0f, 0xba, 0xe1, 0x0c}) // bt ecx, 12
+	fc.out.Emit([]byte{0x0f, 0x92, 0xc0})       // setc al
+	fc.out.LeaSymbolToReg("rbx", "cpu_has_fma")
+	fc.out.MovByteRegToMem("rax", "rbx", 0)
 
-	// Patch the jump to done
-	doneJumpTarget := doneStart - doneJump - 6
-	fc.patchJump(doneJump, doneJumpTarget)
+	// Test ECX bit 23 (POPCNT)
+	fc.out.Emit([]byte{0x0f, 0xba, 0xe1, 0x17}) // bt ecx, 23
+	fc.out.Emit([]byte{0x0f, 0x92, 0xc0})       // setc al
+	fc.out.LeaSymbolToReg("rbx", "cpu_has_popcnt")
+	fc.out.MovByteRegToMem("rax", "rbx", 0)
 
-	// Clean up AVX state
-	fc.out.VZeroUpper()
+	// ESI = XCR0 if ECX bit 27 (OSXSAVE) is set, else 0
+	fc.out.Emit([]byte{0x31, 0xf6})             // xor esi, esi
+	fc.out.Emit([]byte{0x0f, 0xba, 0xe1, 0x1b}) // bt ecx, 27
+	fc.out.Emit([]byte{0x73, 0x07})             // jnc +7
+	fc.out.Emit([]byte{0x31, 0xc9})             // xor ecx, ecx
+	fc.out.Emit([]byte{0x0f, 0x01, 0xd0})       // xgetbv
+	fc.out.Emit([]byte{0x89, 0xc6})             // mov esi, eax
+
+	// Check CPUID leaf 7 for AVX2 and AVX-512
+	fc.out.MovImmToReg("rax", "7")     // CPUID leaf 7
+	fc.out.XorRegWithReg("rcx", "rcx") // subleaf 0
+	fc.out.Emit([]byte{0x0f, 0xa2})    // cpuid
+	fc.out.Emit([]byte{0x89, 0xdf})    // mov edi, ebx (rbx is used for the flag addresses)
+
+	// AVX2: EBX bit 5, and the OS saves the XMM and YMM state (XCR0 bits 1-2)
+	fc.out.Emit([]byte{0x0f, 0xba, 0xe7, 0x05}) // bt edi, 5
+	fc.out.Emit([]byte{0x0f, 0x92, 0xc0})       // setc al
+	fc.out.Emit([]byte{0x89, 0xf2})             // mov edx, esi
+	fc.out.Emit([]byte{0x83, 0xe2, 0x06})       // and edx, 6
+	fc.out.Emit([]byte{0x83, 0xfa, 0x06})       // cmp edx, 6
+	fc.out.Emit([]byte{0x0f, 0x94, 0xc2})       // sete dl
+	fc.out.Emit([]byte{0x20, 0xd0})             // and al, dl
+	fc.out.LeaSymbolToReg("rbx", "cpu_has_avx2")
+	fc.out.MovByteRegToMem("rax", "rbx", 0)
 
-	if VerboseMode {
-		fmt.Fprintf(os.Stderr, "SIMD: Successfully emitted vectorized loop\n")
-	}
-}
+	// AVX-512F: EBX bit 16, and the OS also saves the opmask and ZMM state (XCR0 bits 5-7)
+	fc.out.Emit([]byte{0x0f, 0xba, 0xe7, 0x10})             // bt edi, 16
+	fc.out.Emit([]byte{0x0f, 0x92, 0xc0})                   // setc al
+	fc.out.Emit([]byte{0x89, 0xf2})                         // mov edx, esi
+	fc.out.Emit([]byte{0x81, 0xe2, 0xe6, 0x00, 0x00, 0x00}) // and edx, 0xe6
+	fc.out.Emit([]byte{0x81, 0xfa, 0xe6, 0x00, 0x00, 0x00}) // cmp edx, 0xe6
+	fc.out.Emit([]byte{0x0f, 0x94, 0xc2})                   // sete dl
+	fc.out.Emit([]byte{0x20, 0xd0})                         // and al, dl
+	fc.out.LeaSymbolToReg("rbx", "cpu_has_avx512")
+	fc.out.MovByteRegToMem("rax", "rbx", 0)
 
-// patchJump patches a conditional jump with the correct offset
-func (fc *C67Compiler) patchJump(jumpPos int, offset int) {
-	// For conditional jumps, the offset is encoded as a 32-bit signed integer
-	// Get the raw bytes from the buffer
-	textBytes := fc.eb.text.Bytes()
-	textBytes[jumpPos+2] = byte(offset & 0xFF)
-	textBytes[jumpPos+3] = byte((offset >> 8) & 0xFF)
-	textBytes[jumpPos+4] = byte((offset >> 16) & 0xFF)
-	textBytes[jumpPos+5] = byte((offset >> 24) & 0xFF)
+	// Clear registers used for CPUID
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.out.XorRegWithReg("rbx", "rbx")
+	fc.out.XorRegWithReg("rcx", "rcx")
+	fc.out.XorRegWithReg("rdx", "rdx")
+	fc.out.XorRegWithReg("rsi", "rsi")
+	fc.out.XorRegWithReg("rdi", "rdi")
 }
 
 // collectLoopLocalVars scans the loop body and returns a map of variables defined inside it
@@ -3447,8 +3314,9 @@ func (fc *C67Compiler) compileParallelRangeLoop(stmt *LoopStmt, rangeExpr *Range
 	}
 
 	// Allocate pthread_t array on stack to store thread IDs
-	// Each pthread_t is 8 bytes, allocate space for all threads
-	pthreadArraySize := int64(actualThreads * 8)
+	// Each pthread_t is 8 bytes, allocate space for all threads, rounded up
+	// to keep rsp 16-byte aligned for pthread_create with an odd thread count
+	pthreadArraySize := int64((actualThreads*8 + 15) &^ 15)
 	fc.out.SubImmFromReg("rsp", pthreadArraySize)
 	fc.out.MovRegToReg("r12", "rsp") // r12 = pthread_t array base
 
@@ -3560,45 +3428,58 @@ func (fc *C67Compiler) compileParallelRangeLoop(stmt *LoopStmt, rangeExpr *Range
 	// Structure: [start: int64][end: int64][barrier_ptr: int64][parent_rbp: int64]
 	// Using rbp-relative addressing ensures stability across function calls (which modify rsp)
 
+	// The loop body addresses its own locals and nested loops at the offsets
+	// collectSymbols gave them, up to maxStackOffset, so the thread keeps its
+	// state below those
+	threadBase := (fc.maxStackOffset + 15) &^ 15
+	startOffset := threadBase + 16
+	endOffset := threadBase + 24
+	counterOffset := threadBase + 32
+	barrierOffset := threadBase + 40
+	parentRbpOffset := threadBase + 48
+	iteratorOffset := threadBase + 56
+
 	// Allocate stack space for loop variables and alignment
 	// After push rbp (8) + push rbx (8) = 16 bytes
-	// Stack layout (rbp-relative):
-	//   [rbp-8]:  saved rbx
-	//   [rbp-16]: start
-	//   [rbp-24]: end
-	//   [rbp-32]: counter
-	//   [rbp-40]: barrier_ptr
-	//   [rbp-48]: parent_rbp
-	//   [rbp-56]: iterator value (float64)
+	// Stack layout (rbp-relative, b = threadBase):
+	//   [rbp-8]:    saved rbx
+	//   [rbp-b-16]: start
+	//   [rbp-b-24]: end
+	//   [rbp-b-32]: counter
+	//   [rbp-b-40]: barrier_ptr
+	//   [rbp-b-48]: parent_rbp
+	//   [rbp-b-56]: iterator value (float64)
 	// CRITICAL: pthread entry gives us 16-byte aligned rsp. After push rbp + push rbx,
 	// rsp is aligned. We need rsp MISALIGNED by 8 before call instructions (so that
-	// after call pushes return address, it becomes aligned). Therefore, sub by 56 not 64.
-	fc.out.SubImmFromReg("rsp", 56)
+	// after call pushes return address, it becomes aligned). threadBase is a
+	// multiple of 16, so sub by threadBase+56.
+	threadFrame := int64(threadBase + 56)
+	fc.out.SubImmFromReg("rsp", threadFrame)
 
 	// Load parameters from argument structure and store to stack slots (rbp-relative)
 	// Note: Using rbx since we saved rdi to rbx above
-	fc.out.MovMemToReg("rax", "rbx", 0)   // rax = start
-	fc.out.MovRegToMem("rax", "rbp", -16) // [rbp-16] = start
+	fc.out.MovMemToReg("rax", "rbx", 0)            // rax = start
+	fc.out.MovRegToMem("rax", "rbp", -startOffset) // start
 
-	fc.out.MovMemToReg("rax", "rbx", 8)   // rax = end
-	fc.out.MovRegToMem("rax", "rbp", -24) // [rbp-24] = end
+	fc.out.MovMemToReg("rax", "rbx", 8)          // rax = end
+	fc.out.MovRegToMem("rax", "rbp", -endOffset) // end
 
-	fc.out.MovMemToReg("rax", "rbx", 16)  // rax = barrier_ptr
-	fc.out.MovRegToMem("rax", "rbp", -40) // [rbp-40] = barrier_ptr
+	fc.out.MovMemToReg("rax", "rbx", 16)             // rax = barrier_ptr
+	fc.out.MovRegToMem("rax", "rbp", -barrierOffset) // barrier_ptr
 
-	fc.out.MovMemToReg("rax", "rbx", 24)  // rax = parent_rbp
-	fc.out.MovRegToMem("rax", "rbp", -48) // [rbp-48] = parent_rbp
+	fc.out.MovMemToReg("rax", "rbx", 24)               // rax = parent_rbp
+	fc.out.MovRegToMem("rax", "rbp", -parentRbpOffset) // parent_rbp
 
 	// Initialize loop counter to start value
-	fc.out.MovMemToReg("rax", "rbp", -16) // rax = start
-	fc.out.MovRegToMem("rax", "rbp", -32) // [rbp-32] = counter (initialized to start)
+	fc.out.MovMemToReg("rax", "rbp", -startOffset)   // rax = start
+	fc.out.MovRegToMem("rax", "rbp", -counterOffset) // counter (initialized to start)
 
 	// Loop start
 	loopStartPos := fc.eb.text.Len()
 
 	// Load counter and end from stack and compare (rbp-relative)
-	fc.out.MovMemToReg("rax", "rbp", -32) // rax = counter
-	fc.out.MovMemToReg("rcx", "rbp", -24) // rcx = end
+	fc.out.MovMemToReg("rax", "rbp", -counterOffset) // rax = counter
+	fc.out.MovMemToReg("rcx", "rbp", -endOffset)     // rcx = end
 	fc.out.CmpRegToReg("rax", "rcx")
 
 	// If counter >= end, exit loop
@@ -3606,20 +3487,18 @@ func (fc *C67Compiler) compileParallelRangeLoop(stmt *LoopStmt, rangeExpr *Range
 	fc.out.JumpConditional(JumpGreaterOrEqual, 0) // Placeholder, will patch
 
 	// V5 Step 2: Set up iterator variable
-	// Convert counter (int) to float64 and store at rbp-56
+	// Convert counter (int) to float64 and store below the other thread slots
 	// This makes the iterator accessible as a proper float64 variable
-	// Note: Using rbp-56 to avoid conflict with loop variables at rbp-16 through rbp-48
-	iteratorOffset := 56
-	fc.out.MovMemToReg("rax", "rbp", -32)              // rax = counter
+	fc.out.MovMemToReg("rax", "rbp", -counterOffset)   // rax = counter
 	fc.out.Cvtsi2sd("xmm0", "rax")                     // xmm0 = (float64)counter
-	fc.out.MovXmmToMem("xmm0", "rbp", -iteratorOffset) // Store at rbp-56
+	fc.out.MovXmmToMem("xmm0", "rbp", -iteratorOffset) // Store the iterator
 
 	// V5 Step 3 & 4: Compile loop body with existing variable context
 	// The variables are already registered in fc.variables from collectSymbols phase
 	// We just need to ensure the iterator is set correctly for this context
 
 	// Save parent_rbp to r11 for parent variable access (rbp-relative)
-	fc.out.MovMemToReg("r11", "rbp", -48) // r11 = parent_rbp
+	fc.out.MovMemToReg("r11", "rbp", -parentRbpOffset) // r11 = parent_rbp
 
 	// Capture parent variables: exclude iterator and loop-local vars
 	loopLocalVars := collectLoopLocalVars(stmt.Body)
@@ -3633,7 +3512,7 @@ func (fc *C67Compiler) compileParallelRangeLoop(stmt *LoopStmt, rangeExpr *Range
 	}
 
 	// Temporarily override the iterator offset for compilation
-	// (collectSymbols set it to a different offset, but in child thread it's at rbp-16)
+	// (collectSymbols set it to a different offset, but in child thread it's at iteratorOffset)
 	savedIteratorOffset := fc.variables[stmt.Iterator]
 	fc.variables[stmt.Iterator] = iteratorOffset
 
@@ -3648,9 +3527,9 @@ func (fc *C67Compiler) compileParallelRangeLoop(stmt *LoopStmt, rangeExpr *Range
 	fc.parentVariables = savedParentVariables
 
 	// Increment loop counter in memory (rbp-relative)
-	fc.out.MovMemToReg("rax", "rbp", -32) // rax = counter
-	fc.out.IncReg("rax")                  // rax++
-	fc.out.MovRegToMem("rax", "rbp", -32) // store back to [rbp-32]
+	fc.out.MovMemToReg("rax", "rbp", -counterOffset) // rax = counter
+	fc.out.IncReg("rax")                             // rax++
+	fc.out.MovRegToMem("rax", "rbp", -counterOffset) // store back
 
 	// Jump back to loop start
 	loopBackJumpPos := fc.eb.text.Len()
@@ -3668,7 +3547,7 @@ func (fc *C67Compiler) compileParallelRangeLoop(stmt *LoopStmt, rangeExpr *Range
 	// Atomically decrement barrier counter and synchronize
 
 	// Load barrier pointer from stack into r15 for barrier operations (rbp-relative)
-	fc.out.MovMemToReg("r15", "rbp", -40) // r15 = barrier_ptr from [rbp-40]
+	fc.out.MovMemToReg("r15", "rbp", -barrierOffset) // r15 = barrier_ptr
 
 	// Load -1 into eax for atomic decrement
 	fc.out.MovImmToReg("rax", "-1")
@@ -3690,11 +3569,11 @@ func (fc *C67Compiler) compileParallelRangeLoop(stmt *LoopStmt, rangeExpr *Range
 	fc.out.JumpConditional(JumpNotEqual, 0) // Placeholder, will patch
 
 	// Last thread path: Wake all waiting threads
-	// futex(barrier_addr, FUTEX_WAKE_PRIVATE, num_threads)
-	fc.out.MovImmToReg("rax", "202")    // sys_futex
-	fc.out.MovRegToReg("rdi", "r15")    // addr = barrier address
-	fc.out.MovImmToReg("rsi", "129")    // op = FUTEX_WAKE_PRIVATE (1 | 128)
-	fc.out.MovMemToReg("rdx", "r15", 8) // val = barrier.total (wake all threads)
+	// futex(barrier_addr, FUTEX_WAKE_PRIVATE, num_threads), _umtx_op on FreeBSD
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_FUTEX"))          // sys_futex
+	fc.out.MovRegToReg("rdi", "r15")                               // addr = barrier address
+	fc.out.MovImmToReg("rsi", fc.out.SysNum("FUTEX_WAKE_PRIVATE")) // op = wake, private to the process
+	fc.out.MovMemToReg("rdx", "r15", 8)                            // val = barrier.total (wake all threads)
 	fc.out.Syscall()
 
 	// Jump to exit
@@ -3735,8 +3614,8 @@ func (fc *C67Compiler) compileParallelRangeLoop(stmt *LoopStmt, rangeExpr *Range
 	wakeExitOffset := int32(threadExitPos - (wakeExitJumpPos + UnconditionalJumpSize))
 	fc.patchJumpImmediate(wakeExitJumpPos+1, wakeExitOffset)
 
-	// Restore stack pointer (matches the sub rsp, 56 in prologue)
-	fc.out.AddImmToReg("rsp", 56)
+	// Restore stack pointer (matches the sub rsp in the prologue)
+	fc.out.AddImmToReg("rsp", threadFrame)
 
 	// Note: Argument structure cleanup - currently relies on process termination
 	// (Memory leak acceptable for short-lived thread wrapper functions)
@@ -3916,6 +3795,7 @@ func (fc *C67Compiler) compileJumpStatement(stmt *JumpStmt) {
 			fc.compileExpression(stmt.Value)
 			// xmm0 now contains return value
 		}
+		fc.releaseHeldLocks(-1)
 		fc.out.MovRegToReg("rsp", "rbp")
 
 		// REGISTER ALLOCATOR: Restore callee-saved registers (for lambda functions)
@@ -3965,6 +3845,9 @@ func (fc *C67Compiler) compileJumpStatement(stmt *JumpStmt) {
 		}
 	}
 
+	// Unlock lock blocks entered inside the target loop
+	fc.releaseHeldLocks(targetLoopIndex)
+
 	if stmt.IsBreak {
 		// Break: jump to end of target loop
 		jumpPos := fc.eb.text.Len()
@@ -4261,10 +4144,10 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 		fc.out.SubImmFromReg("rsp", 8)
 
 		// Call getrandom: syscall(318, rsp, 8, 0)
-		fc.out.MovImmToReg("rax", "318")   // getrandom syscall number
-		fc.out.MovRegToReg("rdi", "rsp")   // buffer = stack pointer
-		fc.out.MovImmToReg("rsi", "8")     // length = 8 bytes
-		fc.out.XorRegWithReg("rdx", "rdx") // flags = 0
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_GETRANDOM")) // getrandom syscall number
+		fc.out.MovRegToReg("rdi", "rsp")                          // buffer = stack pointer
+		fc.out.MovImmToReg("rsi", "8")                            // length = 8 bytes
+		fc.out.XorRegWithReg("rdx", "rdx")                        // flags = 0
 		fc.out.Syscall()
 
 		// Load the random uint64 from stack
@@ -4299,6 +4182,16 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 		fc.out.DivsdXmm("xmm0", "xmm1")
 
 	case *BooleanExpr:
+		if fc.scalars.Unboxed(e) {
+			// Only used as a number, so the marker is never looked at
+			if e.Value {
+				fc.out.MovImmToReg("rax", "1")
+				fc.out.Cvtsi2sd("xmm0", "rax")
+			} else {
+				fc.out.XorpdXmm("xmm0", "xmm0")
+			}
+			break
+		}
 		// Boolean: yes = {0: 1.0, 1: 1.0}, no = {0: 0.0, 1: 0.0}
 		// Marker at key 1 distinguishes booleans from numbers
 		// Allocate 40 bytes (count + 2 entries × (key + value))
@@ -4478,8 +4371,8 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 			compilerError("use of moved variable '%s' - value was transferred with '!'", e.Name)
 		}
 
-		// Check if it's a global variable
-		if dataOffset, isGlobal := fc.globalVars[e.Name]; isGlobal {
+		// Check if it's a global variable, unless a parameter hides it
+		if dataOffset, isGlobal := fc.globalVars[e.Name]; isGlobal && !fc.lambdaParams[e.Name] {
 			// Load from .data section
 			// lea rax, [rel _global_varname]
 			// movsd xmm0, [rax]
@@ -4514,6 +4407,9 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 			}
 			fc.out.MovMemToXmm("xmm0", baseReg, -offset)
 		}
+		if p := fc.persistentBinding(e.Name); p != nil {
+			fc.flattenPersistent(p)
+		}
 
 	case *MoveExpr:
 		// Compile the expression being moved (loads into xmm0)
@@ -4654,6 +4550,10 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 		}
 
 	case *UnaryExpr:
+		if ident, p := fc.persistentIdent(e.Operand); p != nil && e.Operator == "#" {
+			fc.compilePersistentLength(ident)
+			break
+		}
 		// Compile the operand first (result in xmm0)
 		fc.compileExpression(e.Operand)
 
@@ -5323,14 +5223,14 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 			fc.eb.Define(errorLabel, errorMsg)
 
 			// syscall: write(2, msg, len)
-			fc.out.MovImmToReg("rax", "1")
+			fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 			fc.out.MovImmToReg("rdi", "2")
 			fc.out.LeaSymbolToReg("rsi", errorLabel)
 			fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", len(errorMsg)))
 			fc.eb.Emit("syscall")
 
 			// syscall: exit(1)
-			fc.out.MovImmToReg("rax", "60")
+			fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_EXIT"))
 			fc.out.MovImmToReg("rdi", "1")
 			fc.eb.Emit("syscall")
 
@@ -5689,36 +5589,35 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 			// Size: 8 + (count * 16) bytes
 			size := 8 + (count * 16)
 
-			// Allocate memory using arena allocator
-			fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", size))
-			fc.callArenaAlloc() // Use arena instead of malloc
+			// Allocate memory in the stack frame or the arena
+			fc.emitAllocation(e, size)
 			// rax now contains pointer to allocated memory
 
-			// Save list pointer
-			fc.out.PushReg("rbx")
-			fc.out.MovRegToReg("rbx", "rax") // rbx = list pointer
+			// Keep the list pointer on the stack: elements may use rbx, which
+			// also holds loop counters
+			fc.out.SubImmFromReg("rsp", 16)
+			fc.out.MovRegToMem("rax", "rsp", 0)
 
 			// Write count
-			fc.out.MovImmToReg("rax", fmt.Sprintf("%d", count))
-			fc.out.Cvtsi2sd("xmm0", "rax")
-			fc.out.MovXmmToMem("xmm0", "rbx", 0)
+			fc.out.MovImmToReg("rcx", fmt.Sprintf("%d", count))
+			fc.out.Cvtsi2sd("xmm0", "rcx")
+			fc.out.MovXmmToMem("xmm0", "rax", 0)
 
 			// Write each [key, value] pair
 			for i, elem := range e.Elements {
 				offset := 8 + (i * 16)
 
-				// Write key (index)
-				fc.out.MovImmToReg("rax", fmt.Sprintf("%d", i))
-				fc.out.MovRegToMem("rax", "rbx", offset)
-
-				// Compile and write value
+				// Compile value, then write key (index) and value
 				fc.compileExpression(elem)
-				fc.out.MovXmmToMem("xmm0", "rbx", offset+8)
+				fc.out.MovMemToReg("rax", "rsp", 0)
+				fc.out.MovImmToReg("rcx", fmt.Sprintf("%d", i))
+				fc.out.MovRegToMem("rcx", "rax", offset)
+				fc.out.MovXmmToMem("xmm0", "rax", offset+8)
 			}
 
 			// Return list pointer in xmm0
-			fc.out.MovqRegToXmm("xmm0", "rbx")
-			fc.out.PopReg("rbx")
+			fc.out.MovMemToXmm("xmm0", "rsp", 0)
+			fc.out.AddImmToReg("rsp", 16)
 		}
 
 	case *InExpr:
@@ -5788,6 +5687,27 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 
 	case *MapExpr:
 		// Map literal stored as: [count (float64)] [key1] [value1] [key2] [value2] ...
+		if !isStaticMap(e) {
+			// Keys or values computed at runtime: allocate and fill in,
+			// keeping the map pointer on the stack while they are compiled
+			fc.emitAllocation(e, 8+len(e.Keys)*16)
+			fc.out.SubImmFromReg("rsp", 16)
+			fc.out.MovRegToMem("rax", "rsp", 0)
+			fc.out.MovImmToReg("rcx", fmt.Sprintf("%d", len(e.Keys)))
+			fc.out.Cvtsi2sd("xmm0", "rcx")
+			fc.out.MovXmmToMem("xmm0", "rax", 0)
+			for i := range e.Keys {
+				fc.compileExpression(e.Keys[i])
+				fc.out.MovMemToReg("rax", "rsp", 0)
+				fc.out.MovXmmToMem("xmm0", "rax", 8+i*16)
+				fc.compileExpression(e.Values[i])
+				fc.out.MovMemToReg("rax", "rsp", 0)
+				fc.out.MovXmmToMem("xmm0", "rax", 16+i*16)
+			}
+			fc.out.MovMemToXmm("xmm0", "rsp", 0)
+			fc.out.AddImmToReg("rsp", 16)
+			break
+		}
 		// Even empty maps need a proper data structure with count = 0
 		labelName := fmt.Sprintf("map_%d", fc.stringCounter)
 		fc.stringCounter++
@@ -5826,6 +5746,10 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 		fc.out.MovMemToXmm("xmm0", "rsp", 0)
 		fc.out.AddImmToReg("rsp", StackSlotSize)
 	case *IndexExpr:
+		if ident, p := fc.persistentIdent(e.List); p != nil {
+			fc.compilePersistentIndex(ident, e.Index, p)
+			break
+		}
 		// Determine if we're indexing a map/string or list
 		// Strings are map[uint64]float64, so use map indexing
 		containerType := fc.getExprType(e.List)
@@ -5930,22 +5854,20 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 			// Gather 8 keys using VGATHERQPD
 			// vgatherqpd zmm0{k1}, [rbx + zmm4*1]
 			// First, set mask k1 to all 1s (we want all 8 values)
-			fc.out.Emit([]byte{0xc5, 0xf8, 0x92, 0xc9}) // kmovb k1, ecx (set to 0xFF)
-			// Actually, let's use kxnorb k1, k1, k1 to set all bits to 1
-			fc.out.Emit([]byte{0xc5, 0xfc, 0x46, 0xc9}) // kxnorb k1, k0, k1 -> k1 = 0xFF
+			fc.out.Emit([]byte{0xc5, 0xf4, 0x46, 0xc9}) // kxnorw k1, k1, k1 -> k1 = 0xFFFF
 
 			// vgatherqpd zmm0{k1}, [rbx + zmm4*1]
-			// EVEX.512.66.0F38.W1 92 /r
+			// EVEX.512.66.0F38.W1 93 /vsib
 			// This is complex - we need rbx as base, zmm4 as index, scale=1
-			fc.out.Emit([]byte{0x62, 0xf2, 0xfd, 0x49, 0x92, 0x04, 0xe3}) // [rbx + zmm4*1]
+			fc.out.Emit([]byte{0x62, 0xf2, 0xfd, 0x49, 0x93, 0x04, 0x23}) // [rbx + zmm4*1]
 
 			// Compare all 8 keys with search key
-			// vcmppd k2{k1}, zmm0, zmm3, 0 (EQ_OQ)
-			fc.out.Emit([]byte{0x62, 0xf1, 0xfd, 0x49, 0xc2, 0xd3, 0x00}) // EVEX.512.66.0F.W1 C2 /r ib
+			// vcmppd k2, zmm0, zmm3, 0 (EQ_OQ), unmasked since the gather cleared k1
+			fc.out.Emit([]byte{0x62, 0xf1, 0xfd, 0x48, 0xc2, 0xd3, 0x00}) // EVEX.512.66.0F.W1 C2 /r ib
 
 			// Extract mask to GPR
 			// kmovb eax, k2
-			fc.out.Emit([]byte{0xc5, 0xf9, 0x90, 0xc2}) // kmovb eax, k2
+			fc.out.Emit([]byte{0xc5, 0xf9, 0x93, 0xc2}) // kmovb eax, k2
 
 			// Test if any key matched
 			fc.out.Emit([]byte{0x85, 0xc0}) // test eax, eax
@@ -6239,24 +6161,25 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 		// For closures with captured variables, we need runtime allocation
 		// For simple lambdas, use a static closure object with NULL environment
 		if e.IsNestedLambda && len(e.CapturedVars) > 0 {
-			// Allocate closure object and environment on the heap using malloc
+			// Allocate closure object and environment in the stack frame or the arena
 			// Closure: [func_ptr, env_ptr] (16 bytes)
 			// Environment: [var0, var1, ...] (8 bytes each)
 			envSize := len(e.CapturedVars) * 8
 			totalSize := 16 + envSize // closure object + environment
 
-			// Note: Currently uses malloc for closures. Future: arena allocation
-			// Allocate memory for closure environment
-			// Ensure stack is 16-byte aligned before call
-			// Save current rsp to restore after alignment
-			fc.out.MovRegToReg("r13", "rsp") // Save original rsp
-			fc.out.AndRegWithImm("rsp", -16) // Align to 16 bytes
+			if _, ok := fc.stackSlots[e]; ok {
+				fc.emitAllocation(e, totalSize)
+			} else {
+				// Allocate memory for closure environment
+				// Ensure stack is 16-byte aligned before call
+				// Save current rsp to restore after alignment
+				fc.out.MovRegToReg("r13", "rsp") // Save original rsp
+				fc.out.AndRegWithImm("rsp", -16) // Align to 16 bytes
 
-			fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", totalSize))
-			// Allocate from arena
-			fc.callArenaAlloc()
+				fc.emitAllocation(e, totalSize)
 
-			fc.out.MovRegToReg("rsp", "r13") // Restore original rsp
+				fc.out.MovRegToReg("rsp", "r13") // Restore original rsp
+			}
 			fc.out.MovRegToReg("r12", "rax") // r12 = closure object pointer
 
 			// Store function pointer at offset 0
@@ -6285,26 +6208,8 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 			fc.out.MovMemToXmm("xmm0", "rsp", 0)
 			fc.out.AddImmToReg("rsp", 16)
 		} else {
-			// Simple lambda (no captures) - create static closure object
-			// Closure object format: [func_ptr (8 bytes), env_ptr (8 bytes)]
-			closureLabel := fmt.Sprintf("closure_%s", funcName)
-
-			// We can't statically encode a function pointer, so we'll do it at runtime
-			// Create a placeholder in .data (writable!) for the closure object
-			// We need writable memory because we initialize it at runtime
-			fc.eb.DefineWritable(closureLabel, strings.Repeat("\x00", 16))
-
-			// At runtime, initialize the closure object with function pointer
-			fc.out.LeaSymbolToReg("r12", closureLabel) // r12 = closure object address
-			fc.out.LeaSymbolToReg("rax", funcName)     // rax = function pointer
-			fc.out.MovRegToMem("rax", "r12", 0)        // Store func ptr at offset 0
-			// Offset 8 is already 0 (NULL environment) from the zeroed data
-
-			// Return closure object pointer as float64 in xmm0
-			fc.out.SubImmFromReg("rsp", 16)
-			fc.out.MovRegToMem("r12", "rsp", 0)
-			fc.out.MovMemToXmm("xmm0", "rsp", 0)
-			fc.out.AddImmToReg("rsp", 16)
+			// Simple lambda (no captures) - static closure object with a NULL environment
+			fc.loadStaticClosure(funcName)
 		}
 
 	case *PatternLambdaExpr:
@@ -6345,6 +6250,10 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 		fc.out.AddImmToReg("rsp", StackSlotSize)
 
 	case *LengthExpr:
+		if ident, p := fc.persistentIdent(e.Operand); p != nil {
+			fc.compilePersistentLength(ident)
+			break
+		}
 		// MAP/LIST LENGTH: Read count from header [count][key0][val0]...
 		// Compile the operand (should be a list/map, returns pointer as float64 in xmm0)
 		fc.compileExpression(e.Operand)
@@ -6448,6 +6357,16 @@ func (fc *C67Compiler) compileExpression(expr Expression) {
 	case *CastExpr:
 		fc.compileCastExpr(e)
 
+	case *FieldAccessExpr:
+		// Metadata of cstructs from C headers (sdl.SDL_Event.size,
+		// sdl.SDL_Event.type.offset) and from imported modules (Pair.size)
+		if value, isType, ok := fc.cstructMetadata(e); ok {
+			fc.out.MovImmToReg("rax", strconv.Itoa(value))
+			fc.out.Cvtsi2sd("xmm0", "rax")
+		} else if isType {
+			compilerError("'%s' is not a struct size or field offset", fieldAccessPath(e))
+		}
+
 	case *UnsafeExpr:
 		fc.compileUnsafeExpr(e)
 
@@ -6552,7 +6471,10 @@ func (fc *C67Compiler) compileMatchExpr(expr *MatchExpr) {
 		// Only default clause - don't jump over it, fall through to execute it
 		// No clauses to process, go straight to default
 	} else {
-		for _, clause := range expr.Clauses {
+		// Arms that can not both match are tested in order of their profile counts
+		for _, i := range profileClauseOrder(expr) {
+			clause := expr.Clauses[i]
+
 			// Patch any guards that should skip to this clause
 			for _, pos := range pendingGuardJumps {
 				offset := int32(fc.eb.text.Len() - (pos + 6))
@@ -6570,6 +6492,7 @@ func (fc *C67Compiler) compileMatchExpr(expr *MatchExpr) {
 				pendingGuardJumps = append(pendingGuardJumps, guardJump)
 			}
 
+			fc.emitProfileCount(profileArmKey(expr, i))
 			fc.compileMatchClauseResult(clause.Result, &endJumpPositions)
 		}
 	}
@@ -6587,6 +6510,7 @@ func (fc *C67Compiler) compileMatchExpr(expr *MatchExpr) {
 		fc.patchJumpImmediate(defaultJumpPos+2, defaultOffset)
 	}
 
+	fc.emitProfileCount(profileArmKey(expr, -1))
 	fc.compileMatchDefault(expr.DefaultExpr)
 
 	endPos := fc.eb.text.Len()
@@ -6646,6 +6570,7 @@ func (fc *C67Compiler) compileMatchJump(jumpExpr *JumpExpr) {
 			fc.compileExpression(jumpExpr.Value)
 			// xmm0 now contains return value
 		}
+		fc.releaseHeldLocks(-1)
 		fc.out.MovRegToReg("rsp", "rbp")
 
 		// REGISTER ALLOCATOR: Restore callee-saved registers (for lambda functions)
@@ -6686,6 +6611,8 @@ func (fc *C67Compiler) compileMatchJump(jumpExpr *JumpExpr) {
 			keyword, jumpExpr.Label, jumpExpr.Label)
 	}
 
+	fc.releaseHeldLocks(targetLoopIndex)
+
 	if jumpExpr.IsBreak {
 		// ret @N - exit loop N and all inner loops
 		jumpPos := fc.eb.text.Len()
@@ -6750,6 +6677,28 @@ func (fc *C67Compiler) compileCastExpr(expr *CastExpr) {
 		}
 	}
 
+	// A C call that returns a cstruct by value (see cabi.go)
+	if decl := fc.cstructByValue(expr.Type); decl != nil {
+		if call, ok := expr.Expr.(*CallExpr); ok {
+			if call.IsCFFI {
+				fc.compileCFunctionCall("", call.Function, call.Args, decl)
+				return
+			}
+			if namespace, funcName, ok := strings.Cut(call.Function, "."); ok {
+				if libName, isC := fc.cImports[namespace]; isC {
+					fc.compileCFunctionCall(libName, funcName, call.Args, decl)
+					return
+				}
+			}
+		}
+	}
+
+	// A callback type turns a lambda into a C function pointer (see callbacks.go)
+	if ct, ok := parseCallbackType(expr.Type); ok {
+		fc.compileCallbackCast(expr, ct)
+		return
+	}
+
 	// Compile the expression being cast (result in xmm0)
 	fc.compileExpression(expr.Expr)
 
@@ -7797,12 +7746,26 @@ func (fc *C67Compiler) generateLambdaFunctions() {
 		// Ensure 16-byte alignment for external function calls
 		frameSize = (frameSize + 15) & ^15
 
+		// Allocations that escape analysis keeps in this function sit below
+		// everything else in the frame
+		slots, slotBytes := fc.escapes.StackSlots(lambda.Name, lambda.Params, lambda.Body)
+		frameSize += slotBytes
+		fc.stackSlots = make(map[Expression]int)
+		for _, slot := range slots {
+			fc.stackSlots[slot.Site] = frameSize - slot.Offset
+			if VerboseMode {
+				fmt.Fprintf(os.Stderr, "Escape analysis: %s: %s stays on the stack (%d bytes)\n", lambda.Name, describeAllocation(slot.Site), slot.Size)
+			}
+		}
+
 		// Allocate entire frame at once (keeps rsp aligned)
 		fc.out.SubImmFromReg("rsp", int64(frameSize))
 
 		// Save rbx at fixed location
 		fc.out.MovRegToMem("rbx", "rbp", -8)
 
+		fc.emitProfileCount(profileCallsKey(lambda.Name))
+
 		// Stack layout after prologue:
 		// [rbp+0]  = saved rbp (from push)
 		// [rbp-8]  = saved rbx
@@ -7833,6 +7796,8 @@ func (fc *C67Compiler) generateLambdaFunctions() {
 		}
 		fc.stackOffset = 0
 		fc.runtimeStack = 0 // Not used in new convention
+		oldLambdaParams := fc.lambdaParams
+		fc.lambdaParams = make(map[string]bool)
 
 		// Store parameters from xmm registers at fixed offsets
 		// Parameters come in xmm0, xmm1, xmm2, ...
@@ -7859,6 +7824,7 @@ func (fc *C67Compiler) generateLambdaFunctions() {
 			fc.stackOffset = paramOffset // Track for collectSymbols compatibility
 			fc.variables[paramName] = paramOffset
 			fc.mutableVars[paramName] = false
+			fc.lambdaParams[paramName] = true
 
 			// Mark parameter type as "number" by default (all values are float64 in C67)
 			// This prevents x + y from being interpreted as list append when x and y are parameters
@@ -8046,6 +8012,7 @@ func (fc *C67Compiler) generateLambdaFunctions() {
 
 		// Clear lambda context
 		fc.currentLambda = nil
+		fc.stackSlots = nil
 
 		// Function epilogue with proper calling convention
 		// Restore rbx from fixed location
@@ -8060,9 +8027,16 @@ func (fc *C67Compiler) generateLambdaFunctions() {
 		// Return to caller
 		fc.out.Ret()
 
+		// Record where the function ends (used to extract its code for hot patching)
+		if fc.lambdaCodeEndOffsets == nil {
+			fc.lambdaCodeEndOffsets = make(map[string]int)
+		}
+		fc.lambdaCodeEndOffsets[lambda.Name] = fc.eb.text.Len()
+
 		// Restore previous state
 		fc.variables = oldVariables
 		fc.mutableVars = oldMutableVars
+		fc.lambdaParams = oldLambdaParams
 		fc.stackOffset = oldStackOffset
 		fc.runtimeStack = oldRuntimeStack
 	}
@@ -8228,68 +8202,6 @@ func (fc *C67Compiler) buildHotFunctionTable() {
 	}
 }
 
-func (fc *C67Compiler) generateHotFunctionTable() {
-	if len(fc.hotFunctions) == 0 {
-		return
-	}
-
-	var hotNames []string
-	for name := range fc.hotFunctions {
-		hotNames = append(hotNames, name)
-	}
-	sort.Strings(hotNames)
-
-	fc.hotTableRodataOffset = fc.eb.rodata.Len()
-	tableData := make([]byte, len(hotNames)*8)
-	fc.eb.Define("_hot_function_table", string(tableData))
-}
-
-func (fc *C67Compiler) patchHotFunctionTable() {
-	if len(fc.hotFunctions) == 0 {
-		return
-	}
-
-	tableConst, ok := fc.eb.consts["_hot_function_table"]
-	if !ok {
-		return
-	}
-
-	rodataSymbols := fc.eb.RodataSection()
-	firstRodataAddr := uint64(0xFFFFFFFFFFFFFFFF)
-	for symName := range rodataSymbols {
-		if c, ok := fc.eb.consts[symName]; ok {
-			if c.addr > 0 && c.addr < firstRodataAddr {
-				firstRodataAddr = c.addr
-			}
-		}
-	}
-
-	tableOffsetInRodata := int(tableConst.addr - firstRodataAddr)
-	rodataBytes := fc.eb.rodata.Bytes()
-
-	var hotNames []string
-	for name := range fc.hotFunctions {
-		hotNames = append(hotNames, name)
-	}
-	sort.Strings(hotNames)
-
-	for idx, name := range hotNames {
-		closureName := "closure_" + name
-		if closureConst, ok := fc.eb.consts[closureName]; ok {
-			closureAddr := closureConst.addr
-			offset := tableOffsetInRodata + idx*8
-			if offset >= 0 && offset+8 <= len(rodataBytes) {
-				binary.LittleEndian.PutUint64(rodataBytes[offset:offset+8], closureAddr)
-				if VerboseMode {
-					fmt.Fprintf(os.Stderr, "Hot table: %s -> closure at 0x%x\n", name, closureAddr)
-				}
-			}
-		} else if VerboseMode {
-			fmt.Fprintf(os.Stderr, "Hot table: closure_%s not found\n", name)
-		}
-	}
-}
-
 func (fc *C67Compiler) generateCacheLookup() {
 	fc.eb.MarkLabel("_vibe67_cache_lookup")
 
@@ -8444,8 +8356,19 @@ func (fc *C67Compiler) generateRuntimeHelpers() {
 		}
 	}
 
+	// Patch listener for hot functions (--watch)
+	fc.generateHotReloadRuntime()
+
+	// Writes the -profile-generate counters at exit
+	fc.generateProfileRuntime()
+
 	// Arena runtime functions are generated inline below (_vibe67_arena_create, alloc, etc)
 
+	// Generate mutex/rwlock/condvar/queue runtime if any sync primitive is used
+	if fc.usesSync {
+		fc.generateSyncRuntime()
+	}
+
 	// Generate syscall-based printf runtime on Linux
 	fc.GeneratePrintfSyscallRuntime()
 
@@ -8463,11 +8386,31 @@ func (fc *C67Compiler) generateRuntimeHelpers() {
 	// Define memoization caches (for pure function automatic memoization)
 	if len(fc.memoCaches) > 0 {
 		for cacheName := range fc.memoCaches {
-			// Allocate initial cache: 8 bytes for count
+			// Pointer to the cache's hash table, NULL until the first insert
 			fc.eb.DefineWritable(cacheName, "\x00\x00\x00\x00\x00\x00\x00\x00")
 		}
 	}
 
+	// Generate C callback trampolines only if used (see callbacks.go)
+	if fc.usedFunctions["_vibe67_callback_thunk"] {
+		fc.generateCallbacks()
+	}
+
+	// Generate the in-place append runtime only if used (see ownership.go)
+	if fc.usedFunctions["_vibe67_list_push"] {
+		fc.generateListPush()
+	}
+
+	// Generate the trie runtime only if used (see persistent.go)
+	if fc.persistent.Used() {
+		fc.generatePersistentRuntime()
+	}
+
+	// Generate the hash table runtime only if used
+	if fc.usedFunctions["_vibe67_map_find"] || fc.usedFunctions["_vibe67_map_set"] || fc.usedFunctions["_vibe67_map_delete"] {
+		fc.generateMapRuntime()
+	}
+
 	// Generate _vibe67_string_concat only if used
 	if fc.usedFunctions["_vibe67_string_concat"] {
 		if VerboseMode {
@@ -9862,13 +9805,13 @@ func (fc *C67Compiler) generateRuntimeHelpers() {
 			fc.deallocateShadowSpace(shadowSpace)
 		} else {
 			// Linux: use mmap (4096 bytes = 1 page)
-			fc.out.MovImmToReg("rdi", "0")    // addr = NULL
-			fc.out.MovImmToReg("rsi", "4096") // length = 4096
-			fc.out.MovImmToReg("rdx", "3")    // prot = PROT_READ | PROT_WRITE
-			fc.out.MovImmToReg("r10", "34")   // flags = MAP_PRIVATE | MAP_ANONYMOUS
-			fc.out.MovImmToReg("r8", "-1")    // fd = -1
-			fc.out.MovImmToReg("r9", "0")     // offset = 0
-			fc.out.MovImmToReg("rax", "9")    // syscall number for mmap
+			fc.out.MovImmToReg("rdi", "0")                                    // addr = NULL
+			fc.out.MovImmToReg("rsi", "4096")                                 // length = 4096
+			fc.out.MovImmToReg("rdx", "3")                                    // prot = PROT_READ | PROT_WRITE
+			fc.out.MovImmToReg("r10", fc.out.SysNum("MAP_PRIVATE_ANONYMOUS")) // flags = MAP_PRIVATE | MAP_ANONYMOUS
+			fc.out.MovImmToReg("r8", "-1")                                    // fd = -1
+			fc.out.MovImmToReg("r9", "0")                                     // offset = 0
+			fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MMAP"))              // syscall number for mmap
 			fc.out.Syscall()
 		}
 		fc.out.PopReg("r12") // Restore capacity
@@ -9892,13 +9835,13 @@ func (fc *C67Compiler) generateRuntimeHelpers() {
 			fc.deallocateShadowSpace(shadowSpace)
 		} else {
 			// Linux: use mmap
-			fc.out.MovImmToReg("rdi", "0")   // addr = NULL
-			fc.out.MovRegToReg("rsi", "r12") // length = capacity
-			fc.out.MovImmToReg("rdx", "3")   // prot = PROT_READ | PROT_WRITE
-			fc.out.MovImmToReg("r10", "34")  // flags = MAP_PRIVATE | MAP_ANONYMOUS
-			fc.out.MovImmToReg("r8", "-1")   // fd = -1
-			fc.out.MovImmToReg("r9", "0")    // offset = 0
-			fc.out.MovImmToReg("rax", "9")   // syscall number for mmap
+			fc.out.MovImmToReg("rdi", "0")                                    // addr = NULL
+			fc.out.MovRegToReg("rsi", "r12")                                  // length = capacity
+			fc.out.MovImmToReg("rdx", "3")                                    // prot = PROT_READ | PROT_WRITE
+			fc.out.MovImmToReg("r10", fc.out.SysNum("MAP_PRIVATE_ANONYMOUS")) // flags = MAP_PRIVATE | MAP_ANONYMOUS
+			fc.out.MovImmToReg("r8", "-1")                                    // fd = -1
+			fc.out.MovImmToReg("r9", "0")                                     // offset = 0
+			fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MMAP"))              // syscall number for mmap
 			fc.out.Syscall()
 		}
 
@@ -10075,11 +10018,11 @@ func (fc *C67Compiler) generateRuntimeHelpers() {
 			// Use mremap syscall on Linux
 			// syscall 25: mremap(void *old_address, size_t old_size, size_t new_size, int flags, ...)
 			// MREMAP_MAYMOVE = 1
-			fc.out.MovRegToReg("rdi", "r8")     // rdi = old buffer_ptr
-			fc.out.MovMemToReg("rsi", "rbx", 8) // rsi = old capacity from arena
-			fc.out.MovRegToReg("rdx", "r9")     // rdx = new_capacity
-			fc.out.MovImmToReg("r10", "1")      // r10 = MREMAP_MAYMOVE
-			fc.out.MovImmToReg("rax", "25")     // rax = syscall number for mremap
+			fc.out.MovRegToReg("rdi", "r8")                        // rdi = old buffer_ptr
+			fc.out.MovMemToReg("rsi", "rbx", 8)                    // rsi = old capacity from arena
+			fc.out.MovRegToReg("rdx", "r9")                        // rdx = new_capacity
+			fc.out.MovImmToReg("r10", "1")                         // r10 = MREMAP_MAYMOVE
+			fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MREMAP")) // rax = syscall number for mremap
 			fc.out.Syscall()
 
 			// Check if mremap failed (returns MAP_FAILED = -1 or negative on error)
@@ -10150,11 +10093,11 @@ func (fc *C67Compiler) generateRuntimeHelpers() {
 			fc.out.MovImmToReg("rdi", "2") // stderr
 			fc.out.LeaSymbolToReg("rsi", errorLabel)
 			fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", len(errorMsg)))
-			fc.out.MovImmToReg("rax", "1") // write syscall
+			fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // write syscall
 			fc.out.Syscall()
 
-			fc.out.MovImmToReg("rdi", "1")  // exit code 1
-			fc.out.MovImmToReg("rax", "60") // exit syscall
+			fc.out.MovImmToReg("rdi", "1")                       // exit code 1
+			fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_EXIT")) // exit syscall
 			fc.out.Syscall()
 		}
 
@@ -10185,15 +10128,15 @@ func (fc *C67Compiler) generateRuntimeHelpers() {
 		fc.out.MovRegToReg("rbx", "rdi") // rbx = arena_ptr
 
 		// Munmap buffer: munmap(ptr, size) via syscall 11
-		fc.out.MovMemToReg("rdi", "rbx", 0) // rdi = buffer_ptr
-		fc.out.MovMemToReg("rsi", "rbx", 8) // rsi = capacity
-		fc.out.MovImmToReg("rax", "11")     // rax = syscall number for munmap
+		fc.out.MovMemToReg("rdi", "rbx", 0)                    // rdi = buffer_ptr
+		fc.out.MovMemToReg("rsi", "rbx", 8)                    // rsi = capacity
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MUNMAP")) // rax = syscall number for munmap
 		fc.out.Syscall()
 
 		// Munmap arena structure: munmap(ptr, 32) via syscall 11
-		fc.out.MovRegToReg("rdi", "rbx")  // rdi = arena_ptr
-		fc.out.MovImmToReg("rsi", "4096") // rsi = page size (was 32, but mmap'd full page)
-		fc.out.MovImmToReg("rax", "11")   // rax = syscall number for munmap
+		fc.out.MovRegToReg("rdi", "rbx")                       // rdi = arena_ptr
+		fc.out.MovImmToReg("rsi", "4096")                      // rsi = page size (was 32, but mmap'd full page)
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MUNMAP")) // rax = syscall number for munmap
 		fc.out.Syscall()
 
 		fc.out.PopReg("rbx")
@@ -10674,10 +10617,10 @@ func (fc *C67Compiler) generateRuntimeHelpers() {
 			fc.out.MovRegToMem("rdi", "r13", 0)
 
 			// write(1, buffer, 1)
-			fc.out.MovImmToReg("rax", "1")   // syscall: write
-			fc.out.MovImmToReg("rdi", "1")   // fd: stdout
-			fc.out.MovRegToReg("rsi", "r13") // buffer
-			fc.out.MovImmToReg("rdx", "1")   // length: 1
+			fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // syscall: write
+			fc.out.MovImmToReg("rdi", "1")                        // fd: stdout
+			fc.out.MovRegToReg("rsi", "r13")                      // buffer
+			fc.out.MovImmToReg("rdx", "1")                        // length: 1
 			fc.out.Syscall()
 
 			// Increment and loop
@@ -10692,10 +10635,10 @@ func (fc *C67Compiler) generateRuntimeHelpers() {
 			// Print newline
 			fc.out.MovImmToReg("rax", "10") // '\n'
 			fc.out.MovRegToMem("rax", "r13", 0)
-			fc.out.MovImmToReg("rax", "1")   // syscall: write
-			fc.out.MovImmToReg("rdi", "1")   // fd: stdout
-			fc.out.MovRegToReg("rsi", "r13") // buffer
-			fc.out.MovImmToReg("rdx", "1")   // length: 1
+			fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // syscall: write
+			fc.out.MovImmToReg("rdi", "1")                        // fd: stdout
+			fc.out.MovRegToReg("rsi", "r13")                      // buffer
+			fc.out.MovImmToReg("rdx", "1")                        // length: 1
 			fc.out.Syscall()
 
 			// Restore
@@ -10814,10 +10757,10 @@ func (fc *C67Compiler) generateRuntimeHelpers() {
 			fc.out.MovRegToMem("rax", "r13", 0)
 
 			// Write syscall
-			fc.out.MovImmToReg("rax", "1")   // syscall: write
-			fc.out.MovImmToReg("rdi", "1")   // fd: stdout
-			fc.out.MovRegToReg("rsi", "r13") // buffer
-			fc.out.MovImmToReg("rdx", "1")   // length: 1
+			fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // syscall: write
+			fc.out.MovImmToReg("rdi", "1")                        // fd: stdout
+			fc.out.MovRegToReg("rsi", "r13")                      // buffer
+			fc.out.MovImmToReg("rdx", "1")                        // length: 1
 			fc.out.Syscall()
 
 			// Increment and loop
@@ -10888,13 +10831,13 @@ func (fc *C67Compiler) initializeMetaArenaAndGlobalArena() {
 		fc.deallocateShadowSpace(shadowSpace)
 	} else {
 		// Linux: use mmap syscall
-		fc.out.MovImmToReg("rdi", "0")                                  // addr = NULL
-		fc.out.MovImmToReg("rsi", fmt.Sprintf("%d", 8*initialCapacity)) // length = 32
-		fc.out.MovImmToReg("rdx", "3")                                  // prot = PROT_READ | PROT_WRITE
-		fc.out.MovImmToReg("r10", "34")                                 // flags = MAP_PRIVATE | MAP_ANONYMOUS
-		fc.out.MovImmToReg("r8", "-1")                                  // fd = -1
-		fc.out.MovImmToReg("r9", "0")                                   // offset = 0
-		fc.out.MovImmToReg("rax", "9")                                  // syscall number for mmap
+		fc.out.MovImmToReg("rdi", "0")                                    // addr = NULL
+		fc.out.MovImmToReg("rsi", fmt.Sprintf("%d", 8*initialCapacity))   // length = 32
+		fc.out.MovImmToReg("rdx", "3")                                    // prot = PROT_READ | PROT_WRITE
+		fc.out.MovImmToReg("r10", fc.out.SysNum("MAP_PRIVATE_ANONYMOUS")) // flags = MAP_PRIVATE | MAP_ANONYMOUS
+		fc.out.MovImmToReg("r8", "-1")                                    // fd = -1
+		fc.out.MovImmToReg("r9", "0")                                     // offset = 0
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MMAP"))              // syscall number for mmap
 		fc.out.Syscall()
 	}
 
@@ -10922,13 +10865,13 @@ func (fc *C67Compiler) initializeMetaArenaAndGlobalArena() {
 		fc.deallocateShadowSpace(shadowSpace)
 	} else {
 		// Linux: use mmap
-		fc.out.MovImmToReg("rdi", "0")       // addr = NULL
-		fc.out.MovImmToReg("rsi", "1048576") // length = 1MB
-		fc.out.MovImmToReg("rdx", "3")       // prot = PROT_READ | PROT_WRITE
-		fc.out.MovImmToReg("r10", "34")      // flags = MAP_PRIVATE | MAP_ANONYMOUS
-		fc.out.MovImmToReg("r8", "-1")       // fd = -1
-		fc.out.MovImmToReg("r9", "0")        // offset = 0
-		fc.out.MovImmToReg("rax", "9")       // syscall number for mmap
+		fc.out.MovImmToReg("rdi", "0")                                    // addr = NULL
+		fc.out.MovImmToReg("rsi", "1048576")                              // length = 1MB
+		fc.out.MovImmToReg("rdx", "3")                                    // prot = PROT_READ | PROT_WRITE
+		fc.out.MovImmToReg("r10", fc.out.SysNum("MAP_PRIVATE_ANONYMOUS")) // flags = MAP_PRIVATE | MAP_ANONYMOUS
+		fc.out.MovImmToReg("r8", "-1")                                    // fd = -1
+		fc.out.MovImmToReg("r9", "0")                                     // offset = 0
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MMAP"))              // syscall number for mmap
 		fc.out.Syscall()
 	}
 
@@ -10948,8 +10891,8 @@ func (fc *C67Compiler) initializeMetaArenaAndGlobalArena() {
 	} else {
 		fc.out.LeaSymbolToReg("rdi", "_malloc_failed_msg")
 		fc.callFunction("printf", "")
-		fc.out.MovImmToReg("rdi", "1")  // exit code 1
-		fc.out.MovImmToReg("rax", "60") // sys_exit
+		fc.out.MovImmToReg("rdi", "1")                       // exit code 1
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_EXIT")) // sys_exit
 		fc.out.Syscall()
 	}
 
@@ -10978,13 +10921,13 @@ func (fc *C67Compiler) initializeMetaArenaAndGlobalArena() {
 		fc.out.PopReg("r12") // Restore arena buffer
 	} else {
 		// Linux: use mmap (round up to page size)
-		fc.out.MovImmToReg("rdi", "0")    // addr = NULL
-		fc.out.MovImmToReg("rsi", "4096") // length = 4096 (page size)
-		fc.out.MovImmToReg("rdx", "3")    // prot = PROT_READ | PROT_WRITE
-		fc.out.MovImmToReg("r10", "34")   // flags = MAP_PRIVATE | MAP_ANONYMOUS
-		fc.out.MovImmToReg("r8", "-1")    // fd = -1
-		fc.out.MovImmToReg("r9", "0")     // offset = 0
-		fc.out.MovImmToReg("rax", "9")    // syscall number for mmap
+		fc.out.MovImmToReg("rdi", "0")                                    // addr = NULL
+		fc.out.MovImmToReg("rsi", "4096")                                 // length = 4096 (page size)
+		fc.out.MovImmToReg("rdx", "3")                                    // prot = PROT_READ | PROT_WRITE
+		fc.out.MovImmToReg("r10", fc.out.SysNum("MAP_PRIVATE_ANONYMOUS")) // flags = MAP_PRIVATE | MAP_ANONYMOUS
+		fc.out.MovImmToReg("r8", "-1")                                    // fd = -1
+		fc.out.MovImmToReg("r9", "0")                                     // offset = 0
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MMAP"))              // syscall number for mmap
 		fc.out.Syscall()
 	}
 
@@ -11043,10 +10986,10 @@ func (fc *C67Compiler) generateArenaInitFunction() {
 		fc.out.MovImmToReg("rdi", "0")
 		fc.out.MovImmToReg("rsi", fmt.Sprintf("%d", 8*initialCapacity))
 		fc.out.MovImmToReg("rdx", "3")
-		fc.out.MovImmToReg("r10", "34")
+		fc.out.MovImmToReg("r10", fc.out.SysNum("MAP_PRIVATE_ANONYMOUS"))
 		fc.out.MovImmToReg("r8", "-1")
 		fc.out.MovImmToReg("r9", "0")
-		fc.out.MovImmToReg("rax", "9")
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MMAP"))
 		fc.out.Syscall()
 	}
 
@@ -11073,10 +11016,10 @@ func (fc *C67Compiler) generateArenaInitFunction() {
 		fc.out.MovImmToReg("rdi", "0")
 		fc.out.MovImmToReg("rsi", "1048576")
 		fc.out.MovImmToReg("rdx", "3")
-		fc.out.MovImmToReg("r10", "34")
+		fc.out.MovImmToReg("r10", fc.out.SysNum("MAP_PRIVATE_ANONYMOUS"))
 		fc.out.MovImmToReg("r8", "-1")
 		fc.out.MovImmToReg("r9", "0")
-		fc.out.MovImmToReg("rax", "9")
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MMAP"))
 		fc.out.Syscall()
 	}
 
@@ -11093,7 +11036,7 @@ func (fc *C67Compiler) generateArenaInitFunction() {
 		fc.deallocateShadowSpace(shadowSpace)
 	} else {
 		fc.out.MovImmToReg("rdi", "1")
-		fc.out.MovImmToReg("rax", "60")
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_EXIT"))
 		fc.out.Syscall()
 	}
 
@@ -11115,13 +11058,13 @@ func (fc *C67Compiler) generateArenaInitFunction() {
 		fc.deallocateShadowSpace(shadowSpace)
 	} else {
 		// Linux: use mmap for arena struct (32 bytes)
-		fc.out.MovImmToReg("rdi", "0")  // addr = NULL
-		fc.out.MovImmToReg("rsi", "32") // length = 32
-		fc.out.MovImmToReg("rdx", "3")  // prot = PROT_READ | PROT_WRITE
-		fc.out.MovImmToReg("r10", "34") // flags = MAP_PRIVATE | MAP_ANONYMOUS
-		fc.out.MovImmToReg("r8", "-1")  // fd = -1
-		fc.out.MovImmToReg("r9", "0")   // offset = 0
-		fc.out.MovImmToReg("rax", "9")  // syscall number for mmap
+		fc.out.MovImmToReg("rdi", "0")                                    // addr = NULL
+		fc.out.MovImmToReg("rsi", "32")                                   // length = 32
+		fc.out.MovImmToReg("rdx", "3")                                    // prot = PROT_READ | PROT_WRITE
+		fc.out.MovImmToReg("r10", fc.out.SysNum("MAP_PRIVATE_ANONYMOUS")) // flags = MAP_PRIVATE | MAP_ANONYMOUS
+		fc.out.MovImmToReg("r8", "-1")                                    // fd = -1
+		fc.out.MovImmToReg("r9", "0")                                     // offset = 0
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MMAP"))              // syscall number for mmap
 		fc.out.Syscall()
 	}
 
@@ -11211,9 +11154,9 @@ func (fc *C67Compiler) cleanupAllArenas() {
 		fc.deallocateShadowSpace(shadowSpace)
 	} else {
 		// Linux: use munmap syscall
-		fc.out.MovMemToReg("rdi", "r9", 0) // rdi = buffer_ptr (arena[0])
-		fc.out.MovMemToReg("rsi", "r9", 8) // rsi = capacity (arena[8])
-		fc.out.MovImmToReg("rax", "11")    // syscall number for munmap
+		fc.out.MovMemToReg("rdi", "r9", 0)                     // rdi = buffer_ptr (arena[0])
+		fc.out.MovMemToReg("rsi", "r9", 8)                     // rsi = capacity (arena[8])
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MUNMAP")) // syscall number for munmap
 		fc.out.Syscall()
 	}
 
@@ -11228,9 +11171,9 @@ func (fc *C67Compiler) cleanupAllArenas() {
 		fc.deallocateShadowSpace(shadowSpace)
 	} else {
 		// Linux: use munmap syscall
-		fc.out.MovRegToReg("rdi", "r9")   // rdi = arena struct pointer
-		fc.out.MovImmToReg("rsi", "4096") // rsi = page size (was 32, but mmap'd full page)
-		fc.out.MovImmToReg("rax", "11")   // syscall number for munmap
+		fc.out.MovRegToReg("rdi", "r9")                        // rdi = arena struct pointer
+		fc.out.MovImmToReg("rsi", "4096")                      // rsi = page size (was 32, but mmap'd full page)
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MUNMAP")) // syscall number for munmap
 		fc.out.Syscall()
 	}
 
@@ -11254,9 +11197,9 @@ func (fc *C67Compiler) cleanupAllArenas() {
 		fc.deallocateShadowSpace(shadowSpace)
 	} else {
 		// Linux: use munmap
-		fc.out.MovRegToReg("rdi", "rbx")  // rdi = meta-arena pointer
-		fc.out.MovImmToReg("rsi", "2048") // rsi = size (256 arena pointers * 8 bytes)
-		fc.out.MovImmToReg("rax", "11")   // syscall number for munmap
+		fc.out.MovRegToReg("rdi", "rbx")                       // rdi = meta-arena pointer
+		fc.out.MovImmToReg("rsi", "2048")                      // rsi = size (256 arena pointers * 8 bytes)
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MUNMAP")) // syscall number for munmap
 		fc.out.Syscall()
 	}
 
@@ -11664,17 +11607,10 @@ func (fc *C67Compiler) compileLambdaDirectCall(call *CallExpr) {
 	fc.trackFunctionCall(call.Function)
 
 	if idx, isHot := fc.hotFunctionTable[call.Function]; isHot {
-		// Hot function: load closure object pointer from table and call through it
+		// Hot function: call through the hot function table, so that the code can be replaced at runtime
+		fc.emitHotMigrationCheck()
 		fc.out.LeaSymbolToReg("r11", "_hot_function_table")
-		offset := idx * 8
-		fc.out.MovMemToReg("rax", "r11", offset) // Load closure object pointer into rax
-
-		// Extract function pointer from closure object (offset 0)
-		fc.out.MovMemToReg("r11", "rax", 0)
-		// Extract environment pointer from closure object (offset 8)
-		fc.out.MovMemToReg("r15", "rax", 8)
-
-		// Call the function pointer
+		fc.out.MovMemToReg("r11", "r11", idx*8)
 		fc.out.CallRegister("r11")
 	} else {
 		fc.out.CallSymbol(call.Function)
@@ -11692,169 +11628,38 @@ func (fc *C67Compiler) compileMemoizedCall(call *CallExpr, lambda *LambdaFunc) {
 	fc.out.SubImmFromReg("rsp", 16)
 	fc.out.MovXmmToMem("xmm0", "rsp", 0) // Save argument on stack
 
-	// Load cache map pointer
-	fc.out.LeaSymbolToReg("rbx", cacheName)
-	fc.out.MovMemToReg("rbx", "rbx", 0) // rbx = cache pointer
-
-	// Check if cache is NULL (not yet initialized)
-	fc.out.TestRegReg("rbx", "rbx")
-	initCacheJump := fc.eb.text.Len()
-	fc.out.JumpConditional(JumpEqual, 0) // Jump to init if NULL
-
-	// Cache exists - check if argument is in cache
-	// Implement "arg in cache" check
-	fc.out.MovMemToXmm("xmm2", "rsp", 0) // xmm2 = argument to search for
-	fc.out.MovMemToXmm("xmm1", "rbx", 0) // Load count from cache
-	fc.out.Cvttsd2si("rcx", "xmm1")      // rcx = count
-
-	// Loop through cache entries
-	fc.out.XorRegWithReg("rdi", "rdi") // rdi = index
-	searchLoopStart := fc.eb.text.Len()
-	fc.out.CmpRegToReg("rdi", "rcx")
-	notFoundJump := fc.eb.text.Len()
-	fc.out.JumpConditional(JumpGreaterOrEqual, 0) // Exit loop if index >= count
-
-	// Load key at index: cache[8 + index*16]
-	fc.out.MovRegToReg("rax", "rdi")
-	fc.out.MulRegWithImm("rax", 16) // 16 bytes per key-value pair
-	fc.out.AddImmToReg("rax", 8)    // Skip count field
-	fc.out.AddRegToReg("rax", "rbx")
-	fc.out.MovMemToXmm("xmm3", "rax", 0) // xmm3 = key
-
-	// Compare key with argument
-	fc.out.Ucomisd("xmm2", "xmm3")
-	notEqualJump := fc.eb.text.Len()
-	fc.out.JumpConditional(JumpNotEqual, 0)
+	// The cache symbol holds a pointer to a hash table (see maps_runtime.go),
+	// which stays NULL until the first result is stored
+	fc.out.LeaSymbolToReg("rdi", cacheName)
+	fc.out.MovMemToReg("rdi", "rdi", 0)
+	fc.out.MovMemToReg("rsi", "rsp", 0) // Key = argument bits
+	fc.trackFunctionCall("_vibe67_map_find")
+	fc.out.CallSymbol("_vibe67_map_find")
+	fc.out.TestRegReg("rax", "rax")
+	missJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
 
-	// Found! Load cached value at cache[8 + index*16 + 8]
-	fc.out.MovMemToXmm("xmm0", "rax", 8) // Load value (8 bytes after key)
-	fc.out.AddImmToReg("rsp", 16)        // Clean up stack
+	// Found: rax = address of the cached value
+	fc.out.MovMemToXmm("xmm0", "rax", 0)
 	endJump := fc.eb.text.Len()
-	fc.out.JumpUnconditional(0) // Jump to end
-
-	// Not equal: try next entry
-	notEqualPos := fc.eb.text.Len()
-	fc.patchJumpImmediate(notEqualJump+2, int32(notEqualPos-(notEqualJump+6)))
-	fc.out.IncReg("rdi")
-	backJump := int32(searchLoopStart - (fc.eb.text.Len() + 5))
-	fc.out.JumpUnconditional(backJump)
+	fc.out.JumpUnconditional(0)
 
 	// Not found: call function and cache result
-	notFoundPos := fc.eb.text.Len()
-	fc.patchJumpImmediate(notFoundJump+2, int32(notFoundPos-(notFoundJump+6)))
-
-	// Load argument and call function
+	fc.patchJumpOffset(missJump+2, fc.eb.text.Len())
 	fc.out.MovMemToXmm("xmm0", "rsp", 0)
 	fc.trackFunctionCall(lambda.Name)
 	fc.out.CallSymbol(lambda.Name)
 	// xmm0 = result
-
-	// Save result
-	fc.out.SubImmFromReg("rsp", 16)
-	fc.out.MovXmmToMem("xmm0", "rsp", 0)
-
-	// Store in cache: need to add key-value pair to map
-	// For simplicity, use linear growth (reallocate and copy)
-	// Load cache pointer
-	fc.out.LeaSymbolToReg("r12", cacheName)
-	fc.out.MovMemToReg("rbx", "r12", 0)
-
-	// Load current count and save to callee-saved register (malloc will preserve it)
-	fc.out.MovMemToXmm("xmm1", "rbx", 0)
-	fc.out.Cvttsd2si("r14", "xmm1") // r14 = old count (callee-saved, preserved across malloc)
-
-	// Calculate new size: 8 + (count+1)*16 bytes
-	fc.out.MovRegToReg("rax", "r14")
-	fc.out.IncReg("rax")            // rax = new count
-	fc.out.MulRegWithImm("rax", 16) // rax = new count * 16
-	fc.out.AddImmToReg("rax", 8)    // rax = total bytes needed
-
-	// Reallocate cache using platform allocation
-	fc.out.SubImmFromReg("rsp", 16) // Align stack
-	fc.allocateMemoryPlatform("rax")
-	fc.out.AddImmToReg("rsp", 16)
-	// rax = new cache pointer (r14 still has old count - allocation preserves callee-saved regs)
-
-	// Copy old entries
-	fc.out.MovRegToReg("r13", "rax") // r13 = new cache
-	fc.out.LeaSymbolToReg("r12", cacheName)
-	fc.out.MovMemToReg("rbx", "r12", 0) // rbx = old cache
-
-	// Calculate bytes to copy: 8 + count*16
-	fc.out.MovRegToReg("rdx", "r14") // Use preserved old count from r14
-	fc.out.MulRegWithImm("rdx", 16)
-	fc.out.AddImmToReg("rdx", 8)
-
-	// memcpy: rdi=dest, rsi=src, rdx=size
-	fc.out.MovRegToReg("rdi", "r13")
-	fc.out.MovRegToReg("rsi", "rbx")
-	fc.out.SubImmFromReg("rsp", 16)
-	fc.callFunction("memcpy", "")
-	fc.out.AddImmToReg("rsp", 16)
-
-	// Old cache is arena-allocated, no need to free (arena cleanup handles it)
-
-	// Update cache pointer
-	fc.out.LeaSymbolToReg("r12", cacheName)
-	fc.out.MovRegToMem("r13", "r12", 0)
-
-	// Increment count in new cache
-	fc.out.MovMemToXmm("xmm1", "r13", 0)
-	fc.out.Cvttsd2si("rax", "xmm1")
-	fc.out.IncReg("rax")
-	fc.out.Cvtsi2sd("xmm1", "rax")
-	fc.out.MovXmmToMem("xmm1", "r13", 0)
-
-	// Add new entry at end: key = arg, value = result
-	// Position: 8 + (count)*16
-	fc.out.Cvttsd2si("rcx", "xmm1") // rcx = new count
-	fc.out.SubImmFromReg("rcx", 1)  // rcx = old count
-	fc.out.MulRegWithImm("rcx", 16)
-	fc.out.AddImmToReg("rcx", 8)
-	fc.out.AddRegToReg("rcx", "r13") // rcx = address for new entry
-
-	// Store key (argument)
-	fc.out.MovMemToXmm("xmm2", "rsp", 16)
-	fc.out.MovXmmToMem("xmm2", "rcx", 0)
-
-	// Store value (result)
-	fc.out.MovMemToXmm("xmm0", "rsp", 0)
-	fc.out.MovXmmToMem("xmm0", "rcx", 8)
-
-	// Clean up stack and return result
-	fc.out.AddImmToReg("rsp", 32) // Remove result + argument
-	doneJump := fc.eb.text.Len()
-	fc.out.JumpUnconditional(0)
-
-	// Initialize cache (first call)
-	initPos := fc.eb.text.Len()
-	fc.patchJumpImmediate(initCacheJump+2, int32(initPos-(initCacheJump+6)))
-
-	// Allocate initial cache: 8 bytes for count
-	fc.out.MovImmToReg("rax", "8")
-	fc.out.SubImmFromReg("rsp", 16)
-	fc.allocateMemoryPlatform("rax")
-	fc.out.AddImmToReg("rsp", 16)
-	// rax = cache pointer
-
-	// Initialize count to 0
-	fc.out.XorRegWithReg("rcx", "rcx")
-	fc.out.Cvtsi2sd("xmm1", "rcx")
-	fc.out.MovXmmToMem("xmm1", "rax", 0)
-
-	// Store cache pointer
-	fc.out.LeaSymbolToReg("rbx", cacheName)
-	fc.out.MovRegToMem("rax", "rbx", 0)
-	fc.out.MovRegToReg("rbx", "rax")
-
-	// Jump back to check (cache now exists)
-	backToCheck := int32(initCacheJump + 6 - (fc.eb.text.Len() + 5))
-	fc.out.JumpUnconditional(backToCheck)
+	fc.out.MovXmmToMem("xmm0", "rsp", 8)
+	fc.out.LeaSymbolToReg("rdi", cacheName)
+	fc.out.MovMemToReg("rsi", "rsp", 0)
+	fc.trackFunctionCall("_vibe67_map_set")
+	fc.out.CallSymbol("_vibe67_map_set")
+	fc.out.MovMemToXmm("xmm0", "rsp", 8)
 
 	// End label
-	endPos := fc.eb.text.Len()
-	fc.patchJumpImmediate(endJump+1, int32(endPos-(endJump+5)))
-	fc.patchJumpImmediate(doneJump+1, int32(endPos-(doneJump+5)))
+	fc.patchJumpOffset(endJump+1, fc.eb.text.Len())
+	fc.out.AddImmToReg("rsp", 16)
 
 	// Track cache for rodata storage allocation (defined before ELF generation)
 	if fc.memoCaches == nil {
@@ -13015,7 +12820,9 @@ func (fc *C67Compiler) compileRecursiveCall(call *CallExpr) {
 }
 
 // Confidence that this function is working: 85%
-func (fc *C67Compiler) compileCFunctionCall(libName string, funcName string, args []Expression) {
+// result, if not nil, is the cstruct the function returns by value when
+// the signature does not say so
+func (fc *C67Compiler) compileCFunctionCall(libName string, funcName string, args []Expression, result *CStructDecl) {
 	// Generate C FFI call
 	// Strategy for v1.1.0:
 	// 1. Marshal arguments according to System V AMD64 ABI
@@ -13117,9 +12924,10 @@ func (fc *C67Compiler) compileCFunctionCall(libName string, funcName string, arg
 				"free":    {ReturnType: "void", Params: []CFunctionParam{{Type: "void*"}}},
 				"realloc": {ReturnType: "void*", Params: []CFunctionParam{{Type: "void*"}, {Type: "size_t"}}},
 				"calloc":  {ReturnType: "void*", Params: []CFunctionParam{{Type: "size_t"}, {Type: "size_t"}}},
-				// Note: printf is variadic and can't be fully described here,
-				// but we can at least mark the format string as const char*
-				"printf": {ReturnType: "int", Params: []CFunctionParam{{Type: "const char*"}}},
+				// Formatted output
+				"printf":   {ReturnType: "int", Params: []CFunctionParam{{Type: "const char*"}}, Variadic: true},
+				"sprintf":  {ReturnType: "int", Params: []CFunctionParam{{Type: "char*"}, {Type: "const char*"}}, Variadic: true},
+				"snprintf": {ReturnType: "int", Params: []CFunctionParam{{Type: "char*"}, {Type: "size_t"}, {Type: "const char*"}}, Variadic: true},
 			}
 			if sig, ok := commonFunctions[funcName]; ok {
 				funcSig = sig
@@ -13131,19 +12939,59 @@ func (fc *C67Compiler) compileCFunctionCall(libName string, funcName string, arg
 		}
 	}
 
-	// Allocate stack space to save arguments temporarily
-	if len(args) > 0 {
-		argStackOffset := len(args) * 8
-		fc.out.SubImmFromReg("rsp", int64(argStackOffset))
+	isWindows := fc.eb.target.OS() == OSWindows
+
+	// Cstructs are passed and returned by value as the ABI classifies them (see cabi.go)
+	var returnType string
+	if funcSig != nil {
+		returnType = funcSig.ReturnType
+	}
+	if isPointerType(returnType) || returnType == "pointer" {
+		result = nil // c.malloc(n) as SDL_Event only names the type
+	}
+	if result == nil {
+		result = fc.cstructByValue(returnType)
+	}
+	var resultPassing StructPassing
+	hiddenResult := false
+	if result != nil {
+		resultPassing = classifyStruct(result, isWindows)
+		hiddenResult = !resultPassing.InRegisters()
+	}
 
+	// Allocate stack space to save arguments temporarily
+	if len(args) > 0 || hiddenResult {
 		// First pass: Determine type information for each argument
 		type argInfo struct {
 			castType     string
 			innerExpr    Expression
 			isFloatParam bool
+			structArg    *StructPassing // cstruct passed by value
+			word         int            // first 8-byte word of the argument in the temporary area
+			copyOffset   int            // where a cstruct passed by reference is copied
+			single       bool           // passed as a C float rather than a double
+			variadic     bool           // matches the "..." of the prototype, or there is none
 		}
 		argInfos := make([]argInfo, len(args))
 
+		// Arguments of a variadic function past its format string take the
+		// types the format asks for: c.printf("%f %d", x, n) passes n as an int
+		var formatKinds []byte
+		if funcSig != nil && funcSig.Variadic && len(funcSig.Params) > 0 && len(args) > len(funcSig.Params) {
+			if format, ok := args[len(funcSig.Params)-1].(*StringExpr); ok {
+				formatKinds = printfArgKinds(format.Value)
+			}
+		}
+
+		// The temporary area holds the words of the arguments, after the
+		// result pointer if the callee returns a cstruct through memory,
+		// followed by the copies of cstructs passed by reference
+		words := 0
+		if hiddenResult {
+			words = 1
+		}
+		copySize := 0
+
 		for i, arg := range args {
 			info := &argInfos[i]
 			info.innerExpr = arg
@@ -13152,6 +13000,11 @@ func (fc *C67Compiler) compileCFunctionCall(libName string, funcName string, arg
 			if castExpr, ok := arg.(*CastExpr); ok {
 				info.castType = castExpr.Type
 				info.innerExpr = castExpr.Expr
+				if _, isCallback := parseCallbackType(castExpr.Type); isCallback {
+					// The cast itself makes the function pointer
+					info.castType = "pointer"
+					info.innerExpr = castExpr
+				}
 			}
 
 			// Determine actual parameter type from signature
@@ -13159,6 +13012,39 @@ func (fc *C67Compiler) compileCFunctionCall(libName string, funcName string, arg
 			if funcSig != nil && i < len(funcSig.Params) {
 				paramType = funcSig.Params[i].Type
 			}
+			info.variadic = funcSig == nil || (funcSig.Variadic && i >= len(funcSig.Params))
+			if len(formatKinds) > 0 && info.castType == "" && i >= len(funcSig.Params) && i-len(funcSig.Params) < len(formatKinds) {
+				switch formatKinds[i-len(funcSig.Params)] {
+				case 'f':
+					info.castType = "double"
+				case 'p':
+					info.castType = "pointer"
+				case 's':
+					if fc.getExprType(arg) != "string" {
+						info.castType = "pointer"
+					}
+				default:
+					info.castType = "int"
+				}
+			}
+
+			// A cstruct by value, named by a cast (v as Vector2) or by the signature
+			structDecl := fc.cstructByValue(info.castType)
+			if structDecl == nil && info.castType == "" {
+				structDecl = fc.cstructByValue(paramType)
+			}
+			if structDecl != nil {
+				passing := classifyStruct(structDecl, isWindows)
+				info.structArg = &passing
+				info.castType = "struct"
+				info.word = words
+				words += passing.Slots()
+				if passing.ByRef {
+					info.copyOffset = copySize
+					copySize += (structDecl.Size + 15) &^ 15
+				}
+				continue
+			}
 
 			// Decide whether this parameter should be treated as float or int
 			if paramType == "float" || paramType == "double" {
@@ -13200,13 +13086,35 @@ func (fc *C67Compiler) compileCFunctionCall(libName string, funcName string, arg
 			} else {
 				info.isFloatParam = false
 			}
+			// A float parameter takes single precision, while a float passed
+			// through "..." is promoted to double
+			if paramType == "float" || (info.castType == "float" && funcSig != nil && !info.variadic) {
+				info.single = true
+			}
+			info.word = words
+			words++
 		}
+		// One spare word above the arguments pads the stack arguments
+		argStackOffset := (words+1)*8 + copySize
+		fc.out.SubImmFromReg("rsp", int64(argStackOffset))
 
 		// Second pass: Compile each argument and store on stack
 		// Save rbx (callee-saved) so we can use it to track argument base
 		fc.out.PushReg("rbx")
 		// Save the base stack pointer for storing arguments (after we've allocated space)
 		fc.out.LeaMemToReg("rbx", "rsp", 8) // rbx = rsp + 8 (account for pushed rbx)
+		// Keep rsp 16-byte aligned while the arguments compile, since they
+		// may call C themselves; restoring rsp from rbx drops the padding
+		if (argStackOffset+8)%16 != 0 {
+			fc.out.SubImmFromReg("rsp", 8)
+		}
+
+		if hiddenResult {
+			// Memory for the result; the callee also returns its address in rax
+			fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", result.Size))
+			fc.callArenaAlloc()
+			fc.out.MovRegToMem("rax", "rbx", 0)
+		}
 
 		for i := range args {
 			info := &argInfos[i]
@@ -13251,16 +13159,26 @@ func (fc *C67Compiler) compileCFunctionCall(libName string, funcName string, arg
 				fc.cContext = false
 			}
 
+			if info.structArg != nil {
+				// A cstruct value is the address of its memory
+				fc.out.Cvttsd2si("rsi", "xmm0")
+				fc.storeStructArg(info.structArg, info.word*8, (words+1)*8+info.copyOffset)
+				continue
+			}
+
 			// Store argument on stack based on its type
 			// Use rbx as base (saved at start of arg compilation)
 			if info.isFloatParam || castType == "float" || castType == "double" {
 				if isNullPointer {
 					// Store 0.0 for null pointer in float context
 					fc.out.XorpdXmm("xmm0", "xmm0")
-					fc.out.MovXmmToMem("xmm0", "rbx", i*8)
+					fc.out.MovXmmToMem("xmm0", "rbx", info.word*8)
 				} else {
 					// Keep as float64 in xmm0, store directly
-					fc.out.MovXmmToMem("xmm0", "rbx", i*8)
+					if info.single {
+						fc.out.Cvtsd2ss("xmm0", "xmm0")
+					}
+					fc.out.MovXmmToMem("xmm0", "rbx", info.word*8)
 				}
 			} else {
 				// Convert to integer or pointer
@@ -13322,8 +13240,8 @@ func (fc *C67Compiler) compileCFunctionCall(libName string, funcName string, arg
 					}
 				}
 
-				// Store on stack at offset i*8 from rbx (saved base)
-				fc.out.MovRegToMem("rax", "rbx", i*8)
+				// Store on stack at the argument's word from rbx (saved base)
+				fc.out.MovRegToMem("rax", "rbx", info.word*8)
 			}
 		}
 
@@ -13339,179 +13257,211 @@ func (fc *C67Compiler) compileCFunctionCall(libName string, funcName string, arg
 		// - Microsoft x64: Parameter slots consumed sequentially (param N uses slot N regardless of type)
 		// - System V AMD64: Int and float registers tracked separately
 
-		// Build a list of stack arguments that overflow registers
-		type stackArg struct {
-			offset int
-			value  int
-		}
-		var stackArgs []stackArg
-
-		isWindows := fc.eb.target.OS() == OSWindows
-		stackArgCount := 0
+		// Words of the arguments that overflow registers, in order
+		var stackWords []int
+		vectorRegs := 0 // xmm registers used, for AL on System V
 
 		if isWindows {
 			// Microsoft x64: Sequential parameter slots
+			slot := 0
+			if hiddenResult {
+				fc.out.MovMemToReg(intArgRegs[0], "rsp", 0)
+				slot++
+			}
 			for i := 0; i < len(args); i++ {
-				isFloatParam := argInfos[i].isFloatParam
+				info := &argInfos[i]
 
-				// For Windows, parameter N goes in slot N (first 4 slots)
-				if i < 4 {
-					if isFloatParam {
+				// For Windows, parameter N goes in slot N (first 4 slots);
+				// a cstruct takes one slot, by value or as a pointer to a copy
+				if slot < 4 {
+					if info.isFloatParam {
 						// Load into XMM register for this slot
-						fc.out.MovMemToXmm(floatArgRegs[i], "rsp", i*8)
+						fc.out.MovMemToXmm(floatArgRegs[slot], "rsp", info.word*8)
+						if info.variadic {
+							// A variadic callee reads it from the integer register
+							fc.out.MovMemToReg(intArgRegs[slot], "rsp", info.word*8)
+						}
 					} else {
 						// Load into integer register for this slot
-						fc.out.MovMemToReg(intArgRegs[i], "rsp", i*8)
+						fc.out.MovMemToReg(intArgRegs[slot], "rsp", info.word*8)
 					}
 				} else {
 					// Parameters 5+ go on stack
-					stackArgs = append(stackArgs, stackArg{offset: i * 8, value: stackArgCount})
-					stackArgCount++
+					stackWords = append(stackWords, info.word)
 				}
+				slot++
 			}
 		} else {
 			// System V AMD64: Track int and float registers separately
 			intRegIdx := 0
 			floatRegIdx := 0
+			if hiddenResult {
+				fc.out.MovMemToReg(intArgRegs[0], "rsp", 0)
+				intRegIdx++
+			}
 
 			for i := 0; i < len(args); i++ {
-				isFloatParam := argInfos[i].isFloatParam
+				info := &argInfos[i]
+
+				if p := info.structArg; p != nil {
+					// Each eightbyte goes in a register of its class, unless
+					// there are not enough left for all of them
+					ints, sses := p.RegisterCounts()
+					if p.InRegisters() && intRegIdx+ints <= len(intArgRegs) && floatRegIdx+sses <= len(floatArgRegs) {
+						for k, class := range p.Words {
+							if class == abiSSE {
+								fc.out.MovMemToXmm(floatArgRegs[floatRegIdx], "rsp", (info.word+k)*8)
+								floatRegIdx++
+							} else {
+								fc.out.MovMemToReg(intArgRegs[intRegIdx], "rsp", (info.word+k)*8)
+								intRegIdx++
+							}
+						}
+					} else {
+						for k := 0; k < p.Slots(); k++ {
+							stackWords = append(stackWords, info.word+k)
+						}
+					}
+					continue
+				}
 
-				if isFloatParam {
+				if info.isFloatParam {
 					if floatRegIdx < len(floatArgRegs) {
 						// Load into float register
-						fc.out.MovMemToXmm(floatArgRegs[floatRegIdx], "rsp", i*8)
+						fc.out.MovMemToXmm(floatArgRegs[floatRegIdx], "rsp", info.word*8)
 						floatRegIdx++
 					} else {
 						// Goes on stack
-						stackArgs = append(stackArgs, stackArg{offset: i * 8, value: stackArgCount})
-						stackArgCount++
+						stackWords = append(stackWords, info.word)
 					}
 				} else {
 					if intRegIdx < len(intArgRegs) {
 						// Load into int register
-						fc.out.MovMemToReg(intArgRegs[intRegIdx], "rsp", i*8)
+						fc.out.MovMemToReg(intArgRegs[intRegIdx], "rsp", info.word*8)
 						intRegIdx++
 					} else {
 						// Goes on stack
-						stackArgs = append(stackArgs, stackArg{offset: i * 8, value: stackArgCount})
-						stackArgCount++
+						stackWords = append(stackWords, info.word)
 					}
 				}
 			}
+			vectorRegs = floatRegIdx
 		}
 
-		// Clean up temp stack space, but preserve stack arguments
+		// Clean up temp stack space, but preserve stack arguments. An odd
+		// number of them is padded with the spare word, keeping rsp
+		// 16-byte aligned at the call
+		stackArgCount := len(stackWords)
+		keptWords := stackArgCount + stackArgCount%2
 		if stackArgCount > 0 {
-			// Move stack args to the bottom of the stack
-			for i, arg := range stackArgs {
-				fc.out.MovMemToReg("r11", "rsp", arg.offset)
-				fc.out.MovRegToMem("r11", "rsp", i*8)
+			// Move stack args to the top of the temporary words, last first
+			// since each one moves up, then drop the words below them
+			base := words + 1 - keptWords
+			for k := stackArgCount - 1; k >= 0; k-- {
+				fc.out.MovMemToReg("r11", "rsp", stackWords[k]*8)
+				fc.out.MovRegToMem("r11", "rsp", (base+k)*8)
 			}
-			// Adjust RSP to remove register arg space, keeping stack args
-			fc.out.AddImmToReg("rsp", int64(argStackOffset-stackArgCount*8))
+			fc.out.AddImmToReg("rsp", int64(base*8))
 		} else {
-			// No stack args - clean up all temp space
-			fc.out.AddImmToReg("rsp", int64(argStackOffset))
+			// No stack args - clean up the words, keeping the cstruct copies
+			fc.out.AddImmToReg("rsp", int64((words+1)*8))
 		}
 
 		// Allocate shadow space for Windows x64 calling convention
 		shadowSpace := fc.allocateShadowSpace()
 
+		// A variadic callee on System V learns from AL how many vector
+		// registers hold arguments
+		if !isWindows && (funcSig == nil || funcSig.Variadic) {
+			fc.out.MovImmToReg("rax", strconv.Itoa(vectorRegs))
+		}
+
 		// Generate PLT call
-		fc.eb.GenerateCallInstruction(funcName)
+		fc.eb.GenerateExternalCallInstruction(funcName)
 
 		// Deallocate shadow space
 		fc.deallocateShadowSpace(shadowSpace)
 
-		// Clean up stack arguments after call
-		if stackArgCount > 0 {
-			fc.out.AddImmToReg("rsp", int64(stackArgCount*8))
-		}
-
-		// Handle return value based on signature
-		var returnType string
-		if funcSig != nil {
-			returnType = funcSig.ReturnType
-		}
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "C function %s return type: %q (funcSig=%v)\n", funcName, returnType, funcSig != nil)
-		}
-
-		if returnType == "float" || returnType == "double" {
-			// Result is already in xmm0 as double - no conversion needed
-		} else if returnType == "void" {
-			// Void return - set xmm0 to 0
-			fc.out.XorpdXmm("xmm0", "xmm0")
-		} else if isPointerType(returnType) || returnType == "" {
-			// Pointer type - keep raw integer value but convert to float64 for C67
-			// (C67 internally represents everything as float64)
-			// On Windows and Linux, pointers are 64-bit and returned in RAX correctly
-			// NOTE: When signature is unknown (returnType == ""), assume pointer/64-bit return
-			// This is safer than assuming 32-bit, and works for SDL functions
-			fc.out.Cvtsi2sd("xmm0", "rax")
-		} else {
-			// Integer result in rax - convert to float64 for C67
-			// On Windows: bool returns are 1 byte (AL), int returns are 4 bytes (EAX)
-			// Zero-extend to 64-bit RAX to avoid garbage in upper bits
-			if fc.eb.target.OS() == OSWindows {
-				// Check if this is a bool return (1 byte in AL)
-				if returnType == "bool" || returnType == "_Bool" {
-					// movzx eax, al (zero-extend 8-bit AL to 32-bit EAX, then to RAX)
-					fc.out.MovzxRegReg("eax", "al")
-				} else {
-					// For int/int32/etc returns: use EAX directly (upper 32 bits of RAX auto-zeroed)
-					// mov eax, eax (zero-extends EAX to 64-bit RAX)
-					fc.out.MovRegToReg("eax", "eax")
-				}
-			}
-			fc.out.Cvtsi2sd("xmm0", "rax")
+		// Clean up stack arguments and cstruct copies after call
+		if keptWords > 0 || copySize > 0 {
+			fc.out.AddImmToReg("rsp", int64(keptWords*8+copySize))
 		}
 	} else {
 		// No arguments - just call the function
 		// Allocate shadow space for Windows x64 calling convention
 		shadowSpace := fc.allocateShadowSpace()
 
-		fc.eb.GenerateCallInstruction(funcName)
+		if !isWindows && (funcSig == nil || funcSig.Variadic) {
+			fc.out.XorRegWithReg("rax", "rax") // AL=0 for variadic function
+		}
+		fc.eb.GenerateExternalCallInstruction(funcName)
 
 		// Deallocate shadow space
 		fc.deallocateShadowSpace(shadowSpace)
+	}
 
-		// Handle return value based on signature
-		var returnType string
-		if funcSig != nil {
-			returnType = funcSig.ReturnType
-		}
+	if result != nil {
+		fc.loadStructResult(result, resultPassing, hiddenResult)
+		return
+	}
+	fc.convertCReturnValue(returnType)
+}
 
-		if returnType == "float" || returnType == "double" {
-			// Result is already in xmm0 as double - no conversion needed
-		} else if returnType == "void" {
-			// Void return - set xmm0 to 0
-			fc.out.XorpdXmm("xmm0", "xmm0")
-		} else if isPointerType(returnType) || returnType == "" {
-			// Pointer type - keep raw integer value but convert to float64 for C67
-			// (C67 internally represents everything as float64)
-			// On Windows and Linux, pointers are 64-bit and returned in RAX correctly
-			// NOTE: When signature is unknown (returnType == ""), assume pointer/64-bit return
-			// This is safer than assuming 32-bit, and works for SDL functions
-			fc.out.Cvtsi2sd("xmm0", "rax")
-		} else {
-			// Integer result in rax - convert to float64 for C67
+// convertCReturnValue converts the scalar result of a C call, in rax or
+// xmm0, to a float64 in xmm0
+func (fc *C67Compiler) convertCReturnValue(returnType string) {
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "C function return type: %q\n", returnType)
+	}
+
+	if returnType == "float" {
+		// Single precision result in xmm0
+		fc.out.Cvtss2sd("xmm0", "xmm0")
+	} else if returnType == "double" {
+		// Result is already in xmm0 as double - no conversion needed
+	} else if returnType == "void" {
+		// Void return - set xmm0 to 0
+		fc.out.XorpdXmm("xmm0", "xmm0")
+	} else if isPointerType(returnType) || returnType == "" {
+		// Pointer type - keep raw integer value but convert to float64 for C67
+		// (C67 internally represents everything as float64)
+		// On Windows and Linux, pointers are 64-bit and returned in RAX correctly
+		// NOTE: When signature is unknown (returnType == ""), assume pointer/64-bit return
+		// This is safer than assuming 32-bit, and works for SDL functions
+		fc.out.Cvtsi2sd("xmm0", "rax")
+	} else {
+		// Integer result in rax - convert to float64 for C67
+		// Only the low bytes that the C type covers are defined, so a
+		// narrower result is extended first (int -1 is not 4294967295)
+		if typ, size, ok := cPrimitive(returnType); ok && size < 8 {
+			switch typ {
+			case "int8":
+				fc.out.Emit([]byte{0x48, 0x0f, 0xbe, 0xc0}) // movsx rax, al
+			case "uint8":
+				fc.out.Emit([]byte{0x0f, 0xb6, 0xc0}) // movzx eax, al
+			case "int16":
+				fc.out.Emit([]byte{0x48, 0x0f, 0xbf, 0xc0}) // movsx rax, ax
+			case "uint16":
+				fc.out.Emit([]byte{0x0f, 0xb7, 0xc0}) // movzx eax, ax
+			case "int32":
+				fc.out.Emit([]byte{0x48, 0x63, 0xc0}) // movsxd rax, eax
+			case "uint32":
+				fc.out.Emit([]byte{0x89, 0xc0}) // mov eax, eax
+			}
+		} else if fc.eb.target.OS() == OSWindows {
 			// On Windows: bool returns are 1 byte (AL), int returns are 4 bytes (EAX)
 			// Zero-extend to 64-bit RAX to avoid garbage in upper bits
-			if fc.eb.target.OS() == OSWindows {
-				// Check if this is a bool return (1 byte in AL)
-				if returnType == "bool" || returnType == "_Bool" {
-					// movzx eax, al (zero-extend 8-bit AL to 32-bit EAX, then to RAX)
-					fc.out.MovzxRegReg("eax", "al")
-				} else {
-					// For int/int32/etc returns: use EAX directly (upper 32 bits of RAX auto-zeroed)
-					// mov eax, eax (zero-extends EAX to 64-bit RAX)
-					fc.out.MovRegToReg("eax", "eax")
-				}
+			// Check if this is a bool return (1 byte in AL)
+			if returnType == "bool" || returnType == "_Bool" {
+				// movzx eax, al (zero-extend 8-bit AL to 32-bit EAX, then to RAX)
+				fc.out.MovzxRegReg("eax", "al")
+			} else {
+				// For int/int32/etc returns: use EAX directly (upper 32 bits of RAX auto-zeroed)
+				// mov eax, eax (zero-extends EAX to 64-bit RAX)
+				fc.out.MovRegToReg("eax", "eax")
 			}
-			fc.out.Cvtsi2sd("xmm0", "rax")
 		}
+		fc.out.Cvtsi2sd("xmm0", "rax")
 	}
 }
 
@@ -13535,7 +13485,7 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 	if call.IsCFFI {
 		// C FFI calls go directly to the C function without namespace lookup
 		// The parser has already stripped the "c." prefix, so call.Function is just "malloc", "free", etc.
-		fc.compileCFunctionCall("", call.Function, call.Args)
+		fc.compileCFunctionCall("", call.Function, call.Args, nil)
 		return
 	}
 
@@ -13548,7 +13498,7 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 
 			// Check if namespace is a registered C import
 			if libName, ok := fc.cImports[namespace]; ok {
-				fc.compileCFunctionCall(libName, funcName, call.Args)
+				fc.compileCFunctionCall(libName, funcName, call.Args, nil)
 				return
 			}
 
@@ -14018,8 +13968,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 
 			if fc.eb.target.OS() == OSLinux {
 				// Use write syscall
-				fc.out.MovImmToReg("rax", "1") // sys_write
-				fc.out.MovImmToReg("rdi", "1") // stdout
+				fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+				fc.out.MovImmToReg("rdi", "1")                        // stdout
 				fc.out.LeaSymbolToReg("rsi", labelName)
 				fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", len(strExpr.Value)))
 				fc.out.Syscall()
@@ -14094,7 +14044,7 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 				fc.callFunction("_vibe67_itoa", "")
 
 				// Write to stdout
-				fc.out.MovImmToReg("rax", "1")
+				fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 				fc.out.MovImmToReg("rdi", "1")
 				fc.out.Syscall()
 
@@ -14130,8 +14080,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 
 			if fc.eb.target.OS() == OSLinux {
 				// Use write syscall
-				fc.out.MovImmToReg("rax", "1") // sys_write
-				fc.out.MovImmToReg("rdi", "1") // stdout
+				fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+				fc.out.MovImmToReg("rdi", "1")                        // stdout
 				fc.out.LeaSymbolToReg("rsi", newlineLabel)
 				fc.out.MovImmToReg("rdx", "1") // 1 byte
 				fc.out.Syscall()
@@ -14156,8 +14106,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 			// Print space before each argument except the first
 			if argIdx > 0 {
 				if fc.eb.target.OS() == OSLinux {
-					fc.out.MovImmToReg("rax", "1") // sys_write
-					fc.out.MovImmToReg("rdi", "1") // stdout
+					fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+					fc.out.MovImmToReg("rdi", "1")                        // stdout
 					fc.out.LeaSymbolToReg("rsi", spaceLabel)
 					fc.out.MovImmToReg("rdx", "1")
 					fc.out.Syscall()
@@ -14180,8 +14130,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 
 				if fc.eb.target.OS() == OSLinux {
 					// Use write syscall
-					fc.out.MovImmToReg("rax", "1") // sys_write
-					fc.out.MovImmToReg("rdi", "1") // stdout
+					fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+					fc.out.MovImmToReg("rdi", "1")                        // stdout
 					fc.out.LeaSymbolToReg("rsi", labelName)
 					fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", len(strExpr.Value)))
 					fc.out.Syscall()
@@ -14347,8 +14297,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 					// Returns: rsi=string start, rdx=length
 
 					// Write to stdout: write(1, rsi, rdx)
-					fc.out.MovImmToReg("rax", "1") // sys_write
-					fc.out.MovImmToReg("rdi", "1") // stdout
+					fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+					fc.out.MovImmToReg("rdi", "1")                        // stdout
 					// rsi already has buffer pointer
 					// rdx already has length
 					fc.out.Syscall()
@@ -14378,8 +14328,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 		fc.eb.Define(newlineLabel, "\n")
 
 		if fc.eb.target.OS() == OSLinux {
-			fc.out.MovImmToReg("rax", "1") // sys_write
-			fc.out.MovImmToReg("rdi", "1") // stdout
+			fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+			fc.out.MovImmToReg("rdi", "1")                        // stdout
 			fc.out.LeaSymbolToReg("rsi", newlineLabel)
 			fc.out.MovImmToReg("rdx", "1")
 			fc.out.Syscall()
@@ -14697,7 +14647,7 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 				fc.eb.Define(labelName, processedStr)
 
 				// Use write syscall: write(2, str, len)
-				fc.out.MovImmToReg("rax", "1")                                  // sys_write
+				fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))           // sys_write
 				fc.out.MovImmToReg("rdi", "2")                                  // fd = stderr
 				fc.out.LeaSymbolToReg("rsi", labelName)                         // buffer
 				fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", len(processedStr))) // length
@@ -14711,8 +14661,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 				fc.stringCounter++
 				fc.eb.Define(newlineLabel, "\n")
 
-				fc.out.MovImmToReg("rax", "1") // sys_write
-				fc.out.MovImmToReg("rdi", "2") // stderr
+				fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+				fc.out.MovImmToReg("rdi", "2")                        // stderr
 				fc.out.LeaSymbolToReg("rsi", newlineLabel)
 				fc.out.MovImmToReg("rdx", "1") // 1 byte
 				fc.out.Syscall()
@@ -14724,8 +14674,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 					processedStr := processEscapeSequences(strExpr.Value) + "\n"
 					fc.eb.Define(labelName, processedStr)
 
-					fc.out.MovImmToReg("rax", "1") // sys_write
-					fc.out.MovImmToReg("rdi", "2") // stderr
+					fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+					fc.out.MovImmToReg("rdi", "2")                        // stderr
 					fc.out.LeaSymbolToReg("rsi", labelName)
 					fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", len(processedStr)))
 					fc.out.Syscall()
@@ -14746,8 +14696,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 					// Returns: rsi=string start, rdx=length
 
 					// Write to stderr: write(2, rsi, rdx)
-					fc.out.MovImmToReg("rax", "1") // sys_write
-					fc.out.MovImmToReg("rdi", "2") // stderr
+					fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+					fc.out.MovImmToReg("rdi", "2")                        // stderr
 					// rsi, rdx already set
 					fc.out.Syscall()
 
@@ -14755,7 +14705,7 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 					newlineLabel := fmt.Sprintf("eprintln_newline_%d", fc.stringCounter)
 					fc.stringCounter++
 					fc.eb.Define(newlineLabel, "\n")
-					fc.out.MovImmToReg("rax", "1")
+					fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 					fc.out.MovImmToReg("rdi", "2")
 					fc.out.LeaSymbolToReg("rsi", newlineLabel)
 					fc.out.MovImmToReg("rdx", "1")
@@ -14779,8 +14729,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 				processedStr := processEscapeSequences(strExpr.Value)
 				fc.eb.Define(labelName, processedStr)
 
-				fc.out.MovImmToReg("rax", "1") // sys_write
-				fc.out.MovImmToReg("rdi", "2") // stderr
+				fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+				fc.out.MovImmToReg("rdi", "2")                        // stderr
 				fc.out.LeaSymbolToReg("rsi", labelName)
 				fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", len(processedStr)))
 				fc.out.Syscall()
@@ -14801,8 +14751,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 				// Returns: rsi=string start, rdx=length
 
 				// Write to stderr: write(2, rsi, rdx)
-				fc.out.MovImmToReg("rax", "1") // sys_write
-				fc.out.MovImmToReg("rdi", "2") // stderr
+				fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+				fc.out.MovImmToReg("rdi", "2")                        // stderr
 				// rsi, rdx already set
 				fc.out.Syscall()
 
@@ -14980,8 +14930,8 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 					// Simple case: just a format string with no placeholders
 					// Write directly to stderr using write syscall (don't include null terminator)
 					strLen := len(fmtStr)
-					fc.out.MovImmToReg("rax", "1") // sys_write
-					fc.out.MovImmToReg("rdi", "2") // stderr (fd 2)
+					fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+					fc.out.MovImmToReg("rdi", "2")                        // stderr (fd 2)
 					fc.out.LeaSymbolToReg("rsi", labelName)
 					fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", strLen))
 					fc.out.Syscall()
@@ -15052,7 +15002,7 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 				fc.stringCounter++
 				fc.eb.Define(newlineLabel, "\n")
 
-				fc.out.MovImmToReg("rax", "1")
+				fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 				fc.out.MovImmToReg("rdi", "2")
 				fc.out.LeaSymbolToReg("rsi", newlineLabel)
 				fc.out.MovImmToReg("rdx", "1")
@@ -15065,7 +15015,7 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 					processedStr := processEscapeSequences(strExpr.Value) + "\n"
 					fc.eb.Define(labelName, processedStr)
 
-					fc.out.MovImmToReg("rax", "1")
+					fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 					fc.out.MovImmToReg("rdi", "2")
 					fc.out.LeaSymbolToReg("rsi", labelName)
 					fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", len(processedStr)))
@@ -15086,7 +15036,7 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 
 					fc.out.MovRegToReg("rdx", "rax")
 					fc.out.MovRegToReg("rsi", "rsp")
-					fc.out.MovImmToReg("rax", "1")
+					fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 					fc.out.MovImmToReg("rdi", "2")
 					fc.out.Syscall()
 
@@ -15102,7 +15052,7 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 					processedStr := processEscapeSequences(strExpr.Value)
 					fc.eb.Define(labelName, processedStr)
 
-					fc.out.MovImmToReg("rax", "1")
+					fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 					fc.out.MovImmToReg("rdi", "2")
 					fc.out.LeaSymbolToReg("rsi", labelName)
 					fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", len(processedStr)))
@@ -15123,7 +15073,7 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 
 					fc.out.MovRegToReg("rdx", "rax")
 					fc.out.MovRegToReg("rsi", "rsp")
-					fc.out.MovImmToReg("rax", "1")
+					fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 					fc.out.MovImmToReg("rdi", "2")
 					fc.out.Syscall()
 
@@ -15158,6 +15108,7 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 		// Restore stack pointer to frame pointer
 		// Don't pop rbp since exit() never returns
 		fc.out.MovRegToReg("rsp", "rbp")
+		fc.emitProfileFlush()
 
 		// On Windows, use ExitProcess from kernel32 (not exit from msvcrt which needs CRT init)
 		if fc.eb.target.OS() == OSWindows {
@@ -18224,42 +18175,14 @@ func (fc *C67Compiler) compileCall(call *CallExpr) {
 		// Convert to float64 and return
 		fc.out.Cvtsi2sd("xmm0", "rax")
 
-	case "chan":
-		// chan(capacity) - Create a new channel
-		// capacity = 0 for unbuffered, >0 for buffered
-		if len(call.Args) == 1 {
-			// Compile capacity argument
-			fc.compileExpression(call.Args[0])
-			fc.out.Cvttsd2si("rdi", "xmm0") // rdi = capacity
-		} else if len(call.Args) == 0 {
-			// Default: unbuffered channel (capacity = 0)
-			fc.out.XorRegWithReg("rdi", "rdi")
-		} else {
-			compilerError("chan() requires 0 or 1 arguments")
-		}
-
-		// Call channel_create from runtime
-		fc.callFunction("channel_create", "")
-
-		// Return channel pointer as float64
-		fc.out.Cvtsi2sd("xmm0", "rax")
-
-	case "close":
-		// close(channel) - Close a channel
-		if len(call.Args) != 1 {
-			compilerError("close() requires exactly 1 argument (channel)")
-		}
-
-		// Compile channel argument
-		fc.compileExpression(call.Args[0])
-		fc.out.Cvttsd2si("rdi", "xmm0") // rdi = channel pointer
-
-		// Call channel_close from runtime
-		fc.callFunction("channel_close", "")
-
-		// Return 0
-		fc.out.XorRegWithReg("rax", "rax")
-		fc.out.Cvtsi2sd("xmm0", "rax")
+	case "mutex", "rwlock", "condvar", "queue", "chan",
+		"mutex_lock", "mutex_unlock",
+		"rwlock_read", "rwlock_read_unlock", "rwlock_write", "rwlock_write_unlock",
+		"condvar_wait", "condvar_signal", "condvar_broadcast",
+		"queue_push", "queue_pop", "queue_close", "close":
+		// Synchronization primitives (see sync.go)
+		// chan(capacity) is a queue; chan() and chan(0) get a single slot
+		fc.compileSyncBuiltin(call)
 
 	case "__vibe67_map_update":
 		// __vibe67_map_update(list, index, value) - Update a list element (functional update)
@@ -18483,18 +18406,18 @@ func (fc *C67Compiler) compileSendExpr(expr *SendExpr) {
 
 	// Step 2: Create UDP socket (syscall 41: socket)
 	// socket(AF_INET=2, SOCK_DGRAM=2, protocol=0)
-	fc.out.MovImmToReg("rax", "41") // socket syscall
-	fc.out.MovImmToReg("rdi", "2")  // AF_INET
-	fc.out.MovImmToReg("rsi", "2")  // SOCK_DGRAM
-	fc.out.MovImmToReg("rdx", "0")  // protocol
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_SOCKET")) // socket syscall
+	fc.out.MovImmToReg("rdi", "2")                         // AF_INET
+	fc.out.MovImmToReg("rsi", "2")                         // SOCK_DGRAM
+	fc.out.MovImmToReg("rdx", "0")                         // protocol
 	fc.out.Syscall()
 	fc.out.MovRegToMem("rax", "rsp", 8) // socket fd at rsp+8
 
 	// Step 3: Build sockaddr_in structure at rsp+16
 	// struct sockaddr_in: family(2), port(2), addr(4), zero(8) = 16 bytes
 
-	// sin_family = AF_INET (2)
-	fc.out.MovImmToReg("rax", "2")
+	// sin_family = AF_INET (2), after sin_len on FreeBSD
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SOCKADDR_IN_FAMILY"))
 	fc.out.MovU16RegToMem("ax", "rsp", 16)
 
 	// sin_port = htons(port) - convert to network byte order
@@ -18533,15 +18456,15 @@ func (fc *C67Compiler) compileSendExpr(expr *SendExpr) {
 	fc.out.MovImmToReg("r10", "0")                                // flags
 	fc.out.LeaMemToReg("r8", "rsp", 16)                           // sockaddr_in
 	fc.out.MovImmToReg("r9", fmt.Sprintf("%d", socketStructSize)) // addrlen
-	fc.out.MovImmToReg("rax", "44")                               // sendto syscall
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_SENDTO"))        // sendto syscall
 	fc.out.Syscall()
 
 	// Save result
 	fc.out.MovRegToReg("rbx", "rax")
 
 	// Step 6: Close socket (syscall 3: close)
-	fc.out.MovMemToReg("rdi", "rsp", 8) // socket fd
-	fc.out.MovImmToReg("rax", "3")      // close syscall
+	fc.out.MovMemToReg("rdi", "rsp", 8)                   // socket fd
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_CLOSE")) // close syscall
 	fc.out.Syscall()
 
 	// Clean up stack
@@ -18599,15 +18522,15 @@ func (fc *C67Compiler) compileReceiveExpr(expr *ReceiveExpr) {
 	fc.runtimeStack += int(stackSpace)
 
 	// Step 1: Create UDP socket (syscall 41: socket)
-	fc.out.MovImmToReg("rax", "41") // socket syscall
-	fc.out.MovImmToReg("rdi", "2")  // AF_INET
-	fc.out.MovImmToReg("rsi", "2")  // SOCK_DGRAM
-	fc.out.MovImmToReg("rdx", "0")  // protocol
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_SOCKET")) // socket syscall
+	fc.out.MovImmToReg("rdi", "2")                         // AF_INET
+	fc.out.MovImmToReg("rsi", "2")                         // SOCK_DGRAM
+	fc.out.MovImmToReg("rdx", "0")                         // protocol
 	fc.out.Syscall()
 	fc.out.MovRegToMem("rax", "rsp", 0) // socket fd at rsp+0
 
 	// Step 2: Build sockaddr_in for binding at rsp+8
-	fc.out.MovImmToReg("rax", "2")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SOCKADDR_IN_FAMILY"))
 	fc.out.MovU16RegToMem("ax", "rsp", 8) // sin_family = AF_INET
 
 	// sin_port = htons(port)
@@ -18624,7 +18547,7 @@ func (fc *C67Compiler) compileReceiveExpr(expr *ReceiveExpr) {
 	fc.out.MovMemToReg("rdi", "rsp", 0)                            // socket fd
 	fc.out.LeaMemToReg("rsi", "rsp", 8)                            // sockaddr_in
 	fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", socketStructSize)) // addrlen
-	fc.out.MovImmToReg("rax", "49")                                // bind syscall
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_BIND"))           // bind syscall
 	fc.out.Syscall()
 
 	// Step 4: Receive message (syscall 45: recvfrom)
@@ -18635,16 +18558,16 @@ func (fc *C67Compiler) compileReceiveExpr(expr *ReceiveExpr) {
 	fc.out.LeaMemToReg("r8", "rsp", 24)                            // sender sockaddr_in at rsp+24
 	fc.out.LeaMemToReg("r9", "rsp", 296)                           // sender addrlen at rsp+296
 	fc.out.MovImmToReg("rax", fmt.Sprintf("%d", socketStructSize))
-	fc.out.MovRegToMem("rax", "rsp", 296) // initialize addrlen
-	fc.out.MovImmToReg("rax", "45")       // recvfrom syscall
+	fc.out.MovRegToMem("rax", "rsp", 296)                    // initialize addrlen
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_RECVFROM")) // recvfrom syscall
 	fc.out.Syscall()
 
 	// rax = bytes received (or -1 on error)
 	fc.out.MovRegToReg("rbx", "rax") // save length
 
 	// Step 5: Close socket (syscall 3: close)
-	fc.out.MovMemToReg("rdi", "rsp", 0) // socket fd
-	fc.out.MovImmToReg("rax", "3")      // close syscall
+	fc.out.MovMemToReg("rdi", "rsp", 0)                   // socket fd
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_CLOSE")) // close syscall
 	fc.out.Syscall()
 
 	// Step 6: Convert received bytes to C67 string (map[uint64]float64)
@@ -18740,16 +18663,16 @@ func (fc *C67Compiler) compileReceiveLoopStmt(stmt *ReceiveLoopStmt) {
 	// addrlen:     rbp-(baseOffset+320)
 
 	// Step 1: Create UDP socket (once, before port loop)
-	fc.out.MovImmToReg("rax", "41") // socket syscall
-	fc.out.MovImmToReg("rdi", "2")  // AF_INET
-	fc.out.MovImmToReg("rsi", "2")  // SOCK_DGRAM
-	fc.out.MovImmToReg("rdx", "0")  // protocol
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_SOCKET")) // socket syscall
+	fc.out.MovImmToReg("rdi", "2")                         // AF_INET
+	fc.out.MovImmToReg("rsi", "2")                         // SOCK_DGRAM
+	fc.out.MovImmToReg("rdx", "0")                         // protocol
 	fc.out.Syscall()
 	fc.out.MovRegToMem("rax", "rbp", -(baseOffset + 24)) // socket fd
 
 	// Step 2: Initialize sockaddr_in structure (constant fields)
-	// sin_family = AF_INET (2)
-	fc.out.MovImmToReg("rax", "2")
+	// sin_family = AF_INET (2), after sin_len on FreeBSD
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SOCKADDR_IN_FAMILY"))
 	fc.out.MovU16RegToMem("ax", "rbp", -(baseOffset + 40))
 
 	// sin_addr = INADDR_ANY (0.0.0.0)
@@ -18779,7 +18702,7 @@ func (fc *C67Compiler) compileReceiveLoopStmt(stmt *ReceiveLoopStmt) {
 	fc.out.MovMemToReg("rdi", "rbp", -(baseOffset + 24))           // socket fd
 	fc.out.LeaMemToReg("rsi", "rbp", -(baseOffset + 40))           // sockaddr_in structure
 	fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", socketStructSize)) // addrlen
-	fc.out.MovImmToReg("rax", "49")                                // bind syscall
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_BIND"))           // bind syscall
 	fc.out.Syscall()
 
 	// Check bind result: rax == 0 means success
@@ -18795,11 +18718,11 @@ func (fc *C67Compiler) compileReceiveLoopStmt(stmt *ReceiveLoopStmt) {
 
 	// All ports failed - close socket and exit
 	fc.eb.MarkLabel(bindFailLabel)
-	fc.out.MovMemToReg("rdi", "rbp", -(baseOffset + 24)) // socket fd
-	fc.out.MovImmToReg("rax", "3")                       // close syscall
+	fc.out.MovMemToReg("rdi", "rbp", -(baseOffset + 24))  // socket fd
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_CLOSE")) // close syscall
 	fc.out.Syscall()
-	fc.out.MovImmToReg("rdi", "1")  // exit code 1
-	fc.out.MovImmToReg("rax", "60") // exit syscall
+	fc.out.MovImmToReg("rdi", "1")                       // exit code 1
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_EXIT")) // exit syscall
 	fc.out.Syscall()
 
 	// Bind succeeded, continue to receive loop
@@ -18830,7 +18753,7 @@ func (fc *C67Compiler) compileReceiveLoopStmt(stmt *ReceiveLoopStmt) {
 	fc.out.MovImmToReg("r10", "0")                                 // flags
 	fc.out.LeaMemToReg("r8", "rbp", -(baseOffset + 40))            // src_addr (sockaddr_in start)
 	fc.out.LeaMemToReg("r9", "rbp", -(baseOffset + 320))           // addrlen pointer
-	fc.out.MovImmToReg("rax", "45")                                // recvfrom syscall
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_RECVFROM"))       // recvfrom syscall
 	fc.out.Syscall()
 
 	// rax now contains bytes received (or -1 on error)
@@ -18867,8 +18790,8 @@ func (fc *C67Compiler) compileReceiveLoopStmt(stmt *ReceiveLoopStmt) {
 	fc.eb.MarkLabel(endLabel)
 
 	// Clean up: close socket
-	fc.out.MovMemToReg("rdi", "rbp", -(baseOffset + 24)) // socket fd
-	fc.out.MovImmToReg("rax", "3")                       // close syscall
+	fc.out.MovMemToReg("rdi", "rbp", -(baseOffset + 24))  // socket fd
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_CLOSE")) // close syscall
 	fc.out.Syscall()
 
 	// Remove variables from scope
@@ -18916,9 +18839,26 @@ func (fc *C67Compiler) trackFunctionCall(funcName string) {
 	if !fc.usedFunctions[funcName] {
 		fc.usedFunctions[funcName] = true
 	}
+	// The C string helper copies into the arena, whose symbols must be
+	// defined before the runtime helpers are generated
+	if funcName == "_vibe67_string_to_cstr" {
+		fc.usesArenas = true
+	}
 	fc.callOrder = append(fc.callOrder, funcName)
 }
 
+// allocationCalls counts the calls to an allocator in the generated code
+func (fc *C67Compiler) allocationCalls() int {
+	count := 0
+	for _, funcName := range fc.callOrder {
+		switch funcName {
+		case "malloc", "calloc", "realloc", "_vibe67_arena_alloc":
+			count++
+		}
+	}
+	return count
+}
+
 // callFunction is a unified helper for calling functions (C FFI or internal).
 // It handles tracking for DCE, library registration, and instruction emission.
 func (fc *C67Compiler) callFunction(funcName string, library string) error {
@@ -19187,6 +19127,11 @@ func collectFunctionCallsFromStmtWithParams(stmt Statement, calls map[string]boo
 		for _, bodyStmt := range s.Body {
 			collectFunctionCallsFromStmtWithParams(bodyStmt, calls, params)
 		}
+	case *LockStmt:
+		collectFunctionCallsWithParams(s.Mutex, calls, params)
+		for _, bodyStmt := range s.Body {
+			collectFunctionCallsFromStmtWithParams(bodyStmt, calls, params)
+		}
 	}
 }
 
@@ -19266,6 +19211,10 @@ func checkForwardReferences(program *Program) []string {
 		"write_i32": true, "write_u32": true, "write_i64": true, "write_u64": true, "write_f32": true, "write_f64": true,
 		"call": true, "arena_create": true, "arena_alloc": true, "arena_reset": true, "arena_destroy": true,
 	}
+	// Synchronization primitives (mutex, rwlock, condvar, queue)
+	for _, name := range syncBuiltinNames() {
+		builtins[name] = true
+	}
 
 	// Mark builtins as defined
 	for k := range builtins {
@@ -19384,6 +19333,10 @@ func getUnknownFunctions(program *Program) []string {
 		// Dynamic calling
 		"call": true, "arena_create": true, "arena_alloc": true, "arena_reset": true, "arena_destroy": true,
 	}
+	// Synchronization primitives (mutex, rwlock, condvar, queue)
+	for _, name := range syncBuiltinNames() {
+		builtins[name] = true
+	}
 
 	// Collect C import namespaces (e.g., "enet", "libc")
 	cImports := make(map[string]bool)
@@ -19575,8 +19528,7 @@ func processImports(program *Program, platform Platform, sourceFilePath string)
 				continue
 			}
 
-			depParser := NewParserWithFilename(string(depContent), c67File)
-			depProgram := depParser.ParseProgram()
+			depProgram := parseSource(string(depContent), c67File)
 
 			// Filter out private functions (names starting with _)
 			filterPrivateFunctions(depProgram)
@@ -19618,6 +19570,16 @@ func processImports(program *Program, platform Platform, sourceFilePath string)
 				}
 			}
 
+			// Merge cstructs, so that their sizes and by-value C calls work in the importer
+			for name, decl := range depProgram.CStructs {
+				if program.CStructs == nil {
+					program.CStructs = make(map[string]*CStructDecl)
+				}
+				if _, exists := program.CStructs[name]; !exists {
+					program.CStructs[name] = decl
+				}
+			}
+
 			if VerboseMode {
 				fmt.Fprintf(os.Stderr, "Loaded %s from %s\n", c67File, imp.URL)
 			}
@@ -19874,9 +19836,13 @@ func CompileC67WithOptions(inputPath string, outputPath string, platform Platfor
 		return fmt.Errorf("failed to read %s: %v", inputPath, readErr)
 	}
 
+	// Parsed modules and executables are cached by content under GetCachePath()
+	oldBuildCache := activeBuildCache
+	activeBuildCache = OpenBuildCache(platform)
+	defer func() { activeBuildCache = oldBuildCache }()
+
 	// Parse main file
-	parser := NewParserWithFilename(string(content), inputPath)
-	program := parser.ParseProgram()
+	program := parseSource(string(content), inputPath)
 
 	if VerboseMode {
 		// Temporarily disabled due to String() crash with nil args
@@ -19887,10 +19853,44 @@ func CompileC67WithOptions(inputPath string, outputPath string, platform Platfor
 	// Desugar classes to regular C67 code
 	desugarClasses(program)
 
+	// A library exports functions of the main file only, so they are
+	// collected before the imports are merged in
+	var exports []libraryExport
+	if BuildMode != BuildModeExe {
+		if modeErr := checkBuildMode(platform); modeErr != nil {
+			return modeErr
+		}
+		var exportErr error
+		if exports, exportErr = libraryExports(program); exportErr != nil {
+			return exportErr
+		}
+	}
+
 	// Sibling loading is now handled later, after checking for unknown functions
 	// This prevents loading unnecessary files and avoids conflicts with test files
 	var combinedSource string
 
+	// Pin Git dependencies to the commits recorded in vibe67.lock
+	lock, lockErr := ReadLockFile(filepath.Dir(inputPath))
+	if lockErr != nil {
+		return lockErr
+	}
+	oldLockFile := activeLockFile
+	activeLockFile = lock
+	defer func() { activeLockFile = oldLockFile }()
+
+	// Vendored modules in vendor_v67/ take precedence over the cache
+	oldVendorDir := activeVendorDir
+	activeVendorDir = filepath.Join(filepath.Dir(inputPath), VendorDirName)
+	defer func() { activeVendorDir = oldVendorDir }()
+
+	// In offline mode, report every missing direct dependency at once
+	if OfflineFlag {
+		if err := checkOfflineModules([]*Program{program}); err != nil {
+			return err
+		}
+	}
+
 	// Process explicit import statements
 	err = processImports(program, platform, inputPath)
 	if err != nil {
@@ -19958,8 +19958,7 @@ func CompileC67WithOptions(inputPath string, outputPath string, platform Platfor
 						continue
 					}
 
-					siblingParser := NewParserWithFilename(string(siblingContent), siblingPath)
-					siblingProgram := siblingParser.ParseProgram()
+					siblingProgram := parseSource(string(siblingContent), siblingPath)
 
 					// Prepend sibling statements before main file (definitions must come before use)
 					program.Statements = append(siblingProgram.Statements, program.Statements...)
@@ -19987,7 +19986,7 @@ func CompileC67WithOptions(inputPath string, outputPath string, platform Platfor
 
 			// Ensure all repositories are cloned/updated
 			for _, repoURL := range repos {
-				repoPath, err := EnsureRepoCloned(repoURL, UpdateDepsFlag)
+				repoPath, err := ResolveModule(repoURL, "")
 				if err != nil {
 					return fmt.Errorf("failed to fetch dependency %s: %v", repoURL, err)
 				}
@@ -20008,8 +20007,7 @@ func CompileC67WithOptions(inputPath string, outputPath string, platform Platfor
 						continue
 					}
 
-					depParser := NewParserWithFilename(string(depContent), c67File)
-					depProgram := depParser.ParseProgram()
+					depProgram := parseSource(string(depContent), c67File)
 
 					// Prepend dependency program to main program (dependencies must be defined before use)
 					program.Statements = append(depProgram.Statements, program.Statements...)
@@ -20022,6 +20020,17 @@ func CompileC67WithOptions(inputPath string, outputPath string, platform Platfor
 			}
 		}
 	}
+
+	// Record newly resolved dependencies in vibe67.lock
+	if lock.dirty {
+		if err := lock.Write(); err != nil {
+			return err
+		}
+		if VerboseMode {
+			fmt.Fprintf(os.Stderr, "Updated %s\n", lock.Path)
+		}
+	}
+
 	// Append main file source
 	combinedSource = combinedSource + string(content)
 
@@ -20074,6 +20083,30 @@ func CompileC67WithOptions(inputPath string, outputPath string, platform Platfor
 		return fmt.Errorf("undefined functions: %s\nNote: Functions must be defined before use or imported from dependencies", strings.Join(finalUnknownFuncs, ", "))
 	}
 
+	if EmitIRFlag {
+		ir, err := DumpIR(program)
+		if err != nil {
+			return err
+		}
+		fmt.Print(ir)
+		return nil
+	}
+
+	// Reuse the executable if nothing that goes into it has changed
+	exeKey := ""
+	if activeBuildCache != nil && !depsOnly {
+		exeKey = activeBuildCache.executableKey(program, outputPath)
+		if VerboseMode {
+			fmt.Fprintf(os.Stderr, "Build cache: %d of %d modules parsed from cache\n", activeBuildCache.hits, activeBuildCache.hits+activeBuildCache.misses)
+		}
+		if activeBuildCache.LoadExecutable(exeKey, outputPath) {
+			if VerboseMode {
+				fmt.Fprintf(os.Stderr, "Build cache: reused executable for %s\n", outputPath)
+			}
+			return nil
+		}
+	}
+
 	// Compile
 	compiler, err := NewC67Compiler(platform, verbose)
 	if err != nil {
@@ -20081,6 +20114,12 @@ func CompileC67WithOptions(inputPath string, outputPath string, platform Platfor
 	}
 	compiler.sourceCode = combinedSource
 	compiler.wpoTimeout = wpoTimeout
+	compiler.exports = exports
+	if activeManifest != nil {
+		for _, lib := range activeManifest.Libraries {
+			compiler.cLibHandles[lib] = "linked"
+		}
+	}
 	compiler.errors.SetSourceCode(combinedSource)
 
 	if depsOnly {
@@ -20097,9 +20136,13 @@ func CompileC67WithOptions(inputPath string, outputPath string, platform Platfor
 	if err != nil {
 		return fmt.Errorf("compilation failed: %v", err)
 	}
+	if activeBuildCache != nil {
+		activeBuildCache.StoreExecutable(exeKey, outputPath)
+	}
 
 	// Output optimization summary in verbose mode
 	if VerboseMode {
+		fmt.Printf("Allocation calls: %d\n", compiler.allocationCalls())
 		totalCalls := compiler.tailCallsOptimized + compiler.nonTailCalls
 		if totalCalls > 0 {
 			fmt.Printf("Tail call optimization: %d/%d recursive calls optimized",
@@ -20192,6 +20235,14 @@ func (fc *C67Compiler) compileARM64(program *Program, outputPath string) error {
 		return err
 	}
 
+	// Programs that the SSA IR covers are lowered from it instead, unless
+	// -no-ir is given, now that the ARM64 code generator has checked them
+	if !NoIRFlag {
+		if ok, err := fc.compileIR(program, outputPath); ok {
+			return err
+		}
+	}
+
 	// Write executable based on target OS
 	if fc.eb.target.IsMachO() {
 		return fc.writeMachOARM64(outputPath)
@@ -20214,4 +20265,54 @@ func (fc *C67Compiler) compileRiscv64(program *Program, outputPath string) error
 	return fc.writeELFRiscv64(outputPath)
 }
 
+// compileIR compiles a program for x86-64 or ARM64 Linux by lowering its SSA
+// IR, and reports whether it did. Programs that use anything the IR does not
+// cover yet, such as closures and C calls, are left to the AST code generator,
+// and so are programs whose lists and maps are persistent tries (see
+// persistent.go), which the IR runtime does not implement.
+func (fc *C67Compiler) compileIR(program *Program, outputPath string) (bool, error) {
+	arch := fc.eb.target.Arch()
+	if arch != ArchX86_64 && arch != ArchARM64 {
+		return false, nil
+	}
+	if fc.eb.target.OS() != OSLinux || BuildMode != BuildModeExe || CompressFlag || ProfileGenerateFile != "" {
+		return false, nil
+	}
+	for _, stmt := range program.Statements {
+		if assign, ok := stmt.(*AssignStmt); ok && assign.IsHot {
+			return false, nil // hot functions are patched through the table of hotpatch.go
+		}
+	}
+	if newPersistentBindings(program, newListOwnership(program)).Used() {
+		if VerboseMode {
+			fmt.Fprintf(os.Stderr, "-> The program uses persistent tries, using the AST code generator\n")
+		}
+		return false, nil
+	}
+	mod := BuildIR(program)
+	if err := mod.Verify(); err != nil {
+		if VerboseMode {
+			fmt.Fprintf(os.Stderr, "-> Invalid IR (%v), using the AST code generator\n", err)
+		}
+		return false, nil
+	}
+	// Lower into a builder of its own, so that nothing is left behind for
+	// the AST code generator if the lowering does not support the program
+	eb, err := NewWithTarget(fc.eb.target)
+	if err != nil {
+		return true, err
+	}
+	if err := LowerIR(mod, eb); err != nil {
+		if VerboseMode {
+			fmt.Fprintf(os.Stderr, "-> %v, using the AST code generator\n", err)
+		}
+		return false, nil
+	}
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "-> Lowered the SSA IR for %s\n", arch)
+	}
+	fc.eb = eb
+	return true, fc.writeIRELF(outputPath)
+}
+
 // writeMachOARM64 writes an ARM64 Mach-O executable for macOS
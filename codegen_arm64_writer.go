@@ -20,6 +20,11 @@ func (fc *C67Compiler) writeELFARM64(outputPath string) error {
 	textBytes := fc.eb.text.Bytes()
 	rodataBytes := fc.eb.rodata.Bytes()
 
+	// Link the C archives the program imports (see static_link.go)
+	if err := fc.linkStaticArchives(append([]string(nil), fc.eb.neededFunctions...)); err != nil {
+		return err
+	}
+
 	// Build pltFunctions list from all called functions
 	pltFunctions := []string{"printf", "exit", "malloc", "free", "realloc", "strlen", "pow", "fflush"}
 
@@ -29,8 +34,16 @@ func (fc *C67Compiler) writeELFARM64(outputPath string) error {
 		pltSet[f] = true
 	}
 
-	// Add functions from eb.neededFunctions (populated by ARM64 codegen)
-	for _, funcName := range fc.eb.neededFunctions {
+	// Add functions from eb.neededFunctions (populated by ARM64 codegen),
+	// and those the linked archive members leave to the C library
+	var staticExternals []string
+	if fc.staticLink != nil {
+		staticExternals = fc.staticLink.externals
+	}
+	for _, funcName := range append(append([]string(nil), fc.eb.neededFunctions...), staticExternals...) {
+		if fc.staticallyLinked(funcName) {
+			continue
+		}
 		if !pltSet[funcName] {
 			pltFunctions = append(pltFunctions, funcName)
 			pltSet[funcName] = true
@@ -52,6 +65,9 @@ func (fc *C67Compiler) writeELFARM64(outputPath string) error {
 		if strings.HasPrefix(funcName, "_vibe67") || strings.HasPrefix(funcName, "vibe67_") {
 			continue
 		}
+		if fc.staticallyLinked(funcName) {
+			continue
+		}
 		if !pltSet[funcName] {
 			pltFunctions = append(pltFunctions, funcName)
 			pltSet[funcName] = true
@@ -63,21 +79,14 @@ func (fc *C67Compiler) writeELFARM64(outputPath string) error {
 	fc.dynamicSymbols = ds
 
 	// Add NEEDED libraries
-	ds.AddNeeded("libc.so.6")
+	ds.AddNeeded(systemLibrary(fc.eb.target, "libc.so.6"))
 
 	// Check if pthread functions are used
 	if fc.usedFunctions["pthread_create"] || fc.usedFunctions["pthread_join"] {
-		ds.AddNeeded("libpthread.so.0")
+		ds.AddNeeded(systemLibrary(fc.eb.target, "libpthread.so.0"))
 	}
 
 	// Check if any libm functions are called
-	libmFunctions := map[string]bool{
-		"sqrt": true, "sin": true, "cos": true, "tan": true,
-		"asin": true, "acos": true, "atan": true, "atan2": true,
-		"sinh": true, "cosh": true, "tanh": true,
-		"log": true, "log10": true, "exp": true, "pow": true,
-		"fabs": true, "fmod": true, "ceil": true, "floor": true,
-	}
 	needsLibm := false
 	for funcName := range fc.usedFunctions {
 		if libmFunctions[funcName] {
@@ -85,12 +94,21 @@ func (fc *C67Compiler) writeELFARM64(outputPath string) error {
 			break
 		}
 	}
+	for _, funcName := range staticExternals {
+		if libmFunctions[funcName] {
+			needsLibm = true
+			break
+		}
+	}
 	if needsLibm {
-		ds.AddNeeded("libm.so.6")
+		ds.AddNeeded(systemLibrary(fc.eb.target, "libm.so.6"))
 	}
 
 	// Add C library dependencies from imports
 	for libName := range fc.cLibHandles {
+		if _, ok := fc.staticArchives[libName]; ok {
+			continue
+		}
 		if libName != "linked" && libName != "c" {
 			ds.AddNeeded(libName)
 		}
@@ -167,6 +185,8 @@ func (fc *C67Compiler) writeELFARM64(outputPath string) error {
 		_ = dataBaseAddr // Mark as used (needed for future logic)
 	}
 
+	fc.emitStaticArchives()
+
 	// Write complete dynamic ELF with PLT/GOT
 	// This already patches PC-relative relocations internally
 	_, rodataBaseAddr, textAddr, pltBase, err := fc.eb.WriteCompleteDynamicELF(ds, pltFunctions)
@@ -214,6 +234,9 @@ func (fc *C67Compiler) writeELFARM64(outputPath string) error {
 
 	// Patch PLT calls in the generated code (similar to x86_64 path)
 	fc.eb.patchPLTCalls(ds, textAddr, pltBase, pltFunctions)
+	if err := fc.relocateStaticArchives(ds, textAddr, pltBase); err != nil {
+		return err
+	}
 
 	// Update ELF with patched text
 	fc.eb.patchTextInELF()
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
@@ -14,8 +15,20 @@ import (
 // This file handles the generation of ELF (Executable and Linkable Format)
 // executables for Linux/Unix systems on x86_64 architecture.
 
+// libmFunctions are the C functions that require libm when called via C FFI
+var libmFunctions = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "asin": true, "acos": true, "atan": true, "atan2": true,
+	"sinh": true, "cosh": true, "tanh": true,
+	"log": true, "log10": true, "exp": true, "pow": true, "sqrt": true,
+	"fabs": true, "fmod": true, "ceil": true, "floor": true,
+}
+
 // Confidence that this function is working: 85%
 func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
+	if BuildMode != BuildModeExe {
+		return fc.writeLibrary(program, outputPath)
+	}
+
 	// Check if dynamic linking is actually needed
 	// On Linux, printf/println use syscalls, not libc
 	libcFunctions := map[string]bool{
@@ -45,14 +58,6 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 		}
 	}
 
-	// Math functions that require libm when called via C FFI
-	libmFunctions := map[string]bool{
-		"sin": true, "cos": true, "tan": true, "asin": true, "acos": true, "atan": true, "atan2": true,
-		"sinh": true, "cosh": true, "tanh": true,
-		"log": true, "log10": true, "exp": true, "pow": true, "sqrt": true,
-		"fabs": true, "fmod": true, "ceil": true, "floor": true,
-	}
-
 	needsLibm := false
 
 	// Check C FFI calls - these need dynamic linking
@@ -67,6 +72,25 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 		}
 	}
 
+	// Link the C archives the program imports; what their members leave
+	// undefined comes from the C library
+	calledFunctions := make([]string, 0, len(fc.cFunctionLibs))
+	for funcName := range fc.cFunctionLibs {
+		calledFunctions = append(calledFunctions, funcName)
+	}
+	if err := fc.linkStaticArchives(calledFunctions); err != nil {
+		return err
+	}
+	if fc.staticLink != nil {
+		for _, funcName := range fc.staticLink.externals {
+			if libmFunctions[funcName] {
+				needsLibm = true
+			} else {
+				needsLibc = true
+			}
+		}
+	}
+
 	// Check if any C FFI functions are used
 	hasCFFI := len(fc.cFunctionLibs) > 0
 
@@ -153,7 +177,7 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 		}
 
 		// Calculate addresses for PC-relative relocations
-		headerSize := 64 + 56
+		headerSize := fc.eb.staticHeaderSize()
 		rodataSize := fc.eb.rodata.Len()
 		dataSize := fc.eb.data.Len()
 
@@ -200,6 +224,9 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 		}
 		fc.eb.PatchCallSites(textAddr)
 
+		// Record the code layout for hot patching (--watch)
+		fc.captureHotImage(textAddr)
+
 		// Get complete binary (header + rodata + data + text)
 		elfBytes := fc.eb.Bytes()
 
@@ -238,17 +265,30 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 
 	// Add functions used so far (main program only, not runtime helpers yet)
 	for funcName := range fc.usedFunctions {
-		if lambdaSet[funcName] {
+		// A lambda can share its name with a C function it wraps; the C
+		// call still needs its PLT entry
+		if lambdaSet[funcName] && !fc.eb.externalCalls[funcName] {
 			continue
 		}
 		if strings.HasPrefix(funcName, "_vibe67") || strings.HasPrefix(funcName, "vibe67_") {
 			continue
 		}
+		if fc.staticallyLinked(funcName) {
+			continue
+		}
 		if !pltSet[funcName] {
 			pltFunctions = append(pltFunctions, funcName)
 			pltSet[funcName] = true
 		}
 	}
+	if fc.staticLink != nil {
+		for _, funcName := range fc.staticLink.externals {
+			if !pltSet[funcName] {
+				pltFunctions = append(pltFunctions, funcName)
+				pltSet[funcName] = true
+			}
+		}
+	}
 
 	// Note: Runtime helper functions will be tracked but won't be in first-pass PLT
 	// This is OK - they'll be resolved as internal labels, not PLT entries
@@ -259,74 +299,20 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 
 	// Add library dependencies
 	if needsLibc {
-		ds.AddNeeded("libc.so.6")
+		ds.AddNeeded(systemLibrary(fc.eb.target, "libc.so.6"))
 	}
 	if needsLibm {
-		ds.AddNeeded("libm.so.6")
+		ds.AddNeeded(systemLibrary(fc.eb.target, "libm.so.6"))
 	}
 
 	// Check if pthread functions are used
 	if fc.usedFunctions["pthread_create"] || fc.usedFunctions["pthread_join"] {
-		ds.AddNeeded("libpthread.so.0")
+		ds.AddNeeded(systemLibrary(fc.eb.target, "libpthread.so.0"))
 	}
 
 	// Add C library dependencies from imports
-	for libName := range fc.cLibHandles {
-		if libName != "linked" {
-			if libName == "c" {
-				continue
-			}
-			libSoName := libName
-			if strings.Contains(libSoName, ".so") {
-				if VerboseMode {
-					fmt.Fprintf(os.Stderr, "Adding custom C library dependency: %s\n", libSoName)
-				}
-				ds.AddNeeded(libSoName)
-				continue
-			}
-			if !strings.Contains(libSoName, ".so") {
-				cmd := exec.Command("pkg-config", "--libs-only-l", libName)
-				if output, err := cmd.Output(); err == nil {
-					libs := strings.TrimSpace(string(output))
-					if strings.HasPrefix(libs, "-l") {
-						libSoName = "lib" + strings.TrimPrefix(libs, "-l") + ".so"
-					} else {
-						if !strings.HasPrefix(libSoName, "lib") {
-							libSoName = "lib" + libSoName
-						}
-						libSoName += ".so"
-					}
-				} else {
-					if !strings.HasPrefix(libSoName, "lib") {
-						libSoName = "lib" + libSoName
-					}
-					ldconfigCmd := exec.Command("ldconfig", "-p")
-					if ldOutput, ldErr := ldconfigCmd.Output(); ldErr == nil {
-						lines := strings.Split(string(ldOutput), "\n")
-						for _, line := range lines {
-							if strings.Contains(line, libSoName) && strings.Contains(line, "=>") {
-								parts := strings.Split(line, "=>")
-								if len(parts) == 2 {
-									actualPath := strings.TrimSpace(parts[1])
-									pathParts := strings.Split(actualPath, "/")
-									if len(pathParts) > 0 {
-										libSoName = pathParts[len(pathParts)-1]
-									}
-									break
-								}
-							}
-						}
-					}
-					if !strings.Contains(libSoName, ".so") {
-						libSoName += ".so"
-					}
-				}
-			}
-			if VerboseMode {
-				fmt.Fprintf(os.Stderr, "Adding C library dependency: %s\n", libSoName)
-			}
-			ds.AddNeeded(libSoName)
-		}
+	for _, libSoName := range fc.neededCLibraries() {
+		ds.AddNeeded(libSoName)
 	}
 
 	// Add PLT symbols
@@ -334,9 +320,11 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 		ds.AddSymbol(funcName, STB_GLOBAL, STT_FUNC)
 	}
 
-	// Add lambda symbols
+	// Add lambda symbols, except those that would interpose a C function
 	for _, lambda := range fc.lambdaFuncs {
-		ds.AddSymbol(lambda.Name, STB_GLOBAL, STT_FUNC)
+		if !fc.eb.externalCalls[lambda.Name] {
+			ds.AddSymbol(lambda.Name, STB_GLOBAL, STT_FUNC)
+		}
 	}
 
 	// Note: Library dependencies will be determined dynamically based on actual usage
@@ -348,14 +336,6 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 		}
 	}
 
-	// Check if hot functions are used with WPO disabled
-	if len(fc.hotFunctions) > 0 && fc.wpoTimeout == 0 {
-		return fmt.Errorf("hot functions require whole-program optimization (do not use --opt-timeout=0)")
-	}
-
-	fc.buildHotFunctionTable()
-	fc.generateHotFunctionTable()
-
 	rodataSymbols := fc.eb.RodataSection()
 
 	// Create sorted list of symbol names for deterministic ordering
@@ -434,6 +414,16 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 		}
 	}
 
+	// The runtime helpers only come in the second pass, within the page the
+	// layout adds to .text. The trie runtime alone takes most of a page, so
+	// it counts towards the space reserved for .text too (see persistent.go).
+	if fc.persistent.Used() {
+		fc.generatePersistentRuntime()
+	}
+
+	// The linked archive members count towards the space reserved for .text
+	fc.emitStaticArchives()
+
 	gotBase, rodataBaseAddr, textAddr, pltBase, err := fc.eb.WriteCompleteDynamicELF(ds, pltFunctions)
 	if err != nil {
 		return err
@@ -476,21 +466,8 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 	}
 
 	// Regenerate code with correct addresses
-	fc.eb.text.Reset()
-	// DON'T reset rodata - it already has correct addresses from first pass
-	// Resetting rodata causes all symbols to move, breaking PC-relative addressing
-	fc.eb.pcRelocations = []PCRelocation{} // Reset PC relocations for recompilation
-	fc.eb.callPatches = []CallPatch{}      // Reset call patches for recompilation
-	fc.eb.labels = make(map[string]int)    // Reset labels for recompilation
-	fc.callOrder = []string{}              // Clear call order for recompilation
-	fc.stringCounter = 0                   // Reset string counter for recompilation
-	fc.labelCounter = 0                    // Reset label counter for recompilation
-	fc.lambdaCounter = 0                   // Reset lambda counter for recompilation
-	// DON'T clear lambdaFuncs - we need them for second pass lambda generation
-	fc.lambdaOffsets = make(map[string]int) // Reset lambda offsets
-	fc.variables = make(map[string]int)     // Reset variables map
-	fc.mutableVars = make(map[string]bool)  // Reset mutability tracking
-	fc.stackOffset = 0                      // Reset stack offset
+	fc.resetForRegeneration()
+
 	// Set up stack frame
 	fc.out.PushReg("rbp")
 	fc.out.MovRegToReg("rbp", "rsp")
@@ -502,79 +479,20 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 	// DON'T re-define rodata symbols - they already exist from first pass
 	// Re-defining them would change their addresses and break PC-relative references
 
-	// ===== AVX-512 CPU DETECTION (regenerated) =====
-	fc.out.MovImmToReg("rax", "7")              // CPUID leaf 7
-	fc.out.XorRegWithReg("rcx", "rcx")          // subleaf 0
-	fc.out.Emit([]byte{0x0f, 0xa2})             // cpuid
-	fc.out.Emit([]byte{0xf6, 0xc3, 0x01})       // test bl, 1
-	fc.out.Emit([]byte{0x0f, 0xba, 0xe3, 0x10}) // bt ebx, 16
-	fc.out.Emit([]byte{0x0f, 0x92, 0xc0})       // setc al
-	fc.out.LeaSymbolToReg("rbx", "cpu_has_avx512")
-	fc.out.MovByteRegToMem("rax", "rbx", 0) // Write only AL, not full RAX
-	fc.out.XorRegWithReg("rax", "rax")
-	fc.out.XorRegWithReg("rbx", "rbx")
-	fc.out.XorRegWithReg("rcx", "rcx")
-	// ===== END AVX-512 DETECTION =====
+	// ===== CPU FEATURE DETECTION (regenerated) =====
+	fc.emitCPUFeatureDetection()
 
 	// Reserve space for arena init call (same as first pass)
 	fc.arenaInitCallOffset = fc.eb.text.Len()
 	fc.out.Emit([]byte{0x90, 0x90, 0x90, 0x90, 0x90}) // 5 NOPs as placeholder
 
-	// Recompile with correct addresses
-	// NOTE: Use the original program parameter (which includes imports),
-	// not a reparsed version from source which would lose imported statements
-
-	// Reset compiler state for second pass
-	fc.variables = make(map[string]int)
-	fc.mutableVars = make(map[string]bool)
-	fc.varTypes = make(map[string]string)
-	fc.stackOffset = 0
-	fc.lambdaFuncs = nil // Clear lambda list so collectSymbols can repopulate it
-	fc.lambdaCounter = 0
-	fc.labelCounter = 0                                       // Reset label counter for consistent loop labels
-	fc.movedVars = make(map[string]bool)                      // Reset moved variables tracking
-	fc.scopedMoved = []map[string]bool{make(map[string]bool)} // Reset scoped tracking
-
-	// Re-detect if main() is called at top level for second pass
-	fc.mainCalledAtTopLevel = fc.detectMainCallInTopLevel(program.Statements)
+	fc.initHotFunctionTable()
 
-	// Collect symbols again (two-pass compilation for second regeneration)
-	for _, stmt := range program.Statements {
-		if err := fc.collectSymbols(stmt); err != nil {
-			return err
-		}
-	}
-
-	// Reset labelCounter after collectSymbols so compilation uses same labels
-	fc.labelCounter = 0
-
-	// DON'T rebuild hot function table - it already exists in rodata from first pass
-	// Rebuilding it would change its address and break PC-relative references
-
-	fc.pushDeferScope()
-
-	// Initialize arena system (malloc'd arenas at runtime)
-	fc.initializeMetaArenaAndGlobalArena()
-
-	// Generate code with symbols collected
-	for _, stmt := range program.Statements {
-		fc.compileStatement(stmt)
+	// Recompile with correct addresses
+	if err := fc.regenerateTopLevel(program); err != nil {
+		return err
 	}
 
-	fc.popDeferScope()
-
-	// Jump over lambda functions to reach the main evaluation code
-	skipLambdasJump := fc.eb.text.Len()
-	fc.out.JumpUnconditional(0) // Will be patched
-	skipLambdasEnd := fc.eb.text.Len()
-
-	// Generate lambda functions here (before exit, but jumped over)
-	fc.generateLambdaFunctions()
-
-	// Patch the jump to skip over lambdas
-	skipLambdasTarget := fc.eb.text.Len()
-	fc.patchJumpImmediate(skipLambdasJump+1, int32(skipLambdasTarget-skipLambdasEnd))
-
 	// Evaluate main (if it exists) to get the exit code
 	_, exists := fc.variables["main"]
 	if exists {
@@ -601,12 +519,14 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 		fc.out.XorRegWithReg("rdi", "rdi")
 	}
 
+	fc.emitProfileFlush()
+
 	// Always add implicit exit at the end of the program
 	// Use syscall exit on Linux (no libc dependency for syscall-based printf)
 	if VerboseMode {
 		fmt.Fprintf(os.Stderr, "DEBUG: Using syscall exit (no libc)\n")
 	}
-	fc.out.MovImmToReg("rax", "60") // syscall number for exit
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_EXIT")) // syscall number for exit
 	// exit code is already in rdi (first syscall argument)
 	fc.eb.Emit("syscall") // invoke syscall directly
 
@@ -615,6 +535,7 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 
 	// Generate runtime helper functions AFTER lambda generation
 	fc.generateRuntimeHelpers()
+	fc.emitStaticArchives()
 
 	// Collect rodata symbols again (lambda/runtime functions may have created new ones)
 	rodataSymbols = fc.eb.RodataSection()
@@ -680,6 +601,9 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 		fc.eb.DefineAddr(lambdaName, lambdaAddr)
 
 		// Update the symbol value in the dynamic symbol table
+		if fc.eb.externalCalls[lambdaName] {
+			continue
+		}
 		if fc.dynamicSymbols != nil {
 			if VerboseMode {
 				fmt.Fprintf(os.Stderr, "DEBUG: Calling UpdateSymbolValue for lambda '%s' at address 0x%x\n", lambdaName, lambdaAddr)
@@ -708,6 +632,9 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 		}
 	}
 	fc.eb.patchPLTCalls(ds, textAddr, pltBase, fc.callOrder)
+	if err := fc.relocateStaticArchives(ds, textAddr, pltBase); err != nil {
+		return err
+	}
 
 	// Patch PC-relative relocations
 	rodataSize := fc.eb.rodata.Len()
@@ -719,8 +646,8 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 			fmt.Fprintf(os.Stderr, "\n=== Patching function calls (regenerated code) ===\n")
 		}
 	}
-	// Patch hot function pointer table
-	fc.patchHotFunctionTable()
+	// Record the code layout for hot patching (--watch)
+	fc.captureHotImage(textAddr)
 
 	// Update ELF with regenerated code (copies eb.text into ELF buffer)
 	fc.eb.patchTextInELF()
@@ -765,5 +692,208 @@ func (fc *C67Compiler) writeELF(program *Program, outputPath string) error {
 	return nil
 }
 
+// neededCLibraries gives the sonames of the shared libraries the program's
+// C imports need, asking pkg-config and ldconfig for bare library names
+func (fc *C67Compiler) neededCLibraries() []string {
+	var needed []string
+	for libName := range fc.cLibHandles {
+		if libName != "linked" {
+			if _, ok := fc.staticArchives[libName]; ok || libName == "c" || libName == "" {
+				continue
+			}
+			libSoName := libName
+			if strings.Contains(libSoName, ".so") {
+				if VerboseMode {
+					fmt.Fprintf(os.Stderr, "Adding custom C library dependency: %s\n", libSoName)
+				}
+				needed = append(needed, libSoName)
+				continue
+			}
+			if !strings.Contains(libSoName, ".so") {
+				cmd := exec.Command("pkg-config", "--libs-only-l", libName)
+				if output, err := cmd.Output(); err == nil {
+					libs := strings.TrimSpace(string(output))
+					if strings.HasPrefix(libs, "-l") {
+						libSoName = "lib" + strings.TrimPrefix(libs, "-l") + ".so"
+					} else {
+						if !strings.HasPrefix(libSoName, "lib") {
+							libSoName = "lib" + libSoName
+						}
+						libSoName += ".so"
+					}
+				} else {
+					if !strings.HasPrefix(libSoName, "lib") {
+						libSoName = "lib" + libSoName
+					}
+					ldconfigCmd := exec.Command("ldconfig", "-p")
+					if ldOutput, ldErr := ldconfigCmd.Output(); ldErr == nil {
+						lines := strings.Split(string(ldOutput), "\n")
+						for _, line := range lines {
+							if strings.Contains(line, libSoName) && strings.Contains(line, "=>") {
+								parts := strings.Split(line, "=>")
+								if len(parts) == 2 {
+									actualPath := strings.TrimSpace(parts[1])
+									pathParts := strings.Split(actualPath, "/")
+									if len(pathParts) > 0 {
+										libSoName = pathParts[len(pathParts)-1]
+									}
+									break
+								}
+							}
+						}
+					}
+					if !strings.Contains(libSoName, ".so") {
+						libSoName += ".so"
+					}
+				}
+			}
+			if VerboseMode {
+				fmt.Fprintf(os.Stderr, "Adding C library dependency: %s\n", libSoName)
+			}
+			needed = append(needed, libSoName)
+		}
+	}
+	return needed
+}
+
+// resetForRegeneration clears the code of the first pass, keeping the
+// addresses it gave to .rodata and .data
+func (fc *C67Compiler) resetForRegeneration() {
+	fc.eb.text.Reset()
+	// DON'T reset rodata - it already has correct addresses from first pass
+	// Resetting rodata causes all symbols to move, breaking PC-relative addressing
+	fc.eb.pcRelocations = []PCRelocation{} // Reset PC relocations for recompilation
+	fc.eb.callPatches = []CallPatch{}      // Reset call patches for recompilation
+	fc.eb.labels = make(map[string]int)    // Reset labels for recompilation
+	fc.callOrder = []string{}              // Clear call order for recompilation
+	fc.stringCounter = 0                   // Reset string counter for recompilation
+	fc.labelCounter = 0                    // Reset label counter for recompilation
+	fc.lambdaCounter = 0                   // Reset lambda counter for recompilation
+	// DON'T clear lambdaFuncs - we need them for second pass lambda generation
+	fc.lambdaOffsets = make(map[string]int) // Reset lambda offsets
+	fc.variables = make(map[string]int)     // Reset variables map
+	fc.mutableVars = make(map[string]bool)  // Reset mutability tracking
+	fc.stackOffset = 0                      // Reset stack offset
+}
+
+// regenerateTopLevel compiles the program's statements again after the
+// entry code, followed by its lambdas, which the entry code jumps over
+func (fc *C67Compiler) regenerateTopLevel(program *Program) error {
+	// NOTE: Use the original program parameter (which includes imports),
+	// not a reparsed version from source which would lose imported statements
+
+	// Reset compiler state for second pass
+	fc.variables = make(map[string]int)
+	fc.mutableVars = make(map[string]bool)
+	fc.varTypes = make(map[string]string)
+	fc.stackOffset = 0
+	fc.lambdaFuncs = nil // Clear lambda list so collectSymbols can repopulate it
+	fc.lambdaCounter = 0
+	fc.labelCounter = 0                                       // Reset label counter for consistent loop labels
+	fc.movedVars = make(map[string]bool)                      // Reset moved variables tracking
+	fc.scopedMoved = []map[string]bool{make(map[string]bool)} // Reset scoped tracking
+
+	// Re-detect if main() is called at top level for second pass
+	fc.mainCalledAtTopLevel = fc.detectMainCallInTopLevel(program.Statements)
+
+	// Collect symbols again (two-pass compilation for second regeneration).
+	// The offsets can differ from the first pass, so the frame is sized from
+	// this collection and not from the first one.
+	fc.maxStackOffset = 0
+	for _, stmt := range program.Statements {
+		if err := fc.collectSymbols(stmt); err != nil {
+			return err
+		}
+	}
+
+	// Reserve the top-level slots, so calls made inside top-level loops
+	// don't overwrite loop counters and limits
+	if fc.maxStackOffset > 0 {
+		fc.out.SubImmFromReg("rsp", int64((fc.maxStackOffset+15) & ^15))
+	}
+
+	// Reset labelCounter after collectSymbols so compilation uses same labels
+	fc.labelCounter = 0
+
+	fc.pushDeferScope()
+
+	// Initialize arena system (malloc'd arenas at runtime). The arena
+	// metadata symbols only exist when arenas are used.
+	if fc.usesArenas {
+		fc.initializeMetaArenaAndGlobalArena()
+	}
+
+	// Generate code with symbols collected
+	for _, stmt := range program.Statements {
+		fc.compileStatement(stmt)
+	}
+
+	fc.popDeferScope()
+
+	// Jump over lambda functions to reach the main evaluation code
+	skipLambdasJump := fc.eb.text.Len()
+	fc.out.JumpUnconditional(0) // Will be patched
+	skipLambdasEnd := fc.eb.text.Len()
+
+	// Generate lambda functions here (before exit, but jumped over)
+	fc.generateLambdaFunctions()
+
+	// Patch the jump to skip over lambdas
+	skipLambdasTarget := fc.eb.text.Len()
+	fc.patchJumpImmediate(skipLambdasJump+1, int32(skipLambdasTarget-skipLambdasEnd))
+	return nil
+}
+
+// writeIRELF writes code lowered from the SSA IR as a static executable. The
+// code only makes system calls, so there is no runtime or C library to link.
+func (fc *C67Compiler) writeIRELF(outputPath string) error {
+	fc.eb.useDynamicLinking = false
+
+	// Memory layout: [headers][rodata][data][text], each constant 8-byte aligned
+	var rodataSymbols, dataSymbols []string
+	for name, c := range fc.eb.consts {
+		if c.writable {
+			dataSymbols = append(dataSymbols, name)
+		} else {
+			rodataSymbols = append(rodataSymbols, name)
+		}
+	}
+	sort.Strings(rodataSymbols)
+	sort.Strings(dataSymbols)
+	offsets := make(map[string]int)
+	layout := func(section *bytes.Buffer, names []string) {
+		section.Reset()
+		for _, name := range names {
+			offsets[name] = section.Len()
+			section.WriteString(fc.eb.consts[name].value)
+			section.Write(make([]byte, (8-section.Len()%8)%8))
+		}
+	}
+	layout(&fc.eb.rodata, rodataSymbols)
+	layout(&fc.eb.data, dataSymbols)
+
+	if err := fc.eb.WriteELFHeader(); err != nil {
+		return fmt.Errorf("failed to write ELF header: %v", err)
+	}
+	rodataAddr := uint64(baseAddr + fc.eb.staticHeaderSize())
+	dataAddr := rodataAddr + uint64(fc.eb.rodata.Len())
+	textAddr := dataAddr + uint64(fc.eb.data.Len())
+	for _, name := range rodataSymbols {
+		fc.eb.DefineAddr(name, rodataAddr+uint64(offsets[name]))
+	}
+	for _, name := range dataSymbols {
+		fc.eb.DefineAddr(name, dataAddr+uint64(offsets[name]))
+	}
+	fc.eb.PatchPCRelocations(textAddr, rodataAddr, fc.eb.rodata.Len())
+
+	if err := os.WriteFile(outputPath, fc.eb.Bytes(), 0755); err != nil {
+		return fmt.Errorf("failed to write executable: %v", err)
+	}
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "-> Wrote static ELF executable from the SSA IR: %s\n", outputPath)
+	}
+	return nil
+}
+
 // Confidence that this function is working: 50%
 // writePE generates a Windows PE (Portable Executable) file for x86_64
@@ -51,12 +51,12 @@ func (fc *C67Compiler) EmitNullCheck(reg, context string) {
 
 	fc.out.MovRegToReg("rsi", "rsp")
 	fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", msgLen))
-	fc.out.MovImmToReg("rax", "1") // write syscall
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // write syscall
 	fc.out.Syscall()
 
 	// Exit with code 1
 	fc.out.MovImmToReg("rdi", "1")
-	fc.out.MovImmToReg("rax", "60") // exit syscall
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_EXIT")) // exit syscall
 	fc.out.Syscall()
 
 	// not_null:
@@ -100,11 +100,11 @@ func (fc *C67Compiler) EmitStackAlignmentCheck(context string) {
 
 	fc.out.MovRegToReg("rsi", "rsp")
 	fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", msgLen))
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.Syscall()
 
 	fc.out.MovImmToReg("rdi", "1")
-	fc.out.MovImmToReg("rax", "60")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_EXIT"))
 	fc.out.Syscall()
 
 	// aligned:
@@ -137,7 +137,7 @@ func (fc *C67Compiler) EmitDebugPrintReg(reg, label string) {
 
 	fc.out.MovRegToReg("rsi", "rsp")
 	fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", msgLen))
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.Syscall()
 	fc.out.AddImmToReg("rsp", stackSpace)
 
@@ -151,7 +151,7 @@ func (fc *C67Compiler) EmitDebugPrintReg(reg, label string) {
 	fc.out.MovImmToReg("rsi", "rsp")
 	fc.out.MovImmToReg("rdx", "4")
 	fc.out.MovImmToReg("rdi", "2")
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.Syscall()
 	fc.out.AddImmToReg("rsp", 16)
 
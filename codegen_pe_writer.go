@@ -83,8 +83,18 @@ func (fc *C67Compiler) writePE(program *Program, outputPath string) error {
 		}
 	}
 
+	hints, err := peImportHints(program, libraries)
+	if err != nil {
+		return err
+	}
+
+	opts, err := WindowsOptions.imageOptions(outputPath)
+	if err != nil {
+		return err
+	}
+
 	// Write the PE file with proper import tables
-	if err := fc.eb.WritePEWithLibraries(outputPath, libraries); err != nil {
+	if err := fc.eb.WritePEWithLibraries(outputPath, libraries, hints, opts); err != nil {
 		return fmt.Errorf("failed to write PE file: %v", err)
 	}
 
@@ -98,8 +108,65 @@ func (fc *C67Compiler) writePE(program *Program, outputPath string) error {
 	return nil
 }
 
+// peImportHints checks the imports from the DLLs the program imports by
+// path (import "libs/foo.dll" as foo) against their export tables, so that
+// a missing function is reported now and not when the program is loaded.
+// It returns the hints of the functions, their indices in the export name
+// tables. A function called as ordinal_<n> must be exported with ordinal n.
+func peImportHints(program *Program, libraries map[string][]string) (map[string]uint16, error) {
+	hints := make(map[string]uint16)
+	for _, stmt := range program.Statements {
+		cImport, ok := stmt.(*CImportStmt)
+		if !ok || !strings.HasSuffix(strings.ToLower(cImport.SoPath), ".dll") {
+			continue
+		}
+		funcs := libraries[mapLibraryToDLL(cImport.Library)]
+		if len(funcs) == 0 {
+			continue
+		}
+		pr, err := OpenPE(cImport.SoPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cImport.SoPath, err)
+		}
+		exports, err := pr.GetExports()
+		pr.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cImport.SoPath, err)
+		}
+		byName := make(map[string]ExportedFunction)
+		byOrdinal := make(map[uint16]bool)
+		for _, fn := range exports.Functions {
+			if fn.Name != "" {
+				byName[fn.Name] = fn
+			}
+			byOrdinal[fn.Ordinal] = true
+		}
+		var missing []string
+		for _, funcName := range funcs {
+			if ordinal, ok := peImportOrdinal(funcName); ok {
+				if !byOrdinal[ordinal] {
+					missing = append(missing, funcName)
+				}
+			} else if fn, ok := byName[funcName]; ok {
+				hints[funcName] = fn.Hint
+			} else {
+				missing = append(missing, funcName)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("%s does not export %s", cImport.SoPath, strings.Join(missing, ", "))
+		}
+	}
+	return hints, nil
+}
+
 // mapLibraryToDLL maps a library name (like "sdl3") to its Windows DLL name (like "SDL3.dll")
 func mapLibraryToDLL(libName string) string {
+	// A library imported by path is named after its file already
+	if strings.HasSuffix(strings.ToLower(libName), ".dll") {
+		return libName
+	}
+
 	// Common library name mappings
 	dllMap := map[string]string{
 		"kernel32": "kernel32.dll",
@@ -279,18 +279,23 @@ func (p *CParser) parseTopLevel() {
 		return
 	}
 
-	// Handle typedef enum declarations
+	// Handle typedef declarations (enums, structs, unions and plain aliases)
 	if tok.Type == CTokIdentifier && tok.Value == "typedef" {
-		if p.tryParseTypedefEnum() {
-			return
-		}
-		p.skipUntil(";")
+		p.parseTypedef()
 		return
 	}
 
 	// Handle standalone enum declarations
 	if tok.Type == CTokIdentifier && tok.Value == "enum" {
 		p.parseEnum()
+		p.skipUntil(";")
+		return
+	}
+
+	// Handle struct and union definitions: struct Tag { ... };
+	if tok.Type == CTokIdentifier && (tok.Value == "struct" || tok.Value == "union") && p.isRecordDefinition() {
+		p.parseTypeSpec()
+		p.skipStatement()
 		return
 	}
 
@@ -522,6 +527,20 @@ func (p *CParser) evalConstant(expr string) (int64, bool) {
 		}
 	}
 
+	// Try addition and multiplication, as in array lengths: N + 1, 4 * 2
+	for _, op := range []string{"+", "*"} {
+		if idx := strings.Index(expr, op); idx > 0 {
+			leftVal, leftOk := p.evalConstant(expr[:idx])
+			rightVal, rightOk := p.evalConstant(expr[idx+1:])
+			if leftOk && rightOk {
+				if op == "+" {
+					return leftVal + rightVal, true
+				}
+				return leftVal * rightVal, true
+			}
+		}
+	}
+
 	return 0, false
 }
 
@@ -607,10 +626,7 @@ func (p *CParser) tryParseFunctionDecl() bool {
 	p.advance() // skip ';'
 
 	// Store the function signature
-	p.results.Functions[funcName] = &CFunctionSignature{
-		ReturnType: returnType,
-		Params:     params,
-	}
+	p.results.Functions[funcName] = newCFunctionSignature(returnType, params)
 
 	if VerboseMode {
 		paramStrs := make([]string, len(params))
@@ -679,6 +695,11 @@ func (p *CParser) parseParameters() []CFunctionParam {
 			break
 		}
 
+		// "..." is tokenized as three dots, newCFunctionSignature turns it into the variadic flag
+		if strings.Join(paramTypeParts, "") == "..." {
+			paramTypeParts = []string{"..."}
+		}
+
 		// Last identifier might be the parameter name
 		// If it doesn't look like a type component, it's the name
 		lastPart := paramTypeParts[len(paramTypeParts)-1]
@@ -689,10 +710,12 @@ func (p *CParser) parseParameters() []CFunctionParam {
 			paramTypeParts = paramTypeParts[:len(paramTypeParts)-1]
 		}
 
-		// Filter out macros from parameter type
+		// Filter out macros from parameter type, and const unless it tells
+		// a string (const char *) from a buffer the function writes to
+		pointer := strings.Contains(strings.Join(paramTypeParts, ""), "*")
 		var actualParamType []string
 		for _, part := range paramTypeParts {
-			if part == "SDL_DECLSPEC" || part == "SDLCALL" || part == "const" {
+			if part == "SDL_DECLSPEC" || part == "SDLCALL" || (part == "const" && !pointer) {
 				continue
 			}
 			actualParamType = append(actualParamType, part)
@@ -752,20 +775,6 @@ func (p *CParser) match(value string) bool {
 	return p.peek().Value == value
 }
 
-// tryParseTypedefEnum tries to parse a typedef enum
-func (p *CParser) tryParseTypedefEnum() bool {
-	saved := p.pos
-	p.advance() // Skip 'typedef'
-
-	if p.isAtEnd() || p.peek().Value != "enum" {
-		p.pos = saved
-		return false
-	}
-
-	p.parseEnum()
-	return true
-}
-
 // parseEnum parses an enum declaration
 func (p *CParser) parseEnum() {
 	p.advance() // Skip 'enum'
@@ -844,8 +853,300 @@ func (p *CParser) parseEnum() {
 		}
 	}
 
-	// Skip until semicolon (for typedef enum Name { ... } Name; pattern)
-	p.skipUntil(";")
+	// The caller handles what follows the body (typedef names, ';')
+}
+
+// isRecordDefinition reports whether the struct or union at the current
+// token has a body, as opposed to a function returning a struct pointer
+func (p *CParser) isRecordDefinition() bool {
+	i := p.pos + 1
+	for i < len(p.tokens) && isCAttribute(p.tokens[i].Value) {
+		i = skipBalanced(p.tokens, i+1)
+	}
+	if i < len(p.tokens) && p.tokens[i].Type == CTokIdentifier {
+		i++
+	}
+	return i < len(p.tokens) && p.tokens[i].Value == "{"
+}
+
+// parseTypedef parses a typedef, recording every name it declares
+func (p *CParser) parseTypedef() {
+	p.advance() // Skip 'typedef'
+
+	base, ok := p.parseTypeSpec()
+	if !ok {
+		p.skipStatement()
+		return
+	}
+	p.parseDeclarators(base, func(name string, ref CTypeRef, bits int) {
+		p.results.Typedefs[name] = ref
+		if VerboseMode {
+			fmt.Fprintf(os.Stderr, "  Typedef: %s = %s\n", name, ref)
+		}
+	})
+}
+
+// parseTypeSpec parses the type part of a declaration: a struct or union
+// (with or without a body), an enum, or a run of type words such as
+// "unsigned long" or "Uint32"
+func (p *CParser) parseTypeSpec() (CTypeRef, bool) {
+	var words []string
+	for !p.isAtEnd() {
+		tok := p.peek()
+		if tok.Type != CTokIdentifier {
+			break
+		}
+		switch {
+		case isCAttribute(tok.Value):
+			p.pos = skipBalanced(p.tokens, p.pos+1)
+			continue
+		case cQualifiers[tok.Value]:
+			p.advance()
+			continue
+		case len(words) == 0 && (tok.Value == "struct" || tok.Value == "union"):
+			return p.parseRecordSpec(), true
+		case len(words) == 0 && tok.Value == "enum":
+			p.parseEnum()
+			return CTypeRef{Name: "enum"}, true
+		case len(words) == 0 || cTypeWords[tok.Value]:
+			words = append(words, tok.Value)
+			p.advance()
+			continue
+		}
+		break
+	}
+	if len(words) == 0 {
+		return CTypeRef{}, false
+	}
+	return CTypeRef{Name: strings.Join(words, " ")}, true
+}
+
+// parseRecordSpec parses "struct Tag", "union Tag { ... }" or an anonymous
+// "struct { ... }", recording tagged definitions
+func (p *CParser) parseRecordSpec() CTypeRef {
+	kind := p.advance().Value
+	packed := p.skipAttributes()
+
+	tag := ""
+	if !p.isAtEnd() && p.peek().Type == CTokIdentifier {
+		tag = p.advance().Value
+	}
+	if !p.match("{") {
+		return CTypeRef{Name: kind + " " + tag}
+	}
+	p.advance() // Skip '{'
+
+	record := &CRecord{Tag: tag, Union: kind == "union"}
+	p.parseRecordBody(record)
+	record.Packed = p.skipAttributes() || packed
+
+	if tag == "" {
+		return CTypeRef{Record: record}
+	}
+	p.results.Records[kind+" "+tag] = record
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "  %s %s: %d members\n", kind, tag, len(record.Members))
+	}
+	return CTypeRef{Name: kind + " " + tag}
+}
+
+// parseRecordBody parses struct or union members up to and including '}'
+func (p *CParser) parseRecordBody(record *CRecord) {
+	for !p.isAtEnd() && !p.match("}") {
+		p.parseOpCount++
+		if p.parseOpCount > p.maxParseOps {
+			return
+		}
+		tok := p.peek()
+		if tok.Type == CTokPreprocessor {
+			p.parsePreprocessor()
+			continue
+		}
+		if tok.Value == ";" {
+			p.advance()
+			continue
+		}
+
+		base, ok := p.parseTypeSpec()
+		if !ok {
+			p.skipStatement()
+			continue
+		}
+		if p.match(";") {
+			// Anonymous struct or union member, its members are promoted
+			p.advance()
+			if base.Record != nil {
+				record.Members = append(record.Members, CMember{Type: base, Bits: -1})
+			}
+			continue
+		}
+		p.parseDeclarators(base, func(name string, ref CTypeRef, bits int) {
+			record.Members = append(record.Members, CMember{Name: name, Type: ref, Bits: bits})
+		})
+	}
+	if p.match("}") {
+		p.advance()
+	}
+}
+
+// parseDeclarators parses "*name[N] : bits, ..." up to and including ';',
+// calling declare for every name. Function pointers declare a pointer.
+func (p *CParser) parseDeclarators(base CTypeRef, declare func(name string, ref CTypeRef, bits int)) {
+	for !p.isAtEnd() {
+		ref := base
+		name := ""
+		bits := -1
+
+		for p.match("*") || (p.peek().Type == CTokIdentifier && cQualifiers[p.peek().Value]) {
+			if p.advance().Value == "*" {
+				ref.Pointers++
+			}
+		}
+		p.skipAttributes()
+
+		if p.match("(") {
+			// Function pointer: (SDLCALL *name)(params)
+			end := skipBalanced(p.tokens, p.pos)
+			for _, tok := range p.tokens[p.pos:end] {
+				if tok.Type == CTokIdentifier && !cQualifiers[tok.Value] {
+					name = tok.Value
+				}
+			}
+			p.pos = end
+			if p.match("(") {
+				p.pos = skipBalanced(p.tokens, p.pos)
+			}
+			ref = CTypeRef{Name: "void", Pointers: 1}
+		} else if !p.isAtEnd() && p.peek().Type == CTokIdentifier {
+			name = p.advance().Value
+		}
+
+		for p.match("[") {
+			p.advance() // Skip '['
+			var expr []string
+			for !p.isAtEnd() && !p.match("]") {
+				expr = append(expr, p.advance().Value)
+			}
+			p.advance() // Skip ']'
+			// Flexible array members have no elements, -1 marks an unknown length
+			n, ok := p.evalConstant(strings.Join(expr, " "))
+			if !ok {
+				n = -1
+				if len(expr) == 0 {
+					n = 0
+				}
+			}
+			ref.Array = append(ref.Array, int(n))
+		}
+
+		if p.match(":") {
+			p.advance() // Skip ':'
+			if n, ok := p.evalConstant(p.advance().Value); ok {
+				bits = int(n)
+			}
+		}
+		p.skipAttributes()
+
+		if name != "" || bits >= 0 {
+			declare(name, ref, bits)
+		}
+
+		if p.match(",") {
+			p.advance()
+			continue
+		}
+		if p.match(";") {
+			p.advance()
+			return
+		}
+		p.skipStatement()
+		return
+	}
+}
+
+// skipAttributes skips __attribute__((...)) and similar annotations,
+// reporting whether one of them asked for a packed layout
+func (p *CParser) skipAttributes() bool {
+	packed := false
+	for !p.isAtEnd() && isCAttribute(p.peek().Value) {
+		start := p.pos
+		p.pos = skipBalanced(p.tokens, p.pos+1)
+		for _, tok := range p.tokens[start:p.pos] {
+			if tok.Value == "packed" || tok.Value == "__packed__" {
+				packed = true
+			}
+		}
+	}
+	return packed
+}
+
+// skipStatement skips up to and including the next ';', stopping before
+// a '}' that closes the enclosing body
+func (p *CParser) skipStatement() {
+	depth := 0
+	for !p.isAtEnd() {
+		switch p.peek().Value {
+		case "{", "(":
+			depth++
+		case ")":
+			depth--
+		case "}":
+			if depth == 0 {
+				return
+			}
+			depth--
+		case ";":
+			if depth == 0 {
+				p.advance()
+				return
+			}
+		}
+		p.advance()
+	}
+}
+
+// skipBalanced returns the index after the parenthesized group starting at
+// tokens[i], or i when there is none
+func skipBalanced(tokens []CToken, i int) int {
+	if i >= len(tokens) || (tokens[i].Value != "(" && tokens[i].Value != "[") {
+		return i
+	}
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tokens[i].Value {
+		case "(", "[":
+			depth++
+		case ")", "]":
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
+
+// isCAttribute reports whether an identifier starts an annotation that
+// takes a parenthesized argument and does not change the declared type
+func isCAttribute(word string) bool {
+	switch word {
+	case "__attribute__", "__declspec", "__aligned", "alignas", "_Alignas", "SDL_ALIGNED":
+		return true
+	}
+	return false
+}
+
+// cQualifiers are skipped when reading declarations
+var cQualifiers = map[string]bool{
+	"const": true, "volatile": true, "restrict": true, "__restrict": true,
+	"extern": true, "static": true, "inline": true, "register": true,
+	"SDL_DECLSPEC": true, "SDLCALL": true, "RLAPI": true, "RAYLIB_API": true,
+}
+
+// cTypeWords can follow another type word in a type name
+var cTypeWords = map[string]bool{
+	"signed": true, "unsigned": true, "short": true, "long": true,
+	"int": true, "char": true, "float": true, "double": true,
 }
 
 // ParseCHeaderFile is a convenience function that parses a C header file
@@ -0,0 +1,579 @@
+// Completion: 80% - C struct, union and typedef layouts from headers, checked against DWARF
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// C types from headers
+//
+// CParser records struct and union bodies and typedefs next to the
+// constants and functions of an import. cHeaderStructs lays them out the
+// way the System V AMD64 ABI does and turns each one into a CStructDecl,
+// so that a C import brings its types along:
+//
+//	import sdl3 as sdl
+//	event = c.malloc(sdl.SDL_Event.size) as sdl.SDL_Event
+//	kind = read_u32(event, 0)
+//
+// Nested structs and unions are flattened into dotted field names
+// ("key.scancode"), anonymous members are promoted into the enclosing
+// struct, array elements are numbered ("pad.0", "pad.1") and bitfields
+// show up as their storage unit. Arrays larger than 16 bytes keep only
+// their first element, since such structs never travel in registers.
+//
+// Headers can disagree with the binary (a missing #define, a platform
+// #ifdef), so when the .so has DWARF info each layout is compared with the
+// compiled one, and the compiled one wins.
+
+// CTypeRef is a C type as written in a declaration
+type CTypeRef struct {
+	Name     string   // "int", "unsigned long", "Uint32", "struct Tag", "enum"
+	Pointers int      // number of '*'
+	Array    []int    // array lengths, outermost first; -1 when unknown
+	Record   *CRecord // body of an anonymous struct or union
+}
+
+func (r CTypeRef) String() string {
+	name := r.Name
+	if r.Record != nil {
+		name = "struct { ... }"
+		if r.Record.Union {
+			name = "union { ... }"
+		}
+	}
+	name += strings.Repeat("*", r.Pointers)
+	for _, n := range r.Array {
+		name += fmt.Sprintf("[%d]", n)
+	}
+	return name
+}
+
+// CRecord is a struct or union body
+type CRecord struct {
+	Tag     string
+	Union   bool
+	Packed  bool
+	Members []CMember
+}
+
+// CMember is a struct or union member; an anonymous member has no name
+type CMember struct {
+	Name string
+	Type CTypeRef
+	Bits int // bitfield width, -1 for ordinary members
+}
+
+// cPrimitive maps a C scalar type name to a cstruct field type and size
+func cPrimitive(name string) (string, int, bool) {
+	switch name {
+	case "int8_t", "Sint8":
+		return "int8", 1, true
+	case "uint8_t", "Uint8", "_Bool", "bool":
+		return "uint8", 1, true
+	case "int16_t", "Sint16":
+		return "int16", 2, true
+	case "uint16_t", "Uint16", "char16_t":
+		return "uint16", 2, true
+	case "int32_t", "Sint32", "wchar_t", "enum":
+		return "int32", 4, true
+	case "uint32_t", "Uint32", "char32_t":
+		return "uint32", 4, true
+	case "int64_t", "Sint64", "intptr_t", "ssize_t", "ptrdiff_t", "off_t":
+		return "int64", 8, true
+	case "uint64_t", "Uint64", "uintptr_t", "size_t":
+		return "uint64", 8, true
+	case "float":
+		return "float32", 4, true
+	case "double":
+		return "float64", 8, true
+	}
+
+	// Combinations of the basic type words: unsigned long long int
+	unsigned, size := false, 4
+	longs := 0
+	for _, word := range strings.Fields(name) {
+		switch word {
+		case "unsigned":
+			unsigned = true
+		case "signed", "int":
+		case "char":
+			size = 1
+		case "short":
+			size = 2
+		case "long":
+			longs++
+		default:
+			return "", 0, false
+		}
+	}
+	if longs > 0 {
+		size = 8 // LP64
+	}
+	typ := fmt.Sprintf("int%d", size*8)
+	if unsigned {
+		typ = "u" + typ
+	}
+	return typ, size, true
+}
+
+// cLayout lays out C types from one header, flattening them into fields
+type cLayout struct {
+	header     *CHeaderConstants
+	active     map[*CRecord]bool // records being laid out, against cycles
+	fullArrays bool              // keep every element of large arrays
+}
+
+// cHeaderStructs lays out every struct and union a header defines, under
+// its typedef names and its tag. Types that cannot be laid out (opaque
+// structs, unknown member types or array lengths) are left out.
+func cHeaderStructs(header *CHeaderConstants) map[string]*CStructDecl {
+	l := &cLayout{header: header, active: make(map[*CRecord]bool)}
+	structs := make(map[string]*CStructDecl)
+	add := func(name string, ref CTypeRef) {
+		decl, err := l.layoutStruct(name, ref)
+		if err != nil {
+			if VerboseMode {
+				fmt.Fprintf(os.Stderr, "  Skipping C type %s: %v\n", name, err)
+			}
+			return
+		}
+		structs[name] = decl
+	}
+	for name, ref := range header.Typedefs {
+		if ref.Pointers == 0 && len(ref.Array) == 0 && l.isRecord(ref) {
+			add(name, ref)
+		}
+	}
+	for key := range header.Records {
+		tag := key[strings.Index(key, " ")+1:]
+		if _, exists := structs[tag]; !exists {
+			add(tag, CTypeRef{Name: key})
+		}
+	}
+	return structs
+}
+
+// isRecord reports whether a type names a struct or union, through typedefs
+func (l *cLayout) isRecord(ref CTypeRef) bool {
+	for depth := 0; depth < 32; depth++ {
+		if ref.Record != nil || strings.HasPrefix(ref.Name, "struct ") || strings.HasPrefix(ref.Name, "union ") {
+			return true
+		}
+		next, ok := l.header.Typedefs[ref.Name]
+		if !ok || next.Pointers > 0 || len(next.Array) > 0 {
+			return false
+		}
+		ref = next
+	}
+	return false
+}
+
+// layoutStruct lays out a struct or union type as a cstruct
+func (l *cLayout) layoutStruct(name string, ref CTypeRef) (*CStructDecl, error) {
+	fields, size, _, err := l.layout(ref, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("empty or incomplete")
+	}
+	return &CStructDecl{Name: name, Fields: fields, Size: size}, nil
+}
+
+// layout returns the fields, size and alignment of a type, naming the
+// fields after prefix
+func (l *cLayout) layout(ref CTypeRef, prefix string, depth int) ([]CStructField, int, int, error) {
+	if depth > 32 {
+		return nil, 0, 0, fmt.Errorf("typedefs nested too deeply")
+	}
+
+	if len(ref.Array) > 0 {
+		n := ref.Array[0]
+		if n < 0 {
+			return nil, 0, 0, fmt.Errorf("unknown array length in %s", prefix)
+		}
+		elem := ref
+		elem.Array = ref.Array[1:]
+		elemFields, elemSize, align, err := l.layout(elem, "", depth+1)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		count := n
+		if elemSize*n > 16 && count > 1 && !l.fullArrays {
+			count = 1 // see the top of the file
+		}
+		var fields []CStructField
+		for i := 0; i < count; i++ {
+			fields = append(fields, shiftFields(elemFields, joinField(prefix, strconv.Itoa(i)), i*elemSize)...)
+		}
+		return fields, elemSize * n, align, nil
+	}
+
+	if ref.Pointers > 0 {
+		return []CStructField{{Name: prefix, Type: "ptr", Size: 8}}, 8, 8, nil
+	}
+	if ref.Record != nil {
+		return l.layoutRecord(ref.Record, prefix, depth)
+	}
+	if strings.HasPrefix(ref.Name, "struct ") || strings.HasPrefix(ref.Name, "union ") {
+		record, ok := l.header.Records[ref.Name]
+		if !ok {
+			return nil, 0, 0, fmt.Errorf("%s has no definition", ref.Name)
+		}
+		return l.layoutRecord(record, prefix, depth)
+	}
+	if strings.HasPrefix(ref.Name, "enum") {
+		return []CStructField{{Name: prefix, Type: "int32", Size: 4}}, 4, 4, nil
+	}
+	if typ, size, ok := cPrimitive(ref.Name); ok {
+		return []CStructField{{Name: prefix, Type: typ, Size: size}}, size, size, nil
+	}
+	if alias, ok := l.header.Typedefs[ref.Name]; ok {
+		return l.layout(alias, prefix, depth+1)
+	}
+	return nil, 0, 0, fmt.Errorf("unknown type %s", ref.Name)
+}
+
+// layoutRecord lays out a struct or union body
+func (l *cLayout) layoutRecord(record *CRecord, prefix string, depth int) ([]CStructField, int, int, error) {
+	if l.active[record] {
+		return nil, 0, 0, fmt.Errorf("struct %s contains itself", record.Tag)
+	}
+	l.active[record] = true
+	defer delete(l.active, record)
+
+	var fields []CStructField
+	bitPos, size, maxAlign := 0, 0, 1
+	for _, m := range record.Members {
+		memberFields, memberSize, align, err := l.layout(m.Type, joinField(prefix, m.Name), depth+1)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if record.Packed {
+			align = 1
+		}
+
+		offset := 0
+		if m.Bits >= 0 {
+			// A bitfield goes in the storage unit of its type that holds
+			// the next free bit, unless it would straddle two units
+			unit := align * 8
+			if m.Bits == 0 || bitPos%unit+m.Bits > memberSize*8 {
+				bitPos = (bitPos + unit - 1) / unit * unit
+			}
+			if m.Bits == 0 {
+				continue
+			}
+			offset = bitPos / unit * align
+			if !record.Union {
+				bitPos += m.Bits
+			}
+		} else if !record.Union {
+			offset = alignUp((bitPos+7)/8, align)
+			bitPos = (offset + memberSize) * 8
+		}
+
+		if m.Name != "" || m.Type.Record != nil {
+			fields = append(fields, shiftFields(memberFields, "", offset)...)
+		}
+		if record.Union {
+			size = max(size, memberSize)
+		}
+		maxAlign = max(maxAlign, align)
+	}
+	if !record.Union {
+		size = (bitPos + 7) / 8
+	}
+	return fields, alignUp(size, maxAlign), maxAlign, nil
+}
+
+// shiftFields moves fields by offset, renaming unnamed ones after name
+func shiftFields(fields []CStructField, name string, offset int) []CStructField {
+	shifted := make([]CStructField, len(fields))
+	for i, f := range fields {
+		f.Offset += offset
+		if name != "" {
+			f.Name = joinField(name, f.Name)
+		}
+		shifted[i] = f
+	}
+	return shifted
+}
+
+// joinField joins the parts of a flattened field name
+func joinField(prefix, name string) string {
+	switch {
+	case prefix == "":
+		return name
+	case name == "":
+		return prefix
+	}
+	return prefix + "." + name
+}
+
+func alignUp(n, align int) int {
+	return (n + align - 1) / align * align
+}
+
+// cstructField finds a flattened field by name; a nested struct or array
+// is found by its first field
+func cstructField(decl *CStructDecl, name string) (CStructField, bool) {
+	for _, f := range decl.Fields {
+		if f.Name == name || strings.HasPrefix(f.Name, name+".") {
+			return f, true
+		}
+	}
+	return CStructField{}, false
+}
+
+// ExtractStructLayouts reads the layouts of the structs and unions in a
+// .so's DWARF info, by typedef name and by tag
+func ExtractStructLayouts(soPath string) (map[string]*CStructDecl, error) {
+	elfFile, err := elf.Open(soPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ELF file: %v", err)
+	}
+	defer elfFile.Close()
+
+	layouts := make(map[string]*CStructDecl)
+	dwarfData, err := elfFile.DWARF()
+	if err != nil {
+		return layouts, nil // No DWARF info, nothing to compare with
+	}
+
+	reader := dwarfData.Reader()
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error reading DWARF: %v", err)
+		}
+		if entry == nil {
+			break
+		}
+		switch entry.Tag {
+		case dwarf.TagTypedef, dwarf.TagStructType, dwarf.TagUnionType:
+		default:
+			continue
+		}
+		name, _ := entry.Val(dwarf.AttrName).(string)
+		if name == "" {
+			continue
+		}
+		if _, exists := layouts[name]; exists && entry.Tag != dwarf.TagTypedef {
+			continue // typedef names win over tags
+		}
+		typ, err := dwarfData.Type(entry.Offset)
+		if err != nil {
+			continue
+		}
+		if st, ok := dwarfUnqualified(typ).(*dwarf.StructType); ok && !st.Incomplete && st.Kind != "class" {
+			if fields, ok := dwarfFields(st, ""); ok {
+				layouts[name] = &CStructDecl{Name: name, Fields: fields, Size: int(st.ByteSize)}
+			}
+		}
+	}
+	return layouts, nil
+}
+
+// dwarfUnqualified strips typedefs and qualifiers
+func dwarfUnqualified(typ dwarf.Type) dwarf.Type {
+	for {
+		switch t := typ.(type) {
+		case *dwarf.TypedefType:
+			typ = t.Type
+		case *dwarf.QualType:
+			typ = t.Type
+		default:
+			return typ
+		}
+	}
+}
+
+// dwarfFields flattens a DWARF type the way cLayout flattens header types
+func dwarfFields(typ dwarf.Type, prefix string) ([]CStructField, bool) {
+	scalar := func(kind string) ([]CStructField, bool) {
+		size := int(typ.Size())
+		return []CStructField{{Name: prefix, Type: fmt.Sprintf("%s%d", kind, size*8), Size: size}}, true
+	}
+	switch t := dwarfUnqualified(typ).(type) {
+	case *dwarf.IntType, *dwarf.CharType, *dwarf.EnumType:
+		return scalar("int")
+	case *dwarf.UintType, *dwarf.UcharType, *dwarf.BoolType:
+		return scalar("uint")
+	case *dwarf.FloatType:
+		return scalar("float")
+	case *dwarf.PtrType, *dwarf.FuncType:
+		return []CStructField{{Name: prefix, Type: "ptr", Size: 8}}, true
+	case *dwarf.ArrayType:
+		if t.Count < 0 {
+			return nil, false
+		}
+		elemSize := int(t.Type.Size())
+		count := int(t.Count)
+		if elemSize*count > 16 && count > 1 {
+			count = 1
+		}
+		var fields []CStructField
+		for i := 0; i < count; i++ {
+			elemFields, ok := dwarfFields(t.Type, "")
+			if !ok {
+				return nil, false
+			}
+			fields = append(fields, shiftFields(elemFields, joinField(prefix, strconv.Itoa(i)), i*elemSize)...)
+		}
+		return fields, true
+	case *dwarf.StructType:
+		var fields []CStructField
+		for _, f := range t.Field {
+			memberFields, ok := dwarfFields(f.Type, joinField(prefix, f.Name))
+			if !ok {
+				return nil, false
+			}
+			offset := int(f.ByteOffset)
+			if f.BitSize > 0 && f.DataBitOffset > 0 {
+				unit := int(f.Type.Size())
+				offset = int(f.DataBitOffset) / (unit * 8) * unit
+			}
+			fields = append(fields, shiftFields(memberFields, "", offset)...)
+		}
+		return fields, true
+	}
+	return nil, false
+}
+
+// checkCStructLayouts compares header layouts with the DWARF ones and
+// replaces the header layouts that differ, with a warning
+func checkCStructLayouts(structs, compiled map[string]*CStructDecl, soPath string) {
+	names := make([]string, 0, len(structs))
+	for name := range structs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		decl := structs[name]
+		want, ok := compiled[name]
+		if !ok {
+			continue
+		}
+		if diff := cstructLayoutDiff(decl, want); diff != "" {
+			fmt.Fprintf(os.Stderr, "Warning: %s: the header layout of %s does not match the DWARF info (%s), using the DWARF layout\n",
+				soPath, name, diff)
+			structs[name] = want
+		}
+	}
+}
+
+// cstructLayoutDiff describes the first difference between two layouts
+func cstructLayoutDiff(header, compiled *CStructDecl) string {
+	if header.Size != compiled.Size {
+		return fmt.Sprintf("%d bytes, not %d", header.Size, compiled.Size)
+	}
+	for _, f := range header.Fields {
+		if g, ok := cstructField(compiled, f.Name); ok && g.Offset != f.Offset {
+			return fmt.Sprintf("%s at offset %d, not %d", f.Name, f.Offset, g.Offset)
+		}
+	}
+	return ""
+}
+
+// importCStructs lays out the structs and unions of a C import's headers,
+// checks them against the library's DWARF info, and registers them as
+// "alias.Name", and as "Name" when no other import has claimed it
+func (fc *C67Compiler) importCStructs(cImport *CImportStmt) {
+	header := fc.cConstants[cImport.Alias]
+	if header == nil || len(header.Records) == 0 {
+		return
+	}
+	for name := range fc.cImportStructs {
+		if strings.HasPrefix(name, cImport.Alias+".") {
+			return // C imports are processed once per compile pass
+		}
+	}
+	structs := cHeaderStructs(header)
+	if cImport.SoPath != "" {
+		compiled, err := ExtractStructLayouts(cImport.SoPath)
+		if err != nil {
+			if VerboseMode {
+				fmt.Fprintf(os.Stderr, "Warning: failed to read struct layouts from %s: %v\n", cImport.SoPath, err)
+			}
+		} else {
+			checkCStructLayouts(structs, compiled, cImport.SoPath)
+		}
+	}
+	for name, decl := range structs {
+		fc.cImportStructs[cImport.Alias+"."+name] = decl
+		if _, exists := fc.cImportStructs[name]; !exists {
+			fc.cImportStructs[name] = decl
+		}
+	}
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "Imported %d C struct types into %s\n", len(structs), cImport.Alias)
+	}
+}
+
+// cstructMetadata resolves ns.Type.size and ns.Type.field.offset for
+// cstructs from C headers, and Type.size for cstructs declared in an
+// imported module, which the parser of the importing file has not seen.
+// isType reports whether the expression starts at such a type, so that a
+// misspelled field is an error rather than a field access on a value.
+func (fc *C67Compiler) cstructMetadata(e *FieldAccessExpr) (value int, isType bool, ok bool) {
+	var path []string
+	var obj Expression = e
+	for {
+		f, isField := obj.(*FieldAccessExpr)
+		if !isField {
+			break
+		}
+		path = append([]string{f.FieldName}, path...)
+		obj = f.Object
+	}
+	var decl *CStructDecl
+	switch root := obj.(type) {
+	case *NamespacedIdentExpr:
+		if _, isC := fc.cImports[root.Namespace]; !isC {
+			return 0, false, false
+		}
+		if decl = fc.cImportStructs[root.Namespace+"."+root.Name]; decl == nil {
+			return 0, true, false
+		}
+	case *IdentExpr:
+		if _, isVar := fc.variables[root.Name]; isVar {
+			return 0, false, false
+		}
+		if decl = fc.cstructs[root.Name]; decl == nil {
+			return 0, false, false
+		}
+	default:
+		return 0, false, false
+	}
+	last := len(path) - 1
+	switch {
+	case len(path) == 1 && path[0] == "size":
+		return decl.Size, true, true
+	case len(path) >= 2 && path[last] == "offset":
+		if f, found := cstructField(decl, strings.Join(path[:last], ".")); found {
+			return f.Offset, true, true
+		}
+	}
+	return 0, true, false
+}
+
+// fieldAccessPath spells out a chain of field accesses for messages
+func fieldAccessPath(e *FieldAccessExpr) string {
+	switch obj := e.Object.(type) {
+	case *FieldAccessExpr:
+		return fieldAccessPath(obj) + "." + e.FieldName
+	case *NamespacedIdentExpr:
+		return obj.Namespace + "." + obj.Name + "." + e.FieldName
+	case *IdentExpr:
+		return obj.Name + "." + e.FieldName
+	}
+	return e.FieldName
+}
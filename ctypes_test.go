@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+const ctypesHeader = `#ifndef CT_H
+#define CT_H
+typedef unsigned int uint32_t;
+typedef unsigned char uint8_t;
+typedef short int16_t;
+typedef unsigned long uint64_t;
+#ifndef CT_NAME_LEN
+#define CT_NAME_LEN 12
+#endif
+typedef uint32_t CT_Kind;
+typedef struct CT_Point { int x, y; } CT_Point;
+typedef struct { float x, y; } CT_Vec2;
+struct ct_flags {
+    unsigned int visible : 1;
+    unsigned int layer : 4;
+    unsigned int : 0;
+    unsigned char mode;
+};
+typedef struct CT_Key {
+    CT_Kind type;
+    uint64_t timestamp;
+    int16_t scancode;
+    uint8_t down, repeat;
+} CT_Key;
+typedef union CT_Event {
+    CT_Kind type;
+    CT_Key key;
+    struct { CT_Kind type; CT_Point pos; } motion;
+    uint8_t padding[64];
+} CT_Event;
+typedef struct CT_Sprite {
+    char name[CT_NAME_LEN];
+    CT_Vec2 pos;
+    union { int id; float weight; };
+    struct ct_flags flags;
+    void (*on_draw)(struct CT_Sprite *self, void *userdata);
+    const char *label;
+    double scale[2];
+} CT_Sprite;
+typedef struct CT_Opaque CT_Opaque;
+CT_Vec2 ct_vec2_add(CT_Vec2 a, CT_Vec2 b);
+int ct_event_kind(const CT_Event *e);
+#endif
+`
+
+func TestCHeaderStructs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ct.h")
+	if err := os.WriteFile(path, []byte(ctypesHeader), 0644); err != nil {
+		t.Fatal(err)
+	}
+	header, err := NewCParser().ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := header.Functions["ct_vec2_add"]; !ok {
+		t.Error("function prototypes after struct definitions were not parsed")
+	}
+
+	structs := cHeaderStructs(header)
+	if _, ok := structs["CT_Opaque"]; ok {
+		t.Error("an opaque struct should not be laid out")
+	}
+	sizes := map[string]int{
+		"CT_Point": 8, "CT_Vec2": 8, "ct_flags": 8, "CT_Key": 24, "CT_Event": 64, "CT_Sprite": 64,
+	}
+	for name, want := range sizes {
+		decl, ok := structs[name]
+		if !ok {
+			t.Errorf("%s was not laid out", name)
+			continue
+		}
+		if decl.Size != want {
+			t.Errorf("%s is %d bytes, want %d", name, decl.Size, want)
+		}
+	}
+
+	// Offsets as gcc computes them for the same header
+	offsets := []struct {
+		typ, field string
+		want       int
+	}{
+		{"CT_Key", "scancode", 16},
+		{"CT_Key", "repeat", 19},
+		{"CT_Event", "key.scancode", 16},
+		{"CT_Event", "motion.pos.y", 8},
+		{"CT_Sprite", "name.0", 0},
+		{"CT_Sprite", "pos", 12},
+		{"CT_Sprite", "id", 20},
+		{"CT_Sprite", "weight", 20},
+		{"CT_Sprite", "flags.mode", 28},
+		{"CT_Sprite", "on_draw", 32},
+		{"CT_Sprite", "label", 40},
+		{"CT_Sprite", "scale.1", 56},
+		{"ct_flags", "layer", 0},
+		{"ct_flags", "mode", 4},
+	}
+	for _, tt := range offsets {
+		decl := structs[tt.typ]
+		if decl == nil {
+			continue
+		}
+		if f, ok := cstructField(decl, tt.field); !ok || f.Offset != tt.want {
+			t.Errorf("%s.%s at offset %d (found %v), want %d", tt.typ, tt.field, f.Offset, ok, tt.want)
+		}
+	}
+
+	if p := classifyStruct(structs["CT_Vec2"], false); len(p.Words) != 1 || p.Words[0] != abiSSE {
+		t.Errorf("CT_Vec2 should travel in one xmm register, got %v", p.Words)
+	}
+}
+
+func TestCStructsFromHeader(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.Skip("needs an x86-64 Linux shared library")
+	}
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "ct.c")
+	lib := filepath.Join(dir, "libct.so")
+	if err := os.WriteFile(filepath.Join(dir, "ct.h"), []byte(ctypesHeader), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte(`#include "ct.h"
+CT_Vec2 ct_vec2_add(CT_Vec2 a, CT_Vec2 b) { CT_Vec2 r = {a.x + b.x, a.y + b.y}; return r; }
+int ct_event_kind(const CT_Event *e) { return (int)e->type + e->key.scancode; }
+CT_Sprite ct_sprite;
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The library is built with longer names than the header says, so the
+	// DWARF layout of CT_Sprite has to replace the header's
+	cmd := exec.Command("gcc", "-g", "-shared", "-fPIC", "-DCT_NAME_LEN=20", "-o", lib, src)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gcc: %v\n%s", err, out)
+	}
+	t.Setenv("LD_LIBRARY_PATH", dir)
+
+	code := `import "` + lib + `" as ct
+import "c" as c
+printf("%v %v %v\n", ct.CT_Event.size, ct.CT_Key.scancode.offset, ct.CT_Event.motion.pos.y.offset)
+printf("%v %v\n", ct.CT_Sprite.size, ct.CT_Sprite.pos.offset)
+a = c.malloc(ct.CT_Vec2.size) as ct.CT_Vec2
+write_f32(a, 0, 1.5)
+write_f32(a, 1, 2.0)
+s = ct.ct_vec2_add(a, a)
+printf("%v %v\n", read_u32(s, 0), read_u32(s, 1))
+e = c.malloc(ct.CT_Event.size) as ct.CT_Event
+write_u32(e, 0, 5)
+write_i16(e, ct.CT_Key.scancode.offset / 2, 3)
+printf("%v\n", ct.ct_event_kind(e))
+`
+	want := "64.000000 16.000000 8.000000\n" +
+		"72.000000 20.000000\n" +
+		"1077936128.000000 1082130432.000000\n" +
+		"8.000000\n"
+	if got := compileAndRun(t, code); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -44,7 +44,7 @@ func (eb *ExecutableBuilder) CompileDefaultProgram(outputFile string) error {
 		}
 		// Set up complete dynamic sections
 		ds := NewDynamicSections(ArchX86_64)
-		ds.AddNeeded("libc.so.6")
+		ds.AddNeeded(systemLibrary(eb.target, "libc.so.6"))
 		// Add symbols
 		for _, funcName := range eb.neededFunctions {
 			ds.AddSymbol(funcName, STB_GLOBAL, STT_FUNC)
@@ -93,7 +93,7 @@ func (eb *ExecutableBuilder) CompileDefaultProgram(outputFile string) error {
 			fmt.Fprintln(os.Stderr, "-> .rodata")
 		}
 		rodataSymbols := eb.RodataSection()
-		rodataAddr := baseAddr + headerSize
+		rodataAddr := baseAddr + eb.staticHeaderSize()
 		currentAddr := uint64(rodataAddr)
 		for symbol, value := range rodataSymbols {
 			eb.DefineAddr(symbol, currentAddr)
@@ -491,7 +491,7 @@ func remoteBranchExists(repoPath, branchName string) bool {
 	return err == nil
 }
 
-// FindVibe67Files returns all .vibe67 files in a directory (recursively)
+// FindVibe67Files returns all .vibe67 and .v67 files in a directory (recursively)
 func FindVibe67Files(dir string) ([]string, error) {
 	var files []string
 
@@ -505,8 +505,8 @@ func FindVibe67Files(dir string) ([]string, error) {
 			return filepath.SkipDir
 		}
 
-		// Add .vibe67 files
-		if !info.IsDir() && strings.HasSuffix(path, ".vibe67") {
+		// Add .vibe67 and .v67 files
+		if !info.IsDir() && isVibeFile(path) {
 			files = append(files, path)
 		}
 
@@ -79,16 +79,19 @@ func (t CType) Size(arch Arch) int {
 
 // Parameter represents a function parameter
 type Parameter struct {
-	Name string
-	Type CType
-	Size int // For structs or arrays
+	Name   string
+	Type   CType
+	Size   int    // For structs or arrays
+	Struct string // cstruct name when Type is CTypeStruct
 }
 
 // Function represents a C function signature
 type Function struct {
-	Name       string
-	ReturnType CType
-	Parameters []Parameter
+	Name         string
+	ReturnType   CType
+	ReturnStruct string // cstruct name when ReturnType is CTypeStruct
+	Parameters   []Parameter
+	Variadic     bool // more arguments may follow Parameters, like printf
 }
 
 // DynamicLibrary represents a .so file and its exported functions
@@ -25,6 +25,16 @@ const (
 	sectionTableAddr       = progHeaderOffset + 0x38 // Section table address
 )
 
+// staticHeaderSize returns the size of the headers of a static executable:
+// the ELF header, the program headers and the ABI note, if any
+func (eb *ExecutableBuilder) staticHeaderSize() int {
+	note := elfABINote(eb.target)
+	if note == nil {
+		return headerSize
+	}
+	return headerSize + progHeaderSize + len(note)
+}
+
 func (eb *ExecutableBuilder) WriteELFHeader() error {
 	w := eb.ELFWriter()
 	rodataSize := eb.rodata.Len()
@@ -38,14 +48,18 @@ func (eb *ExecutableBuilder) WriteELFHeader() error {
 
 	// Magic
 	w.Write(0x7f)
-	w.Write(0x45)  // E
-	w.Write(0x4c)  // L
-	w.Write(0x46)  // F
-	w.Write(2)     // 64-bit
-	w.Write(1)     // little endian
-	w.Write(1)     // ELF version
-	w.Write(3)     // Linux
-	w.Write(3)     // ABI version, dynamic linker version
+	w.Write(0x45) // E
+	w.Write(0x4c) // L
+	w.Write(0x46) // F
+	w.Write(2)    // 64-bit
+	w.Write(1)    // little endian
+	w.Write(1)    // ELF version
+	w.Write(elfOSABI(eb.target))
+	if eb.target.OS() == OSFreeBSD {
+		w.Write(0) // ABI version
+	} else {
+		w.Write(3) // ABI version, dynamic linker version
+	}
 	w.WriteN(0, 7) // zero padding, length of 7
 	w.Write2(2)    // object file type: executable
 
@@ -58,6 +72,8 @@ func (eb *ExecutableBuilder) WriteELFHeader() error {
 		fmt.Fprintln(os.Stderr)
 	}
 
+	note := elfABINote(eb.target)
+	headerSize := eb.staticHeaderSize()
 	entry := uint64(baseAddr + headerSize + rodataSize + dataSize)
 
 	w.Write8u(entry)
@@ -66,8 +82,11 @@ func (eb *ExecutableBuilder) WriteELFHeader() error {
 	w.Write4(0)
 	w.Write2(elfHeaderSize)
 	w.Write2(progHeaderSize)
-	const programHeaderTableEntries = 1
-	w.Write2(programHeaderTableEntries)
+	programHeaderTableEntries := 1
+	if note != nil {
+		programHeaderTableEntries = 2
+	}
+	w.Write2(byte(programHeaderTableEntries))
 	w.Write2(sectionHeaderEntrySize)
 	const sectionHeaderTableEntries = 0
 	w.Write2(sectionHeaderTableEntries)
@@ -88,6 +107,20 @@ func (eb *ExecutableBuilder) WriteELFHeader() error {
 	w.Write8u(fileSize)
 	w.Write8u(pageSize)
 
+	if note != nil {
+		// PT_NOTE, right after the program headers
+		noteOffset := uint64(elfHeaderSize + 2*progHeaderSize)
+		w.Write4(4)
+		w.Write4(4) // PF_R
+		w.Write8u(noteOffset)
+		w.Write8u(baseAddr + noteOffset)
+		w.Write8u(baseAddr + noteOffset)
+		w.Write8u(uint64(len(note)))
+		w.Write8u(uint64(len(note)))
+		w.Write8u(4)
+		w.WriteBytes(note)
+	}
+
 	if VerboseMode {
 		fmt.Fprintln(os.Stderr)
 	}
@@ -48,8 +48,15 @@ func (eb *ExecutableBuilder) WriteCompleteDynamicELF(ds *DynamicSections, functi
 	// OPTIMIZED: Use single RWX LOAD segment (like static ELF does)
 	// Modern Linux supports this, saves ~8KB from segment separation
 	// We need: PHDR, INTERP, LOAD(rwx), DYNAMIC
+	// FreeBSD also needs PT_NOTE for the ABI note, which follows the
+	// program headers so that the kernel finds it in the first page
 	numProgHeaders := 4 // PT_PHDR, PT_INTERP, PT_LOAD, PT_DYNAMIC
-	headersSize := uint64(elfHeaderSize + progHeaderSize*numProgHeaders)
+	note := elfABINote(eb.target)
+	if note != nil {
+		numProgHeaders++
+	}
+	noteOffset := uint64(elfHeaderSize + progHeaderSize*numProgHeaders)
+	headersSize := noteOffset + uint64(len(note))
 
 	// Align to page boundary
 	alignedHeaders := (headersSize + pageSize - 1) & ^uint64(pageSize-1)
@@ -175,6 +182,8 @@ func (eb *ExecutableBuilder) WriteCompleteDynamicELF(ds *DynamicSections, functi
 		size   int
 	}{currentOffset, currentAddr, int(textReservedSize)}
 
+	eb.textOffsetInELF = currentOffset
+	eb.textReservedInELF = textReservedSize
 	currentOffset += textReservedSize
 	currentAddr += textReservedSize
 
@@ -356,7 +365,7 @@ func (eb *ExecutableBuilder) WriteCompleteDynamicELF(ds *DynamicSections, functi
 	w.Write(2)    // 64-bit
 	w.Write(1)    // little endian
 	w.Write(1)    // ELF version
-	w.Write(3)    // Linux
+	w.Write(elfOSABI(eb.target))
 	w.WriteN(0, 8)
 	w.Write2(2) // EXEC (Executable file)
 	w.Write2(byte(GetELFMachineType(eb.target.Arch())))
@@ -426,6 +435,18 @@ func (eb *ExecutableBuilder) WriteCompleteDynamicELF(ds *DynamicSections, functi
 	w.Write8u(uint64(layout["dynamic"].size))
 	w.Write8u(8)
 
+	if note != nil {
+		w.Write4(4) // PT_NOTE
+		w.Write4(4) // PF_R
+		w.Write8u(noteOffset)
+		w.Write8u(baseAddr + noteOffset)
+		w.Write8u(baseAddr + noteOffset)
+		w.Write8u(uint64(len(note)))
+		w.Write8u(uint64(len(note)))
+		w.Write8u(4)
+		w.WriteBytes(note)
+	}
+
 	// Pad to aligned header size
 	for i := headersSize; i < alignedHeaders; i++ {
 		w.Write(0)
@@ -498,8 +519,9 @@ func (eb *ExecutableBuilder) WriteCompleteDynamicELF(ds *DynamicSections, functi
 		branchInstr := uint32(0x94000000) | (uint32(jumpOffset) & 0x03FFFFFF) // bl instruction (0x94 instead of 0x14)
 		binary.Write(w.(*BufferWrapper).buf, binary.LittleEndian, branchInstr)
 		// After return, x0/w0 contains exit code - call exit syscall
-		// mov x8, #93 (sys_exit on Linux ARM64)
-		w.WriteBytes([]byte{0xa8, 0x0b, 0x80, 0xd2})
+		// mov x8, #SYS_EXIT
+		movz := uint32(0xd2800008) | uint32(sysNum(eb.target, "SYS_EXIT"))<<5
+		binary.Write(w.(*BufferWrapper).buf, binary.LittleEndian, movz)
 		// svc #0
 		w.WriteBytes([]byte{0x01, 0x00, 0x00, 0xd4})
 		startActualSize = 24 // 6 instructions * 4 bytes
@@ -647,6 +669,9 @@ func (eb *ExecutableBuilder) WriteCompleteDynamicELF(ds *DynamicSections, functi
 }
 
 func (eb *ExecutableBuilder) getInterpreterPath() string {
+	if eb.target.OS() == OSFreeBSD {
+		return freeBSDLinker
+	}
 	switch eb.target.Arch() {
 	case ArchX86_64:
 		return "/lib64/ld-linux-x86-64.so.2"
@@ -742,6 +767,12 @@ func (eb *ExecutableBuilder) patchX86PLTCalls(textBytes []byte, ds *DynamicSecti
 				var targetAddr uint64
 				var isInternal bool
 
+				// Direct calls to a label (no $stub) stay internal even when
+				// a C function of the same name is in the PLT
+				if _, ok := eb.labels[funcName]; ok && funcName == patch.targetName {
+					pltOffset = -1
+				}
+
 				if pltOffset >= 0 {
 					// External function via PLT
 					targetAddr = pltBase + uint64(pltOffset)
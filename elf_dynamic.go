@@ -17,13 +17,7 @@ func (eb *ExecutableBuilder) WriteDynamicELF() error {
 	codeSize := eb.text.Len()
 
 	// Interpreter path (architecture-specific)
-	interp := "/lib64/ld-linux-x86-64.so.2"
-	switch eb.target.Arch() {
-	case ArchARM64:
-		interp = "/lib/ld-linux-aarch64.so.1"
-	case ArchRiscv64:
-		interp = "/lib/ld-linux-riscv64-lp64d.so.1"
-	}
+	interp := eb.getInterpreterPath()
 
 	interpLen := len(interp) + 1
 
@@ -48,7 +42,7 @@ func (eb *ExecutableBuilder) WriteDynamicELF() error {
 	w.Write(2)    // 64-bit
 	w.Write(1)    // little endian
 	w.Write(1)    // ELF version
-	w.Write(3)    // Linux
+	w.Write(elfOSABI(eb.target))
 	w.WriteN(0, 8)
 	w.Write2(3) // DYN (position independent) - changed from 2 (EXEC)
 
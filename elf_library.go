@@ -0,0 +1,409 @@
+// Completion: 70% - ELF relocatable objects and shared libraries (x86-64)
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+)
+
+// elf_library.go - ELF output of -buildmode=obj and -buildmode=shared
+//
+// A library is .text and .data (see buildmode.go). In the relocatable
+// object the references from .text to .data and to C functions become
+// R_X86_64_PC32 and R_X86_64_PLT32 relocations, and .init_array holds an
+// R_X86_64_64 relocation to the initializer. In the shared library they
+// are resolved: calls go through a PLT stub that jumps through a GOT slot,
+// which the dynamic loader fills at load time (DF_BIND_NOW), and the
+// .init_array entry gets an R_X86_64_RELATIVE relocation.
+//
+// The shared library has two PT_LOAD segments: the headers, the dynamic
+// symbols and .text, mapped read and execute, and then .data, .init_array,
+// .got and .dynamic, mapped read and write. Addresses equal file offsets.
+
+// libraryImage is the code and data of a library build and what a linker
+// or the dynamic loader still has to fill in
+type libraryImage struct {
+	text     []byte
+	data     []byte
+	init     int             // offset of the initializer in text
+	exports  []librarySymbol // exported functions, sorted by name
+	imports  []string        // functions called from elsewhere, sorted
+	dataRefs []libraryRef    // rip-relative references from text to data
+	calls    []libraryRef    // calls from text to imports
+	soname   string          // shared library only
+	needed   []string        // shared library only
+}
+
+// librarySymbol is an exported function in .text
+type librarySymbol struct {
+	name         string
+	offset, size int
+}
+
+// libraryRef is a rel32 field in .text that refers to data or an import
+type libraryRef struct {
+	offset int    // of the rel32 in text
+	target int    // offset in data, for dataRefs
+	symbol string // imported function, for calls
+}
+
+// librarySection is a section header with its content, for the writers below
+type librarySection struct {
+	name    string
+	header  elf.Section64
+	content []byte
+}
+
+// elfStrings builds a string table
+type elfStrings struct {
+	buf     bytes.Buffer
+	offsets map[string]uint32
+}
+
+func newELFStrings() *elfStrings {
+	st := &elfStrings{offsets: map[string]uint32{"": 0}}
+	st.buf.WriteByte(0)
+	return st
+}
+
+func (st *elfStrings) add(s string) uint32 {
+	if offset, ok := st.offsets[s]; ok {
+		return offset
+	}
+	offset := uint32(st.buf.Len())
+	st.buf.WriteString(s)
+	st.buf.WriteByte(0)
+	st.offsets[s] = offset
+	return offset
+}
+
+// elfBytes gives the little-endian encoding of an ELF structure
+func elfBytes(values ...any) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	return buf.Bytes()
+}
+
+// elfHash is the hash function of SHT_HASH tables
+func elfHash(name string) uint32 {
+	var h uint32
+	for i := 0; i < len(name); i++ {
+		h = h<<4 + uint32(name[i])
+		g := h & 0xF0000000
+		h ^= g >> 24
+		h &^= g
+	}
+	return h
+}
+
+func symInfo(bind elf.SymBind, typ elf.SymType) uint8 {
+	return uint8(bind)<<4 | uint8(typ)
+}
+
+func relaInfo(sym uint32, typ elf.R_X86_64) uint64 {
+	return uint64(sym)<<32 | uint64(typ)
+}
+
+// writeELFFile lays out the header, the sections in order after it and the
+// section headers, filling in sh_offset and sh_size. phdrs is written
+// after the ELF header; sections with an offset are placed at it.
+func writeELFFile(typ elf.Type, phdrs []byte, phnum int, sections []*librarySection) []byte {
+	var out bytes.Buffer
+	out.Write(make([]byte, 64))
+	out.Write(phdrs)
+	shstrtab := newELFStrings()
+	for _, sec := range sections {
+		sec.header.Name = shstrtab.add(sec.name)
+	}
+	shstrtabName := shstrtab.add(".shstrtab")
+
+	for _, sec := range sections[1:] {
+		if align := int(sec.header.Addralign); align > 1 {
+			for out.Len()%align != 0 {
+				out.WriteByte(0)
+			}
+		}
+		if sec.header.Off != 0 {
+			// A loaded section sits at its address
+			for uint64(out.Len()) < sec.header.Off {
+				out.WriteByte(0)
+			}
+		}
+		sec.header.Off = uint64(out.Len())
+		out.Write(sec.content)
+		if sec.header.Type != uint32(elf.SHT_NOBITS) {
+			sec.header.Size = uint64(len(sec.content))
+		}
+	}
+	shstrtabOff := uint64(out.Len())
+	out.Write(shstrtab.buf.Bytes())
+	for out.Len()%8 != 0 {
+		out.WriteByte(0)
+	}
+	shoff := uint64(out.Len())
+	for _, sec := range sections {
+		out.Write(elfBytes(sec.header))
+	}
+	out.Write(elfBytes(elf.Section64{
+		Name: shstrtabName, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint64(shstrtab.buf.Len()), Addralign: 1,
+	}))
+
+	header := elf.Header64{
+		Type:      uint16(typ),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     shoff,
+		Ehsize:    64,
+		Phentsize: 56,
+		Phnum:     uint16(phnum),
+		Shentsize: 64,
+		Shnum:     uint16(len(sections) + 1),
+		Shstrndx:  uint16(len(sections)),
+	}
+	if phnum > 0 {
+		header.Phoff = 64
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	header.Ident[elf.EI_OSABI] = byte(elf.ELFOSABI_NONE)
+	file := out.Bytes()
+	copy(file, elfBytes(header))
+	return file
+}
+
+// relocatableObject writes the image as an ET_REL object
+func (img *libraryImage) relocatableObject() []byte {
+	const (
+		secText = 1 + iota
+		secData
+		secInitArray
+		secRelaText
+		secRelaInitArray
+		secNoteStack
+		secSymtab
+		secStrtab
+	)
+
+	// Section symbols, the initializer, then the global symbols
+	strtab := newELFStrings()
+	symtab := elfBytes(elf.Sym64{})
+	for _, shndx := range []uint16{secText, secData, secInitArray} {
+		symtab = append(symtab, elfBytes(elf.Sym64{Info: symInfo(elf.STB_LOCAL, elf.STT_SECTION), Shndx: shndx})...)
+	}
+	symtab = append(symtab, elfBytes(elf.Sym64{
+		Name: strtab.add(libraryInitLabel), Info: symInfo(elf.STB_LOCAL, elf.STT_FUNC), Shndx: secText, Value: uint64(img.init),
+	})...)
+	firstGlobal := uint32(len(symtab) / 24)
+	for _, sym := range img.exports {
+		symtab = append(symtab, elfBytes(elf.Sym64{
+			Name: strtab.add(sym.name), Info: symInfo(elf.STB_GLOBAL, elf.STT_FUNC), Shndx: secText,
+			Value: uint64(sym.offset), Size: uint64(sym.size),
+		})...)
+	}
+	importIndex := make(map[string]uint32)
+	for _, name := range img.imports {
+		importIndex[name] = uint32(len(symtab) / 24)
+		symtab = append(symtab, elfBytes(elf.Sym64{Name: strtab.add(name), Info: symInfo(elf.STB_GLOBAL, elf.STT_NOTYPE)})...)
+	}
+
+	// The fields the relocations fill in start out as zero
+	text := append([]byte(nil), img.text...)
+	var relaText []byte
+	for _, ref := range img.dataRefs {
+		copy(text[ref.offset:], []byte{0, 0, 0, 0})
+		relaText = append(relaText, elfBytes(elf.Rela64{
+			Off: uint64(ref.offset), Info: relaInfo(2, elf.R_X86_64_PC32), Addend: int64(ref.target) - 4,
+		})...)
+	}
+	for _, ref := range img.calls {
+		copy(text[ref.offset:], []byte{0, 0, 0, 0})
+		relaText = append(relaText, elfBytes(elf.Rela64{
+			Off: uint64(ref.offset), Info: relaInfo(importIndex[ref.symbol], elf.R_X86_64_PLT32), Addend: -4,
+		})...)
+	}
+	relaInitArray := elfBytes(elf.Rela64{Info: relaInfo(1, elf.R_X86_64_64), Addend: int64(img.init)})
+
+	rela := func(name string, content []byte, target uint32) *librarySection {
+		return &librarySection{name: name, content: content, header: elf.Section64{
+			Type: uint32(elf.SHT_RELA), Flags: uint64(elf.SHF_INFO_LINK), Link: secSymtab, Info: target, Addralign: 8, Entsize: 24,
+		}}
+	}
+	sections := []*librarySection{
+		{},
+		{name: ".text", content: text, header: elf.Section64{
+			Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Addralign: 16,
+		}},
+		{name: ".data", content: img.data, header: elf.Section64{
+			Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE), Addralign: 16,
+		}},
+		{name: ".init_array", content: make([]byte, 8), header: elf.Section64{
+			Type: uint32(elf.SHT_INIT_ARRAY), Flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE), Addralign: 8, Entsize: 8,
+		}},
+		rela(".rela.text", relaText, secText),
+		rela(".rela.init_array", relaInitArray, secInitArray),
+		// The stack need not be executable
+		{name: ".note.GNU-stack", header: elf.Section64{Type: uint32(elf.SHT_PROGBITS), Addralign: 1}},
+		{name: ".symtab", content: symtab, header: elf.Section64{
+			Type: uint32(elf.SHT_SYMTAB), Link: secStrtab, Info: firstGlobal, Addralign: 8, Entsize: 24,
+		}},
+		{name: ".strtab", content: strtab.buf.Bytes(), header: elf.Section64{Type: uint32(elf.SHT_STRTAB), Addralign: 1}},
+	}
+	return writeELFFile(elf.ET_REL, nil, 0, sections)
+}
+
+// sharedObject writes the image as an ET_DYN shared library
+func (img *libraryImage) sharedObject() []byte {
+	const (
+		secHash = 1 + iota
+		secDynsym
+		secDynstr
+		secRelaDyn
+		secText
+		secData
+		secInitArray
+		secGot
+		secDynamic
+		phnum      = 4 // two PT_LOAD, PT_DYNAMIC and PT_GNU_STACK
+		pltStub    = 8 // jmp *got(%rip), padded with int3
+		headerSize = 64 + 56*phnum
+	)
+	align := func(offset, to uint64) uint64 { return (offset + to - 1) &^ (to - 1) }
+
+	// Dynamic symbols: the imports, then the exports
+	dynstr := newELFStrings()
+	for _, lib := range img.needed {
+		dynstr.add(lib)
+	}
+	soname := dynstr.add(img.soname)
+	type dynSymbol struct {
+		name string
+		sym  elf.Sym64
+	}
+	syms := []dynSymbol{{}}
+	for _, name := range img.imports {
+		syms = append(syms, dynSymbol{name, elf.Sym64{Name: dynstr.add(name), Info: symInfo(elf.STB_GLOBAL, elf.STT_FUNC)}})
+	}
+	firstExport := len(syms)
+	for _, sym := range img.exports {
+		syms = append(syms, dynSymbol{sym.name, elf.Sym64{
+			Name: dynstr.add(sym.name), Info: symInfo(elf.STB_GLOBAL, elf.STT_FUNC), Shndx: secText, Size: uint64(sym.size),
+		}})
+	}
+
+	// SHT_HASH with one bucket per symbol
+	nbucket := uint32(len(syms))
+	buckets := make([]uint32, nbucket)
+	chains := make([]uint32, len(syms))
+	for i := len(syms) - 1; i > 0; i-- {
+		b := elfHash(syms[i].name) % nbucket
+		chains[i] = buckets[b]
+		buckets[b] = uint32(i)
+	}
+	hash := elfBytes(nbucket, uint32(len(syms)), buckets, chains)
+
+	// Layout of the read-execute segment
+	hashAddr := align(headerSize, 8)
+	dynsymAddr := align(hashAddr+uint64(len(hash)), 8)
+	dynstrAddr := dynsymAddr + uint64(24*len(syms))
+	relaAddr := align(dynstrAddr+uint64(dynstr.buf.Len()), 8)
+	relaSize := uint64(24 * (1 + len(img.imports)))
+	textAddr := align(relaAddr+relaSize, 16)
+	pltAddr := align(textAddr+uint64(len(img.text)), 8)
+	textEnd := pltAddr + uint64(pltStub*len(img.imports))
+
+	// and of the read-write segment, on the next page at the same offset
+	dataAddr := align(textEnd, pageSize)
+	initArrayAddr := align(dataAddr+uint64(len(img.data)), 8)
+	gotAddr := initArrayAddr + 8
+	dynamicAddr := align(gotAddr+uint64(8*len(img.imports)), 16)
+
+	for i := firstExport; i < len(syms); i++ {
+		syms[i].sym.Value = textAddr + uint64(img.exports[i-firstExport].offset)
+	}
+	var dynsym []byte
+	for _, s := range syms {
+		dynsym = append(dynsym, elfBytes(s.sym)...)
+	}
+
+	// .text with the references resolved, then the PLT stubs
+	text := append([]byte(nil), img.text...)
+	for textAddr+uint64(len(text)) < pltAddr {
+		text = append(text, 0xCC)
+	}
+	putRel32 := func(b []byte, pos int, from, to uint64) {
+		binary.LittleEndian.PutUint32(b[pos:], uint32(int32(int64(to)-int64(from))))
+	}
+	for _, ref := range img.dataRefs {
+		putRel32(text, ref.offset, textAddr+uint64(ref.offset)+4, dataAddr+uint64(ref.target))
+	}
+	pltIndex := make(map[string]int)
+	for i, name := range img.imports {
+		pltIndex[name] = i
+		stub := len(text)
+		text = append(text, 0xFF, 0x25, 0, 0, 0, 0, 0xCC, 0xCC)
+		putRel32(text, stub+2, textAddr+uint64(stub)+6, gotAddr+uint64(8*i))
+	}
+	for _, ref := range img.calls {
+		putRel32(text, ref.offset, textAddr+uint64(ref.offset)+4, pltAddr+uint64(pltStub*pltIndex[ref.symbol]))
+	}
+
+	rela := elfBytes(elf.Rela64{Off: initArrayAddr, Info: relaInfo(0, elf.R_X86_64_RELATIVE), Addend: int64(textAddr) + int64(img.init)})
+	for i := range img.imports {
+		rela = append(rela, elfBytes(elf.Rela64{Off: gotAddr + uint64(8*i), Info: relaInfo(uint32(1+i), elf.R_X86_64_GLOB_DAT)})...)
+	}
+
+	var dynamic []byte
+	dyn := func(tag elf.DynTag, val uint64) {
+		dynamic = append(dynamic, elfBytes(elf.Dyn64{Tag: int64(tag), Val: val})...)
+	}
+	for _, lib := range img.needed {
+		dyn(elf.DT_NEEDED, uint64(dynstr.add(lib)))
+	}
+	dyn(elf.DT_SONAME, uint64(soname))
+	dyn(elf.DT_HASH, hashAddr)
+	dyn(elf.DT_STRTAB, dynstrAddr)
+	dyn(elf.DT_SYMTAB, dynsymAddr)
+	dyn(elf.DT_STRSZ, uint64(dynstr.buf.Len()))
+	dyn(elf.DT_SYMENT, 24)
+	dyn(elf.DT_RELA, relaAddr)
+	dyn(elf.DT_RELASZ, relaSize)
+	dyn(elf.DT_RELAENT, 24)
+	dyn(elf.DT_INIT_ARRAY, initArrayAddr)
+	dyn(elf.DT_INIT_ARRAYSZ, 8)
+	dyn(elf.DT_FLAGS, uint64(elf.DF_BIND_NOW))
+	dyn(elf.DT_NULL, 0)
+
+	fileEnd := dynamicAddr + uint64(len(dynamic))
+	phdrs := elfBytes(
+		elf.Prog64{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_X), Filesz: textEnd, Memsz: textEnd, Align: pageSize},
+		elf.Prog64{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_W), Off: dataAddr, Vaddr: dataAddr, Paddr: dataAddr,
+			Filesz: fileEnd - dataAddr, Memsz: fileEnd - dataAddr, Align: pageSize},
+		elf.Prog64{Type: uint32(elf.PT_DYNAMIC), Flags: uint32(elf.PF_R | elf.PF_W), Off: dynamicAddr, Vaddr: dynamicAddr, Paddr: dynamicAddr,
+			Filesz: uint64(len(dynamic)), Memsz: uint64(len(dynamic)), Align: 8},
+		elf.Prog64{Type: uint32(elf.PT_GNU_STACK), Flags: uint32(elf.PF_R | elf.PF_W), Align: 16},
+	)
+
+	loaded := func(name string, typ elf.SectionType, flags elf.SectionFlag, addr uint64, content []byte, link, info uint32, alignment, entsize uint64) *librarySection {
+		return &librarySection{name: name, content: content, header: elf.Section64{
+			Type: uint32(typ), Flags: uint64(flags), Addr: addr, Off: addr, Link: link, Info: info, Addralign: alignment, Entsize: entsize,
+		}}
+	}
+	sections := []*librarySection{
+		{},
+		loaded(".hash", elf.SHT_HASH, elf.SHF_ALLOC, hashAddr, hash, secDynsym, 0, 8, 4),
+		loaded(".dynsym", elf.SHT_DYNSYM, elf.SHF_ALLOC, dynsymAddr, dynsym, secDynstr, 1, 8, 24),
+		loaded(".dynstr", elf.SHT_STRTAB, elf.SHF_ALLOC, dynstrAddr, dynstr.buf.Bytes(), 0, 0, 1, 0),
+		loaded(".rela.dyn", elf.SHT_RELA, elf.SHF_ALLOC, relaAddr, rela, secDynsym, 0, 8, 24),
+		loaded(".text", elf.SHT_PROGBITS, elf.SHF_ALLOC|elf.SHF_EXECINSTR, textAddr, text, 0, 0, 16, 0),
+		loaded(".data", elf.SHT_PROGBITS, elf.SHF_ALLOC|elf.SHF_WRITE, dataAddr, img.data, 0, 0, 16, 0),
+		loaded(".init_array", elf.SHT_INIT_ARRAY, elf.SHF_ALLOC|elf.SHF_WRITE, initArrayAddr, make([]byte, 8), 0, 0, 8, 8),
+		loaded(".got", elf.SHT_PROGBITS, elf.SHF_ALLOC|elf.SHF_WRITE, gotAddr, make([]byte, 8*len(img.imports)), 0, 0, 8, 8),
+		loaded(".dynamic", elf.SHT_DYNAMIC, elf.SHF_ALLOC|elf.SHF_WRITE, dynamicAddr, dynamic, secDynstr, 0, 16, 16),
+	}
+	return writeELFFile(elf.ET_DYN, phdrs, phnum, sections)
+}
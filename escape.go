@@ -0,0 +1,510 @@
+// Completion: 80% - Escape analysis for list, map and closure allocations (stack slots on x86-64)
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Escape analysis
+//
+// List literals with runtime elements, map literals with runtime keys or
+// values and closures that capture variables are allocated in the arena.
+// When a value provably never outlives the function that creates it, it gets
+// a fixed slot at the bottom of that function's stack frame instead.
+//
+// A value escapes when it is:
+//   - the function's result, or the value of a ret
+//   - stored in a list, map or closure, or assigned to a variable that is
+//     not local to the function
+//   - passed to a function that keeps the parameter, to a closure or C
+//     function, or to a builtin other than the print functions
+//   - used by an expression the analysis does not model
+//
+// Values bound to local variables are followed through them. Since a site
+// reuses its slot every time it runs, a value created in a loop may only be
+// bound to variables declared in that loop: any variable that lives longer
+// could still hold last iteration's value when the slot is overwritten.
+// Parameters live longer than the whole body, so values passed to the
+// function itself are never promoted either.
+
+// escapeReadBuiltins only read their arguments
+var escapeReadBuiltins = map[string]bool{
+	"print": true, "println": true, "printf": true,
+	"eprint": true, "eprintln": true, "eprintf": true,
+}
+
+// escapeReadOperators compute a new value from their operands. + is missing
+// because it also concatenates lists.
+var escapeReadOperators = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"-": true, "*": true, "/": true, "%": true, "**": true,
+}
+
+// EscapeAnalysis knows, for every top-level function, which parameters the
+// function may keep beyond the call
+type EscapeAnalysis struct {
+	paramEscapes map[string][]bool
+}
+
+// StackSlot is an allocation that stays in its function's stack frame
+type StackSlot struct {
+	Site   Expression
+	Offset int // from the bottom of the slot area
+	Size   int
+}
+
+// escapeNode is a local variable or an allocation site. Values flow from a
+// node into the variables listed in into.
+type escapeNode struct {
+	into    []string
+	escapes bool
+	loops   []int      // loops the variable is declared in, or the site's loop
+	site    Expression // nil for variables
+	size    int
+}
+
+// escapeFunc is the analysis of one function body
+type escapeFunc struct {
+	ea      *EscapeAnalysis
+	name    string
+	params  []string
+	nodes   map[string]*escapeNode
+	sites   []string // in source order
+	siteIDs map[Expression]string
+	loop    int
+	parents []int // parents[loop] is the loop around it, -1 for the body
+}
+
+// paramLoop is where parameters are declared: outside of the body, so that
+// values that reach a parameter are never promoted
+const paramLoop = -1
+
+// newEscapeAnalysis finds out which parameters the program's top-level
+// functions keep. Functions that can be replaced at runtime keep everything.
+func newEscapeAnalysis(program *Program) *EscapeAnalysis {
+	ea := &EscapeAnalysis{paramEscapes: make(map[string][]bool)}
+	defined := make(map[string]int)
+	funcs := make(map[string]*LambdaExpr)
+	for _, stmt := range program.Statements {
+		assign, ok := stmt.(*AssignStmt)
+		if !ok {
+			continue
+		}
+		defined[assign.Name]++
+		lambda, ok := assign.Value.(*LambdaExpr)
+		if ok && !assign.Mutable && !assign.IsHot && lambda.VariadicParam == "" && len(lambda.CapturedVars) == 0 {
+			funcs[assign.Name] = lambda
+		}
+	}
+	var names []string
+	for name, lambda := range funcs {
+		if defined[name] == 1 {
+			names = append(names, name)
+			ea.paramEscapes[name] = make([]bool, len(lambda.Params))
+		}
+	}
+	sort.Strings(names)
+
+	// Start from "nothing escapes" and add escaping parameters until no
+	// function changes, so that recursive functions are summarized too
+	for changed := true; changed; {
+		changed = false
+		for _, name := range names {
+			lambda := funcs[name]
+			f := ea.analyze(name, lambda.Params, lambda.Body)
+			for i, param := range lambda.Params {
+				if !ea.paramEscapes[name][i] && f.escapes(param) {
+					ea.paramEscapes[name][i] = true
+					changed = true
+				}
+			}
+		}
+	}
+	return ea
+}
+
+// StackSlots returns the allocations of a function that can live in its stack
+// frame, and the size of the area they need
+func (ea *EscapeAnalysis) StackSlots(name string, params []string, body Expression) ([]StackSlot, int) {
+	if ea == nil {
+		return nil, 0
+	}
+	f := ea.analyze(name, params, body)
+	var slots []StackSlot
+	size := 0
+	for _, id := range f.sites {
+		node := f.nodes[id]
+		if !f.promotable(node) {
+			continue
+		}
+		slots = append(slots, StackSlot{Site: node.site, Offset: size, Size: node.size})
+		size += (node.size + 7) &^ 7
+	}
+	return slots, (size + 15) &^ 15
+}
+
+func (ea *EscapeAnalysis) analyze(name string, params []string, body Expression) *escapeFunc {
+	f := &escapeFunc{
+		ea:      ea,
+		name:    name,
+		params:  params,
+		nodes:   make(map[string]*escapeNode),
+		siteIDs: make(map[Expression]string),
+		parents: []int{paramLoop},
+	}
+	f.loop = paramLoop
+	for _, param := range params {
+		f.declare(param)
+	}
+	f.loop = 0
+	f.escape(f.value(body))
+	return f
+}
+
+// describeAllocation names an allocation site for -v output
+func describeAllocation(site Expression) string {
+	switch e := site.(type) {
+	case *ListExpr:
+		return "list " + e.String()
+	case *MapExpr:
+		return "map " + e.String()
+	case *LambdaExpr:
+		return "closure capturing " + strings.Join(e.CapturedVars, ", ")
+	}
+	return site.String()
+}
+
+// ===== Building the flow graph =====
+
+func (f *escapeFunc) declare(name string) {
+	node, ok := f.nodes[name]
+	if !ok {
+		node = &escapeNode{}
+		f.nodes[name] = node
+	}
+	node.loops = append(node.loops, f.loop)
+}
+
+// ref returns the node of a variable, if it is local
+func (f *escapeFunc) ref(name string) []string {
+	if _, ok := f.nodes[name]; ok {
+		return []string{name}
+	}
+	return nil
+}
+
+func (f *escapeFunc) flow(from []string, into string) {
+	for _, id := range from {
+		f.nodes[id].into = append(f.nodes[id].into, into)
+	}
+}
+
+func (f *escapeFunc) escape(ids []string) {
+	for _, id := range ids {
+		f.nodes[id].escapes = true
+	}
+}
+
+// site registers an allocation. A site that is reached twice (the inliner
+// may share an argument between the uses of a parameter) runs twice per
+// iteration, so its slot could be overwritten while still in use.
+func (f *escapeFunc) site(e Expression, size int) []string {
+	if id, ok := f.siteIDs[e]; ok {
+		f.nodes[id].escapes = true
+		return []string{id}
+	}
+	id := fmt.Sprintf("\x00site%d", len(f.sites))
+	f.siteIDs[e] = id
+	f.sites = append(f.sites, id)
+	f.nodes[id] = &escapeNode{loops: []int{f.loop}, site: e, size: size}
+	return []string{id}
+}
+
+func (f *escapeFunc) inLoop(body func()) {
+	outer := f.loop
+	f.loop = len(f.parents)
+	f.parents = append(f.parents, outer)
+	body()
+	f.loop = outer
+}
+
+// value analyzes an expression and returns the nodes its value may be
+func (f *escapeFunc) value(expr Expression) []string {
+	switch e := expr.(type) {
+	case nil:
+		return nil
+	case *NumberExpr, *StringExpr, *BooleanExpr, *RandomExpr, *RangeExpr, *LoopStateExpr:
+		return nil
+	case *IdentExpr:
+		return f.ref(e.Name)
+	case *ListExpr:
+		for _, elem := range e.Elements {
+			f.escape(f.value(elem))
+		}
+		if isStaticList(e) {
+			return nil
+		}
+		return f.site(e, 8+16*len(e.Elements))
+	case *MapExpr:
+		for i := range e.Keys {
+			f.escape(f.value(e.Keys[i]))
+			f.escape(f.value(e.Values[i]))
+		}
+		if isStaticMap(e) {
+			return nil
+		}
+		return f.site(e, 8+16*len(e.Keys))
+	case *LambdaExpr:
+		// The body is analyzed as a function of its own
+		if !e.IsNestedLambda || len(e.CapturedVars) == 0 {
+			return nil
+		}
+		for _, name := range e.CapturedVars {
+			f.escape(f.ref(name))
+		}
+		return f.site(e, 16+8*len(e.CapturedVars))
+	case *BlockExpr:
+		return f.block(e.Statements)
+	case *MatchExpr:
+		result := f.value(e.Condition)
+		for _, clause := range e.Clauses {
+			// Value matches compare the shared condition in every guard
+			if guard, ok := clause.Guard.(*BinaryExpr); ok && guard.Left == e.Condition {
+				f.value(guard.Right)
+			} else {
+				f.value(clause.Guard)
+			}
+			result = append(result, f.value(clause.Result)...)
+		}
+		return append(result, f.value(e.DefaultExpr)...)
+	case *IndexExpr:
+		f.value(e.List)
+		f.value(e.Index)
+	case *LengthExpr:
+		f.value(e.Operand)
+	case *InExpr:
+		f.value(e.Value)
+		f.value(e.Container)
+	case *UnaryExpr:
+		f.value(e.Operand)
+	case *PostfixExpr:
+		f.value(e.Operand)
+	case *FMAExpr:
+		f.value(e.A)
+		f.value(e.B)
+		f.value(e.C)
+	case *BinaryExpr:
+		left, right := f.value(e.Left), f.value(e.Right)
+		if !escapeReadOperators[e.Operator] {
+			f.escape(left)
+			f.escape(right)
+		}
+	case *MoveExpr:
+		return f.value(e.Expr)
+	case *JumpExpr:
+		f.escape(f.value(e.Value))
+	case *CallExpr:
+		f.call(e)
+	default:
+		f.escapeAll(e)
+	}
+	return nil
+}
+
+func (f *escapeFunc) call(e *CallExpr) {
+	params := f.ea.paramEscapes[e.Function]
+	switch {
+	case e.Function == f.name || e.Function == "me":
+		for i, arg := range e.Args {
+			if i < len(f.params) {
+				f.flow(f.value(arg), f.params[i])
+			} else {
+				f.escape(f.value(arg))
+			}
+		}
+	case f.nodes[e.Function] == nil && !e.IsCFFI && escapeReadBuiltins[e.Function]:
+		for _, arg := range e.Args {
+			f.value(arg)
+		}
+	case f.nodes[e.Function] == nil && !e.IsCFFI && params != nil && len(params) == len(e.Args):
+		for i, arg := range e.Args {
+			if refs := f.value(arg); params[i] {
+				f.escape(refs)
+			}
+		}
+	default:
+		for _, arg := range e.Args {
+			f.escape(f.value(arg))
+		}
+	}
+}
+
+// block analyzes statements and returns the nodes of the block's value
+func (f *escapeFunc) block(stmts []Statement) []string {
+	for i, stmt := range stmts {
+		if last, ok := stmt.(*ExpressionStmt); ok && i == len(stmts)-1 {
+			return f.value(last.Expr)
+		}
+		f.statement(stmt)
+	}
+	return nil
+}
+
+func (f *escapeFunc) statement(stmt Statement) {
+	switch s := stmt.(type) {
+	case *ExpressionStmt:
+		f.value(s.Expr)
+	case *AssignStmt:
+		refs := f.value(s.Value)
+		if !s.IsUpdate && !s.IsReuseMutable {
+			f.declare(s.Name)
+		}
+		if _, ok := f.nodes[s.Name]; ok {
+			f.flow(refs, s.Name)
+		} else {
+			f.escape(refs)
+		}
+	case *MapUpdateStmt:
+		f.value(s.Index)
+		f.escape(f.value(s.Value))
+	case *JumpStmt:
+		f.escape(f.value(s.Value))
+	case *LoopStmt:
+		// Parallel loops run their body on other threads' stacks
+		if s.NumThreads != 0 || s.Reducer != nil {
+			f.escapeAll(s)
+			return
+		}
+		f.value(s.Iterable)
+		f.inLoop(func() {
+			f.declare(s.Iterator)
+			f.block(s.Body)
+		})
+	case *WhileStmt:
+		if s.NumThreads != 0 {
+			f.escapeAll(s)
+			return
+		}
+		f.inLoop(func() {
+			f.value(s.Condition)
+			f.block(s.Body)
+		})
+	default:
+		f.escapeAll(s)
+	}
+}
+
+// escapeAll makes everything in a node escape, for code the analysis does not
+// model
+func (f *escapeFunc) escapeAll(node Node) {
+	walkProfileSites(reflect.ValueOf(node), "", func(n interface{}, _ string) string {
+		switch n := n.(type) {
+		case *ListExpr, *MapExpr, *LambdaExpr:
+			f.escape(f.site(n.(Expression), 0))
+		case *IdentExpr:
+			f.escape(f.ref(n.Name))
+		case *AssignStmt:
+			f.escape(f.ref(n.Name))
+		case *MapUpdateStmt:
+			f.escape(f.ref(n.MapName))
+		case *CallExpr:
+			f.escape(f.ref(n.Function))
+		}
+		return ""
+	})
+}
+
+// ===== Results =====
+
+// reach returns the nodes a node's value can flow into, itself included
+func (f *escapeFunc) reach(id string) []*escapeNode {
+	seen := map[string]bool{id: true}
+	work := []string{id}
+	var nodes []*escapeNode
+	for len(work) > 0 {
+		node := f.nodes[work[len(work)-1]]
+		work = work[:len(work)-1]
+		nodes = append(nodes, node)
+		for _, next := range node.into {
+			if !seen[next] {
+				seen[next] = true
+				work = append(work, next)
+			}
+		}
+	}
+	return nodes
+}
+
+func (f *escapeFunc) escapes(id string) bool {
+	for _, node := range f.reach(id) {
+		if node.escapes {
+			return true
+		}
+	}
+	return false
+}
+
+// promotable reports whether a site's value neither escapes nor outlives the
+// loop iteration that created it
+func (f *escapeFunc) promotable(site *escapeNode) bool {
+	loop := site.loops[0]
+	for _, node := range f.reach(f.siteIDs[site.site]) {
+		if node.escapes {
+			return false
+		}
+		for _, declared := range node.loops {
+			if !f.within(declared, loop) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// within reports whether loop is outer or nested inside it
+func (f *escapeFunc) within(loop, outer int) bool {
+	for ; loop != paramLoop; loop = f.parents[loop] {
+		if loop == outer {
+			return true
+		}
+	}
+	return false
+}
+
+// isStaticList reports whether a list literal is emitted as constant data
+func isStaticList(e *ListExpr) bool {
+	for _, elem := range e.Elements {
+		if _, ok := elem.(*NumberExpr); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isStaticMap reports whether a map literal is emitted as constant data
+func isStaticMap(e *MapExpr) bool {
+	for i := range e.Keys {
+		_, key := e.Keys[i].(*NumberExpr)
+		_, value := e.Values[i].(*NumberExpr)
+		if !key || !value {
+			return false
+		}
+	}
+	return true
+}
+
+// ===== Code generation =====
+
+// emitAllocation leaves the address of size bytes for an allocation site in
+// rax: its stack slot when escape analysis gave it one, arena memory otherwise
+func (fc *C67Compiler) emitAllocation(site Expression, size int) {
+	if distance, ok := fc.stackSlots[site]; ok {
+		fc.out.LeaMemToReg("rax", "rbp", -distance)
+		return
+	}
+	fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", size))
+	fc.callArenaAlloc()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// stackAllocations returns the allocations of a function that escape
+// analysis keeps on the stack
+func stackAllocations(t *testing.T, code, function string) []string {
+	t.Helper()
+	program := NewParser(code).ParseProgram()
+	globalVars := make(map[string]int)
+	for _, stmt := range program.Statements {
+		if assign, ok := stmt.(*AssignStmt); ok {
+			globalVars[assign.Name] = 0
+		}
+	}
+	for _, stmt := range program.Statements {
+		analyzeClosures(stmt, make(map[string]bool), globalVars)
+	}
+	ea := newEscapeAnalysis(program)
+	for _, stmt := range program.Statements {
+		assign, ok := stmt.(*AssignStmt)
+		if !ok || assign.Name != function {
+			continue
+		}
+		lambda := assign.Value.(*LambdaExpr)
+		slots, size := ea.StackSlots(assign.Name, lambda.Params, lambda.Body)
+		var sites []string
+		total := 0
+		for _, slot := range slots {
+			sites = append(sites, describeAllocation(slot.Site))
+			total += slot.Size
+		}
+		if size < total || size%16 != 0 {
+			t.Errorf("slot area of %d bytes for %d bytes of slots", size, total)
+		}
+		return sites
+	}
+	t.Fatalf("no function %s in %q", function, code)
+	return nil
+}
+
+func TestEscapeAnalysis(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want []string
+	}{
+		{"read only", `f = (x, y) -> {
+    v := [x, y]
+    v[0] * v[1] + #v
+}`, []string{"list [x, y]"}},
+		{"returned", `f = (x, y) -> {
+    v := [x, y]
+    v
+}`, nil},
+		{"returned through alias", `f = (x, y) -> {
+    v := [x, y]
+    w := v
+    ret w
+}`, nil},
+		{"stored in list", `f = (x, y) -> {
+    v := [x, y]
+    w := [v, 1]
+    w[1]
+}`, []string{"list [v, 1]"}},
+		{"stored in global", `g := 0
+f = (x, y) -> {
+    v := [x, y]
+    g <- v
+    0
+}`, nil},
+		{"temporary in loop", `f = (n) -> {
+    s := 0
+    @ i in 0..<n max 1000 {
+        p := [i, i * 2]
+        s <- s + p[1]
+    }
+    s
+}`, []string{"list [i, (i * 2)]"}},
+		{"kept across iterations", `f = (n) -> {
+    prev := [0, 0]
+    @ i in 0..<n max 1000 {
+        cur := [i, n]
+        prev <- cur
+    }
+    prev[0]
+}`, nil},
+		{"parallel loop", `f = (n) -> {
+    @@ i in 0..<n max 1000 {
+        p := [i, n]
+        println(p[0])
+    }
+    0
+}`, nil},
+		{"map and closure", `f = (x) -> {
+    m := {1: x, 2: 3}
+    add := (a) -> a + x
+    add(m[1])
+}`, []string{"map {1: x, 2: 3}", "closure capturing x"}},
+		{"closure returned", `f = (x) -> {
+    add := (a) -> a + x
+    add
+}`, nil},
+		{"passed to reading function", `sum = (v) -> {
+    s := 0
+    @ i in 0..<#v max 100 {
+        s <- s + v[i]
+    }
+    s
+}
+f = (x, y) -> {
+    v := [x, y]
+    sum(v)
+}`, []string{"list [x, y]"}},
+		{"passed to keeping function", `keep = (v) -> {
+    s := 0
+    @ i in 0..<#v max 100 {
+        s <- s + v[i]
+    }
+    v
+}
+f = (x, y) -> {
+    v := [x, y]
+    keep(v)[0]
+}`, nil},
+		{"passed to itself", `f = (v, n) -> {
+    s := 0
+    @ i in 0..<n max 1000 {
+        s <- s + f([n, v[0]], n - 1)
+    }
+    s
+}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stackAllocations(t, tt.code, "f"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stack allocations = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStackAllocatedValues(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("stack slots are only used by the x86-64 backend")
+	}
+	code := `norm2 = (x, y) -> {
+    v := [x, y]
+    v[0] * v[0] + v[1] * v[1]
+}
+main = {
+    total := 0
+    @ i in 0..<1000 {
+        p := [i, i * 2]
+        total <- total + p[0] + p[1] + #p
+    }
+    println(total)
+    println(norm2(3, 4))
+    k := 5
+    m := {1: k, 2: k * 2}
+    println(m[2])
+}
+`
+	if got := compileAndRun(t, code); got != "1500500\n25\n10\n" {
+		t.Errorf("got %q", got)
+	}
+}
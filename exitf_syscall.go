@@ -69,8 +69,8 @@ func (fc *C67Compiler) emitStderrLiteral(str string) {
 	fc.stringCounter++
 	fc.eb.Define(labelName, str)
 
-	fc.out.MovImmToReg("rax", "1") // sys_write
-	fc.out.MovImmToReg("rdi", "2") // stderr
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+	fc.out.MovImmToReg("rdi", "2")                        // stderr
 	fc.out.LeaSymbolToReg("rsi", labelName)
 	fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", len(str)))
 	fc.out.Syscall()
@@ -81,7 +81,7 @@ func (fc *C67Compiler) emitStderrChar(ch rune) {
 	fc.out.SubImmFromReg("rsp", 8)
 	fc.out.MovImmToReg("rax", fmt.Sprintf("%d", ch))
 	fc.out.MovRegToMem("rax", "rsp", 0)
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.MovImmToReg("rdi", "2") // stderr
 	fc.out.MovRegToReg("rsi", "rsp")
 	fc.out.MovImmToReg("rdx", "1")
@@ -112,7 +112,7 @@ func (fc *C67Compiler) emitStderrCString() {
 	// Write using syscall
 	fc.out.MovRegToReg("rsi", "rbx")
 	fc.out.MovImmToReg("rdi", "2") // stderr
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.Syscall()
 
 	fc.out.PopReg("rbx")
@@ -135,7 +135,7 @@ func (fc *C67Compiler) emitStderrInteger() {
 	fc.out.SubImmFromReg("rsp", 8)
 	fc.out.MovImmToReg("rax", "45") // '-'
 	fc.out.MovRegToMem("rax", "rsp", 0)
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.MovImmToReg("rdi", "2") // stderr
 	fc.out.MovRegToReg("rsi", "rsp")
 	fc.out.MovImmToReg("rdx", "1")
@@ -170,7 +170,7 @@ func (fc *C67Compiler) emitStderrInteger() {
 	fc.out.SubRegFromReg("rdx", "rbx")
 
 	// Write
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.MovImmToReg("rdi", "2") // stderr
 	fc.out.MovRegToReg("rsi", "rbx")
 	fc.out.Syscall()
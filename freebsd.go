@@ -0,0 +1,92 @@
+// Completion: 75% - FreeBSD amd64 and arm64 executables
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// freebsd.go - What FreeBSD executables need beyond the Linux ones
+//
+// FreeBSD runs the same ELF executables as Linux does, with four differences:
+//
+//   - The kernel picks the ABI from the brand: EI_OSABI is ELFOSABI_FREEBSD,
+//     and the ABI note (.note.tag in the executables of the system
+//     toolchain) gives the FreeBSD version the program was built for. An
+//     executable without them is run as a Linux program, if at all.
+//   - The dynamic linker is /libexec/ld-elf.so.1 on every architecture, and
+//     the C library is libc.so.7.
+//   - The system calls have other numbers, the same on every architecture
+//     (see getSyscallNumbers), and some flags and structures differ.
+//   - A failed system call sets the carry flag and returns the positive
+//     errno, where Linux returns -errno. Out.Syscall turns the former into
+//     the latter, so that the code generator checks for errors the same way
+//     on both.
+//
+// The runtime is otherwise shared with Linux: printing, memory and threads
+// go through the C library like on the other platforms that are not Linux.
+
+const (
+	elfOSABILinux   = 3 // ELFOSABI_GNU
+	elfOSABIFreeBSD = 9
+
+	ntFreeBSDABITag = 1 // NT_FREEBSD_ABI_TAG
+	freeBSDOSRel    = 1400000
+	freeBSDLinker   = "/libexec/ld-elf.so.1"
+)
+
+// elfOSABI returns the EI_OSABI byte of executables for the target
+func elfOSABI(target Target) byte {
+	if target.OS() == OSFreeBSD {
+		return elfOSABIFreeBSD
+	}
+	return elfOSABILinux
+}
+
+// elfABINote returns the contents of the PT_NOTE segment of executables for
+// the target, or nil if they have none
+func elfABINote(target Target) []byte {
+	if target.OS() != OSFreeBSD {
+		return nil
+	}
+	// namesz, descsz and type, then the name and the descriptor, each
+	// padded to 4 bytes: "FreeBSD\0" is 8 and the version is 4
+	note := make([]byte, 0, 24)
+	note = binary.LittleEndian.AppendUint32(note, 8)
+	note = binary.LittleEndian.AppendUint32(note, 4)
+	note = binary.LittleEndian.AppendUint32(note, ntFreeBSDABITag)
+	note = append(note, "FreeBSD\x00"...)
+	return binary.LittleEndian.AppendUint32(note, freeBSDOSRel)
+}
+
+// systemLibrary returns the soname of a library of the C runtime on the
+// target, given its glibc soname
+func systemLibrary(target Target, soname string) string {
+	if target.OS() != OSFreeBSD {
+		return soname
+	}
+	switch soname {
+	case "libc.so.6":
+		return "libc.so.7"
+	case "libm.so.6":
+		return "libm.so.5"
+	case "libpthread.so.0":
+		return "libthr.so.3"
+	}
+	return soname
+}
+
+// sysNum returns the number of a system call on the target, or the value of
+// a flag that differs between kernels (see getSyscallNumbers)
+func sysNum(target Target, name string) uint64 {
+	value, ok := getSyscallNumbers(target)[name]
+	if !ok {
+		compilerError("%s is not available on %s-%s", name, target.Arch().String(), target.OS().String())
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		panic(fmt.Sprintf("bad system call number %s = %q", name, value))
+	}
+	return n
+}
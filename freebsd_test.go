@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// freeBSDNote returns the FreeBSD ABI note of f, read from its PT_NOTE
+// segment, or nil
+func freeBSDNote(t *testing.T, f *elf.File) []byte {
+	t.Helper()
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_NOTE {
+			continue
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if prog.Off+prog.Filesz > pageSize {
+			t.Errorf("note at 0x%x is not in the first page", prog.Off)
+		}
+		if len(data) < 12 {
+			t.Fatalf("note of %d bytes", len(data))
+		}
+		namesz := binary.LittleEndian.Uint32(data)
+		descsz := binary.LittleEndian.Uint32(data[4:])
+		noteType := binary.LittleEndian.Uint32(data[8:])
+		if int(12+align4(int(namesz))+int(descsz)) > len(data) {
+			t.Fatalf("note sizes %d and %d beyond the segment", namesz, descsz)
+		}
+		name := data[12 : 12+namesz]
+		if string(name) == "FreeBSD\x00" && noteType == ntFreeBSDABITag {
+			return data[12+align4(int(namesz)) : 12+align4(int(namesz))+int(descsz)]
+		}
+	}
+	return nil
+}
+
+// neededLibraries reads the DT_NEEDED entries of f from its PT_DYNAMIC
+// segment, since the executables have no section headers
+func neededLibraries(t *testing.T, f *elf.File) []string {
+	t.Helper()
+	var dynamic []byte
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_DYNAMIC {
+			dynamic = make([]byte, prog.Filesz)
+			if _, err := prog.ReadAt(dynamic, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var strtab uint64
+	var needed []uint64
+	for i := 0; i+16 <= len(dynamic); i += 16 {
+		tag := elf.DynTag(binary.LittleEndian.Uint64(dynamic[i:]))
+		value := binary.LittleEndian.Uint64(dynamic[i+8:])
+		switch tag {
+		case elf.DT_STRTAB:
+			strtab = value
+		case elf.DT_NEEDED:
+			needed = append(needed, value)
+		}
+	}
+	var libs []string
+	for _, offset := range needed {
+		for _, prog := range f.Progs {
+			addr := strtab + offset
+			if prog.Type != elf.PT_LOAD || addr < prog.Vaddr || addr >= prog.Vaddr+prog.Filesz {
+				continue
+			}
+			name := make([]byte, 64)
+			n, _ := prog.ReadAt(name, int64(addr-prog.Vaddr))
+			if i := bytes.IndexByte(name[:n], 0); i >= 0 {
+				libs = append(libs, string(name[:i]))
+			}
+		}
+	}
+	return libs
+}
+
+func TestFreeBSDExecutables(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		dynamic bool
+	}{
+		{"exit", "x := 3\ny := x + 4\n", false},
+		{"hello", "println(\"hello\")\n", true},
+	}
+	dir := t.TempDir()
+	for _, arch := range []Arch{ArchX86_64, ArchARM64} {
+		for _, tt := range tests {
+			t.Run(arch.String()+"/"+tt.name, func(t *testing.T) {
+				src := filepath.Join(dir, tt.name+".v67")
+				if err := os.WriteFile(src, []byte(tt.source), 0644); err != nil {
+					t.Fatal(err)
+				}
+				exe := filepath.Join(dir, tt.name+"-"+arch.String())
+				if err := CompileC67(src, exe, Platform{Arch: arch, OS: OSFreeBSD}); err != nil {
+					t.Fatal(err)
+				}
+
+				f, err := elf.Open(exe)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				if f.OSABI != elf.ELFOSABI_FREEBSD || f.ABIVersion != 0 {
+					t.Errorf("OS ABI = %v, version %d", f.OSABI, f.ABIVersion)
+				}
+				if f.Type != elf.ET_EXEC {
+					t.Errorf("type = %v", f.Type)
+				}
+				want := map[Arch]elf.Machine{ArchX86_64: elf.EM_X86_64, ArchARM64: elf.EM_AARCH64}[arch]
+				if f.Machine != want {
+					t.Errorf("machine = %v, want %v", f.Machine, want)
+				}
+
+				desc := freeBSDNote(t, f)
+				if len(desc) != 4 || binary.LittleEndian.Uint32(desc) != freeBSDOSRel {
+					t.Errorf("ABI note = % x", desc)
+				}
+
+				var interp string
+				for _, prog := range f.Progs {
+					if prog.Type == elf.PT_INTERP {
+						data := make([]byte, prog.Filesz)
+						if _, err := prog.ReadAt(data, 0); err != nil {
+							t.Fatal(err)
+						}
+						interp = string(bytes.TrimRight(data, "\x00"))
+					}
+				}
+				// The arm64 code generator always links with libc
+				if !tt.dynamic && arch != ArchARM64 {
+					if interp != "" {
+						t.Errorf("static executable has interpreter %q", interp)
+					}
+					return
+				}
+				if interp != freeBSDLinker {
+					t.Errorf("interpreter = %q, want %q", interp, freeBSDLinker)
+				}
+				libs := neededLibraries(t, f)
+				hasLibc := false
+				for _, lib := range libs {
+					switch lib {
+					case "libc.so.7":
+						hasLibc = true
+					case "libc.so.6", "libm.so.6", "libpthread.so.0":
+						t.Errorf("needs Linux library %s", lib)
+					}
+				}
+				if !hasLibc {
+					t.Errorf("needed libraries = %v, want libc.so.7", libs)
+				}
+			})
+		}
+	}
+}
+
+func TestFreeBSDSyscalls(t *testing.T) {
+	tests := []struct {
+		target Target
+		name   string
+		want   uint64
+	}{
+		{NewTarget(ArchX86_64, OSFreeBSD), "SYS_WRITE", 4},
+		{NewTarget(ArchX86_64, OSFreeBSD), "SYS_EXIT", 1},
+		{NewTarget(ArchX86_64, OSFreeBSD), "SYS_MMAP", 477},
+		{NewTarget(ArchX86_64, OSFreeBSD), "MAP_PRIVATE_ANONYMOUS", 0x1002},
+		{NewTarget(ArchX86_64, OSFreeBSD), "O_WRONLY_CREAT_TRUNC", 0x601},
+		{NewTarget(ArchARM64, OSFreeBSD), "SYS_WRITE", 4},
+		{NewTarget(ArchARM64, OSFreeBSD), "SYS_EXIT", 1},
+		{NewTarget(ArchX86_64, OSLinux), "SYS_WRITE", 1},
+		{NewTarget(ArchX86_64, OSLinux), "SYS_EXIT", 60},
+		{NewTarget(ArchX86_64, OSLinux), "MAP_PRIVATE_ANONYMOUS", 0x22},
+		{NewTarget(ArchX86_64, OSLinux), "O_WRONLY_CREAT_TRUNC", 0x241},
+		{NewTarget(ArchARM64, OSLinux), "SYS_WRITE", 64},
+		{NewTarget(ArchARM64, OSLinux), "SYS_EXIT", 93},
+	}
+	for _, tt := range tests {
+		if got := sysNum(tt.target, tt.name); got != tt.want {
+			t.Errorf("%s on %s-%s = %d, want %d", tt.name, tt.target.Arch(), tt.target.OS(), got, tt.want)
+		}
+	}
+
+	// A failed system call sets the carry flag on FreeBSD, and the errno is
+	// negated to match Linux
+	errnoTests := []struct {
+		machine string
+		want    []byte
+	}{
+		{"x86_64-freebsd", []byte{0x0F, 0x05, 0x73, 0x03, 0x48, 0xF7, 0xD8}},        // syscall; jnc +3; neg rax
+		{"x86_64-linux", []byte{0x0F, 0x05}},                                        // syscall
+		{"aarch64-freebsd", []byte{0x01, 0x00, 0x00, 0xD4, 0x00, 0x34, 0x80, 0xDA}}, // svc #0; cneg x0, x0, cs
+		{"aarch64-linux", []byte{0x01, 0x00, 0x00, 0xD4}},                           // svc #0
+	}
+	for _, tt := range errnoTests {
+		eb, err := New(tt.machine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := NewOut(eb.target, eb.TextWriter(), eb)
+		out.Syscall()
+		if got := eb.text.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: syscall = % x, want % x", tt.machine, got, tt.want)
+		}
+	}
+}
+
+// TestFreeBSDSyscallNumbers checks that the direct system calls of FreeBSD
+// executables never use a number that only Linux has
+func TestFreeBSDSyscallNumbers(t *testing.T) {
+	freeBSD := map[string]bool{}
+	for name, value := range getSyscallNumbers(NewTarget(ArchX86_64, OSFreeBSD)) {
+		if strings.HasPrefix(name, "SYS_") {
+			freeBSD[value] = true
+		}
+	}
+	linuxOnly := map[uint64]bool{}
+	for name, value := range getSyscallNumbers(NewTarget(ArchX86_64, OSLinux)) {
+		if strings.HasPrefix(name, "SYS_") && !freeBSD[value] {
+			linuxOnly[sysNum(NewTarget(ArchX86_64, OSLinux), name)] = true
+		}
+	}
+
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"exit", "x := 3\ny := x + 4\n"},
+		{"modzero", "x := 7\ny := 0\nprintln(x % y)\n"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		src := filepath.Join(dir, tt.name+".v67")
+		if err := os.WriteFile(src, []byte(tt.source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		exe := filepath.Join(dir, tt.name)
+		if err := CompileC67(src, exe, Platform{Arch: ArchX86_64, OS: OSFreeBSD}); err != nil {
+			t.Fatal(err)
+		}
+		f, err := elf.Open(exe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syscalls := 0
+		for _, prog := range f.Progs {
+			if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+				continue
+			}
+			code := make([]byte, prog.Filesz)
+			if _, err := prog.ReadAt(code, 0); err != nil {
+				t.Fatal(err)
+			}
+			// Follow mov rax, imm32 up to each syscall
+			rax := int64(-1)
+			for i := 0; i+1 < len(code); i++ {
+				switch {
+				case i+7 <= len(code) && bytes.Equal(code[i:i+3], []byte{0x48, 0xc7, 0xc0}):
+					rax = int64(int32(binary.LittleEndian.Uint32(code[i+3:])))
+					i += 6
+				case code[i] == 0x0f && code[i+1] == 0x05:
+					syscalls++
+					if rax >= 0 && linuxOnly[uint64(rax)] {
+						t.Errorf("%s: Linux system call %d at 0x%x", tt.name, rax, prog.Vaddr+uint64(i))
+					}
+					i++
+				}
+			}
+		}
+		f.Close()
+		if syscalls == 0 {
+			t.Errorf("%s: no system calls found", tt.name)
+		}
+	}
+}
@@ -2,215 +2,243 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
-	"hash/fnv"
+	"math"
 )
 
 // Vibe67HashMap represents a hash map from uint64 to float64
 // This is the fundamental datastructure in Vibe67
 // All values (ints, strings, etc) are stored in such a hash map
+//
+// The table is an open-addressing Swiss table. Slots are grouped by 14, and
+// every group starts with a 16-byte control word: one tag byte per slot (0
+// for an empty slot, 0x80 | 7 bits of the hash for a full one), an unused
+// byte and an overflow count. A lookup compares the tag with all 14 control
+// bytes at once (SSE2 pcmpeqb in the emitted runtime, see maps_runtime.go)
+// and only looks at the keys of matching slots.
+//
+// Groups are probed one after the other from the group picked by the hash.
+// The overflow count of a group is the number of entries that were inserted
+// past it because it was full, so a lookup can stop at the first group with
+// a zero count. Deleting an entry empties its slot and decrements the counts
+// along its probe path, which is why the table never needs tombstones.
+//
+// The emitted runtime works on the same memory layout, which Layout returns:
+//
+//	[count:8][groups:8] then per group [control:16][key:8][value:8] × 14
 type Vibe67HashMap struct {
-	buckets []Vibe67HashBucket
-	size    int
-	count   int
+	groups []mapGroup
+	count  int
 }
 
-type Vibe67HashBucket struct {
-	key      uint64
-	value    float64
-	occupied bool
-	next     *Vibe67HashBucket
+type mapGroup struct {
+	control [mapControlSize]byte
+	keys    [mapGroupSlots]uint64
+	values  [mapGroupSlots]float64
 }
 
-// NewVibe67HashMap creates a new hash map with the given initial size
+const (
+	mapGroupSlots     = 14                                // Slots per group
+	mapControlSize    = 16                                // Bytes in a control word
+	mapOverflowByte   = 15                                // Index of the overflow count in the control word
+	mapHeaderSize     = 16                                // count and number of groups
+	mapGroupSize      = mapControlSize + mapGroupSlots*16 // Bytes per group
+	mapSlotMask       = 1<<mapGroupSlots - 1              // Control bytes that belong to slots
+	mapHashMultiplier = 0x9E3779B97F4A7C15                // 2^64 / golden ratio
+	mapMaxLoad        = mapGroupSlots * 7                 // Entries per group × 8 before the table grows (7/8 full)
+	mapFullTag        = 0x80                              // Set in the tag of every full slot
+	mapOverflowMax    = 255                               // Saturated overflow counts are never decremented
+	mapEmptyTag       = 0                                 // Tag of an empty slot
+	mapMinGroups      = 1                                 // Groups in the first table
+	mapGrowthFactor   = 2                                 // Groups are doubled when the table grows
+)
+
+// NewVibe67HashMap creates a new hash map with room for the given number of
+// entries
 func NewVibe67HashMap(initialSize int) *Vibe67HashMap {
-	if initialSize < 16 {
-		initialSize = 16
-	}
-	return &Vibe67HashMap{
-		buckets: make([]Vibe67HashBucket, initialSize),
-		size:    initialSize,
-		count:   0,
+	m := &Vibe67HashMap{}
+	if initialSize > 0 {
+		groups := mapMinGroups
+		for initialSize*8 > groups*mapMaxLoad {
+			groups *= mapGrowthFactor
+		}
+		m.groups = make([]mapGroup, groups)
 	}
+	return m
 }
 
-// hash computes the hash of a uint64 key
-func (m *Vibe67HashMap) hash(key uint64) uint64 {
-	h := fnv.New64a()
-	bytes := make([]byte, 8)
-	for i := 0; i < 8; i++ {
-		bytes[i] = byte(key >> (i * 8))
-	}
-	h.Write(bytes)
-	return h.Sum64()
+// mapHash mixes a key. The low bits pick the first group and the top 7 bits
+// are the tag.
+func mapHash(key uint64) uint64 {
+	h := key * mapHashMultiplier
+	return h ^ h>>32
 }
 
-// Get retrieves a value from the hash map
-func (m *Vibe67HashMap) Get(key uint64) (float64, bool) {
-	idx := m.hash(key) % uint64(m.size)
-	bucket := &m.buckets[idx]
+func mapTag(h uint64) byte {
+	return mapFullTag | byte(h>>57)
+}
+
+// match returns a bit for every slot whose control byte is b, like pcmpeqb
+// followed by pmovmskb
+func (g *mapGroup) match(b byte) uint32 {
+	var mask uint32
+	for i, c := range g.control[:mapGroupSlots] {
+		if c == b {
+			mask |= 1 << i
+		}
+	}
+	return mask & mapSlotMask
+}
 
-	// Check the first bucket
-	if bucket.occupied && bucket.key == key {
-		return bucket.value, true
+// lowestBit returns the index of the lowest set bit, like bsf
+func lowestBit(mask uint32) int {
+	i := 0
+	for mask&1 == 0 {
+		mask >>= 1
+		i++
 	}
+	return i
+}
 
-	// Check the chain
-	current := bucket.next
-	for current != nil {
-		if current.key == key {
-			return current.value, true
+// find returns the group and slot of a key, or -1
+func (m *Vibe67HashMap) find(key uint64) (int, int) {
+	if len(m.groups) == 0 {
+		return -1, -1
+	}
+	h := mapHash(key)
+	tag := mapTag(h)
+	mask := uint64(len(m.groups) - 1)
+	gi := h & mask
+	for range len(m.groups) {
+		g := &m.groups[gi]
+		for matches := g.match(tag); matches != 0; matches &= matches - 1 {
+			if slot := lowestBit(matches); g.keys[slot] == key {
+				return int(gi), slot
+			}
+		}
+		if g.control[mapOverflowByte] == 0 {
+			break
 		}
-		current = current.next
+		gi = (gi + 1) & mask
 	}
+	return -1, -1
+}
 
-	return 0.0, false
+// Get retrieves a value from the hash map
+func (m *Vibe67HashMap) Get(key uint64) (float64, bool) {
+	gi, slot := m.find(key)
+	if gi < 0 {
+		return 0.0, false
+	}
+	return m.groups[gi].values[slot], true
 }
 
 // Set stores a value in the hash map
 func (m *Vibe67HashMap) Set(key uint64, value float64) {
-	idx := m.hash(key) % uint64(m.size)
-	bucket := &m.buckets[idx]
-
-	// If bucket is empty, use it
-	if !bucket.occupied {
-		bucket.key = key
-		bucket.value = value
-		bucket.occupied = true
-		m.count++
+	if gi, slot := m.find(key); gi >= 0 {
+		m.groups[gi].values[slot] = value
 		return
 	}
 
-	// If this key already exists in the first bucket, update it
-	if bucket.key == key {
-		bucket.value = value
-		return
+	// Grow before the table gets more than 7/8 full
+	if (m.count+1)*8 > len(m.groups)*mapMaxLoad {
+		m.resize()
 	}
+	m.place(key, value)
+}
 
-	// Check the chain for existing key
-	current := bucket.next
-	prev := bucket
-	for current != nil {
-		if current.key == key {
-			current.value = value
+// place inserts a key that is not in the table into the first empty slot
+// along its probe path
+func (m *Vibe67HashMap) place(key uint64, value float64) {
+	h := mapHash(key)
+	mask := uint64(len(m.groups) - 1)
+	gi := h & mask
+	for {
+		g := &m.groups[gi]
+		if empty := g.match(mapEmptyTag); empty != 0 {
+			slot := lowestBit(empty)
+			g.control[slot] = mapTag(h)
+			g.keys[slot] = key
+			g.values[slot] = value
+			m.count++
 			return
 		}
-		prev = current
-		current = current.next
-	}
-
-	// Add new entry to chain
-	newBucket := &Vibe67HashBucket{
-		key:      key,
-		value:    value,
-		occupied: true,
-		next:     nil,
-	}
-	prev.next = newBucket
-	m.count++
-
-	// Check load factor and resize if needed
-	if float64(m.count)/float64(m.size) > 0.75 {
-		m.resize()
+		if g.control[mapOverflowByte] != mapOverflowMax {
+			g.control[mapOverflowByte]++
+		}
+		gi = (gi + 1) & mask
 	}
 }
 
-// resize doubles the size of the hash map and rehashes all entries
+// resize doubles the number of groups and reinserts all entries
 func (m *Vibe67HashMap) resize() {
-	oldBuckets := m.buckets
-	m.size *= 2
-	m.buckets = make([]Vibe67HashBucket, m.size)
+	old := m.groups
+	size := mapMinGroups
+	if len(old) > 0 {
+		size = len(old) * mapGrowthFactor
+	}
+	m.groups = make([]mapGroup, size)
 	m.count = 0
 
-	// Rehash all entries
-	for i := range oldBuckets {
-		bucket := &oldBuckets[i]
-		if bucket.occupied {
-			m.Set(bucket.key, bucket.value)
-		}
-
-		current := bucket.next
-		for current != nil {
-			m.Set(current.key, current.value)
-			current = current.next
+	// Reinsert in memory order, like the emitted runtime
+	for gi := range old {
+		g := &old[gi]
+		for slot := range mapGroupSlots {
+			if g.control[slot] != mapEmptyTag {
+				m.place(g.keys[slot], g.values[slot])
+			}
 		}
 	}
 }
 
 // Delete removes a key from the hash map
 func (m *Vibe67HashMap) Delete(key uint64) bool {
-	idx := m.hash(key) % uint64(m.size)
-	bucket := &m.buckets[idx]
-
-	// Check first bucket
-	if bucket.occupied && bucket.key == key {
-		if bucket.next != nil {
-			// Move next bucket to first position
-			*bucket = *bucket.next
-		} else {
-			// Clear the bucket
-			bucket.key = 0
-			bucket.value = 0.0
-			bucket.occupied = false
-			bucket.next = nil
-		}
-		m.count--
-		return true
-	}
-
-	// Check chain
-	prev := bucket
-	current := bucket.next
-	for current != nil {
-		if current.key == key {
-			prev.next = current.next
-			m.count--
-			return true
+	gi, slot := m.find(key)
+	if gi < 0 {
+		return false
+	}
+	g := &m.groups[gi]
+	g.control[slot] = mapEmptyTag
+	g.keys[slot] = 0
+	g.values[slot] = 0.0
+	m.count--
+
+	// The groups before this one no longer overflow because of the key
+	mask := len(m.groups) - 1
+	for i := int(mapHash(key) & uint64(mask)); i != gi; i = (i + 1) & mask {
+		if c := &m.groups[i].control[mapOverflowByte]; *c != mapOverflowMax {
+			*c--
 		}
-		prev = current
-		current = current.next
 	}
-
-	return false
+	return true
 }
 
 // Keys returns all keys in the hash map
 func (m *Vibe67HashMap) Keys() []uint64 {
 	keys := make([]uint64, 0, m.count)
-
-	for i := range m.buckets {
-		bucket := &m.buckets[i]
-		if bucket.occupied {
-			keys = append(keys, bucket.key)
-		}
-
-		current := bucket.next
-		for current != nil {
-			keys = append(keys, current.key)
-			current = current.next
+	for gi := range m.groups {
+		g := &m.groups[gi]
+		for slot := range mapGroupSlots {
+			if g.control[slot] != mapEmptyTag {
+				keys = append(keys, g.keys[slot])
+			}
 		}
 	}
-
 	return keys
 }
 
 // Values returns all values in the hash map
 func (m *Vibe67HashMap) Values() []float64 {
 	values := make([]float64, 0, m.count)
-
-	for i := range m.buckets {
-		bucket := &m.buckets[i]
-		if bucket.occupied {
-			values = append(values, bucket.value)
-		}
-
-		current := bucket.next
-		for current != nil {
-			values = append(values, current.value)
-			current = current.next
+	for gi := range m.groups {
+		g := &m.groups[gi]
+		for slot := range mapGroupSlots {
+			if g.control[slot] != mapEmptyTag {
+				values = append(values, g.values[slot])
+			}
 		}
 	}
-
 	return values
 }
 
@@ -219,7 +247,28 @@ func (m *Vibe67HashMap) Count() int {
 	return m.count
 }
 
+// Layout returns the table as the emitted runtime stores it in memory, or nil
+// for a map that has never held an entry
+func (m *Vibe67HashMap) Layout() []byte {
+	if len(m.groups) == 0 {
+		return nil
+	}
+	buf := make([]byte, mapHeaderSize+len(m.groups)*mapGroupSize)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(m.count))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(len(m.groups)))
+	for gi := range m.groups {
+		g := &m.groups[gi]
+		base := buf[mapHeaderSize+gi*mapGroupSize:]
+		copy(base, g.control[:])
+		for slot := range mapGroupSlots {
+			binary.LittleEndian.PutUint64(base[mapControlSize+slot*16:], g.keys[slot])
+			binary.LittleEndian.PutUint64(base[mapControlSize+slot*16+8:], math.Float64bits(g.values[slot]))
+		}
+	}
+	return buf
+}
+
 // String returns a string representation of the hash map
 func (m *Vibe67HashMap) String() string {
-	return fmt.Sprintf("Vibe67HashMap{count: %d, size: %d}", m.count, m.size)
+	return fmt.Sprintf("Vibe67HashMap{count: %d, groups: %d}", m.count, len(m.groups))
 }
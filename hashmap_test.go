@@ -182,3 +182,27 @@ func TestVibe67HashMapEmpty(t *testing.T) {
 		t.Errorf("Expected 0 values for empty map, got %d", len(values))
 	}
 }
+
+func TestVibe67HashMapDeleteLeavesNoTombstones(t *testing.T) {
+	m := NewVibe67HashMap(0)
+	keys := collidingKeys(40)
+
+	// All keys start at the same group, so most of them overflow into the next ones
+	for i, key := range keys {
+		m.Set(key, float64(i))
+	}
+	for _, key := range keys {
+		if !m.Delete(key) {
+			t.Fatalf("Expected key %d to be deleted", key)
+		}
+	}
+
+	if m.Count() != 0 {
+		t.Errorf("Expected count 0, got %d", m.Count())
+	}
+	for gi, g := range m.groups {
+		if g.control != [mapControlSize]byte{} {
+			t.Errorf("Expected group %d to be empty, got control bytes %v", gi, g.control)
+		}
+	}
+}
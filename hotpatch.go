@@ -0,0 +1,616 @@
+// Completion: 80% - In-process hot patching of hot functions (x86-64 Linux)
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hotpatch.go - Replacing hot functions in a running program
+//
+// Calls to functions defined with 'hot' go through _hot_function_table, a
+// writable table of code pointers that is filled in at startup. When the
+// program is started by 'vibe67 --watch', file descriptor 3 is a Unix socket
+// connected to the watcher. The program then maps a patch area at a fixed
+// address and installs a SIGIO handler that reads patches from the socket:
+//
+//	magic uint32   "V67H"
+//	index uint32   index in _hot_function_table
+//	addr  uint64   where the code goes in the patch area
+//	size  uint64   number of code bytes that follow
+//
+// The handler copies the code to addr, points the table entry at it and
+// acknowledges with one byte. Old code is never unmapped, so a function that
+// is running while it is replaced finishes with its old code.
+//
+// When a reload changes the layout of a cstruct or class, the old state must
+// be migrated before new code sees it. The patches are then staged (index |
+// hotStageFlag) and committed by a hotMigrateIndex message. At the next call
+// of a hot function, the staged code is switched in and on_reload is called
+// with the value of the global 'state', which is replaced by the result.
+// on_reload always has a slot in the table, so that it can be added later.
+//
+// The watcher recompiles the program, takes the code of the changed function
+// from the new executable and relocates it against the running one: globals,
+// runtime helpers and unchanged functions resolve to their addresses in the
+// running program, so game state survives the edit. New constants travel
+// with the code. Anything that can not be patched this way (new globals,
+// changed helper functions) makes the watcher restart the program instead.
+
+const (
+	hotPatchFD        = 3          // socket to the watcher, inherited by the program
+	hotPatchAreaAddr  = 0x20000000 // within rel32 range of the executable at 0x400000
+	hotPatchAreaSize  = 0x1000000
+	hotPatchMagic     = 0x48373656 // "V67H"
+	hotPatchHeaderLen = 24
+	hotStageFlag      = 0x40000000 // index flag: load the code, but switch to it at the migration
+	hotMigrateIndex   = 0x7FFFFFFF // index of the message that requests the migration
+	hotReloadFunction = "on_reload"
+	hotStateVariable  = "state"
+)
+
+// lastHotImage is the code layout of the most recent executable with hot functions
+var lastHotImage *HotImage
+
+// HotImage is the code layout of an executable, as needed for hot patching
+type HotImage struct {
+	TextAddr  uint64
+	Text      []byte
+	Hot       []string                // hot functions, in table order
+	Functions map[string]hotRange     // lambda name -> code range in Text
+	Relocs    []hotReloc              // every rel32 in Text, sorted by offset
+	Symbols   map[string]uint64       // address of every label, constant and call target
+	Data      map[string]hotImageData // contents of every constant
+}
+
+type hotRange struct {
+	Start, End int
+}
+
+type hotReloc struct {
+	Offset int // offset of the rel32 in Text
+	Symbol string
+}
+
+type hotImageData struct {
+	Value    string
+	Writable bool
+}
+
+// defineHotFunctionTable collects the hot functions and defines the data they need
+// Hot patching is only supported on x86-64 Linux; elsewhere hot functions are ordinary functions.
+func (fc *C67Compiler) defineHotFunctionTable(program *Program) {
+	if fc.eb.target.Arch() != ArchX86_64 || fc.eb.target.OS() != OSLinux {
+		return
+	}
+	for _, stmt := range program.Statements {
+		if assign, ok := stmt.(*AssignStmt); ok && assign.IsHot {
+			fc.hotFunctions[assign.Name] = true
+		}
+	}
+	if len(fc.hotFunctions) == 0 {
+		return
+	}
+	if _, ok := fc.hotFunctions[hotReloadFunction]; !ok {
+		fc.hotFunctions[hotReloadFunction] = false // reserved, the slot stays empty until on_reload is patched in
+	}
+	fc.buildHotFunctionTable()
+	table := strings.Repeat("\x00", len(fc.hotFunctionTable)*8)
+	fc.eb.DefineWritable("_hot_function_table", table)
+	fc.eb.DefineWritable("_hot_staged_table", table)
+	fc.eb.DefineWritable("_hot_reload_pending", strings.Repeat("\x00", 8))
+	fc.eb.DefineWritable("_hot_sigaction", strings.Repeat("\x00", 32)) // struct kernel_sigaction
+}
+
+// initHotFunctionTable emits the startup code that fills in the hot function table
+// and starts listening for patches
+func (fc *C67Compiler) initHotFunctionTable() {
+	if len(fc.hotFunctionTable) == 0 {
+		return
+	}
+	names := make([]string, len(fc.hotFunctionTable))
+	for name, idx := range fc.hotFunctionTable {
+		names[idx] = name
+	}
+	fc.out.LeaSymbolToReg("rcx", "_hot_function_table")
+	for idx, name := range names {
+		if fc.hotFunctions[name] {
+			fc.out.LeaSymbolToReg("rax", name)
+			fc.out.MovRegToMem("rax", "rcx", idx*8)
+		}
+	}
+	fc.out.CallSymbol("_vibe67_hot_listen")
+}
+
+// emitHotMigrationCheck emits the check for a pending state migration that
+// precedes every call of a hot function
+func (fc *C67Compiler) emitHotMigrationCheck() {
+	fc.out.LeaSymbolToReg("r11", "_hot_reload_pending")
+	fc.out.MovMemToReg("r11", "r11", 0)
+	fc.out.TestRegReg("r11", "r11")
+	skip := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.CallSymbol("_vibe67_hot_migrate")
+	fc.patchJumpImmediate(skip+2, int32(fc.eb.text.Len()-(skip+ConditionalJumpSize)))
+}
+
+// generateHotReloadRuntime emits the patch listener and its SIGIO handler
+func (fc *C67Compiler) generateHotReloadRuntime() {
+	if len(fc.hotFunctionTable) == 0 {
+		return
+	}
+
+	var exits []int
+	jumpToExit := func(cond JumpCondition) {
+		exits = append(exits, fc.eb.text.Len())
+		fc.out.JumpConditional(cond, 0)
+	}
+	patchExits := func() {
+		for _, pos := range exits {
+			fc.patchJumpImmediate(pos+2, int32(fc.eb.text.Len()-(pos+ConditionalJumpSize)))
+		}
+		exits = nil
+	}
+	syscall := func(number int, args ...string) {
+		regs := []string{"rdi", "rsi", "rdx", "r10", "r8", "r9"}
+		for i, arg := range args {
+			if arg != "" {
+				fc.out.MovImmToReg(regs[i], arg)
+			}
+		}
+		fc.out.MovImmToReg("rax", fmt.Sprintf("%d", number))
+		fc.out.Syscall()
+	}
+	fd := fmt.Sprintf("%d", hotPatchFD)
+
+	// _vibe67_hot_listen: enable patching if fd 3 is a socket (started by --watch)
+	fc.eb.MarkLabel("_vibe67_hot_listen")
+	fc.out.SubImmFromReg("rsp", 16)
+	fc.out.MovImmToMem(4, "rsp", 8)
+	fc.out.MovRegToReg("r10", "rsp")
+	fc.out.LeaMemToReg("r8", "rsp", 8)
+	syscall(55, fd, "1", "3") // getsockopt(3, SOL_SOCKET, SO_TYPE, rsp, rsp+8)
+	fc.out.TestRegReg("rax", "rax")
+	jumpToExit(JumpNotEqual)
+
+	// mmap(area, size, PROT_READ|PROT_WRITE|PROT_EXEC, MAP_PRIVATE|MAP_ANONYMOUS|MAP_FIXED_NOREPLACE, -1, 0)
+	fc.out.XorRegWithReg("r9", "r9")
+	syscall(9, fmt.Sprintf("%d", hotPatchAreaAddr), fmt.Sprintf("%d", hotPatchAreaSize), "7", "0x100022", "-1")
+	fc.out.MovImmToReg("rcx", fmt.Sprintf("%d", hotPatchAreaAddr))
+	fc.out.CmpRegToReg("rax", "rcx")
+	jumpToExit(JumpNotEqual)
+
+	// rt_sigaction(SIGIO, {handler, SA_RESTORER|SA_RESTART, restorer, 0}, NULL, 8)
+	fc.out.LeaSymbolToReg("rsi", "_hot_sigaction")
+	fc.out.LeaSymbolToReg("rax", "_vibe67_hot_signal")
+	fc.out.MovRegToMem("rax", "rsi", 0)
+	fc.out.MovImmToReg("rax", "0x14000000")
+	fc.out.MovRegToMem("rax", "rsi", 8)
+	fc.out.LeaSymbolToReg("rax", "_vibe67_hot_restorer")
+	fc.out.MovRegToMem("rax", "rsi", 16)
+	fc.out.XorRegWithReg("rdx", "rdx")
+	syscall(13, "29", "", "", "8")
+
+	// Deliver SIGIO to this process when a patch arrives
+	syscall(39) // getpid
+	fc.out.MovRegToReg("rdx", "rax")
+	syscall(72, fd, "8")              // fcntl(3, F_SETOWN, pid)
+	syscall(72, fd, "4", "0x2000")    // fcntl(3, F_SETFL, O_ASYNC)
+	fc.out.MovImmToMem('R', "rsp", 0) // tell the watcher that patches can be sent
+	fc.out.MovRegToReg("rsi", "rsp")
+	syscall(1, fd, "", "1")
+	patchExits()
+	fc.out.AddImmToReg("rsp", 16)
+	fc.out.Ret()
+
+	// _vibe67_hot_read: read rdx bytes from the watcher to rsi, rax = 0 on success
+	fc.eb.MarkLabel("_vibe67_hot_read")
+	fc.out.MovRegToReg("r8", "rsi")
+	fc.out.MovRegToReg("r9", "rdx")
+	readLoop := fc.eb.text.Len()
+	fc.out.TestRegReg("r9", "r9")
+	doneJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovRegToReg("rsi", "r8")
+	fc.out.MovRegToReg("rdx", "r9")
+	syscall(0, fd)
+	fc.out.CmpRegToImm("rax", 0)
+	jumpToExit(JumpLessOrEqual)
+	fc.out.AddRegToReg("r8", "rax")
+	fc.out.SubRegFromReg("r9", "rax")
+	fc.out.JumpUnconditional(int32(readLoop - (fc.eb.text.Len() + UnconditionalJumpSize)))
+	fc.patchJumpImmediate(doneJump+2, int32(fc.eb.text.Len()-(doneJump+ConditionalJumpSize)))
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.out.Ret()
+	patchExits()
+	fc.out.MovImmToReg("rax", "-1")
+	fc.out.Ret()
+
+	// _vibe67_hot_signal: SIGIO handler, applies every pending patch
+	// The kernel saves and restores all registers around signal handlers.
+	fc.eb.MarkLabel("_vibe67_hot_signal")
+	fc.out.SubImmFromReg("rsp", 48) // pollfd at 0, header at 8, ack at 32, table at 40
+	nextPatch := fc.eb.text.Len()
+	fc.out.MovImmToMem(1, "rsp", 4) // events = POLLIN
+	fc.out.MovImmToReg("rax", fd)
+	fc.out.MovU32RegToMem("rax", "rsp", 0)
+	fc.out.MovRegToReg("rdi", "rsp")
+	fc.out.XorRegWithReg("rdx", "rdx")
+	syscall(7, "", "1") // poll(pollfd, 1, 0)
+	fc.out.CmpRegToImm("rax", 1)
+	jumpToExit(JumpNotEqual)
+
+	fc.out.LeaMemToReg("rsi", "rsp", 8)
+	fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", hotPatchHeaderLen))
+	fc.out.CallSymbol("_vibe67_hot_read")
+	fc.out.TestRegReg("rax", "rax")
+	jumpToExit(JumpNotEqual)
+	fc.out.MovU32MemToReg("rax", "rsp", 8)
+	fc.out.CmpRegToImm("rax", hotPatchMagic)
+	jumpToExit(JumpNotEqual)
+
+	// Pick the table: live, staged (hotStageFlag) or none (hotMigrateIndex)
+	fc.out.MovU32MemToReg("rax", "rsp", 12)
+	fc.out.CmpRegToImm("rax", hotMigrateIndex)
+	migrateJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.LeaSymbolToReg("rdi", "_hot_function_table")
+	fc.out.CmpRegToImm("rax", int64(len(fc.hotFunctionTable)))
+	liveJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpBelow, 0)
+	fc.out.LeaSymbolToReg("rdi", "_hot_staged_table")
+	fc.out.SubImmFromReg("rax", hotStageFlag)
+	fc.out.CmpRegToImm("rax", int64(len(fc.hotFunctionTable)))
+	jumpToExit(JumpAboveOrEqual)
+	fc.patchJumpImmediate(liveJump+2, int32(fc.eb.text.Len()-(liveJump+ConditionalJumpSize)))
+	fc.out.MovU32RegToMem("rax", "rsp", 12)
+	fc.out.MovRegToMem("rdi", "rsp", 40)
+
+	fc.out.MovMemToReg("rsi", "rsp", 16)
+	fc.out.MovMemToReg("rdx", "rsp", 24)
+	fc.out.CallSymbol("_vibe67_hot_read")
+	fc.out.TestRegReg("rax", "rax")
+	jumpToExit(JumpNotEqual)
+
+	// Point the table entry at the new code
+	fc.out.MovMemToReg("rdi", "rsp", 40)
+	fc.out.MovU32MemToReg("rax", "rsp", 12)
+	fc.out.MulRegWithImm("rax", 8)
+	fc.out.AddRegToReg("rdi", "rax")
+	fc.out.MovMemToReg("rax", "rsp", 16)
+	fc.out.MovRegToMem("rax", "rdi", 0)
+	ackJump := fc.eb.text.Len()
+	fc.out.JumpUnconditional(0)
+
+	// The migration runs at the next call of a hot function, not in the signal handler
+	fc.patchJumpImmediate(migrateJump+2, int32(fc.eb.text.Len()-(migrateJump+ConditionalJumpSize)))
+	fc.out.LeaSymbolToReg("rax", "_hot_reload_pending")
+	fc.out.MovImmToMem(1, "rax", 0)
+
+	fc.patchJumpImmediate(ackJump+1, int32(fc.eb.text.Len()-(ackJump+UnconditionalJumpSize)))
+	fc.out.MovImmToMem(1, "rsp", 32)
+	fc.out.LeaMemToReg("rsi", "rsp", 32)
+	syscall(1, fd, "", "1")
+	fc.out.JumpUnconditional(int32(nextPatch - (fc.eb.text.Len() + UnconditionalJumpSize)))
+	patchExits()
+	fc.out.AddImmToReg("rsp", 48)
+	fc.out.Ret()
+
+	// _vibe67_hot_restorer: returns from the signal handler
+	fc.eb.MarkLabel("_vibe67_hot_restorer")
+	syscall(15) // rt_sigreturn
+
+	fc.generateHotMigrate()
+}
+
+// generateHotMigrate emits _vibe67_hot_migrate, which switches to the staged
+// code and runs on_reload: state <- on_reload(state)
+// It is called before a hot function call, so every register is preserved.
+func (fc *C67Compiler) generateHotMigrate() {
+	savedRegs := []string{"rax", "rcx", "rdx", "rsi", "rdi", "r8", "r9", "r10", "r11", "rbx", "r12", "r13", "r14", "r15"}
+
+	fc.eb.MarkLabel("_vibe67_hot_migrate")
+	fc.out.PushReg("rbp")
+	fc.out.MovRegToReg("rbp", "rsp")
+	for _, reg := range savedRegs {
+		fc.out.PushReg(reg)
+	}
+	fc.out.AndRegWithImm("rsp", -16)
+	fc.out.SubImmFromReg("rsp", 16*8)
+	for i := 0; i < 16; i++ {
+		fc.out.MovXmmToMem(fmt.Sprintf("xmm%d", i), "rsp", i*8)
+	}
+
+	// Switch to the staged code
+	fc.out.LeaSymbolToReg("rsi", "_hot_staged_table")
+	fc.out.LeaSymbolToReg("rdi", "_hot_function_table")
+	for idx := 0; idx < len(fc.hotFunctionTable); idx++ {
+		fc.out.MovMemToReg("rax", "rsi", idx*8)
+		fc.out.TestRegReg("rax", "rax")
+		skip := fc.eb.text.Len()
+		fc.out.JumpConditional(JumpEqual, 0)
+		fc.out.MovRegToMem("rax", "rdi", idx*8)
+		fc.out.MovImmToMem(0, "rsi", idx*8)
+		fc.patchJumpImmediate(skip+2, int32(fc.eb.text.Len()-(skip+ConditionalJumpSize)))
+	}
+	fc.out.LeaSymbolToReg("rax", "_hot_reload_pending")
+	fc.out.MovImmToMem(0, "rax", 0)
+
+	// state <- on_reload(state)
+	fc.out.MovMemToReg("r11", "rdi", fc.hotFunctionTable[hotReloadFunction]*8)
+	fc.out.TestRegReg("r11", "r11")
+	done := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	stateSymbol := "_global_" + hotStateVariable
+	if _, hasState := fc.eb.consts[stateSymbol]; hasState {
+		fc.out.LeaSymbolToReg("rax", stateSymbol)
+		fc.out.MovMemToXmm("xmm0", "rax", 0)
+	} else {
+		fc.out.XorpdXmm("xmm0", "xmm0")
+	}
+	fc.out.CallRegister("r11")
+	if _, hasState := fc.eb.consts[stateSymbol]; hasState {
+		fc.out.LeaSymbolToReg("rax", stateSymbol)
+		fc.out.MovXmmToMem("xmm0", "rax", 0)
+	}
+	fc.patchJumpImmediate(done+2, int32(fc.eb.text.Len()-(done+ConditionalJumpSize)))
+
+	for i := 0; i < 16; i++ {
+		fc.out.MovMemToXmm(fmt.Sprintf("xmm%d", i), "rsp", i*8)
+	}
+	fc.out.LeaMemToReg("rsp", "rbp", -8*len(savedRegs))
+	for i := len(savedRegs) - 1; i >= 0; i-- {
+		fc.out.PopReg(savedRegs[i])
+	}
+	fc.out.PopReg("rbp")
+	fc.out.Ret()
+}
+
+// captureHotImage records the final code layout in lastHotImage, for --watch
+func (fc *C67Compiler) captureHotImage(textAddr uint64) {
+	lastHotImage = nil
+	if len(fc.hotFunctionTable) == 0 {
+		return
+	}
+
+	text := fc.eb.text.Bytes()
+	img := &HotImage{
+		TextAddr:  textAddr,
+		Text:      append([]byte(nil), text...),
+		Hot:       make([]string, len(fc.hotFunctionTable)),
+		Functions: make(map[string]hotRange),
+		Symbols:   make(map[string]uint64),
+		Data:      make(map[string]hotImageData),
+	}
+	for name, idx := range fc.hotFunctionTable {
+		img.Hot[idx] = name
+	}
+	for name, start := range fc.lambdaOffsets {
+		if end, ok := fc.lambdaCodeEndOffsets[name]; ok && end > start {
+			img.Functions[name] = hotRange{start, end}
+		}
+	}
+	for name, c := range fc.eb.consts {
+		img.Symbols[name] = c.addr
+		img.Data[name] = hotImageData{Value: c.value, Writable: c.writable}
+	}
+	for name, offset := range fc.eb.labels {
+		// Labels win over constants of the same name, as in PatchPCRelocations
+		img.Symbols[name] = textAddr + uint64(offset)
+		delete(img.Data, name)
+	}
+
+	addReloc := func(offset int, symbol string) {
+		if offset < 0 || offset+4 > len(img.Text) {
+			return
+		}
+		img.Relocs = append(img.Relocs, hotReloc{offset, symbol})
+		if _, ok := img.Symbols[symbol]; !ok {
+			img.Symbols[symbol] = img.target(offset) // e.g. PLT stubs
+		}
+	}
+	for _, reloc := range fc.eb.pcRelocations {
+		addReloc(int(reloc.offset), reloc.symbolName)
+	}
+	for _, patch := range fc.eb.callPatches {
+		addReloc(patch.position, patch.targetName)
+	}
+	sort.Slice(img.Relocs, func(i, j int) bool { return img.Relocs[i].Offset < img.Relocs[j].Offset })
+
+	lastHotImage = img
+}
+
+// target returns the address a rel32 in the text refers to
+func (img *HotImage) target(offset int) uint64 {
+	disp := int32(binary.LittleEndian.Uint32(img.Text[offset:]))
+	return img.TextAddr + uint64(offset) + 4 + uint64(int64(disp))
+}
+
+// HotIndex returns the index of a hot function in the hot function table
+func (img *HotImage) HotIndex(name string) int {
+	for i, hot := range img.Hot {
+		if hot == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// functionSignature describes the code of a function, ignoring where it and
+// the symbols it refers to are placed, so that two builds can be compared
+func (img *HotImage) functionSignature(name string) (string, bool) {
+	r, ok := img.Functions[name]
+	if !ok {
+		return "", false
+	}
+	code := append([]byte(nil), img.Text[r.Start:r.End]...)
+	var sb strings.Builder
+	for _, reloc := range img.Relocs {
+		if reloc.Offset < r.Start || reloc.Offset >= r.End {
+			continue
+		}
+		copy(code[reloc.Offset-r.Start:], []byte{0, 0, 0, 0})
+		fmt.Fprintf(&sb, "%d:%s", reloc.Offset-r.Start, reloc.Symbol)
+		if d, ok := img.Data[reloc.Symbol]; ok && !d.Writable {
+			fmt.Fprintf(&sb, "=%q", d.Value)
+		}
+		sb.WriteByte('\n')
+	}
+	sb.Write(code)
+	return sb.String(), true
+}
+
+// ExtractFunctionCode returns the code of a function in img, relocated to run
+// at addr in a process that runs the executable described by running
+func ExtractFunctionCode(img, running *HotImage, name string, addr uint64) ([]byte, error) {
+	r, ok := img.Functions[name]
+	if !ok {
+		return nil, fmt.Errorf("function '%s' not found", name)
+	}
+	start := img.TextAddr + uint64(r.Start)
+	end := img.TextAddr + uint64(r.End)
+	blob := append([]byte(nil), img.Text[r.Start:r.End]...)
+	placed := make(map[string]uint64) // constants copied after the code
+
+	for _, reloc := range img.Relocs {
+		if reloc.Offset < r.Start || reloc.Offset >= r.End {
+			continue
+		}
+		if t := img.target(reloc.Offset); t >= start && t < end {
+			continue // moves along with the code
+		}
+
+		sym := reloc.Symbol
+		var dest uint64
+		if d, isData := img.Data[sym]; isData {
+			old, inRunning := running.Data[sym]
+			switch {
+			case d.Writable:
+				// Globals must be shared with the running program, that is where the state is
+				if !inRunning || !old.Writable {
+					return nil, fmt.Errorf("%s uses %s, which is not in the running program", name, sym)
+				}
+				dest = running.Symbols[sym]
+			case inRunning && old.Value == d.Value:
+				dest = running.Symbols[sym]
+			default:
+				if _, ok := placed[sym]; !ok {
+					for len(blob)%16 != 0 {
+						blob = append(blob, 0)
+					}
+					placed[sym] = addr + uint64(len(blob))
+					blob = append(blob, d.Value...)
+				}
+				dest = placed[sym]
+			}
+		} else {
+			if _, isFunc := img.Functions[sym]; isFunc {
+				newSig, _ := img.functionSignature(sym)
+				if oldSig, ok := running.functionSignature(sym); !ok || oldSig != newSig {
+					return nil, fmt.Errorf("%s calls %s, which has changed", name, sym)
+				}
+			}
+			a, ok := running.Symbols[sym]
+			if !ok {
+				return nil, fmt.Errorf("%s uses %s, which is not in the running program", name, sym)
+			}
+			dest = a
+		}
+
+		site := reloc.Offset - r.Start
+		disp := int64(dest) - int64(addr+uint64(site)+4)
+		if disp < -0x80000000 || disp > 0x7FFFFFFF {
+			return nil, fmt.Errorf("%s: %s is out of range of the patch area", name, sym)
+		}
+		binary.LittleEndian.PutUint32(blob[site:], uint32(int32(disp)))
+	}
+	return blob, nil
+}
+
+// HotPatcher sends patches to a program started by --watch
+type HotPatcher struct {
+	conn  net.Conn
+	next  uint64 // address of the next free byte in the patch area
+	ready bool
+}
+
+// NewHotPatcher returns a patcher for the watcher end of the socket
+func NewHotPatcher(conn net.Conn) *HotPatcher {
+	return &HotPatcher{conn: conn, next: hotPatchAreaAddr}
+}
+
+// Next returns the address that the next patch will be loaded at
+func (hp *HotPatcher) Next() uint64 {
+	return hp.next
+}
+
+// Push loads code (relocated for Next) into the running program and points
+// the hot function table entry at it
+func (hp *HotPatcher) Push(index int, code []byte) error {
+	return hp.send(uint32(index), code)
+}
+
+// Stage loads code (relocated for Next) into the running program, which
+// switches to it when the migration requested by Migrate runs
+func (hp *HotPatcher) Stage(index int, code []byte) error {
+	return hp.send(uint32(index)|hotStageFlag, code)
+}
+
+// Migrate makes the program switch to the staged code and call on_reload
+// before the next call of a hot function
+func (hp *HotPatcher) Migrate() error {
+	return hp.send(hotMigrateIndex, nil)
+}
+
+// send sends one message to the program and waits until it has been handled
+func (hp *HotPatcher) send(index uint32, code []byte) error {
+	if hp.next+uint64(len(code)) > hotPatchAreaAddr+hotPatchAreaSize {
+		return fmt.Errorf("patch area is full")
+	}
+	if !hp.ready {
+		// The program reports once its listener is active
+		if err := hp.expect('R', 2*time.Second); err != nil {
+			return fmt.Errorf("program is not listening for patches: %v", err)
+		}
+		hp.ready = true
+	}
+
+	msg := make([]byte, hotPatchHeaderLen, hotPatchHeaderLen+len(code))
+	binary.LittleEndian.PutUint32(msg[0:], hotPatchMagic)
+	binary.LittleEndian.PutUint32(msg[4:], index)
+	binary.LittleEndian.PutUint64(msg[8:], hp.next)
+	binary.LittleEndian.PutUint64(msg[16:], uint64(len(code)))
+	msg = append(msg, code...)
+	hp.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := hp.conn.Write(msg); err != nil {
+		return err
+	}
+	if err := hp.expect(1, 2*time.Second); err != nil {
+		return fmt.Errorf("patch was not applied: %v", err)
+	}
+	hp.next = (hp.next + uint64(len(code)) + 15) &^ 15
+	return nil
+}
+
+// expect reads one byte from the program
+func (hp *HotPatcher) expect(want byte, timeout time.Duration) error {
+	hp.conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := []byte{0}
+	if _, err := io.ReadFull(hp.conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != want {
+		return fmt.Errorf("unexpected reply %d", buf[0])
+	}
+	return nil
+}
+
+// Close closes the connection to the program
+func (hp *HotPatcher) Close() error {
+	return hp.conn.Close()
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHotFunction(t *testing.T) {
+	program := NewParser("hot render = n -> n * 2\nprintln(render(2))\n").ParseProgram()
+	assign, ok := program.Statements[0].(*AssignStmt)
+	if !ok || !assign.IsHot || assign.Name != "render" {
+		t.Fatalf("expected a hot function definition, got %v", program.Statements[0])
+	}
+
+	tests := map[string]string{
+		"hot x = 42\n":                     "can only be used on function definitions",
+		"hot 3\n":                          "expected function name",
+		"outer = { hot inner = x -> x }\n": "must be defined at the top level",
+		"hot counter := x -> x\n":          "can only be used on function definitions",
+	}
+	for code, want := range tests {
+		p := NewParser(code)
+		func() {
+			defer func() { recover() }()
+			p.ParseProgram()
+		}()
+		if report := p.errors.Report(false); !strings.Contains(report, want) {
+			t.Errorf("%q: expected an error containing %q, got %q", code, want, report)
+		}
+	}
+}
+
+// rel32 encodes a call from offset in text to target
+func rel32(textAddr uint64, offset int, target uint64) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(int32(int64(target)-int64(textAddr+uint64(offset)+4))))
+	return b
+}
+
+func TestExtractFunctionCode(t *testing.T) {
+	// Both images: helper at 0, render at 16. render calls helper and uses a global and a string.
+	build := func(textAddr uint64, str string, globalAddr, strAddr uint64) *HotImage {
+		text := make([]byte, 40)
+		copy(text[0:], []byte{0x48, 0x31, 0xC0, 0xC3}) // helper: xor rax, rax; ret
+		text[16] = 0xE8                                // call helper
+		copy(text[17:], rel32(textAddr, 17, textAddr))
+		copy(text[21:], []byte{0x48, 0x8D, 0x05}) // lea rax, [rip+global]
+		copy(text[24:], rel32(textAddr, 24, globalAddr))
+		copy(text[28:], []byte{0x48, 0x8D, 0x35}) // lea rsi, [rip+str]
+		copy(text[31:], rel32(textAddr, 31, strAddr))
+		text[35] = 0xC3
+		return &HotImage{
+			TextAddr:  textAddr,
+			Text:      text,
+			Hot:       []string{"render"},
+			Functions: map[string]hotRange{"helper": {0, 16}, "render": {16, 36}},
+			Relocs:    []hotReloc{{17, "helper"}, {24, "_global_frames"}, {31, "str_0"}},
+			Symbols: map[string]uint64{
+				"helper": textAddr, "render": textAddr + 16,
+				"_global_frames": globalAddr, "str_0": strAddr,
+			},
+			Data: map[string]hotImageData{
+				"_global_frames": {Value: "\x00\x00\x00\x00\x00\x00\x00\x00", Writable: true},
+				"str_0":          {Value: str},
+			},
+		}
+	}
+	running := build(0x401000, "frame ", 0x400100, 0x400200)
+	edited := build(0x401020, "FRAME ", 0x400140, 0x400240)
+
+	const addr = hotPatchAreaAddr
+	code, err := ExtractFunctionCode(edited, running, "render", addr)
+	if err != nil {
+		t.Fatalf("ExtractFunctionCode failed: %v", err)
+	}
+	if len(code) != 32+len("FRAME ") {
+		t.Fatalf("expected the code followed by the new string, got %d bytes", len(code))
+	}
+	target := func(site int) uint64 {
+		return addr + uint64(site) + 4 + uint64(int64(int32(binary.LittleEndian.Uint32(code[site:]))))
+	}
+	if got := target(1); got != 0x401000 {
+		t.Errorf("call should go to the running helper at 0x401000, got 0x%x", got)
+	}
+	if got := target(8); got != 0x400100 {
+		t.Errorf("global should be the running one at 0x400100, got 0x%x", got)
+	}
+	if got := target(15); got != addr+32 || string(code[32:]) != "FRAME " {
+		t.Errorf("new string should be copied after the code, got 0x%x", got)
+	}
+
+	// A changed callee can not be patched in
+	edited.Text[0] = 0x90
+	if _, err := ExtractFunctionCode(edited, running, "render", addr); err == nil || !strings.Contains(err.Error(), "helper") {
+		t.Errorf("expected an error about the changed helper, got %v", err)
+	}
+	edited.Text[0] = 0x48
+
+	// New globals can not be patched in
+	delete(running.Data, "_global_frames")
+	if _, err := ExtractFunctionCode(edited, running, "render", addr); err == nil {
+		t.Error("expected an error about the new global")
+	}
+}
+
+func TestHotPatchRunningProgram(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("hot patching is only supported on x86-64 Linux")
+	}
+	t.Setenv("VIBE67_NOCACHE", "1")
+
+	program := `
+hot render = n -> {
+    print("frame ")
+    println(n)
+}
+frames := 0
+@ i in 0..<100000 {
+    frames <- frames + 1
+    render(frames)
+    spin := 0
+    @ j in 0..<1000000 {
+        spin <- spin + 1
+    }
+}
+`
+	tmpDir := t.TempDir()
+	compile := func(name, code string) *HotImage {
+		t.Helper()
+		srcPath := filepath.Join(tmpDir, name+".vibe67")
+		if err := os.WriteFile(srcPath, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := CompileC67(srcPath, filepath.Join(tmpDir, name), GetDefaultPlatform()); err != nil {
+			t.Fatalf("compilation failed: %v", err)
+		}
+		if lastHotImage == nil {
+			t.Fatal("no hot image was recorded")
+		}
+		return lastHotImage
+	}
+	running := compile("game", program)
+
+	patcher, next := startHotProgram(t, filepath.Join(tmpDir, "game"))
+	for next() != "frame 3" {
+	}
+
+	// Change the render function while the game loop runs
+	edited := compile("game2", strings.Replace(program, `print("frame ")`, `print("FRAME ")`, 1))
+	code, err := ExtractFunctionCode(edited, running, "render", patcher.Next())
+	if err != nil {
+		t.Fatalf("ExtractFunctionCode failed: %v", err)
+	}
+	if err := patcher.Push(running.HotIndex("render"), code); err != nil {
+		t.Fatalf("Push failed: %v", err)
+	}
+
+	// The frame counter keeps going, so the state survived the edit
+	frame := 3
+	for {
+		line := next()
+		frame++
+		if strings.HasPrefix(line, "FRAME ") {
+			if line != "FRAME "+strconv.Itoa(frame) {
+				t.Fatalf("expected FRAME %d after patching, got %q", frame, line)
+			}
+			break
+		}
+		if line != "frame "+strconv.Itoa(frame) {
+			t.Fatalf("expected frame %d, got %q", frame, line)
+		}
+	}
+}
+
+// startHotProgram runs a program connected to a hot patcher, and returns a
+// function that returns its next line of output
+func startHotProgram(t *testing.T, exePath string) (*HotPatcher, func() string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, patcher, err := launchHotProcess(exePath, w)
+	w.Close()
+	if err != nil {
+		r.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		process.Kill()
+		process.Wait()
+		patcher.Close()
+		r.Close()
+	})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("program exited early")
+			}
+			return line
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for output")
+		}
+		return ""
+	}
+	return patcher, next
+}
+
+func TestDataLayoutChanges(t *testing.T) {
+	old := dataLayouts(NewParser(`cstruct Tile {
+    kind as int32
+}
+cstruct Same {
+    x as float64
+}
+class Enemy {
+    init = hp -> {
+        .hp = hp
+    }
+}
+`).ParseProgram())
+	new := dataLayouts(NewParser(`cstruct Tile {
+    kind as int32,
+    height as float64
+}
+cstruct Same {
+    x as float64
+}
+cstruct Added {
+    y as uint8
+}
+class Enemy {
+    init = (hp, speed) -> {
+        .hp = hp
+        .speed = speed
+    }
+}
+`).ParseProgram())
+
+	changes := compareLayouts(old, new)
+	if len(changes) != 2 || changes[0].Name != "class Enemy" || changes[1].Name != "cstruct Tile" {
+		t.Fatalf("expected class Enemy and cstruct Tile to change, got %v", changes)
+	}
+	if changes[1].Old != "{ kind int32 @0 } size 4" || changes[1].New != "{ kind int32 @0, height float64 @8 } size 16" {
+		t.Errorf("unexpected cstruct layouts: %q -> %q", changes[1].Old, changes[1].New)
+	}
+	if changes[0].New != "{ .hp, .speed }" {
+		t.Errorf("unexpected class layout: %q", changes[0].New)
+	}
+
+	msg := (&LayoutChangeError{Changes: changes}).Error()
+	if !strings.Contains(msg, "cstruct Tile changed layout") || !strings.Contains(msg, "on_reload") {
+		t.Errorf("diagnostic should name the type and the migration hook, got:\n%s", msg)
+	}
+}
+
+func TestHotReloadMigratesState(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("hot patching is only supported on x86-64 Linux")
+	}
+	t.Setenv("VIBE67_NOCACHE", "1")
+
+	program := `cstruct Tile {
+    kind as int32
+}
+state := 7
+hot render = n -> {
+    print(n)
+    print(" ")
+    println(state)
+}
+frames := 0
+@ i in 0..<100000 {
+    frames <- frames + 1
+    render(frames)
+    spin := 0
+    @ j in 0..<1000000 {
+        spin <- spin + 1
+    }
+}
+`
+	tmpDir := t.TempDir()
+	srcPath := filepath.Join(tmpDir, "editor.vibe67")
+	exePath := filepath.Join(tmpDir, "editor")
+	edit := func(code string) {
+		t.Helper()
+		if err := os.WriteFile(srcPath, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edit(program)
+	is := NewIncrementalState(GetDefaultPlatform())
+	if err := is.InitialCompile(srcPath, exePath); err != nil {
+		t.Fatal(err)
+	}
+	patcher, next := startHotProgram(t, exePath)
+	for next() != "3 7" {
+	}
+
+	// Without on_reload, a layout change is refused
+	program = strings.Replace(program, "    kind as int32\n", "    kind as int32,\n    height as float64\n", 1)
+	edit(program)
+	updated, err := is.IncrementalRecompile(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layoutErr *LayoutChangeError
+	if err := is.HotPatch(patcher, updated); !errors.As(err, &layoutErr) {
+		t.Fatalf("expected the reload to be refused, got %v", err)
+	}
+
+	// With on_reload, the state is migrated before the new code runs
+	edit(strings.Replace(program, "state := 7\n", "state := 7\nhot on_reload = old_state -> old_state * 100\n", 1))
+	updated, err = is.IncrementalRecompile(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := is.HotPatch(patcher, updated); err != nil {
+		t.Fatalf("HotPatch failed: %v", err)
+	}
+	frame := 3
+	for {
+		line := next()
+		frame++
+		if line == strconv.Itoa(frame)+" 700" {
+			break
+		}
+		if line != strconv.Itoa(frame)+" 7" {
+			t.Fatalf("expected frame %d with the old or migrated state, got %q", frame, line)
+		}
+	}
+}
@@ -5,8 +5,8 @@
 package main
 
 import (
-	"debug/elf"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
@@ -144,52 +144,32 @@ func UpdateFunctionPointer(tableAddr uintptr, index int, newAddr uintptr) {
 	*ptr = newAddr
 }
 
-func ExtractFunctionCode(elfPath string, functionName string) ([]byte, error) {
-	elfFile, err := elf.Open(elfPath)
+// launchHotProcess starts a program with a socket to the watcher as fd 3,
+// which makes the program listen for hot function patches
+func launchHotProcess(binaryPath string, stdout *os.File) (*os.Process, *HotPatcher, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open ELF: %v", err)
+		return nil, nil, fmt.Errorf("socketpair failed: %v", err)
 	}
-	defer elfFile.Close()
+	syscall.CloseOnExec(fds[0])
+	watcherEnd := os.NewFile(uintptr(fds[0]), "vibe67-watcher")
+	programEnd := os.NewFile(uintptr(fds[1]), "vibe67-program")
+	defer programEnd.Close()
 
-	symbols, err := elfFile.Symbols()
+	conn, err := net.FileConn(watcherEnd)
+	watcherEnd.Close() // FileConn duplicates the descriptor
 	if err != nil {
-		return nil, fmt.Errorf("failed to read symbols: %v", err)
+		return nil, nil, err
 	}
 
-	var funcSym *elf.Symbol
-	for _, sym := range symbols {
-		if sym.Name == functionName && elf.ST_TYPE(sym.Info) == elf.STT_FUNC {
-			funcSym = &sym
-			break
-		}
-	}
-
-	if funcSym == nil {
-		return nil, fmt.Errorf("function '%s' not found in symbol table", functionName)
-	}
-
-	textSection := elfFile.Section(".text")
-	if textSection == nil {
-		return nil, fmt.Errorf(".text section not found")
-	}
-
-	textData, err := textSection.Data()
+	process, err := os.StartProcess(binaryPath, []string{binaryPath}, &os.ProcAttr{
+		Files: []*os.File{os.Stdin, stdout, os.Stderr, programEnd},
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read .text section: %v", err)
-	}
-
-	funcOffset := funcSym.Value - textSection.Addr
-	funcSize := funcSym.Size
-
-	if funcOffset+funcSize > uint64(len(textData)) {
-		return nil, fmt.Errorf("function bounds invalid: offset=%d, size=%d, text_size=%d",
-			funcOffset, funcSize, len(textData))
+		conn.Close()
+		return nil, nil, err
 	}
-
-	code := make([]byte, funcSize)
-	copy(code, textData[funcOffset:funcOffset+funcSize])
-
-	return code, nil
+	return process, NewHotPatcher(conn), nil
 }
 
 func (hrm *HotReloadManager) ReloadHotFunction(name string, code []byte, tableAddr uintptr, tableIndex int) error {
@@ -3,6 +3,16 @@
 
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
 func setupReloadSignal(recompile func(string)) {
 	// Windows doesn't support SIGUSR1, so we skip signal-based reload
 }
+
+func launchHotProcess(binaryPath string, stdout *os.File) (*os.Process, *HotPatcher, error) {
+	// Hot patching needs Unix sockets and SIGIO
+	return nil, nil, fmt.Errorf("hot patching is not supported on Windows")
+}
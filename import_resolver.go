@@ -124,12 +124,12 @@ func resolvePkgConfig(libName string) []string {
 
 // resolveSystemLibrary searches standard system library paths
 func resolveSystemLibrary(libName string) ([]string, error) {
-	standardPaths := []string{
+	standardPaths := cIncludePaths(
 		"./include",
 		"/usr/include",
 		"/usr/local/include",
 		"/opt/local/include",
-	}
+	)
 
 	for _, basePath := range standardPaths {
 		// Try direct header file
@@ -222,14 +222,8 @@ func resolveGitRepo(spec *ImportSpec) ([]string, error) {
 		repoURL = "https://" + repoURL
 	}
 
-	// Clone or update the repository
-	var repoPath string
-	var err error
-	if spec.Version != "" {
-		repoPath, err = EnsureRepoClonedWithVersion(repoURL, spec.Version, false)
-	} else {
-		repoPath, err = EnsureRepoCloned(repoURL, false)
-	}
+	// Use the vendored copy, or clone or update the repository (at the commit pinned in vibe67.lock, if any)
+	repoPath, err := ResolveModule(repoURL, spec.Version)
 	if err != nil {
 		return nil, err
 	}
@@ -268,7 +262,7 @@ func resolveDirectory(spec *ImportSpec) ([]string, error) {
 
 	// If it's a .vibe67 file, return it directly
 	if !info.IsDir() {
-		if strings.HasSuffix(dirPath, ".vibe67") {
+		if isVibeFile(dirPath) {
 			return []string{dirPath}, nil
 		}
 		return nil, fmt.Errorf("not a .vibe67 file or directory: %s", dirPath)
@@ -291,7 +285,7 @@ func findVibe67Files(dirPath string, topLevelOnly bool) ([]string, error) {
 		}
 
 		for _, entry := range entries {
-			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".vibe67") {
+			if !entry.IsDir() && isVibeFile(entry.Name()) {
 				// Exclude test files (test_*.vibe67) and generated files (_*.vibe67)
 				name := entry.Name()
 				if !strings.HasPrefix(name, "test_") && !strings.HasPrefix(name, "_") {
@@ -305,7 +299,7 @@ func findVibe67Files(dirPath string, topLevelOnly bool) ([]string, error) {
 			if err != nil {
 				return err
 			}
-			if !info.IsDir() && strings.HasSuffix(path, ".vibe67") {
+			if !info.IsDir() && isVibeFile(path) {
 				// Exclude test files (test_*.vibe67) and generated files (_*.vibe67)
 				baseName := filepath.Base(path)
 				if !strings.HasPrefix(baseName, "test_") && !strings.HasPrefix(baseName, "_") {
@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -19,6 +23,88 @@ type IncrementalState struct {
 	compiledBinary   []byte                  // the full compiled binary
 	platform         Platform                // target platform
 	lastBinaryPath   string                  // path to last compiled binary
+	runningImage     *HotImage               // code layout of the running program
+	latestImage      *HotImage               // code layout of the last recompilation
+	runningLayouts   map[string]string       // cstruct/class name -> data layout in the running program
+	latestLayouts    map[string]string       // cstruct/class name -> data layout in the last recompilation
+	layoutChanges    []LayoutChange          // layouts that differ between the running program and the last recompilation
+}
+
+// LayoutChange is a cstruct or class whose fields changed since the program was started
+type LayoutChange struct {
+	Name string
+	Old  string
+	New  string
+}
+
+func (lc LayoutChange) String() string {
+	return fmt.Sprintf("%s changed layout\n  old: %s\n  new: %s", lc.Name, lc.Old, lc.New)
+}
+
+// LayoutChangeError refuses a reload that changes data layouts without an on_reload migration
+type LayoutChangeError struct {
+	Changes []LayoutChange
+}
+
+func (e *LayoutChangeError) Error() string {
+	var sb strings.Builder
+	for _, change := range e.Changes {
+		sb.WriteString(change.String())
+		sb.WriteString("\n")
+	}
+	sb.WriteString("The running program still has data in the old layout, which the new code would misread.\n")
+	sb.WriteString("Define 'hot on_reload = old_state -> new_state' to migrate the global 'state', or restart the program.")
+	return sb.String()
+}
+
+// dataLayouts describes the memory layout of every cstruct and the fields of every class
+func dataLayouts(program *Program) map[string]string {
+	layouts := make(map[string]string)
+	thisField := regexp.MustCompile(`this\.([A-Za-z_][A-Za-z0-9_]*) (=|:=|<-) `)
+	for _, stmt := range program.Statements {
+		switch decl := stmt.(type) {
+		case *CStructDecl:
+			layout := *decl
+			layout.Fields = append([]CStructField(nil), decl.Fields...)
+			layout.CalculateStructLayout()
+			fields := make([]string, len(layout.Fields))
+			for i, field := range layout.Fields {
+				fields[i] = fmt.Sprintf("%s %s @%d", field.Name, field.Type, field.Offset)
+			}
+			layouts["cstruct "+decl.Name] = fmt.Sprintf("{ %s } size %d", strings.Join(fields, ", "), layout.Size)
+		case *ClassDecl:
+			// Class-level variables and the instance fields that init assigns
+			fieldSet := make(map[string]bool)
+			for name := range decl.ClassVars {
+				fieldSet[name] = true
+			}
+			if init, ok := decl.Methods["init"]; ok {
+				for _, m := range thisField.FindAllStringSubmatch(init.String(), -1) {
+					fieldSet["."+m[1]] = true
+				}
+			}
+			fields := make([]string, 0, len(fieldSet))
+			for name := range fieldSet {
+				fields = append(fields, name)
+			}
+			sort.Strings(fields)
+			layouts["class "+decl.Name] = "{ " + strings.Join(fields, ", ") + " }"
+		}
+	}
+	return layouts
+}
+
+// compareLayouts returns the cstructs and classes whose layout differs
+// Added and removed types hold no data in the old layout, so they are not changes.
+func compareLayouts(old, new map[string]string) []LayoutChange {
+	var changes []LayoutChange
+	for name, oldLayout := range old {
+		if newLayout, ok := new[name]; ok && newLayout != oldLayout {
+			changes = append(changes, LayoutChange{Name: name, Old: oldLayout, New: newLayout})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
 }
 
 // NewIncrementalState creates a new incremental compilation state
@@ -61,6 +147,7 @@ func (is *IncrementalState) InitialCompile(inputPath, outputPath string) error {
 	}
 	is.compiledBinary = binary
 	is.lastBinaryPath = outputPath
+	is.runningImage = lastHotImage
 
 	// Parse program to extract hot functions
 	parser := NewParserWithFilename(string(content), inputPath)
@@ -69,13 +156,24 @@ func (is *IncrementalState) InitialCompile(inputPath, outputPath string) error {
 
 	// Find all hot function definitions
 	is.extractHotFunctions(program, inputPath)
+	is.runningLayouts = dataLayouts(program)
+	is.latestLayouts = is.runningLayouts
 
 	return nil
 }
 
-// extractHotFunctions walks the AST and collects hot function definitions (DISABLED - hot keyword removed)
+// extractHotFunctions collects the hot function definitions of a file
 func (is *IncrementalState) extractHotFunctions(program *Program, filePath string) {
-	// Hot-reloading feature removed from language spec
+	for _, stmt := range program.Statements {
+		assign, ok := stmt.(*AssignStmt)
+		if !ok || !assign.IsHot {
+			continue
+		}
+		if lambda, ok := assign.Value.(*LambdaExpr); ok {
+			is.hotFunctions[assign.Name] = &FunctionDef{Name: assign.Name, Lambda: lambda}
+			is.hotFunctionFiles[assign.Name] = filePath
+		}
+	}
 }
 
 // FunctionDef represents a hot function definition
@@ -135,9 +233,33 @@ func (is *IncrementalState) IncrementalRecompile(changedPath string) ([]string,
 	// Extract new hot functions from the changed file
 	is.extractHotFunctions(program, changedPath)
 
-	// Find which hot functions actually changed or are new (DISABLED - hot keyword removed)
+	// Find which hot functions actually changed or are new
 	updatedFuncs := []string{}
-	// Hot-reloading feature removed from language spec
+	for funcName, def := range is.hotFunctions {
+		if is.hotFunctionFiles[funcName] != changedPath {
+			continue
+		}
+		if old, exists := oldHotFuncs[funcName]; !exists || old.Lambda.String() != def.Lambda.String() {
+			updatedFuncs = append(updatedFuncs, funcName)
+		}
+	}
+	for funcName := range oldHotFuncs {
+		if _, exists := is.hotFunctions[funcName]; !exists {
+			updatedFuncs = append(updatedFuncs, funcName) // removed
+		}
+	}
+	sort.Strings(updatedFuncs)
+
+	// Field offsets are compiled into the code, so a layout change updates every hot function
+	is.latestLayouts = dataLayouts(program)
+	is.layoutChanges = compareLayouts(is.runningLayouts, is.latestLayouts)
+	if len(is.layoutChanges) > 0 {
+		updatedFuncs = updatedFuncs[:0]
+		for funcName := range is.hotFunctions {
+			updatedFuncs = append(updatedFuncs, funcName)
+		}
+		sort.Strings(updatedFuncs)
+	}
 
 	if len(updatedFuncs) == 0 {
 		if VerboseMode {
@@ -159,14 +281,65 @@ func (is *IncrementalState) IncrementalRecompile(changedPath string) ([]string,
 		return nil, fmt.Errorf("failed to read recompiled binary: %v", err)
 	}
 	is.compiledBinary = binary
-
-	// Phase 4 will: Extract machine code for the updated hot functions
-	// Phase 4 will: Inject the new code into the running process
-	// For now, just return the list of updated function names
+	is.latestImage = lastHotImage
 
 	return updatedFuncs, nil
 }
 
+// HotPatch loads the recompiled code of the updated hot functions into the
+// running program. If that is not possible, the program must be restarted.
+func (is *IncrementalState) HotPatch(patcher *HotPatcher, updatedFuncs []string) error {
+	running, latest := is.runningImage, is.latestImage
+	if patcher == nil || running == nil || latest == nil {
+		return fmt.Errorf("the program does not support hot patching")
+	}
+	// The table layout is fixed when the program starts
+	if strings.Join(running.Hot, ",") != strings.Join(latest.Hot, ",") {
+		return fmt.Errorf("the set of hot functions changed")
+	}
+
+	// Data in a changed layout must be migrated before the new code sees it
+	migrate := len(is.layoutChanges) > 0
+	if migrate {
+		if _, ok := is.hotFunctions[hotReloadFunction]; !ok {
+			return &LayoutChangeError{Changes: is.layoutChanges}
+		}
+		if !slices.Contains(updatedFuncs, hotReloadFunction) {
+			updatedFuncs = append(updatedFuncs, hotReloadFunction)
+		}
+	}
+
+	for _, funcName := range updatedFuncs {
+		code, err := ExtractFunctionCode(latest, running, funcName, patcher.Next())
+		if err != nil {
+			return err
+		}
+		if migrate {
+			err = patcher.Stage(running.HotIndex(funcName), code)
+		} else {
+			err = patcher.Push(running.HotIndex(funcName), code)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if migrate {
+		if err := patcher.Migrate(); err != nil {
+			return err
+		}
+		is.runningLayouts = is.latestLayouts
+		is.layoutChanges = nil
+	}
+	return nil
+}
+
+// Restarted records that the program was restarted with the last recompilation
+func (is *IncrementalState) Restarted() {
+	is.runningImage = is.latestImage
+	is.runningLayouts = is.latestLayouts
+	is.layoutChanges = nil
+}
+
 // GetChangedFiles returns files that have been modified since last compilation
 func (is *IncrementalState) GetChangedFiles() ([]string, error) {
 	var changed []string
@@ -0,0 +1,724 @@
+// Completion: 85% - SSA IR, printer and verifier complete; the builder keeps unsupported constructs as opaque instructions
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The IR is a typed SSA form with basic blocks. BuildIR produces it from the
+// Program AST, and LowerIR turns it into machine code through a CodeGenerator.
+//
+// Every value is an instruction. Blocks start with their phis and end with
+// exactly one terminator (jump, branch or ret). Phi arguments are in the same
+// order as the predecessors of the block.
+
+// IRType is the type of an IR value
+type IRType int
+
+const (
+	IRVoid   IRType = iota
+	IRF64           // A Vibe67 number
+	IRBool          // The result of a comparison, 0 or 1
+	IRList          // The address of a list
+	IRMap           // The address of a map
+	IRString        // The address of a string
+)
+
+func (t IRType) String() string {
+	switch t {
+	case IRF64:
+		return "f64"
+	case IRBool:
+		return "bool"
+	case IRList:
+		return "list"
+	case IRMap:
+		return "map"
+	case IRString:
+		return "string"
+	default:
+		return "void"
+	}
+}
+
+// IsRef reports whether values of the type are the address of a container.
+// Lists, maps and strings all start with the same header (see ir_runtime.go).
+func (t IRType) IsRef() bool {
+	return t == IRList || t == IRMap || t == IRString
+}
+
+// IsValue reports whether the type can be held by a variable
+func (t IRType) IsValue() bool {
+	return t == IRF64 || t.IsRef()
+}
+
+// IROp is the operation of an IR instruction
+type IROp int
+
+const (
+	IROpConst       IROp = iota // f64 constant in Num
+	IROpString                  // the string constant in Str
+	IROpParam                   // function parameter number Index
+	IROpPhi                     // one argument per predecessor
+	IROpAdd                     // f64 arithmetic
+	IROpSub                     //
+	IROpMul                     //
+	IROpDiv                     //
+	IROpMod                     //
+	IROpNeg                     //
+	IROpEq                      // f64 comparisons, producing a bool
+	IROpNe                      //
+	IROpLt                      //
+	IROpLe                      //
+	IROpGt                      //
+	IROpGe                      //
+	IROpNot                     // bool negation
+	IROpBoolToF64               // 1.0 or 0.0
+	IROpLoadGlobal              // load the global Name
+	IROpStoreGlobal             // store the argument in the global Name
+	IROpCall                    // call the IR function Name
+	IROpPrint                   // print or println (Name) the argument
+	IROpExit                    // exit the program with the argument as status
+	IROpList                    // a new list of the arguments
+	IROpMap                     // a new map of the arguments, as keys and values in turn
+	IROpIndex                   // the element of a container at a key, or 0
+	IROpLength                  // the number of elements of a container
+	IROpAppend                  // a copy of a list with one more element
+	IROpPush                    // append in place to a list whose binding owns it, if the third argument is not 0
+	IROpSet                     // set a key of a map in place, returning the map
+	IROpConcat                  // a new string of two strings
+	IROpOpaque                  // a construct the IR does not model yet, with its source in Str
+	IROpJump                    // terminator: jump to Targets[0]
+	IROpBranch                  // terminator: if the argument then Targets[0] else Targets[1]
+	IROpReturn                  // terminator: return the argument
+)
+
+var irOpNames = map[IROp]string{
+	IROpConst:       "const",
+	IROpString:      "string",
+	IROpParam:       "param",
+	IROpPhi:         "phi",
+	IROpAdd:         "add",
+	IROpSub:         "sub",
+	IROpMul:         "mul",
+	IROpDiv:         "div",
+	IROpMod:         "mod",
+	IROpNeg:         "neg",
+	IROpEq:          "eq",
+	IROpNe:          "ne",
+	IROpLt:          "lt",
+	IROpLe:          "le",
+	IROpGt:          "gt",
+	IROpGe:          "ge",
+	IROpNot:         "not",
+	IROpBoolToF64:   "bool2f",
+	IROpLoadGlobal:  "load",
+	IROpStoreGlobal: "store",
+	IROpCall:        "call",
+	IROpPrint:       "print",
+	IROpExit:        "exit",
+	IROpList:        "list",
+	IROpMap:         "map",
+	IROpIndex:       "index",
+	IROpLength:      "len",
+	IROpAppend:      "append",
+	IROpPush:        "push",
+	IROpSet:         "set",
+	IROpConcat:      "concat",
+	IROpOpaque:      "opaque",
+	IROpJump:        "jump",
+	IROpBranch:      "branch",
+	IROpReturn:      "ret",
+}
+
+func (op IROp) String() string {
+	if name, ok := irOpNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("op%d", int(op))
+}
+
+// IsTerminator reports whether the operation ends a basic block
+func (op IROp) IsTerminator() bool {
+	return op == IROpJump || op == IROpBranch || op == IROpReturn
+}
+
+// IsArith reports whether the operation is binary f64 arithmetic
+func (op IROp) IsArith() bool {
+	return op >= IROpAdd && op <= IROpMod
+}
+
+// IsCompare reports whether the operation is an f64 comparison
+func (op IROp) IsCompare() bool {
+	return op >= IROpEq && op <= IROpGe
+}
+
+// HasSideEffects reports whether the instruction must be kept even if its value is unused
+func (op IROp) HasSideEffects() bool {
+	switch op {
+	case IROpStoreGlobal, IROpCall, IROpPrint, IROpExit, IROpOpaque, IROpPush, IROpSet:
+		return true
+	}
+	return op.IsTerminator()
+}
+
+// IRValue is an instruction and the value it produces
+type IRValue struct {
+	ID      int
+	Op      IROp
+	Type    IRType
+	Args    []*IRValue
+	Block   *IRBlock
+	Num     float64    // IROpConst
+	Index   int        // IROpParam
+	Name    string     // IROpLoadGlobal, IROpStoreGlobal, IROpCall, IROpPrint
+	Str     string     // IROpString, IROpOpaque
+	Targets []*IRBlock // terminators
+}
+
+// Ref returns the name the value is referred to by
+func (v *IRValue) Ref() string {
+	return "v" + strconv.Itoa(v.ID)
+}
+
+func (v *IRValue) String() string {
+	var out strings.Builder
+	if v.Type != IRVoid {
+		fmt.Fprintf(&out, "%s = %s ", v.Ref(), v.Type)
+	}
+	out.WriteString(v.Op.String())
+	var operands []string
+	switch v.Op {
+	case IROpConst:
+		operands = append(operands, strconv.FormatFloat(v.Num, 'g', -1, 64))
+	case IROpString, IROpOpaque:
+		operands = append(operands, strconv.Quote(v.Str))
+	case IROpParam:
+		operands = append(operands, strconv.Itoa(v.Index))
+	case IROpLoadGlobal, IROpStoreGlobal, IROpCall:
+		operands = append(operands, "@"+v.Name)
+	case IROpPrint:
+		out.Reset()
+		out.WriteString(v.Name)
+	}
+	for i, arg := range v.Args {
+		if v.Op == IROpPhi && i < len(v.Block.Preds) {
+			operands = append(operands, fmt.Sprintf("[%s, %s]", arg.Ref(), v.Block.Preds[i].Ref()))
+		} else {
+			operands = append(operands, arg.Ref())
+		}
+	}
+	for _, target := range v.Targets {
+		operands = append(operands, target.Ref())
+	}
+	if len(operands) > 0 {
+		out.WriteString(" ")
+		out.WriteString(strings.Join(operands, ", "))
+	}
+	return out.String()
+}
+
+// IRBlock is a basic block
+type IRBlock struct {
+	ID     int
+	Values []*IRValue
+	Preds  []*IRBlock
+	Succs  []*IRBlock
+	Func   *IRFunction
+}
+
+// Ref returns the name the block is referred to by
+func (b *IRBlock) Ref() string {
+	return "b" + strconv.Itoa(b.ID)
+}
+
+// Terminator returns the last instruction of the block, if it is a terminator
+func (b *IRBlock) Terminator() *IRValue {
+	if len(b.Values) == 0 {
+		return nil
+	}
+	if last := b.Values[len(b.Values)-1]; last.Op.IsTerminator() {
+		return last
+	}
+	return nil
+}
+
+// IRFunction is a function made of basic blocks. The first block is the entry.
+type IRFunction struct {
+	Name      string
+	Params    []string
+	Blocks    []*IRBlock
+	nextValue int
+	nextBlock int
+}
+
+// NewBlock adds an empty block to the function
+func (f *IRFunction) NewBlock() *IRBlock {
+	b := &IRBlock{ID: f.nextBlock, Func: f}
+	f.nextBlock++
+	f.Blocks = append(f.Blocks, b)
+	return b
+}
+
+// NewValue appends an instruction to a block
+func (f *IRFunction) NewValue(b *IRBlock, op IROp, typ IRType, args ...*IRValue) *IRValue {
+	v := &IRValue{ID: f.nextValue, Op: op, Type: typ, Args: args, Block: b}
+	f.nextValue++
+	b.Values = append(b.Values, v)
+	return v
+}
+
+// AddEdge records that control can flow from one block to another
+func AddEdge(from, to *IRBlock) {
+	from.Succs = append(from.Succs, to)
+	to.Preds = append(to.Preds, from)
+}
+
+// Renumber puts the blocks in reverse postorder and numbers the blocks and
+// values in that order
+func (f *IRFunction) Renumber() {
+	var order []*IRBlock
+	visited := make(map[*IRBlock]bool)
+	var visit func(b *IRBlock)
+	visit = func(b *IRBlock) {
+		visited[b] = true
+		for _, s := range b.Succs {
+			if !visited[s] {
+				visit(s)
+			}
+		}
+		order = append(order, b)
+	}
+	visit(f.Blocks[0])
+	for _, b := range f.Blocks {
+		if !visited[b] {
+			visit(b)
+		}
+	}
+	slices.Reverse(order)
+	f.Blocks = order
+	f.nextBlock, f.nextValue = 0, 0
+	for _, b := range f.Blocks {
+		b.ID = f.nextBlock
+		f.nextBlock++
+		for _, v := range b.Values {
+			if v.Type != IRVoid {
+				v.ID = f.nextValue
+				f.nextValue++
+			}
+		}
+	}
+}
+
+func (f *IRFunction) String() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "func %s(%s) {\n", f.Name, strings.Join(f.Params, ", "))
+	for _, b := range f.Blocks {
+		out.WriteString(b.Ref() + ":")
+		if len(b.Preds) > 0 {
+			preds := make([]string, len(b.Preds))
+			for i, p := range b.Preds {
+				preds[i] = p.Ref()
+			}
+			out.WriteString(" ; preds " + strings.Join(preds, ", "))
+		}
+		out.WriteString("\n")
+		for _, v := range b.Values {
+			out.WriteString("    " + v.String() + "\n")
+		}
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
+
+// IRModule is a whole program. The first function is main.
+type IRModule struct {
+	Functions []*IRFunction
+	Globals   []string
+}
+
+// Function returns the function with the given name, or nil
+func (m *IRModule) Function(name string) *IRFunction {
+	for _, f := range m.Functions {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Opaque returns the opaque instructions, which can not be lowered
+func (m *IRModule) Opaque() []*IRValue {
+	var result []*IRValue
+	for _, f := range m.Functions {
+		for _, b := range f.Blocks {
+			for _, v := range b.Values {
+				if v.Op == IROpOpaque {
+					result = append(result, v)
+				}
+			}
+		}
+	}
+	return result
+}
+
+func (m *IRModule) String() string {
+	var out strings.Builder
+	for _, g := range m.Globals {
+		fmt.Fprintf(&out, "global @%s\n", g)
+	}
+	for i, f := range m.Functions {
+		if i > 0 || len(m.Globals) > 0 {
+			out.WriteString("\n")
+		}
+		out.WriteString(f.String())
+	}
+	return out.String()
+}
+
+// Dominators returns the immediate dominator of every block reachable from the
+// entry. The entry block is its own immediate dominator.
+func (f *IRFunction) Dominators() map[*IRBlock]*IRBlock {
+	// Cooper, Harvey and Kennedy: "A Simple, Fast Dominance Algorithm"
+	var order []*IRBlock
+	visited := make(map[*IRBlock]bool)
+	var visit func(b *IRBlock)
+	visit = func(b *IRBlock) {
+		visited[b] = true
+		for _, s := range b.Succs {
+			if !visited[s] {
+				visit(s)
+			}
+		}
+		order = append(order, b)
+	}
+	if len(f.Blocks) == 0 {
+		return nil
+	}
+	visit(f.Blocks[0])
+	postorder := make(map[*IRBlock]int, len(order))
+	for i, b := range order {
+		postorder[b] = i
+	}
+
+	idom := map[*IRBlock]*IRBlock{f.Blocks[0]: f.Blocks[0]}
+	intersect := func(a, b *IRBlock) *IRBlock {
+		for a != b {
+			for postorder[a] < postorder[b] {
+				a = idom[a]
+			}
+			for postorder[b] < postorder[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(order) - 2; i >= 0; i-- {
+			b := order[i]
+			var newIdom *IRBlock
+			for _, p := range b.Preds {
+				if idom[p] == nil {
+					continue
+				}
+				if newIdom == nil {
+					newIdom = p
+				} else {
+					newIdom = intersect(p, newIdom)
+				}
+			}
+			if idom[b] != newIdom {
+				idom[b] = newIdom
+				changed = true
+			}
+		}
+	}
+	return idom
+}
+
+// Dominates reports whether a dominates b, given the result of Dominators
+func Dominates(idom map[*IRBlock]*IRBlock, a, b *IRBlock) bool {
+	for {
+		if a == b {
+			return true
+		}
+		parent, ok := idom[b]
+		if !ok || parent == b {
+			return false
+		}
+		b = parent
+	}
+}
+
+// Verify checks that the module is well formed: every block ends in a
+// terminator, the CFG edges agree with the terminators, phis match the
+// predecessors, operands have the right types and every definition dominates
+// its uses.
+func (m *IRModule) Verify() error {
+	functions := make(map[string]*IRFunction)
+	for _, f := range m.Functions {
+		functions[f.Name] = f
+	}
+	globals := make(map[string]bool)
+	for _, g := range m.Globals {
+		globals[g] = true
+	}
+	for _, f := range m.Functions {
+		if err := f.verify(functions, globals); err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+	}
+	return m.verifyGlobalTypes()
+}
+
+// verifyGlobalTypes checks that every global holds values of one type
+func (m *IRModule) verifyGlobalTypes() error {
+	types := make(map[string]IRType)
+	for _, f := range m.Functions {
+		for _, b := range f.Blocks {
+			for _, v := range b.Values {
+				var typ IRType
+				switch v.Op {
+				case IROpLoadGlobal:
+					typ = v.Type
+				case IROpStoreGlobal:
+					typ = v.Args[0].Type
+				default:
+					continue
+				}
+				if seen, ok := types[v.Name]; ok && seen != typ {
+					return fmt.Errorf("%s: global @%s holds both %s and %s", f.Name, v.Name, seen, typ)
+				}
+				types[v.Name] = typ
+			}
+		}
+	}
+	return nil
+}
+
+func (f *IRFunction) verify(functions map[string]*IRFunction, globals map[string]bool) error {
+	if len(f.Blocks) == 0 {
+		return fmt.Errorf("function has no blocks")
+	}
+	inFunc := make(map[*IRBlock]bool)
+	for _, b := range f.Blocks {
+		inFunc[b] = true
+	}
+	idom := f.Dominators()
+	position := make(map[*IRValue]int)
+	for _, b := range f.Blocks {
+		for i, v := range b.Values {
+			position[v] = i
+		}
+	}
+
+	for _, b := range f.Blocks {
+		term := b.Terminator()
+		if term == nil {
+			return fmt.Errorf("%s does not end in a terminator", b.Ref())
+		}
+		if len(term.Targets) != len(b.Succs) {
+			return fmt.Errorf("%s: %s does not match the successors", b.Ref(), term.Op)
+		}
+		for i, s := range b.Succs {
+			if term.Targets[i] != s || !inFunc[s] {
+				return fmt.Errorf("%s: successor %s does not match the terminator", b.Ref(), s.Ref())
+			}
+			if countBlocks(s.Preds, b) != countBlocks(b.Succs, s) {
+				return fmt.Errorf("%s is missing from the predecessors of %s", b.Ref(), s.Ref())
+			}
+		}
+		for _, p := range b.Preds {
+			if !inFunc[p] || countBlocks(p.Succs, b) == 0 {
+				return fmt.Errorf("%s: predecessor %s does not jump here", b.Ref(), p.Ref())
+			}
+		}
+
+		seenNonPhi := false
+		for i, v := range b.Values {
+			if v.Block != b {
+				return fmt.Errorf("%s: %s belongs to another block", b.Ref(), v.Ref())
+			}
+			if v.Op.IsTerminator() && i != len(b.Values)-1 {
+				return fmt.Errorf("%s: %s in the middle of the block", b.Ref(), v.Op)
+			}
+			if v.Op == IROpPhi {
+				if seenNonPhi {
+					return fmt.Errorf("%s: phi %s after other instructions", b.Ref(), v.Ref())
+				}
+				if len(v.Args) != len(b.Preds) {
+					return fmt.Errorf("%s: phi %s has %d arguments for %d predecessors", b.Ref(), v.Ref(), len(v.Args), len(b.Preds))
+				}
+			} else {
+				seenNonPhi = true
+			}
+			if err := v.checkTypes(f, functions, globals); err != nil {
+				return fmt.Errorf("%s: %s: %v", b.Ref(), v.Ref(), err)
+			}
+
+			// Definitions must dominate their uses. A phi argument is used at
+			// the end of the matching predecessor.
+			if _, reachable := idom[b]; !reachable {
+				continue
+			}
+			for j, arg := range v.Args {
+				if arg.Block == nil || !inFunc[arg.Block] {
+					return fmt.Errorf("%s: %s uses %s from another function", b.Ref(), v.Ref(), arg.Ref())
+				}
+				useBlock := b
+				if v.Op == IROpPhi {
+					useBlock = b.Preds[j]
+				}
+				if !Dominates(idom, arg.Block, useBlock) {
+					return fmt.Errorf("%s: %s uses %s, which does not dominate it", b.Ref(), v.Ref(), arg.Ref())
+				}
+				if arg.Block == useBlock && v.Op != IROpPhi && position[arg] >= i {
+					return fmt.Errorf("%s: %s uses %s before it is defined", b.Ref(), v.Ref(), arg.Ref())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func countBlocks(blocks []*IRBlock, b *IRBlock) int {
+	n := 0
+	for _, x := range blocks {
+		if x == b {
+			n++
+		}
+	}
+	return n
+}
+
+// checkTypes checks the operand and result types of one instruction
+func (v *IRValue) checkTypes(f *IRFunction, functions map[string]*IRFunction, globals map[string]bool) error {
+	want := func(typ IRType, args ...IRType) error {
+		if v.Type != typ {
+			return fmt.Errorf("%s should be %s, not %s", v.Op, typ, v.Type)
+		}
+		if len(v.Args) != len(args) {
+			return fmt.Errorf("%s takes %d operands, not %d", v.Op, len(args), len(v.Args))
+		}
+		for i, arg := range v.Args {
+			if arg.Type != args[i] {
+				return fmt.Errorf("operand %d of %s should be %s, not %s", i+1, v.Op, args[i], arg.Type)
+			}
+		}
+		return nil
+	}
+	switch {
+	case v.Op.IsArith():
+		return want(IRF64, IRF64, IRF64)
+	case v.Op.IsCompare():
+		return want(IRBool, IRF64, IRF64)
+	}
+	switch v.Op {
+	case IROpConst:
+		return want(IRF64)
+	case IROpOpaque:
+		if v.Type != IRVoid && !v.Type.IsValue() {
+			return fmt.Errorf("opaque can not be %s", v.Type)
+		}
+		return want(v.Type)
+	case IROpString:
+		return want(IRString)
+	case IROpParam:
+		if v.Index < 0 || v.Index >= len(f.Params) {
+			return fmt.Errorf("no parameter %d", v.Index)
+		}
+		return want(IRF64)
+	case IROpPhi:
+		if v.Type == IRVoid {
+			return fmt.Errorf("phi can not be void")
+		}
+		for i, arg := range v.Args {
+			if arg.Type != v.Type {
+				return fmt.Errorf("phi argument %d is %s, not %s", i+1, arg.Type, v.Type)
+			}
+		}
+		return nil
+	case IROpNeg:
+		return want(IRF64, IRF64)
+	case IROpNot:
+		return want(IRBool, IRBool)
+	case IROpBoolToF64:
+		return want(IRF64, IRBool)
+	case IROpLoadGlobal, IROpStoreGlobal:
+		if !globals[v.Name] {
+			return fmt.Errorf("unknown global @%s", v.Name)
+		}
+		if v.Op == IROpLoadGlobal {
+			if !v.Type.IsValue() {
+				return fmt.Errorf("load can not be %s", v.Type)
+			}
+			return want(v.Type)
+		}
+		if len(v.Args) == 1 && v.Args[0].Type.IsValue() {
+			return want(IRVoid, v.Args[0].Type)
+		}
+		return want(IRVoid, IRF64)
+	case IROpCall:
+		callee, ok := functions[v.Name]
+		if !ok {
+			return fmt.Errorf("unknown function @%s", v.Name)
+		}
+		args := make([]IRType, len(callee.Params))
+		for i := range args {
+			args[i] = IRF64
+		}
+		return want(IRF64, args...)
+	case IROpPrint:
+		if v.Name != "print" && v.Name != "println" {
+			return fmt.Errorf("unknown print function %q", v.Name)
+		}
+		if len(v.Args) == 1 && v.Args[0].Type == IRString {
+			return want(IRVoid, IRString)
+		}
+		return want(IRVoid, IRF64)
+	case IROpExit:
+		return want(IRVoid, IRF64)
+	case IROpList:
+		args := make([]IRType, len(v.Args))
+		for i := range args {
+			args[i] = IRF64
+		}
+		return want(IRList, args...)
+	case IROpMap:
+		if len(v.Args)%2 != 0 {
+			return fmt.Errorf("map takes keys and values in pairs")
+		}
+		args := make([]IRType, len(v.Args))
+		for i := range args {
+			args[i] = IRF64
+		}
+		return want(IRMap, args...)
+	case IROpIndex, IROpLength:
+		if len(v.Args) == 0 || !v.Args[0].Type.IsRef() {
+			return fmt.Errorf("%s takes a list, map or string", v.Op)
+		}
+		if v.Op == IROpLength {
+			return want(IRF64, v.Args[0].Type)
+		}
+		return want(IRF64, v.Args[0].Type, IRF64)
+	case IROpAppend:
+		return want(IRList, IRList, IRF64)
+	case IROpPush:
+		return want(IRList, IRList, IRF64, IRF64)
+	case IROpSet:
+		return want(IRMap, IRMap, IRF64, IRF64)
+	case IROpConcat:
+		return want(IRString, IRString, IRString)
+	case IROpJump:
+		return want(IRVoid)
+	case IROpBranch:
+		return want(IRVoid, IRBool)
+	case IROpReturn:
+		return want(IRVoid, IRF64)
+	}
+	return fmt.Errorf("unknown operation %s", v.Op)
+}
@@ -0,0 +1,1115 @@
+// Completion: 85% - Numbers, strings, lists, maps, variables, loops, matches and top-level functions; the rest is kept opaque
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+)
+
+// BuildIR translates a program into SSA form. Top-level statements become the
+// function main, and top-level function definitions become functions of their
+// own. Top-level variables used by functions become globals. A function bound
+// to main is called once the top-level statements have run, and its result is
+// the exit status, as with the AST code generator; without one, the last
+// number the top-level statements compute is the exit status. Constructs that the IR does
+// not model yet become opaque instructions, so that -emit-ir can show every
+// program.
+//
+// Every variable holds values of one type. Numbers, lists, maps and strings
+// are told apart when the IR is built, the way the AST code generator tells
+// them apart with getExprType, and a variable that is given values of two
+// types is kept opaque.
+//
+// SSA is constructed on the fly, as described in Braun et al. "Simple and
+// Efficient Construction of Static Single Assignment Form": variables are read
+// per block, and phis are added when a block has several predecessors. Blocks
+// are sealed once all their predecessors are known.
+func BuildIR(program *Program) *IRModule {
+	b := &irBuilder{
+		mod:       &IRModule{},
+		functions: make(map[string]*LambdaExpr),
+		topVars:   make(map[string]bool),
+		topKinds:  make(map[string]IRType),
+		globals:   make(map[string]bool),
+		ownership: newListOwnership(program),
+	}
+
+	var order []string
+	for _, stmt := range program.Statements {
+		assign, ok := stmt.(*AssignStmt)
+		if !ok {
+			continue
+		}
+		if lambda, ok := assign.Value.(*LambdaExpr); ok && !assign.IsUpdate && lambda.VariadicParam == "" {
+			if _, seen := b.functions[assign.Name]; !seen {
+				order = append(order, assign.Name)
+			}
+			b.functions[assign.Name] = lambda
+		} else {
+			b.topVars[assign.Name] = true
+		}
+	}
+
+	// Functions load top-level variables before main has assigned them, so
+	// their types come from the first assignment
+	for _, stmt := range program.Statements {
+		if assign, ok := stmt.(*AssignStmt); ok && b.topVars[assign.Name] {
+			if _, seen := b.topKinds[assign.Name]; !seen {
+				b.topKinds[assign.Name] = b.staticKind(assign.Value)
+			}
+		}
+	}
+
+	// Build main first, so that it becomes the entry point, but fill it in
+	// last, once the functions have decided which variables are globals.
+	main := &IRFunction{Name: "main"}
+	b.mod.Functions = append(b.mod.Functions, main)
+	for _, name := range order {
+		b.buildFunction(name, b.functions[name])
+	}
+
+	b.begin(main, nil)
+	result := b.constant(0)
+	for _, stmt := range program.Statements {
+		if v := b.topLevel(stmt); v != nil {
+			result = v
+		}
+	}
+	if b.block != nil {
+		switch {
+		case b.functions["main"] != nil:
+			call := &CallExpr{Function: "main"}
+			b.ret(b.toF64(b.call(call), call))
+		case b.topVars["main"]:
+			ident := &IdentExpr{Name: "main"}
+			b.ret(b.toF64(b.expression(ident), ident))
+		default:
+			b.ret(result)
+		}
+	}
+	b.finish()
+
+	for g := range b.globals {
+		b.mod.Globals = append(b.mod.Globals, g)
+	}
+	sort.Strings(b.mod.Globals)
+	return b.mod
+}
+
+type irBuilder struct {
+	mod       *IRModule
+	functions map[string]*LambdaExpr // top-level function definitions
+	topVars   map[string]bool        // top-level variables
+	topKinds  map[string]IRType      // the types of the top-level variables
+	globals   map[string]bool        // top-level variables used by functions
+	ownership *ListOwnership         // the appends that may extend a list in place
+
+	fn         *IRFunction
+	block      *IRBlock // nil after a terminator
+	locals     map[string]bool
+	kinds      map[string]IRType // the types of the variables of fn
+	defs       map[*IRBlock]map[string]*IRValue
+	sealed     map[*IRBlock]bool
+	incomplete map[*IRBlock]map[string]*IRValue
+	loops      []irLoop
+}
+
+type irLoop struct {
+	next *IRBlock // where @N continues
+	exit *IRBlock // where ret @N goes
+}
+
+// irFunctionName is the name of the IR function for a top-level function.
+// The entry point is called main, so a function bound to main is renamed.
+func irFunctionName(name string) string {
+	if name == "main" {
+		return "main.lambda"
+	}
+	return name
+}
+
+func (b *irBuilder) buildFunction(name string, lambda *LambdaExpr) {
+	fn := &IRFunction{Name: irFunctionName(name), Params: lambda.Params}
+	b.mod.Functions = append(b.mod.Functions, fn)
+	b.begin(fn, lambda.Params)
+	result := b.expression(lambda.Body)
+	if b.block != nil {
+		b.ret(b.toF64(result, lambda.Body))
+	}
+	b.finish()
+}
+
+// begin starts building a function
+func (b *irBuilder) begin(fn *IRFunction, params []string) {
+	b.fn = fn
+	b.locals = make(map[string]bool)
+	b.kinds = make(map[string]IRType)
+	b.defs = make(map[*IRBlock]map[string]*IRValue)
+	b.sealed = make(map[*IRBlock]bool)
+	b.incomplete = make(map[*IRBlock]map[string]*IRValue)
+	b.loops = nil
+	b.block = fn.NewBlock()
+	b.seal(b.block)
+	for i, p := range params {
+		param := fn.NewValue(b.block, IROpParam, IRF64)
+		param.Index = i
+		b.locals[p] = true
+		b.kinds[p] = IRF64
+		b.write(p, b.block, param)
+	}
+}
+
+// finish removes the blocks that can not be reached and the phis that turned
+// out to be unnecessary, and numbers the rest in reverse postorder
+func (b *irBuilder) finish() {
+	fn := b.fn
+	reachable := make(map[*IRBlock]bool)
+	var visit func(blk *IRBlock)
+	visit = func(blk *IRBlock) {
+		reachable[blk] = true
+		for _, s := range blk.Succs {
+			if !reachable[s] {
+				visit(s)
+			}
+		}
+	}
+	visit(fn.Blocks[0])
+
+	var kept []*IRBlock
+	for _, blk := range fn.Blocks {
+		if reachable[blk] {
+			kept = append(kept, blk)
+			continue
+		}
+		for _, s := range blk.Succs {
+			removePred(s, blk)
+		}
+	}
+	fn.Blocks = kept
+	for _, blk := range fn.Blocks {
+		for _, v := range slices.Clone(blk.Values) {
+			if v.Op == IROpPhi && slices.Contains(blk.Values, v) {
+				b.tryRemoveTrivialPhi(v)
+			}
+		}
+	}
+	fn.Renumber()
+}
+
+// removePred removes an edge into a block, along with the matching phi arguments
+func removePred(blk, pred *IRBlock) {
+	for i := 0; i < len(blk.Preds); i++ {
+		if blk.Preds[i] != pred {
+			continue
+		}
+		blk.Preds = append(blk.Preds[:i], blk.Preds[i+1:]...)
+		for _, v := range blk.Values {
+			if v.Op == IROpPhi && i < len(v.Args) {
+				v.Args = append(v.Args[:i], v.Args[i+1:]...)
+			}
+		}
+		i--
+	}
+}
+
+// ===== Variables =====
+
+func (b *irBuilder) write(name string, blk *IRBlock, v *IRValue) {
+	if b.defs[blk] == nil {
+		b.defs[blk] = make(map[string]*IRValue)
+	}
+	b.defs[blk][name] = v
+}
+
+func (b *irBuilder) read(name string, blk *IRBlock) *IRValue {
+	if v, ok := b.defs[blk][name]; ok {
+		return v
+	}
+	var v *IRValue
+	switch {
+	case !b.sealed[blk]:
+		v = b.newPhi(blk, b.kind(name))
+		if b.incomplete[blk] == nil {
+			b.incomplete[blk] = make(map[string]*IRValue)
+		}
+		b.incomplete[blk][name] = v
+	case len(blk.Preds) == 0:
+		// Read before any assignment, such as in code that can not be reached
+		v = b.zeroIn(blk, b.kind(name), name)
+	case len(blk.Preds) == 1:
+		v = b.read(name, blk.Preds[0])
+	default:
+		phi := b.newPhi(blk, b.kind(name))
+		b.write(name, blk, phi)
+		v = b.addPhiOperands(name, phi)
+	}
+	b.write(name, blk, v)
+	return v
+}
+
+// kind returns the type of a local variable, which is a number until it is
+// assigned something else
+func (b *irBuilder) kind(name string) IRType {
+	if typ, ok := b.kinds[name]; ok {
+		return typ
+	}
+	b.kinds[name] = IRF64
+	return IRF64
+}
+
+func (b *irBuilder) newPhi(blk *IRBlock, typ IRType) *IRValue {
+	phi := &IRValue{ID: b.fn.nextValue, Op: IROpPhi, Type: typ, Block: blk}
+	b.fn.nextValue++
+	blk.Values = append([]*IRValue{phi}, blk.Values...)
+	return phi
+}
+
+func (b *irBuilder) addPhiOperands(name string, phi *IRValue) *IRValue {
+	for _, pred := range phi.Block.Preds {
+		phi.Args = append(phi.Args, b.read(name, pred))
+	}
+	return b.tryRemoveTrivialPhi(phi)
+}
+
+// tryRemoveTrivialPhi replaces a phi whose arguments are all the same value
+// (or the phi itself) with that value
+func (b *irBuilder) tryRemoveTrivialPhi(phi *IRValue) *IRValue {
+	var same *IRValue
+	for _, arg := range phi.Args {
+		if arg == same || arg == phi {
+			continue
+		}
+		if same != nil {
+			return phi
+		}
+		same = arg
+	}
+	if same == nil {
+		// Only reachable through the phi itself
+		same = b.zeroIn(b.fn.Blocks[0], phi.Type, "")
+	}
+
+	blk := phi.Block
+	for i, v := range blk.Values {
+		if v == phi {
+			blk.Values = append(blk.Values[:i], blk.Values[i+1:]...)
+			break
+		}
+	}
+	var users []*IRValue
+	for _, other := range b.fn.Blocks {
+		for _, v := range other.Values {
+			for i, arg := range v.Args {
+				if arg == phi {
+					v.Args[i] = same
+					if v.Op == IROpPhi && v != phi {
+						users = append(users, v)
+					}
+				}
+			}
+		}
+	}
+	for _, vars := range b.defs {
+		for name, v := range vars {
+			if v == phi {
+				vars[name] = same
+			}
+		}
+	}
+	for _, vars := range b.incomplete {
+		for name, v := range vars {
+			if v == phi {
+				vars[name] = same
+			}
+		}
+	}
+	for _, user := range users {
+		if user.Block != nil && slices.Contains(user.Block.Values, user) {
+			b.tryRemoveTrivialPhi(user)
+		}
+	}
+	return same
+}
+
+func (b *irBuilder) seal(blk *IRBlock) {
+	for name, phi := range b.incomplete[blk] {
+		if phi.Op == IROpPhi && slices.Contains(blk.Values, phi) {
+			b.addPhiOperands(name, phi)
+		}
+	}
+	delete(b.incomplete, blk)
+	b.sealed[blk] = true
+}
+
+// readVar reads a local or global variable
+func (b *irBuilder) readVar(name string) *IRValue {
+	if b.isGlobal(name) {
+		b.globals[name] = true
+		v := b.emit(IROpLoadGlobal, b.globalKind(name))
+		v.Name = name
+		return v
+	}
+	return b.read(name, b.block)
+}
+
+// writeVar assigns a local or global variable. A value of another type than
+// the variable holds is kept opaque.
+func (b *irBuilder) writeVar(name string, v *IRValue, define bool) {
+	if !define && b.isGlobal(name) {
+		b.globals[name] = true
+		if typ := b.globalKind(name); v.Type != typ {
+			v = b.opaqueValue(name, typ)
+		}
+		store := b.emit(IROpStoreGlobal, IRVoid, v)
+		store.Name = name
+		return
+	}
+	if typ, ok := b.kinds[name]; ok && typ != v.Type {
+		v = b.opaqueValue(name, typ)
+	}
+	b.kinds[name] = v.Type
+	b.locals[name] = true
+	b.write(name, b.block, v)
+}
+
+func (b *irBuilder) globalKind(name string) IRType {
+	if typ, ok := b.topKinds[name]; ok {
+		return typ
+	}
+	return IRF64
+}
+
+// staticKind returns the type of the value of an expression, as far as it
+// can be told without building it
+func (b *irBuilder) staticKind(expr Expression) IRType {
+	switch e := expr.(type) {
+	case *ListExpr:
+		return IRList
+	case *MapExpr:
+		return IRMap
+	case *StringExpr:
+		return IRString
+	case *IdentExpr:
+		return b.globalKind(e.Name)
+	case *CallExpr:
+		if e.Function == "append" {
+			return IRList
+		}
+	case *BinaryExpr:
+		if e.Operator == "+" && b.staticKind(e.Left) == IRString {
+			return IRString
+		}
+	}
+	return IRF64
+}
+
+// isGlobal reports whether a variable lives in memory rather than in SSA values
+func (b *irBuilder) isGlobal(name string) bool {
+	if b.locals[name] {
+		return false
+	}
+	if b.fn.Name == "main" {
+		return b.globals[name]
+	}
+	return b.topVars[name]
+}
+
+// ===== Instructions =====
+
+func (b *irBuilder) emit(op IROp, typ IRType, args ...*IRValue) *IRValue {
+	if b.block == nil {
+		// Code after ret or a loop jump can not be reached, but is still built
+		b.block = b.fn.NewBlock()
+		b.seal(b.block)
+	}
+	return b.fn.NewValue(b.block, op, typ, args...)
+}
+
+func (b *irBuilder) constant(n float64) *IRValue {
+	v := b.emit(IROpConst, IRF64)
+	v.Num = n
+	return v
+}
+
+func (b *irBuilder) constantIn(blk *IRBlock, n float64) *IRValue {
+	v := b.insertIn(blk, IROpConst, IRF64)
+	v.Num = n
+	return v
+}
+
+// insertIn adds an instruction to a block, after its phis
+func (b *irBuilder) insertIn(blk *IRBlock, op IROp, typ IRType) *IRValue {
+	v := &IRValue{ID: b.fn.nextValue, Op: op, Type: typ, Block: blk}
+	b.fn.nextValue++
+	// Keep phis first
+	i := 0
+	for i < len(blk.Values) && blk.Values[i].Op == IROpPhi {
+		i++
+	}
+	blk.Values = append(blk.Values[:i], append([]*IRValue{v}, blk.Values[i:]...)...)
+	return v
+}
+
+func (b *irBuilder) opaque(node Node, typ IRType) *IRValue {
+	return b.opaqueValue(node.String(), typ)
+}
+
+func (b *irBuilder) opaqueValue(source string, typ IRType) *IRValue {
+	v := b.emit(IROpOpaque, typ)
+	v.Str = source
+	return v
+}
+
+// zeroIn returns the value of a variable of the given type that has not been
+// assigned: 0 for a number, and an opaque value otherwise
+func (b *irBuilder) zeroIn(blk *IRBlock, typ IRType, name string) *IRValue {
+	if typ == IRF64 {
+		return b.constantIn(blk, 0)
+	}
+	v := b.insertIn(blk, IROpOpaque, typ)
+	v.Str = name
+	return v
+}
+
+func (b *irBuilder) jump(target *IRBlock) {
+	if b.block == nil {
+		return
+	}
+	term := b.emit(IROpJump, IRVoid)
+	term.Targets = []*IRBlock{target}
+	AddEdge(b.block, target)
+	b.block = nil
+}
+
+func (b *irBuilder) branch(cond *IRValue, then, els *IRBlock) {
+	term := b.emit(IROpBranch, IRVoid, cond)
+	term.Targets = []*IRBlock{then, els}
+	AddEdge(b.block, then)
+	AddEdge(b.block, els)
+	b.block = nil
+}
+
+func (b *irBuilder) ret(v *IRValue) {
+	b.emit(IROpReturn, IRVoid, v)
+	b.block = nil
+}
+
+// toF64 converts a value to a number. A statement, which has no value, is 0.
+func (b *irBuilder) toF64(v *IRValue, node Node) *IRValue {
+	if v == nil {
+		return b.constant(0)
+	}
+	switch v.Type {
+	case IRF64:
+		return v
+	case IRBool:
+		return b.emit(IROpBoolToF64, IRF64, v)
+	case IRVoid:
+		return b.constant(0)
+	}
+	// Lists, maps and strings are not numbers in the IR
+	return b.opaque(node, IRF64)
+}
+
+// toBool converts a value to a condition: any number other than 0 is true
+func (b *irBuilder) toBool(v *IRValue, node Node) *IRValue {
+	if v.Type == IRBool {
+		return v
+	}
+	return b.emit(IROpNe, IRBool, b.toF64(v, node), b.constant(0))
+}
+
+// ===== Statements =====
+
+func (b *irBuilder) statements(stmts []Statement) *IRValue {
+	var last *IRValue
+	for _, stmt := range stmts {
+		last = b.statement(stmt)
+	}
+	return last
+}
+
+// statement builds a statement, and returns its value if it is an expression
+func (b *irBuilder) statement(stmt Statement) *IRValue {
+	switch s := stmt.(type) {
+	case *ExpressionStmt:
+		return b.expression(s.Expr)
+	case *AssignStmt:
+		if _, ok := s.Value.(*LambdaExpr); ok && b.fn.Name == "main" && b.functions[s.Name] != nil {
+			return nil // built as a function of its own
+		}
+		b.assign(s)
+	case *MapUpdateStmt:
+		b.mapUpdate(s)
+	case *LoopStmt:
+		b.loop(s)
+	case *WhileStmt:
+		b.while(s)
+	case *JumpStmt:
+		b.jumpStmt(s.Label, s.IsBreak, s.Value, s)
+	case *CStructDecl, *ClassDecl, *UseStmt, *ImportStmt, *ExportStmt, *CImportStmt:
+		// Declarations generate no code of their own
+	default:
+		b.opaque(stmt, IRVoid)
+	}
+	return nil
+}
+
+// topLevel builds a top-level statement, and returns the number that it
+// leaves for the exit status, or nil if it leaves the previous one. As with
+// the AST code generator, that is the value of an expression or assignment,
+// or the number printed, and lists, maps, strings and loops leave 0.
+func (b *irBuilder) topLevel(stmt Statement) *IRValue {
+	var v *IRValue
+	switch s := stmt.(type) {
+	case *ExpressionStmt:
+		v = b.statement(s)
+		if v != nil && v.Op == IROpPrint {
+			if len(v.Args) != 1 || v.Args[0].Type != IRF64 {
+				return nil
+			}
+			v = v.Args[0]
+		}
+	case *AssignStmt:
+		if _, ok := s.Value.(*LambdaExpr); ok && b.functions[s.Name] != nil {
+			return nil // built as a function of its own
+		}
+		v = b.assign(s)
+	case *LoopStmt, *WhileStmt:
+		b.statement(s)
+		return b.constant(0)
+	default:
+		b.statement(s)
+		return nil
+	}
+	switch {
+	case v == nil || v.Type == IRVoid:
+		return nil
+	case v.Type.IsRef():
+		return b.constant(0)
+	}
+	return b.toF64(v, stmt)
+}
+
+// assign builds an assignment. xs = append(xs, v) pushes in place when the
+// list ownership analysis allows it, and the hidden variable " owned xs"
+// records whether the current list of xs was made by such a push, so that
+// the first push after any other assignment copies the list. It returns the
+// value assigned.
+func (b *irBuilder) assign(s *AssignStmt) *IRValue {
+	define := !s.IsUpdate && !s.IsReuseMutable && b.fn.Name != "main"
+	if b.ownership.Push(s) && !b.isGlobal(s.Name) {
+		call := s.Value.(*CallExpr)
+		list := b.expression(call.Args[0])
+		value := b.toF64(b.expression(call.Args[1]), call.Args[1])
+		if list.Type != IRList {
+			v := b.opaque(s.Value, IRList)
+			b.writeVar(s.Name, v, define)
+			return v
+		}
+		owned := b.read(" owned "+s.Name, b.block)
+		v := b.emit(IROpPush, IRList, list, value, owned)
+		b.writeVar(s.Name, v, define)
+		b.write(" owned "+s.Name, b.block, b.constant(1))
+		return v
+	}
+	v := b.expression(s.Value)
+	if !v.Type.IsValue() {
+		v = b.toF64(v, s.Value)
+	}
+	b.writeVar(s.Name, v, define)
+	if b.ownership.Releases(s) && !b.isGlobal(s.Name) {
+		b.write(" owned "+s.Name, b.block, b.constant(0))
+	}
+	return v
+}
+
+// mapUpdate builds m[k] <- v, which changes the map in place
+func (b *irBuilder) mapUpdate(s *MapUpdateStmt) {
+	if !b.locals[s.MapName] && !b.topVars[s.MapName] {
+		b.opaque(s, IRVoid)
+		return
+	}
+	m := b.readVar(s.MapName)
+	if m.Type != IRMap {
+		b.opaque(s, IRVoid)
+		return
+	}
+	key := b.toF64(b.expression(s.Index), s.Index)
+	value := b.toF64(b.expression(s.Value), s.Value)
+	b.writeVar(s.MapName, b.emit(IROpSet, IRMap, m, key, value), false)
+}
+
+func (b *irBuilder) loop(s *LoopStmt) {
+	if s.NumThreads != 0 {
+		b.opaque(s, IRVoid)
+		return
+	}
+	rng, ok := s.Iterable.(*RangeExpr)
+	if !ok {
+		b.elementLoop(s)
+		return
+	}
+	start := b.toF64(b.expression(rng.Start), rng.Start)
+	end := b.toF64(b.expression(rng.End), rng.End)
+	b.locals[s.Iterator] = true
+	b.kinds[s.Iterator] = IRF64
+	b.write(s.Iterator, b.block, start)
+	counter := ""
+	if s.NeedsMaxCheck {
+		counter = b.iterationCounter(s.MaxIterations)
+	}
+
+	header := b.fn.NewBlock()
+	body := b.fn.NewBlock()
+	next := b.fn.NewBlock()
+	exit := b.fn.NewBlock()
+	b.jump(header)
+
+	b.block = header
+	op := IROpLt
+	if rng.Inclusive {
+		op = IROpLe
+	}
+	b.branch(b.emit(op, IRBool, b.read(s.Iterator, header), end), body, exit)
+
+	b.seal(body)
+	b.block = body
+	b.loops = append(b.loops, irLoop{next: next, exit: exit})
+	b.statements(s.Body)
+	b.loops = b.loops[:len(b.loops)-1]
+	b.jump(next)
+
+	b.seal(next)
+	b.block = next
+	b.write(s.Iterator, next, b.emit(IROpAdd, IRF64, b.read(s.Iterator, next), b.constant(1)))
+	b.countIteration(counter, s.MaxIterations, header, exit)
+	b.seal(header)
+
+	b.seal(exit)
+	b.block = exit
+}
+
+// elementLoop builds a loop over the elements of a list or string, counting
+// with a hidden index variable
+func (b *irBuilder) elementLoop(s *LoopStmt) {
+	container := b.expression(s.Iterable)
+	if container.Type != IRList && container.Type != IRString {
+		b.opaque(s, IRVoid)
+		return
+	}
+	index := fmt.Sprintf(" index%d", len(b.loops))
+	end := b.emit(IROpLength, IRF64, container)
+	b.write(index, b.block, b.constant(0))
+	b.locals[s.Iterator] = true
+	b.kinds[s.Iterator] = IRF64
+	counter := ""
+	if s.NeedsMaxCheck {
+		counter = b.iterationCounter(s.MaxIterations)
+	}
+
+	header := b.fn.NewBlock()
+	body := b.fn.NewBlock()
+	next := b.fn.NewBlock()
+	exit := b.fn.NewBlock()
+	b.jump(header)
+
+	b.block = header
+	b.branch(b.emit(IROpLt, IRBool, b.read(index, header), end), body, exit)
+
+	b.seal(body)
+	b.block = body
+	b.write(s.Iterator, body, b.emit(IROpIndex, IRF64, container, b.read(index, body)))
+	b.loops = append(b.loops, irLoop{next: next, exit: exit})
+	b.statements(s.Body)
+	b.loops = b.loops[:len(b.loops)-1]
+	b.jump(next)
+
+	b.seal(next)
+	b.block = next
+	b.write(index, next, b.emit(IROpAdd, IRF64, b.read(index, next), b.constant(1)))
+	b.countIteration(counter, s.MaxIterations, header, exit)
+	b.seal(header)
+
+	b.seal(exit)
+	b.block = exit
+}
+
+func (b *irBuilder) while(s *WhileStmt) {
+	counter := b.iterationCounter(s.MaxIterations)
+	header := b.fn.NewBlock()
+	body := b.fn.NewBlock()
+	next := b.fn.NewBlock()
+	exit := b.fn.NewBlock()
+	b.jump(header)
+
+	b.block = header
+	b.branch(b.toBool(b.expression(s.Condition), s.Condition), body, exit)
+
+	b.seal(body)
+	b.block = body
+	b.loops = append(b.loops, irLoop{next: next, exit: exit})
+	b.statements(s.Body)
+	b.loops = b.loops[:len(b.loops)-1]
+	b.jump(next)
+
+	b.seal(next)
+	b.block = next
+	b.countIteration(counter, s.MaxIterations, header, exit)
+	b.seal(header)
+
+	b.seal(exit)
+	b.block = exit
+}
+
+// iterationCounter starts counting the iterations of a loop with a maximum,
+// and returns the internal variable that holds the count
+func (b *irBuilder) iterationCounter(max int64) string {
+	if max == math.MaxInt64 {
+		return ""
+	}
+	counter := fmt.Sprintf(" iterations%d", len(b.loops))
+	zero := b.constant(0)
+	b.write(counter, b.block, zero)
+	return counter
+}
+
+// countIteration ends an iteration by going back to the header, or leaving
+// the loop once the maximum number of iterations has been reached
+func (b *irBuilder) countIteration(counter string, max int64, header, exit *IRBlock) {
+	if counter == "" {
+		b.jump(header)
+		return
+	}
+	n := b.emit(IROpAdd, IRF64, b.read(counter, b.block), b.constant(1))
+	b.write(counter, b.block, n)
+	b.branch(b.emit(IROpLt, IRBool, n, b.constant(float64(max))), header, exit)
+}
+
+// jumpStmt builds ret, ret @N and @N. Labels count loops from the outermost
+// one, and -1 is the innermost loop.
+func (b *irBuilder) jumpStmt(label int, isBreak bool, value Expression, node Node) {
+	if label == 0 && isBreak {
+		if value == nil {
+			b.ret(b.constant(0))
+		} else {
+			b.ret(b.toF64(b.expression(value), value))
+		}
+		return
+	}
+	index := len(b.loops) - 1
+	if label > 0 {
+		index = label - 1
+	}
+	if index < 0 || index >= len(b.loops) || value != nil {
+		b.opaque(node, IRVoid)
+		return
+	}
+	if isBreak {
+		b.jump(b.loops[index].exit)
+	} else {
+		b.jump(b.loops[index].next)
+	}
+}
+
+// ===== Expressions =====
+
+var irCompareOps = map[string]IROp{
+	"==": IROpEq, "!=": IROpNe, "<": IROpLt, "<=": IROpLe, ">": IROpGt, ">=": IROpGe,
+}
+
+var irArithOps = map[string]IROp{
+	"+": IROpAdd, "-": IROpSub, "*": IROpMul, "/": IROpDiv, "%": IROpMod,
+}
+
+func (b *irBuilder) expression(expr Expression) *IRValue {
+	switch e := expr.(type) {
+	case *NumberExpr:
+		return b.constant(e.Value)
+	case *BooleanExpr:
+		if e.Value {
+			return b.constant(1)
+		}
+		return b.constant(0)
+	case *StringExpr:
+		v := b.emit(IROpString, IRString)
+		v.Str = e.Value
+		return v
+	case *ListExpr:
+		elements := make([]*IRValue, len(e.Elements))
+		for i, elem := range e.Elements {
+			elements[i] = b.toF64(b.expression(elem), elem)
+		}
+		return b.emit(IROpList, IRList, elements...)
+	case *MapExpr:
+		var pairs []*IRValue
+		for i, key := range e.Keys {
+			pairs = append(pairs, b.toF64(b.expression(key), key))
+			pairs = append(pairs, b.toF64(b.expression(e.Values[i]), e.Values[i]))
+		}
+		return b.emit(IROpMap, IRMap, pairs...)
+	case *IndexExpr:
+		container := b.expression(e.List)
+		if !container.Type.IsRef() {
+			break
+		}
+		return b.emit(IROpIndex, IRF64, container, b.toF64(b.expression(e.Index), e.Index))
+	case *LengthExpr:
+		return b.length(e.Operand, e)
+	case *IdentExpr:
+		if b.locals[e.Name] || b.topVars[e.Name] {
+			return b.readVar(e.Name)
+		}
+		return b.opaque(e, IRF64)
+	case *BinaryExpr:
+		return b.binary(e)
+	case *FMAExpr:
+		product := b.emit(IROpMul, IRF64, b.toF64(b.expression(e.A), e.A), b.toF64(b.expression(e.B), e.B))
+		if e.IsNegMul {
+			product = b.emit(IROpNeg, IRF64, product)
+		}
+		op := IROpAdd
+		if e.IsSub {
+			op = IROpSub
+		}
+		return b.emit(op, IRF64, product, b.toF64(b.expression(e.C), e.C))
+	case *UnaryExpr:
+		switch e.Operator {
+		case "-":
+			return b.emit(IROpNeg, IRF64, b.toF64(b.expression(e.Operand), e.Operand))
+		case "not":
+			return b.emit(IROpNot, IRBool, b.toBool(b.expression(e.Operand), e.Operand))
+		case "#":
+			return b.length(e.Operand, e)
+		}
+	case *BlockExpr:
+		// A block of statements has the value of its last expression
+		return b.statements(e.Statements)
+	case *MatchExpr:
+		return b.match(e)
+	case *JumpExpr:
+		b.jumpStmt(e.Label, e.IsBreak || e.Label == 0, e.Value, e)
+		return nil
+	case *CallExpr:
+		return b.call(e)
+	}
+	return b.opaque(expr, IRF64)
+}
+
+// length builds #x
+func (b *irBuilder) length(operand Expression, node Node) *IRValue {
+	container := b.expression(operand)
+	if !container.Type.IsRef() {
+		return b.opaque(node, IRF64)
+	}
+	return b.emit(IROpLength, IRF64, container)
+}
+
+func (b *irBuilder) binary(e *BinaryExpr) *IRValue {
+	if op, ok := irArithOps[e.Operator]; ok {
+		left := b.expression(e.Left)
+		right := b.expression(e.Right)
+		if op == IROpAdd && left.Type == IRString && right.Type == IRString {
+			return b.emit(IROpConcat, IRString, left, right)
+		}
+		return b.emit(op, IRF64, b.toF64(left, e.Left), b.toF64(right, e.Right))
+	}
+	if op, ok := irCompareOps[e.Operator]; ok {
+		left := b.toF64(b.expression(e.Left), e.Left)
+		right := b.toF64(b.expression(e.Right), e.Right)
+		return b.emit(op, IRBool, left, right)
+	}
+	if e.Operator == "and" || e.Operator == "or" {
+		// Short-circuit evaluation, producing 1 or 0
+		left := b.toBool(b.expression(e.Left), e.Left)
+		rhs := b.fn.NewBlock()
+		short := b.fn.NewBlock()
+		join := b.fn.NewBlock()
+		if e.Operator == "and" {
+			b.branch(left, rhs, short)
+		} else {
+			b.branch(left, short, rhs)
+		}
+		b.seal(rhs)
+		b.seal(short)
+
+		b.block = rhs
+		right := b.expression(e.Right)
+		if b.block != nil {
+			b.write(" cond", b.block, b.toF64(b.toBool(right, e.Right), e.Right))
+			b.jump(join)
+		}
+
+		b.block = short
+		if e.Operator == "and" {
+			b.write(" cond", short, b.constant(0))
+		} else {
+			b.write(" cond", short, b.constant(1))
+		}
+		b.jump(join)
+
+		b.seal(join)
+		b.block = join
+		return b.read(" cond", join)
+	}
+	return b.opaque(e, IRF64)
+}
+
+// match builds a match expression as a chain of conditional branches. Each
+// clause is tested in order, and the value of the first that matches, or the
+// default, is the value of the expression.
+func (b *irBuilder) match(e *MatchExpr) *IRValue {
+	var cond *IRValue
+	if e.Condition != nil {
+		cond = b.expression(e.Condition)
+	}
+	join := b.fn.NewBlock()
+	const result = " match"
+	arrive := func(v *IRValue, node Node) {
+		if b.block == nil {
+			return
+		}
+		b.write(result, b.block, b.toF64(v, node))
+		b.jump(join)
+	}
+
+	for _, clause := range e.Clauses {
+		if b.block == nil {
+			break
+		}
+		var test *IRValue
+		switch {
+		case clause.Guard == nil && cond == nil:
+			test = b.toBool(b.constant(1), e)
+		case clause.Guard == nil:
+			test = b.toBool(cond, e.Condition)
+		case clause.IsValueMatch:
+			guard := b.toF64(b.expression(clause.Guard), clause.Guard)
+			test = b.emit(IROpEq, IRBool, b.toF64(cond, e.Condition), guard)
+		default:
+			test = b.toBool(b.expression(clause.Guard), clause.Guard)
+		}
+		then := b.fn.NewBlock()
+		next := b.fn.NewBlock()
+		b.branch(test, then, next)
+		b.seal(then)
+		b.seal(next)
+
+		b.block = then
+		var v *IRValue
+		var node Node = e
+		if clause.Result != nil {
+			v = b.expression(clause.Result)
+			node = clause.Result
+		}
+		if v == nil && b.block != nil {
+			v = b.constant(0)
+		}
+		arrive(v, node)
+		b.block = next
+	}
+
+	if b.block != nil {
+		var v *IRValue
+		var node Node = e
+		if e.DefaultExpr != nil {
+			v = b.expression(e.DefaultExpr)
+			node = e.DefaultExpr
+		}
+		if v == nil && b.block != nil {
+			v = b.constant(0)
+		}
+		arrive(v, node)
+	}
+
+	b.seal(join)
+	if len(join.Preds) == 0 {
+		// Every clause left with ret or a loop jump
+		b.block = nil
+		return nil
+	}
+	b.block = join
+	return b.read(result, join)
+}
+
+func (b *irBuilder) call(e *CallExpr) *IRValue {
+	switch e.Function {
+	case "print", "println":
+		if e.Function == "print" && len(e.Args) != 1 {
+			break
+		}
+		if len(e.Args) == 0 {
+			return b.print("println", b.expression(&StringExpr{}), e)
+		}
+		// println separates its arguments with spaces
+		var v *IRValue
+		for i, arg := range e.Args {
+			if i > 0 {
+				b.print("print", b.expression(&StringExpr{Value: " "}), e)
+			}
+			name := "print"
+			if i == len(e.Args)-1 {
+				name = e.Function
+			}
+			v = b.print(name, b.expression(arg), arg)
+		}
+		return v
+	case "append":
+		if len(e.Args) != 2 {
+			break
+		}
+		list := b.expression(e.Args[0])
+		if list.Type != IRList {
+			return b.opaque(e, IRList)
+		}
+		return b.emit(IROpAppend, IRList, list, b.toF64(b.expression(e.Args[1]), e.Args[1]))
+	case "exit":
+		if len(e.Args) != 1 {
+			break
+		}
+		b.emit(IROpExit, IRVoid, b.toF64(b.expression(e.Args[0]), e.Args[0]))
+		// The value of exit(...) is never seen, but it may be an operand,
+		// as in x == 1 or exit(2)
+		return b.constant(0)
+	}
+
+	lambda, ok := b.functions[e.Function]
+	if !ok || len(e.Args) != len(lambda.Params) || b.locals[e.Function] {
+		return b.opaque(e, IRF64)
+	}
+	args := make([]*IRValue, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = b.toF64(b.expression(arg), arg)
+	}
+	v := b.emit(IROpCall, IRF64, args...)
+	v.Name = irFunctionName(e.Function)
+	return v
+}
+
+// print prints a number or a string. Lists and maps are printed by the AST
+// code generator.
+func (b *irBuilder) print(name string, arg *IRValue, node Node) *IRValue {
+	if arg == nil {
+		return nil // the argument left with ret or a loop jump
+	}
+	switch arg.Type {
+	case IRList, IRMap:
+		return b.opaque(node, IRVoid)
+	case IRBool, IRVoid:
+		arg = b.toF64(arg, node)
+	}
+	v := b.emit(IROpPrint, IRVoid, arg)
+	v.Name = name
+	return v
+}
+
+// DumpIR prints the IR of a program, for -emit-ir
+func DumpIR(program *Program) (string, error) {
+	mod := BuildIR(program)
+	if err := mod.Verify(); err != nil {
+		return "", fmt.Errorf("invalid IR: %v", err)
+	}
+	return mod.String(), nil
+}
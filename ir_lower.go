@@ -0,0 +1,520 @@
+// Completion: 85% - Lowers the IR through the CodeGenerator interface; values live in stack slots
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// irRegisters names the registers LowerIR uses on a target
+type irRegisters struct {
+	sp      string
+	link    string    // return address ("" if calls push it on the stack)
+	ints    [2]string // scratch integer registers
+	floats  [3]string // scratch floating-point registers
+	args    []string  // floating-point argument and result registers
+	sysArgs [3]string // system call arguments
+	sysNum  string    // system call number
+	sysRet  string    // system call result
+}
+
+var irTargetRegisters = map[Arch]irRegisters{
+	ArchARM64: {
+		sp:      "sp",
+		link:    "x30",
+		ints:    [2]string{"x9", "x10"},
+		floats:  [3]string{"d16", "d17", "d18"},
+		args:    []string{"d0", "d1", "d2", "d3", "d4", "d5", "d6", "d7"},
+		sysArgs: [3]string{"x0", "x1", "x2"},
+		sysNum:  "x8",
+		sysRet:  "x0",
+	},
+	ArchX86_64: {
+		sp:      "rsp",
+		ints:    [2]string{"r8", "r9"},
+		floats:  [3]string{"xmm8", "xmm9", "xmm10"},
+		args:    []string{"xmm0", "xmm1", "xmm2", "xmm3", "xmm4", "xmm5", "xmm6", "xmm7"},
+		sysArgs: [3]string{"rdi", "rsi", "rdx"},
+		sysNum:  "rax",
+		sysRet:  "rax",
+	},
+	ArchRiscv64: {
+		sp:      "sp",
+		link:    "ra",
+		ints:    [2]string{"t1", "t2"}, // t0 holds comparison results
+		floats:  [3]string{"ft0", "ft1", "ft2"},
+		args:    []string{"fa0", "fa1", "fa2", "fa3", "fa4", "fa5", "fa6", "fa7"},
+		sysArgs: [3]string{"a0", "a1", "a2"},
+		sysNum:  "a7",
+		sysRet:  "a0",
+	},
+}
+
+// irMaxFrame keeps stack slot offsets within the immediate range of every target
+const irMaxFrame = 2032
+
+// irMaxWrite is the longest string written with one system call, so that the
+// length fits in an immediate
+const irMaxWrite = 2047
+
+// LowerIR generates machine code for a module through the CodeGenerator of
+// the target, appending it to the text of eb. main comes first, so execution
+// starts at the beginning of the text.
+//
+// Every value lives in a stack slot and is loaded into scratch registers when
+// it is used, which keeps the lowering independent of the register file of
+// the target. Branches are only emitted as short skips over an unconditional
+// jump, so they stay within range on every target, and jumps and calls are
+// patched once all blocks have been placed. The helpers of ir_runtime.go that
+// the module uses are placed after the functions.
+func LowerIR(mod *IRModule, eb *ExecutableBuilder) error {
+	arch := eb.target.Arch()
+	regs, ok := irTargetRegisters[arch]
+	if !ok {
+		return fmt.Errorf("the IR can not be lowered for %s yet", arch)
+	}
+	if opaque := mod.Opaque(); len(opaque) > 0 {
+		return fmt.Errorf("%s is not supported by the %s backend yet", opaque[0].Str, arch)
+	}
+
+	l := &irLowering{
+		arch:    arch,
+		eb:      eb,
+		cg:      NewCodeGenerator(arch, eb.TextWriter(), eb),
+		regs:    regs,
+		labels:  make(map[string]int),
+		runtime: make(map[string]bool),
+	}
+	for _, g := range mod.Globals {
+		eb.DefineWritable(irGlobalLabel(g), string(make([]byte, 8)))
+	}
+	for _, fn := range mod.Functions {
+		if err := l.function(fn); err != nil {
+			return fmt.Errorf("%s: %v", fn.Name, err)
+		}
+	}
+	if err := l.runtimeCode(); err != nil {
+		return err
+	}
+	return l.patch()
+}
+
+func irGlobalLabel(name string) string {
+	return "ir_global_" + name
+}
+
+type irLowering struct {
+	arch    Arch
+	eb      *ExecutableBuilder
+	cg      CodeGenerator
+	regs    irRegisters
+	labels  map[string]int // text offsets of functions and blocks
+	fixups  []irFixup
+	strings int
+	runtime map[string]bool // the helpers of ir_runtime.go the module uses
+
+	fn       *IRFunction
+	frame    int32
+	slots    map[*IRValue]int32
+	incoming map[*IRValue]int32 // where predecessors leave the arguments of a phi
+	edges    int
+}
+
+// irFixup is a jump or call whose target was not known when it was emitted
+type irFixup struct {
+	pos    int
+	target string
+	call   bool
+}
+
+func (l *irLowering) pos() int {
+	return l.eb.text.Len()
+}
+
+// size returns the number of bytes an instruction takes on the target
+func (l *irLowering) size(emit func(cg CodeGenerator)) int32 {
+	var buf bytes.Buffer
+	emit(NewCodeGenerator(l.arch, &BufferWrapper{&buf}, l.eb))
+	return int32(buf.Len())
+}
+
+func (l *irLowering) blockLabel(b *IRBlock) string {
+	return l.fn.Name + "." + b.Ref()
+}
+
+func (l *irLowering) jumpTo(label string) {
+	l.fixups = append(l.fixups, irFixup{pos: l.pos(), target: label})
+	l.cg.JumpUnconditional(0)
+}
+
+// jumpIf jumps to label when the condition holds, by skipping over an
+// unconditional jump when it does not
+func (l *irLowering) jumpIf(cond JumpCondition, label string) {
+	skip := l.size(func(cg CodeGenerator) { cg.JumpConditional(cond, 0) }) +
+		l.size(func(cg CodeGenerator) { cg.JumpUnconditional(0) })
+	l.cg.JumpConditional(invertJumpCondition(cond), skip)
+	l.jumpTo(label)
+}
+
+func invertJumpCondition(cond JumpCondition) JumpCondition {
+	switch cond {
+	case JumpEqual:
+		return JumpNotEqual
+	case JumpNotEqual:
+		return JumpEqual
+	case JumpLess:
+		return JumpGreaterOrEqual
+	case JumpGreaterOrEqual:
+		return JumpLess
+	case JumpGreater:
+		return JumpLessOrEqual
+	case JumpLessOrEqual:
+		return JumpGreater
+	}
+	return cond
+}
+
+// patch fills in the offsets of the jumps and calls
+func (l *irLowering) patch() error {
+	text := l.eb.text.Bytes()
+	for _, f := range l.fixups {
+		target, ok := l.labels[f.target]
+		if !ok {
+			return fmt.Errorf("undefined label %s", f.target)
+		}
+		var buf bytes.Buffer
+		cg := NewCodeGenerator(l.arch, &BufferWrapper{&buf}, l.eb)
+		if f.call {
+			cg.CallRelative(int32(target - f.pos))
+		} else {
+			cg.JumpUnconditional(int32(target - f.pos))
+		}
+		copy(text[f.pos:], buf.Bytes())
+	}
+	return nil
+}
+
+// ===== Stack slots =====
+
+func (l *irLowering) load(freg string, v *IRValue) {
+	l.cg.MovMemToXmm(freg, l.regs.sp, l.slots[v])
+}
+
+func (l *irLowering) store(freg string, v *IRValue) {
+	l.cg.MovXmmToMem(freg, l.regs.sp, l.slots[v])
+}
+
+// loadInt loads a bool or address into an integer register
+func (l *irLowering) loadInt(ireg string, v *IRValue) {
+	l.cg.MovMemToXmm(l.regs.floats[2], l.regs.sp, l.slots[v])
+	l.cg.MovXmmToReg(ireg, l.regs.floats[2])
+}
+
+// storeInt stores an integer register as a bool or address
+func (l *irLowering) storeInt(ireg string, v *IRValue) {
+	l.cg.MovRegToXmm(l.regs.floats[2], ireg)
+	l.cg.MovXmmToMem(l.regs.floats[2], l.regs.sp, l.slots[v])
+}
+
+// ===== Functions =====
+
+func (l *irLowering) function(fn *IRFunction) error {
+	if len(fn.Params) > len(l.regs.args) {
+		return fmt.Errorf("more than %d parameters are not supported yet", len(l.regs.args))
+	}
+	l.fn = fn
+	l.slots = make(map[*IRValue]int32)
+	l.incoming = make(map[*IRValue]int32)
+	next := int32(8) // the return address is saved at 0 if there is a link register
+	for _, b := range fn.Blocks {
+		for _, v := range b.Values {
+			if v.Type == IRVoid {
+				continue
+			}
+			l.slots[v] = next
+			next += 8
+			if v.Op == IROpPhi {
+				l.incoming[v] = next
+				next += 8
+			}
+		}
+	}
+	l.frame = (next + 15) &^ 15
+	if l.frame > irMaxFrame {
+		return fmt.Errorf("too many values for one stack frame (%d bytes, at most %d)", l.frame, irMaxFrame)
+	}
+
+	l.labels[fn.Name] = l.pos()
+	f := l.regs.floats
+	l.cg.SubImmFromReg(l.regs.sp, int64(l.frame))
+	if l.regs.link != "" {
+		l.cg.MovRegToXmm(f[2], l.regs.link)
+		l.cg.MovXmmToMem(f[2], l.regs.sp, 0)
+	}
+	for _, v := range fn.Blocks[0].Values {
+		if v.Op == IROpParam {
+			l.store(l.regs.args[v.Index], v)
+		}
+	}
+
+	for _, b := range fn.Blocks {
+		l.labels[l.blockLabel(b)] = l.pos()
+		for _, v := range b.Values {
+			if v.Op == IROpPhi {
+				l.cg.MovMemToXmm(f[0], l.regs.sp, l.incoming[v])
+				l.store(f[0], v)
+				continue
+			}
+			if err := l.value(v); err != nil {
+				return fmt.Errorf("%s: %v", v, err)
+			}
+		}
+	}
+	return nil
+}
+
+// phiCopies passes the values of the phis of a successor along an edge
+func (l *irLowering) phiCopies(from, to *IRBlock) {
+	index := -1
+	for i, p := range to.Preds {
+		if p == from {
+			index = i
+			break
+		}
+	}
+	for _, v := range to.Values {
+		if v.Op != IROpPhi || index < 0 {
+			continue
+		}
+		l.load(l.regs.floats[0], v.Args[index])
+		l.cg.MovXmmToMem(l.regs.floats[0], l.regs.sp, l.incoming[v])
+	}
+}
+
+func (l *irLowering) value(v *IRValue) error {
+	cg := l.cg
+	f := l.regs.floats
+	r := l.regs.ints
+	switch {
+	case v.Op.IsArith():
+		l.load(f[0], v.Args[0])
+		l.load(f[1], v.Args[1])
+		switch v.Op {
+		case IROpAdd:
+			cg.AddpdXmm(f[0], f[1])
+		case IROpSub:
+			cg.SubpdXmm(f[0], f[1])
+		case IROpMul:
+			cg.MulpdXmm(f[0], f[1])
+		case IROpDiv:
+			cg.DivpdXmm(f[0], f[1])
+		case IROpMod:
+			// a - b * trunc(a / b)
+			cg.SubpdXmm(f[2], f[2])
+			cg.AddpdXmm(f[2], f[0])
+			cg.DivpdXmm(f[2], f[1])
+			cg.Cvttsd2si(r[0], f[2])
+			cg.Cvtsi2sd(f[2], r[0])
+			cg.MulpdXmm(f[2], f[1])
+			cg.SubpdXmm(f[0], f[2])
+		}
+		l.store(f[0], v)
+		return nil
+	case v.Op.IsCompare():
+		cond := l.compare(v)
+		skip := l.size(func(cg CodeGenerator) { cg.JumpConditional(cond, 0) }) +
+			l.size(func(cg CodeGenerator) { cg.MovImmToReg(r[1], "0") })
+		cg.MovImmToReg(r[1], "1")
+		cg.JumpConditional(cond, skip)
+		cg.MovImmToReg(r[1], "0")
+		l.storeInt(r[1], v)
+		return nil
+	}
+
+	switch v.Op {
+	case IROpParam:
+		// Stored by the prologue
+	case IROpConst:
+		label := fmt.Sprintf("ir_f64_%016x", math.Float64bits(v.Num))
+		if _, ok := l.eb.consts[label]; !ok {
+			bits := make([]byte, 8)
+			binary.LittleEndian.PutUint64(bits, math.Float64bits(v.Num))
+			l.eb.Define(label, string(bits))
+		}
+		cg.LeaSymbolToReg(r[0], label)
+		cg.MovMemToXmm(f[0], r[0], 0)
+		l.store(f[0], v)
+	case IROpString:
+		cg.LeaSymbolToReg(r[0], l.defineString(irContainerData(v.Str)))
+		l.storeInt(r[0], v)
+	case IROpNeg:
+		cg.MovImmToReg(r[0], "0")
+		cg.MovRegToXmm(f[0], r[0])
+		l.load(f[1], v.Args[0])
+		cg.SubpdXmm(f[0], f[1])
+		l.store(f[0], v)
+	case IROpNot:
+		l.loadInt(r[0], v.Args[0])
+		cg.MovImmToReg(r[1], "1")
+		cg.SubRegToReg(r[1], r[0])
+		l.storeInt(r[1], v)
+	case IROpBoolToF64:
+		l.loadInt(r[0], v.Args[0])
+		cg.Cvtsi2sd(f[0], r[0])
+		l.store(f[0], v)
+	case IROpLoadGlobal:
+		cg.LeaSymbolToReg(r[0], irGlobalLabel(v.Name))
+		cg.MovMemToXmm(f[0], r[0], 0)
+		l.store(f[0], v)
+	case IROpStoreGlobal:
+		l.load(f[0], v.Args[0])
+		cg.LeaSymbolToReg(r[0], irGlobalLabel(v.Name))
+		cg.MovXmmToMem(f[0], r[0], 0)
+	case IROpCall:
+		for i, arg := range v.Args {
+			l.load(l.regs.args[i], arg)
+		}
+		l.fixups = append(l.fixups, irFixup{pos: l.pos(), target: v.Name, call: true})
+		cg.CallRelative(0)
+		l.store(l.regs.args[0], v)
+	case IROpPrint:
+		arg := v.Args[0]
+		switch {
+		case arg.Op == IROpString:
+			text := arg.Str
+			if v.Name == "println" {
+				text += "\n"
+			}
+			l.writeText(text)
+			return nil
+		case arg.Type == IRString:
+			l.loadInt(r[0], arg)
+			l.callRuntime("print_string")
+		default:
+			l.load(l.regs.args[0], arg)
+			l.callRuntime("print_number")
+		}
+		if v.Name == "println" {
+			l.writeText("\n")
+		}
+	case IROpList, IROpMap:
+		l.newContainer(v)
+	case IROpIndex:
+		l.loadInt(r[0], v.Args[0])
+		l.load(l.regs.args[0], v.Args[1])
+		if v.Args[0].Type == IRMap {
+			l.callRuntime("map_get")
+		} else {
+			l.callRuntime("list_get")
+		}
+		l.store(l.regs.args[0], v)
+	case IROpLength:
+		l.loadInt(r[0], v.Args[0])
+		cg.MovMemToXmm(f[0], r[0], 0)
+		l.store(f[0], v)
+	case IROpAppend, IROpPush, IROpSet:
+		l.loadInt(r[0], v.Args[0])
+		for i, arg := range v.Args[1:] {
+			l.load(l.regs.args[i], arg)
+		}
+		l.callRuntime(v.Op.String())
+		l.storeInt(r[0], v)
+	case IROpConcat:
+		l.loadInt(r[0], v.Args[0])
+		l.loadInt(r[1], v.Args[1])
+		l.callRuntime("concat")
+		l.storeInt(r[0], v)
+	case IROpExit:
+		l.load(f[0], v.Args[0])
+		l.exit()
+	case IROpJump:
+		l.phiCopies(v.Block, v.Targets[0])
+		l.jumpTo(l.blockLabel(v.Targets[0]))
+	case IROpBranch:
+		then, els := v.Targets[0], v.Targets[1]
+		l.loadInt(r[0], v.Args[0])
+		cg.CmpRegToImm(r[0], 0)
+		thenLabel := l.blockLabel(then)
+		if hasPhis(then) {
+			thenLabel = fmt.Sprintf("%s.edge%d", l.fn.Name, l.edges)
+			l.edges++
+		}
+		l.jumpIf(JumpNotEqual, thenLabel)
+		l.phiCopies(v.Block, els)
+		l.jumpTo(l.blockLabel(els))
+		if hasPhis(then) {
+			l.labels[thenLabel] = l.pos()
+			l.phiCopies(v.Block, then)
+			l.jumpTo(l.blockLabel(then))
+		}
+	case IROpReturn:
+		if l.fn.Name == "main" {
+			l.load(f[0], v.Args[0])
+			l.exit()
+			return nil
+		}
+		l.load(l.regs.args[0], v.Args[0])
+		if l.regs.link != "" {
+			cg.MovMemToXmm(f[2], l.regs.sp, 0)
+			cg.MovXmmToReg(l.regs.link, f[2])
+		}
+		cg.AddImmToReg(l.regs.sp, int64(l.frame))
+		cg.Ret()
+	default:
+		return fmt.Errorf("can not lower %s yet", v.Op)
+	}
+	return nil
+}
+
+func hasPhis(b *IRBlock) bool {
+	return len(b.Values) > 0 && b.Values[0].Op == IROpPhi
+}
+
+// exit ends the program with the number in the first scratch register as status
+func (l *irLowering) exit() {
+	l.cg.Cvttsd2si(l.regs.sysArgs[0], l.regs.floats[0])
+	l.cg.MovImmToReg(l.regs.sysNum, strconv.FormatUint(sysNum(l.eb.target, "SYS_EXIT"), 10))
+	l.cg.Syscall()
+}
+
+func (l *irLowering) defineString(s string) string {
+	label := fmt.Sprintf("ir_str_%d", l.strings)
+	l.strings++
+	l.eb.Define(label, s)
+	return label
+}
+
+// compare compares the operands of a comparison and returns the condition
+// that holds when the comparison is true. The backends only agree on integer
+// comparisons, so the difference of the operands, plus zero to turn -0 into 0,
+// is moved to an integer register, where it has the same sign as the float and
+// is zero when the float is.
+func (l *irLowering) compare(v *IRValue) JumpCondition {
+	f := l.regs.floats
+	r := l.regs.ints
+	a, b := v.Args[0], v.Args[1]
+	if v.Op == IROpGt || v.Op == IROpLe {
+		a, b = b, a
+	}
+	l.load(f[0], a)
+	l.load(f[1], b)
+	l.cg.SubpdXmm(f[0], f[1])
+	l.cg.MovImmToReg(r[0], "0")
+	l.cg.MovRegToXmm(f[1], r[0])
+	l.cg.AddpdXmm(f[0], f[1])
+	l.cg.MovXmmToReg(r[0], f[0])
+	l.cg.CmpRegToImm(r[0], 0)
+	switch v.Op {
+	case IROpEq:
+		return JumpEqual
+	case IROpNe:
+		return JumpNotEqual
+	case IROpLt, IROpGt:
+		return JumpLess
+	default:
+		return JumpGreaterOrEqual
+	}
+}
@@ -0,0 +1,659 @@
+// Completion: 80% - Heap, lists, maps, strings and number printing for code lowered from the IR
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ir_runtime.go - The runtime of code lowered from the IR
+//
+// Lists, maps and strings share one layout:
+//
+//	[count f64][capacity int64][entries...]
+//
+// A list or string has one 8-byte element per entry, the codepoints in the
+// case of a string, and a map has a key and a value per entry. Map keys are
+// normalized by adding 0, so that -0 and 0 are the same key, and compared by
+// their bits. String constants are laid out the same way in rodata.
+//
+// The helpers are generated through the CodeGenerator of the target, like the
+// lowered code, and only the helpers a module uses are emitted. They take
+// integers in the scratch integer registers and numbers in the first argument
+// registers, return an address in the first scratch integer register or a
+// number in the first argument register, and may clobber every scratch,
+// argument and system call register. The heap grows with brk and is never
+// freed.
+
+// irHeaderSize is the size of the count and capacity of a container
+const irHeaderSize = 16
+
+// irHeapChunk is how much the heap grows by at least
+const irHeapChunk = 1 << 20
+
+// irPrintBuffer is how many characters print_string writes at once
+const irPrintBuffer = 256
+
+// irRuntimeOrder is the order the helpers are emitted in
+var irRuntimeOrder = []string{
+	"alloc", "list_get", "map_get", "append", "push", "grow_list",
+	"set", "grow_map", "concat", "print_number", "print_string",
+}
+
+// irRuntimeDeps lists the helpers each helper calls or jumps to
+var irRuntimeDeps = map[string][]string{
+	"append":    {"grow_list"},
+	"push":      {"grow_list"},
+	"set":       {"grow_map"},
+	"grow_list": {"alloc"},
+	"grow_map":  {"alloc"},
+	"concat":    {"alloc"},
+}
+
+// Slots of ir_rt_save, where helpers that call alloc keep their state
+const (
+	irSaveFirst  = 0
+	irSaveSecond = 8
+	irSaveThird  = 16
+	irSaveLink   = 24
+	irSaveCount  = 32
+)
+
+func irRuntimeLabel(name string) string {
+	return "ir_rt_" + name
+}
+
+// useRuntime marks a helper, and the helpers it needs, to be emitted
+func (l *irLowering) useRuntime(name string) {
+	if l.runtime[name] {
+		return
+	}
+	l.runtime[name] = true
+	for _, dep := range irRuntimeDeps[name] {
+		l.useRuntime(dep)
+	}
+}
+
+func (l *irLowering) callRuntime(name string) {
+	l.useRuntime(name)
+	l.fixups = append(l.fixups, irFixup{pos: l.pos(), target: irRuntimeLabel(name), call: true})
+	l.cg.CallRelative(0)
+}
+
+// runtimeCode emits the helpers the module uses
+func (l *irLowering) runtimeCode() error {
+	if l.runtime["alloc"] {
+		if _, ok := getSyscallNumbers(l.eb.target)["SYS_BRK"]; !ok {
+			return fmt.Errorf("lists, maps and strings need brk, which %s does not have", l.eb.target.OS())
+		}
+		l.eb.DefineWritable("ir_heap", string(make([]byte, 16)))
+		l.eb.DefineWritable("ir_rt_save", string(make([]byte, 40)))
+	}
+	if l.runtime["print_number"] || l.runtime["print_string"] {
+		l.eb.DefineWritable("ir_rt_buf", string(make([]byte, irPrintBuffer+8)))
+	}
+	emitters := map[string]func(){
+		"alloc":        l.rtAlloc,
+		"list_get":     l.rtListGet,
+		"map_get":      l.rtMapGet,
+		"append":       l.rtAppend,
+		"push":         l.rtPush,
+		"grow_list":    func() { l.rtGrow("grow_list", 1) },
+		"set":          l.rtSet,
+		"grow_map":     func() { l.rtGrow("grow_map", 2) },
+		"concat":       l.rtConcat,
+		"print_number": l.rtPrintNumber,
+		"print_string": l.rtPrintString,
+	}
+	for _, name := range irRuntimeOrder {
+		if l.runtime[name] {
+			l.labels[irRuntimeLabel(name)] = l.pos()
+			emitters[name]()
+		}
+	}
+	return nil
+}
+
+// label places a label local to a helper
+func (l *irLowering) label(name string) {
+	l.labels[name] = l.pos()
+}
+
+// ===== Registers and memory =====
+
+// loadWord loads the integer at base+offset
+func (l *irLowering) loadWord(ireg, base string, offset int32) {
+	l.cg.MovMemToXmm(l.regs.floats[2], base, offset)
+	l.cg.MovXmmToReg(ireg, l.regs.floats[2])
+}
+
+// storeWord stores an integer at base+offset
+func (l *irLowering) storeWord(ireg, base string, offset int32) {
+	l.cg.MovRegToXmm(l.regs.floats[2], ireg)
+	l.cg.MovXmmToMem(l.regs.floats[2], base, offset)
+}
+
+// loadImm loads any integer, through rodata if it does not fit in an immediate
+func (l *irLowering) loadImm(ireg string, n int64) {
+	if n >= 0 && n <= irMaxWrite {
+		l.cg.MovImmToReg(ireg, strconv.FormatInt(n, 10))
+		return
+	}
+	label := fmt.Sprintf("ir_i64_%016x", uint64(n))
+	if _, ok := l.eb.consts[label]; !ok {
+		bits := make([]byte, 8)
+		binary.LittleEndian.PutUint64(bits, uint64(n))
+		l.eb.Define(label, string(bits))
+	}
+	l.cg.LeaSymbolToReg(ireg, label)
+	l.loadWord(ireg, ireg, 0)
+}
+
+// scale multiplies an integer register by 1<<shift. Shifts and multiplication
+// differ between the backends, and addition does not.
+func (l *irLowering) scale(ireg string, shift int) {
+	for range shift {
+		l.cg.AddRegToReg(ireg, ireg)
+	}
+}
+
+// copyFloat copies a floating-point register through an integer register
+func (l *irLowering) copyFloat(dst, src, via string) {
+	l.cg.MovXmmToReg(via, src)
+	l.cg.MovRegToXmm(dst, via)
+}
+
+// zeroFloat sets a floating-point register to 0
+func (l *irLowering) zeroFloat(freg, via string) {
+	l.cg.MovImmToReg(via, "0")
+	l.cg.MovRegToXmm(freg, via)
+}
+
+// loadCount loads the count of the container at base into an integer register
+func (l *irLowering) loadCount(ireg, base string) {
+	l.cg.MovMemToXmm(l.regs.floats[2], base, 0)
+	l.cg.Cvttsd2si(ireg, l.regs.floats[2])
+}
+
+// storeCount stores an integer register as the count of the container at base
+func (l *irLowering) storeCount(ireg, base string) {
+	l.cg.Cvtsi2sd(l.regs.floats[2], ireg)
+	l.cg.MovXmmToMem(l.regs.floats[2], base, 0)
+}
+
+// copyWords copies count 8-byte words from src to dst, advancing both and
+// counting count down to 0
+func (l *irLowering) copyWords(dst, src, count, prefix string) {
+	f := l.regs.floats
+	l.label(prefix + ".loop")
+	l.cg.CmpRegToImm(count, 0)
+	l.jumpIf(JumpEqual, prefix+".done")
+	l.cg.MovMemToXmm(f[1], src, 0)
+	l.cg.MovXmmToMem(f[1], dst, 0)
+	l.cg.AddImmToReg(src, 8)
+	l.cg.AddImmToReg(dst, 8)
+	l.cg.SubImmFromReg(count, 1)
+	l.jumpTo(prefix + ".loop")
+	l.label(prefix + ".done")
+}
+
+// syscall makes a system call and moves its result to dst, if dst is not ""
+func (l *irLowering) syscall(name, dst string) {
+	l.cg.MovImmToReg(l.regs.sysNum, strconv.FormatUint(sysNum(l.eb.target, name), 10))
+	l.cg.Syscall()
+	if dst != "" && dst != l.regs.sysRet {
+		l.cg.MovRegToReg(dst, l.regs.sysRet)
+	}
+}
+
+// writeText writes a string constant to stdout
+func (l *irLowering) writeText(text string) {
+	sys := l.regs.sysArgs
+	for len(text) > 0 {
+		chunk := text[:min(len(text), irMaxWrite)]
+		text = text[len(chunk):]
+		l.cg.MovImmToReg(sys[0], "1")
+		l.cg.LeaSymbolToReg(sys[1], l.defineString(chunk))
+		l.cg.MovImmToReg(sys[2], strconv.Itoa(len(chunk)))
+		l.syscall("SYS_WRITE", "")
+	}
+}
+
+// saveLink keeps the return address of a helper that calls another helper
+func (l *irLowering) saveLink(save string) {
+	if l.regs.link != "" {
+		l.storeWord(l.regs.link, save, irSaveLink)
+	}
+}
+
+func (l *irLowering) restoreLink(save string) {
+	if l.regs.link != "" {
+		l.loadWord(l.regs.link, save, irSaveLink)
+	}
+}
+
+// ===== Containers =====
+
+// irContainerData lays out a string constant as a container
+func irContainerData(s string) string {
+	runes := []rune(s)
+	data := make([]byte, irHeaderSize+8*len(runes))
+	binary.LittleEndian.PutUint64(data[0:], math.Float64bits(float64(len(runes))))
+	binary.LittleEndian.PutUint64(data[8:], uint64(len(runes)))
+	for i, r := range runes {
+		binary.LittleEndian.PutUint64(data[irHeaderSize+8*i:], math.Float64bits(float64(r)))
+	}
+	return string(data)
+}
+
+// newContainer allocates a list or map with the values of the arguments
+func (l *irLowering) newContainer(v *IRValue) {
+	cg := l.cg
+	f := l.regs.floats
+	r := l.regs.ints
+	count := len(v.Args)
+	if v.Op == IROpMap {
+		count /= 2
+	}
+	l.loadImm(r[0], int64(irHeaderSize+8*len(v.Args)))
+	l.callRuntime("alloc")
+	l.storeInt(r[0], v)
+	l.loadImm(r[1], int64(count))
+	l.storeWord(r[1], r[0], 8)
+	cg.Cvtsi2sd(f[0], r[1])
+	cg.MovXmmToMem(f[0], r[0], 0)
+	if v.Op == IROpMap {
+		l.zeroFloat(f[1], r[1])
+	}
+	offset := int32(irHeaderSize)
+	for i, arg := range v.Args {
+		if offset > irMaxFrame {
+			cg.AddImmToReg(r[0], int64(offset))
+			offset = 0
+		}
+		l.load(f[0], arg)
+		if v.Op == IROpMap && i%2 == 0 {
+			cg.AddpdXmm(f[0], f[1])
+		}
+		cg.MovXmmToMem(f[0], r[0], offset)
+		offset += 8
+	}
+}
+
+// ===== Helpers =====
+
+// rtAlloc: r0 = size in bytes, a multiple of 8 -> r0 = address
+//
+// ir_heap holds the next free address and the end of the heap, both 0 until
+// the first allocation asks brk where the heap starts.
+func (l *irLowering) rtAlloc() {
+	cg := l.cg
+	r := l.regs.ints
+	a, b, c := l.regs.sysArgs[0], l.regs.sysArgs[1], l.regs.sysArgs[2]
+	cg.LeaSymbolToReg(r[1], "ir_heap")
+	l.loadWord(a, r[1], 0)
+	cg.CmpRegToImm(a, 0)
+	l.jumpIf(JumpNotEqual, "ir_rt_alloc.started")
+	l.syscall("SYS_BRK", a)
+	l.storeWord(a, r[1], 0)
+	l.storeWord(a, r[1], 8)
+	l.label("ir_rt_alloc.started")
+	l.loadWord(b, r[1], 8)
+	cg.MovRegToReg(c, a)
+	cg.AddRegToReg(c, r[0])
+	cg.CmpRegToReg(b, c)
+	l.jumpIf(JumpGreaterOrEqual, "ir_rt_alloc.fits")
+
+	l.loadImm(a, irHeapChunk)
+	cg.AddRegToReg(a, c)
+	l.syscall("SYS_BRK", b)
+	cg.CmpRegToReg(b, c)
+	l.jumpIf(JumpGreaterOrEqual, "ir_rt_alloc.grown")
+	l.writeText("out of memory\n")
+	cg.MovImmToReg(a, "1")
+	l.syscall("SYS_EXIT", "")
+
+	l.label("ir_rt_alloc.grown")
+	l.storeWord(b, r[1], 8)
+	l.loadWord(a, r[1], 0)
+	l.label("ir_rt_alloc.fits")
+	l.storeWord(c, r[1], 0)
+	cg.MovRegToReg(r[0], a)
+	cg.Ret()
+}
+
+// rtListGet: r0 = list or string, args0 = index -> args0 = element, or 0
+// when the index is out of range
+func (l *irLowering) rtListGet() {
+	cg := l.cg
+	r := l.regs.ints
+	fa := l.regs.args
+	a := l.regs.sysArgs[0]
+	cg.Cvttsd2si(r[1], fa[0])
+	cg.CmpRegToImm(r[1], 0)
+	l.jumpIf(JumpLess, "ir_rt_list_get.missing")
+	l.loadCount(a, r[0])
+	cg.CmpRegToReg(r[1], a)
+	l.jumpIf(JumpGreaterOrEqual, "ir_rt_list_get.missing")
+	l.scale(r[1], 3)
+	cg.AddRegToReg(r[1], r[0])
+	cg.MovMemToXmm(fa[0], r[1], irHeaderSize)
+	cg.Ret()
+	l.label("ir_rt_list_get.missing")
+	l.zeroFloat(fa[0], r[1])
+	cg.Ret()
+}
+
+// findKey normalizes the key in args0 and looks for it in the map at r0.
+// It jumps to prefix.found with r1 at the entry, or to prefix.missing with
+// r1 at the end of the entries.
+func (l *irLowering) findKey(prefix string) {
+	cg := l.cg
+	r := l.regs.ints
+	fa := l.regs.args
+	a, b, c := l.regs.sysArgs[0], l.regs.sysArgs[1], l.regs.sysArgs[2]
+	l.zeroFloat(fa[2], r[1])
+	cg.AddpdXmm(fa[0], fa[2])
+	cg.MovXmmToReg(b, fa[0])
+	l.loadCount(c, r[0])
+	cg.MovRegToReg(r[1], r[0])
+	cg.AddImmToReg(r[1], irHeaderSize)
+	l.label(prefix + ".scan")
+	cg.CmpRegToImm(c, 0)
+	l.jumpIf(JumpEqual, prefix+".missing")
+	l.loadWord(a, r[1], 0)
+	cg.CmpRegToReg(a, b)
+	l.jumpIf(JumpEqual, prefix+".found")
+	cg.AddImmToReg(r[1], 16)
+	cg.SubImmFromReg(c, 1)
+	l.jumpTo(prefix + ".scan")
+}
+
+// rtMapGet: r0 = map, args0 = key -> args0 = value, or 0
+func (l *irLowering) rtMapGet() {
+	fa := l.regs.args
+	l.findKey("ir_rt_map_get")
+	l.label("ir_rt_map_get.found")
+	l.cg.MovMemToXmm(fa[0], l.regs.ints[1], 8)
+	l.cg.Ret()
+	l.label("ir_rt_map_get.missing")
+	l.zeroFloat(fa[0], l.regs.ints[1])
+	l.cg.Ret()
+}
+
+// rtAppend: r0 = list, args0 = value -> r0 = a new list
+func (l *irLowering) rtAppend() {
+	r := l.regs.ints
+	l.loadCount(r[1], r[0])
+	l.cg.AddImmToReg(r[1], 1)
+	l.jumpTo(irRuntimeLabel("grow_list"))
+}
+
+// rtPush: r0 = list, args0 = value, args1 = whether the list is owned ->
+// r0 = the list, or a new one if it is not owned or full. A new list has
+// room to double, so that pushing in a loop takes amortized constant time.
+func (l *irLowering) rtPush() {
+	cg := l.cg
+	r := l.regs.ints
+	fa := l.regs.args
+	a, c := l.regs.sysArgs[0], l.regs.sysArgs[2]
+	l.loadCount(c, r[0])
+	cg.MovXmmToReg(r[1], fa[1])
+	cg.CmpRegToImm(r[1], 0)
+	l.jumpIf(JumpEqual, "ir_rt_push.full")
+	l.loadWord(a, r[0], 8)
+	cg.CmpRegToReg(c, a)
+	l.jumpIf(JumpGreaterOrEqual, "ir_rt_push.full")
+	cg.MovRegToReg(r[1], c)
+	l.scale(r[1], 3)
+	cg.AddRegToReg(r[1], r[0])
+	cg.MovXmmToMem(fa[0], r[1], irHeaderSize)
+	cg.AddImmToReg(c, 1)
+	l.storeCount(c, r[0])
+	cg.Ret()
+	l.label("ir_rt_push.full")
+	l.growCapacity("ir_rt_push", c, 8)
+	l.jumpTo(irRuntimeLabel("grow_list"))
+}
+
+// growCapacity sets r1 to twice the count in a register, and at least least
+func (l *irLowering) growCapacity(prefix, count string, least int) {
+	r := l.regs.ints
+	l.cg.MovRegToReg(r[1], count)
+	l.cg.AddRegToReg(r[1], r[1])
+	l.cg.CmpRegToImm(r[1], int64(least))
+	l.jumpIf(JumpGreaterOrEqual, prefix+".grow")
+	l.cg.MovImmToReg(r[1], strconv.Itoa(least))
+	l.label(prefix + ".grow")
+}
+
+// rtSet: r0 = map, args0 = key, args1 = value -> r0 = the map, or a new one
+// if it was full
+func (l *irLowering) rtSet() {
+	cg := l.cg
+	r := l.regs.ints
+	fa := l.regs.args
+	a, c := l.regs.sysArgs[0], l.regs.sysArgs[2]
+	l.findKey("ir_rt_set")
+	l.label("ir_rt_set.found")
+	cg.MovXmmToMem(fa[1], r[1], 8)
+	cg.Ret()
+	l.label("ir_rt_set.missing")
+	l.loadCount(c, r[0])
+	l.loadWord(a, r[0], 8)
+	cg.CmpRegToReg(c, a)
+	l.jumpIf(JumpGreaterOrEqual, "ir_rt_set.full")
+	cg.MovXmmToMem(fa[0], r[1], 0)
+	cg.MovXmmToMem(fa[1], r[1], 8)
+	cg.AddImmToReg(c, 1)
+	l.storeCount(c, r[0])
+	cg.Ret()
+	l.label("ir_rt_set.full")
+	l.growCapacity("ir_rt_set", c, 4)
+	l.jumpTo(irRuntimeLabel("grow_map"))
+}
+
+// rtGrow: r0 = container, r1 = capacity, args0 (and args1 for a map) = the
+// entry to add -> r0 = a copy of the container with the entry added
+func (l *irLowering) rtGrow(name string, words int) {
+	cg := l.cg
+	r := l.regs.ints
+	fa := l.regs.args
+	a, b, c := l.regs.sysArgs[0], l.regs.sysArgs[1], l.regs.sysArgs[2]
+	n := l.regs.sysNum
+	prefix := irRuntimeLabel(name)
+	cg.LeaSymbolToReg(a, "ir_rt_save")
+	l.saveLink(a)
+	l.storeWord(r[0], a, irSaveFirst)
+	cg.MovXmmToMem(fa[0], a, irSaveSecond)
+	cg.MovXmmToMem(fa[1], a, irSaveThird)
+	l.storeWord(r[1], a, irSaveCount)
+	cg.MovRegToReg(r[0], r[1])
+	l.scale(r[0], 2+words)
+	cg.AddImmToReg(r[0], irHeaderSize)
+	l.callRuntime("alloc")
+
+	cg.LeaSymbolToReg(a, "ir_rt_save")
+	l.loadWord(c, a, irSaveCount)
+	l.storeWord(c, r[0], 8)
+	l.loadWord(b, a, irSaveFirst)
+	l.loadCount(c, b)
+	cg.MovRegToReg(n, c)
+	if words == 2 {
+		cg.AddRegToReg(c, c)
+	}
+	cg.AddImmToReg(b, irHeaderSize)
+	cg.MovRegToReg(r[1], r[0])
+	cg.AddImmToReg(r[1], irHeaderSize)
+	l.copyWords(r[1], b, c, prefix+".copy")
+	cg.MovMemToXmm(fa[0], a, irSaveSecond)
+	cg.MovXmmToMem(fa[0], r[1], 0)
+	if words == 2 {
+		cg.MovMemToXmm(fa[0], a, irSaveThird)
+		cg.MovXmmToMem(fa[0], r[1], 8)
+	}
+	cg.AddImmToReg(n, 1)
+	l.storeCount(n, r[0])
+	l.restoreLink(a)
+	cg.Ret()
+}
+
+// rtConcat: r0 = string, r1 = string -> r0 = a new string of both
+func (l *irLowering) rtConcat() {
+	cg := l.cg
+	r := l.regs.ints
+	fa := l.regs.args
+	a, b, c := l.regs.sysArgs[0], l.regs.sysArgs[1], l.regs.sysArgs[2]
+	cg.LeaSymbolToReg(a, "ir_rt_save")
+	l.saveLink(a)
+	l.storeWord(r[0], a, irSaveFirst)
+	l.storeWord(r[1], a, irSaveSecond)
+	cg.MovMemToXmm(fa[0], r[0], 0)
+	cg.MovMemToXmm(fa[1], r[1], 0)
+	cg.AddpdXmm(fa[0], fa[1])
+	cg.Cvttsd2si(r[0], fa[0])
+	l.storeWord(r[0], a, irSaveCount)
+	l.scale(r[0], 3)
+	cg.AddImmToReg(r[0], irHeaderSize)
+	l.callRuntime("alloc")
+
+	cg.LeaSymbolToReg(a, "ir_rt_save")
+	l.loadWord(c, a, irSaveCount)
+	l.storeWord(c, r[0], 8)
+	l.storeCount(c, r[0])
+	cg.MovRegToReg(r[1], r[0])
+	cg.AddImmToReg(r[1], irHeaderSize)
+	for _, slot := range []int32{irSaveFirst, irSaveSecond} {
+		l.loadWord(b, a, slot)
+		l.loadCount(c, b)
+		cg.AddImmToReg(b, irHeaderSize)
+		l.copyWords(r[1], b, c, fmt.Sprintf("ir_rt_concat.copy%d", slot))
+	}
+	l.restoreLink(a)
+	cg.Ret()
+}
+
+// rtPrintNumber: args0 = number
+//
+// The number is printed as the integer it truncates to, the way the AST code
+// generator prints it. Digits are found with floating-point division by
+// powers of ten, which every backend has, and written to ir_rt_buf.
+func (l *irLowering) rtPrintNumber() {
+	cg := l.cg
+	r := l.regs.ints
+	fa := l.regs.args
+	a, b, c := l.regs.sysArgs[0], l.regs.sysArgs[1], l.regs.sysArgs[2]
+	cg.LeaSymbolToReg(r[1], "ir_rt_buf")
+	cg.Cvttsd2si(a, fa[0])
+	cg.CmpRegToImm(a, 0)
+	l.jumpIf(JumpGreaterOrEqual, "ir_rt_print_number.positive")
+	cg.MovImmToReg(b, "45") // '-'
+	l.storeWord(b, r[1], 0)
+	cg.AddImmToReg(r[1], 1)
+	cg.NegReg(a)
+	cg.CmpRegToImm(a, 0)
+	l.jumpIf(JumpGreaterOrEqual, "ir_rt_print_number.positive")
+	// The most negative integer has no positive counterpart
+	l.writeText(strconv.FormatInt(math.MinInt64, 10))
+	cg.Ret()
+
+	l.label("ir_rt_print_number.positive")
+	cg.Cvtsi2sd(fa[0], a)
+	cg.MovImmToReg(b, "10")
+	cg.Cvtsi2sd(fa[2], b)
+	cg.MovImmToReg(b, "1")
+	cg.Cvtsi2sd(fa[1], b)
+	// Find the largest power of ten that is not above the number. The
+	// difference is compared rather than the power, which may not fit in an
+	// integer.
+	l.label("ir_rt_print_number.scale")
+	l.copyFloat(fa[3], fa[1], c)
+	cg.MulpdXmm(fa[3], fa[2])
+	l.copyFloat(fa[4], fa[0], c)
+	cg.SubpdXmm(fa[4], fa[3])
+	cg.MovXmmToReg(c, fa[4])
+	cg.CmpRegToImm(c, 0)
+	l.jumpIf(JumpLess, "ir_rt_print_number.digits")
+	l.copyFloat(fa[1], fa[3], c)
+	l.jumpTo("ir_rt_print_number.scale")
+
+	l.label("ir_rt_print_number.digits")
+	l.copyFloat(fa[3], fa[0], c)
+	cg.DivpdXmm(fa[3], fa[1])
+	cg.Cvttsd2si(b, fa[3])
+	cg.Cvtsi2sd(fa[3], b)
+	cg.MulpdXmm(fa[3], fa[1])
+	cg.SubpdXmm(fa[0], fa[3])
+	cg.AddImmToReg(b, 48) // '0'
+	l.storeWord(b, r[1], 0)
+	cg.AddImmToReg(r[1], 1)
+	cg.DivpdXmm(fa[1], fa[2])
+	cg.Cvttsd2si(c, fa[1])
+	cg.CmpRegToImm(c, 0)
+	l.jumpIf(JumpNotEqual, "ir_rt_print_number.digits")
+
+	cg.LeaSymbolToReg(b, "ir_rt_buf")
+	cg.MovRegToReg(c, r[1])
+	cg.SubRegToReg(c, b)
+	cg.MovImmToReg(a, "1")
+	l.syscall("SYS_WRITE", "")
+	cg.Ret()
+}
+
+// rtPrintString: r0 = string
+//
+// Each codepoint is printed as its low byte, the way the AST code generator
+// prints strings, through ir_rt_buf.
+func (l *irLowering) rtPrintString() {
+	cg := l.cg
+	r := l.regs.ints
+	fa := l.regs.args
+	a, b, c := l.regs.sysArgs[0], l.regs.sysArgs[1], l.regs.sysArgs[2]
+	l.loadCount(c, r[0])
+	cg.MovRegToReg(b, r[0])
+	cg.AddImmToReg(b, irHeaderSize)
+	cg.LeaSymbolToReg(r[1], "ir_rt_buf")
+
+	// flush writes the buffer, keeping the position in the string in
+	// ir_rt_buf past the characters, which the write does not touch
+	flush := func(last bool) {
+		cg.LeaSymbolToReg(r[0], "ir_rt_buf")
+		if !last {
+			l.storeWord(b, r[0], irPrintBuffer-8)
+			cg.MovRegToXmm(fa[1], c)
+		}
+		cg.MovRegToReg(c, r[1])
+		cg.SubRegToReg(c, r[0])
+		cg.MovRegToReg(b, r[0])
+		cg.MovImmToReg(a, "1")
+		l.syscall("SYS_WRITE", "")
+		if last {
+			cg.Ret()
+			return
+		}
+		cg.LeaSymbolToReg(r[1], "ir_rt_buf")
+		l.loadWord(b, r[1], irPrintBuffer-8)
+		cg.MovXmmToReg(c, fa[1])
+		l.jumpTo("ir_rt_print_string.next")
+	}
+
+	l.label("ir_rt_print_string.next")
+	cg.CmpRegToImm(c, 0)
+	l.jumpIf(JumpEqual, "ir_rt_print_string.done")
+	cg.MovMemToXmm(fa[0], b, 0)
+	cg.Cvttsd2si(r[0], fa[0])
+	l.storeWord(r[0], r[1], 0)
+	cg.AddImmToReg(r[1], 1)
+	cg.AddImmToReg(b, 8)
+	cg.SubImmFromReg(c, 1)
+	cg.LeaSymbolToReg(r[0], "ir_rt_buf")
+	cg.MovRegToReg(a, r[1])
+	cg.SubRegToReg(a, r[0])
+	cg.CmpRegToImm(a, irPrintBuffer-16)
+	l.jumpIf(JumpLess, "ir_rt_print_string.next")
+	flush(false)
+	l.label("ir_rt_print_string.done")
+	flush(true)
+}
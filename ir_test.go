@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func buildTestIR(t *testing.T, code string) *IRModule {
+	t.Helper()
+	mod := BuildIR(NewParser(code).ParseProgram())
+	if err := mod.Verify(); err != nil {
+		t.Fatalf("invalid IR: %v\n%s", err, mod)
+	}
+	return mod
+}
+
+func TestIRLoopPhi(t *testing.T) {
+	mod := buildTestIR(t, `
+sum := 0
+@ i in 0..<10 {
+    sum <- sum + i
+}
+exit(sum)
+`)
+	main := mod.Function("main")
+	var phis int
+	for _, b := range main.Blocks {
+		for _, v := range b.Values {
+			if v.Op == IROpPhi {
+				phis++
+				if len(v.Args) != len(b.Preds) {
+					t.Errorf("%s has %d arguments for %d predecessors", v, len(v.Args), len(b.Preds))
+				}
+			}
+		}
+	}
+	if phis != 2 {
+		t.Errorf("expected phis for the counter and the sum, got %d:\n%s", phis, mod)
+	}
+	if len(mod.Opaque()) != 0 {
+		t.Errorf("unexpected opaque instructions:\n%s", mod)
+	}
+}
+
+func TestIRFunctionsAndGlobals(t *testing.T) {
+	mod := buildTestIR(t, `
+hits := 0
+square = x -> {
+    hits <- hits + 1
+    x * x
+}
+exit(square(3) + hits)
+`)
+	if mod.Function("square") == nil {
+		t.Fatalf("no function for square:\n%s", mod)
+	}
+	if len(mod.Globals) != 1 || mod.Globals[0] != "hits" {
+		t.Errorf("expected hits to be the only global, got %v", mod.Globals)
+	}
+	text := mod.String()
+	for _, want := range []string{"global @hits", "store @hits", "load @hits", "call @square"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected %q in:\n%s", want, text)
+		}
+	}
+}
+
+func TestIRMatch(t *testing.T) {
+	mod := buildTestIR(t, `
+sign = x -> x {
+    | x > 0 => 1
+    | x < 0 => -1
+    ~> 0
+}
+exit(sign(-5) + 1)
+`)
+	fn := mod.Function("sign")
+	if fn == nil {
+		t.Fatalf("no function for sign:\n%s", mod)
+	}
+	last := fn.Blocks[len(fn.Blocks)-1]
+	if len(last.Values) == 0 || last.Values[0].Op != IROpPhi || len(last.Values[0].Args) != 3 {
+		t.Errorf("expected the clauses to join in a phi with three arguments:\n%s", fn)
+	}
+}
+
+func TestIROpaque(t *testing.T) {
+	mod := buildTestIR(t, `
+main = {
+    k := 3
+    f := x -> x + k
+    f(2)
+}
+`)
+	if len(mod.Opaque()) == 0 {
+		t.Errorf("expected the closure to be kept opaque:\n%s", mod)
+	}
+}
+
+func TestIRContainers(t *testing.T) {
+	mod := buildTestIR(t, `
+xs := [1, 2]
+m := {1: 10}
+m[2] <- 20
+s := "a" + "b"
+@ i in 0..<10 {
+    xs <- append(xs, i)
+}
+exit(xs[1] + m[2] + #s)
+`)
+	if len(mod.Opaque()) != 0 {
+		t.Errorf("unexpected opaque instructions:\n%s", mod)
+	}
+	text := mod.String()
+	for _, want := range []string{"list list", "map map", "map set", "string concat", "list push", "f64 index", "f64 len"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected %q in:\n%s", want, text)
+		}
+	}
+}
+
+func TestIRVerifyErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(f *IRFunction)
+		want  string
+	}{
+		{
+			name: "missing terminator",
+			build: func(f *IRFunction) {
+				b := f.NewBlock()
+				f.NewValue(b, IROpConst, IRF64)
+			},
+			want: "terminator",
+		},
+		{
+			name: "type mismatch",
+			build: func(f *IRFunction) {
+				b := f.NewBlock()
+				c := f.NewValue(b, IROpConst, IRF64)
+				f.NewValue(b, IROpBranch, IRVoid, c).Targets = []*IRBlock{b, b}
+				AddEdge(b, b)
+				AddEdge(b, b)
+			},
+			want: "bool",
+		},
+		{
+			name: "use before definition",
+			build: func(f *IRFunction) {
+				entry := f.NewBlock()
+				then := f.NewBlock()
+				join := f.NewBlock()
+				cond := f.NewValue(entry, IROpConst, IRF64)
+				test := f.NewValue(entry, IROpNe, IRBool, cond, cond)
+				f.NewValue(entry, IROpBranch, IRVoid, test).Targets = []*IRBlock{then, join}
+				AddEdge(entry, then)
+				AddEdge(entry, join)
+				onlyThen := f.NewValue(then, IROpConst, IRF64)
+				f.NewValue(then, IROpJump, IRVoid).Targets = []*IRBlock{join}
+				AddEdge(then, join)
+				f.NewValue(join, IROpReturn, IRVoid, onlyThen)
+			},
+			want: "dominate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &IRFunction{Name: "main"}
+			tt.build(f)
+			err := (&IRModule{Functions: []*IRFunction{f}}).Verify()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error about %q, got %v\n%s", tt.want, err, f)
+			}
+		})
+	}
+}
+
+func TestDumpIR(t *testing.T) {
+	out, err := DumpIR(NewParser("x := 2\nexit(x * 3)\n").ParseProgram())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"func main() {", "f64 mul", "exit v"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+}
+
+// lowerTestIR lowers a program for arch and returns the builder holding the text
+func lowerTestIR(t *testing.T, arch Arch, code string) *ExecutableBuilder {
+	t.Helper()
+	eb, err := NewWithTarget(NewTarget(arch, OSLinux))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := LowerIR(buildTestIR(t, code), eb); err != nil {
+		t.Fatal(err)
+	}
+	return eb
+}
+
+// irProgramTests are programs the IR covers, with their exit status and output
+var irProgramTests = []struct {
+	name   string
+	code   string
+	status int
+	output string
+}{
+	{"exit", "exit(42)", 42, ""},
+	{"arithmetic", "exit((7 - 2) * 6 / 3 % 4)", 2, ""},
+	{"negation", "x := -3\nexit(x + 10)", 7, ""},
+	{"println", "println(\"hello\")\nexit(0)", 0, "hello\n"},
+	{"loop", "sum := 0\n@ i in 0..<10 {\n    sum <- sum + i\n}\nexit(sum)", 45, ""},
+	{"while", "n := 1\n@ n < 100 max 10 {\n    n <- n * 3\n}\nexit(n)", 243, ""},
+	{"max iterations", "n := 1\n@ n < 100 max 3 {\n    n <- n * 3\n}\nexit(n)", 27, ""},
+	{"recursion", "fib = n -> n < 2 {\n    => n\n    ~> fib(n - 1) + fib(n - 2)\n}\nexit(fib(10))", 55, ""},
+	{"guards", "sign = x -> x {\n    | x > 0 => 1\n    | x < 0 => 2\n    ~> 3\n}\nexit(sign(-5) * 10 + sign(0))", 23, ""},
+	{"logic", "a := 3\nexit((a > 1 and a <= 3) + (a == 2 or not (a != 3)) * 2)", 3, ""},
+	{"nested logic", "a := 3\nexit((a > 1 and (a < 2 or a == 3)) * 5)", 5, ""},
+	{"globals", "hits := 0\nbump = x -> {\n    hits <- hits + x\n    hits\n}\nbump(4)\nbump(5)\nexit(hits)", 9, ""},
+	{"default result", "x := 1", 1, ""},
+	{"last number", "x := 42\nprintln(\"hi\")\nprintln(7)\ns := \"a\"\nprintln(s)", 0, "hi\n7\na\n"},
+	{"loop result", "x := 42\n@ i in 0..<3 max 3 {\n}", 0, ""},
+	{"printed result", "x := 42\nprintln(x + 1)", 43, "43\n"},
+	{"print numbers", "println(42)\nprintln(-5.9)\nprintln(1234567890123)\nprint(7)\nprintln(\"\")\nexit(0)", 0, "42\n-5\n1234567890123\n7\n"},
+	{"println arguments", "println(1, \"a\", 2.5)\nexit(0)", 0, "1 a 2\n"},
+	{"lists", "xs := [4, 5, 6]\nexit(xs[1] + #xs * 10 + xs[7] + xs[-1])", 35, ""},
+	{"maps", "m := {1: 10, 2: 20}\nexit(m[2] + m[3] + #m)", 22, ""},
+	{"strings", "s := \"ab\" + \"c\"\nprintln(s)\nexit(#s)", 3, "abc\n"},
+	{"string loop", "n := 0\n@ c in \"hi\" max 5 {\n    n <- n + c\n}\nexit(n - 200)", 9, ""},
+	{"push", "ys := []\n@ i in 0..<20 {\n    ys <- append(ys, i)\n}\nexit(ys[19] + #ys)", 39, ""},
+	{"map update", "m := {1: 1}\nput = k -> {\n    m[k] <- k * 2\n    #m\n}\nput(1)\nput(3)\nput(5)\nput(7)\nput(9)\nexit(m[1] + m[9] + #m)", 25, ""},
+	{"main lambda", "main = {\n    println(\"hi\")\n    7\n}", 7, "hi\n"},
+}
+
+func TestLowerIRRiscv64(t *testing.T) {
+	for _, tt := range irProgramTests {
+		t.Run(tt.name, func(t *testing.T) {
+			eb := lowerTestIR(t, ArchRiscv64, tt.code)
+			status, output, err := runRiscv64(eb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.status || output != tt.output {
+				t.Errorf("got status %d and output %q, want %d and %q", status, output, tt.status, tt.output)
+			}
+		})
+	}
+}
+
+// TestLowerIRX86_64 compiles programs, which are lowered from the IR unless
+// it does not cover them, and runs them
+func TestLowerIRX86_64(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.Skip("runs x86-64 Linux executables")
+	}
+	dir := t.TempDir()
+	compile := func(t *testing.T, code string) (*C67Compiler, string) {
+		fc, err := NewC67Compiler(Platform{OS: OSLinux, Arch: ArchX86_64}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exe := filepath.Join(dir, strings.ReplaceAll(t.Name(), "/", "_"))
+		if err := fc.Compile(parseSource(code, "test.vibe67"), exe); err != nil {
+			t.Fatalf("compilation failed: %v", err)
+		}
+		return fc, exe
+	}
+	run := func(t *testing.T, exe string) (int, string) {
+		var stdout bytes.Buffer
+		cmd := exec.Command(exe)
+		cmd.Stdout = &stdout
+		err := cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), stdout.String()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return 0, stdout.String()
+	}
+	lowered := func(fc *C67Compiler) bool {
+		for name := range fc.eb.consts {
+			if strings.HasPrefix(name, "ir_") {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, tt := range irProgramTests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc, exe := compile(t, tt.code)
+			if !lowered(fc) {
+				t.Errorf("not lowered from the IR")
+			}
+			if status, output := run(t, exe); status != tt.status || output != tt.output {
+				t.Errorf("got status %d and output %q, want %d and %q", status, output, tt.status, tt.output)
+			}
+		})
+	}
+
+	// C calls are not in the IR yet, and lists that are kept as persistent
+	// tries are not in its runtime, so the AST code generator takes over
+	fallbacks := []struct {
+		name   string
+		code   string
+		status int
+		output string
+	}{
+		{"c call", "printf(\"%.1f\\n\", 2.5)\nexit(0)", 0, "2.5\n"},
+		{"persistent", "xs := [1]\nys := xs\nxs <- append(xs, 2)\nprintln(#xs)\nprintln(#ys)\nexit(0)", 0, "2\n1\n"},
+	}
+	for _, tt := range fallbacks {
+		t.Run("fallback/"+tt.name, func(t *testing.T) {
+			fc, exe := compile(t, tt.code)
+			if lowered(fc) {
+				t.Errorf("lowered from the IR")
+			}
+			if status, output := run(t, exe); status != tt.status || output != tt.output {
+				t.Errorf("got status %d and output %q, want %d and %q", status, output, tt.status, tt.output)
+			}
+		})
+	}
+}
+
+func TestLowerIRUnsupported(t *testing.T) {
+	eb, err := NewWithTarget(NewTarget(ArchRiscv64, OSLinux))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LowerIR(buildTestIR(t, "main = {\n    k := 3\n    f := x -> x + k\n    f(2)\n}"), eb)
+	if err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("expected an unsupported error, got %v", err)
+	}
+	eb, _ = NewWithTarget(NewTarget(ArchUnknown, OSLinux))
+	if err := LowerIR(buildTestIR(t, "exit(0)"), eb); err == nil {
+		t.Errorf("expected an error when lowering for an unknown architecture")
+	}
+}
+
+func TestLowerIRARM64(t *testing.T) {
+	eb := lowerTestIR(t, ArchARM64, "fib = n -> n < 2 {\n    => n\n    ~> fib(n - 1) + fib(n - 2)\n}\nexit(fib(10))")
+	text := eb.text.Bytes()
+	if len(text) == 0 || len(text)%4 != 0 {
+		t.Fatalf("unexpected text size %d", len(text))
+	}
+	word := func(pos int) uint32 { return binary.LittleEndian.Uint32(text[pos:]) }
+	isPrologue := func(instr uint32) bool {
+		// SUB sp, sp, #imm
+		return instr&0xFFC003FF == 0xD10003FF
+	}
+	if !isPrologue(word(0)) {
+		t.Errorf("main does not start with a prologue: %08x", word(0))
+	}
+	var calls, adds int
+	for pos := 0; pos < len(text); pos += 4 {
+		instr := word(pos)
+		switch {
+		case instr&0xFC000000 == 0x94000000: // BL
+			calls++
+			target := pos + int(int32(instr<<6)>>6)*4
+			if target <= 0 || target >= len(text) || !isPrologue(word(target)) {
+				t.Errorf("call at %#x goes to %#x, which is not a function", pos, target)
+			}
+		case instr&0xFC000000 == 0x14000000: // B
+			target := pos + int(int32(instr<<6)>>6)*4
+			if target < 0 || target >= len(text) || target == pos {
+				t.Errorf("jump at %#x goes to %#x", pos, target)
+			}
+		case instr == 0x1E712A10: // FADD d16, d16, d17
+			adds++
+		}
+	}
+	if calls != 3 {
+		t.Errorf("expected three calls, found %d", calls)
+	}
+	if adds == 0 {
+		t.Errorf("expected the sum to be computed in d16 and d17")
+	}
+}
+
+// TestLowerIRARM64Executable compiles a program that uses the runtime of
+// ir_runtime.go for ARM64 Linux, and checks that the executable is static and
+// that its addresses of symbols point at them
+func TestLowerIRARM64Executable(t *testing.T) {
+	fc, err := NewC67Compiler(Platform{OS: OSLinux, Arch: ArchARM64}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe := filepath.Join(t.TempDir(), "test")
+	if err := fc.Compile(parseSource("xs := [1, 2]\nm := {1: 2}\nprintln(xs[1] + m[1])\nprintln(\"a\" + \"b\")", "test.vibe67"), exe); err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Machine != elf.EM_AARCH64 {
+		t.Errorf("machine = %v, want EM_AARCH64", f.Machine)
+	}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			t.Errorf("expected a static executable")
+		}
+	}
+	if len(fc.eb.pcRelocations) == 0 {
+		t.Fatalf("no symbols are used")
+	}
+	text := fc.eb.text.Bytes()
+	for _, reloc := range fc.eb.pcRelocations {
+		c, ok := fc.eb.consts[reloc.symbolName]
+		if !ok || !strings.HasPrefix(reloc.symbolName, "ir_") {
+			t.Fatalf("unexpected symbol %s", reloc.symbolName)
+		}
+		// ADRP x, page; ADD x, x, offset
+		adrp := binary.LittleEndian.Uint32(text[reloc.offset:])
+		add := binary.LittleEndian.Uint32(text[reloc.offset+4:])
+		pc := f.Entry + reloc.offset
+		page := int64(int32((adrp>>5&0x7FFFF)<<13|(adrp>>29&3)<<11) >> 11)
+		addr := uint64(int64(pc&^0xFFF)+page<<12) + uint64(add>>10&0xFFF)
+		if addr != c.addr {
+			t.Errorf("%s is at %#x, but the code uses %#x", reloc.symbolName, c.addr, addr)
+		}
+	}
+}
+
+// runRiscv64 runs the lowered text of eb in a minimal RV64 emulator that
+// covers the instructions LowerIR emits, and returns the exit status and
+// what was written to stdout
+func runRiscv64(eb *ExecutableBuilder) (int, string, error) {
+	const (
+		textAddr = 0x10000
+		dataAddr = 0x100000
+		heapAddr = 0x400000
+		heapEnd  = 0x700000
+		stackTop = 0x7F0000
+	)
+	mem := make([]byte, 0x800000)
+	brk := uint64(heapAddr)
+	text := eb.text.Bytes()
+	copy(mem[textAddr:], text)
+
+	addrs := make(map[string]uint64)
+	next := uint64(dataAddr)
+	for name, c := range eb.consts {
+		addrs[name] = next
+		copy(mem[next:], c.value)
+		next += (uint64(len(c.value)) + 15) &^ 15
+	}
+	for _, reloc := range eb.pcRelocations {
+		target, ok := addrs[reloc.symbolName]
+		if !ok {
+			return 0, "", fmt.Errorf("undefined symbol %s", reloc.symbolName)
+		}
+		pc := textAddr + reloc.offset
+		offset := int64(target) - int64(pc)
+		upper := uint32((offset + 0x800) >> 12)
+		lower := uint32(offset) & 0xFFF
+		auipc := binary.LittleEndian.Uint32(mem[pc:])
+		addi := binary.LittleEndian.Uint32(mem[pc+4:])
+		binary.LittleEndian.PutUint32(mem[pc:], auipc&0xFFF|upper<<12)
+		binary.LittleEndian.PutUint32(mem[pc+4:], addi&0xFFFFF|lower<<20)
+	}
+
+	var x [32]uint64
+	var f [32]float64
+	var output strings.Builder
+	x[2] = stackTop
+	pc := uint64(textAddr)
+	signExtend := func(v uint32, bits uint) int64 {
+		return int64(int32(v<<(32-bits))) >> (32 - bits)
+	}
+	for steps := 0; steps < 1000000; steps++ {
+		if pc < textAddr || pc >= textAddr+uint64(len(text)) {
+			return 0, "", fmt.Errorf("pc %#x is outside of the text", pc)
+		}
+		instr := binary.LittleEndian.Uint32(mem[pc:])
+		rd := instr >> 7 & 31
+		rs1 := instr >> 15 & 31
+		rs2 := instr >> 20 & 31
+		funct3 := instr >> 12 & 7
+		funct7 := instr >> 25
+		immI := signExtend(instr>>20, 12)
+		immS := signExtend(instr>>25<<5|instr>>7&31, 12)
+		nextPC := pc + 4
+		switch instr & 0x7F {
+		case 0x13: // ADDI
+			if funct3 != 0 {
+				return 0, "", fmt.Errorf("unsupported instruction %08x at %#x", instr, pc)
+			}
+			x[rd] = x[rs1] + uint64(immI)
+		case 0x33: // ADD, SUB
+			switch {
+			case funct3 == 0 && funct7 == 0:
+				x[rd] = x[rs1] + x[rs2]
+			case funct3 == 0 && funct7 == 0x20:
+				x[rd] = x[rs1] - x[rs2]
+			default:
+				return 0, "", fmt.Errorf("unsupported instruction %08x at %#x", instr, pc)
+			}
+		case 0x17: // AUIPC
+			x[rd] = pc + uint64(int64(int32(instr&0xFFFFF000)))
+		case 0x07: // FLD
+			f[rd] = math.Float64frombits(binary.LittleEndian.Uint64(mem[x[rs1]+uint64(immI):]))
+		case 0x27: // FSD
+			binary.LittleEndian.PutUint64(mem[x[rs1]+uint64(immS):], math.Float64bits(f[rs2]))
+		case 0x53:
+			switch funct7 {
+			case 0x01:
+				f[rd] = f[rs1] + f[rs2]
+			case 0x05:
+				f[rd] = f[rs1] - f[rs2]
+			case 0x09:
+				f[rd] = f[rs1] * f[rs2]
+			case 0x0D:
+				f[rd] = f[rs1] / f[rs2]
+			case 0x79: // FMV.D.X
+				f[rd] = math.Float64frombits(x[rs1])
+			case 0x71: // FMV.X.D
+				x[rd] = math.Float64bits(f[rs1])
+			case 0x69: // FCVT.D.L
+				f[rd] = float64(int64(x[rs1]))
+			case 0x61: // FCVT.L.D
+				if funct3 != 1 || rs2 != 2 {
+					return 0, "", fmt.Errorf("unsupported conversion %08x at %#x", instr, pc)
+				}
+				x[rd] = uint64(int64(math.Trunc(f[rs1])))
+			default:
+				return 0, "", fmt.Errorf("unsupported instruction %08x at %#x", instr, pc)
+			}
+		case 0x63: // BEQ, BNE, BLT, BGE
+			imm := signExtend(instr>>31<<12|instr>>7&1<<11|instr>>25&0x3F<<5|instr>>8&0xF<<1, 13)
+			a, b := int64(x[rs1]), int64(x[rs2])
+			var taken bool
+			switch funct3 {
+			case 0:
+				taken = a == b
+			case 1:
+				taken = a != b
+			case 4:
+				taken = a < b
+			case 5:
+				taken = a >= b
+			default:
+				return 0, "", fmt.Errorf("unsupported branch %08x at %#x", instr, pc)
+			}
+			if taken {
+				nextPC = pc + uint64(imm)
+			}
+		case 0x6F: // JAL
+			imm := signExtend(instr>>31<<20|instr>>12&0xFF<<12|instr>>20&1<<11|instr>>21&0x3FF<<1, 21)
+			x[rd] = pc + 4
+			nextPC = pc + uint64(imm)
+		case 0x67: // JALR
+			target := (x[rs1] + uint64(immI)) &^ 1
+			x[rd] = pc + 4
+			nextPC = target
+		case 0x73: // ECALL
+			switch x[17] {
+			case 64: // write
+				output.Write(mem[x[11] : x[11]+x[12]])
+			case 93: // exit
+				return int(x[10]), output.String(), nil
+			case 214: // brk
+				if x[10] >= heapAddr && x[10] <= heapEnd {
+					brk = x[10]
+				}
+				x[10] = brk
+			default:
+				return 0, "", fmt.Errorf("unsupported system call %d", x[17])
+			}
+		default:
+			return 0, "", fmt.Errorf("unsupported instruction %08x at %#x", instr, pc)
+		}
+		x[0] = 0
+		pc = nextPC
+	}
+	return 0, "", fmt.Errorf("the program did not exit")
+}
@@ -179,6 +179,8 @@ const (
 	TOKEN_YES      // yes (boolean true)
 	TOKEN_NO       // no (boolean false)
 	TOKEN_BOOL     // bool (boolean type annotation)
+	TOKEN_LOCK     // lock (mutex-guarded block)
+	TOKEN_HOT      // hot (hot-reloadable function definition)
 )
 
 // Code generation constants
@@ -501,6 +503,8 @@ func (l *Lexer) NextToken() Token {
 			return Token{Type: TOKEN_ARENA, Value: value, Line: l.line, Column: tokenColumn}
 		case "defer":
 			return Token{Type: TOKEN_DEFER, Value: value, Line: l.line, Column: tokenColumn}
+		case "lock":
+			return Token{Type: TOKEN_LOCK, Value: value, Line: l.line, Column: tokenColumn}
 		case "max":
 			return Token{Type: TOKEN_MAX, Value: value, Line: l.line, Column: tokenColumn}
 		case "inf":
@@ -523,6 +527,8 @@ func (l *Lexer) NextToken() Token {
 			return Token{Type: TOKEN_CLASS, Value: value, Line: l.line, Column: tokenColumn}
 		case "shadow":
 			return Token{Type: TOKEN_SHADOW, Value: value, Line: l.line, Column: tokenColumn}
+		case "hot":
+			return Token{Type: TOKEN_HOT, Value: value, Line: l.line, Column: tokenColumn}
 		case "yes":
 			return Token{Type: TOKEN_YES, Value: value, Line: l.line, Column: tokenColumn}
 		case "no":
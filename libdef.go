@@ -14,6 +14,14 @@ type LibraryDefinition struct {
 	Name      string
 	SoFile    string
 	Functions map[string]*Function
+	Structs   map[string]*CStructDecl // structs passed or returned by value
+}
+
+// newCStruct lays out a cstruct for a library definition
+func newCStruct(name string, fields ...CStructField) *CStructDecl {
+	decl := &CStructDecl{Name: name, Fields: fields}
+	decl.CalculateStructLayout()
+	return decl
 }
 
 // CreateRaylibDefinition creates the raylib library definition
@@ -22,6 +30,16 @@ func CreateRaylibDefinition() *LibraryDefinition {
 		Name:      "raylib",
 		SoFile:    "libraylib.so.5",
 		Functions: make(map[string]*Function),
+		Structs: map[string]*CStructDecl{
+			"Color": newCStruct("Color",
+				CStructField{Name: "r", Type: "uint8"},
+				CStructField{Name: "g", Type: "uint8"},
+				CStructField{Name: "b", Type: "uint8"},
+				CStructField{Name: "a", Type: "uint8"}),
+			"Vector2": newCStruct("Vector2",
+				CStructField{Name: "x", Type: "float32"},
+				CStructField{Name: "y", Type: "float32"}),
+		},
 	}
 
 	// Core raylib functions for basic graphics
@@ -63,7 +81,7 @@ func CreateRaylibDefinition() *LibraryDefinition {
 		Name:       "ClearBackground",
 		ReturnType: CTypeVoid,
 		Parameters: []Parameter{
-			{Name: "color", Type: CTypeUInt}, // Color as uint32
+			{Name: "color", Type: CTypeStruct, Struct: "Color", Size: 4},
 		},
 	}
 
@@ -73,10 +91,27 @@ func CreateRaylibDefinition() *LibraryDefinition {
 		Parameters: []Parameter{
 			{Name: "posX", Type: CTypeInt},
 			{Name: "posY", Type: CTypeInt},
-			{Name: "color", Type: CTypeUInt}, // Color as uint32
+			{Name: "color", Type: CTypeStruct, Struct: "Color", Size: 4},
+		},
+	}
+
+	lib.Functions["DrawCircleV"] = &Function{
+		Name:       "DrawCircleV",
+		ReturnType: CTypeVoid,
+		Parameters: []Parameter{
+			{Name: "center", Type: CTypeStruct, Struct: "Vector2", Size: 8},
+			{Name: "radius", Type: CTypeFloat},
+			{Name: "color", Type: CTypeStruct, Struct: "Color", Size: 4},
 		},
 	}
 
+	lib.Functions["GetMousePosition"] = &Function{
+		Name:         "GetMousePosition",
+		ReturnType:   CTypeStruct,
+		ReturnStruct: "Vector2",
+		Parameters:   []Parameter{},
+	}
+
 	lib.Functions["SetTargetFPS"] = &Function{
 		Name:       "SetTargetFPS",
 		ReturnType: CTypeVoid,
@@ -101,8 +136,8 @@ func CreateGlibcDefinition() *LibraryDefinition {
 		ReturnType: CTypeInt,
 		Parameters: []Parameter{
 			{Name: "format", Type: CTypePointer}, // const char*
-			// Note: printf is variadic, would need special handling
 		},
+		Variadic: true,
 	}
 
 	lib.Functions["malloc"] = &Function{
@@ -135,8 +170,8 @@ func CreateGlibcDefinition() *LibraryDefinition {
 		Parameters: []Parameter{
 			{Name: "str", Type: CTypePointer},    // char*
 			{Name: "format", Type: CTypePointer}, // const char*
-			// Note: sprintf is variadic
 		},
+		Variadic: true,
 	}
 
 	return lib
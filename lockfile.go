@@ -0,0 +1,453 @@
+// Completion: 90% - Lock file, pinned checkouts, mod tidy and mod verify
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// lockfile.go - Reproducible Git dependencies (vibe67.lock)
+//
+// Every Git import and every auto-dependency from FunctionRepository is pinned
+// to the exact commit it resolved to. The lock file lives next to the main
+// source file and has one line per repository:
+//
+//	github.com/xyproto/vibe67_math latest 3f2c9d0e...
+//
+// When a lock file exists, builds check out the pinned commits instead of
+// whatever a tag or branch points to today. New dependencies are appended
+// automatically; -u re-resolves and re-pins everything.
+
+// LockFileName is the name of the dependency lock file
+const LockFileName = "vibe67.lock"
+
+// LockEntry pins one repository to a commit
+type LockEntry struct {
+	Repo    string // Normalized repository path, e.g. "github.com/xyproto/vibe67_math"
+	Version string // Requested version ("latest", "main", "v1.0.0", ...)
+	Commit  string // Full commit hash
+}
+
+// LockFile holds the pinned dependencies of a project
+type LockFile struct {
+	Path    string
+	Entries map[string]*LockEntry // keyed by normalized repository path
+	dirty   bool                  // true when entries changed since the file was read
+}
+
+// activeLockFile is the lock file of the program currently being compiled (nil if none)
+var activeLockFile *LockFile
+
+// NewLockFile returns an empty lock file for the given directory
+func NewLockFile(dir string) *LockFile {
+	return &LockFile{
+		Path:    filepath.Join(dir, LockFileName),
+		Entries: make(map[string]*LockEntry),
+	}
+}
+
+// ReadLockFile reads the lock file in dir
+// A missing file is not an error; an empty LockFile is returned instead.
+func ReadLockFile(dir string) (*LockFile, error) {
+	lock := NewLockFile(dir)
+
+	f, err := os.Open(lock.Path)
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", lock.Path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected '<repository> <version> <commit>'", lock.Path, lineNum)
+		}
+		if !isCommitHash(fields[2]) {
+			return nil, fmt.Errorf("%s:%d: invalid commit hash %q", lock.Path, lineNum, fields[2])
+		}
+		repo := normalizeRepoURL(fields[0])
+		lock.Entries[repo] = &LockEntry{Repo: repo, Version: fields[1], Commit: fields[2]}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", lock.Path, err)
+	}
+
+	return lock, nil
+}
+
+// Write saves the lock file with entries sorted by repository
+func (l *LockFile) Write() error {
+	repos := make([]string, 0, len(l.Entries))
+	for repo := range l.Entries {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	var sb strings.Builder
+	sb.WriteString("# vibe67.lock - generated by vibe67, do not edit by hand\n")
+	sb.WriteString("# <repository> <requested version> <commit>\n")
+	for _, repo := range repos {
+		e := l.Entries[repo]
+		fmt.Fprintf(&sb, "%s %s %s\n", e.Repo, e.Version, e.Commit)
+	}
+
+	if err := os.WriteFile(l.Path, []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", l.Path, err)
+	}
+	l.dirty = false
+	return nil
+}
+
+// Pin records the commit a repository resolved to
+func (l *LockFile) Pin(repoURL, version, commit string) {
+	repo := normalizeRepoURL(repoURL)
+	if version == "" {
+		version = "latest"
+	}
+	if e, ok := l.Entries[repo]; ok && e.Version == version && e.Commit == commit {
+		return
+	}
+	l.Entries[repo] = &LockEntry{Repo: repo, Version: version, Commit: commit}
+	l.dirty = true
+}
+
+// Lookup returns the pinned entry for a repository requested at version, if any
+// An entry recorded for a different version is stale and ignored.
+func (l *LockFile) Lookup(repoURL, version string) (*LockEntry, bool) {
+	if version == "" {
+		version = "latest"
+	}
+	e, ok := l.Entries[normalizeRepoURL(repoURL)]
+	if !ok || e.Version != version {
+		return nil, false
+	}
+	return e, true
+}
+
+// normalizeRepoURL converts any supported repository URL form to "host/owner/repo"
+func normalizeRepoURL(repoURL string) string {
+	if strings.HasPrefix(repoURL, "git@") {
+		repoURL = strings.TrimPrefix(repoURL, "git@")
+		repoURL = strings.Replace(repoURL, ":", "/", 1)
+	}
+	repoURL = strings.TrimPrefix(repoURL, "https://")
+	repoURL = strings.TrimPrefix(repoURL, "http://")
+	repoURL = strings.TrimPrefix(repoURL, "git://")
+	repoURL = strings.TrimSuffix(repoURL, "/")
+	return strings.TrimSuffix(repoURL, ".git")
+}
+
+// isCommitHash reports whether s looks like a full SHA-1 or SHA-256 commit hash
+func isCommitHash(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// gitHeadCommit returns the commit hash checked out in a repository
+func gitHeadCommit(repoPath string) (string, error) {
+	output, err := exec.Command("git", "-C", repoPath, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse HEAD failed in %s: %w", repoPath, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// gitWorktreeClean reports whether a repository has no local modifications
+func gitWorktreeClean(repoPath string) (bool, error) {
+	output, err := exec.Command("git", "-C", repoPath, "status", "--porcelain").Output()
+	if err != nil {
+		return false, fmt.Errorf("git status failed in %s: %w", repoPath, err)
+	}
+	return strings.TrimSpace(string(output)) == "", nil
+}
+
+// gitHasCommit reports whether a commit is present in a local repository
+func gitHasCommit(repoPath, commit string) bool {
+	return exec.Command("git", "-C", repoPath, "cat-file", "-e", commit+"^{commit}").Run() == nil
+}
+
+// gitCheckoutCommit checks out an exact commit, fetching it first if the
+// (possibly shallow) clone does not contain it yet
+func gitCheckoutCommit(repoPath, commit string) error {
+	if !gitHasCommit(repoPath, commit) {
+		// Servers such as GitHub allow fetching a single commit by hash
+		fetchCmd := exec.Command("git", "-C", repoPath, "fetch", "--depth=1", "origin", commit)
+		fetchCmd.Stdout = os.Stderr
+		fetchCmd.Stderr = os.Stderr
+		if fetchCmd.Run() != nil {
+			unshallowCmd := exec.Command("git", "-C", repoPath, "fetch", "--unshallow", "--tags", "origin")
+			unshallowCmd.Stdout = os.Stderr
+			unshallowCmd.Stderr = os.Stderr
+			if err := unshallowCmd.Run(); err != nil {
+				return fmt.Errorf("failed to fetch commit %s: %w", commit, err)
+			}
+		}
+	}
+
+	checkoutCmd := exec.Command("git", "-C", repoPath, "checkout", "--quiet", "--detach", commit)
+	checkoutCmd.Stdout = os.Stderr
+	checkoutCmd.Stderr = os.Stderr
+	if err := checkoutCmd.Run(); err != nil {
+		return fmt.Errorf("git checkout %s failed: %w", commit, err)
+	}
+	return nil
+}
+
+// EnsureRepoLocked returns the cache path of a repository checked out at the
+// commit pinned in the active lock file. Unpinned repositories are resolved
+// normally and then pinned. Without an active lock file this is the same as
+// EnsureRepoClonedWithVersion. With -offline, only the cache is used.
+func EnsureRepoLocked(repoURL, version string, updateDeps bool) (string, error) {
+	version = manifestVersion(repoURL, version)
+	if OfflineFlag {
+		return ensureRepoOffline(repoURL, version)
+	}
+
+	lock := activeLockFile
+	if lock != nil && !updateDeps {
+		if entry, ok := lock.Lookup(repoURL, version); ok {
+			repoPath, err := GetRepoCachePath(repoURL)
+			if err != nil {
+				return "", err
+			}
+			if _, err := os.Stat(filepath.Join(repoPath, ".git")); err != nil {
+				if err := GitCloneWithVersion(repoURL, repoPath, entry.Commit); err != nil {
+					return "", fmt.Errorf("failed to clone %s: %w", repoURL, err)
+				}
+			}
+			if err := gitCheckoutCommit(repoPath, entry.Commit); err != nil {
+				return "", fmt.Errorf("%s: %w", repoURL, err)
+			}
+			if err := verifyLockEntry(repoPath, entry); err != nil {
+				return "", err
+			}
+			if VerboseMode {
+				fmt.Fprintf(os.Stderr, "Using %s at locked commit %s\n", entry.Repo, entry.Commit)
+			}
+			return repoPath, nil
+		}
+	}
+
+	var repoPath string
+	var err error
+	if version != "" {
+		repoPath, err = EnsureRepoClonedWithVersion(repoURL, version, updateDeps)
+	} else {
+		repoPath, err = EnsureRepoCloned(repoURL, updateDeps)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if lock != nil {
+		commit, err := gitHeadCommit(repoPath)
+		if err != nil {
+			return "", err
+		}
+		lock.Pin(repoURL, version, commit)
+	}
+	return repoPath, nil
+}
+
+// verifyLockEntry checks that the cached checkout matches a lock entry exactly
+func verifyLockEntry(repoPath string, entry *LockEntry) error {
+	head, err := gitHeadCommit(repoPath)
+	if err != nil {
+		return err
+	}
+	if head != entry.Commit {
+		return fmt.Errorf("%s: checked out commit %s does not match %s (locked in %s)", entry.Repo, head, entry.Commit, LockFileName)
+	}
+	clean, err := gitWorktreeClean(repoPath)
+	if err != nil {
+		return err
+	}
+	if !clean {
+		return fmt.Errorf("%s: cached checkout %s has local modifications", entry.Repo, repoPath)
+	}
+	return nil
+}
+
+// collectModuleDeps returns the Git imports and auto-dependencies of a set of
+// parsed programs as repository URL -> requested version
+func collectModuleDeps(programs []*Program) map[string]string {
+	deps := make(map[string]string)
+	merged := &Program{}
+	for _, program := range programs {
+		merged.Statements = append(merged.Statements, program.Statements...)
+		for _, stmt := range program.Statements {
+			if imp, ok := stmt.(*ImportStmt); ok && isGitURL(imp.URL) {
+				deps[imp.URL] = imp.Version
+			}
+		}
+	}
+	for _, repoURL := range ResolveDependencies(getUnknownFunctions(merged)) {
+		if _, ok := deps[repoURL]; !ok {
+			deps[repoURL] = ""
+		}
+	}
+	return deps
+}
+
+// parseVibe67Files parses source files, returning an error for the first file with parse errors
+func parseVibe67Files(files []string) ([]*Program, error) {
+	var programs []*Program
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		parser := NewParserWithFilename(string(content), file)
+		program := parser.ParseProgram()
+		if parser.errors.HasErrors() {
+			return nil, fmt.Errorf("parse errors in %s", file)
+		}
+		programs = append(programs, program)
+	}
+	return programs, nil
+}
+
+// TidyLockFile resolves every transitive Git dependency of the Vibe67 files in
+// dir and rewrites the lock file so that it pins exactly those repositories.
+// Existing pins are kept unless updateDeps is set.
+func TidyLockFile(dir string, updateDeps bool) (*LockFile, error) {
+	old, err := ReadLockFile(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isVibeFile(entry.Name()) {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	programs, err := parseVibe67Files(files)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	oldManifest := activeManifest
+	activeManifest = manifest
+	defer func() { activeManifest = oldManifest }()
+
+	// Resolve against the old pins, but only keep what is still reachable
+	oldActive := activeLockFile
+	activeLockFile = old
+	defer func() { activeLockFile = oldActive }()
+
+	lock := NewLockFile(dir)
+	queue := collectModuleDeps(programs)
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		next := make(map[string]string)
+		for repoURL, version := range queue {
+			repo := normalizeRepoURL(repoURL)
+			if seen[repo] {
+				continue
+			}
+			seen[repo] = true
+
+			repoPath, err := EnsureRepoLocked(repoURL, version, updateDeps)
+			if err != nil {
+				return nil, err
+			}
+			commit, err := gitHeadCommit(repoPath)
+			if err != nil {
+				return nil, err
+			}
+			lock.Pin(repoURL, version, commit)
+
+			// Walk into the dependency for its own imports and auto-dependencies
+			depFiles, err := FindVibe67Files(repoPath)
+			if err != nil {
+				return nil, err
+			}
+			depPrograms, err := parseVibe67Files(depFiles)
+			if err != nil {
+				return nil, err
+			}
+			for depURL, depVersion := range collectModuleDeps(depPrograms) {
+				next[depURL] = depVersion
+			}
+		}
+		queue = next
+	}
+
+	if err := lock.Write(); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// VerifyLockFile checks that every pinned repository is present in the cache,
+// has no local modifications and can still be checked out at its locked commit
+func VerifyLockFile(dir string) ([]string, error) {
+	lock, err := ReadLockFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(lock.Path); os.IsNotExist(err) {
+		return nil, fmt.Errorf("no %s in %s (run 'vibe67 mod tidy')", LockFileName, dir)
+	}
+
+	var problems []string
+	repos := make([]string, 0, len(lock.Entries))
+	for repo := range lock.Entries {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		entry := lock.Entries[repo]
+		repoPath, err := GetRepoCachePath(repo)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filepath.Join(repoPath, ".git")); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: not downloaded", repo))
+			continue
+		}
+		if clean, err := gitWorktreeClean(repoPath); err != nil || !clean {
+			problems = append(problems, fmt.Sprintf("%s: cached checkout %s has local modifications", repo, repoPath))
+			continue
+		}
+		if err := gitCheckoutCommit(repoPath, entry.Commit); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", repo, err))
+			continue
+		}
+		if err := verifyLockEntry(repoPath, entry); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitRun runs a git command in dir and fails the test on error
+func gitRun(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// setupCachedRepo creates a Git repository with two commits directly in the
+// dependency cache and returns its path and both commit hashes
+func setupCachedRepo(t *testing.T, repo string) (string, string, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	repoPath, err := GetRepoCachePath(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(repoPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	gitRun(t, repoPath, "init", "--quiet")
+
+	src := filepath.Join(repoPath, "dep.vibe67")
+	if err := os.WriteFile(src, []byte("answer = () -> 41\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitRun(t, repoPath, "add", "-A")
+	gitRun(t, repoPath, "commit", "--quiet", "-m", "first")
+	first := gitRun(t, repoPath, "rev-parse", "HEAD")
+
+	if err := os.WriteFile(src, []byte("answer = () -> 42\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitRun(t, repoPath, "commit", "--quiet", "-am", "second")
+	second := gitRun(t, repoPath, "rev-parse", "HEAD")
+
+	return repoPath, first, second
+}
+
+func TestLockFileRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	lock := NewLockFile(dir)
+	lock.Pin("https://github.com/xyproto/vibe67_math", "", strings.Repeat("a", 40))
+	lock.Pin("git@github.com:xyproto/other.git", "v1.2.0", strings.Repeat("b", 40))
+	if !lock.dirty {
+		t.Fatal("expected lock file to be dirty after Pin")
+	}
+	if err := lock.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadLockFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(read.Entries))
+	}
+	if e, ok := read.Lookup("github.com/xyproto/vibe67_math", "latest"); !ok || e.Commit != strings.Repeat("a", 40) {
+		t.Errorf("unexpected entry for vibe67_math: %+v", e)
+	}
+	if e, ok := read.Lookup("https://github.com/xyproto/other", "v1.2.0"); !ok || e.Commit != strings.Repeat("b", 40) {
+		t.Errorf("unexpected entry for other: %+v", e)
+	}
+	if _, ok := read.Lookup("github.com/xyproto/other", "v2.0.0"); ok {
+		t.Error("entry for a different version should be treated as stale")
+	}
+}
+
+func TestReadLockFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := ReadLockFile(dir)
+	if err != nil || len(lock.Entries) != 0 {
+		t.Fatalf("missing lock file should give an empty lock, got %v, %v", lock, err)
+	}
+
+	bad := "github.com/a/b latest not-a-commit\n"
+	if err := os.WriteFile(filepath.Join(dir, LockFileName), []byte(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadLockFile(dir); err == nil {
+		t.Fatal("expected an error for an invalid commit hash")
+	}
+}
+
+func TestNormalizeRepoURL(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/xyproto/vibe67_math":     "github.com/xyproto/vibe67_math",
+		"http://github.com/xyproto/vibe67_math.git":  "github.com/xyproto/vibe67_math",
+		"git@github.com:xyproto/vibe67_math.git":     "github.com/xyproto/vibe67_math",
+		"github.com/xyproto/vibe67_math/":            "github.com/xyproto/vibe67_math",
+		"git://gitlab.com/someone/project.git":       "gitlab.com/someone/project",
+		"https://bitbucket.org/someone/project":      "bitbucket.org/someone/project",
+		"github.com/xyproto/vibe67_math":             "github.com/xyproto/vibe67_math",
+		"https://github.com/xyproto/vibe67_math.git": "github.com/xyproto/vibe67_math",
+	}
+	for input, expected := range tests {
+		if got := normalizeRepoURL(input); got != expected {
+			t.Errorf("normalizeRepoURL(%q) = %q, want %q", input, got, expected)
+		}
+	}
+}
+
+func TestEnsureRepoLockedUsesPinnedCommit(t *testing.T) {
+	const repo = "github.com/test/dep"
+	repoPath, first, second := setupCachedRepo(t, repo)
+
+	oldActive := activeLockFile
+	defer func() { activeLockFile = oldActive }()
+
+	// Unpinned: the current checkout is used and pinned
+	activeLockFile = NewLockFile(t.TempDir())
+	if _, err := EnsureRepoLocked("https://"+repo, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := activeLockFile.Lookup(repo, ""); !ok || e.Commit != second {
+		t.Fatalf("expected %s to be pinned at %s, got %+v", repo, second, e)
+	}
+
+	// Pinned: the locked commit is checked out even though HEAD moved on
+	dir := t.TempDir()
+	activeLockFile = NewLockFile(dir)
+	activeLockFile.Pin(repo, "", first)
+	if err := activeLockFile.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EnsureRepoLocked("https://"+repo, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if head := gitRun(t, repoPath, "rev-parse", "HEAD"); head != first {
+		t.Fatalf("expected checkout of %s, got %s", first, head)
+	}
+	if activeLockFile.dirty {
+		t.Error("using an existing pin should not modify the lock file")
+	}
+
+	problems, err := VerifyLockFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected verification to pass, got %v", problems)
+	}
+
+	// Local modifications in the cache must be reported
+	if err := os.WriteFile(filepath.Join(repoPath, "dep.vibe67"), []byte("answer = () -> 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = VerifyLockFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "local modifications") {
+		t.Fatalf("expected a local modification problem, got %v", problems)
+	}
+}
+
+func TestTidyLockFileReadsV67Sources(t *testing.T) {
+	const repo = "github.com/test/dep"
+	_, _, second := setupCachedRepo(t, repo)
+
+	dir := t.TempDir()
+	src := "import \"" + repo + "\" as dep\nprintln(answer())\n"
+	if err := os.WriteFile(filepath.Join(dir, "main.v67"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := TidyLockFile(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := lock.Lookup(repo, ""); !ok || e.Commit != second {
+		t.Fatalf("expected the import in main.v67 to pin %s at %s, got %+v", repo, second, e)
+	}
+
+	files, err := FindVibe67Files(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Base(files[0]) != "main.v67" {
+		t.Errorf("FindVibe67Files(%s) = %v, want main.v67", dir, files)
+	}
+}
@@ -180,6 +180,10 @@ func (lda *LoopDependencyAnalyzer) collectExprReads(expr Expression, position in
 		for _, arg := range e.Args {
 			lda.collectExprReads(arg, position)
 		}
+	case *FMAExpr:
+		lda.collectExprReads(e.A, position)
+		lda.collectExprReads(e.B, position)
+		lda.collectExprReads(e.C, position)
 	}
 }
 
@@ -3,6 +3,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -120,6 +121,23 @@ func (p Platform) FullString() string {
 	return archStr + "-" + p.OS.String()
 }
 
+// ParseTarget parses a target string like "arm64-macos" or "amd64-linux"
+func ParseTarget(s string) (Platform, error) {
+	archStr, osStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return Platform{}, fmt.Errorf("invalid target %q (expected ARCH-OS, e.g. arm64-macos, amd64-linux)", s)
+	}
+	arch, err := ParseArch(archStr)
+	if err != nil {
+		return Platform{}, err
+	}
+	targetOS, err := ParseOS(osStr)
+	if err != nil {
+		return Platform{}, err
+	}
+	return Platform{Arch: arch, OS: targetOS}, nil
+}
+
 // IsMachO returns true if this platform uses Mach-O format
 func (p Platform) IsMachO() bool {
 	return p.OS == OSDarwin
@@ -222,8 +240,11 @@ type ExecutableBuilder struct {
 	functionLibraries       map[string]string // Maps function names to their library paths (for Mach-O multi-lib support)
 	pcRelocations           []PCRelocation
 	callPatches             []CallPatch
+	externalCalls           map[string]bool // C functions that must not resolve to a label of the same name
 	elf, rodata, data, text bytes.Buffer
 	rodataOffsetInELF       uint64
+	textOffsetInELF         uint64 // where .text starts in the file
+	textReservedInELF       uint64 // the space the layout reserved for .text
 	dataOffsetInELF         uint64
 	dynsymOffsetInELF       uint64
 }
@@ -588,24 +609,62 @@ func getSyscallNumbers(target Target) map[string]string {
 		}
 	}
 
-	// Linux/FreeBSD syscall numbers
-	switch target.Arch() {
-	case ArchX86_64:
+	// FreeBSD numbers its system calls the same on every architecture
+	if target.OS() == OSFreeBSD {
 		return map[string]string{
-			"SYS_WRITE": "1",
-			"SYS_EXIT":  "60",
-			"STDOUT":    "1",
+			"SYS_EXIT":      "1",
+			"SYS_FORK":      "2",
+			"SYS_WRITE":     "4",
+			"SYS_OPEN":      "5",
+			"SYS_CLOSE":     "6",
+			"SYS_RECVFROM":  "29",
+			"SYS_MUNMAP":    "73",
+			"SYS_SOCKET":    "97",
+			"SYS_BIND":      "104",
+			"SYS_SENDTO":    "133",
+			"SYS_FUTEX":     "454", // _umtx_op
+			"SYS_MMAP":      "477",
+			"SYS_GETRANDOM": "563",
+			"STDOUT":        "1",
+
+			"MAP_PRIVATE_ANONYMOUS": "4098", // 0x1002
+			"O_WRONLY_CREAT_TRUNC":  "1537", // 0x601
+			"FUTEX_WAKE_PRIVATE":    "16",   // UMTX_OP_WAKE_PRIVATE
+			"SOCKADDR_IN_FAMILY":    "528",  // sin_len = 16, sin_family = AF_INET
 		}
-	case ArchARM64:
+	}
+
+	// Linux syscall numbers
+	switch target.Arch() {
+	case ArchX86_64:
 		return map[string]string{
-			"SYS_WRITE": "64",
-			"SYS_EXIT":  "93",
-			"STDOUT":    "1",
+			"SYS_WRITE":     "1",
+			"SYS_OPEN":      "2",
+			"SYS_CLOSE":     "3",
+			"SYS_MMAP":      "9",
+			"SYS_MUNMAP":    "11",
+			"SYS_BRK":       "12",
+			"SYS_MREMAP":    "25",
+			"SYS_SOCKET":    "41",
+			"SYS_SENDTO":    "44",
+			"SYS_RECVFROM":  "45",
+			"SYS_BIND":      "49",
+			"SYS_FORK":      "57",
+			"SYS_EXIT":      "60",
+			"SYS_FUTEX":     "202",
+			"SYS_GETRANDOM": "318",
+			"STDOUT":        "1",
+
+			"MAP_PRIVATE_ANONYMOUS": "34",  // 0x22
+			"O_WRONLY_CREAT_TRUNC":  "577", // 0x241
+			"FUTEX_WAKE_PRIVATE":    "129", // FUTEX_WAKE | FUTEX_PRIVATE_FLAG
+			"SOCKADDR_IN_FAMILY":    "2",   // AF_INET
 		}
-	case ArchRiscv64:
+	case ArchARM64, ArchRiscv64:
 		return map[string]string{
 			"SYS_WRITE": "64",
 			"SYS_EXIT":  "93",
+			"SYS_BRK":   "214",
 			"STDOUT":    "1",
 		}
 	default:
@@ -630,7 +689,7 @@ func (eb *ExecutableBuilder) PatchCallSites(textAddr uint64) {
 		// Find the target symbol address (should be a label in the text section)
 		// For internal functions, try without the $stub suffix first
 		targetOffset := eb.LabelOffset(patch.targetName)
-		if targetOffset < 0 && strings.HasSuffix(patch.targetName, "$stub") {
+		if targetOffset < 0 && strings.HasSuffix(patch.targetName, "$stub") && !eb.externalCalls[strings.TrimSuffix(patch.targetName, "$stub")] {
 			// Try looking for internal label without $stub suffix
 			baseName := patch.targetName[:len(patch.targetName)-5]
 			targetOffset = eb.LabelOffset(baseName)
@@ -1017,6 +1076,17 @@ func (eb *ExecutableBuilder) GenerateCallInstruction(funcName string) error {
 	return nil
 }
 
+// GenerateExternalCallInstruction generates a call to a C function, which
+// goes through the PLT or IAT even when a Vibe67 function has the same name
+// (a binding module wraps SDL_Init in a function called SDL_Init)
+func (eb *ExecutableBuilder) GenerateExternalCallInstruction(funcName string) error {
+	if eb.externalCalls == nil {
+		eb.externalCalls = make(map[string]bool)
+	}
+	eb.externalCalls[funcName] = true
+	return eb.GenerateCallInstruction(funcName)
+}
+
 // EmitArenaRuntimeCode emits arena allocator runtime functions
 func (eb *ExecutableBuilder) EmitArenaRuntimeCode() {
 	out := NewOut(eb.target, &BufferWrapper{&eb.text}, eb)
@@ -1156,11 +1226,9 @@ func (eb *ExecutableBuilder) patchTextInELF() {
 		}
 	}
 
-	// Find the text section in the ELF buffer
-	// PLT is at offset 0x2000
-	// _start is after PLT
-	// text is on its own page at 0x3000 (to prevent overflow into writable segment)
-	textOffset := 0x3000 // text is now on page 0x3000 (separate from PLT/_start)
+	// Find the text section in the ELF buffer, on its own page after the
+	// PLT and _start (recorded by WriteCompleteDynamicELF)
+	textOffset := int(eb.textOffsetInELF)
 	textSize := len(newText)
 
 	if VerboseMode {
@@ -1171,12 +1239,10 @@ func (eb *ExecutableBuilder) patchTextInELF() {
 	fmt.Fprintf(os.Stderr, "DEBUG patchTextInELF: Before copy, elfBuf[0x309b:0x30a3] = %x\n", elfBuf[0x309b:0x30a3])
 	fmt.Fprintf(os.Stderr, "DEBUG patchTextInELF: Before copy, newText[0x9b:0xa3] = %x\n", newText[0x9b:0xa3])
 
-	// CRITICAL: The dynamic section starts 4 pages after text section
-	// Text section is pre-allocated 8 pages (32KB) at offset 0x3000
-	// Dynamic section starts at 0xB000
+	// CRITICAL: The dynamic section follows the space reserved for text
 	// Check if text exceeds the reserved space
 	textEndAligned := (textOffset + textSize + 7) & ^7
-	textReservedEnd := 0xB000 // End of 32KB text reservation
+	textReservedEnd := textOffset + int(eb.textReservedInELF)
 
 	// Check if we would overflow past the reserved text space
 	if textEndAligned > textReservedEnd {
@@ -1278,9 +1344,13 @@ var VerboseMode bool
 var QuietMode bool
 var EnableAVX512 bool // Enable AVX-512 vectorization (512-bit vectors, 8 doubles)
 var UpdateDepsFlag bool
+var OfflineFlag bool
 var WPOTimeout float64
 var SingleFlag bool
 var CompressFlag bool
+var TinyFlag bool
+var EmitIRFlag bool
+var NoIRFlag bool
 
 func main() {
 	// Create default output filename in system temp directory
@@ -1310,22 +1380,43 @@ func main() {
 	var verboseLong = flag.Bool("verbose", false, "verbose mode (show build messages and detailed compilation info)")
 	var updateDeps = flag.Bool("u", false, "update all dependency repositories from Git")
 	var updateDepsLong = flag.Bool("update-deps", false, "update all dependency repositories from Git")
+	var offlineFlag = flag.Bool("offline", false, "never access the network: use only vendor_v67/ and the dependency cache")
 	var codeFlag = flag.String("c", "", "execute Vibe67 code from command line")
 	var optTimeout = flag.Float64("opt-timeout", 2.0, "optimization timeout in seconds (0 to disable)")
 	var watchFlag = flag.Bool("watch", false, "watch mode: recompile on file changes (requires hot functions)")
 	var singleFlag = flag.Bool("single", false, "compile single file only (don't load other .vibe67 files from directory)")
 	var singleShort = flag.Bool("s", false, "shorthand for --single")
+	var noCacheFlag = flag.Bool("no-cache", false, "do not use or update the build cache of parsed modules and executables")
 	var compressFlag = flag.Bool("compress", false, "enable executable compression (experimental)")
-	_ = flag.Bool("tiny", false, "size optimization mode: remove debug strings and minimize runtime checks for demoscene/64k")
+	var tinyFlag = flag.Bool("tiny", false, "size optimization mode: remove debug strings and minimize runtime checks for demoscene/64k")
 	var depsFlag = flag.Bool("d", false, "show dependency tree and DCE info, then exit (no file generation)")
+	var emitIRFlag = flag.Bool("emit-ir", false, "print the SSA intermediate representation, then exit (no file generation)")
+	var noIRFlag = flag.Bool("no-ir", false, "always use the AST code generator, instead of lowering the SSA IR of programs it covers (x86-64 and ARM64 Linux)")
+	var profileGenerateFlag = flag.String("profile-generate", "", "instrument the program to write a profile to this file at exit (x86-64 Linux)")
+	var profileUseFlag = flag.String("profile-use", "", "optimize with profiles written by -profile-generate builds (comma-separated files are summed)")
+	var buildModeFlag = flag.String("buildmode", BuildModeExe, "what to write: exe, obj (ELF relocatable object) or shared (shared library); obj and shared also write a C header")
+	var subsystemFlag = flag.String("subsystem", "", "Windows subsystem: console (the default) or windows (a GUI program, without a console window)")
+	var iconFlag = flag.String("icon", "", "icon (.ico file) of Windows executables")
 	flag.Parse()
+	BuildMode = *buildModeFlag
+	WindowsOptions.Subsystem = *subsystemFlag
+	WindowsOptions.Icon = *iconFlag
 
 	// Set global update-deps flag (use whichever was specified)
 	UpdateDepsFlag = *updateDeps || *updateDepsLong
+	OfflineFlag = *offlineFlag
+	if OfflineFlag && UpdateDepsFlag {
+		fmt.Fprintln(os.Stderr, "Error: -u/--update-deps cannot be combined with -offline")
+		os.Exit(1)
+	}
 
 	// Set global single flag (use whichever was specified)
 	SingleFlag = *singleFlag || *singleShort
 	CompressFlag = *compressFlag
+	TinyFlag = *tinyFlag
+	NoCacheFlag = *noCacheFlag
+	EmitIRFlag = *emitIRFlag
+	NoIRFlag = *noIRFlag
 
 	if *version || *versionShort {
 		fmt.Println(versionString)
@@ -1443,6 +1534,38 @@ func main() {
 	}
 
 	targetPlatform := Platform{Arch: targetArch, OS: targetOS}
+	if err := checkBuildMode(targetPlatform); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkWindowsOptions(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *profileGenerateFlag != "" && *profileUseFlag != "" {
+		fmt.Fprintln(os.Stderr, "Error: -profile-generate cannot be combined with -profile-use")
+		os.Exit(1)
+	}
+	if *profileGenerateFlag != "" {
+		if targetArch != ArchX86_64 || targetOS != OSLinux {
+			fmt.Fprintf(os.Stderr, "Error: -profile-generate is only supported for amd64-linux, not %s-%s\n", targetArch.String(), targetOS.String())
+			os.Exit(1)
+		}
+		// The program may run in another directory than the compiler
+		ProfileGenerateFile, err = filepath.Abs(*profileGenerateFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid -profile-generate path: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *profileUseFlag != "" {
+		activeProfile, err = LoadProfile(*profileUseFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Cannot read profile: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	if VerboseMode {
 		fmt.Fprintf(os.Stderr, "Target platform: %s-%s\n", targetArch.String(), targetOS.String())
@@ -1462,8 +1585,8 @@ func main() {
 		// Check if it's a subcommand or looks like the new CLI style
 		// Support both .v67 and .vibe67 extensions
 		isVibeFile := strings.HasSuffix(firstArg, ".vibe67") || strings.HasSuffix(firstArg, ".v67")
-		if firstArg == "build" || firstArg == "run" || firstArg == "test" || firstArg == "help" ||
-			(isVibeFile && *codeFlag == "") {
+		if firstArg == "build" || firstArg == "run" || firstArg == "test" || firstArg == "help" || firstArg == "mod" || firstArg == "bindgen" ||
+			(isVibeFile && *codeFlag == "" && !*watchFlag) {
 			// Use new CLI system
 			// Only pass outputFilename if user explicitly provided it
 			cliOutputPath := ""
@@ -1633,9 +1756,34 @@ func watchAndRecompile(sourceFile, outputFile string, platform Platform) error {
 	fmt.Fprintf(os.Stderr, "Press Ctrl+C to stop, or send SIGUSR1 to trigger manual reload\n")
 	fmt.Fprintf(os.Stderr, "Command: kill -USR1 %d\n\n", os.Getpid())
 
+	// Patching needs the code layout of every build, which cached executables do not have
+	NoCacheFlag = true
+
 	// Initialize incremental state for hot reload
 	incrementalState := NewIncrementalState(platform)
 	var gameProcess *os.Process
+	var patcher *HotPatcher
+
+	// launch starts the game, connected to the watcher where hot patching is supported
+	launch := func() (*os.Process, error) {
+		if patcher != nil {
+			patcher.Close()
+			patcher = nil
+		}
+		if incrementalState.runningImage == nil {
+			return launchGameProcess(outputFile)
+		}
+		absPath, err := filepath.Abs(outputFile)
+		if err != nil {
+			return nil, err
+		}
+		process, hp, err := launchHotProcess(absPath, os.Stdout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start process: %v", err)
+		}
+		patcher = hp
+		return process, nil
+	}
 
 	// Initial compilation
 	fmt.Fprintf(os.Stderr, "[%s] Initial compilation...\n", time.Now().Format("15:04:05"))
@@ -1647,7 +1795,7 @@ func watchAndRecompile(sourceFile, outputFile string, platform Platform) error {
 	// Launch the game process
 	if len(incrementalState.hotFunctions) > 0 {
 		fmt.Fprintf(os.Stderr, "🎮 Launching game process with %d hot functions...\n", len(incrementalState.hotFunctions))
-		gameProcess, err = launchGameProcess(outputFile)
+		gameProcess, err = launch()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "⚠️  Failed to launch game: %v\n", err)
 		} else {
@@ -1687,14 +1835,33 @@ func watchAndRecompile(sourceFile, outputFile string, platform Platform) error {
 			return
 		}
 
-		// Hot functions changed - restart process
-		// TODO: Future enhancement - patch running process via IPC instead of restart
+		// Replace the code in the running game, so that its state is kept
+		restart := false
 		if gameProcess != nil {
-			fmt.Fprintf(os.Stderr, "🔄 Hot functions changed - restarting game process...\n")
-			gameProcess.Kill()
-			gameProcess.Wait()
+			var layoutErr *LayoutChangeError
+			if err := incrementalState.HotPatch(patcher, updatedFuncs); err == nil {
+				fmt.Fprintf(os.Stderr, "🔥 Patched %d hot function(s) into the running game\n", len(updatedFuncs))
+			} else if errors.As(err, &layoutErr) {
+				// Restarting would throw away the state that the layout change is about
+				fmt.Fprintf(os.Stderr, "❌ Reload refused:\n%v\n", err)
+				os.Remove(outputFile + ".tmp")
+				return
+			} else {
+				fmt.Fprintf(os.Stderr, "🔄 Can not patch the running game (%v) - restarting game process...\n", err)
+				gameProcess.Kill()
+				gameProcess.Wait()
+				restart = true
+			}
+		}
+
+		if err := os.Rename(outputFile+".tmp", outputFile); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Failed to update %s: %v\n", outputFile, err)
+			return
+		}
 
-			gameProcess, err = launchGameProcess(outputFile)
+		if restart {
+			incrementalState.Restarted()
+			gameProcess, err = launch()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "⚠️  Failed to restart game: %v\n", err)
 				gameProcess = nil
@@ -0,0 +1,348 @@
+// Completion: 85% - vibe67.toml project manifest (TOML subset)
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// manifest.go - Project manifest (vibe67.toml)
+//
+// A vibe67.toml file in a project directory declares everything needed to
+// build it, so that 'vibe67 build' in that directory needs no flags:
+//
+//	[module]
+//	name = "mygame"
+//	entry = "main.vibe67"
+//
+//	[build]
+//	targets = ["amd64-linux", "arm64-linux", "amd64-windows"]
+//	libraries = ["SDL3"]
+//	include_paths = ["include"]
+//	tiny = true
+//	compress = false
+//
+//	[windows]
+//	subsystem = "windows"
+//	icon = "assets/game.ico"
+//	version = "1.2.0"
+//	product = "My Game"
+//	description = "A game"
+//	company = "Me"
+//	copyright = "Copyright 2026 Me"
+//
+//	[dependencies]
+//	"github.com/xyproto/vibe67_math" = "v1.0.0"
+//
+// Only the subset of TOML needed for this is supported: [sections], comments,
+// and keys set to strings, booleans or arrays of strings.
+
+// ManifestFileName is the name of the project manifest
+const ManifestFileName = "vibe67.toml"
+
+// Manifest is a parsed vibe67.toml
+type Manifest struct {
+	Path         string
+	Name         string            // [module] name, also the default output name
+	Entry        string            // [module] entry, the main source file (relative to the manifest)
+	Output       string            // [build] output, overrides the output name
+	Targets      []Platform        // [build] targets, e.g. "amd64-linux"
+	Libraries    []string          // [build] libraries, C libraries to link
+	IncludePaths []string          // [build] include_paths, searched before the system include paths
+	Tiny         bool              // [build] tiny, same as -tiny
+	Compress     bool              // [build] compress, same as --compress
+	Windows      PEOptions         // [windows], options of Windows executables (see pe_resources.go)
+	Dependencies map[string]string // [dependencies], normalized repository -> version, tag, branch or commit
+}
+
+// activeManifest is the manifest of the project currently being built (nil if none)
+var activeManifest *Manifest
+
+// ReadManifest reads the manifest in dir
+// A missing manifest is not an error; nil is returned instead.
+func ReadManifest(dir string) (*Manifest, error) {
+	path := filepath.Join(dir, ManifestFileName)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return ParseManifest(path, string(data))
+}
+
+// ParseManifest parses the contents of a manifest file
+// Relative include paths are resolved against the directory of path.
+func ParseManifest(path, data string) (*Manifest, error) {
+	m := &Manifest{
+		Path:         path,
+		Dependencies: make(map[string]string),
+	}
+	dir := filepath.Dir(path)
+
+	section := ""
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNum := i + 1
+		line := strings.TrimSpace(stripTomlComment(lines[i]))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: malformed section header", path, lineNum)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			switch section {
+			case "module", "build", "windows", "dependencies":
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown section [%s]", path, lineNum, section)
+			}
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq == -1 {
+			return nil, fmt.Errorf("%s:%d: expected 'key = value'", path, lineNum)
+		}
+		key, err := parseTomlKey(strings.TrimSpace(line[:eq]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		raw := strings.TrimSpace(line[eq+1:])
+
+		// Arrays may span several lines
+		for strings.HasPrefix(raw, "[") && !strings.HasSuffix(raw, "]") && i+1 < len(lines) {
+			i++
+			raw += " " + strings.TrimSpace(stripTomlComment(lines[i]))
+		}
+
+		value, err := parseTomlValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, lineNum, key, err)
+		}
+		if err := m.set(section, key, value, dir); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+	}
+
+	return m, nil
+}
+
+// set assigns one parsed key/value pair
+func (m *Manifest) set(section, key string, value interface{}, dir string) error {
+	if section == "dependencies" {
+		version, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("dependency %s: version must be a string", key)
+		}
+		if !isGitURL(key) {
+			return fmt.Errorf("dependency %s: not a Git repository", key)
+		}
+		m.Dependencies[normalizeRepoURL(key)] = version
+		return nil
+	}
+
+	field := section + "." + key
+	switch field {
+	case "module.name", "module.entry", "build.output":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", key)
+		}
+		switch field {
+		case "module.name":
+			m.Name = s
+		case "module.entry":
+			m.Entry = s
+		case "build.output":
+			m.Output = s
+		}
+	case "build.targets", "build.libraries", "build.include_paths":
+		list, ok := value.([]string)
+		if !ok {
+			return fmt.Errorf("%s must be an array of strings", key)
+		}
+		switch field {
+		case "build.targets":
+			for _, target := range list {
+				platform, err := ParseTarget(target)
+				if err != nil {
+					return err
+				}
+				m.Targets = append(m.Targets, platform)
+			}
+		case "build.libraries":
+			m.Libraries = list
+		case "build.include_paths":
+			for _, p := range list {
+				if !filepath.IsAbs(p) {
+					p = filepath.Join(dir, p)
+				}
+				m.IncludePaths = append(m.IncludePaths, p)
+			}
+		}
+	case "build.tiny", "build.compress":
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("%s must be true or false", key)
+		}
+		if field == "build.tiny" {
+			m.Tiny = b
+		} else {
+			m.Compress = b
+		}
+	case "windows.subsystem", "windows.icon", "windows.version", "windows.product",
+		"windows.description", "windows.company", "windows.copyright":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", key)
+		}
+		switch key {
+		case "subsystem":
+			m.Windows.Subsystem = s
+			if _, err := m.Windows.subsystem(); err != nil {
+				return err
+			}
+		case "icon":
+			if !filepath.IsAbs(s) {
+				s = filepath.Join(dir, s)
+			}
+			m.Windows.Icon = s
+		case "version":
+			m.Windows.Version = s
+			if _, err := m.Windows.version(); err != nil {
+				return err
+			}
+		case "product":
+			m.Windows.Product = s
+		case "description":
+			m.Windows.Description = s
+		case "company":
+			m.Windows.Company = s
+		case "copyright":
+			m.Windows.Copyright = s
+		}
+	default:
+		if section == "" {
+			return fmt.Errorf("key %s must be inside a section", key)
+		}
+		return fmt.Errorf("unknown key %s in [%s]", key, section)
+	}
+	return nil
+}
+
+// stripTomlComment removes a trailing # comment that is not inside a string
+func stripTomlComment(line string) string {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if inString {
+				i++
+			}
+		case '"':
+			inString = !inString
+		case '#':
+			if !inString {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// parseTomlKey parses a bare or quoted key
+func parseTomlKey(key string) (string, error) {
+	if strings.HasPrefix(key, "\"") {
+		return strconv.Unquote(key)
+	}
+	if key == "" || strings.ContainsAny(key, " \t\"") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return key, nil
+}
+
+// parseTomlValue parses a string, boolean or array of strings
+func parseTomlValue(raw string) (interface{}, error) {
+	switch {
+	case raw == "true":
+		return true, nil
+	case raw == "false":
+		return false, nil
+	case strings.HasPrefix(raw, "\""):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		list := []string{}
+		rest := strings.TrimSpace(raw[1 : len(raw)-1])
+		for rest != "" {
+			if !strings.HasPrefix(rest, "\"") {
+				return nil, fmt.Errorf("array elements must be strings")
+			}
+			s, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return nil, err
+			}
+			elem, _ := strconv.Unquote(s)
+			list = append(list, elem)
+			rest = strings.TrimSpace(rest[len(s):])
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("unsupported value %q (expected a string, boolean or array of strings)", raw)
+}
+
+// manifestVersion returns the version of a repository pinned in the active
+// manifest, for imports and auto-dependencies that do not request one
+func manifestVersion(repoURL, version string) string {
+	if version != "" || activeManifest == nil {
+		return version
+	}
+	return activeManifest.Dependencies[normalizeRepoURL(repoURL)]
+}
+
+// cIncludePaths returns the include paths of the active manifest followed by paths
+func cIncludePaths(paths ...string) []string {
+	if activeManifest == nil || len(activeManifest.IncludePaths) == 0 {
+		return paths
+	}
+	return append(append([]string{}, activeManifest.IncludePaths...), paths...)
+}
+
+// OutputName returns the executable name for a target
+// With several targets, the target is appended so that outputs do not collide.
+func (m *Manifest) OutputName(fallback string, platform Platform) string {
+	name := fallback
+	if m.Output != "" {
+		name = m.Output
+	} else if m.Name != "" {
+		name = m.Name
+	}
+	if len(m.Targets) > 1 {
+		name += "-" + platform.FullString()
+	}
+	if platform.OS == OSWindows && !strings.HasSuffix(strings.ToLower(name), ".exe") {
+		name += ".exe"
+	}
+	return name
+}
+
+// DependencyList returns the declared dependencies as sorted "repo@version" strings
+func (m *Manifest) DependencyList() []string {
+	deps := make([]string, 0, len(m.Dependencies))
+	for repo, version := range m.Dependencies {
+		deps = append(deps, repo+"@"+version)
+	}
+	sort.Strings(deps)
+	return deps
+}
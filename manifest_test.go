@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseManifest(t *testing.T) {
+	data := `# Example project
+[module]
+name = "mygame"   # default output name
+entry = "src/main.vibe67"
+
+[build]
+targets = [
+    "amd64-linux",
+    "arm64-macos", # trailing comma is fine
+]
+libraries = ["SDL3", "m"]
+include_paths = ["include", "/opt/sdl/include"]
+tiny = true
+compress = false
+
+[dependencies]
+"github.com/xyproto/vibe67_math" = "v1.0.0"
+"git@github.com:someone/lib.git" = "0123456789abcdef0123456789abcdef01234567"
+`
+	m, err := ParseManifest("/project/vibe67.toml", data)
+	if err != nil {
+		t.Fatalf("ParseManifest failed: %v", err)
+	}
+	if m.Name != "mygame" || m.Entry != "src/main.vibe67" {
+		t.Errorf("unexpected module section: name=%q entry=%q", m.Name, m.Entry)
+	}
+	if len(m.Targets) != 2 || m.Targets[0] != (Platform{ArchX86_64, OSLinux}) || m.Targets[1] != (Platform{ArchARM64, OSDarwin}) {
+		t.Errorf("unexpected targets: %v", m.Targets)
+	}
+	if strings.Join(m.Libraries, ",") != "SDL3,m" {
+		t.Errorf("unexpected libraries: %v", m.Libraries)
+	}
+	if strings.Join(m.IncludePaths, ",") != "/project/include,/opt/sdl/include" {
+		t.Errorf("unexpected include paths: %v", m.IncludePaths)
+	}
+	if !m.Tiny || m.Compress {
+		t.Errorf("unexpected feature flags: tiny=%v compress=%v", m.Tiny, m.Compress)
+	}
+	if m.Dependencies["github.com/someone/lib"] != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("unexpected dependencies: %v", m.Dependencies)
+	}
+
+	if got := m.OutputName("main", Platform{ArchX86_64, OSWindows}); got != "mygame-amd64-windows.exe" {
+		t.Errorf("unexpected output name %q", got)
+	}
+
+	oldManifest := activeManifest
+	defer func() { activeManifest = oldManifest }()
+	activeManifest = m
+	if v := manifestVersion("https://github.com/xyproto/vibe67_math", ""); v != "v1.0.0" {
+		t.Errorf("expected manifest version v1.0.0, got %q", v)
+	}
+	if v := manifestVersion("https://github.com/xyproto/vibe67_math", "main"); v != "main" {
+		t.Errorf("an explicit import version should win, got %q", v)
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	tests := map[string]string{
+		"[module]\nnmae = \"x\"\n":               "unknown key nmae",
+		"[modules]\n":                            "unknown section",
+		"[build]\ntargets = [\"amd64-plan9\"]\n": "unsupported OS",
+		"[build]\ntiny = \"yes\"\n":              "must be true or false",
+		"name = \"x\"\n":                         "must be inside a section",
+		"[dependencies]\n\"./local\" = \"v1\"\n": "not a Git repository",
+	}
+	for data, want := range tests {
+		_, err := ParseManifest("vibe67.toml", data)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ParseManifest(%q): expected error containing %q, got %v", data, want, err)
+		}
+	}
+}
+
+func TestBuildDirWithManifest(t *testing.T) {
+	dir := t.TempDir()
+	outDir := t.TempDir()
+	manifest := `[module]
+name = "app"
+entry = "app.vibe67"
+
+[build]
+output = "` + filepath.Join(outDir, "app") + `"
+targets = ["amd64-linux", "arm64-linux"]
+`
+	if err := os.WriteFile(filepath.Join(dir, ManifestFileName), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "app.vibe67"), []byte("println(42)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &CommandContext{Platform: GetDefaultPlatform(), Quiet: true, OptTimeout: 2.0}
+	if err := cmdBuildDir(ctx, dir); err != nil {
+		t.Fatalf("cmdBuildDir failed: %v", err)
+	}
+	for _, name := range []string{"app-amd64-linux", "app-arm64-linux"} {
+		if _, err := os.Stat(filepath.Join(outDir, name)); err != nil {
+			t.Errorf("expected %s to be built: %v", name, err)
+		}
+	}
+}
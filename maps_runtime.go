@@ -0,0 +1,408 @@
+// Completion: 90% - Swiss table hash map runtime (x86-64 SSE2, ARM64 NEON in arm64_maps.go)
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Hash map runtime
+//
+// The emitted counterpart of Vibe67HashMap (see hashmap.go), on the same
+// memory layout and with the same hash, probe order, growth and deletion, so
+// a table built by generated code is byte for byte the table the Go model
+// builds from the same operations (see maps_runtime_test.go).
+//
+// Keys are compared as raw 64-bit patterns. The functions use the System V
+// registers on every OS, since only generated code calls them:
+//
+//	_vibe67_map_find(rdi = table, rsi = key) -> rax = &value, or 0
+//	_vibe67_map_set(rdi = &table, rsi = key, xmm0 = value)
+//	_vibe67_map_delete(rdi = table, rsi = key) -> rax = 1 if the key was there
+//
+// A table pointer of 0 is an empty map. _vibe67_map_set allocates the first
+// table and replaces the table when it grows, which is why it takes the
+// address of the pointer.
+
+// generateMapRuntime emits the hash map functions
+func (fc *C67Compiler) generateMapRuntime() {
+	fc.generateMapFind()
+	fc.generateMapDelete()
+	fc.generateMapSet()
+	fc.generateMapPlace()
+	fc.generateMapGrow()
+}
+
+// emitMapHash computes mapHash(rsi) into rax, clobbering rdx
+func (fc *C67Compiler) emitMapHash() {
+	imm := make([]byte, 8)
+	binary.LittleEndian.PutUint64(imm, mapHashMultiplier)
+	fc.out.Emit(append([]byte{0x48, 0xb8}, imm...)) // mov rax, mapHashMultiplier
+	fc.out.ImulRegWithReg("rax", "rsi")
+	fc.out.MovRegToReg("rdx", "rax")
+	fc.out.ShrRegByImm("rdx", 32)
+	fc.out.XorRegWithReg("rax", "rdx")
+}
+
+// emitMapGroup points dst at the control word of group index in table
+func (fc *C67Compiler) emitMapGroup(dst, index, table string) {
+	fc.out.MovRegToReg(dst, index)
+	fc.out.ImulImmToReg(dst, mapGroupSize)
+	fc.out.AddRegToReg(dst, table)
+	fc.out.AddImmToReg(dst, mapHeaderSize)
+}
+
+// emitMapProbeStart hashes rsi, broadcasts its tag to all bytes of xmm1 and
+// sets rax to the first group, r8 to the group mask and r9 to the number of
+// groups. rdi must not be 0.
+func (fc *C67Compiler) emitMapProbeStart() {
+	fc.emitMapHash()
+	fc.out.MovRegToReg("rcx", "rax")
+	fc.out.ShrRegByImm("rcx", 57)
+	fc.out.OrRegWithImm("rcx", mapFullTag)
+	fc.out.Emit([]byte{0x66, 0x0f, 0x6e, 0xc9})       // movd xmm1, ecx
+	fc.out.Emit([]byte{0x66, 0x0f, 0x60, 0xc9})       // punpcklbw xmm1, xmm1
+	fc.out.Emit([]byte{0xf2, 0x0f, 0x70, 0xc9, 0x00}) // pshuflw xmm1, xmm1, 0
+	fc.out.Emit([]byte{0x66, 0x0f, 0x70, 0xc9, 0x00}) // pshufd xmm1, xmm1, 0
+	fc.out.MovMemToReg("r9", "rdi", 8)
+	fc.out.MovRegToReg("r8", "r9")
+	fc.out.DecReg("r8")
+	fc.out.AndRegWithReg("rax", "r8")
+}
+
+// emitMapProbeGroup looks for the key in rsi in the group at rax. It jumps
+// to the returned position with r10 at the group and r11 at the matching
+// slot, and falls through when the key is not in the group or any later one.
+// missJumps are the jumps to patch to the miss path.
+func (fc *C67Compiler) emitMapProbeGroup() (found int, missJumps []int) {
+	loopStart := fc.eb.text.Len()
+	fc.emitMapGroup("r10", "rax", "rdi")
+
+	// One bit per slot whose control byte is the tag
+	fc.out.Emit([]byte{0xf3, 0x41, 0x0f, 0x6f, 0x02}) // movdqu xmm0, [r10]
+	fc.out.Emit([]byte{0x66, 0x0f, 0x74, 0xc1})       // pcmpeqb xmm0, xmm1
+	fc.out.Emit([]byte{0x66, 0x0f, 0xd7, 0xd0})       // pmovmskb edx, xmm0
+	fc.out.AndRegWithImm("rdx", mapSlotMask)
+
+	// Compare the keys of the matching slots, lowest first
+	matchLoop := fc.eb.text.Len()
+	fc.out.TestRegReg("rdx", "rdx")
+	noMatch := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.Emit([]byte{0x44, 0x0f, 0xbc, 0xda}) // bsf r11d, edx
+	fc.out.ShlRegByImm("r11", 4)
+	fc.out.AddRegToReg("r11", "r10")
+	fc.out.MovMemToReg("rcx", "r11", mapControlSize)
+	fc.out.CmpRegToReg("rcx", "rsi")
+	found = fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovRegToReg("rcx", "rdx")
+	fc.out.DecReg("rcx")
+	fc.out.AndRegWithReg("rdx", "rcx")
+	fc.out.JumpUnconditional(int32(matchLoop - (fc.eb.text.Len() + 5)))
+
+	// Stop at a group that nothing overflowed from, or after all groups
+	fc.patchJumpOffset(noMatch+2, fc.eb.text.Len())
+	fc.out.MovU8MemToReg("rcx", "r10", mapOverflowByte)
+	fc.out.TestRegReg("rcx", "rcx")
+	missJumps = append(missJumps, fc.eb.text.Len())
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.IncReg("rax")
+	fc.out.AndRegWithReg("rax", "r8")
+	fc.out.DecReg("r9")
+	fc.out.JumpConditional(JumpNotEqual, int32(loopStart-(fc.eb.text.Len()+6)))
+	return found, missJumps
+}
+
+// generateMapFind emits _vibe67_map_find(rdi = table, rsi = key) -> rax
+func (fc *C67Compiler) generateMapFind() {
+	fc.eb.MarkLabel("_vibe67_map_find")
+
+	fc.out.TestRegReg("rdi", "rdi")
+	emptyJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+
+	fc.emitMapProbeStart()
+	found, missJumps := fc.emitMapProbeGroup()
+
+	// Not found
+	fc.patchJumpOffset(emptyJump+2, fc.eb.text.Len())
+	for _, jump := range missJumps {
+		fc.patchJumpOffset(jump+2, fc.eb.text.Len())
+	}
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.out.Ret()
+
+	// Found: return the address of the value
+	fc.patchJumpOffset(found+2, fc.eb.text.Len())
+	fc.out.LeaMemToReg("rax", "r11", mapControlSize+8)
+	fc.out.Ret()
+}
+
+// generateMapDelete emits _vibe67_map_delete(rdi = table, rsi = key) -> rax
+func (fc *C67Compiler) generateMapDelete() {
+	fc.eb.MarkLabel("_vibe67_map_delete")
+	fc.out.PushReg("rbx")
+
+	fc.out.TestRegReg("rdi", "rdi")
+	emptyJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+
+	fc.emitMapProbeStart()
+	fc.out.MovRegToReg("rbx", "rax") // rbx = first group of the key
+	found, missJumps := fc.emitMapProbeGroup()
+
+	// Not found
+	fc.patchJumpOffset(emptyJump+2, fc.eb.text.Len())
+	for _, jump := range missJumps {
+		fc.patchJumpOffset(jump+2, fc.eb.text.Len())
+	}
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.out.PopReg("rbx")
+	fc.out.Ret()
+
+	// Found: empty the slot
+	fc.patchJumpOffset(found+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("rcx", "r11")
+	fc.out.SubRegFromReg("rcx", "r10")
+	fc.out.ShrRegByImm("rcx", 4)
+	fc.out.AddRegToReg("rcx", "r10")
+	fc.out.XorRegWithReg("rdx", "rdx")
+	fc.out.MovU8RegToMem("rdx", "rcx", 0)
+	fc.out.MovRegToMem("rdx", "r11", mapControlSize)
+	fc.out.MovRegToMem("rdx", "r11", mapControlSize+8)
+	fc.out.MovMemToReg("rcx", "rdi", 0)
+	fc.out.DecReg("rcx")
+	fc.out.MovRegToMem("rcx", "rdi", 0)
+
+	// The groups from the first one up to this one no longer overflow
+	// because of the key
+	fixLoop := fc.eb.text.Len()
+	fc.out.CmpRegToReg("rbx", "rax")
+	doneJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.emitMapGroup("r10", "rbx", "rdi")
+	fc.out.MovU8MemToReg("rcx", "r10", mapOverflowByte)
+	fc.out.CmpRegToImm("rcx", mapOverflowMax)
+	saturatedJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.DecReg("rcx")
+	fc.out.MovU8RegToMem("rcx", "r10", mapOverflowByte)
+	fc.patchJumpOffset(saturatedJump+2, fc.eb.text.Len())
+	fc.out.IncReg("rbx")
+	fc.out.AndRegWithReg("rbx", "r8")
+	fc.out.JumpUnconditional(int32(fixLoop - (fc.eb.text.Len() + 5)))
+
+	fc.patchJumpOffset(doneJump+2, fc.eb.text.Len())
+	fc.out.MovImmToReg("rax", "1")
+	fc.out.PopReg("rbx")
+	fc.out.Ret()
+}
+
+// generateMapSet emits _vibe67_map_set(rdi = &table, rsi = key, xmm0 = value)
+func (fc *C67Compiler) generateMapSet() {
+	fc.eb.MarkLabel("_vibe67_map_set")
+	fc.out.PushReg("rbx")
+	fc.out.PushReg("r12")
+	fc.out.PushReg("r13")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.out.MovRegToReg("r12", "rsi")
+	fc.out.Emit([]byte{0x66, 0x49, 0x0f, 0x7e, 0xc5}) // movq r13, xmm0
+
+	// Replace the value of a key that is already there
+	fc.out.MovMemToReg("rdi", "rbx", 0)
+	fc.out.CallSymbol("_vibe67_map_find")
+	fc.out.TestRegReg("rax", "rax")
+	insertJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovRegToMem("r13", "rax", 0)
+	doneJump := fc.eb.text.Len()
+	fc.out.JumpUnconditional(0)
+
+	// Grow before the table gets more than 7/8 full
+	fc.patchJumpOffset(insertJump+2, fc.eb.text.Len())
+	fc.out.MovMemToReg("rdi", "rbx", 0)
+	fc.out.TestRegReg("rdi", "rdi")
+	growJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToReg("rax", "rdi", 0)
+	fc.out.IncReg("rax")
+	fc.out.ShlRegByImm("rax", 3)
+	fc.out.MovMemToReg("rcx", "rdi", 8)
+	fc.out.ImulImmToReg("rcx", mapMaxLoad)
+	fc.out.CmpRegToReg("rax", "rcx")
+	placeJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpBelowOrEqual, 0)
+	fc.patchJumpOffset(growJump+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("rdi", "rbx")
+	fc.out.CallSymbol("_vibe67_map_grow")
+
+	fc.patchJumpOffset(placeJump+2, fc.eb.text.Len())
+	fc.out.MovMemToReg("rdi", "rbx", 0)
+	fc.out.MovRegToReg("rsi", "r12")
+	fc.out.MovRegToReg("rdx", "r13")
+	fc.out.CallSymbol("_vibe67_map_place")
+
+	fc.patchJumpOffset(doneJump+1, fc.eb.text.Len())
+	fc.out.PopReg("r13")
+	fc.out.PopReg("r12")
+	fc.out.PopReg("rbx")
+	fc.out.Ret()
+}
+
+// generateMapPlace emits _vibe67_map_place(rdi = table, rsi = key, rdx =
+// value bits), which puts a new key into the first empty slot along its
+// probe path
+func (fc *C67Compiler) generateMapPlace() {
+	fc.eb.MarkLabel("_vibe67_map_place")
+	fc.out.MovRegToReg("r9", "rdx")
+	fc.emitMapHash()
+	fc.out.MovRegToReg("rcx", "rax")
+	fc.out.ShrRegByImm("rcx", 57)
+	fc.out.OrRegWithImm("rcx", mapFullTag)
+	fc.out.MovMemToReg("r8", "rdi", 8)
+	fc.out.DecReg("r8")
+	fc.out.AndRegWithReg("rax", "r8")
+
+	loopStart := fc.eb.text.Len()
+	fc.emitMapGroup("r10", "rax", "rdi")
+	fc.out.Emit([]byte{0xf3, 0x41, 0x0f, 0x6f, 0x02}) // movdqu xmm0, [r10]
+	fc.out.Emit([]byte{0x66, 0x0f, 0xef, 0xd2})       // pxor xmm2, xmm2
+	fc.out.Emit([]byte{0x66, 0x0f, 0x74, 0xc2})       // pcmpeqb xmm0, xmm2
+	fc.out.Emit([]byte{0x66, 0x44, 0x0f, 0xd7, 0xd8}) // pmovmskb r11d, xmm0
+	fc.out.AndRegWithImm("r11", mapSlotMask)
+	fc.out.TestRegReg("r11", "r11")
+	emptyJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpNotEqual, 0)
+
+	// The group is full: count the overflow and try the next one
+	fc.out.MovU8MemToReg("rdx", "r10", mapOverflowByte)
+	fc.out.CmpRegToImm("rdx", mapOverflowMax)
+	saturatedJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.IncReg("rdx")
+	fc.out.MovU8RegToMem("rdx", "r10", mapOverflowByte)
+	fc.patchJumpOffset(saturatedJump+2, fc.eb.text.Len())
+	fc.out.IncReg("rax")
+	fc.out.AndRegWithReg("rax", "r8")
+	fc.out.JumpUnconditional(int32(loopStart - (fc.eb.text.Len() + 5)))
+
+	// Fill the lowest empty slot
+	fc.patchJumpOffset(emptyJump+2, fc.eb.text.Len())
+	fc.out.Emit([]byte{0x45, 0x0f, 0xbc, 0xdb}) // bsf r11d, r11d
+	fc.out.MovRegToReg("rdx", "r10")
+	fc.out.AddRegToReg("rdx", "r11")
+	fc.out.MovU8RegToMem("rcx", "rdx", 0)
+	fc.out.ShlRegByImm("r11", 4)
+	fc.out.AddRegToReg("r11", "r10")
+	fc.out.MovRegToMem("rsi", "r11", mapControlSize)
+	fc.out.MovRegToMem("r9", "r11", mapControlSize+8)
+	fc.out.MovMemToReg("rdx", "rdi", 0)
+	fc.out.IncReg("rdx")
+	fc.out.MovRegToMem("rdx", "rdi", 0)
+	fc.out.Ret()
+}
+
+// generateMapGrow emits _vibe67_map_grow(rdi = &table), which replaces the
+// table with one with twice the groups (or the first table)
+func (fc *C67Compiler) generateMapGrow() {
+	fc.eb.MarkLabel("_vibe67_map_grow")
+	fc.out.PushReg("rbx")
+	fc.out.PushReg("r12")
+	fc.out.PushReg("r13")
+	fc.out.PushReg("r14")
+	fc.out.PushReg("r15")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.out.MovMemToReg("r12", "rbx", 0) // r12 = old table
+
+	// r13 = groups in the new table
+	fc.out.MovImmToReg("r13", fmt.Sprintf("%d", mapMinGroups))
+	fc.out.TestRegReg("r12", "r12")
+	firstJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToReg("r13", "r12", 8)
+	fc.out.ImulImmToReg("r13", mapGrowthFactor)
+	fc.patchJumpOffset(firstJump+2, fc.eb.text.Len())
+
+	// Allocate and clear the new table
+	fc.out.MovRegToReg("r14", "r13")
+	fc.out.ImulImmToReg("r14", mapGroupSize)
+	fc.out.AddImmToReg("r14", mapHeaderSize)
+	fc.out.MovRegToReg("rsi", "r14")
+	fc.allocateMemoryPlatform("rsi")
+	fc.out.MovRegToReg("rdx", "rax")
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.out.MovRegToReg("rcx", "r14")
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.out.Emit([]byte{0xf3, 0xaa}) // rep stosb
+	fc.out.MovRegToMem("r13", "rdx", 8)
+	fc.out.MovRegToMem("rdx", "rbx", 0)
+	fc.out.MovRegToReg("r14", "rdx") // r14 = new table
+
+	fc.out.TestRegReg("r12", "r12")
+	doneJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+
+	// Reinsert the entries of the old table in memory order
+	fc.out.MovMemToReg("r13", "r12", 8)
+	fc.out.ImulImmToReg("r13", mapGroupSize)
+	fc.out.AddRegToReg("r13", "r12")
+	fc.out.AddImmToReg("r13", mapHeaderSize) // r13 = end of the old groups
+	fc.out.LeaMemToReg("rbx", "r12", mapHeaderSize)
+	groupLoop := fc.eb.text.Len()
+	fc.out.CmpRegToReg("rbx", "r13")
+	freeJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpAboveOrEqual, 0)
+	fc.out.XorRegWithReg("r15", "r15")
+	slotLoop := fc.eb.text.Len()
+	fc.out.CmpRegToImm("r15", mapGroupSlots)
+	nextGroupJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovRegToReg("rax", "rbx")
+	fc.out.AddRegToReg("rax", "r15")
+	fc.out.MovU8MemToReg("rcx", "rax", 0)
+	fc.out.TestRegReg("rcx", "rcx")
+	emptyJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovRegToReg("rax", "r15")
+	fc.out.ShlRegByImm("rax", 4)
+	fc.out.AddRegToReg("rax", "rbx")
+	fc.out.MovRegToReg("rdi", "r14")
+	fc.out.MovMemToReg("rsi", "rax", mapControlSize)
+	fc.out.MovMemToReg("rdx", "rax", mapControlSize+8)
+	fc.out.CallSymbol("_vibe67_map_place")
+	fc.patchJumpOffset(emptyJump+2, fc.eb.text.Len())
+	fc.out.IncReg("r15")
+	fc.out.JumpUnconditional(int32(slotLoop - (fc.eb.text.Len() + 5)))
+	fc.patchJumpOffset(nextGroupJump+2, fc.eb.text.Len())
+	fc.out.AddImmToReg("rbx", mapGroupSize)
+	fc.out.JumpUnconditional(int32(groupLoop - (fc.eb.text.Len() + 5)))
+
+	// Release the old table
+	fc.patchJumpOffset(freeJump+2, fc.eb.text.Len())
+	if fc.eb.target.OS() == OSWindows {
+		if !fc.hasCFunction("free") {
+			fc.importCFunction("free", "msvcrt.dll")
+		}
+		fc.out.MovRegToReg("rcx", "r12")
+		shadowSpace := fc.allocateShadowSpace()
+		fc.out.CallSymbol("__imp_free")
+		fc.deallocateShadowSpace(shadowSpace)
+	} else {
+		// munmap(old table, size)
+		fc.out.MovRegToReg("rdi", "r12")
+		fc.out.MovMemToReg("rsi", "r12", 8)
+		fc.out.ImulImmToReg("rsi", mapGroupSize)
+		fc.out.AddImmToReg("rsi", mapHeaderSize)
+		fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_MUNMAP"))
+		fc.out.Syscall()
+	}
+
+	fc.patchJumpOffset(doneJump+2, fc.eb.text.Len())
+	fc.out.PopReg("r15")
+	fc.out.PopReg("r14")
+	fc.out.PopReg("r13")
+	fc.out.PopReg("r12")
+	fc.out.PopReg("rbx")
+	fc.out.Ret()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// mapOp is one operation of a differential test: 's'et, 'g'et or 'd'elete
+type mapOp struct {
+	kind  byte
+	key   uint64
+	value float64
+}
+
+// mapMissing is what a get of a missing key reports
+const mapMissing = 0xdead_beef_dead_beef
+
+// runStaticELF links the code emitted by fc into a static x86-64 Linux
+// executable with a single segment of the given flags, runs it and returns
+// its output
+func runStaticELF(t *testing.T, fc *C67Compiler, name string, flags elf.ProgFlag) []byte {
+	t.Helper()
+	const base, headers = 0x400000, 64 + 56
+	fc.eb.PatchCallSites(base + headers)
+	fc.eb.PatchPCRelocations(base+headers, 0, 0)
+	code := fc.eb.text.Bytes()
+	exe := make([]byte, headers, headers+len(code))
+	copy(exe, "\x7fELF\x02\x01\x01")
+	le := binary.LittleEndian
+	le.PutUint16(exe[16:], 2)  // ET_EXEC
+	le.PutUint16(exe[18:], 62) // EM_X86_64
+	le.PutUint32(exe[20:], 1)
+	le.PutUint64(exe[24:], base+headers) // entry
+	le.PutUint64(exe[32:], 64)           // program headers
+	le.PutUint16(exe[52:], 64)
+	le.PutUint16(exe[54:], 56)
+	le.PutUint16(exe[56:], 1)
+	ph := exe[64:]
+	le.PutUint32(ph[0:], 1) // PT_LOAD
+	le.PutUint32(ph[4:], uint32(flags))
+	le.PutUint64(ph[16:], base)
+	le.PutUint64(ph[24:], base)
+	le.PutUint64(ph[32:], uint64(headers+len(code)))
+	le.PutUint64(ph[40:], uint64(headers+len(code)))
+	le.PutUint64(ph[48:], 0x1000)
+	exe = append(exe, code...)
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, exe, 0755); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(path).Output()
+	if err != nil {
+		t.Fatalf("running %s: %v", name, err)
+	}
+	return out
+}
+
+// runMapOps runs the operations through the emitted runtime in a static
+// x86-64 Linux executable. It returns one result per operation (the value
+// bits for a get, 1 or 0 for a delete, 0 for a set) and the final table.
+func runMapOps(t *testing.T, ops []mapOp) ([]uint64, []byte) {
+	t.Helper()
+	fc, err := NewC67Compiler(Platform{OS: OSLinux, Arch: ArchX86_64}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	movImm64 := func(reg byte, imm uint64) {
+		code := []byte{0x48, 0xb8 + reg, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(code[2:], imm)
+		fc.out.Emit(code)
+	}
+	const rax, rsi = 0, 6
+
+	// The table pointer is at [rsp] and the results follow it
+	frame := (16 + 8*len(ops) + 15) &^ 15
+	fc.out.SubImmFromReg("rsp", int64(frame))
+	fc.out.MovImmToMem(0, "rsp", 0)
+	for i, op := range ops {
+		result := 16 + 8*i
+		movImm64(rsi, op.key)
+		switch op.kind {
+		case 's':
+			fc.out.LeaMemToReg("rdi", "rsp", 0)
+			movImm64(rax, math.Float64bits(op.value))
+			fc.out.MovRegToXmm("xmm0", "rax")
+			fc.out.CallSymbol("_vibe67_map_set")
+			fc.out.MovImmToMem(0, "rsp", result)
+		case 'g':
+			fc.out.MovMemToReg("rdi", "rsp", 0)
+			fc.out.CallSymbol("_vibe67_map_find")
+			movImm64(1, mapMissing) // rcx
+			fc.out.TestRegReg("rax", "rax")
+			missing := fc.eb.text.Len()
+			fc.out.JumpConditional(JumpEqual, 0)
+			fc.out.MovMemToReg("rcx", "rax", 0)
+			fc.patchJumpOffset(missing+2, fc.eb.text.Len())
+			fc.out.MovRegToMem("rcx", "rsp", result)
+		case 'd':
+			fc.out.MovMemToReg("rdi", "rsp", 0)
+			fc.out.CallSymbol("_vibe67_map_delete")
+			fc.out.MovRegToMem("rax", "rsp", result)
+		}
+	}
+
+	// write(1, results), write(1, table), exit(0)
+	fc.out.MovImmToReg("rdi", "1")
+	fc.out.LeaMemToReg("rsi", "rsp", 16)
+	fc.out.MovImmToReg("rdx", "0")
+	fc.out.AddImmToReg("rdx", int64(8*len(ops)))
+	fc.out.MovImmToReg("rax", "1")
+	fc.out.Syscall()
+	fc.out.MovMemToReg("rsi", "rsp", 0)
+	fc.out.TestRegReg("rsi", "rsi")
+	noTable := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToReg("rdx", "rsi", 8)
+	fc.out.ImulImmToReg("rdx", mapGroupSize)
+	fc.out.AddImmToReg("rdx", mapHeaderSize)
+	fc.out.MovImmToReg("rdi", "1")
+	fc.out.MovImmToReg("rax", "1")
+	fc.out.Syscall()
+	fc.patchJumpOffset(noTable+2, fc.eb.text.Len())
+	fc.out.MovImmToReg("rdi", "0")
+	fc.out.MovImmToReg("rax", "60")
+	fc.out.Syscall()
+
+	fc.generateMapRuntime()
+
+	out := runStaticELF(t, fc, "maps", elf.PF_R|elf.PF_X)
+	if len(out) < 8*len(ops) {
+		t.Fatalf("got %d bytes of output for %d operations", len(out), len(ops))
+	}
+	results := make([]uint64, len(ops))
+	for i := range results {
+		results[i] = binary.LittleEndian.Uint64(out[8*i:])
+	}
+	return results, out[8*len(ops):]
+}
+
+// collidingKeys returns keys that all start probing at the first group of
+// any table with up to 2^16 groups
+func collidingKeys(n int) []uint64 {
+	var keys []uint64
+	for k := uint64(1); len(keys) < n; k++ {
+		if mapHash(k)&0xffff == 0 {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func TestMapRuntimeMatchesModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(67))
+	colliding := collidingKeys(40)
+	randomOps := func(n int, keySpace uint64, deletes int) []mapOp {
+		var ops []mapOp
+		for range n {
+			key := rng.Uint64() % keySpace
+			if rng.Intn(4) == 0 {
+				key = math.Float64bits(float64(key)) // keys are usually float bit patterns
+			}
+			switch r := rng.Intn(10); {
+			case r < deletes:
+				ops = append(ops, mapOp{kind: 'd', key: key})
+			case r < 6:
+				ops = append(ops, mapOp{kind: 's', key: key, value: rng.NormFloat64()})
+			default:
+				ops = append(ops, mapOp{kind: 'g', key: key})
+			}
+		}
+		return ops
+	}
+
+	tests := map[string][]mapOp{
+		"empty":  {{kind: 'g', key: 1}, {kind: 'd', key: 1}},
+		"growth": randomOps(3000, 1<<20, 0),
+		"churn":  randomOps(3000, 300, 3),
+		"colliding": func() []mapOp {
+			var ops []mapOp
+			for round := range 3 {
+				for i, key := range colliding {
+					ops = append(ops, mapOp{kind: 's', key: key, value: float64(round*100 + i)})
+				}
+				for i, key := range colliding {
+					if (i+round)%3 != 0 {
+						ops = append(ops, mapOp{kind: 'd', key: key})
+					}
+					ops = append(ops, mapOp{kind: 'g', key: colliding[len(colliding)-1-i]})
+				}
+			}
+			return ops
+		}(),
+	}
+	backends := []struct {
+		name string
+		run  func(*testing.T, []mapOp) ([]uint64, []byte)
+	}{
+		{"x86-64", runMapOps},
+		{"arm64", runARM64MapOps},
+	}
+	for _, backend := range backends {
+		for name, ops := range tests {
+			t.Run(backend.name+"/"+name, func(t *testing.T) {
+				if backend.name == "x86-64" && (runtime.GOOS != "linux" || runtime.GOARCH != "amd64") {
+					t.Skip("runs the emitted x86-64 runtime as a Linux executable")
+				}
+				results, table := backend.run(t, ops)
+				m := NewVibe67HashMap(0)
+				for i, op := range ops {
+					var want uint64
+					switch op.kind {
+					case 's':
+						m.Set(op.key, op.value)
+					case 'g':
+						want = mapMissing
+						if v, ok := m.Get(op.key); ok {
+							want = math.Float64bits(v)
+						}
+					case 'd':
+						if m.Delete(op.key) {
+							want = 1
+						}
+					}
+					if results[i] != want {
+						t.Fatalf("operation %d (%c %#x): runtime gave %#x, model %#x", i, op.kind, op.key, results[i], want)
+					}
+				}
+				if want := m.Layout(); string(table) != string(want) {
+					t.Errorf("runtime table (%d bytes) differs from the model's (%d bytes)", len(table), len(want))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Completion: 85% - Content-addressed build cache for parsed modules and executables
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// modcache.go - Incremental build cache
+//
+// Parsing is done per file, so parsed ASTs are cached per source file, keyed
+// on the SHA-256 of the compiler build, the target, the file name and the file
+// contents. Code generation works on the whole program (dead code
+// elimination, closure analysis and call patching span all modules), so
+// machine code is cached per executable, keyed on every parsed input, the
+// target and the flags that affect code generation. Rebuilding a project whose Git modules
+// did not change therefore skips both parsing and code generation for them.
+//
+//	$XDG_CACHE_HOME/vibe67/build/ast/3f/3f2c...  gob-encoded *Program
+//	$XDG_CACHE_HOME/vibe67/build/exe/a1/a1b7...  executable
+//
+// Entries are never modified, only added, so a stale entry can not be hit.
+
+// buildCacheFormat is bumped whenever the encoding of cached entries changes
+const buildCacheFormat = "3"
+
+// NoCacheFlag disables the build cache (--no-cache)
+var NoCacheFlag bool
+
+// BuildCache is the build cache for one compilation
+type BuildCache struct {
+	dir       string
+	platform  Platform
+	inputs    []string // keys of all parsed inputs, in parse order
+	cacheable bool     // false if the executable depends on more than the parsed inputs
+	hits      int
+	misses    int
+}
+
+// activeBuildCache is the build cache of the program currently being compiled (nil if disabled)
+var activeBuildCache *BuildCache
+
+func init() {
+	// Every concrete node type must be registered, since the AST is made of interfaces
+	for _, node := range []interface{}{
+		&AddressLiteralExpr{}, &AliasStmt{}, &ArenaExpr{}, &ArenaStmt{}, &AssignStmt{},
+		&BackgroundExpr{}, &BinaryExpr{}, &BlockExpr{}, &BooleanExpr{}, &CImportStmt{},
+		&CStructDecl{}, &CallExpr{}, &CastExpr{}, &ClassDecl{}, &ComposeExpr{},
+		&DeferStmt{}, &DirectCallExpr{}, &ExportStmt{}, &ExpressionStmt{}, &FMAExpr{},
+		&FStringExpr{}, &FieldAccessExpr{}, &IdentExpr{}, &ImportStmt{}, &InExpr{},
+		&IndexExpr{}, &JumpExpr{}, &JumpStmt{}, &LambdaExpr{}, &LengthExpr{},
+		&ListExpr{}, &LiteralPattern{}, &LockStmt{}, &LoopExpr{}, &LoopStateExpr{},
+		&LoopStmt{}, &MapExpr{}, &MapUpdateStmt{}, &MatchExpr{}, &MemoryStore{},
+		&MoveExpr{}, &MultiLambdaExpr{}, &MultipleAssignStmt{}, &NamespacedIdentExpr{}, &NumberExpr{},
+		&ParallelExpr{}, &PatternLambdaExpr{}, &PipeExpr{}, &PostfixExpr{}, &RandomExpr{},
+		&RangeExpr{}, &ReceiveExpr{}, &ReceiveLoopStmt{}, &RegisterAssignStmt{}, &RegisterExpr{},
+		&SendExpr{}, &SliceExpr{}, &SpawnStmt{}, &StringExpr{}, &StructLiteralExpr{},
+		&SyscallStmt{}, &UnaryExpr{}, &UnsafeExpr{}, &UnsafeReturnStmt{}, &UseStmt{},
+		&VarPattern{}, &VectorExpr{}, &WhileStmt{}, &WildcardPattern{},
+		&RegisterOp{}, &MemoryLoad{}, // stored in interface{} fields of unsafe blocks
+	} {
+		gob.Register(node)
+	}
+}
+
+// OpenBuildCache returns the build cache for a target, or nil if it is
+// disabled or the cache directory is not available
+func OpenBuildCache(platform Platform) *BuildCache {
+	if NoCacheFlag || os.Getenv("VIBE67_NOCACHE") != "" {
+		return nil
+	}
+	cachePath, err := GetCachePath()
+	if err != nil {
+		return nil
+	}
+	return &BuildCache{
+		dir:       filepath.Join(cachePath, "build"),
+		platform:  platform,
+		cacheable: true,
+	}
+}
+
+// compilerFingerprint identifies the running compiler build. The version
+// string alone is not enough: a rebuilt compiler (or test binary) with the
+// same version must not reuse executables generated by the old code.
+var compilerFingerprint = sync.OnceValue(func() string {
+	path, err := os.Executable()
+	if err != nil {
+		return versionString
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return versionString
+	}
+	sum := sha256.Sum256(data)
+	return versionString + " " + hex.EncodeToString(sum[:])
+})
+
+// key hashes the compiler build, the target and parts into a cache key
+func (bc *BuildCache) key(kind string, parts ...string) string {
+	h := sha256.New()
+	for _, s := range append([]string{compilerFingerprint(), buildCacheFormat, bc.platform.FullString(), kind}, parts...) {
+		fmt.Fprintf(h, "%d:%s\n", len(s), s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// entryPath returns the file of a cache entry
+func (bc *BuildCache) entryPath(kind, key string) string {
+	return filepath.Join(bc.dir, kind, key[:2], key)
+}
+
+// store writes a cache entry atomically, so that concurrent builds never see partial entries
+func (bc *BuildCache) store(kind, key string, data []byte, perm os.FileMode) {
+	path := bc.entryPath(kind, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".tmp*")
+	if err != nil {
+		return
+	}
+	_, werr := tmp.Write(data)
+	cerr := tmp.Close()
+	if werr != nil || cerr != nil || os.Chmod(tmp.Name(), perm) != nil || os.Rename(tmp.Name(), path) != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// parseSource parses one source file, using the active build cache if there is one
+// Parse errors panic, as with Parser.ParseProgram.
+func parseSource(content, filename string) *Program {
+	var program *Program
+	if bc := activeBuildCache; bc != nil {
+		program = bc.ParseFile(content, filename)
+	} else {
+		program = NewParserWithFilename(content, filename).ParseProgram()
+	}
+	if strings.HasPrefix(content, bindgenMarker) {
+		addBindingPrototypes(program) // see bindgen.go
+	}
+	return program
+}
+
+// ParseFile returns the AST of a source file from the cache, parsing and
+// caching it on a miss
+func (bc *BuildCache) ParseFile(content, filename string) *Program {
+	ext := filepath.Ext(filename)
+	if ext != ".vibe67" && ext != ".v67" && ext != ".c67" {
+		bc.cacheable = false // e.g. C headers from library imports
+	}
+	// The AST holds no positions, but the optimizer names temporaries and
+	// profile counters after the file, so the name is part of the key
+	key := bc.key("ast", profileCacheKey(), filename, content)
+	bc.inputs = append(bc.inputs, key)
+
+	if data, err := os.ReadFile(bc.entryPath("ast", key)); err == nil {
+		var program Program
+		if gob.NewDecoder(bytes.NewReader(data)).Decode(&program) == nil {
+			restoreProgram(&program)
+			bc.hits++
+			return &program
+		}
+	}
+
+	bc.misses++
+	program := NewParserWithFilename(content, filename).ParseProgram()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(program); err == nil {
+		bc.store("ast", key, buf.Bytes(), 0644)
+	} else if VerboseMode {
+		fmt.Fprintf(os.Stderr, "Warning: could not cache AST of %s: %v\n", filename, err)
+	}
+	return program
+}
+
+// restoreProgram undoes what gob does not preserve: it drops empty maps and
+// slices, and shared pointers are decoded as separate copies
+func restoreProgram(program *Program) {
+	restoreEmptyMaps(reflect.ValueOf(program))
+	for _, stmt := range program.Statements {
+		if decl, ok := stmt.(*CStructDecl); ok {
+			program.CStructs[decl.Name] = decl
+		}
+	}
+}
+
+// restoreEmptyMaps replaces nil maps with empty ones throughout a decoded AST
+// (the parser always allocates them, and later passes write into them)
+func restoreEmptyMaps(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			restoreEmptyMaps(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				restoreEmptyMaps(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			restoreEmptyMaps(v.Index(i))
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			if v.CanSet() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			return
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			restoreEmptyMaps(iter.Value())
+		}
+	}
+}
+
+// executableKey returns the cache key of the executable built from all
+// parsed inputs, or "" if the executable can not be cached
+func (bc *BuildCache) executableKey(program *Program, outputPath string) string {
+	if !bc.cacheable || BuildMode != BuildModeExe {
+		return "" // the header written next to a library is not cached
+	}
+	for _, stmt := range program.Statements {
+		if _, ok := stmt.(*CImportStmt); ok {
+			return "" // depends on C headers outside the cache key
+		}
+	}
+	if WindowsOptions.Icon != "" {
+		return "" // the icon is a file outside the cache key
+	}
+	var libs []string
+	if activeManifest != nil {
+		libs = activeManifest.Libraries
+	}
+	flags := fmt.Sprintf("compress=%v tiny=%v avx512=%v no-ir=%v libs=%s profile=%s windows=%+v", CompressFlag, TinyFlag, EnableAVX512, NoIRFlag, strings.Join(libs, ","), profileCacheKey(), WindowsOptions)
+	parts := append([]string{flags, filepath.Base(outputPath)}, bc.inputs...)
+	return bc.key("exe", parts...)
+}
+
+// LoadExecutable copies a cached executable to outputPath, reporting whether there was one
+func (bc *BuildCache) LoadExecutable(key, outputPath string) bool {
+	if key == "" {
+		return false
+	}
+	data, err := os.ReadFile(bc.entryPath("exe", key))
+	if err != nil {
+		return false
+	}
+	if err := os.WriteFile(outputPath, data, 0755); err != nil {
+		return false
+	}
+	// WriteFile keeps the mode of an existing file
+	return os.Chmod(outputPath, 0755) == nil
+}
+
+// StoreExecutable adds a freshly built executable to the cache
+func (bc *BuildCache) StoreExecutable(key, outputPath string) {
+	if key == "" {
+		return
+	}
+	if data, err := os.ReadFile(outputPath); err == nil {
+		bc.store("exe", key, data, 0755)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBuildCacheRegistersAllNodes makes sure that every AST node type can be
+// encoded, since gob refuses unregistered types behind interfaces
+func TestBuildCacheRegistersAllNodes(t *testing.T) {
+	registry, err := os.ReadFile("modcache.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil {
+				continue
+			}
+			switch fn.Name.Name {
+			case "expressionNode", "statementNode", "patternNode":
+			default:
+				continue
+			}
+			recv := fn.Recv.List[0].Type
+			if star, ok := recv.(*ast.StarExpr); ok {
+				recv = star.X
+			}
+			name := recv.(*ast.Ident).Name
+			if !strings.Contains(string(registry), "&"+name+"{}") {
+				t.Errorf("%s (%s) is not registered with gob in modcache.go", name, file)
+			}
+		}
+	}
+}
+
+func TestBuildCacheReusesModules(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("VIBE67_NOCACHE", "")
+
+	code := `
+base := 3
+sq := x -> x * x
+classify := n -> n {
+    0 -> 10
+    ~> 20
+}
+@ i in 0..<3 {
+    println(sq(i) + base)
+}
+println(classify(0))
+println(classify(5))
+`
+	tmpDir := t.TempDir()
+	srcPath := filepath.Join(tmpDir, "cached.vibe67")
+	exePath := filepath.Join(tmpDir, "cached")
+	if err := os.WriteFile(srcPath, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func() string {
+		t.Helper()
+		if err := CompileC67(srcPath, exePath, GetDefaultPlatform()); err != nil {
+			t.Fatalf("compilation failed: %v", err)
+		}
+		// The exit code is the value of the last expression, so only the output is checked
+		output, err := exec.Command(exePath).Output()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			t.Fatalf("run failed: %v", err)
+		}
+		return string(output)
+	}
+
+	expected := "3\n4\n7\n10\n20\n"
+	if got := run(); got != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+
+	// Drop the cached executable, so that the next build generates code from the cached AST
+	bc := OpenBuildCache(GetDefaultPlatform())
+	if bc == nil {
+		t.Fatal("build cache is not available")
+	}
+	asts, _ := filepath.Glob(filepath.Join(bc.dir, "ast", "*", "*"))
+	exes, _ := filepath.Glob(filepath.Join(bc.dir, "exe", "*", "*"))
+	if len(asts) != 1 || len(exes) != 1 {
+		t.Fatalf("expected 1 cached AST and 1 cached executable, got %d and %d", len(asts), len(exes))
+	}
+	if err := os.RemoveAll(filepath.Join(bc.dir, "exe")); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(exePath)
+	if got := run(); got != expected {
+		t.Fatalf("build from cached AST: expected %q, got %q", expected, got)
+	}
+
+	// Unchanged sources reuse the executable
+	os.Remove(exePath)
+	if got := run(); got != expected {
+		t.Fatalf("cached executable: expected %q, got %q", expected, got)
+	}
+
+	// Changed sources get new entries
+	if err := os.WriteFile(srcPath, []byte("println(99)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := run(); got != "99\n" {
+		t.Fatalf("expected the changed program to print 99, got %q", got)
+	}
+	asts, _ = filepath.Glob(filepath.Join(bc.dir, "ast", "*", "*"))
+	if len(asts) != 2 {
+		t.Fatalf("expected 2 cached ASTs, got %d", len(asts))
+	}
+}
+
+func TestBuildCacheKeyDependsOnTarget(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("VIBE67_NOCACHE", "")
+	amd64 := OpenBuildCache(Platform{Arch: ArchX86_64, OS: OSLinux})
+	arm64 := OpenBuildCache(Platform{Arch: ArchARM64, OS: OSLinux})
+	if amd64.key("ast", "x = 1") == arm64.key("ast", "x = 1") {
+		t.Error("cache keys for different targets must differ")
+	}
+	if amd64.key("ast", "x = 1") == amd64.key("ast", "x = 2") {
+		t.Error("cache keys for different sources must differ")
+	}
+}
+
+// TestBuildCacheKeyDependsOnFileName makes sure that files with the same
+// contents get their own ASTs, since the optimizer names temporaries and
+// profile counters after the file
+func TestBuildCacheKeyDependsOnFileName(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("VIBE67_NOCACHE", "")
+	bc := OpenBuildCache(Platform{Arch: ArchX86_64, OS: OSLinux})
+	if bc == nil {
+		t.Fatal("build cache is not available")
+	}
+	code := `
+x := 3.0
+y := 4.0
+a = sqrt(x * x + y * y)
+b = sqrt(x * x + y * y) * 2
+println(a + b)
+`
+	first := bc.ParseFile(code, "/project/a.v67")
+	second := bc.ParseFile(code, "/project/lib/b.v67")
+	if bc.hits != 0 || bc.misses != 2 {
+		t.Errorf("expected 2 misses, got %d hits and %d misses", bc.hits, bc.misses)
+	}
+	temp := first.Statements[2].(*AssignStmt).Name
+	if !strings.HasPrefix(temp, "_t") {
+		t.Fatalf("expected a temporary, got %s", first.Statements[2])
+	}
+	if other := second.Statements[2].(*AssignStmt).Name; other == temp {
+		t.Errorf("both files name their temporary %s", temp)
+	}
+	if again := bc.ParseFile(code, "/project/a.v67"); again.Statements[2].(*AssignStmt).Name != temp || bc.hits != 1 {
+		t.Errorf("the first file was not read back from the cache")
+	}
+}
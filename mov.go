@@ -18,7 +18,10 @@ type Out struct {
 
 // NewOut creates a new Out instance with the backend properly initialized
 func NewOut(target Target, writer Writer, eb *ExecutableBuilder) *Out {
-	backend := NewCodeGenerator(target.Arch(), writer, eb)
+	var backend CodeGenerator
+	if target.Arch() != ArchX86_64 {
+		backend = NewCodeGenerator(target.Arch(), writer, eb)
+	}
 	return &Out{
 		target:         target,
 		writer:         writer,
@@ -16,9 +16,13 @@ import (
 // - Dead code elimination
 // - Function inlining
 // - Purity analysis
+// - Common subexpression elimination and loop-invariant code motion
 // - Closure analysis
 
-func optimizeProgram(program *Program) *Program {
+func optimizeProgram(program *Program, source string) *Program {
+	// Name the profile counters while the program is as written
+	assignProfileKeys(program, source)
+
 	// Pass 1: Constant folding (2 + 3 → 5)
 	for i, stmt := range program.Statements {
 		program.Statements[i] = foldConstants(stmt)
@@ -75,7 +79,10 @@ func optimizeProgram(program *Program) *Program {
 		program.Statements[i] = foldConstants(stmt)
 	}
 
-	// Pass 7: Loop vectorization (convert scalar loops to SIMD)
+	// Pass 7: Redundancy elimination (compute repeated and loop-invariant expressions once)
+	eliminateRedundancy(program, pureFunctions, source)
+
+	// Pass 8: Loop vectorization (convert scalar loops to SIMD)
 	for i, stmt := range program.Statements {
 		program.Statements[i] = vectorizeLoops(stmt)
 	}
@@ -1187,44 +1194,87 @@ func eliminateDeadCode(stmt Statement, usedVars map[string]bool) Statement {
 
 // hasSideEffects checks if an expression contains function calls or other side effects
 func hasSideEffects(expr Expression) bool {
+	return hasSideEffectsCalling(expr, nil)
+}
+
+// hasSideEffectsCalling is hasSideEffects, except that the calls for which
+// pure returns true only have the side effects of their arguments
+func hasSideEffectsCalling(expr Expression, pure func(*CallExpr) bool) bool {
+	has := func(e Expression) bool { return hasSideEffectsCalling(e, pure) }
 	switch e := expr.(type) {
 	case *CallExpr:
-		return true // Function calls have side effects
+		if pure == nil || !pure(e) {
+			return true // Function calls have side effects
+		}
+		for _, arg := range e.Args {
+			if has(arg) {
+				return true
+			}
+		}
+		return false
 	case *BinaryExpr:
-		return hasSideEffects(e.Left) || hasSideEffects(e.Right)
+		return has(e.Left) || has(e.Right)
+	case *UnaryExpr:
+		return has(e.Operand)
+	case *LengthExpr:
+		return has(e.Operand)
+	case *CastExpr:
+		return has(e.Expr)
+	case *InExpr:
+		return has(e.Value) || has(e.Container)
+	case *RangeExpr:
+		return has(e.Start) || has(e.End)
 	case *ListExpr:
 		for _, elem := range e.Elements {
-			if hasSideEffects(elem) {
+			if has(elem) {
 				return true
 			}
 		}
 		return false
 	case *MapExpr:
 		for i := range e.Keys {
-			if hasSideEffects(e.Keys[i]) || hasSideEffects(e.Values[i]) {
+			if has(e.Keys[i]) || has(e.Values[i]) {
 				return true
 			}
 		}
 		return false
 	case *IndexExpr:
-		return hasSideEffects(e.List) || hasSideEffects(e.Index)
+		return has(e.List) || has(e.Index)
+	case *SliceExpr:
+		return has(e.List) || has(e.Start) || has(e.End) || has(e.Step)
+	case *FieldAccessExpr:
+		return has(e.Object)
+	case *StructLiteralExpr:
+		for _, field := range e.Fields {
+			if has(field) {
+				return true
+			}
+		}
+		return false
+	case *FStringExpr:
+		for _, part := range e.Parts {
+			if has(part) {
+				return true
+			}
+		}
+		return false
 	case *ParallelExpr:
 		return true // Parallel operations have side effects
 	case *PipeExpr:
-		return hasSideEffects(e.Left) || hasSideEffects(e.Right)
+		return has(e.Left) || has(e.Right)
 	case *MatchExpr:
-		if hasSideEffects(e.Condition) {
+		if has(e.Condition) {
 			return true
 		}
 		for _, clause := range e.Clauses {
-			if clause.Guard != nil && hasSideEffects(clause.Guard) {
+			if clause.Guard != nil && has(clause.Guard) {
 				return true
 			}
-			if hasSideEffects(clause.Result) {
+			if has(clause.Result) {
 				return true
 			}
 		}
-		if e.DefaultExpr != nil && hasSideEffects(e.DefaultExpr) {
+		if e.DefaultExpr != nil && has(e.DefaultExpr) {
 			return true
 		}
 		return false
@@ -1232,9 +1282,26 @@ func hasSideEffects(expr Expression) bool {
 		// Blocks can have side effects if any statement does
 		return true
 	case *FMAExpr:
-		return hasSideEffects(e.A) || hasSideEffects(e.B) || hasSideEffects(e.C)
+		return has(e.A) || has(e.B) || has(e.C)
+	case *VectorExpr:
+		for _, comp := range e.Components {
+			if has(comp) {
+				return true
+			}
+		}
+		return false
+	case *ComposeExpr:
+		return has(e.Left) || has(e.Right)
+	case *DirectCallExpr, *PostfixExpr, *MoveExpr, *SendExpr, *ReceiveExpr, *RandomExpr,
+		*LoopExpr, *JumpExpr, *BackgroundExpr, *ArenaExpr, *UnsafeExpr:
+		return true // Update variables or memory, or do I/O
+	case *RegisterExpr, *LoopStateExpr:
+		return true // Change between statements and between iterations
+	case nil, *NumberExpr, *StringExpr, *BooleanExpr, *IdentExpr, *NamespacedIdentExpr,
+		*AddressLiteralExpr, *LambdaExpr, *MultiLambdaExpr, *PatternLambdaExpr:
+		return false // Literals, identifiers and function values
 	default:
-		return false // Literals, identifiers, etc. have no side effects
+		return true // Unknown expressions may clobber anything
 	}
 }
 
@@ -1528,6 +1595,12 @@ func analyzeClosures(stmt Statement, availableVars map[string]bool, globalVars m
 			analyzeClosures(bodyStmt, newAvailableVars, globalVars)
 		}
 
+	case *LockStmt:
+		analyzeClosuresExpr(s.Mutex, availableVars, globalVars)
+		for _, bodyStmt := range s.Body {
+			analyzeClosures(bodyStmt, availableVars, globalVars)
+		}
+
 	case *JumpStmt:
 		// Analyze the value expression of return/jump statements
 		if s.Value != nil {
@@ -1642,14 +1715,28 @@ func analyzeClosuresExpr(expr Expression, availableVars map[string]bool, globalV
 
 // collectInlineCandidates identifies lambdas suitable for inlining
 // Criteria: immutable, small body (single expression), not in a loop
+// With -profile-use, functions that were never called are not inlined, and
+// hot functions whose body is a match are. Instrumented builds inline nothing,
+// so that every call is counted.
 func collectInlineCandidates(stmt Statement, candidates map[string]*LambdaExpr) {
+	if ProfileGenerateFile != "" {
+		return
+	}
 	switch s := stmt.(type) {
 	case *AssignStmt:
 		// Only inline immutable assignments to lambdas
-		if !s.Mutable && !s.IsUpdate {
+		// Hot functions are never inlined, since their code is replaced at runtime
+		if !s.Mutable && !s.IsUpdate && !s.IsHot {
 			if lambda, ok := s.Value.(*LambdaExpr); ok {
+				if calls, ok := activeProfile.Calls(s.Name); ok && calls == 0 {
+					return
+				}
 				// Only inline simple lambdas (single expression body, no blocks)
-				if !isComplexExpression(lambda.Body) {
+				hotMatch := isComplexExpression(lambda.Body) && activeProfile.hotFunction(s.Name) && isInlinableMatch(s.Name, lambda.Body)
+				if hotMatch && VerboseMode {
+					fmt.Fprintf(os.Stderr, "PGO: inlining hot function %s\n", s.Name)
+				}
+				if !isComplexExpression(lambda.Body) || hotMatch {
 					// Store a copy to avoid mutation
 					candidates[s.Name] = &LambdaExpr{
 						Params: lambda.Params,
@@ -1667,6 +1754,23 @@ func collectInlineCandidates(stmt Statement, candidates map[string]*LambdaExpr)
 	}
 }
 
+// isInlinableMatch checks if the body of a hot function is a match of simple
+// expressions, which is worth inlining into its callers
+func isInlinableMatch(name string, body Expression) bool {
+	match, ok := body.(*MatchExpr)
+	if !ok || isComplexExpression(match.Condition) || isComplexExpression(match.DefaultExpr) {
+		return false
+	}
+	for _, clause := range match.Clauses {
+		if _, isJump := clause.Result.(*JumpExpr); isJump || isComplexExpression(clause.Guard) || isComplexExpression(clause.Result) {
+			return false
+		}
+	}
+	calls := make(map[string]int)
+	countCallsExpr(match, calls)
+	return calls[name] == 0 // recursive functions would inline forever
+}
+
 // isComplexExpression checks if an expression is too complex to inline
 func isComplexExpression(expr Expression) bool {
 	switch e := expr.(type) {
@@ -1803,7 +1907,10 @@ func inlineFunctionsExpr(expr Expression, candidates map[string]*LambdaExpr, cal
 			// Only inline if:
 			// 1. Parameter count matches
 			// 2. Called at least once
-			if len(e.Args) == len(lambda.Params) && callCounts[e.Function] > 0 {
+			// 3. Arguments are variables or numbers, if the body is a match
+			//    (its guards may use the parameters many times)
+			if len(e.Args) == len(lambda.Params) && callCounts[e.Function] > 0 &&
+				(!isComplexExpression(lambda.Body) || simpleArguments(e.Args)) {
 				// Inline by substituting parameters with arguments (which may now be inlined)
 				inlinedBody := substituteParams(lambda.Body, lambda.Params, e.Args)
 				return inlinedBody
@@ -1867,6 +1974,18 @@ func inlineFunctionsExpr(expr Expression, candidates map[string]*LambdaExpr, cal
 	}
 }
 
+// simpleArguments reports whether all arguments are variables or numbers
+func simpleArguments(args []Expression) bool {
+	for _, arg := range args {
+		switch arg.(type) {
+		case *IdentExpr, *NumberExpr:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // deepCopyExpr creates a deep copy of an expression to avoid AST node sharing
 func deepCopyExpr(expr Expression) Expression {
 	switch e := expr.(type) {
@@ -1989,8 +2108,9 @@ func substituteParamsExpr(expr Expression, substMap map[string]Expression) Expre
 		newClauses := make([]*MatchClause, len(e.Clauses))
 		for i, clause := range e.Clauses {
 			newClause := &MatchClause{
-				Guard:  nil,
-				Result: substituteParamsExpr(clause.Result, substMap),
+				Guard:        nil,
+				Result:       substituteParamsExpr(clause.Result, substMap),
+				IsValueMatch: clause.IsValueMatch,
 			}
 			if clause.Guard != nil {
 				newClause.Guard = substituteParamsExpr(clause.Guard, substMap)
@@ -2002,9 +2122,11 @@ func substituteParamsExpr(expr Expression, substMap map[string]Expression) Expre
 			newDefault = substituteParamsExpr(e.DefaultExpr, substMap)
 		}
 		return &MatchExpr{
-			Condition:   substituteParamsExpr(e.Condition, substMap),
-			Clauses:     newClauses,
-			DefaultExpr: newDefault,
+			Condition:       substituteParamsExpr(e.Condition, substMap),
+			Clauses:         newClauses,
+			DefaultExpr:     newDefault,
+			DefaultExplicit: e.DefaultExplicit,
+			ProfileKey:      e.ProfileKey,
 		}
 	case *LambdaExpr:
 		// Don't substitute inside nested lambdas' parameters
@@ -2060,6 +2182,7 @@ func substituteParamsStmt(stmt Statement, substMap map[string]Expression) Statem
 			MaxIterations: s.MaxIterations,
 			NeedsMaxCheck: s.NeedsMaxCheck,
 			NumThreads:    s.NumThreads,
+			ProfileKey:    s.ProfileKey,
 		}
 	default:
 		return stmt
@@ -0,0 +1,717 @@
+// Completion: 85% - CSE and loop-invariant code motion over statement lists and sequential @ loops
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+)
+
+// optimizer_redundancy.go - Redundancy elimination
+//
+// Common subexpression elimination computes an expression that is evaluated
+// more than once in a statement list into a temporary before its first use,
+// and loop-invariant code motion computes the expressions of an @ loop that
+// are the same in every iteration into temporaries before the loop.
+//
+// Expressions are compared by value number: a key built from the structure of
+// the expression, in which every variable carries the number of assignments to
+// it that came before. Two expressions with the same key compute the same
+// value. Calls of impure functions may update any mutable variable and any
+// list or map, so they start new generations of those.
+//
+// Only expressions without side effects are moved: arithmetic, comparisons,
+// the math builtins, functions analyzePurity found pure, and reads of lists
+// and maps. Reads and calls of user functions are never moved to where they
+// would not have been evaluated, while arithmetic may be computed
+// speculatively, since it can not fail.
+
+// redundancyMinCost is the cost an expression must have before a temporary is
+// worth it. A single arithmetic operation is about as cheap as the load of a
+// temporary.
+const redundancyMinCost = 2
+
+// pureMathBuiltins are the builtins that only compute a number from their arguments
+var pureMathBuiltins = map[string]bool{
+	"sqrt": true, "sin": true, "cos": true, "tan": true,
+	"asin": true, "acos": true, "atan": true, "exp": true, "log": true,
+	"pow": true, "floor": true, "ceil": true, "round": true, "abs": true,
+}
+
+// redundancyOperators are the binary operators that can be value numbered
+var redundancyOperators = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true, "%": true,
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"and": true, "or": true,
+}
+
+type redundancyEliminator struct {
+	pure    map[string]bool // named functions, and whether analyzePurity found them pure
+	mutable map[string]bool // variables that are updated somewhere in the program
+	prefix  string          // keeps the temporaries of different files apart
+	temps   int
+}
+
+// eliminateRedundancy removes common subexpressions and hoists loop-invariant
+// expressions out of @ loops. source names the file the program was parsed
+// from, and goes into the names of the temporaries, so that they stay the same
+// between builds of the same file.
+func eliminateRedundancy(program *Program, pureFunctions map[string]bool, source string) {
+	h := fnv.New32a()
+	h.Write([]byte(source))
+	r := &redundancyEliminator{
+		pure:    pureFunctions,
+		mutable: make(map[string]bool),
+		prefix:  fmt.Sprintf("_t%08x_", h.Sum32()),
+	}
+	for _, stmt := range program.Statements {
+		collectMutableVariables(stmt, r.mutable)
+	}
+	program.Statements = r.optimizeList(program.Statements)
+}
+
+func (r *redundancyEliminator) newTemp() string {
+	name := r.prefix + strconv.Itoa(r.temps)
+	r.temps++
+	return name
+}
+
+func (r *redundancyEliminator) isTemp(name string) bool {
+	return len(name) > len(r.prefix) && name[:len(r.prefix)] == r.prefix
+}
+
+// collectMutableVariables finds the variables that may change after they are defined
+func collectMutableVariables(stmt Statement, mutable map[string]bool) {
+	switch s := stmt.(type) {
+	case *AssignStmt:
+		if s.Mutable || s.IsUpdate || s.IsReuseMutable {
+			mutable[s.Name] = true
+		}
+		collectMutableVariablesExpr(s.Value, mutable)
+	case *MultipleAssignStmt:
+		for _, name := range s.Names {
+			mutable[name] = true
+		}
+	case *MapUpdateStmt:
+		mutable[s.MapName] = true
+		collectMutableVariablesExpr(s.Value, mutable)
+	case *ExpressionStmt:
+		collectMutableVariablesExpr(s.Expr, mutable)
+	case *LoopStmt:
+		mutable[s.Iterator] = true
+		for _, st := range s.Body {
+			collectMutableVariables(st, mutable)
+		}
+	case *WhileStmt:
+		for _, st := range s.Body {
+			collectMutableVariables(st, mutable)
+		}
+	}
+}
+
+func collectMutableVariablesExpr(expr Expression, mutable map[string]bool) {
+	switch e := expr.(type) {
+	case *LambdaExpr:
+		collectMutableVariablesExpr(e.Body, mutable)
+	case *BlockExpr:
+		for _, st := range e.Statements {
+			collectMutableVariables(st, mutable)
+		}
+	case *MatchExpr:
+		for _, clause := range e.Clauses {
+			collectMutableVariablesExpr(clause.Result, mutable)
+		}
+		collectMutableVariablesExpr(e.DefaultExpr, mutable)
+	}
+}
+
+// ===== Value numbering =====
+
+// valueNumbers tracks what the variables hold at a point in a statement list
+type valueNumbers struct {
+	versions map[string]int  // number of assignments to each variable so far
+	world    int             // bumped when an impure call may have updated mutable variables
+	memory   int             // bumped when lists or maps may have been written to
+	unstable bool            // reading a statement with impure calls, where mutable state may change
+	variant  map[string]bool // variables that can not be used (they change in the loop being hoisted from)
+	writes   bool            // lists and maps can not be read
+}
+
+func newValueNumbers() *valueNumbers {
+	return &valueNumbers{versions: make(map[string]int), variant: make(map[string]bool)}
+}
+
+// valueKey is the value number of an expression
+type valueKey struct {
+	key         string
+	cost        int
+	speculative bool // can be evaluated where it was not going to be
+	fresh       bool // may create a new list, map or string, so that sharing the value could be observed
+}
+
+func (r *redundancyEliminator) isPureCall(call *CallExpr) bool {
+	if call.IsCFFI || r.mutable[call.Function] {
+		return false
+	}
+	if pure, known := r.pure[call.Function]; known {
+		return pure
+	}
+	return pureMathBuiltins[call.Function]
+}
+
+// key returns the value number of expr, or false if it can not have one
+func (r *redundancyEliminator) key(vn *valueNumbers, expr Expression) (valueKey, bool) {
+	switch e := expr.(type) {
+	case *NumberExpr:
+		return valueKey{key: strconv.FormatFloat(e.Value, 'g', -1, 64), speculative: true}, true
+	case *BooleanExpr:
+		return valueKey{key: strconv.FormatBool(e.Value), speculative: true}, true
+	case *StringExpr:
+		return valueKey{key: strconv.Quote(e.Value), speculative: true}, true
+	case *IdentExpr:
+		if vn.variant[e.Name] || (vn.unstable && r.mutable[e.Name]) {
+			return valueKey{}, false
+		}
+		key := e.Name + "@" + strconv.Itoa(vn.versions[e.Name])
+		if r.mutable[e.Name] {
+			key += "." + strconv.Itoa(vn.world)
+		}
+		return valueKey{key: key, speculative: true}, true
+	case *BinaryExpr:
+		if !redundancyOperators[e.Operator] {
+			return valueKey{}, false
+		}
+		left, ok := r.key(vn, e.Left)
+		if !ok {
+			return valueKey{}, false
+		}
+		right, ok := r.key(vn, e.Right)
+		if !ok {
+			return valueKey{}, false
+		}
+		return valueKey{
+			key:         "(" + left.key + " " + e.Operator + " " + right.key + ")",
+			cost:        1 + left.cost + right.cost,
+			speculative: left.speculative && right.speculative,
+			// + also concatenates strings and lists
+			fresh: e.Operator == "+" && !(isNumericKey(e.Left) && isNumericKey(e.Right)),
+		}, true
+	case *UnaryExpr:
+		if e.Operator != "-" && e.Operator != "not" {
+			return valueKey{}, false
+		}
+		operand, ok := r.key(vn, e.Operand)
+		if !ok {
+			return valueKey{}, false
+		}
+		return valueKey{key: "(" + e.Operator + " " + operand.key + ")", cost: 1 + operand.cost, speculative: operand.speculative}, true
+	case *FMAExpr:
+		a, okA := r.key(vn, e.A)
+		b, okB := r.key(vn, e.B)
+		c, okC := r.key(vn, e.C)
+		if !okA || !okB || !okC {
+			return valueKey{}, false
+		}
+		return valueKey{
+			key:         fmt.Sprintf("fma(%s, %s, %s, %t, %t)", a.key, b.key, c.key, e.IsSub, e.IsNegMul),
+			cost:        2 + a.cost + b.cost + c.cost,
+			speculative: a.speculative && b.speculative && c.speculative,
+		}, true
+	case *CallExpr:
+		if !r.isPureCall(e) {
+			return valueKey{}, false
+		}
+		builtin := pureMathBuiltins[e.Function]
+		k := valueKey{key: e.Function + "(", cost: 4, speculative: builtin, fresh: !builtin}
+		if !builtin {
+			k.cost = 8
+		}
+		for i, arg := range e.Args {
+			a, ok := r.key(vn, arg)
+			if !ok {
+				return valueKey{}, false
+			}
+			if i > 0 {
+				k.key += ", "
+			}
+			k.key += a.key
+			k.cost += a.cost
+			k.speculative = k.speculative && a.speculative
+		}
+		k.key += ")"
+		return k, true
+	case *IndexExpr:
+		list, isIdent := e.List.(*IdentExpr)
+		if !isIdent || vn.writes || vn.unstable {
+			return valueKey{}, false
+		}
+		l, ok := r.key(vn, list)
+		if !ok {
+			return valueKey{}, false
+		}
+		index, ok := r.key(vn, e.Index)
+		if !ok {
+			return valueKey{}, false
+		}
+		return valueKey{
+			key:  l.key + "[" + index.key + "]#" + strconv.Itoa(vn.memory),
+			cost: 4 + index.cost,
+		}, true
+	}
+	return valueKey{}, false
+}
+
+// isNumericKey reports whether an expression certainly evaluates to a number
+func isNumericKey(expr Expression) bool {
+	switch e := expr.(type) {
+	case *NumberExpr, *BooleanExpr, *UnaryExpr, *FMAExpr:
+		return true
+	case *BinaryExpr:
+		return e.Operator != "+" || (isNumericKey(e.Left) && isNumericKey(e.Right))
+	case *CallExpr:
+		return pureMathBuiltins[e.Function]
+	}
+	return false
+}
+
+// hasSideEffects is hasSideEffects with what analyzePurity found: calls of
+// pure functions only have the side effects of their arguments
+func (r *redundancyEliminator) hasSideEffects(expr Expression) bool {
+	return hasSideEffectsCalling(expr, r.isPureCall)
+}
+
+// ===== Statements =====
+
+// statementExprs returns the expressions a statement evaluates before it
+// takes effect, as pointers so that they can be replaced
+func statementExprs(stmt Statement) []*Expression {
+	switch s := stmt.(type) {
+	case *AssignStmt:
+		if _, isLambda := s.Value.(*LambdaExpr); isLambda {
+			return nil
+		}
+		return []*Expression{&s.Value}
+	case *MultipleAssignStmt:
+		return []*Expression{&s.Value}
+	case *ExpressionStmt:
+		return []*Expression{&s.Expr}
+	case *MapUpdateStmt:
+		return []*Expression{&s.Index, &s.Value}
+	case *LoopStmt:
+		if s.NumThreads != 0 {
+			return nil
+		}
+		return []*Expression{&s.Iterable}
+	case *JumpStmt:
+		if s.Value != nil {
+			return []*Expression{&s.Value}
+		}
+	}
+	return nil
+}
+
+// statementClobbers reports whether a statement, including the statements
+// nested in it, may change mutable state other than by assigning variables
+func (r *redundancyEliminator) statementClobbers(stmt Statement) bool {
+	switch s := stmt.(type) {
+	case *AssignStmt:
+		return r.hasSideEffects(s.Value)
+	case *MultipleAssignStmt:
+		return r.hasSideEffects(s.Value)
+	case *ExpressionStmt:
+		return r.hasSideEffects(s.Expr)
+	case *MapUpdateStmt:
+		return r.hasSideEffects(s.Index) || r.hasSideEffects(s.Value)
+	case *JumpStmt:
+		return r.hasSideEffects(s.Value)
+	case *LoopStmt:
+		if s.NumThreads != 0 || r.hasSideEffects(s.Iterable) {
+			return true
+		}
+		return r.listClobbers(s.Body)
+	case *WhileStmt:
+		return r.hasSideEffects(s.Condition) || r.listClobbers(s.Body)
+	}
+	return true
+}
+
+func (r *redundancyEliminator) listClobbers(stmts []Statement) bool {
+	for _, stmt := range stmts {
+		if r.statementClobbers(stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+// assignedVariables collects the variables a statement assigns, and reports
+// whether it writes to lists or maps
+func assignedVariables(stmt Statement, assigned map[string]bool) (writes bool) {
+	switch s := stmt.(type) {
+	case *AssignStmt:
+		assigned[s.Name] = true
+	case *MultipleAssignStmt:
+		for _, name := range s.Names {
+			assigned[name] = true
+		}
+	case *MapUpdateStmt:
+		return true
+	case *LoopStmt:
+		assigned[s.Iterator] = true
+		for _, st := range s.Body {
+			writes = assignedVariables(st, assigned) || writes
+		}
+	case *WhileStmt:
+		for _, st := range s.Body {
+			writes = assignedVariables(st, assigned) || writes
+		}
+	}
+	return writes
+}
+
+// apply records what a statement does to the variables
+func (r *redundancyEliminator) apply(vn *valueNumbers, stmt Statement) {
+	assigned := make(map[string]bool)
+	if assignedVariables(stmt, assigned) {
+		vn.memory++
+	}
+	for name := range assigned {
+		vn.versions[name]++
+	}
+	if r.statementClobbers(stmt) {
+		vn.world++
+		vn.memory++
+	}
+}
+
+// hasJump reports whether a statement may leave the statement list early
+func hasJump(stmt Statement) bool {
+	switch s := stmt.(type) {
+	case *JumpStmt:
+		return true
+	case *AssignStmt:
+		return exprHasJump(s.Value)
+	case *ExpressionStmt:
+		return exprHasJump(s.Expr)
+	case *MapUpdateStmt:
+		return exprHasJump(s.Index) || exprHasJump(s.Value)
+	case *LoopStmt, *WhileStmt:
+		return false // jumps in nested loops leave those loops
+	}
+	return true
+}
+
+func exprHasJump(expr Expression) bool {
+	switch e := expr.(type) {
+	case nil, *NumberExpr, *BooleanExpr, *StringExpr, *IdentExpr, *LambdaExpr:
+		return false
+	case *BinaryExpr:
+		return exprHasJump(e.Left) || exprHasJump(e.Right)
+	case *UnaryExpr:
+		return exprHasJump(e.Operand)
+	case *FMAExpr:
+		return exprHasJump(e.A) || exprHasJump(e.B) || exprHasJump(e.C)
+	case *IndexExpr:
+		return exprHasJump(e.List) || exprHasJump(e.Index)
+	case *CallExpr:
+		for _, arg := range e.Args {
+			if exprHasJump(arg) {
+				return true
+			}
+		}
+		return false
+	case *MatchExpr:
+		if exprHasJump(e.Condition) || exprHasJump(e.DefaultExpr) {
+			return true
+		}
+		for _, clause := range e.Clauses {
+			if exprHasJump(clause.Guard) || exprHasJump(clause.Result) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// rewrite offers the subexpressions of expr that can be moved to visit,
+// outermost first, and replaces them with what visit returns. Subexpressions
+// that are only evaluated under a condition are only offered if they can be
+// evaluated speculatively.
+func (r *redundancyEliminator) rewrite(vn *valueNumbers, expr Expression, conditional bool, visit func(Expression, valueKey) Expression) Expression {
+	if expr == nil {
+		return nil
+	}
+	if k, ok := r.key(vn, expr); ok && k.cost >= redundancyMinCost && !k.fresh && (k.speculative || !conditional) {
+		if replaced := visit(expr, k); replaced != expr {
+			return replaced
+		}
+	}
+	switch e := expr.(type) {
+	case *BinaryExpr:
+		e.Left = r.rewrite(vn, e.Left, conditional, visit)
+		e.Right = r.rewrite(vn, e.Right, conditional || e.Operator == "and" || e.Operator == "or", visit)
+	case *UnaryExpr:
+		e.Operand = r.rewrite(vn, e.Operand, conditional, visit)
+	case *FMAExpr:
+		e.A = r.rewrite(vn, e.A, conditional, visit)
+		e.B = r.rewrite(vn, e.B, conditional, visit)
+		e.C = r.rewrite(vn, e.C, conditional, visit)
+	case *CallExpr:
+		for i, arg := range e.Args {
+			e.Args[i] = r.rewrite(vn, arg, conditional, visit)
+		}
+	case *IndexExpr:
+		e.Index = r.rewrite(vn, e.Index, conditional, visit)
+	case *RangeExpr:
+		e.Start = r.rewrite(vn, e.Start, conditional, visit)
+		e.End = r.rewrite(vn, e.End, conditional, visit)
+	case *ListExpr:
+		for i, elem := range e.Elements {
+			e.Elements[i] = r.rewrite(vn, elem, conditional, visit)
+		}
+	case *MapExpr:
+		for i := range e.Keys {
+			e.Keys[i] = r.rewrite(vn, e.Keys[i], conditional, visit)
+			e.Values[i] = r.rewrite(vn, e.Values[i], conditional, visit)
+		}
+	case *MatchExpr:
+		e.Condition = r.rewrite(vn, e.Condition, conditional, visit)
+		for _, clause := range e.Clauses {
+			clause.Guard = r.rewrite(vn, clause.Guard, true, visit)
+			clause.Result = r.rewrite(vn, clause.Result, true, visit)
+		}
+		e.DefaultExpr = r.rewrite(vn, e.DefaultExpr, true, visit)
+	}
+	return expr
+}
+
+// rewriteStatement applies rewrite to the expressions a statement evaluates
+func (r *redundancyEliminator) rewriteStatement(vn *valueNumbers, stmt Statement, conditional bool, visit func(Expression, valueKey) Expression) {
+	vn.unstable = r.statementClobbers(stmt)
+	for _, slot := range statementExprs(stmt) {
+		*slot = r.rewrite(vn, *slot, conditional, visit)
+	}
+	vn.unstable = false
+}
+
+// ===== Passes =====
+
+// optimizeList optimizes a statement list and the statement lists nested in it
+func (r *redundancyEliminator) optimizeList(stmts []Statement) []Statement {
+	result := make([]Statement, 0, len(stmts))
+	for _, stmt := range stmts {
+		r.optimizeNested(stmt)
+		switch s := stmt.(type) {
+		case *LoopStmt:
+			if s.NumThreads == 0 {
+				result = append(result, r.hoist(s.Body, s.Iterator, loopRunsOnce(s), func(body []Statement) { s.Body = body })...)
+			}
+		case *WhileStmt:
+			if s.NumThreads == 0 {
+				result = append(result, r.hoistWhileCondition(s)...)
+				result = append(result, r.hoist(s.Body, "", false, func(body []Statement) { s.Body = body })...)
+			}
+		}
+		result = append(result, stmt)
+	}
+	return r.eliminateCommon(result)
+}
+
+// optimizeNested optimizes the loop bodies and blocks in a statement
+func (r *redundancyEliminator) optimizeNested(stmt Statement) {
+	switch s := stmt.(type) {
+	case *LoopStmt:
+		if s.NumThreads == 0 {
+			s.Body = r.optimizeList(s.Body)
+		}
+	case *WhileStmt:
+		if s.NumThreads == 0 {
+			s.Body = r.optimizeList(s.Body)
+		}
+		r.optimizeBlocks(s.Condition)
+	case *AssignStmt:
+		r.optimizeBlocks(s.Value)
+	case *ExpressionStmt:
+		r.optimizeBlocks(s.Expr)
+	case *MapUpdateStmt:
+		r.optimizeBlocks(s.Value)
+	}
+}
+
+// optimizeBlocks optimizes the statement lists of the blocks in an expression,
+// such as the bodies of functions
+func (r *redundancyEliminator) optimizeBlocks(expr Expression) {
+	switch e := expr.(type) {
+	case *BlockExpr:
+		e.Statements = r.optimizeList(e.Statements)
+	case *LambdaExpr:
+		r.optimizeBlocks(e.Body)
+	case *BinaryExpr:
+		r.optimizeBlocks(e.Left)
+		r.optimizeBlocks(e.Right)
+	case *UnaryExpr:
+		r.optimizeBlocks(e.Operand)
+	case *CallExpr:
+		for _, arg := range e.Args {
+			r.optimizeBlocks(arg)
+		}
+	case *ListExpr:
+		for _, elem := range e.Elements {
+			r.optimizeBlocks(elem)
+		}
+	case *MatchExpr:
+		r.optimizeBlocks(e.Condition)
+		for _, clause := range e.Clauses {
+			r.optimizeBlocks(clause.Guard)
+			r.optimizeBlocks(clause.Result)
+		}
+		r.optimizeBlocks(e.DefaultExpr)
+	}
+}
+
+// loopRunsOnce reports whether a loop is known to run its body at least once
+func loopRunsOnce(s *LoopStmt) bool {
+	rng, ok := s.Iterable.(*RangeExpr)
+	if !ok {
+		return false
+	}
+	start, okStart := rng.Start.(*NumberExpr)
+	end, okEnd := rng.End.(*NumberExpr)
+	if !okStart || !okEnd {
+		return false
+	}
+	if rng.Inclusive {
+		return start.Value <= end.Value
+	}
+	return start.Value < end.Value
+}
+
+// loopValueNumbers returns value numbers under which only the expressions
+// that stay the same in every iteration of a loop body have keys
+func (r *redundancyEliminator) loopValueNumbers(body []Statement, iterator string) *valueNumbers {
+	vn := newValueNumbers()
+	for _, stmt := range body {
+		vn.writes = assignedVariables(stmt, vn.variant) || vn.writes
+	}
+	if iterator != "" {
+		vn.variant[iterator] = true
+	}
+	if r.listClobbers(body) {
+		vn.writes = true
+		for name := range r.mutable {
+			vn.variant[name] = true
+		}
+	}
+	return vn
+}
+
+// hoist moves the loop-invariant expressions of a loop body into
+// temporaries, and returns the assignments of those, which go before the loop
+func (r *redundancyEliminator) hoist(body []Statement, iterator string, runsOnce bool, setBody func([]Statement)) []Statement {
+	vn := r.loopValueNumbers(body, iterator)
+	var hoisted []Statement
+	temps := make(map[string]string)
+	visit := func(expr Expression, k valueKey) Expression {
+		temp, seen := temps[k.key]
+		if !seen {
+			temp = r.newTemp()
+			temps[k.key] = temp
+			hoisted = append(hoisted, &AssignStmt{Name: temp, Value: expr})
+		}
+		return &IdentExpr{Name: temp}
+	}
+
+	conditional := !runsOnce
+	kept := make([]Statement, 0, len(body))
+	for _, stmt := range body {
+		// Temporaries from nested loops or common subexpressions move as a whole
+		if assign, ok := stmt.(*AssignStmt); ok && r.isTemp(assign.Name) {
+			if k, ok := r.key(vn, assign.Value); ok && (k.speculative || !conditional) {
+				hoisted = append(hoisted, assign)
+				delete(vn.variant, assign.Name)
+				continue
+			}
+		}
+		r.rewriteStatement(vn, stmt, conditional, visit)
+		if hasJump(stmt) {
+			conditional = true
+		}
+		kept = append(kept, stmt)
+	}
+	setBody(kept)
+	return hoisted
+}
+
+// hoistWhileCondition moves the loop-invariant parts of the condition of a
+// while loop before it. The condition is evaluated at least once.
+func (r *redundancyEliminator) hoistWhileCondition(s *WhileStmt) []Statement {
+	vn := r.loopValueNumbers(s.Body, "")
+	if r.hasSideEffects(s.Condition) {
+		return nil
+	}
+	var hoisted []Statement
+	s.Condition = r.rewrite(vn, s.Condition, false, func(expr Expression, k valueKey) Expression {
+		temp := r.newTemp()
+		hoisted = append(hoisted, &AssignStmt{Name: temp, Value: expr})
+		return &IdentExpr{Name: temp}
+	})
+	return hoisted
+}
+
+// commonUse is an expression that is computed more than once
+type commonUse struct {
+	count int
+	first int // index of the statement where it is first computed
+	cost  int
+	expr  Expression
+}
+
+// eliminateCommon computes the expressions that are evaluated more than once
+// in a statement list into temporaries, the most expensive ones first
+func (r *redundancyEliminator) eliminateCommon(stmts []Statement) []Statement {
+	for {
+		uses := make(map[string]*commonUse)
+		vn := newValueNumbers()
+		for i, stmt := range stmts {
+			r.rewriteStatement(vn, stmt, false, func(expr Expression, k valueKey) Expression {
+				use := uses[k.key]
+				if use == nil {
+					use = &commonUse{first: i, cost: k.cost, expr: expr}
+					uses[k.key] = use
+				}
+				use.count++
+				return expr
+			})
+			r.apply(vn, stmt)
+		}
+
+		var best string
+		for key, use := range uses {
+			if use.count < 2 {
+				continue
+			}
+			if b := uses[best]; b == nil || use.cost > b.cost ||
+				(use.cost == b.cost && (use.first < b.first || (use.first == b.first && key < best))) {
+				best = key
+			}
+		}
+		if best == "" {
+			return stmts
+		}
+
+		use := uses[best]
+		temp := r.newTemp()
+		vn = newValueNumbers()
+		for _, stmt := range stmts {
+			r.rewriteStatement(vn, stmt, false, func(expr Expression, k valueKey) Expression {
+				if k.key == best {
+					return &IdentExpr{Name: temp}
+				}
+				return expr
+			})
+			r.apply(vn, stmt)
+		}
+		stmts = append(stmts[:use.first], append([]Statement{&AssignStmt{Name: temp, Value: use.expr}}, stmts[use.first:]...)...)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// redundancyStatements parses code and returns the top level statements as strings
+func redundancyStatements(t *testing.T, code string) []string {
+	t.Helper()
+	program := NewParser(code).ParseProgram()
+	var out []string
+	for _, stmt := range program.Statements {
+		out = append(out, stmt.String())
+	}
+	return out
+}
+
+// findLoop returns the index of the first loop in stmts
+func findLoop(t *testing.T, stmts []string) int {
+	t.Helper()
+	for i, s := range stmts {
+		if strings.HasPrefix(s, "@") {
+			return i
+		}
+	}
+	t.Fatalf("no loop in %q", stmts)
+	return -1
+}
+
+func TestLoopInvariantHoisting(t *testing.T) {
+	stmts := redundancyStatements(t, `
+dx := 3.0
+dy := 4.0
+total := 0.0
+@ i in 0..<5 {
+    total <- total + sqrt(dx*dx + dy*dy) + i
+}
+println(total)
+`)
+	loop := findLoop(t, stmts)
+	if strings.Contains(stmts[loop], "sqrt") {
+		t.Errorf("sqrt was not hoisted out of the loop:\n%s", stmts[loop])
+	}
+	if !strings.Contains(stmts[loop-1], "sqrt") {
+		t.Errorf("expected the hoisted sqrt right before the loop, got %q", stmts[loop-1])
+	}
+}
+
+func TestLoopInvariantNotHoisted(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		keep string
+	}{
+		{
+			name: "depends on the iterator",
+			code: `
+x := 2.0
+s := 0.0
+@ i in 0..<4 {
+    s <- s + sqrt(x * i)
+}
+println(s)
+`,
+			keep: "sqrt",
+		},
+		{
+			name: "depends on a variable updated in the loop",
+			code: `
+x := 2.0
+@ i in 0..<4 {
+    x <- x + sqrt(x * x)
+}
+println(x)
+`,
+			keep: "sqrt",
+		},
+		{
+			name: "map read after a map update",
+			code: `
+m := {1: 10}
+s := 0
+@ i in 0..<3 {
+    s <- s + m[1] * 2
+    m[1] <- m[1] + 1
+}
+println(s)
+`,
+			keep: "m[1]",
+		},
+		{
+			name: "loop with impure calls",
+			code: `
+x := 2.0
+@ i in 0..<3 {
+    println(x * x + 1)
+}
+`,
+			keep: "x * x",
+		},
+		{
+			name: "map read next to a vector of impure calls",
+			code: `
+m := {1: 10}
+s := 0
+@ i in 0..<3 {
+    s <- s + m[1] * 2
+    v = vec2(println(i), 0)
+}
+println(s)
+`,
+			keep: "m[1]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmts := redundancyStatements(t, tt.code)
+			loop := findLoop(t, stmts)
+			if !strings.Contains(stmts[loop], tt.keep) {
+				t.Errorf("%q was moved out of the loop:\n%s", tt.keep, strings.Join(stmts, "\n"))
+			}
+		})
+	}
+}
+
+// unknownExpr is an expression the optimizer has no case for
+type unknownExpr struct{}
+
+func (u *unknownExpr) String() string  { return "unknown" }
+func (u *unknownExpr) expressionNode() {}
+
+func TestHasSideEffects(t *testing.T) {
+	call := &CallExpr{Function: "println", Args: []Expression{&NumberExpr{Value: 1}}}
+	x := &IdentExpr{Name: "x"}
+	tests := []struct {
+		name string
+		expr Expression
+		want bool
+	}{
+		{"pure vector", &VectorExpr{Components: []Expression{x, x}, Size: 2}, false},
+		{"vector of a call", &VectorExpr{Components: []Expression{x, call}, Size: 2}, true},
+		{"composition", &ComposeExpr{Left: x, Right: x}, false},
+		{"composition of a call", &ComposeExpr{Left: call, Right: x}, true},
+		{"register", &RegisterExpr{Name: "rax"}, true},
+		{"loop state", &LoopStateExpr{Type: "counter"}, true},
+		{"unknown", &unknownExpr{}, true},
+	}
+	for _, tt := range tests {
+		if got := hasSideEffects(tt.expr); got != tt.want {
+			t.Errorf("%s: hasSideEffects(%s) = %v, want %v", tt.name, tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCommonSubexpressionElimination(t *testing.T) {
+	stmts := redundancyStatements(t, `
+x := 3.0
+y := 4.0
+a = sqrt(x * x + y * y)
+b = sqrt(x * x + y * y) * 2
+println(a + b)
+`)
+	count := 0
+	for _, s := range stmts {
+		count += strings.Count(s, "sqrt")
+	}
+	if count != 1 {
+		t.Errorf("expected sqrt to be computed once, found %d:\n%s", count, strings.Join(stmts, "\n"))
+	}
+}
+
+func TestCommonSubexpressionAfterUpdate(t *testing.T) {
+	stmts := redundancyStatements(t, `
+x := 3.0
+a = sqrt(x * x + 1)
+x <- 5.0
+b = sqrt(x * x + 1)
+println(a + b)
+`)
+	count := 0
+	for _, s := range stmts {
+		count += strings.Count(s, "sqrt")
+	}
+	if count != 2 {
+		t.Errorf("sqrt was shared across an update of x:\n%s", strings.Join(stmts, "\n"))
+	}
+}
+
+func TestRedundancyEliminationPrograms(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{
+			name: "hoisted distance",
+			code: `
+dx := 3.0
+dy := 4.0
+total := 0.0
+@ i in 0..<5 {
+    total <- total + sqrt(dx*dx + dy*dy) + i
+}
+println(total)
+`,
+			want: "35",
+		},
+		{
+			name: "shared subexpression",
+			code: `
+x := 3.0
+y := 4.0
+a = x * y + 1
+b = x * y + 1
+println(a + b)
+`,
+			want: "26",
+		},
+		{
+			name: "update between uses",
+			code: `
+x := 3.0
+a = x * x + 1
+x <- 5.0
+b = x * x + 1
+println(a + b)
+`,
+			want: "36",
+		},
+		{
+			name: "invariant in loop body definition",
+			code: `
+k := 3.0
+s := 0.0
+@ i in 0..<3 {
+    d = k * k
+    s <- s + d - i
+}
+println(s)
+`,
+			want: "24",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := compileAndRun(t, tt.code)
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("expected %q in output, got %q", tt.want, got)
+			}
+		})
+	}
+}
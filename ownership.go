@@ -0,0 +1,324 @@
+// Completion: 75% - In-place list appends for bindings that own their list (x86-64)
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// List ownership
+//
+// append(xs, v) copies xs into a new list, so a loop that accumulates with
+// xs = append(xs, v) is quadratic. When the old value of xs cannot be seen
+// by anything but xs itself, the append may extend the list in place instead.
+// That is the case for xs = append(xs, v) and xs <- append(xs, v) when xs is
+// defined in the same function, is not a parameter, is not used by a nested
+// function, and is otherwise only indexed, measured with #, searched with in,
+// printed, or returned as the function's result.
+//
+// Such an append calls _vibe67_list_push(rdi = &binding, xmm0 = value). The
+// first push to a binding copies the list into a buffer with spare capacity,
+// stored in the word before the list, and records in a hash table (see
+// maps_runtime.go) that the binding owns that buffer. Later pushes to the
+// same binding find the buffer in the table and append in place, doubling
+// the capacity when it runs out, so n appends cost O(n) in total.
+//
+// Every other assignment to a binding that has pushes drops the ownership,
+// so a binding whose slot is reused by a later call never appends in place to
+// a list it did not create.
+
+// ListOwnership records the appends that extend a list in place
+type ListOwnership struct {
+	pushes   map[*AssignStmt]bool
+	releases map[*AssignStmt]bool
+}
+
+// ownershipScope is a function body, or the top level
+type ownershipScope struct {
+	parent *ownershipScope
+	params map[string]bool
+	names  map[string]*ownedName
+}
+
+// ownedName is what a scope does with one name
+type ownedName struct {
+	appends []*AssignStmt // xs = append(xs, v) and xs <- append(xs, v)
+	assigns []*AssignStmt // every other assignment
+	defined bool          // assigned before its first append
+	other   bool          // used in a way that can keep the list
+	nested  bool          // used by a nested function
+}
+
+// newListOwnership finds the appends that may extend a list in place
+func newListOwnership(program *Program) *ListOwnership {
+	lo := &ListOwnership{
+		pushes:   make(map[*AssignStmt]bool),
+		releases: make(map[*AssignStmt]bool),
+	}
+	top := &ownershipScope{params: map[string]bool{}, names: map[string]*ownedName{}}
+	scopes := []*ownershipScope{top}
+	scopeIDs := map[string]*ownershipScope{"": top}
+	allowed := make(map[*IdentExpr]bool)
+
+	walkProfileSites(reflect.ValueOf(program), "", func(node interface{}, id string) string {
+		scope := scopeIDs[id]
+		switch n := node.(type) {
+		case *LambdaExpr:
+			inner := &ownershipScope{parent: scope, params: map[string]bool{}, names: map[string]*ownedName{}}
+			for _, param := range n.Params {
+				inner.params[param] = true
+			}
+			if n.VariadicParam != "" {
+				inner.params[n.VariadicParam] = true
+			}
+			if result := blockResult(n.Body); result != nil {
+				allowed[result] = true
+			}
+			id = fmt.Sprintf("%p", n)
+			scopeIDs[id] = inner
+			scopes = append(scopes, inner)
+		case *PatternLambdaExpr, *MultiLambdaExpr:
+			// Their parameters are not modeled, so nothing in them is owned
+			inner := &ownershipScope{parent: scope, params: map[string]bool{}, names: map[string]*ownedName{}}
+			id = fmt.Sprintf("%p", n)
+			scopeIDs[id] = inner
+		case *AssignStmt:
+			name := scope.name(n.Name)
+			if list := selfAppend(n); list != nil {
+				allowed[list] = true
+				name.appends = append(name.appends, n)
+			} else {
+				name.defined = name.defined || len(name.appends) == 0
+				name.assigns = append(name.assigns, n)
+			}
+		case *IndexExpr:
+			allowIdent(allowed, n.List)
+		case *LengthExpr:
+			allowIdent(allowed, n.Operand)
+		case *UnaryExpr:
+			if n.Operator == "#" {
+				allowIdent(allowed, n.Operand)
+			}
+		case *InExpr:
+			allowIdent(allowed, n.Container)
+		case *CallExpr:
+			if escapeReadBuiltins[n.Function] {
+				for _, arg := range n.Args {
+					allowIdent(allowed, arg)
+				}
+			}
+		case *IdentExpr:
+			if !allowed[n] {
+				scope.name(n.Name).other = true
+			}
+			for outer := scope.parent; outer != nil; outer = outer.parent {
+				outer.name(n.Name).nested = true
+			}
+		}
+		return id
+	})
+
+	pushed := make(map[string]bool)
+	for _, scope := range scopes {
+		for name, use := range scope.names {
+			if !use.defined || use.other || use.nested || scope.params[name] {
+				continue
+			}
+			for _, s := range use.appends {
+				lo.pushes[s] = true
+				pushed[name] = true
+			}
+		}
+	}
+
+	// Releasing a binding that never had a push only costs a lookup, so
+	// assignments are matched by name
+	for _, scope := range scopes {
+		for name, use := range scope.names {
+			if pushed[name] {
+				for _, s := range use.assigns {
+					if _, isLambda := s.Value.(*LambdaExpr); !isLambda {
+						lo.releases[s] = true
+					}
+				}
+			}
+		}
+	}
+	return lo
+}
+
+func (s *ownershipScope) name(name string) *ownedName {
+	use := s.names[name]
+	if use == nil {
+		use = &ownedName{}
+		s.names[name] = use
+	}
+	return use
+}
+
+// selfAppend returns xs for xs = append(xs, v), or nil
+func selfAppend(s *AssignStmt) *IdentExpr {
+	call, ok := s.Value.(*CallExpr)
+	if !ok || call.Function != "append" || len(call.Args) != 2 {
+		return nil
+	}
+	list, ok := call.Args[0].(*IdentExpr)
+	if !ok || list.Name != s.Name {
+		return nil
+	}
+	return list
+}
+
+// blockResult returns the variable a function body ends with, or nil
+func blockResult(body Expression) *IdentExpr {
+	if block, ok := body.(*BlockExpr); ok && len(block.Statements) > 0 {
+		if stmt, ok := block.Statements[len(block.Statements)-1].(*ExpressionStmt); ok {
+			body = stmt.Expr
+		}
+	}
+	ident, _ := body.(*IdentExpr)
+	return ident
+}
+
+func allowIdent(allowed map[*IdentExpr]bool, expr Expression) {
+	if ident, ok := expr.(*IdentExpr); ok {
+		allowed[ident] = true
+	}
+}
+
+// Used reports whether any assignment pushes or releases
+func (lo *ListOwnership) Used() bool {
+	return lo != nil && (len(lo.pushes) > 0 || len(lo.releases) > 0)
+}
+
+// Push reports whether an assignment appends in place
+func (lo *ListOwnership) Push(s *AssignStmt) bool {
+	return lo != nil && lo.pushes[s]
+}
+
+// Releases reports whether an assignment drops the ownership of its binding
+func (lo *ListOwnership) Releases(s *AssignStmt) bool {
+	return lo != nil && lo.releases[s]
+}
+
+// compileListPush compiles xs = append(xs, v) as a push to the binding at
+// base-offset, or to the global when base is empty
+func (fc *C67Compiler) compileListPush(s *AssignStmt, base string, offset int) {
+	call := s.Value.(*CallExpr)
+	fc.compileExpression(call.Args[0])
+	fc.listBindingAddress("rax", s.Name, base, offset)
+	fc.out.MovXmmToMem("xmm0", "rax", 0)
+	fc.compileExpression(call.Args[1])
+	fc.listBindingAddress("rdi", s.Name, base, offset)
+	fc.trackFunctionCall("_vibe67_list_push")
+	fc.out.CallSymbol("_vibe67_list_push")
+	fc.listBindingAddress("rax", s.Name, base, offset)
+	fc.out.MovMemToXmm("xmm0", "rax", 0)
+}
+
+// releaseListBinding drops the ownership of a binding after an assignment to
+// it, keeping the assigned value in xmm0
+func (fc *C67Compiler) releaseListBinding(name, base string, offset int) {
+	fc.out.LeaSymbolToReg("rdi", "_vibe67_list_owners")
+	fc.out.MovMemToReg("rdi", "rdi", 0)
+	fc.listBindingAddress("rsi", name, base, offset)
+	fc.trackFunctionCall("_vibe67_map_delete")
+	fc.out.CallSymbol("_vibe67_map_delete")
+	fc.listBindingAddress("rax", name, base, offset)
+	fc.out.MovMemToXmm("xmm0", "rax", 0)
+}
+
+func (fc *C67Compiler) listBindingAddress(reg, name, base string, offset int) {
+	if base == "" {
+		fc.out.LeaSymbolToReg(reg, "_global_"+name)
+	} else {
+		fc.out.LeaMemToReg(reg, base, -offset)
+	}
+}
+
+// generateListPush emits _vibe67_list_push(rdi = &binding, xmm0 = value)
+func (fc *C67Compiler) generateListPush() {
+	fc.eb.MarkLabel("_vibe67_list_push")
+	saved := []string{"rbx", "r12", "r13", "r14", "r15", "rbp"}
+	for _, reg := range saved {
+		fc.out.PushReg(reg)
+	}
+	fc.out.MovRegToReg("rbp", "rsp")
+	fc.out.AndRegWithImm("rsp", -16)    // malloc on Windows
+	fc.out.MovRegToReg("rbx", "rdi")    // rbx = &binding
+	fc.out.MovqXmmToReg("r12", "xmm0")  // r12 = value
+	fc.out.MovMemToReg("r13", "rbx", 0) // r13 = list
+
+	// In place if the binding owns the list and it has room
+	fc.out.LeaSymbolToReg("rdi", "_vibe67_list_owners")
+	fc.out.MovMemToReg("rdi", "rdi", 0)
+	fc.out.MovRegToReg("rsi", "rbx")
+	fc.trackFunctionCall("_vibe67_map_find")
+	fc.out.CallSymbol("_vibe67_map_find")
+	fc.out.TestRegReg("rax", "rax")
+	notOwned := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToReg("rax", "rax", 0)
+	fc.out.CmpRegToReg("rax", "r13")
+	otherList := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpNotEqual, 0)
+	fc.out.MovMemToXmm("xmm1", "r13", 0)
+	fc.out.Cvttsd2si("rcx", "xmm1") // rcx = count
+	fc.out.MovMemToReg("rax", "r13", -8)
+	fc.out.CmpRegToReg("rcx", "rax")
+	full := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpGreaterOrEqual, 0)
+
+	// Store [count][value] after the last entry and bump the count
+	store := fc.eb.text.Len()
+	fc.out.MovRegToReg("rdx", "rcx")
+	fc.out.ShlImmReg("rdx", 4)
+	fc.out.AddRegToReg("rdx", "r13")
+	fc.out.MovRegToMem("rcx", "rdx", 8) // keys are integer indexes, as in list literals
+	fc.out.MovRegToMem("r12", "rdx", 16)
+	fc.out.IncReg("rcx")
+	fc.out.Cvtsi2sd("xmm1", "rcx")
+	fc.out.MovXmmToMem("xmm1", "r13", 0)
+	fc.out.MovRegToReg("rsp", "rbp")
+	for i := len(saved) - 1; i >= 0; i-- {
+		fc.out.PopReg(saved[i])
+	}
+	fc.out.Ret()
+
+	// Copy the list into a buffer of twice its length, at least 8 entries:
+	// [capacity][count][key][value]...
+	fc.patchJumpOffset(notOwned+2, fc.eb.text.Len())
+	fc.patchJumpOffset(otherList+2, fc.eb.text.Len())
+	fc.patchJumpOffset(full+2, fc.eb.text.Len())
+	fc.out.MovMemToXmm("xmm1", "r13", 0)
+	fc.out.Cvttsd2si("r14", "xmm1") // r14 = count
+	fc.out.LeaMemToReg("r15", "r14", 0)
+	fc.out.AddRegToReg("r15", "r14") // r15 = capacity
+	fc.out.MovImmToReg("rax", "8")
+	fc.out.CmpRegToReg("r15", "rax")
+	fc.out.Cmovb("r15", "rax")
+	fc.out.MovRegToReg("rsi", "r15")
+	fc.out.ShlImmReg("rsi", 4)
+	fc.out.AddImmToReg("rsi", 16)
+	fc.allocateMemoryPlatform("rsi")
+	fc.out.MovRegToMem("r15", "rax", 0)
+	fc.out.LeaMemToReg("rdi", "rax", 8)
+	fc.out.MovRegToReg("rdx", "rdi") // rdx = new list
+	fc.out.MovRegToReg("rsi", "r13")
+	fc.out.MovRegToReg("rcx", "r14")
+	fc.out.ShlImmReg("rcx", 4)
+	fc.out.AddImmToReg("rcx", 8)
+	fc.out.RepMovsb()
+	fc.out.MovRegToReg("r13", "rdx")
+	fc.out.MovRegToMem("r13", "rbx", 0)
+
+	// The binding owns the new buffer
+	fc.out.LeaSymbolToReg("rdi", "_vibe67_list_owners")
+	fc.out.MovRegToReg("rsi", "rbx")
+	fc.out.MovqRegToXmm("xmm0", "r13")
+	fc.trackFunctionCall("_vibe67_map_set")
+	fc.out.CallSymbol("_vibe67_map_set")
+	fc.out.MovRegToReg("rcx", "r14")
+	back := fc.eb.text.Len()
+	fc.out.JumpUnconditional(int32(store - (back + 5)))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// inPlaceAppends returns the names assigned by the appends that extend their
+// list in place, in source order
+func inPlaceAppends(code string) []string {
+	program := NewParser(code).ParseProgram()
+	lo := newListOwnership(program)
+	var names []string
+	walkProfileSites(reflect.ValueOf(program), "", func(node interface{}, id string) string {
+		if s, ok := node.(*AssignStmt); ok && lo.Push(s) {
+			names = append(names, s.Name)
+		}
+		return id
+	})
+	return names
+}
+
+func TestListOwnership(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want []string
+	}{
+		{"accumulator", `xs = []
+@ i in 0..<10 {
+    xs = append(xs, i)
+}
+println(#xs)`, []string{"xs"}},
+		{"mutable accumulator", `xs := []
+@ i in 0..<10 {
+    xs <- append(xs, i)
+}
+println(xs[0])`, []string{"xs"}},
+		{"returned", `f = n -> {
+    acc = []
+    @ i in 0..<n max 100 {
+        acc = append(acc, i)
+    }
+    acc
+}`, []string{"acc"}},
+		{"aliased", `xs = [1, 2]
+keep = xs
+xs = append(xs, 3)`, nil},
+		{"mutable aliased", `xs := [1, 2]
+keep = xs
+xs <- append(xs, 3)`, nil},
+		{"stored", `xs = [1]
+xs = append(xs, 2)
+m = {1: xs}`, nil},
+		{"parameter", `f = xs -> {
+    xs = append(xs, 1)
+    #xs
+}`, nil},
+		{"captured", `xs = [1]
+xs = append(xs, 2)
+f = () -> #xs`, nil},
+		{"not defined first", `f = () -> {
+    ys = append(ys, 1)
+    #ys
+}`, nil},
+		{"other list", `xs = [1]
+ys = append(xs, 2)`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inPlaceAppends(tt.code); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("in-place appends = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInPlaceAppends(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("in-place appends are only emitted by the x86-64 backend")
+	}
+	code := `xs := []
+@ i in 0..<100 {
+    xs <- append(xs, i * 2)
+}
+ys = [5]
+@ i in 0..<50 {
+    ys = append(ys, i)
+}
+zs = [1, 2]
+keep = zs
+zs = append(zs, 3)
+build = n -> {
+    acc = []
+    @ i in 0..<n max 1000 {
+        acc = append(acc, i)
+    }
+    printf("%v %v\n", #acc, acc[n - 1])
+    0
+}
+build(40)
+build(3)
+printf("%v %v\n", #xs, xs[99])
+printf("%v %v %v\n", #ys, ys[0], ys[50])
+printf("%v %v\n", #zs, #keep)
+`
+	want := "40.000000 39.000000\n3.000000 2.000000\n100.000000 198.000000\n" +
+		"51.000000 5.000000 49.000000\n3.000000 2.000000\n"
+	if got := compileAndRun(t, code); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// Top-level lists leave the second pass with other stack offsets than the
+// first, and the main frame has to cover the slots of the loop below. The
+// lambda keeps compileAndRun from wrapping the program in main.
+func TestTopLevelLoopFrame(t *testing.T) {
+	code := `a := [1]
+b := [2]
+c := [3]
+d := [4]
+e := [5]
+outer := [0]
+show = (i, t) -> printf("i=%v t0=%v\n", i, t[0])
+@ i in 0..<3 {
+    t := [i + 1, i]
+    show(i, t)
+    outer <- t
+}
+printf("%v %v\n", outer[0], a[0] + b[0] + c[0] + d[0] + e[0])
+`
+	want := "i=0.000000 t0=1.000000\ni=1.000000 t0=2.000000\n" +
+		"i=2.000000 t0=3.000000\n3.000000 15.000000\n"
+	if got := compileAndRun(t, code); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
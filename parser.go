@@ -383,7 +383,7 @@ func (p *Parser) ParseProgram() *Program {
 	// after processing deferred statements (see lines 2658-2669 in compileStatement)
 
 	// Apply optimizations
-	program = optimizeProgram(program)
+	program = optimizeProgram(program, p.filename)
 
 	return program
 }
@@ -399,6 +399,7 @@ func (p *Parser) parseImport() Statement {
 	// - import "github.com/user/repo@v1.0.0" as repo         (git with version)
 	// - import "." as local                                  (directory)
 	// - import "/path/to/lib.so" as lib                      (library file)
+	// - import "/path/to/libfoo.a" as foo                    (archive, linked in)
 
 	var source string
 	var isLibraryFile bool
@@ -406,8 +407,9 @@ func (p *Parser) parseImport() Statement {
 	if p.current.Type == TOKEN_STRING {
 		source = p.current.Value
 
-		// Check if it's a library file (.so, .dll, .dylib)
+		// Check if it's a library file (.so, .dll, .dylib, or a .a archive to link in)
 		isLibraryFile = strings.HasSuffix(source, ".so") ||
+			strings.HasSuffix(source, ".a") ||
 			strings.Contains(source, ".so.") ||
 			strings.HasSuffix(source, ".dll") ||
 			strings.HasSuffix(source, ".dylib")
@@ -540,6 +542,40 @@ func (p *Parser) parseDeferStmt() *DeferStmt {
 	return &DeferStmt{Call: expr}
 }
 
+func (p *Parser) parseLockStmt() *LockStmt {
+	p.nextToken() // skip 'lock'
+
+	// Parse the mutex expression (typically an identifier)
+	mutex := p.parseExpression()
+	if mutex == nil {
+		p.error("expected mutex expression after 'lock'")
+	}
+	p.nextToken() // move past mutex expression
+	p.skipNewlines()
+
+	if p.current.Type != TOKEN_LBRACE {
+		p.error("expected '{' after lock expression")
+	}
+	p.nextToken() // skip '{'
+	p.skipNewlines()
+
+	var body []Statement
+	for p.current.Type != TOKEN_RBRACE && p.current.Type != TOKEN_EOF {
+		stmt := p.parseStatement()
+		if stmt != nil {
+			body = append(body, stmt)
+		}
+		p.nextToken()
+		p.skipNewlines()
+	}
+
+	if p.current.Type != TOKEN_RBRACE {
+		p.error("expected '}' at end of lock block")
+	}
+
+	return &LockStmt{Mutex: mutex, Body: body}
+}
+
 func (p *Parser) parseSpawnStmt() *SpawnStmt {
 	p.nextToken() // skip 'spawn'
 
@@ -631,7 +667,7 @@ func (p *Parser) parseAliasStmt() *AliasStmt {
 	// Validate that target is a valid keyword or operator
 	validTargets := map[TokenType]bool{
 		TOKEN_AT: true, TOKEN_IN: true, TOKEN_RET: true, TOKEN_ERR: true,
-		TOKEN_UNSAFE: true, TOKEN_ARENA: true, TOKEN_DEFER: true,
+		TOKEN_UNSAFE: true, TOKEN_ARENA: true, TOKEN_DEFER: true, TOKEN_LOCK: true,
 		TOKEN_MAX: true, TOKEN_INF: true, TOKEN_AND: true, TOKEN_OR: true,
 		TOKEN_NOT: true, TOKEN_XOR: true, TOKEN_AT_PLUSPLUS: true,
 	}
@@ -997,6 +1033,16 @@ func (p *Parser) parseStatement() Statement {
 		return p.parseDeferStmt()
 	}
 
+	// Check for lock keyword
+	if p.current.Type == TOKEN_LOCK {
+		return p.parseLockStmt()
+	}
+
+	// Check for hot keyword (hot-reloadable function definition)
+	if p.current.Type == TOKEN_HOT {
+		return p.parseHotStmt()
+	}
+
 	// Check for alias keyword
 	if p.current.Type == TOKEN_ALIAS {
 		return p.parseAliasStmt()
@@ -1331,6 +1377,25 @@ func (p *Parser) parseFString() Expression {
 	return &FStringExpr{Parts: parts}
 }
 
+// parseHotStmt parses a hot function definition: hot name = (params) -> body
+// Hot functions are called through a function pointer table, so that 'vibe67 --watch'
+// can replace their code in the running program.
+func (p *Parser) parseHotStmt() Statement {
+	p.nextToken() // skip 'hot'
+	if p.current.Type != TOKEN_IDENT {
+		p.error("expected function name after 'hot' keyword")
+	}
+	if p.functionDepth > 0 {
+		p.error("hot functions must be defined at the top level")
+	}
+	assign := p.parseAssignment()
+	if _, ok := assign.Value.(*LambdaExpr); !ok || assign.Mutable || assign.IsUpdate {
+		p.error(fmt.Sprintf("'hot' can only be used on function definitions (hot %s = (...) -> ...)", assign.Name))
+	}
+	assign.IsHot = true
+	return assign
+}
+
 // Confidence that this function is working: 100%
 func (p *Parser) parseAssignment() *AssignStmt {
 	// Check for shadow keyword
@@ -3910,12 +3975,23 @@ func (p *Parser) parsePostfix() Expression {
 
 			// Parse the cast type
 			var castType string
-			if p.current.Type == TOKEN_IDENT {
+			if p.current.Type == TOKEN_IDENT && p.current.Value == "fn" && p.peek.Type == TOKEN_LPAREN {
+				// C callback type: f as fn(cptr, cptr) -> int32
+				castType = p.parseCallbackCastType()
+			} else if p.current.Type == TOKEN_IDENT {
 				typeName := p.current.Value
 				// Check if it's a cstruct name
 				if _, exists := p.cstructs[typeName]; exists {
 					// It's a cstruct type - store the full type name
 					castType = typeName
+				} else if p.cImports[typeName] && p.peek.Type == TOKEN_DOT {
+					// A struct from a C import's headers: sdl.SDL_Event
+					p.nextToken() // skip namespace
+					p.nextToken() // skip '.'
+					if p.current.Type != TOKEN_IDENT {
+						p.error("expected C type name after '" + typeName + ".'")
+					}
+					castType = typeName + "." + p.current.Value
 				} else {
 					// Check if it's a built-in type
 					validTypes := map[string]bool{
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -33,10 +34,35 @@ const (
 	scnMemWrite    = 0x80000000
 	scnCntCode     = 0x00000020
 	scnCntInitData = 0x00000040
+	scnMemDiscard  = 0x02000000
+
+	// DLL characteristics: HIGH_ENTROPY_VA | DYNAMIC_BASE | NX_COMPAT | TERMINAL_SERVER_AWARE.
+	// The image can be loaded anywhere, as the code reaches everything
+	// RIP-relative and .reloc lists what else has to be fixed up.
+	peDllCharacteristics = 0x8160
+
+	// Data directory indices
+	peDirImport    = 1
+	peDirBaseReloc = 5
+	peDirIAT       = 12
+
+	// Base relocation types
+	peRelBasedAbsolute = 0  // padding
+	peRelBasedDir64    = 10 // a 64-bit address
+
+	peOrdinalFlag64 = 1 << 63    // import lookup entry by ordinal
+	peOrdinalPrefix = "ordinal_" // C function name that imports by ordinal: ordinal_12
 )
 
+// peDataDirectory is an entry of the optional header's data directories
+type peDataDirectory struct {
+	rva, size uint32
+}
+
 // Confidence that this function is working: 85%
-func (eb *ExecutableBuilder) WritePEHeaderWithImports(entryPointRVA uint32, codeSize, dataSize, idataSize, idataRVA uint32) error {
+// WritePEHeaderWithImports writes the headers up to the section table for
+// an image of numSections sections that ends at imageEnd (an RVA)
+func (eb *ExecutableBuilder) WritePEHeaderWithImports(entryPointRVA, codeSize, dataSize, imageEnd uint32, numSections int, subsystem uint16, dirs map[int]peDataDirectory) error {
 	w := eb.ELFWriter() // Reuse the writer
 
 	// Helper functions to write multi-byte values
@@ -64,13 +90,13 @@ func (eb *ExecutableBuilder) WritePEHeaderWithImports(entryPointRVA uint32, code
 	writeU32(0x00004550) // "PE\0\0"
 
 	// === COFF File Header (20 bytes) ===
-	writeU16(0x8664)             // Machine: AMD64
-	writeU16(3)                  // Number of sections (.text, .data, .idata)
-	writeU32(0)                  // TimeDateStamp (0 for reproducibility)
-	writeU32(0)                  // Pointer to symbol table (deprecated)
-	writeU32(0)                  // Number of symbols (deprecated)
-	writeU16(optionalHeaderSize) // Size of optional header
-	writeU16(0x0022)             // Characteristics: EXECUTABLE_IMAGE | LARGE_ADDRESS_AWARE
+	writeU16(0x8664)              // Machine: AMD64
+	writeU16(uint16(numSections)) // Number of sections
+	writeU32(0)                   // TimeDateStamp (0 for reproducibility)
+	writeU32(0)                   // Pointer to symbol table (deprecated)
+	writeU32(0)                   // Number of symbols (deprecated)
+	writeU16(optionalHeaderSize)  // Size of optional header
+	writeU16(0x0022)              // Characteristics: EXECUTABLE_IMAGE | LARGE_ADDRESS_AWARE
 
 	// === Optional Header (PE32+) ===
 	writeU16(0x020B)        // Magic: PE32+ (64-bit)
@@ -94,18 +120,17 @@ func (eb *ExecutableBuilder) WritePEHeaderWithImports(entryPointRVA uint32, code
 	writeU16(0)              // Minor subsystem version
 	writeU32(0)              // Win32 version value (reserved)
 
-	// Calculate image size: end of last section (idata RVA + idata size), aligned to section alignment
 	// SizeOfImage must be the size of the image in memory, not on disk
-	imageSize := alignTo(idataRVA+idataSize, peSectionAlign)
+	imageSize := alignTo(imageEnd, peSectionAlign)
 	writeU32(imageSize) // Size of image
 
 	headersSize := alignTo(dosHeaderSize+dosStubSize+peSignatureSize+coffHeaderSize+
-		optionalHeaderSize+3*peSectionHeaderSize, peFileAlign)
+		optionalHeaderSize+uint32(numSections)*peSectionHeaderSize, peFileAlign)
 	writeU32(headersSize) // Size of headers
 
 	writeU32(0)         // Checksum
-	writeU16(3)         // Subsystem: CUI (Console)
-	writeU16(0x8120)    // DLL characteristics: DYNAMIC_BASE | NX_COMPAT | TERMINAL_SERVER_AWARE | NO_SEH
+	writeU16(subsystem) // Subsystem: GUI or CUI (console)
+	writeU16(peDllCharacteristics)
 	w.Write8u(0x100000) // Size of stack reserve
 	w.Write8u(0x1000)   // Size of stack commit
 	w.Write8u(0x100000) // Size of heap reserve
@@ -115,12 +140,8 @@ func (eb *ExecutableBuilder) WritePEHeaderWithImports(entryPointRVA uint32, code
 
 	// Data directories (16 entries, each 8 bytes: RVA + Size)
 	for i := 0; i < 16; i++ {
-		if i == 1 { // Import directory
-			writeU32(idataRVA)  // Import RVA
-			writeU32(idataSize) // Import size
-		} else {
-			w.Write8u(0)
-		}
+		writeU32(dirs[i].rva)
+		writeU32(dirs[i].size)
 	}
 
 	return nil
@@ -196,9 +217,9 @@ func (eb *ExecutableBuilder) WritePEHeader(entryPointRVA uint32, codeSize, dataS
 		optionalHeaderSize+3*peSectionHeaderSize, peFileAlign)
 	writeU32(headersSize) // Size of headers
 
-	writeU32(0)         // Checksum
-	writeU16(3)         // Subsystem: CUI (Console)
-	writeU16(0x8120)    // DLL characteristics: DYNAMIC_BASE | NX_COMPAT | TERMINAL_SERVER_AWARE | NO_SEH
+	writeU32(0) // Checksum
+	writeU16(3) // Subsystem: CUI (Console)
+	writeU16(peDllCharacteristics)
 	w.Write8u(0x100000) // Size of stack reserve
 	w.Write8u(0x1000)   // Size of stack commit
 	w.Write8u(0x100000) // Size of heap reserve
@@ -252,168 +273,15 @@ func (eb *ExecutableBuilder) WritePESectionHeader(name string, virtualSize, virt
 }
 
 // Confidence that this function is working: 75%
+// WritePE writes a PE file that imports the C runtime functions Vibe67 programs use
 func (eb *ExecutableBuilder) WritePE(outputPath string) error {
-	// For Windows, we need to generate import tables for C runtime
-	// Build import directory for msvcrt.dll (C runtime)
-
-	// Standard C runtime functions needed by Vibe67 programs
-	libraries := map[string][]string{
+	return eb.WritePEWithLibraries(outputPath, map[string][]string{
 		"msvcrt.dll": {
 			"printf", "exit", "malloc", "free", "realloc", "getenv",
 			"strlen", "memcpy", "memset", "pow", "fflush",
 			"sin", "cos", "sqrt", "fopen", "fclose", "fwrite", "fread",
 		},
-	}
-
-	// Write rodata and data content to buffers first
-	// IMPORTANT: We must iterate in a consistent order so addresses match!
-	rodataSymbols := eb.RodataSection()
-	dataSymbols := eb.DataSection()
-
-	// Create sorted slices of symbol names for consistent ordering
-	rodataNames := make([]string, 0, len(rodataSymbols))
-	for name := range rodataSymbols {
-		rodataNames = append(rodataNames, name)
-	}
-	sort.Strings(rodataNames)
-
-	dataNames := make([]string, 0, len(dataSymbols))
-	for name := range dataSymbols {
-		dataNames = append(dataNames, name)
-	}
-	sort.Strings(dataNames)
-
-	// Write rodata in sorted order
-	for _, name := range rodataNames {
-		eb.WriteRodata([]byte(rodataSymbols[name]))
-	}
-	// Write data in sorted order
-	for _, name := range dataNames {
-		eb.data.Write([]byte(dataSymbols[name]))
-	}
-
-	codeSize := uint32(eb.text.Len())
-	dataSize := uint32(eb.rodata.Len() + eb.data.Len())
-
-	// Align sizes to file alignment
-	codeSize = alignTo(codeSize, peFileAlign)
-	dataSize = alignTo(dataSize, peFileAlign)
-
-	// Calculate section positions
-	headerSize := uint32(dosHeaderSize + dosStubSize + peSignatureSize + coffHeaderSize +
-		optionalHeaderSize + 3*peSectionHeaderSize)
-	headerSize = alignTo(headerSize, peFileAlign)
-
-	textRawAddr := uint32(headerSize)
-	textVirtualAddr := uint32(0x1000) // First section after headers
-
-	dataRawAddr := textRawAddr + codeSize
-	dataVirtualAddr := textVirtualAddr + alignTo(codeSize, peSectionAlign)
-
-	// Build import data
-	idataVirtualAddr := dataVirtualAddr + alignTo(dataSize, peSectionAlign)
-	importData, iatMap, err := BuildPEImportData(libraries, idataVirtualAddr)
-	if err != nil {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "Warning: Failed to build import data: %v\n", err)
-		}
-		importData = []byte{} // Empty import section
-	}
-
-	idataSize := uint32(len(importData))
-	idataRawSize := alignTo(idataSize, peFileAlign)
-	idataRawAddr := dataRawAddr + dataSize
-
-	if VerboseMode {
-		fmt.Fprintf(os.Stderr, "Import section: size=%d, RVA=0x%x\n", idataSize, idataVirtualAddr)
-		fmt.Fprintf(os.Stderr, "IAT mapping: %d functions\n", len(iatMap))
-	}
-
-	// Entry point is at start of .text section
-	entryPointRVA := textVirtualAddr
-
-	// Write PE header with import directory info
-	if err := eb.WritePEHeaderWithImports(entryPointRVA, codeSize, dataSize, idataSize, idataVirtualAddr); err != nil {
-		return err
-	}
-
-	// Write section headers
-	eb.WritePESectionHeader(".text", codeSize, textVirtualAddr, codeSize, textRawAddr,
-		scnCntCode|scnMemExecute|scnMemRead)
-	eb.WritePESectionHeader(".data", dataSize, dataVirtualAddr, dataSize, dataRawAddr,
-		scnCntInitData|scnMemRead|scnMemWrite)
-	eb.WritePESectionHeader(".idata", idataSize, idataVirtualAddr, idataRawSize, idataRawAddr,
-		scnCntInitData|scnMemRead) // Import section
-
-	// Pad headers to file alignment
-	currentPos := uint32(dosHeaderSize + dosStubSize + peSignatureSize + coffHeaderSize +
-		optionalHeaderSize + 3*peSectionHeaderSize)
-	padding := int(headerSize - currentPos)
-	if padding > 0 {
-		eb.ELFWriter().WriteN(0, padding)
-	}
-
-	// Assign addresses to all data symbols (strings, constants)
-	// For PE, the .data section contains both rodata and data
-	// IMPORTANT: Must use the same sorted order as when we wrote the data!
-	rodataAddr := peImageBase + uint64(dataVirtualAddr)
-	currentAddr := rodataAddr
-
-	// First, rodata symbols (read-only) in sorted order
-	for _, symbol := range rodataNames {
-		value := rodataSymbols[symbol]
-		eb.DefineAddr(symbol, currentAddr)
-		currentAddr += uint64(len(value))
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "PE rodata: %s at 0x%x\n", symbol, eb.consts[symbol].addr)
-		}
-	}
-
-	// Then, data symbols (writable, like cpu_has_avx512) in sorted order
-	for _, symbol := range dataNames {
-		value := dataSymbols[symbol]
-		eb.DefineAddr(symbol, currentAddr)
-		currentAddr += uint64(len(value))
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "PE data: %s at 0x%x\n", symbol, eb.consts[symbol].addr)
-		}
-	}
-
-	// Patch calls to use IAT (Import Address Table)
-	if err := eb.PatchPECallsToIAT(iatMap, uint64(textVirtualAddr), uint64(idataVirtualAddr), peImageBase); err != nil {
-		return err
-	}
-
-	// Patch PC-relative relocations (LEA instructions for data access)
-	textAddrFull := peImageBase + uint64(textVirtualAddr)
-	eb.PatchPCRelocations(textAddrFull, rodataAddr, eb.rodata.Len())
-
-	// Write sections
-	// .text section
-	eb.ELFWriter().WriteBytes(eb.text.Bytes())
-	if pad := int(codeSize) - eb.text.Len(); pad > 0 {
-		eb.ELFWriter().WriteN(0, pad)
-	}
-
-	// .data section (combine rodata and data)
-	eb.ELFWriter().WriteBytes(eb.rodata.Bytes())
-	eb.ELFWriter().WriteBytes(eb.data.Bytes())
-	if pad := int(dataSize) - eb.rodata.Len() - eb.data.Len(); pad > 0 {
-		eb.ELFWriter().WriteN(0, pad)
-	}
-
-	// .idata section (imports)
-	eb.ELFWriter().WriteBytes(importData)
-	if pad := int(idataRawSize) - len(importData); pad > 0 {
-		eb.ELFWriter().WriteN(0, pad)
-	}
-
-	// Write to file
-	if err := os.WriteFile(outputPath, eb.elf.Bytes(), 0755); err != nil {
-		return fmt.Errorf("failed to write PE file: %v", err)
-	}
-
-	return nil
+	}, nil, nil)
 }
 
 // alignTo aligns a value to the given alignment
@@ -436,8 +304,12 @@ func (eb *ExecutableBuilder) WritePEWithImports(outputPath string, imports []str
 }
 
 // Confidence that this function is working: 80%
-// WritePEWithLibraries writes a PE file with the given library imports
-func (eb *ExecutableBuilder) WritePEWithLibraries(outputPath string, libraries map[string][]string) error {
+// WritePEWithLibraries writes a PE file with the given library imports.
+// hints gives the index in its DLL's export name table of a function, if
+// known, which saves the loader a search (see BuildPEImportData). opts
+// gives the subsystem and the resources; without them the image is a
+// console program without resources.
+func (eb *ExecutableBuilder) WritePEWithLibraries(outputPath string, libraries map[string][]string, hints map[string]uint16, opts *peImageOptions) error {
 	if len(libraries) == 0 {
 		// No imports, use default msvcrt.dll
 		libraries = map[string][]string{
@@ -445,11 +317,14 @@ func (eb *ExecutableBuilder) WritePEWithLibraries(outputPath string, libraries m
 		}
 	}
 
-	return eb.writePEWithLibraries(outputPath, libraries)
+	if opts == nil {
+		opts = &peImageOptions{subsystem: peSubsystemConsole}
+	}
+	return eb.writePEWithLibraries(outputPath, libraries, hints, opts)
 }
 
 // Confidence that this function is working: 75%
-func (eb *ExecutableBuilder) writePEWithLibraries(outputPath string, libraries map[string][]string) error {
+func (eb *ExecutableBuilder) writePEWithLibraries(outputPath string, libraries map[string][]string, hints map[string]uint16, opts *peImageOptions) error {
 	// Write rodata and data content to buffers first
 	// IMPORTANT: We must iterate in a consistent order so addresses match!
 	rodataSymbols := eb.RodataSection()
@@ -487,9 +362,14 @@ func (eb *ExecutableBuilder) writePEWithLibraries(outputPath string, libraries m
 	fmt.Fprintf(os.Stderr, "Aligned: codeSize=%d (0x%X), dataSize=%d (0x%X)\n",
 		codeSize, codeSize, dataSize, dataSize)
 
-	// Calculate section positions
+	// Calculate section positions: .text, .data, .idata, .rsrc if there are
+	// resources, and .reloc
+	numSections := 4
+	if len(opts.resources) > 0 {
+		numSections++
+	}
 	headerSize := uint32(dosHeaderSize + dosStubSize + peSignatureSize + coffHeaderSize +
-		optionalHeaderSize + 3*peSectionHeaderSize)
+		optionalHeaderSize + uint32(numSections)*peSectionHeaderSize)
 	headerSize = alignTo(headerSize, peFileAlign)
 
 	textRawAddr := uint32(headerSize)
@@ -502,13 +382,11 @@ func (eb *ExecutableBuilder) writePEWithLibraries(outputPath string, libraries m
 
 	// Build import data
 	idataVirtualAddr := dataVirtualAddr + alignTo(dataSize, peSectionAlign)
-	importData, iatMap, err := BuildPEImportData(libraries, idataVirtualAddr)
+	imports, err := BuildPEImportData(libraries, hints, idataVirtualAddr)
 	if err != nil {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "Warning: Failed to build import data: %v\n", err)
-		}
-		importData = []byte{} // Empty import section
+		return err
 	}
+	importData := imports.data
 
 	idataSize := uint32(len(importData))
 	idataRawSize := alignTo(idataSize, peFileAlign)
@@ -516,14 +394,41 @@ func (eb *ExecutableBuilder) writePEWithLibraries(outputPath string, libraries m
 
 	if VerboseMode {
 		fmt.Fprintf(os.Stderr, "Import section: size=%d, RVA=0x%x\n", idataSize, idataVirtualAddr)
-		fmt.Fprintf(os.Stderr, "IAT mapping: %d functions\n", len(iatMap))
+		fmt.Fprintf(os.Stderr, "IAT mapping: %d functions\n", len(imports.iat))
+	}
+
+	// Resources (icon, version info, manifest)
+	rsrcVirtualAddr := idataVirtualAddr + alignTo(idataSize, peSectionAlign)
+	var rsrcData []byte
+	if len(opts.resources) > 0 {
+		rsrcData = BuildPEResources(opts.resources, rsrcVirtualAddr)
 	}
+	rsrcSize := uint32(len(rsrcData))
+	rsrcRawSize := alignTo(rsrcSize, peFileAlign)
+	rsrcRawAddr := idataRawAddr + idataRawSize
+
+	// The generated code reaches its data and the IAT RIP-relative and the
+	// import tables hold RVAs, so no absolute address has to be fixed up.
+	// The table still has to be there for the loader to move the image.
+	relocVirtualAddr := rsrcVirtualAddr + alignTo(rsrcSize, peSectionAlign)
+	relocData := BuildPERelocations(nil)
+	relocSize := uint32(len(relocData))
+	relocRawSize := alignTo(relocSize, peFileAlign)
+	relocRawAddr := rsrcRawAddr + rsrcRawSize
 
 	// Entry point is at start of .text section
 	entryPointRVA := textVirtualAddr
 
 	// Write PE header with import directory info
-	if err := eb.WritePEHeaderWithImports(entryPointRVA, codeSize, dataSize, idataSize, idataVirtualAddr); err != nil {
+	dirs := map[int]peDataDirectory{
+		peDirImport:    {idataVirtualAddr, idataSize},
+		peDirBaseReloc: {relocVirtualAddr, relocSize},
+		peDirIAT:       {imports.iatRVA, imports.iatSize},
+	}
+	if rsrcSize > 0 {
+		dirs[peDirResource] = peDataDirectory{rsrcVirtualAddr, rsrcSize}
+	}
+	if err := eb.WritePEHeaderWithImports(entryPointRVA, codeSize, dataSize, relocVirtualAddr+relocSize, numSections, opts.subsystem, dirs); err != nil {
 		return err
 	}
 	fmt.Fprintf(os.Stderr, "[1] After header: pos=%d\n", eb.elf.Len())
@@ -534,12 +439,18 @@ func (eb *ExecutableBuilder) writePEWithLibraries(outputPath string, libraries m
 	eb.WritePESectionHeader(".data", dataSize, dataVirtualAddr, dataSize, dataRawAddr,
 		scnCntInitData|scnMemRead|scnMemWrite)
 	eb.WritePESectionHeader(".idata", idataSize, idataVirtualAddr, idataRawSize, idataRawAddr,
-		scnCntInitData|scnMemRead) // Import section
+		scnCntInitData|scnMemRead|scnMemWrite) // Import section; the loader writes the IAT
+	if rsrcSize > 0 {
+		eb.WritePESectionHeader(".rsrc", rsrcSize, rsrcVirtualAddr, rsrcRawSize, rsrcRawAddr,
+			scnCntInitData|scnMemRead)
+	}
+	eb.WritePESectionHeader(".reloc", relocSize, relocVirtualAddr, relocRawSize, relocRawAddr,
+		scnCntInitData|scnMemRead|scnMemDiscard)
 	fmt.Fprintf(os.Stderr, "[2] After section headers: pos=%d\n", eb.elf.Len())
 
 	// Pad headers to file alignment
 	currentPos := uint32(dosHeaderSize + dosStubSize + peSignatureSize + coffHeaderSize +
-		optionalHeaderSize + 3*peSectionHeaderSize)
+		optionalHeaderSize + uint32(numSections)*peSectionHeaderSize)
 	padding := int(headerSize - currentPos)
 	fmt.Fprintf(os.Stderr, "[3] Padding %d bytes\n", padding)
 	if padding > 0 {
@@ -574,7 +485,7 @@ func (eb *ExecutableBuilder) writePEWithLibraries(outputPath string, libraries m
 	}
 
 	// Patch calls to use IAT (Import Address Table)
-	if err := eb.PatchPECallsToIAT(iatMap, uint64(textVirtualAddr), uint64(idataVirtualAddr), peImageBase); err != nil {
+	if err := eb.PatchPECallsToIAT(imports.iat, uint64(textVirtualAddr), uint64(idataVirtualAddr), peImageBase); err != nil {
 		return err
 	}
 
@@ -604,6 +515,18 @@ func (eb *ExecutableBuilder) writePEWithLibraries(outputPath string, libraries m
 		eb.ELFWriter().WriteN(0, pad)
 	}
 
+	// .rsrc section (resources)
+	eb.ELFWriter().WriteBytes(rsrcData)
+	if pad := int(rsrcRawSize) - len(rsrcData); pad > 0 {
+		eb.ELFWriter().WriteN(0, pad)
+	}
+
+	// .reloc section (base relocations)
+	eb.ELFWriter().WriteBytes(relocData)
+	if pad := int(relocRawSize) - len(relocData); pad > 0 {
+		eb.ELFWriter().WriteN(0, pad)
+	}
+
 	// Write to file
 	fmt.Fprintf(os.Stderr, "[FINAL] File size: %d bytes\n", eb.elf.Len())
 	if err := os.WriteFile(outputPath, eb.elf.Bytes(), 0755); err != nil {
@@ -613,44 +536,49 @@ func (eb *ExecutableBuilder) writePEWithLibraries(outputPath string, libraries m
 	return nil
 }
 
-// Confidence that this function is working: 70%
-// BuildPEImportData builds the complete import section data for PE files
-// Returns: import data, IAT RVA map (funcName -> RVA), error
-func BuildPEImportData(libraries map[string][]string, idataRVA uint32) ([]byte, map[string]uint32, error) {
+// peImportData is the .idata section of a PE file
+type peImportData struct {
+	data    []byte
+	iat     map[string]uint32 // function name -> RVA of its IAT slot
+	iatRVA  uint32            // the IATs of all DLLs, which follow each other
+	iatSize uint32
+}
+
+// peImportOrdinal reports the ordinal a C function name like ordinal_12 imports
+func peImportOrdinal(funcName string) (uint16, bool) {
+	digits, ok := strings.CutPrefix(funcName, peOrdinalPrefix)
+	if !ok {
+		return 0, false
+	}
+	ordinal, err := strconv.ParseUint(digits, 10, 16)
+	if err != nil || ordinal == 0 {
+		return 0, false
+	}
+	return uint16(ordinal), true
+}
+
+// Confidence that this function is working: 80%
+// BuildPEImportData builds the import section for PE files. Functions named
+// ordinal_<n> are imported by ordinal, the others by name with the hint
+// from hints (0 if there is none).
+func BuildPEImportData(libraries map[string][]string, hints map[string]uint16, idataRVA uint32) (*peImportData, error) {
 	// Structure of .idata section:
 	// 1. Import Directory Table (IDT) - array of IMAGE_IMPORT_DESCRIPTOR (20 bytes each), null-terminated
-	// 2. Import Lookup Tables (ILT) - one per DLL, array of RVAs to hint/name entries
-	// 3. Import Address Tables (IAT) - one per DLL, same structure as ILT (loader fills this)
-	// 4. Hint/Name Table - hint (uint16) + name (null-terminated string) for each function
+	// 2. Import Lookup Tables (ILT) - one per DLL, array of 64-bit entries, null-terminated
+	// 3. Import Address Tables (IAT) - one per DLL, same as the ILT until the loader fills it in
+	// 4. Hint/Name Table - hint (uint16) + name (null-terminated string) for each function, 2-byte aligned
 	// 5. DLL names - null-terminated strings
+	//
+	// The ILTs and IATs are arrays of 64-bit values, so they start 8-byte aligned.
 
 	if VerboseMode {
 		fmt.Fprintf(os.Stderr, "BuildPEImportData: libraries = %v\n", libraries)
 	}
 
 	if len(libraries) == 0 {
-		return nil, nil, fmt.Errorf("no libraries to import")
+		return nil, fmt.Errorf("no libraries to import")
 	}
 
-	var buf bytes.Buffer
-	iatMap := make(map[string]uint32)
-
-	// Calculate offsets
-	numLibs := len(libraries)
-	idtSize := (numLibs + 1) * 20 // +1 for null terminator
-	currentOffset := uint32(idtSize)
-
-	// Storage for each library's data
-	type libData struct {
-		name        string
-		functions   []string
-		iltOffset   uint32
-		iatOffset   uint32
-		nameOffset  uint32
-		hintsOffset uint32
-	}
-	libsData := make([]libData, 0, numLibs)
-
 	// Sort library names for deterministic output
 	libNames := make([]string, 0, len(libraries))
 	for libName := range libraries {
@@ -658,178 +586,99 @@ func BuildPEImportData(libraries map[string][]string, idataRVA uint32) ([]byte,
 	}
 	sort.Strings(libNames)
 
-	// First pass: calculate all offsets
-	for _, libName := range libNames {
-		funcs := libraries[libName]
-		ld := libData{
-			name:      libName,
-			functions: funcs,
-		}
-
-		// ILT offset
-		ld.iltOffset = currentOffset
-		iltSize := uint32((len(funcs) + 1) * 8) // 8 bytes per entry (64-bit), +1 for null
-		currentOffset += iltSize
-
-		// IAT offset (same size as ILT)
-		ld.iatOffset = currentOffset
-		currentOffset += iltSize
-
-		libsData = append(libsData, ld)
-	}
-
-	// Calculate hint/name entries
-	for i := range libsData {
-		libsData[i].hintsOffset = currentOffset
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "DEBUG: %s hintsOffset = 0x%x (currentOffset before hints)\n", libsData[i].name, currentOffset)
-		}
-		for _, funcName := range libsData[i].functions {
-			// 2 bytes (hint) + function name + null terminator
-			// Align to 2-byte boundary
-			entrySize := 2 + len(funcName) + 1
-			if entrySize%2 != 0 {
-				entrySize++
+	// Lay out the tables
+	idtSize := uint32((len(libNames) + 1) * 20) // +1 for null terminator
+	offset := alignTo(idtSize, 8)
+	iltOffsets := make([]uint32, len(libNames))
+	for i, libName := range libNames {
+		iltOffsets[i] = offset
+		offset += uint32((len(libraries[libName]) + 1) * 8)
+	}
+	iatStart := offset
+	iatOffsets := make([]uint32, len(libNames))
+	for i, libName := range libNames {
+		iatOffsets[i] = offset
+		offset += uint32((len(libraries[libName]) + 1) * 8)
+	}
+	iatEnd := offset
+	hintOffsets := make([][]uint32, len(libNames))
+	for i, libName := range libNames {
+		for _, funcName := range libraries[libName] {
+			if _, byOrdinal := peImportOrdinal(funcName); byOrdinal {
+				hintOffsets[i] = append(hintOffsets[i], 0)
+				continue
 			}
-			if VerboseMode && i == len(libsData)-1 { // Last library
-				fmt.Fprintf(os.Stderr, "DEBUG:   %s: len=%d, entrySize=%d, nextOffset=0x%x\n", funcName, len(funcName), entrySize, currentOffset+uint32(entrySize))
-			}
-			currentOffset += uint32(entrySize)
-		}
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "DEBUG: %s hints end at 0x%x\n", libsData[i].name, currentOffset)
+			hintOffsets[i] = append(hintOffsets[i], offset)
+			offset += alignTo(uint32(2+len(funcName)+1), 2)
 		}
 	}
-
-	// DLL names offset
-	for i := range libsData {
-		libsData[i].nameOffset = currentOffset
-		currentOffset += uint32(len(libsData[i].name) + 1) // +1 for null terminator
-	}
-
-	// Write Import Directory Table
-	for _, ld := range libsData {
-		// IMAGE_IMPORT_DESCRIPTOR
-		binary.Write(&buf, binary.LittleEndian, idataRVA+ld.iltOffset)  // OriginalFirstThunk (ILT RVA)
-		binary.Write(&buf, binary.LittleEndian, uint32(0))              // TimeDateStamp
-		binary.Write(&buf, binary.LittleEndian, uint32(0))              // ForwarderChain
-		binary.Write(&buf, binary.LittleEndian, idataRVA+ld.nameOffset) // Name RVA
-		binary.Write(&buf, binary.LittleEndian, idataRVA+ld.iatOffset)  // FirstThunk (IAT RVA)
+	nameOffsets := make([]uint32, len(libNames))
+	for i, libName := range libNames {
+		nameOffsets[i] = offset
+		offset += uint32(len(libName) + 1)
 	}
-	// Null terminator for IDT
-	binary.Write(&buf, binary.LittleEndian, [20]byte{})
 
-	// Write ILTs and IATs for each library (interleaved: ILT then IAT for each library)
-	for libIdx, ld := range libsData {
-		// Write ILT for this library
-		hintOffset := ld.hintsOffset // Start at this library's hint offset
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "DEBUG: Writing ILT for %s, starting hintOffset=0x%x\n", ld.name, hintOffset)
-		}
-		for funcIdx, funcName := range ld.functions {
-			// RVA to hint/name entry (bit 63 clear = import by name)
-			binary.Write(&buf, binary.LittleEndian, uint64(idataRVA+hintOffset))
-
-			if VerboseMode && libIdx == 1 && funcIdx < 3 { // msvcrt, first 3 functions
-				fmt.Fprintf(os.Stderr, "DEBUG:   ILT[%d] %s -> hint RVA 0x%x\n", funcIdx, funcName, idataRVA+hintOffset)
-			}
-
-			// Calculate hint/name entry size for next iteration
-			entrySize := 2 + len(funcName) + 1
-			if entrySize%2 != 0 {
-				entrySize++
+	buf := make([]byte, offset)
+	iatMap := make(map[string]uint32)
+	for i, libName := range libNames {
+		writePEImportDescriptor(buf, i*20, idataRVA+iltOffsets[i], idataRVA+iatOffsets[i], idataRVA+nameOffsets[i], 0)
+		for j, funcName := range libraries[libName] {
+			entry := uint64(idataRVA + hintOffsets[i][j])
+			if ordinal, byOrdinal := peImportOrdinal(funcName); byOrdinal {
+				entry = peOrdinalFlag64 | uint64(ordinal)
+			} else {
+				binary.LittleEndian.PutUint16(buf[hintOffsets[i][j]:], hints[funcName])
+				copy(buf[hintOffsets[i][j]+2:], funcName)
 			}
-			hintOffset += uint32(entrySize)
+			binary.LittleEndian.PutUint64(buf[iltOffsets[i]+uint32(j*8):], entry)
+			binary.LittleEndian.PutUint64(buf[iatOffsets[i]+uint32(j*8):], entry)
+			iatMap[funcName] = idataRVA + iatOffsets[i] + uint32(j*8)
 		}
-		// Null terminator for ILT
-		binary.Write(&buf, binary.LittleEndian, uint64(0))
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "DEBUG: Finished ILT for %s\n", ld.name)
-		}
-
-		// Write IAT for this library (same as ILT initially, loader will fill it)
-		hintOffset = ld.hintsOffset // Reset to this library's hint offset
-		iatBase := idataRVA + ld.iatOffset
-
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "DEBUG: Writing IAT for %s (offset=0x%x, iatBase=0x%x, functions=%v)\n", ld.name, ld.iatOffset, iatBase, ld.functions)
-			fmt.Fprintf(os.Stderr, "DEBUG: Starting hintOffset=0x%x\n", hintOffset)
-		}
-
-		for funcIndex, funcName := range ld.functions {
-			// Store IAT RVA for this function
-			iatRVA := iatBase + uint32(funcIndex*8)
-			iatMap[funcName] = iatRVA
-
-			if funcName == "ExitProcess" || funcName == "malloc" {
-				fmt.Fprintf(os.Stderr, "DEBUG:   %s -> IAT RVA=0x%X (iatBase=0x%X + %d*8), hint RVA=0x%X\n",
-					funcName, iatRVA, iatBase, funcIndex, idataRVA+hintOffset)
-			}
+		copy(buf[nameOffsets[i]:], libName)
+	}
 
-			// RVA to hint/name entry
-			hintRVA := uint64(idataRVA + hintOffset)
-			binary.Write(&buf, binary.LittleEndian, hintRVA)
+	return &peImportData{
+		data:    buf,
+		iat:     iatMap,
+		iatRVA:  idataRVA + iatStart,
+		iatSize: iatEnd - iatStart,
+	}, nil
+}
 
-			if funcName == "ExitProcess" || funcName == "malloc" {
-				fmt.Fprintf(os.Stderr, "DEBUG:   Writing %s IAT: hintRVA=0x%X, buf position=0x%X\n", funcName, hintRVA, buf.Len()-8)
-			}
+// Confidence that this function is working: 80%
+// BuildPERelocations builds the base relocation table (.reloc) for the
+// 64-bit absolute addresses at the given RVAs. There is one block per 4 KB
+// page, padded to a multiple of 4 bytes. Without addresses, the table is a
+// single block that only pads, which still lets the loader move the image.
+func BuildPERelocations(rvas []uint32) []byte {
+	sorted := append([]uint32(nil), rvas...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
 
-			entrySize := 2 + len(funcName) + 1
-			if entrySize%2 != 0 {
-				entrySize++
-			}
-			hintOffset += uint32(entrySize)
+	var buf bytes.Buffer
+	writeBlock := func(page uint32, entries []uint16) {
+		if len(entries)%2 != 0 {
+			entries = append(entries, peRelBasedAbsolute<<12)
 		}
-		// Null terminator for IAT
-		binary.Write(&buf, binary.LittleEndian, uint64(0))
+		binary.Write(&buf, binary.LittleEndian, page)
+		binary.Write(&buf, binary.LittleEndian, uint32(8+2*len(entries)))
+		binary.Write(&buf, binary.LittleEndian, entries)
 	}
-
-	// Write Hint/Name Table
-	for libIdx, ld := range libsData {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "DEBUG: Writing hints for %s starting at buf offset 0x%x\n", ld.name, buf.Len())
-		}
-		for _, funcName := range ld.functions {
-			beforeLen := buf.Len()
-			// Hint (ordinal, we use 0)
-			binary.Write(&buf, binary.LittleEndian, uint16(0))
-			// Function name
-			buf.WriteString(funcName)
-			buf.WriteByte(0) // Null terminator
-			// Align to 2-byte boundary
-			if (2+len(funcName)+1)%2 != 0 {
-				buf.WriteByte(0)
-			}
-			afterLen := buf.Len()
-			if VerboseMode && libIdx == 0 && (funcName == "SDL_RenderTexture" || funcName == "SDL_RenderPresent" || funcName == "SDL_RenderClear") {
-				fmt.Fprintf(os.Stderr, "DEBUG:   %s: wrote %d bytes (buf %d -> %d)\n", funcName, afterLen-beforeLen, beforeLen, afterLen)
-			}
-		}
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, "DEBUG: Finished hints for %s at buf offset 0x%x\n", ld.name, buf.Len())
-		}
+	if len(sorted) == 0 {
+		writeBlock(0, []uint16{peRelBasedAbsolute << 12})
+		return buf.Bytes()
 	}
 
-	// Write DLL names
-	for _, ld := range libsData {
-		buf.WriteString(ld.name)
-		buf.WriteByte(0) // Null terminator
+	page := sorted[0] &^ 0xFFF
+	var entries []uint16
+	for _, rva := range sorted {
+		if rva&^0xFFF != page {
+			writeBlock(page, entries)
+			page, entries = rva&^0xFFF, nil
+		}
+		entries = append(entries, peRelBasedDir64<<12|uint16(rva&0xFFF))
 	}
-
-	return buf.Bytes(), iatMap, nil
-}
-
-// Confidence that this function is working: 50%
-// WritePERelocations writes base relocation table for PE files
-func (eb *ExecutableBuilder) WritePERelocations() ([]byte, error) {
-	// Base relocations allow the PE loader to adjust addresses if the image
-	// is loaded at a different base address
-
-	// For simplicity, we'll generate minimal relocations
-	// In a full implementation, we'd need to track all absolute addresses
-	// and create relocation entries for them
-
-	return []byte{}, nil
+	writeBlock(page, entries)
+	return buf.Bytes()
 }
 
 // Confidence that this function is working: 80%
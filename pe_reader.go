@@ -110,9 +110,10 @@ type ExportDirectory struct {
 
 // ExportedFunction represents an exported function
 type ExportedFunction struct {
-	Name    string
+	Name    string // empty for a function exported by ordinal only
 	Ordinal uint16
 	RVA     uint32
+	Hint    uint16 // index in the export name table
 }
 
 // OpenPE opens a PE/DLL file for reading
@@ -335,7 +336,8 @@ func (pr *PEReader) GetExports() (*ExportDirectory, error) {
 	}
 
 	// Read function names and build export list
-	expDir.Functions = make([]ExportedFunction, 0, expDir.NumberOfNames)
+	expDir.Functions = make([]ExportedFunction, 0, expDir.NumberOfFunctions)
+	named := make([]bool, expDir.NumberOfFunctions)
 	for i := uint32(0); i < expDir.NumberOfNames; i++ {
 		name, err := pr.readStringAtRVA(nameRVAs[i])
 		if err != nil {
@@ -354,13 +356,25 @@ func (pr *PEReader) GetExports() (*ExportDirectory, error) {
 		}
 
 		rva := funcAddrs[ordinal]
+		named[ordinal] = true
 		expDir.Functions = append(expDir.Functions, ExportedFunction{
 			Name:    name,
 			Ordinal: ordinal + uint16(expDir.Base),
 			RVA:     rva,
+			Hint:    uint16(i),
 		})
 	}
 
+	// Functions exported by ordinal only (unused slots have RVA 0)
+	for i, rva := range funcAddrs {
+		if !named[i] && rva != 0 {
+			expDir.Functions = append(expDir.Functions, ExportedFunction{
+				Ordinal: uint16(i) + uint16(expDir.Base),
+				RVA:     rva,
+			})
+		}
+	}
+
 	pr.exports = &expDir
 	return &expDir, nil
 }
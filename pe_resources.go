@@ -0,0 +1,387 @@
+// Completion: 80% - Windows resources: icon, version info and application manifest
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// pe_resources.go - The .rsrc section of Windows executables
+//
+// Every Windows executable gets an application manifest that makes it DPI
+// aware (Windows does not scale its windows up blurrily) and sets the UTF-8
+// code page (the C runtime takes strings as UTF-8), and a VERSIONINFO block
+// that Explorer shows in the file's properties. An icon is added with -icon.
+// -subsystem windows makes a GUI program, which gets no console window.
+//
+// The options come from the command line and from the [windows] section of
+// vibe67.toml (see manifest.go), the command line taking precedence.
+
+// Resource types
+const (
+	rtIcon      = 3
+	rtGroupIcon = 14
+	rtVersion   = 16
+	rtManifest  = 24
+
+	peResourceLang  = 0x0409 // en-US
+	peCodePageUTF16 = 1200
+
+	// Subsystems
+	peSubsystemGUI     = 2
+	peSubsystemConsole = 3
+
+	peDirResource = 2 // data directory index
+)
+
+// peManifest is the application manifest of Windows executables
+const peManifest = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<assembly xmlns="urn:schemas-microsoft-com:asm.v1" manifestVersion="1.0">
+  <trustInfo xmlns="urn:schemas-microsoft-com:asm.v3">
+    <security>
+      <requestedPrivileges>
+        <requestedExecutionLevel level="asInvoker" uiAccess="false"/>
+      </requestedPrivileges>
+    </security>
+  </trustInfo>
+  <compatibility xmlns="urn:schemas-microsoft-com:compatibility.v1">
+    <application>
+      <supportedOS Id="{8e0f7a12-bfb3-4fe8-b9a5-48fd50a15a9a}"/>
+    </application>
+  </compatibility>
+  <application xmlns="urn:schemas-microsoft-com:asm.v3">
+    <windowsSettings>
+      <dpiAware xmlns="http://schemas.microsoft.com/SMI/2005/WindowsSettings">true/pm</dpiAware>
+      <dpiAwareness xmlns="http://schemas.microsoft.com/SMI/2016/WindowsSettings">PerMonitorV2</dpiAwareness>
+      <activeCodePage xmlns="http://schemas.microsoft.com/SMI/2019/WindowsSettings">UTF-8</activeCodePage>
+    </windowsSettings>
+  </application>
+</assembly>
+`
+
+// PEOptions are the options of Windows executables
+type PEOptions struct {
+	Subsystem   string // console (the default) or windows
+	Icon        string // .ico file
+	Version     string // file and product version, up to four numbers: 1.2.3.4
+	Product     string // product name, the executable's name if empty
+	Description string
+	Company     string
+	Copyright   string
+}
+
+// WindowsOptions are the options of the Windows executable being built
+// (-subsystem, -icon and [windows] in vibe67.toml)
+var WindowsOptions PEOptions
+
+// merge fills in the options that o leaves empty from other
+func (o PEOptions) merge(other PEOptions) PEOptions {
+	pick := func(a, b string) string {
+		if a != "" {
+			return a
+		}
+		return b
+	}
+	return PEOptions{
+		Subsystem:   pick(o.Subsystem, other.Subsystem),
+		Icon:        pick(o.Icon, other.Icon),
+		Version:     pick(o.Version, other.Version),
+		Product:     pick(o.Product, other.Product),
+		Description: pick(o.Description, other.Description),
+		Company:     pick(o.Company, other.Company),
+		Copyright:   pick(o.Copyright, other.Copyright),
+	}
+}
+
+// checkWindowsOptions reports whether the -subsystem and -icon flags are
+// valid. Other targets than Windows ignore them, as a manifest may build
+// for several targets.
+func checkWindowsOptions() error {
+	if _, err := WindowsOptions.subsystem(); err != nil {
+		return err
+	}
+	if WindowsOptions.Icon != "" {
+		if _, err := readICO(WindowsOptions.Icon); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subsystem gives the PE subsystem of the options
+func (o PEOptions) subsystem() (uint16, error) {
+	switch o.Subsystem {
+	case "", "console":
+		return peSubsystemConsole, nil
+	case "windows":
+		return peSubsystemGUI, nil
+	}
+	return 0, fmt.Errorf("unknown subsystem %q (use console or windows)", o.Subsystem)
+}
+
+// version parses the version number, missing parts being 0
+func (o PEOptions) version() ([4]uint16, error) {
+	var v [4]uint16
+	if o.Version == "" {
+		return v, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(o.Version, "v"), ".")
+	if len(parts) > 4 {
+		return v, fmt.Errorf("version %q has more than four numbers", o.Version)
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			return v, fmt.Errorf("version %q: %q is not a number from 0 to 65535", o.Version, part)
+		}
+		v[i] = uint16(n)
+	}
+	return v, nil
+}
+
+// peImageOptions are what a PE image has besides code, data and imports
+type peImageOptions struct {
+	subsystem uint16
+	resources []peResource
+}
+
+// imageOptions gives the subsystem and the resources of the executable
+// written to outputPath
+func (o PEOptions) imageOptions(outputPath string) (*peImageOptions, error) {
+	subsystem, err := o.subsystem()
+	if err != nil {
+		return nil, err
+	}
+	version, err := o.version()
+	if err != nil {
+		return nil, err
+	}
+	opts := &peImageOptions{subsystem: subsystem}
+	if o.Icon != "" {
+		icons, err := readICO(o.Icon)
+		if err != nil {
+			return nil, err
+		}
+		opts.resources = append(opts.resources, icons...)
+	}
+	opts.resources = append(opts.resources,
+		peResource{typ: rtVersion, id: 1, data: o.versionInfo(filepath.Base(outputPath), version)},
+		peResource{typ: rtManifest, id: 1, data: []byte(peManifest)},
+	)
+	return opts, nil
+}
+
+// peResource is a resource, identified by type and ID
+type peResource struct {
+	typ, id uint32
+	data    []byte
+}
+
+// readICO reads the images of an .ico file as RT_ICON resources 1, 2, ...
+// and the RT_GROUP_ICON resource 1 that lists them
+func readICO(path string) ([]peResource, error) {
+	ico, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// ICONDIR: reserved, type 1 (icon), number of images
+	if len(ico) < 6 || binary.LittleEndian.Uint16(ico[0:]) != 0 || binary.LittleEndian.Uint16(ico[2:]) != 1 {
+		return nil, fmt.Errorf("%s is not an .ico file", path)
+	}
+	count := int(binary.LittleEndian.Uint16(ico[4:]))
+	if count == 0 || len(ico) < 6+16*count {
+		return nil, fmt.Errorf("%s has no images", path)
+	}
+
+	// GRPICONDIR is ICONDIR with the file offsets replaced by resource IDs,
+	// which makes the entries 14 bytes instead of 16
+	group := append([]byte(nil), ico[:6]...)
+	var resources []peResource
+	for i := 0; i < count; i++ {
+		entry := ico[6+16*i:][:16]
+		size := binary.LittleEndian.Uint32(entry[8:])
+		offset := binary.LittleEndian.Uint32(entry[12:])
+		if uint64(offset)+uint64(size) > uint64(len(ico)) {
+			return nil, fmt.Errorf("%s: image %d is truncated", path, i+1)
+		}
+		id := uint32(i + 1)
+		resources = append(resources, peResource{typ: rtIcon, id: id, data: ico[offset : offset+size]})
+		group = append(group, entry[:12]...)
+		group = binary.LittleEndian.AppendUint16(group, uint16(id))
+	}
+	return append(resources, peResource{typ: rtGroupIcon, id: 1, data: group}), nil
+}
+
+// versionInfo builds the VS_VERSIONINFO resource
+func (o PEOptions) versionInfo(filename string, version [4]uint16) []byte {
+	versionText := fmt.Sprintf("%d.%d.%d.%d", version[0], version[1], version[2], version[3])
+	product := o.Product
+	if product == "" {
+		product = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+	strs := []struct{ key, value string }{
+		{"CompanyName", o.Company},
+		{"FileDescription", o.Description},
+		{"FileVersion", versionText},
+		{"InternalName", strings.TrimSuffix(filename, filepath.Ext(filename))},
+		{"LegalCopyright", o.Copyright},
+		{"OriginalFilename", filename},
+		{"ProductName", product},
+		{"ProductVersion", versionText},
+	}
+	var table [][]byte
+	for _, s := range strs {
+		if s.value == "" {
+			continue
+		}
+		value := utf16z(s.value)
+		table = append(table, versionBlock(s.key, 1, value, uint16(len(value)/2)))
+	}
+
+	ms := uint32(version[0])<<16 | uint32(version[1])
+	ls := uint32(version[2])<<16 | uint32(version[3])
+	fixed := make([]byte, 0, 52)
+	for _, v := range []uint32{
+		0xFEEF04BD, // signature
+		0x00010000, // structure version
+		ms,         // file version: major, minor
+		ls,         // file version: patch, build
+		ms,         // product version: major, minor
+		ls,         // product version: patch, build
+		0x3F,       // valid flags
+		0,          // flags
+		0x00040004, // VOS_NT_WINDOWS32
+		1,          // VFT_APP
+		0,          // subtype
+		0,          // date (high)
+		0,          // date (low)
+	} {
+		fixed = binary.LittleEndian.AppendUint32(fixed, v)
+	}
+
+	translation := binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, peResourceLang), peCodePageUTF16)
+	return versionBlock("VS_VERSION_INFO", 0, fixed, uint16(len(fixed)),
+		versionBlock("StringFileInfo", 1, nil, 0,
+			versionBlock(fmt.Sprintf("%04X%04X", peResourceLang, peCodePageUTF16), 1, nil, 0, table...)),
+		versionBlock("VarFileInfo", 1, nil, 0,
+			versionBlock("Translation", 0, translation, uint16(len(translation)))))
+}
+
+// versionBlock encodes one block of a VERSIONINFO resource: its length,
+// the length of its value (in characters for text), the type (1 for text),
+// the key and the value, then the children, each 4-byte aligned
+func versionBlock(key string, valueType uint16, value []byte, valueLength uint16, children ...[]byte) []byte {
+	b := make([]byte, 2, 64) // the length goes here
+	b = binary.LittleEndian.AppendUint16(b, valueLength)
+	b = binary.LittleEndian.AppendUint16(b, valueType)
+	b = append(b, utf16z(key)...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	b = append(b, value...)
+	for _, child := range children {
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		b = append(b, child...)
+	}
+	binary.LittleEndian.PutUint16(b, uint16(len(b)))
+	return b
+}
+
+// utf16z encodes s as null-terminated UTF-16LE
+func utf16z(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return append(b, 0, 0)
+}
+
+// Confidence that this function is working: 80%
+// BuildPEResources builds the .rsrc section at rsrcRVA. The resource
+// directory has three levels: type, ID and language, with one language per
+// resource. The directories come first, then the data entries, then the
+// data, 8-byte aligned.
+func BuildPEResources(resources []peResource, rsrcRVA uint32) []byte {
+	sorted := append([]peResource(nil), resources...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].typ != sorted[j].typ {
+			return sorted[i].typ < sorted[j].typ
+		}
+		return sorted[i].id < sorted[j].id
+	})
+	var types []uint32
+	byType := make(map[uint32][]peResource)
+	for _, res := range sorted {
+		if len(byType[res.typ]) == 0 {
+			types = append(types, res.typ)
+		}
+		byType[res.typ] = append(byType[res.typ], res)
+	}
+
+	const (
+		dirSize   = 16
+		entrySize = 8
+		dataEntry = 16
+		subdir    = 1 << 31
+	)
+	offset := uint32(dirSize + entrySize*len(types))
+	typeDirs := make(map[uint32]uint32)
+	for _, typ := range types {
+		typeDirs[typ] = offset
+		offset += uint32(dirSize + entrySize*len(byType[typ]))
+	}
+	idDirs := make([]uint32, len(sorted))
+	for i := range sorted {
+		idDirs[i] = offset
+		offset += dirSize + entrySize
+	}
+	dataEntries := offset
+	offset += uint32(dataEntry * len(sorted))
+	dataOffsets := make([]uint32, len(sorted))
+	for i, res := range sorted {
+		offset = alignTo(offset, 8)
+		dataOffsets[i] = offset
+		offset += uint32(len(res.data))
+	}
+
+	buf := make([]byte, offset)
+	directory := func(at uint32, entries int) uint32 {
+		binary.LittleEndian.PutUint16(buf[at+14:], uint16(entries)) // ID entries
+		return at + dirSize
+	}
+	entry := func(at, id, target uint32) {
+		binary.LittleEndian.PutUint32(buf[at:], id)
+		binary.LittleEndian.PutUint32(buf[at+4:], target)
+	}
+
+	at := directory(0, len(types))
+	for _, typ := range types {
+		entry(at, typ, subdir|typeDirs[typ])
+		at += entrySize
+	}
+	i := 0
+	for _, typ := range types {
+		at := directory(typeDirs[typ], len(byType[typ]))
+		for _, res := range byType[typ] {
+			entry(at, res.id, subdir|idDirs[i])
+			at += entrySize
+			entry(directory(idDirs[i], 1), peResourceLang, dataEntries+uint32(dataEntry*i))
+			i++
+		}
+	}
+	for i, res := range sorted {
+		at := dataEntries + uint32(dataEntry*i)
+		binary.LittleEndian.PutUint32(buf[at:], rsrcRVA+dataOffsets[i])
+		binary.LittleEndian.PutUint32(buf[at+4:], uint32(len(res.data)))
+		copy(buf[dataOffsets[i]:], res.data)
+	}
+	return buf
+}
@@ -0,0 +1,247 @@
+// Completion: 85% - Reading the resources of PE files
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// PEResource is a resource read from a PE file. A resource type or ID
+// that is given by a name has the name set and the number 0.
+type PEResource struct {
+	Type     uint32
+	TypeName string
+	ID       uint32
+	Name     string
+	Lang     uint32
+	Data     []byte
+}
+
+// VersionInfo is what a VERSIONINFO resource holds
+type VersionInfo struct {
+	FileVersion    [4]uint16
+	ProductVersion [4]uint16
+	FileType       uint32
+	Strings        map[string]string // from the StringFileInfo tables
+	Translations   []uint32          // language << 16 | code page
+}
+
+// Subsystem returns the subsystem of the image (2 for GUI, 3 for console)
+func (pr *PEReader) Subsystem() uint16 {
+	return pr.optHdr.Subsystem
+}
+
+// GetResources reads the resource directory. The resources are returned in
+// directory order: by type, then ID, then language.
+func (pr *PEReader) GetResources() ([]PEResource, error) {
+	dir := pr.optHdr.DataDirectory[peDirResource]
+	if dir.Size == 0 {
+		return nil, fmt.Errorf("no resource directory")
+	}
+	section := pr.rvaToSection(dir.VirtualAddress)
+	if section == nil {
+		return nil, fmt.Errorf("resource directory RVA not found in any section")
+	}
+	rsrc := make([]byte, section.SizeOfRawData)
+	if _, err := pr.file.ReadAt(rsrc, int64(section.PointerToRawData)); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", section.GetName(), err)
+	}
+	base := dir.VirtualAddress - section.VirtualAddress
+	if base >= uint32(len(rsrc)) {
+		return nil, fmt.Errorf("resource directory outside of %s", section.GetName())
+	}
+	rsrc = rsrc[base:]
+
+	var resources []PEResource
+	// The three levels are type, ID and language
+	var walk func(offset uint32, level int, res PEResource) error
+	walk = func(offset uint32, level int, res PEResource) error {
+		if level > 2 || uint64(offset)+16 > uint64(len(rsrc)) {
+			return fmt.Errorf("bad resource directory at 0x%x", offset)
+		}
+		named := binary.LittleEndian.Uint16(rsrc[offset+12:])
+		ids := binary.LittleEndian.Uint16(rsrc[offset+14:])
+		for i := uint32(0); i < uint32(named)+uint32(ids); i++ {
+			entry := offset + 16 + 8*i
+			if uint64(entry)+8 > uint64(len(rsrc)) {
+				return fmt.Errorf("bad resource directory entry at 0x%x", entry)
+			}
+			nameOrID := binary.LittleEndian.Uint32(rsrc[entry:])
+			target := binary.LittleEndian.Uint32(rsrc[entry+4:])
+
+			var id uint32
+			var name string
+			if nameOrID&(1<<31) != 0 {
+				var err error
+				if name, err = resourceName(rsrc, nameOrID&^(1<<31)); err != nil {
+					return err
+				}
+			} else {
+				id = nameOrID
+			}
+			switch level {
+			case 0:
+				res.Type, res.TypeName = id, name
+			case 1:
+				res.ID, res.Name = id, name
+			case 2:
+				res.Lang = id
+			}
+
+			if target&(1<<31) != 0 {
+				if err := walk(target&^(1<<31), level+1, res); err != nil {
+					return err
+				}
+				continue
+			}
+			if level != 2 || uint64(target)+16 > uint64(len(rsrc)) {
+				return fmt.Errorf("bad resource data entry at 0x%x", target)
+			}
+			rva := binary.LittleEndian.Uint32(rsrc[target:])
+			size := binary.LittleEndian.Uint32(rsrc[target+4:])
+			data := make([]byte, size)
+			if _, err := pr.file.ReadAt(data, int64(pr.rvaToFileOffset(rva))); err != nil {
+				return fmt.Errorf("failed to read resource %d/%d: %v", res.Type, res.ID, err)
+			}
+			res.Data = data
+			resources = append(resources, res)
+		}
+		return nil
+	}
+	if err := walk(0, 0, PEResource{}); err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+// resourceName reads a name of the resource directory: a length followed
+// by that many UTF-16 characters
+func resourceName(rsrc []byte, offset uint32) (string, error) {
+	if uint64(offset)+2 > uint64(len(rsrc)) {
+		return "", fmt.Errorf("bad resource name at 0x%x", offset)
+	}
+	n := uint32(binary.LittleEndian.Uint16(rsrc[offset:]))
+	if uint64(offset)+2+2*uint64(n) > uint64(len(rsrc)) {
+		return "", fmt.Errorf("bad resource name at 0x%x", offset)
+	}
+	chars := make([]uint16, n)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(rsrc[offset+2+2*uint32(i):])
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+// ParseVersionInfo parses a VERSIONINFO resource
+func ParseVersionInfo(data []byte) (*VersionInfo, error) {
+	root, _, err := parseVersionBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	if root.key != "VS_VERSION_INFO" {
+		return nil, fmt.Errorf("not a version resource: %q", root.key)
+	}
+	if len(root.value) < 52 || binary.LittleEndian.Uint32(root.value) != 0xFEEF04BD {
+		return nil, fmt.Errorf("version resource without VS_FIXEDFILEINFO")
+	}
+	u32 := func(i int) uint32 { return binary.LittleEndian.Uint32(root.value[4*i:]) }
+	info := &VersionInfo{
+		FileVersion:    [4]uint16{uint16(u32(2) >> 16), uint16(u32(2)), uint16(u32(3) >> 16), uint16(u32(3))},
+		ProductVersion: [4]uint16{uint16(u32(4) >> 16), uint16(u32(4)), uint16(u32(5) >> 16), uint16(u32(5))},
+		FileType:       u32(9),
+		Strings:        make(map[string]string),
+	}
+	for _, child := range root.children {
+		switch child.key {
+		case "StringFileInfo":
+			for _, table := range child.children {
+				for _, s := range table.children {
+					info.Strings[s.key] = s.text()
+				}
+			}
+		case "VarFileInfo":
+			for _, v := range child.children {
+				if v.key != "Translation" {
+					continue
+				}
+				for i := 0; i+4 <= len(v.value); i += 4 {
+					lang := uint32(binary.LittleEndian.Uint16(v.value[i:]))
+					codePage := uint32(binary.LittleEndian.Uint16(v.value[i+2:]))
+					info.Translations = append(info.Translations, lang<<16|codePage)
+				}
+			}
+		}
+	}
+	return info, nil
+}
+
+// versionBlockData is a parsed block of a VERSIONINFO resource
+type versionBlockData struct {
+	key      string
+	isText   bool
+	value    []byte
+	children []versionBlockData
+}
+
+// text decodes the value of a text block
+func (b versionBlockData) text() string {
+	chars := make([]uint16, len(b.value)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(b.value[2*i:])
+	}
+	return strings.TrimRight(string(utf16.Decode(chars)), "\x00")
+}
+
+// parseVersionBlock parses the block at the start of data and returns it
+// with its length (see versionBlock in pe_resources.go)
+func parseVersionBlock(data []byte) (versionBlockData, int, error) {
+	var b versionBlockData
+	if len(data) < 6 {
+		return b, 0, fmt.Errorf("truncated version block")
+	}
+	length := int(binary.LittleEndian.Uint16(data))
+	valueLength := int(binary.LittleEndian.Uint16(data[2:]))
+	b.isText = binary.LittleEndian.Uint16(data[4:]) == 1
+	if length < 6 || length > len(data) {
+		return b, 0, fmt.Errorf("bad version block length %d", length)
+	}
+	data = data[:length]
+
+	// The key is null-terminated UTF-16
+	pos := 6
+	var key []uint16
+	for ; pos+2 <= length; pos += 2 {
+		c := binary.LittleEndian.Uint16(data[pos:])
+		if c == 0 {
+			break
+		}
+		key = append(key, c)
+	}
+	b.key = string(utf16.Decode(key))
+	pos = align4(pos + 2)
+
+	if b.isText {
+		valueLength *= 2
+	}
+	if pos+valueLength > length {
+		return b, 0, fmt.Errorf("version block %q: value beyond its end", b.key)
+	}
+	b.value = data[pos : pos+valueLength]
+	pos = align4(pos + valueLength)
+
+	for pos < length {
+		child, n, err := parseVersionBlock(data[pos:])
+		if err != nil {
+			return b, 0, err
+		}
+		b.children = append(b.children, child)
+		pos = align4(pos + n)
+	}
+	return b, length, nil
+}
+
+// align4 rounds n up to a multiple of 4
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
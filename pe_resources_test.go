@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testICO builds an .ico file with one image of each size, the image data
+// being filled with the size
+func testICO(sizes ...byte) []byte {
+	var ico []byte
+	ico = binary.LittleEndian.AppendUint16(ico, 0)
+	ico = binary.LittleEndian.AppendUint16(ico, 1)
+	ico = binary.LittleEndian.AppendUint16(ico, uint16(len(sizes)))
+	offset := 6 + 16*len(sizes)
+	var images []byte
+	for _, size := range sizes {
+		image := bytes.Repeat([]byte{size}, 40+int(size))
+		ico = append(ico, size, size, 0, 0)
+		ico = binary.LittleEndian.AppendUint16(ico, 1)  // planes
+		ico = binary.LittleEndian.AppendUint16(ico, 32) // bits per pixel
+		ico = binary.LittleEndian.AppendUint32(ico, uint32(len(image)))
+		ico = binary.LittleEndian.AppendUint32(ico, uint32(offset+len(images)))
+		images = append(images, image...)
+	}
+	return append(ico, images...)
+}
+
+func TestPEResources(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "game.v67")
+	if err := os.WriteFile(src, []byte("println(\"hello\")\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	icon := filepath.Join(dir, "game.ico")
+	if err := os.WriteFile(icon, testICO(16, 32), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(opts PEOptions) { WindowsOptions = opts }(WindowsOptions)
+	WindowsOptions = PEOptions{
+		Subsystem:   "windows",
+		Icon:        icon,
+		Version:     "1.2.3",
+		Description: "A game",
+		Company:     "Vibe Games",
+	}
+	exe := filepath.Join(dir, "game.exe")
+	if err := CompileC67(src, exe, Platform{Arch: ArchX86_64, OS: OSWindows}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := pe.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub := f.OptionalHeader.(*pe.OptionalHeader64).Subsystem; sub != pe.IMAGE_SUBSYSTEM_WINDOWS_GUI {
+		t.Errorf("subsystem = %d, want GUI", sub)
+	}
+	if s := f.Section(".rsrc"); s == nil || s.Characteristics&pe.IMAGE_SCN_MEM_WRITE != 0 {
+		t.Errorf("no read-only .rsrc section")
+	}
+	f.Close()
+
+	pr, err := OpenPE(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	if pr.Subsystem() != peSubsystemGUI {
+		t.Errorf("PEReader subsystem = %d", pr.Subsystem())
+	}
+	resources, err := pr.GetResources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byType := make(map[uint32][]PEResource)
+	for _, res := range resources {
+		if res.Lang != peResourceLang {
+			t.Errorf("resource %d/%d has language %x", res.Type, res.ID, res.Lang)
+		}
+		byType[res.Type] = append(byType[res.Type], res)
+	}
+
+	ico := testICO(16, 32)
+	icons := byType[rtIcon]
+	if len(icons) != 2 || icons[0].ID != 1 || icons[1].ID != 2 ||
+		!bytes.Equal(icons[0].Data, bytes.Repeat([]byte{16}, 56)) ||
+		!bytes.Equal(icons[1].Data, bytes.Repeat([]byte{32}, 72)) {
+		t.Errorf("icons = %+v", icons)
+	}
+	if groups := byType[rtGroupIcon]; len(groups) != 1 {
+		t.Errorf("%d icon groups", len(groups))
+	} else {
+		group := groups[0].Data
+		if len(group) != 6+14*2 || !bytes.Equal(group[:6], ico[:6]) ||
+			!bytes.Equal(group[6:18], ico[6:18]) || binary.LittleEndian.Uint16(group[18:]) != 1 ||
+			!bytes.Equal(group[20:32], ico[22:34]) || binary.LittleEndian.Uint16(group[32:]) != 2 {
+			t.Errorf("icon group = % x", group)
+		}
+	}
+
+	if versions := byType[rtVersion]; len(versions) != 1 {
+		t.Errorf("%d version resources", len(versions))
+	} else {
+		info, err := ParseVersionInfo(versions[0].Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.FileVersion != [4]uint16{1, 2, 3, 0} || info.ProductVersion != info.FileVersion {
+			t.Errorf("versions = %v, %v", info.FileVersion, info.ProductVersion)
+		}
+		want := map[string]string{
+			"CompanyName":      "Vibe Games",
+			"FileDescription":  "A game",
+			"FileVersion":      "1.2.3.0",
+			"InternalName":     "game",
+			"OriginalFilename": "game.exe",
+			"ProductName":      "game",
+			"ProductVersion":   "1.2.3.0",
+		}
+		for key, value := range want {
+			if info.Strings[key] != value {
+				t.Errorf("%s = %q, want %q", key, info.Strings[key], value)
+			}
+		}
+		if _, ok := info.Strings["LegalCopyright"]; ok {
+			t.Errorf("empty LegalCopyright is included")
+		}
+		if len(info.Translations) != 1 || info.Translations[0] != 0x040904B0 {
+			t.Errorf("translations = %x", info.Translations)
+		}
+	}
+
+	if manifests := byType[rtManifest]; len(manifests) != 1 {
+		t.Errorf("%d manifests", len(manifests))
+	} else {
+		for _, want := range []string{"<dpiAwareness", ">PerMonitorV2<", "<activeCodePage", ">UTF-8<", `level="asInvoker"`} {
+			if !strings.Contains(string(manifests[0].Data), want) {
+				t.Errorf("manifest lacks %s", want)
+			}
+		}
+	}
+}
+
+func TestPEOptions(t *testing.T) {
+	tests := []struct {
+		opts PEOptions
+		want string // the start of the error, if any
+	}{
+		{PEOptions{}, ""},
+		{PEOptions{Subsystem: "console", Version: "2"}, ""},
+		{PEOptions{Subsystem: "windows", Version: "v1.2.3.4"}, ""},
+		{PEOptions{Subsystem: "gui"}, `unknown subsystem "gui"`},
+		{PEOptions{Version: "1.2.3.4.5"}, `version "1.2.3.4.5" has more than four numbers`},
+		{PEOptions{Version: "1.x"}, `version "1.x": "x" is not a number`},
+		{PEOptions{Icon: "missing.ico"}, "open missing.ico"},
+	}
+	for _, tt := range tests {
+		_, err := tt.opts.imageOptions("game.exe")
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if (tt.want == "") != (got == "") || !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%+v: got %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+
+	m, err := ParseManifest("/project/vibe67.toml", `[windows]
+subsystem = "windows"
+icon = "assets/game.ico"
+version = "1.0"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Windows.Subsystem != "windows" || m.Windows.Icon != "/project/assets/game.ico" || m.Windows.Version != "1.0" {
+		t.Errorf("manifest [windows] = %+v", m.Windows)
+	}
+	merged := PEOptions{Subsystem: "console"}.merge(m.Windows)
+	if merged.Subsystem != "console" || merged.Version != "1.0" {
+		t.Errorf("merged options = %+v", merged)
+	}
+	if _, err := ParseManifest("vibe67.toml", "[windows]\nsubsystem = \"gui\"\n"); err == nil {
+		t.Errorf("bad subsystem in manifest accepted")
+	}
+}
@@ -0,0 +1,393 @@
+// Completion: 80% - Persistent lists and maps (x86-64)
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Persistent lists and maps
+//
+// A list that another variable can see is copied on every append (see
+// ownership.go), and an update to a map has to copy it for the same reason.
+// When a binding is appended to or updated while the old value may be kept
+// elsewhere, the compiler keeps the binding as a persistent trie instead (see
+// persistent_runtime.go): an append or update copies the nodes on the path to
+// the change, O(log n) of them, and shares the rest with the old value.
+//
+// The binding holds the trie's header rather than a flat list. Indexing and #
+// read the trie directly, and assigning the binding to another such binding
+// shares the header. Every other use reads a flat copy, so the rest of the
+// code never sees a trie.
+//
+// A binding defined with := edits in place the nodes it created itself, so a
+// loop that only ever updates it copies no more than a flat list would. Once
+// the header is shared with another binding, neither owns it any more, and
+// the next edit of either copies the nodes it changes.
+//
+// This applies to xs = append(xs, v), xs <- append(xs, v) and m[k] <- v when
+// the binding is defined with a list or map literal earlier in the same
+// function, is not a parameter, is not used by a nested function or in a
+// parallel loop, and does not append in place anyway.
+
+// PersistentBindings records the bindings kept as tries, per function body
+type PersistentBindings struct {
+	top    map[string]*persistentName
+	scopes map[Expression]map[string]*persistentName
+}
+
+// persistentName is a binding kept as a trie
+type persistentName struct {
+	kind    string // "list" or "map"
+	mutable bool   // defined with := and edited in place
+}
+
+// persistentScope is a function body, or the top level
+type persistentScope struct {
+	parent *persistentScope
+	body   Expression
+	opaque bool // a pattern lambda, whose bindings are not modeled
+	params map[string]bool
+	names  map[string]*persistentUse
+}
+
+// persistentUse is what a scope does with one name
+type persistentUse struct {
+	appends  int
+	updates  int
+	values   []Expression // the values of every other assignment
+	defined  bool         // assigned before its first edit
+	mutable  bool
+	excluded bool // used in a way that reads the binding's slot directly
+}
+
+// newPersistentBindings finds the bindings to keep as tries
+func newPersistentBindings(program *Program, lo *ListOwnership) *PersistentBindings {
+	pb := &PersistentBindings{scopes: make(map[Expression]map[string]*persistentName)}
+	top := newPersistentScope(nil, nil)
+	scopes := []*persistentScope{top}
+	scopeIDs := map[string]*persistentScope{"": top}
+	parallel := make(map[string]bool)
+
+	walkProfileSites(reflect.ValueOf(program), "", func(node interface{}, id string) string {
+		scope := scopeIDs[id]
+		switch n := node.(type) {
+		case *LambdaExpr:
+			inner := newPersistentScope(scope, n.Body)
+			for _, param := range n.Params {
+				inner.params[param] = true
+			}
+			if n.VariadicParam != "" {
+				inner.params[n.VariadicParam] = true
+			}
+			id = fmt.Sprintf("%p", n)
+			scopeIDs[id] = inner
+			scopes = append(scopes, inner)
+		case *PatternLambdaExpr, *MultiLambdaExpr:
+			inner := newPersistentScope(scope, nil)
+			inner.opaque = true
+			id = fmt.Sprintf("%p", n)
+			scopeIDs[id] = inner
+		case *LoopStmt:
+			scope.name(n.Iterator).excluded = true
+			if n.NumThreads != 0 {
+				id = parallelScope(scopeIDs, parallel, scope, n)
+			}
+		case *LoopExpr:
+			scope.name(n.Iterator).excluded = true
+			if n.NumThreads != 0 {
+				id = parallelScope(scopeIDs, parallel, scope, n)
+			}
+		case *WhileStmt:
+			if n.NumThreads != 0 {
+				id = parallelScope(scopeIDs, parallel, scope, n)
+			}
+		case *ReceiveLoopStmt:
+			scope.name(n.MessageVar).excluded = true
+			scope.name(n.SenderVar).excluded = true
+		case *SpawnStmt:
+			for _, param := range n.Params {
+				scope.name(param).excluded = true
+			}
+		case *MultipleAssignStmt:
+			for _, name := range n.Names {
+				scope.name(name).excluded = true
+			}
+		case *AssignStmt:
+			use := scope.name(n.Name)
+			use.mutable = use.mutable || n.Mutable || n.IsUpdate
+			if parallel[id] {
+				use.excluded = true
+			}
+			if selfAppend(n) != nil {
+				use.appends++
+				if lo.Push(n) {
+					use.excluded = true
+				}
+			} else {
+				use.defined = use.defined || use.appends+use.updates == 0
+				use.values = append(use.values, n.Value)
+			}
+		case *MapUpdateStmt:
+			use := scope.name(n.MapName)
+			use.updates++
+			if parallel[id] {
+				use.excluded = true
+			}
+		case *CastExpr:
+			excludeIdent(scope, n.Expr)
+		case *PostfixExpr:
+			excludeIdent(scope, n.Operand)
+		case *CallExpr:
+			scope.name(n.Function).excluded = true
+		case *IdentExpr:
+			if parallel[id] {
+				scope.name(n.Name).excluded = true
+			}
+			for outer := scope.parent; outer != nil; outer = outer.parent {
+				outer.name(n.Name).excluded = true
+			}
+		}
+		return id
+	})
+
+	for _, scope := range scopes {
+		if scope.opaque {
+			continue
+		}
+		kinds := make(map[string]string)
+		for name, use := range scope.names {
+			if !use.defined || use.excluded || scope.params[name] {
+				continue
+			}
+			if use.appends > 0 && use.updates == 0 {
+				kinds[name] = "list"
+			} else if use.updates > 0 && use.appends == 0 && use.mutable {
+				kinds[name] = "map"
+			}
+		}
+
+		// A binding assigned from another binding is one only if that one is
+		// too, so drop names until nothing changes
+		for changed := true; changed; {
+			changed = false
+			for name, kind := range kinds {
+				for _, value := range scope.names[name].values {
+					if !persistentValue(value, kind, kinds) {
+						delete(kinds, name)
+						changed = true
+						break
+					}
+				}
+			}
+		}
+
+		if len(kinds) > 0 {
+			names := make(map[string]*persistentName)
+			for name, kind := range kinds {
+				names[name] = &persistentName{kind: kind, mutable: scope.names[name].mutable}
+			}
+			if scope == top {
+				pb.top = names
+			} else {
+				pb.scopes[scope.body] = names
+			}
+		}
+	}
+	return pb
+}
+
+func newPersistentScope(parent *persistentScope, body Expression) *persistentScope {
+	return &persistentScope{parent: parent, body: body, params: map[string]bool{}, names: map[string]*persistentUse{}}
+}
+
+// parallelScope gives a parallel loop an id of its own, in the same scope
+func parallelScope(scopeIDs map[string]*persistentScope, parallel map[string]bool, scope *persistentScope, loop interface{}) string {
+	id := fmt.Sprintf("%p", loop)
+	scopeIDs[id] = scope
+	parallel[id] = true
+	return id
+}
+
+func (s *persistentScope) name(name string) *persistentUse {
+	use := s.names[name]
+	if use == nil {
+		use = &persistentUse{}
+		s.names[name] = use
+	}
+	return use
+}
+
+func excludeIdent(scope *persistentScope, expr Expression) {
+	if ident, ok := expr.(*IdentExpr); ok {
+		scope.name(ident.Name).excluded = true
+	}
+}
+
+// persistentValue reports whether a binding of the kind may be assigned the
+// value: a literal, or another such binding
+func persistentValue(value Expression, kind string, kinds map[string]string) bool {
+	switch v := value.(type) {
+	case *ListExpr:
+		return kind == "list"
+	case *MapExpr:
+		return kind == "map"
+	case *CallExpr:
+		return kind == "list" && v.Function == "append"
+	case *IdentExpr:
+		return kinds[v.Name] == kind
+	}
+	return false
+}
+
+// Used reports whether any binding is kept as a trie
+func (pb *PersistentBindings) Used() bool {
+	return pb != nil && (len(pb.top) > 0 || len(pb.scopes) > 0)
+}
+
+// persistentBinding returns the trie binding of a name in the function being
+// compiled, or nil
+func (fc *C67Compiler) persistentBinding(name string) *persistentName {
+	if fc.persistent == nil {
+		return nil
+	}
+	if fc.currentLambda == nil {
+		return fc.persistent.top[name]
+	}
+	return fc.persistent.scopes[fc.currentLambda.Body][name]
+}
+
+// persistentIdent returns expr and its binding when expr names a trie
+// binding, or nil
+func (fc *C67Compiler) persistentIdent(expr Expression) (*IdentExpr, *persistentName) {
+	ident, ok := expr.(*IdentExpr)
+	if !ok {
+		return nil, nil
+	}
+	return ident, fc.persistentBinding(ident.Name)
+}
+
+// persistentMode is the edit mode of _vibe67_plist_push and _vibe67_pmap_set
+func (p *persistentName) persistentMode() string {
+	if p.mutable {
+		return "1"
+	}
+	return "0"
+}
+
+// compilePersistentAssign compiles an assignment to a trie binding at
+// base-offset, or to the global when base is empty, leaving the header in
+// xmm0
+func (fc *C67Compiler) compilePersistentAssign(s *AssignStmt, p *persistentName, base string, offset int) {
+	if list := selfAppend(s); list != nil {
+		fc.compileExpression(s.Value.(*CallExpr).Args[1])
+		fc.listBindingAddress("rdi", s.Name, base, offset)
+		fc.out.MovImmToReg("rsi", p.persistentMode())
+		fc.callPersistent("_vibe67_plist_push")
+		fc.listBindingAddress("rax", s.Name, base, offset)
+		fc.out.MovMemToXmm("xmm0", "rax", 0)
+		return
+	}
+
+	if ident, ok := s.Value.(*IdentExpr); ok {
+		// Share the header. The source stops owning it, so that neither
+		// binding changes the other's nodes in place.
+		source := fc.persistentBinding(ident.Name)
+		sourceBase, sourceOffset := fc.persistentSlot(ident.Name)
+		fc.listBindingAddress("rax", ident.Name, sourceBase, sourceOffset)
+		fc.out.MovMemToXmm("xmm0", "rax", 0)
+		fc.listBindingAddress("rax", s.Name, base, offset)
+		fc.out.MovXmmToMem("xmm0", "rax", 0)
+		if source.mutable {
+			fc.releasePersistentBinding(ident.Name, sourceBase, sourceOffset)
+		}
+	} else {
+		fc.currentAssignName = s.Name
+		fc.compileExpression(s.Value)
+		fc.currentAssignName = ""
+		fc.out.MovqXmmToReg("rdi", "xmm0")
+		if p.kind == "list" {
+			fc.callPersistent("_vibe67_plist_from_flat")
+		} else {
+			fc.callPersistent("_vibe67_pmap_from_flat")
+		}
+		fc.listBindingAddress("rdi", s.Name, base, offset)
+		fc.out.MovRegToMem("rax", "rdi", 0)
+	}
+	if p.mutable {
+		fc.releasePersistentBinding(s.Name, base, offset)
+	}
+	fc.listBindingAddress("rax", s.Name, base, offset)
+	fc.out.MovMemToXmm("xmm0", "rax", 0)
+}
+
+// compilePersistentUpdate compiles m[k] <- v for a trie binding
+func (fc *C67Compiler) compilePersistentUpdate(s *MapUpdateStmt, p *persistentName) {
+	base, offset := fc.persistentSlot(s.MapName)
+	fc.compileExpression(s.Index)
+	fc.out.SubImmFromReg("rsp", 16)
+	fc.out.MovXmmToMem("xmm0", "rsp", 0)
+	fc.compileExpression(s.Value)
+	fc.out.MovMemToReg("rsi", "rsp", 0)
+	fc.out.AddImmToReg("rsp", 16)
+	fc.listBindingAddress("rdi", s.MapName, base, offset)
+	fc.out.MovImmToReg("rdx", p.persistentMode())
+	fc.callPersistent("_vibe67_pmap_set")
+}
+
+// compilePersistentIndex compiles xs[i] or m[k] for a trie binding
+func (fc *C67Compiler) compilePersistentIndex(ident *IdentExpr, index Expression, p *persistentName) {
+	fc.compileExpression(index)
+	if p.kind == "list" {
+		fc.out.Cvttsd2si("rsi", "xmm0")
+	} else {
+		fc.out.MovqXmmToReg("rsi", "xmm0")
+	}
+	base, offset := fc.persistentSlot(ident.Name)
+	fc.listBindingAddress("rdi", ident.Name, base, offset)
+	fc.out.MovMemToReg("rdi", "rdi", 0)
+	if p.kind == "list" {
+		fc.callPersistent("_vibe67_plist_get")
+	} else {
+		fc.callPersistent("_vibe67_pmap_get")
+	}
+}
+
+// compilePersistentLength compiles #xs for a trie binding
+func (fc *C67Compiler) compilePersistentLength(ident *IdentExpr) {
+	base, offset := fc.persistentSlot(ident.Name)
+	fc.listBindingAddress("rax", ident.Name, base, offset)
+	fc.out.MovMemToReg("rax", "rax", 0)
+	fc.out.MovMemToReg("rax", "rax", plistCount) // pmapCount too
+	fc.out.Cvtsi2sd("xmm0", "rax")
+}
+
+// flattenPersistent turns the header of a trie binding in xmm0 into a flat
+// list or map
+func (fc *C67Compiler) flattenPersistent(p *persistentName) {
+	fc.out.MovqXmmToReg("rdi", "xmm0")
+	if p.kind == "list" {
+		fc.callPersistent("_vibe67_plist_flatten")
+	} else {
+		fc.callPersistent("_vibe67_pmap_flatten")
+	}
+	fc.out.MovqRegToXmm("xmm0", "rax")
+}
+
+// releasePersistentBinding drops the ownership of a binding's header
+func (fc *C67Compiler) releasePersistentBinding(name, base string, offset int) {
+	fc.out.LeaSymbolToReg("rdi", "_vibe67_persistent_owners")
+	fc.out.MovMemToReg("rdi", "rdi", 0)
+	fc.listBindingAddress("rsi", name, base, offset)
+	fc.trackFunctionCall("_vibe67_map_delete")
+	fc.out.CallSymbol("_vibe67_map_delete")
+}
+
+// persistentSlot returns where a trie binding lives, as for
+// listBindingAddress
+func (fc *C67Compiler) persistentSlot(name string) (string, int) {
+	if _, isGlobal := fc.globalVars[name]; isGlobal && !fc.lambdaParams[name] {
+		return "", 0
+	}
+	return "rbp", fc.variables[name]
+}
@@ -0,0 +1,942 @@
+// Completion: 85% - Persistent list and map runtime (x86-64)
+package main
+
+import "fmt"
+
+// Persistent list and map runtime
+//
+// Lists are 32-way tries with a tail, like Clojure's vectors:
+//
+//	header: [owner:8][count:8][shift:8][root:8][tail:8]
+//	node:   [owner:8][32 slots of 8 bytes]
+//
+// The last 1 to 32 values live in the tail, all others in the leaves of the
+// trie under root, which has shift/5 levels of inner nodes. Appending writes
+// to the tail, and a full tail moves into the trie.
+//
+// Maps are hash array mapped tries keyed on mapHash (see hashmap.go), five
+// bits of the hash per level:
+//
+//	header: [owner:8][count:8][root:8]
+//	node:   [owner:8][datamap:4][nodemap:4][entry:16]...
+//
+// A node has one 16-byte entry per bit set in datamap|nodemap, in bit order:
+// [key][value] for the bits of datamap and [child][0] for those of nodemap.
+// mapHash is a bijection, so two keys always part before the hash runs out
+// and there are no collision nodes. Keys are compared as raw 64-bit patterns
+// after turning -0.0 into 0.0.
+//
+// An edit copies the nodes on the path to the change, unless the edit token
+// owns them: a node whose owner word equals a non-zero token is changed in
+// place. Persistent edits use token 0 and copy every node on the path. A
+// mutable binding edits with the header it owns as the token (see
+// persistent.go), so a run of edits to a binding that nothing else can see
+// copies each node at most once.
+//
+// Nodes come from a bump allocator that takes 1MB chunks from the OS and
+// never frees or moves them. The functions use the System V registers on
+// every OS, since only generated code calls them:
+//
+//	_vibe67_plist_push(rdi = &binding, xmm0 = value, rsi = mode)
+//	_vibe67_plist_get(rdi = list, rsi = index) -> xmm0
+//	_vibe67_plist_flatten(rdi = list) -> rax = flat list
+//	_vibe67_plist_from_flat(rdi = flat list) -> rax = list
+//	_vibe67_pmap_set(rdi = &binding, rsi = key, xmm0 = value, rdx = mode)
+//	_vibe67_pmap_get(rdi = map, rsi = key) -> xmm0
+//	_vibe67_pmap_flatten(rdi = map) -> rax = flat map
+//	_vibe67_pmap_from_flat(rdi = flat map) -> rax = map
+//
+// Mode 0 edits persistently, mode 1 in place where the binding owns the
+// nodes. A get of a missing index or key gives 0.0. The count is at offset 8
+// of both headers. get and flatten keep every register but rax and xmm0.
+
+const (
+	plistCount      = 8
+	plistShift      = 16
+	plistRoot       = 24
+	plistTail       = 32
+	plistHeaderSize = 40
+	plistNodeSize   = 8 + 32*8
+
+	pmapCount      = 8
+	pmapRoot       = 16
+	pmapHeaderSize = 24
+	pmapDatamap    = 8
+	pmapNodemap    = 12
+	pmapNodeHeader = 16
+
+	persistentChunkSize = 1 << 20
+)
+
+// generatePersistentRuntime emits the persistent list and map functions
+func (fc *C67Compiler) generatePersistentRuntime() {
+	fc.generatePersistentAlloc()
+	fc.generatePersistentCopy()
+	fc.generatePersistentBegin()
+	fc.generatePlistAppend()
+	fc.generatePlistPush()
+	fc.generatePlistLeaf()
+	fc.generatePlistGet()
+	fc.generatePlistFlatten()
+	fc.generatePlistFromFlat()
+	fc.generatePmapFind()
+	fc.generatePmapGet()
+	fc.generatePmapInsert()
+	fc.generatePmapSet()
+	fc.generatePmapWalk()
+	fc.generatePmapFlatten()
+	fc.generatePmapFromFlat()
+}
+
+func (fc *C67Compiler) pushRegs(regs []string) {
+	for _, reg := range regs {
+		fc.out.PushReg(reg)
+	}
+}
+
+func (fc *C67Compiler) popRegs(regs []string) {
+	for i := len(regs) - 1; i >= 0; i-- {
+		fc.out.PopReg(regs[i])
+	}
+}
+
+// callPersistent calls one of the functions of this file
+func (fc *C67Compiler) callPersistent(name string) {
+	fc.trackFunctionCall(name)
+	fc.out.CallSymbol(name)
+}
+
+// emitPopcount32 counts the bits of the low 32 bits of reg, clobbering tmp
+func (fc *C67Compiler) emitPopcount32(reg, tmp string) {
+	fc.out.MovRegToReg(tmp, reg)
+	fc.out.ShrRegByImm(tmp, 1)
+	fc.out.AndRegWithImm(tmp, 0x55555555)
+	fc.out.SubRegFromReg(reg, tmp)
+	fc.out.MovRegToReg(tmp, reg)
+	fc.out.ShrRegByImm(tmp, 2)
+	fc.out.AndRegWithImm(tmp, 0x33333333)
+	fc.out.AndRegWithImm(reg, 0x33333333)
+	fc.out.AddRegToReg(reg, tmp)
+	fc.out.MovRegToReg(tmp, reg)
+	fc.out.ShrRegByImm(tmp, 4)
+	fc.out.AddRegToReg(reg, tmp)
+	fc.out.AndRegWithImm(reg, 0x0f0f0f0f)
+	fc.out.ImulImmToReg(reg, 0x01010101)
+	fc.out.ShrRegByImm(reg, 24)
+	fc.out.AndRegWithImm(reg, 0xff)
+}
+
+// emitNormalizeKey turns the key -0.0 in reg into 0.0, clobbering rax
+func (fc *C67Compiler) emitNormalizeKey(reg string) {
+	fc.out.MovRegToReg("rax", reg)
+	fc.out.AddRegToReg("rax", "rax")
+	nonZero := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpNotEqual, 0)
+	fc.out.XorRegWithReg(reg, reg)
+	fc.patchJumpOffset(nonZero+2, fc.eb.text.Len())
+}
+
+// emitListTailOffset sets dst to the index of the first value in the tail
+// of a list of count values
+func (fc *C67Compiler) emitListTailOffset(dst, count string) {
+	fc.out.XorRegWithReg(dst, dst)
+	fc.out.CmpRegToImm(count, 32)
+	short := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpBelow, 0)
+	fc.out.MovRegToReg(dst, count)
+	fc.out.DecReg(dst)
+	fc.out.ShrRegByImm(dst, 5)
+	fc.out.ShlRegByImm(dst, 5)
+	fc.patchJumpOffset(short+2, fc.eb.text.Len())
+}
+
+// emitPmapSlot sets r10 to the bit of the hash in r15 at the level in r11,
+// rdx to the node's datamap, rcx to its nodemap and rax to the address of
+// the entry for the bit in the node at r9. rsi is clobbered.
+func (fc *C67Compiler) emitPmapSlot(hash string) {
+	fc.out.MovRegToReg("rcx", "r11")
+	fc.out.MovRegToReg("rax", hash)
+	fc.out.ShrClReg("rax", "cl")
+	fc.out.AndRegWithImm("rax", 31)
+	fc.out.MovRegToReg("rcx", "rax")
+	fc.out.MovImmToReg("r10", "1")
+	fc.out.ShlClReg("r10", "cl")
+	fc.out.MovU32MemToReg("rdx", "r9", pmapDatamap)
+	fc.out.MovU32MemToReg("rcx", "r9", pmapNodemap)
+	fc.out.MovRegToReg("rax", "r10")
+	fc.out.DecReg("rax")
+	fc.out.MovRegToReg("rsi", "rdx")
+	fc.out.OrRegWithReg("rsi", "rcx")
+	fc.out.AndRegWithReg("rax", "rsi")
+	fc.emitPopcount32("rax", "rsi")
+	fc.out.ShlRegByImm("rax", 4)
+	fc.out.AddRegToReg("rax", "r9")
+	fc.out.AddImmToReg("rax", pmapNodeHeader)
+}
+
+// generatePersistentAlloc emits _vibe67_persistent_alloc(rdi = size) -> rax,
+// zeroed memory that is never freed. Keeps every other register.
+func (fc *C67Compiler) generatePersistentAlloc() {
+	fc.eb.MarkLabel("_vibe67_persistent_alloc")
+	saved := []string{"rcx", "rdx", "rsi", "rdi", "r8", "r9", "r10", "r11"}
+	fc.pushRegs(saved)
+	fc.out.LeaSymbolToReg("rdx", "_vibe67_persistent_heap")
+	fc.out.MovMemToReg("rax", "rdx", 0)
+	fc.out.LeaMemToReg("rcx", "rax", 0)
+	fc.out.AddRegToReg("rcx", "rdi")
+	fc.out.CmpRegToReg("rcx", "rax")
+	wrapped := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpBelow, 0)
+	fc.out.MovMemToReg("rsi", "rdx", 8)
+	fc.out.CmpRegToReg("rcx", "rsi")
+	full := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpAbove, 0)
+	fc.out.TestRegReg("rax", "rax")
+	first := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovRegToMem("rcx", "rdx", 0)
+
+	// Zero the allocation, since Windows chunks come from malloc
+	zero := fc.eb.text.Len()
+	fc.out.MovRegToReg("rdx", "rax")
+	fc.out.MovRegToReg("rcx", "rdi")
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.out.Emit([]byte{0xf3, 0xaa}) // rep stosb
+	fc.out.MovRegToReg("rax", "rdx")
+	fc.popRegs(saved)
+	fc.out.Ret()
+
+	// Take a new chunk of at least the size
+	fc.patchJumpOffset(wrapped+2, fc.eb.text.Len())
+	fc.patchJumpOffset(full+2, fc.eb.text.Len())
+	fc.patchJumpOffset(first+2, fc.eb.text.Len())
+	fc.out.PushReg("rbp")
+	fc.out.PushReg("rbx")
+	fc.out.MovRegToReg("rbp", "rsp")
+	fc.out.AndRegWithImm("rsp", -16) // malloc on Windows
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.out.MovImmToReg("rsi", fmt.Sprintf("%d", persistentChunkSize))
+	fc.out.CmpRegToReg("rbx", "rsi")
+	fc.out.Cmova("rsi", "rbx")
+	fc.out.PushReg("rsi")
+	fc.out.PushReg("rsi")
+	fc.allocateMemoryPlatform("rsi")
+	fc.out.PopReg("rsi")
+	fc.out.PopReg("rsi")
+	fc.out.LeaSymbolToReg("rdx", "_vibe67_persistent_heap")
+	fc.out.AddRegToReg("rsi", "rax")
+	fc.out.MovRegToMem("rsi", "rdx", 8)
+	fc.out.LeaMemToReg("rcx", "rax", 0)
+	fc.out.AddRegToReg("rcx", "rbx")
+	fc.out.MovRegToMem("rcx", "rdx", 0)
+	fc.out.MovRegToReg("rdi", "rbx")
+	fc.out.MovRegToReg("rsp", "rbp")
+	fc.out.PopReg("rbx")
+	fc.out.PopReg("rbp")
+	fc.out.JumpUnconditional(int32(zero - (fc.eb.text.Len() + 5)))
+}
+
+// generatePersistentCopy emits _vibe67_persistent_copy(rdi = node,
+// rsi = size, rdx = owner) -> rax, a copy of the node owned by owner. Keeps
+// every other register.
+func (fc *C67Compiler) generatePersistentCopy() {
+	fc.eb.MarkLabel("_vibe67_persistent_copy")
+	saved := []string{"rcx", "rsi", "rdi"}
+	fc.pushRegs(saved)
+	fc.out.MovRegToReg("rcx", "rsi")
+	fc.out.PushReg("rdi")
+	fc.out.MovRegToReg("rdi", "rsi")
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.PopReg("rsi")
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.out.RepMovsb()
+	fc.out.MovRegToMem("rdx", "rax", 0)
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
+
+// generatePersistentBegin emits _vibe67_persistent_begin(rdi = &binding,
+// rsi = header size, rdx = mode) -> rax, the header of the binding's value
+// that the edit may change. In mode 0 that is a copy owned by nobody. In
+// mode 1 it is the header itself if the binding owns it, and otherwise a
+// copy that owns itself and that the binding owns from now on (recorded in
+// _vibe67_persistent_owners). Keeps every other register but xmm0 and xmm1.
+func (fc *C67Compiler) generatePersistentBegin() {
+	fc.eb.MarkLabel("_vibe67_persistent_begin")
+	saved := []string{"rbx", "rcx", "rdx", "rsi", "rdi", "r8", "r9", "r10", "r11", "r12", "rbp"}
+	fc.pushRegs(saved)
+	fc.out.MovRegToReg("rbp", "rsp")
+	fc.out.AndRegWithImm("rsp", -16) // malloc on Windows
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.out.MovRegToReg("r12", "rsi")
+	fc.out.MovRegToReg("r8", "rdx")
+	fc.out.TestRegReg("r8", "r8")
+	persistent := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+
+	// Owned if the table maps the binding to its current value
+	fc.out.LeaSymbolToReg("rdi", "_vibe67_persistent_owners")
+	fc.out.MovMemToReg("rdi", "rdi", 0)
+	fc.out.MovRegToReg("rsi", "rbx")
+	fc.trackFunctionCall("_vibe67_map_find")
+	fc.out.CallSymbol("_vibe67_map_find")
+	fc.out.TestRegReg("rax", "rax")
+	notOwned := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToReg("rax", "rax", 0)
+	fc.out.MovMemToReg("rcx", "rbx", 0)
+	fc.out.CmpRegToReg("rax", "rcx")
+	owned := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+
+	fc.patchJumpOffset(persistent+2, fc.eb.text.Len())
+	fc.patchJumpOffset(notOwned+2, fc.eb.text.Len())
+	fc.out.MovMemToReg("rdi", "rbx", 0)
+	fc.out.MovRegToReg("rsi", "r12")
+	fc.out.XorRegWithReg("rdx", "rdx")
+	fc.callPersistent("_vibe67_persistent_copy")
+	fc.out.MovRegToMem("rax", "rbx", 0)
+	fc.out.TestRegReg("r8", "r8")
+	done := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovRegToMem("rax", "rax", 0)
+	fc.out.MovRegToReg("r12", "rax")
+	fc.out.LeaSymbolToReg("rdi", "_vibe67_persistent_owners")
+	fc.out.MovRegToReg("rsi", "rbx")
+	fc.out.MovqRegToXmm("xmm0", "r12")
+	fc.trackFunctionCall("_vibe67_map_set")
+	fc.out.CallSymbol("_vibe67_map_set")
+	fc.out.MovRegToReg("rax", "r12")
+
+	fc.patchJumpOffset(owned+2, fc.eb.text.Len())
+	fc.patchJumpOffset(done+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("rsp", "rbp")
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
+
+// generatePlistAppend emits _vibe67_plist_append(rdi = list, rsi = value,
+// rdx = token), which appends to a header the edit may change
+func (fc *C67Compiler) generatePlistAppend() {
+	fc.eb.MarkLabel("_vibe67_plist_append")
+	saved := []string{"rbx", "r12", "r13", "r14", "r15"}
+	fc.pushRegs(saved)
+	fc.out.MovRegToReg("rbx", "rdi")             // rbx = list
+	fc.out.MovRegToReg("r12", "rsi")             // r12 = value
+	fc.out.MovRegToReg("r13", "rdx")             // r13 = token
+	fc.out.MovMemToReg("r14", "rbx", plistCount) // r14 = count
+	fc.emitListTailOffset("r9", "r14")           // r9 = tail offset
+	fc.out.MovRegToReg("r10", "r14")             // r10 = tail length
+	fc.out.SubRegFromReg("r10", "r9")
+	fc.out.CmpRegToImm("r10", 32)
+	room := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpBelow, 0)
+
+	// The tail is full. Add a level when the trie has no room for it:
+	// count/32 leaves > 32^(shift/5).
+	fc.out.MovMemToReg("rcx", "rbx", plistShift)
+	fc.out.MovImmToReg("rax", "1")
+	fc.out.ShlClReg("rax", "cl")
+	fc.out.MovRegToReg("r11", "r14")
+	fc.out.ShrRegByImm("r11", 5)
+	fc.out.CmpRegToReg("r11", "rax")
+	fits := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpBelowOrEqual, 0)
+	fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", plistNodeSize))
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.MovRegToMem("r13", "rax", 0)
+	fc.out.MovMemToReg("rdx", "rbx", plistRoot)
+	fc.out.MovRegToMem("rdx", "rax", 8)
+	fc.out.MovRegToMem("rax", "rbx", plistRoot)
+	fc.out.AddImmToReg("rcx", 5)
+	fc.out.MovRegToMem("rcx", "rbx", plistShift)
+
+	// Walk down to the leaf slot of the tail, copying the nodes the token
+	// does not own and creating the missing ones
+	fc.patchJumpOffset(fits+2, fc.eb.text.Len())
+	fc.out.LeaMemToReg("r15", "rbx", plistRoot)  // r15 = slot
+	fc.out.MovMemToReg("rcx", "rbx", plistShift) // rcx = level
+	descend := fc.eb.text.Len()
+	fc.out.MovMemToReg("rax", "r15", 0)
+	fc.out.TestRegReg("rax", "rax")
+	present := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpNotEqual, 0)
+	fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", plistNodeSize))
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.MovRegToMem("r13", "rax", 0)
+	fc.out.MovRegToMem("rax", "r15", 0)
+	created := fc.eb.text.Len()
+	fc.out.JumpUnconditional(0)
+	fc.patchJumpOffset(present+2, fc.eb.text.Len())
+	fc.out.TestRegReg("r13", "r13")
+	shared := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToReg("rdx", "rax", 0)
+	fc.out.CmpRegToReg("rdx", "r13")
+	owned := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.patchJumpOffset(shared+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.out.MovImmToReg("rsi", fmt.Sprintf("%d", plistNodeSize))
+	fc.out.MovRegToReg("rdx", "r13")
+	fc.callPersistent("_vibe67_persistent_copy")
+	fc.out.MovRegToMem("rax", "r15", 0)
+	fc.patchJumpOffset(created+1, fc.eb.text.Len())
+	fc.patchJumpOffset(owned+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("rdx", "r14")
+	fc.out.DecReg("rdx")
+	fc.out.ShrClReg("rdx", "cl")
+	fc.out.AndRegWithImm("rdx", 31)
+	fc.out.ShlRegByImm("rdx", 3)
+	fc.out.LeaMemToReg("r15", "rax", 8)
+	fc.out.AddRegToReg("r15", "rdx")
+	fc.out.CmpRegToImm("rcx", 5)
+	leaf := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.SubImmFromReg("rcx", 5)
+	fc.out.JumpUnconditional(int32(descend - (fc.eb.text.Len() + 5)))
+	fc.patchJumpOffset(leaf+2, fc.eb.text.Len())
+	fc.out.MovMemToReg("rax", "rbx", plistTail)
+	fc.out.MovRegToMem("rax", "r15", 0)
+
+	// Start a new tail
+	fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", plistNodeSize))
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.MovRegToMem("r13", "rax", 0)
+	fc.out.MovRegToMem("rax", "rbx", plistTail)
+	fc.out.XorRegWithReg("r10", "r10")
+	newTail := fc.eb.text.Len()
+	fc.out.JumpUnconditional(0)
+
+	// Room in the tail: make it one the token owns
+	fc.patchJumpOffset(room+2, fc.eb.text.Len())
+	fc.out.MovMemToReg("rax", "rbx", plistTail)
+	fc.out.TestRegReg("r13", "r13")
+	sharedTail := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToReg("rdx", "rax", 0)
+	fc.out.CmpRegToReg("rdx", "r13")
+	ownedTail := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.patchJumpOffset(sharedTail+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.out.MovImmToReg("rsi", fmt.Sprintf("%d", plistNodeSize))
+	fc.out.MovRegToReg("rdx", "r13")
+	fc.callPersistent("_vibe67_persistent_copy")
+	fc.out.MovRegToMem("rax", "rbx", plistTail)
+
+	// Store the value and bump the count
+	fc.patchJumpOffset(newTail+1, fc.eb.text.Len())
+	fc.patchJumpOffset(ownedTail+2, fc.eb.text.Len())
+	fc.out.ShlRegByImm("r10", 3)
+	fc.out.AddRegToReg("r10", "rax")
+	fc.out.MovRegToMem("r12", "r10", 8)
+	fc.out.IncReg("r14")
+	fc.out.MovRegToMem("r14", "rbx", plistCount)
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
+
+// generatePlistPush emits _vibe67_plist_push(rdi = &binding, xmm0 = value,
+// rsi = mode)
+func (fc *C67Compiler) generatePlistPush() {
+	fc.eb.MarkLabel("_vibe67_plist_push")
+	fc.out.PushReg("rbx")
+	fc.out.MovqXmmToReg("rbx", "xmm0")
+	fc.out.MovRegToReg("rdx", "rsi")
+	fc.out.MovImmToReg("rsi", fmt.Sprintf("%d", plistHeaderSize))
+	fc.callPersistent("_vibe67_persistent_begin")
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.out.MovRegToReg("rsi", "rbx")
+	fc.out.TestRegReg("rdx", "rdx")
+	fc.out.Cmovne("rdx", "rax") // the token is the owned header, or 0
+	fc.callPersistent("_vibe67_plist_append")
+	fc.out.PopReg("rbx")
+	fc.out.Ret()
+}
+
+// generatePlistLeaf emits _vibe67_plist_leaf(rdi = list, rsi = index) -> rax,
+// the node that holds the value at an index below the count. Clobbers rcx
+// and rdx.
+func (fc *C67Compiler) generatePlistLeaf() {
+	fc.eb.MarkLabel("_vibe67_plist_leaf")
+	fc.out.MovMemToReg("rcx", "rdi", plistCount)
+	fc.emitListTailOffset("rax", "rcx")
+	fc.out.CmpRegToReg("rsi", "rax")
+	inTail := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpAboveOrEqual, 0)
+	fc.out.MovMemToReg("rax", "rdi", plistRoot)
+	fc.out.MovMemToReg("rcx", "rdi", plistShift)
+	descend := fc.eb.text.Len()
+	fc.out.MovRegToReg("rdx", "rsi")
+	fc.out.ShrClReg("rdx", "cl")
+	fc.out.AndRegWithImm("rdx", 31)
+	fc.out.ShlRegByImm("rdx", 3)
+	fc.out.AddRegToReg("rdx", "rax")
+	fc.out.MovMemToReg("rax", "rdx", 8)
+	fc.out.SubImmFromReg("rcx", 5)
+	fc.out.JumpConditional(JumpNotEqual, int32(descend-(fc.eb.text.Len()+6)))
+	fc.out.Ret()
+	fc.patchJumpOffset(inTail+2, fc.eb.text.Len())
+	fc.out.MovMemToReg("rax", "rdi", plistTail)
+	fc.out.Ret()
+}
+
+// generatePlistGet emits _vibe67_plist_get(rdi = list, rsi = index) -> xmm0
+func (fc *C67Compiler) generatePlistGet() {
+	fc.eb.MarkLabel("_vibe67_plist_get")
+	saved := []string{"rcx", "rdx"}
+	fc.pushRegs(saved)
+	fc.out.MovMemToReg("rax", "rdi", plistCount)
+	fc.out.CmpRegToReg("rsi", "rax")
+	outside := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpAboveOrEqual, 0) // negative indexes too
+	fc.callPersistent("_vibe67_plist_leaf")
+	fc.out.MovRegToReg("rdx", "rsi")
+	fc.out.AndRegWithImm("rdx", 31)
+	fc.out.ShlRegByImm("rdx", 3)
+	fc.out.AddRegToReg("rdx", "rax")
+	fc.out.MovMemToXmm("xmm0", "rdx", 8)
+	fc.popRegs(saved)
+	fc.out.Ret()
+	fc.patchJumpOffset(outside+2, fc.eb.text.Len())
+	fc.out.XorpdXmm("xmm0", "xmm0")
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
+
+// generatePlistFlatten emits _vibe67_plist_flatten(rdi = list) -> rax, the
+// list in the flat [count][key][value]... layout
+func (fc *C67Compiler) generatePlistFlatten() {
+	fc.eb.MarkLabel("_vibe67_plist_flatten")
+	saved := []string{"rbx", "rcx", "rdx", "rsi", "rdi", "r8", "r9"}
+	fc.pushRegs(saved)
+	fc.out.MovRegToReg("r9", "rdi")
+	fc.out.MovMemToReg("r8", "r9", plistCount) // r8 = count
+	fc.out.MovRegToReg("rdi", "r8")
+	fc.out.ShlRegByImm("rdi", 4)
+	fc.out.AddImmToReg("rdi", 8)
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.MovRegToReg("rbx", "rax") // rbx = flat list
+	fc.out.Cvtsi2sd("xmm0", "r8")
+	fc.out.MovXmmToMem("xmm0", "rbx", 0)
+	fc.out.MovRegToReg("rdi", "r9")
+	fc.out.XorRegWithReg("rsi", "rsi") // rsi = index
+	loop := fc.eb.text.Len()
+	fc.out.CmpRegToReg("rsi", "r8")
+	done := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpAboveOrEqual, 0)
+	fc.out.TestRegWithImm("rsi", 31)
+	sameLeaf := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpNotEqual, 0)
+	fc.callPersistent("_vibe67_plist_leaf")
+	fc.out.MovRegToReg("r9", "rax") // r9 = leaf
+	fc.patchJumpOffset(sameLeaf+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("rax", "rsi")
+	fc.out.AndRegWithImm("rax", 31)
+	fc.out.ShlRegByImm("rax", 3)
+	fc.out.AddRegToReg("rax", "r9")
+	fc.out.MovMemToReg("rax", "rax", 8)
+	fc.out.MovRegToReg("rdx", "rsi")
+	fc.out.ShlRegByImm("rdx", 4)
+	fc.out.AddRegToReg("rdx", "rbx")
+	fc.out.MovRegToMem("rsi", "rdx", 8) // keys are integer indexes, as in list literals
+	fc.out.MovRegToMem("rax", "rdx", 16)
+	fc.out.IncReg("rsi")
+	fc.out.JumpUnconditional(int32(loop - (fc.eb.text.Len() + 5)))
+	fc.patchJumpOffset(done+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("rax", "rbx")
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
+
+// generatePlistFromFlat emits _vibe67_plist_from_flat(rdi = flat list) -> rax
+func (fc *C67Compiler) generatePlistFromFlat() {
+	fc.eb.MarkLabel("_vibe67_plist_from_flat")
+	saved := []string{"rbx", "r12", "r13", "r14"}
+	fc.pushRegs(saved)
+	fc.out.MovRegToReg("r12", "rdi") // r12 = flat list
+	fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", plistHeaderSize))
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.MovRegToReg("rbx", "rax") // rbx = list, which owns its new nodes
+	fc.out.MovRegToMem("rbx", "rbx", 0)
+	fc.out.MovImmToMem(5, "rbx", plistShift)
+	fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", plistNodeSize))
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.MovRegToMem("rbx", "rax", 0)
+	fc.out.MovRegToMem("rax", "rbx", plistTail)
+	fc.out.XorRegWithReg("r13", "r13") // r13 = count
+	fc.out.TestRegReg("r12", "r12")
+	empty := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToXmm("xmm0", "r12", 0)
+	fc.out.Cvttsd2si("r13", "xmm0")
+	fc.patchJumpOffset(empty+2, fc.eb.text.Len())
+	fc.out.XorRegWithReg("r14", "r14") // r14 = index
+	loop := fc.eb.text.Len()
+	fc.out.CmpRegToReg("r14", "r13")
+	done := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpGreaterOrEqual, 0)
+	fc.out.MovRegToReg("rax", "r14")
+	fc.out.ShlRegByImm("rax", 4)
+	fc.out.AddRegToReg("rax", "r12")
+	fc.out.MovMemToReg("rsi", "rax", 16)
+	fc.out.MovRegToReg("rdi", "rbx")
+	fc.out.MovRegToReg("rdx", "rbx")
+	fc.callPersistent("_vibe67_plist_append")
+	fc.out.IncReg("r14")
+	fc.out.JumpUnconditional(int32(loop - (fc.eb.text.Len() + 5)))
+	fc.patchJumpOffset(done+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("rax", "rbx")
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
+
+// generatePmapFind emits _vibe67_pmap_find(rdi = map, rsi = key) -> rax =
+// &value, or 0. Keeps every other register.
+func (fc *C67Compiler) generatePmapFind() {
+	fc.eb.MarkLabel("_vibe67_pmap_find")
+	saved := []string{"rbx", "rcx", "rdx", "rsi", "r8", "r9", "r10", "r11"}
+	fc.pushRegs(saved)
+	fc.emitNormalizeKey("rsi")
+	fc.emitMapHash()
+	fc.out.MovRegToReg("r8", "rax")           // r8 = hash
+	fc.out.MovRegToReg("rbx", "rsi")          // rbx = key
+	fc.out.MovMemToReg("r9", "rdi", pmapRoot) // r9 = node
+	fc.out.XorRegWithReg("r11", "r11")        // r11 = level
+	loop := fc.eb.text.Len()
+	fc.emitPmapSlot("r8")
+	fc.out.TestRegReg("rdx", "r10")
+	data := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpNotEqual, 0)
+	fc.out.TestRegReg("rcx", "r10")
+	miss := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToReg("r9", "rax", 0)
+	fc.out.AddImmToReg("r11", 5)
+	fc.out.JumpUnconditional(int32(loop - (fc.eb.text.Len() + 5)))
+	fc.patchJumpOffset(data+2, fc.eb.text.Len())
+	fc.out.MovMemToReg("rdx", "rax", 0)
+	fc.out.CmpRegToReg("rdx", "rbx")
+	other := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpNotEqual, 0)
+	fc.out.AddImmToReg("rax", 8)
+	fc.popRegs(saved)
+	fc.out.Ret()
+	fc.patchJumpOffset(miss+2, fc.eb.text.Len())
+	fc.patchJumpOffset(other+2, fc.eb.text.Len())
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
+
+// generatePmapGet emits _vibe67_pmap_get(rdi = map, rsi = key) -> xmm0
+func (fc *C67Compiler) generatePmapGet() {
+	fc.eb.MarkLabel("_vibe67_pmap_get")
+	fc.callPersistent("_vibe67_pmap_find")
+	fc.out.XorpdXmm("xmm0", "xmm0")
+	fc.out.TestRegReg("rax", "rax")
+	missing := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToXmm("xmm0", "rax", 0)
+	fc.patchJumpOffset(missing+2, fc.eb.text.Len())
+	fc.out.Ret()
+}
+
+// generatePmapInsert emits _vibe67_pmap_insert(rdi = map, rsi = key,
+// rdx = value, rcx = token), which sets a key of a header the edit may change
+func (fc *C67Compiler) generatePmapInsert() {
+	fc.eb.MarkLabel("_vibe67_pmap_insert")
+	saved := []string{"rbx", "r12", "r13", "r14", "r15"}
+	fc.pushRegs(saved)
+	fc.out.MovRegToReg("rbx", "rdi") // rbx = map
+	fc.out.MovRegToReg("r13", "rdx") // r13 = value
+	fc.out.MovRegToReg("r14", "rcx") // r14 = token
+	fc.emitNormalizeKey("rsi")
+	fc.out.MovRegToReg("r12", "rsi") // r12 = key
+	fc.emitMapHash()
+	fc.out.MovRegToReg("r15", "rax")           // r15 = hash
+	fc.out.LeaMemToReg("rdi", "rbx", pmapRoot) // rdi = slot
+	fc.out.XorRegWithReg("r11", "r11")         // r11 = level
+
+	// Make the node in the slot one the token owns
+	loop := fc.eb.text.Len()
+	fc.out.MovMemToReg("r9", "rdi", 0)
+	fc.out.TestRegReg("r14", "r14")
+	shared := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToReg("rax", "r9", 0)
+	fc.out.CmpRegToReg("rax", "r14")
+	owned := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.patchJumpOffset(shared+2, fc.eb.text.Len())
+	fc.out.MovU32MemToReg("rax", "r9", pmapDatamap)
+	fc.out.MovU32MemToReg("rcx", "r9", pmapNodemap)
+	fc.out.OrRegWithReg("rax", "rcx")
+	fc.emitPopcount32("rax", "rcx")
+	fc.out.ShlRegByImm("rax", 4)
+	fc.out.AddImmToReg("rax", pmapNodeHeader)
+	fc.out.MovRegToReg("r8", "rdi")
+	fc.out.MovRegToReg("rdi", "r9")
+	fc.out.MovRegToReg("rsi", "rax")
+	fc.out.MovRegToReg("rdx", "r14")
+	fc.callPersistent("_vibe67_persistent_copy")
+	fc.out.MovRegToReg("rdi", "r8")
+	fc.out.MovRegToMem("rax", "rdi", 0)
+	fc.out.MovRegToReg("r9", "rax")
+	fc.patchJumpOffset(owned+2, fc.eb.text.Len())
+
+	fc.emitPmapSlot("r15")
+	fc.out.TestRegReg("rdx", "r10")
+	data := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpNotEqual, 0)
+	fc.out.TestRegReg("rcx", "r10")
+	insert := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.out.AddImmToReg("r11", 5)
+	fc.out.JumpUnconditional(int32(loop - (fc.eb.text.Len() + 5)))
+
+	// A key in the slot: replace its value, or push both keys down
+	fc.patchJumpOffset(data+2, fc.eb.text.Len())
+	fc.out.MovMemToReg("rsi", "rax", 0)
+	fc.out.CmpRegToReg("rsi", "r12")
+	split := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpNotEqual, 0)
+	fc.out.MovRegToMem("r13", "rax", 8)
+	replaced := fc.eb.text.Len()
+	fc.out.JumpUnconditional(0)
+
+	fc.patchJumpOffset(split+2, fc.eb.text.Len())
+	fc.out.MovMemToReg("r8", "rax", 8) // rsi, r8 = the other key and value
+	fc.out.XorRegWithReg("rdx", "r10")
+	fc.out.OrRegWithReg("rcx", "r10")
+	fc.out.MovU32RegToMem("rdx", "r9", pmapDatamap)
+	fc.out.MovU32RegToMem("rcx", "r9", pmapNodemap)
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.emitMapHash()
+	fc.out.MovRegToReg("rdx", "rax") // rdx = hash of the other key
+	pair := fc.eb.text.Len()
+	fc.out.AddImmToReg("r11", 5)
+	fc.out.MovRegToReg("rcx", "r11")
+	fc.out.MovRegToReg("r9", "r15")
+	fc.out.ShrClReg("r9", "cl")
+	fc.out.AndRegWithImm("r9", 31)
+	fc.out.MovRegToReg("r10", "rdx")
+	fc.out.ShrClReg("r10", "cl")
+	fc.out.AndRegWithImm("r10", 31)
+	fc.out.CmpRegToReg("r9", "r10")
+	parted := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpNotEqual, 0)
+	fc.out.PushReg("rdi")
+	fc.out.MovImmToReg("rdi", "32")
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.PopReg("rdi")
+	fc.out.MovRegToMem("r14", "rax", 0)
+	fc.out.MovRegToReg("rcx", "r9")
+	fc.out.MovImmToReg("r10", "1")
+	fc.out.ShlClReg("r10", "cl")
+	fc.out.MovU32RegToMem("r10", "rax", pmapNodemap)
+	fc.out.MovRegToMem("rax", "rdi", 0)
+	fc.out.LeaMemToReg("rdi", "rax", pmapNodeHeader)
+	fc.out.JumpUnconditional(int32(pair - (fc.eb.text.Len() + 5)))
+	fc.patchJumpOffset(parted+2, fc.eb.text.Len())
+	fc.out.PushReg("rdi")
+	fc.out.MovImmToReg("rdi", "48")
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.PopReg("rdi")
+	fc.out.MovRegToMem("r14", "rax", 0)
+	fc.out.MovRegToMem("rax", "rdi", 0)
+	fc.out.MovRegToReg("rcx", "r9")
+	fc.out.MovImmToReg("rdi", "1")
+	fc.out.ShlClReg("rdi", "cl")
+	fc.out.MovRegToReg("rcx", "r10")
+	fc.out.MovImmToReg("r11", "1")
+	fc.out.ShlClReg("r11", "cl")
+	fc.out.OrRegWithReg("rdi", "r11")
+	fc.out.MovU32RegToMem("rdi", "rax", pmapDatamap)
+	fc.out.CmpRegToReg("r9", "r10")
+	otherFirst := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpAbove, 0)
+	fc.out.MovRegToMem("r12", "rax", 16)
+	fc.out.MovRegToMem("r13", "rax", 24)
+	fc.out.MovRegToMem("rsi", "rax", 32)
+	fc.out.MovRegToMem("r8", "rax", 40)
+	splitDone := fc.eb.text.Len()
+	fc.out.JumpUnconditional(0)
+	fc.patchJumpOffset(otherFirst+2, fc.eb.text.Len())
+	fc.out.MovRegToMem("rsi", "rax", 16)
+	fc.out.MovRegToMem("r8", "rax", 24)
+	fc.out.MovRegToMem("r12", "rax", 32)
+	fc.out.MovRegToMem("r13", "rax", 40)
+	added := fc.eb.text.Len()
+	fc.out.JumpUnconditional(0)
+
+	// A free slot: a copy of the node with one more entry
+	fc.patchJumpOffset(insert+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("r8", "rax")
+	fc.out.SubRegFromReg("r8", "r9") // r8 = bytes before the new entry
+	fc.out.OrRegWithReg("rdx", "r10")
+	fc.out.MovRegToReg("rax", "rdx")
+	fc.out.OrRegWithReg("rax", "rcx")
+	fc.emitPopcount32("rax", "rsi")
+	fc.out.ShlRegByImm("rax", 4)
+	fc.out.AddImmToReg("rax", pmapNodeHeader) // rax = size with the new entry
+	fc.out.MovRegToReg("r11", "rax")
+	fc.out.PushReg("rdi")
+	fc.out.PushReg("rdx")
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.out.MovRegToReg("rsi", "r9")
+	fc.out.MovRegToReg("rcx", "r8")
+	fc.out.RepMovsb()
+	fc.out.MovRegToMem("r12", "rdi", 0)
+	fc.out.MovRegToMem("r13", "rdi", 8)
+	fc.out.AddImmToReg("rdi", 16)
+	fc.out.MovRegToReg("rcx", "r11")
+	fc.out.SubRegFromReg("rcx", "r8")
+	fc.out.SubImmFromReg("rcx", 16)
+	fc.out.RepMovsb()
+	fc.out.PopReg("rdx")
+	fc.out.MovU32RegToMem("rdx", "rax", pmapDatamap)
+	fc.out.MovRegToMem("r14", "rax", 0)
+	fc.out.PopReg("rdi")
+	fc.out.MovRegToMem("rax", "rdi", 0)
+
+	fc.patchJumpOffset(added+1, fc.eb.text.Len())
+	fc.patchJumpOffset(splitDone+1, fc.eb.text.Len())
+	fc.out.MovMemToReg("rax", "rbx", pmapCount)
+	fc.out.IncReg("rax")
+	fc.out.MovRegToMem("rax", "rbx", pmapCount)
+	fc.patchJumpOffset(replaced+1, fc.eb.text.Len())
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
+
+// generatePmapSet emits _vibe67_pmap_set(rdi = &binding, rsi = key,
+// xmm0 = value, rdx = mode)
+func (fc *C67Compiler) generatePmapSet() {
+	fc.eb.MarkLabel("_vibe67_pmap_set")
+	saved := []string{"rbx", "r12"}
+	fc.pushRegs(saved)
+	fc.out.MovqXmmToReg("rbx", "xmm0")
+	fc.out.MovRegToReg("r12", "rsi")
+	fc.out.MovImmToReg("rsi", fmt.Sprintf("%d", pmapHeaderSize))
+	fc.callPersistent("_vibe67_persistent_begin")
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.out.MovRegToReg("rsi", "r12")
+	fc.out.XorRegWithReg("rcx", "rcx")
+	fc.out.TestRegReg("rdx", "rdx")
+	fc.out.Cmovne("rcx", "rax") // the token is the owned header, or 0
+	fc.out.MovRegToReg("rdx", "rbx")
+	fc.callPersistent("_vibe67_pmap_insert")
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
+
+// generatePmapWalk emits _vibe67_pmap_walk(rdi = node, rsi = out) -> rsi,
+// which writes the entries under node to out in hash order
+func (fc *C67Compiler) generatePmapWalk() {
+	fc.eb.MarkLabel("_vibe67_pmap_walk")
+	saved := []string{"rbx", "r12", "r13", "r14"}
+	fc.pushRegs(saved)
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.out.MovU32MemToReg("r12", "rbx", pmapDatamap) // r12 = datamap
+	fc.out.MovU32MemToReg("r13", "rbx", pmapNodemap)
+	fc.out.OrRegWithReg("r13", "r12")                // r13 = bits left
+	fc.out.LeaMemToReg("r14", "rbx", pmapNodeHeader) // r14 = entry
+	loop := fc.eb.text.Len()
+	fc.out.TestRegReg("r13", "r13")
+	done := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovRegToReg("rax", "r13")
+	fc.out.NegReg("rax")
+	fc.out.AndRegWithReg("rax", "r13") // lowest bit
+	fc.out.XorRegWithReg("r13", "rax")
+	fc.out.TestRegReg("r12", "rax")
+	child := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToReg("rax", "r14", 0)
+	fc.out.MovRegToMem("rax", "rsi", 0)
+	fc.out.MovMemToReg("rax", "r14", 8)
+	fc.out.MovRegToMem("rax", "rsi", 8)
+	fc.out.AddImmToReg("rsi", 16)
+	next := fc.eb.text.Len()
+	fc.out.JumpUnconditional(0)
+	fc.patchJumpOffset(child+2, fc.eb.text.Len())
+	fc.out.MovMemToReg("rdi", "r14", 0)
+	fc.callPersistent("_vibe67_pmap_walk")
+	fc.patchJumpOffset(next+1, fc.eb.text.Len())
+	fc.out.AddImmToReg("r14", 16)
+	fc.out.JumpUnconditional(int32(loop - (fc.eb.text.Len() + 5)))
+	fc.patchJumpOffset(done+2, fc.eb.text.Len())
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
+
+// generatePmapFlatten emits _vibe67_pmap_flatten(rdi = map) -> rax, the map
+// in the flat [count][key][value]... layout, in hash order
+func (fc *C67Compiler) generatePmapFlatten() {
+	fc.eb.MarkLabel("_vibe67_pmap_flatten")
+	saved := []string{"rbx", "rsi", "rdi", "r8"}
+	fc.pushRegs(saved)
+	fc.out.MovRegToReg("r8", "rdi")
+	fc.out.MovMemToReg("rdi", "r8", pmapCount)
+	fc.out.ShlRegByImm("rdi", 4)
+	fc.out.AddImmToReg("rdi", 8)
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.MovRegToReg("rbx", "rax")
+	fc.out.MovMemToReg("rax", "r8", pmapCount)
+	fc.out.Cvtsi2sd("xmm0", "rax")
+	fc.out.MovXmmToMem("xmm0", "rbx", 0)
+	fc.out.MovMemToReg("rdi", "r8", pmapRoot)
+	fc.out.LeaMemToReg("rsi", "rbx", 8)
+	fc.callPersistent("_vibe67_pmap_walk")
+	fc.out.MovRegToReg("rax", "rbx")
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
+
+// generatePmapFromFlat emits _vibe67_pmap_from_flat(rdi = flat map) -> rax
+func (fc *C67Compiler) generatePmapFromFlat() {
+	fc.eb.MarkLabel("_vibe67_pmap_from_flat")
+	saved := []string{"rbx", "r12", "r13", "r14"}
+	fc.pushRegs(saved)
+	fc.out.MovRegToReg("r12", "rdi") // r12 = flat map
+	fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", pmapHeaderSize))
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.MovRegToReg("rbx", "rax") // rbx = map, which owns its new nodes
+	fc.out.MovRegToMem("rbx", "rbx", 0)
+	fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", pmapNodeHeader))
+	fc.callPersistent("_vibe67_persistent_alloc")
+	fc.out.MovRegToMem("rbx", "rax", 0)
+	fc.out.MovRegToMem("rax", "rbx", pmapRoot)
+	fc.out.XorRegWithReg("r13", "r13") // r13 = count
+	fc.out.TestRegReg("r12", "r12")
+	empty := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.out.MovMemToXmm("xmm0", "r12", 0)
+	fc.out.Cvttsd2si("r13", "xmm0")
+	fc.patchJumpOffset(empty+2, fc.eb.text.Len())
+	fc.out.XorRegWithReg("r14", "r14") // r14 = index
+	loop := fc.eb.text.Len()
+	fc.out.CmpRegToReg("r14", "r13")
+	done := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpGreaterOrEqual, 0)
+	fc.out.MovRegToReg("rax", "r14")
+	fc.out.ShlRegByImm("rax", 4)
+	fc.out.AddRegToReg("rax", "r12")
+	fc.out.MovMemToReg("rsi", "rax", 8)
+	fc.out.MovMemToReg("rdx", "rax", 16)
+	fc.out.MovRegToReg("rdi", "rbx")
+	fc.out.MovRegToReg("rcx", "rbx")
+	fc.callPersistent("_vibe67_pmap_insert")
+	fc.out.IncReg("r14")
+	fc.out.JumpUnconditional(int32(loop - (fc.eb.text.Len() + 5)))
+	fc.patchJumpOffset(done+2, fc.eb.text.Len())
+	fc.out.MovRegToReg("rax", "rbx")
+	fc.popRegs(saved)
+	fc.out.Ret()
+}
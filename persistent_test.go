@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+// trieBindings returns the bindings kept as tries, as kind:name sorted by
+// name, looking in every scope
+func trieBindings(code string) []string {
+	program := NewParser(code).ParseProgram()
+	pb := newPersistentBindings(program, newListOwnership(program))
+	var names []string
+	add := func(scope map[string]*persistentName) {
+		for name, p := range scope {
+			names = append(names, fmt.Sprintf("%s:%s", p.kind, name))
+		}
+	}
+	add(pb.top)
+	for _, scope := range pb.scopes {
+		add(scope)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPersistentBindings(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want []string
+	}{
+		{"aliased", `xs = [1, 2]
+keep = xs
+xs = append(xs, 3)`, []string{"list:xs"}},
+		{"mutable aliased", `xs := [1, 2]
+keep = xs
+xs <- append(xs, 3)`, []string{"list:xs"}},
+		{"owned", `xs = []
+@ i in 0..<10 {
+    xs = append(xs, i)
+}
+println(#xs)`, nil},
+		{"map", `m := {1: 2}
+m[3] <- 4`, []string{"map:m"}},
+		{"map from map", `m := {1: 2}
+n := m
+n[3] <- 4
+m[5] <- 6`, []string{"map:m", "map:n"}},
+		{"not a literal", `m := 5
+m[3] <- 4`, nil},
+		{"in a function", `f = n -> {
+    acc := {}
+    @ i in 0..<n max 100 {
+        acc[i] <- i
+    }
+    keep = acc
+    #keep
+}`, []string{"map:acc"}},
+		{"captured", `m := {1: 2}
+m[3] <- 4
+f = () -> m[3]`, nil},
+		{"parameter", `f = m -> {
+    m[1] <- 2
+    m
+}`, nil},
+		{"parallel", `m := {1: 2}
+@@ i in 0..<4 {
+    println(m[1])
+}
+m[3] <- 4`, nil},
+		{"cast", `xs = [1]
+keep = xs
+xs = append(xs, 2)
+p = xs as cptr`, nil},
+		{"not defined first", `f = () -> {
+    ys = append(ys, 1)
+    keep = ys
+    #ys
+}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trieBindings(tt.code); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("trie bindings = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPersistentLists(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("persistent lists are only emitted by the x86-64 backend")
+	}
+	// 100000 appends to a list another binding can see would copy 5e9
+	// values with flat lists. 1056 and 32800 are in the second and third
+	// level of the trie. The lambda keeps compileAndRun from wrapping the
+	// program in main.
+	code := `xs = [0]
+keep = xs
+@ i in 1..<100000 max 200000 {
+    xs = append(xs, i * 2)
+}
+bad := 0
+@ i in 0..<100000 max 200000 {
+    xs[i] != i * 2 { bad <- bad + 1 }
+}
+ys := [1, 2, 3]
+@ i in 0..<40 {
+    ys <- append(ys, i)
+}
+snap = ys
+ys <- append(ys, 100)
+ys <- append(ys, 101)
+grow = n -> {
+    acc := [0]
+    first = acc
+    @ i in 1..<n max 1000 {
+        acc <- append(acc, i)
+    }
+    printf("%v %v %v\n", #acc, #first, acc[n - 1])
+    0
+}
+grow(100)
+grow(40)
+printf("%v %v %v\n", #xs, #keep, bad)
+printf("%v %v %v %v\n", xs[1056], xs[32800], xs[99999], xs[100000])
+printf("%v %v %v %v %v\n", #ys, #snap, ys[43], snap[42], snap[43])
+`
+	want := "100.000000 1.000000 99.000000\n40.000000 1.000000 39.000000\n" +
+		"100000.000000 1.000000 0.000000\n" +
+		"2112.000000 65600.000000 199998.000000 0.000000\n" +
+		"45.000000 43.000000 100.000000 39.000000 0.000000\n"
+	if got := compileAndRun(t, code); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPersistentMaps(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("persistent maps are only emitted by the x86-64 backend")
+	}
+	code := `m := {1: 10, 7: 20}
+m[7] <- 5
+m[3] <- 9
+old = m
+m[1] <- 11
+m[-0.0] <- 4
+printf("%v %v %v %v %v\n", m[1], m[7], m[3], m[0], #m)
+printf("%v %v %v\n", old[1], old[0], #old)
+big := {0: 0}
+@ i in 1..<5000 max 10000 {
+    big[i] <- i * 3
+}
+snap = big
+@ i in 0..<5000 max 10000 {
+    big[i] <- i + 1
+}
+big[0.5] <- 7
+bad := 0
+@ i in 0..<5000 max 10000 {
+    big[i] != i + 1 { bad <- bad + 1 }
+    snap[i] != i * 3 { bad <- bad + 1 }
+}
+printf("%v %v %v %v\n", bad, #big, #snap, big[0.5])
+count = n -> {
+    acc := {}
+    @ i in 0..<n max 1000 {
+        acc[i * 7] <- i
+    }
+    keep = acc
+    acc[1] <- 99
+    printf("%v %v %v\n", #keep, acc[1], acc[14])
+    0
+}
+count(10)
+count(20)
+`
+	want := "11.000000 5.000000 9.000000 4.000000 4.000000\n" +
+		"10.000000 0.000000 3.000000\n" +
+		"0.000000 5001.000000 5000.000000 7.000000\n" +
+		"10.000000 99.000000 2.000000\n20.000000 99.000000 2.000000\n"
+	if got := compileAndRun(t, code); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -120,10 +120,10 @@ func (fc *C67Compiler) generatePrintSyscall() {
 	fc.out.MovRegToMem("rdi", "r13", 0)
 
 	// write(1, buffer, 1)
-	fc.out.MovImmToReg("rax", "1")   // syscall: write
-	fc.out.MovImmToReg("rdi", "1")   // fd: stdout
-	fc.out.MovRegToReg("rsi", "r13") // buffer
-	fc.out.MovImmToReg("rdx", "1")   // length: 1
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // syscall: write
+	fc.out.MovImmToReg("rdi", "1")                        // fd: stdout
+	fc.out.MovRegToReg("rsi", "r13")                      // buffer
+	fc.out.MovImmToReg("rdx", "1")                        // length: 1
 	fc.out.Syscall()
 
 	// Increment index and loop
@@ -273,7 +273,7 @@ func (fc *C67Compiler) generatePrintlnSyscall() {
 	fc.out.MovRegToMem("rdi", "r13", 0)
 
 	// write(1, buffer, 1)
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.MovRegToReg("rsi", "r13")
 	fc.out.MovImmToReg("rdx", "1")
@@ -291,7 +291,7 @@ func (fc *C67Compiler) generatePrintlnSyscall() {
 	// Write newline
 	fc.out.MovImmToReg("rax", "10") // '\n'
 	fc.out.MovRegToMem("rax", "r13", 0)
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.MovRegToReg("rsi", "r13")
 	fc.out.MovImmToReg("rdx", "1")
@@ -220,9 +220,9 @@ func EmitPrintfRuntimeX86_64(eb *ExecutableBuilder, out *Out) error {
 	out.SubRegFromReg("rdx", "rax")
 
 	// Write output using syscall write(1, buf, len)
-	out.MovImmToReg("rax", "1")       // sys_write
-	out.MovImmToReg("rdi", "1")       // fd = stdout
-	out.LeaMemToReg("rsi", "rsp", 64) // buf
+	out.MovImmToReg("rax", out.SysNum("SYS_WRITE")) // sys_write
+	out.MovImmToReg("rdi", "1")                     // fd = stdout
+	out.LeaMemToReg("rsi", "rsp", 64)               // buf
 	// rdx already has length
 	out.Syscall()
 
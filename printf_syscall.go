@@ -99,10 +99,10 @@ func (fc *C67Compiler) generatePrintfMain() {
 	fc.out.Emit([]byte{0x0f, 0x84, 0x00, 0x00, 0x00, 0x00}) // je _printf_format_spec
 
 	// Regular character - write it using syscall
-	fc.out.MovImmToReg("rdi", "1")      // stdout
-	fc.out.LeaMemToReg("rsi", "r12", 0) // current char
-	fc.out.MovImmToReg("rdx", "1")      // length
-	fc.out.MovImmToReg("rax", "1")      // sys_write
+	fc.out.MovImmToReg("rdi", "1")                        // stdout
+	fc.out.LeaMemToReg("rsi", "r12", 0)                   // current char
+	fc.out.MovImmToReg("rdx", "1")                        // length
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
 	fc.out.Syscall()
 
 	fc.out.IncReg("r12")
@@ -168,7 +168,7 @@ func (fc *C67Compiler) generatePrintfMain() {
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.LeaMemToReg("rsi", "r12", 0)
 	fc.out.MovImmToReg("rdx", "1")
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.Syscall()
 	fc.out.IncReg("r12")
 	percentJump := fc.eb.text.Len()
@@ -634,8 +634,8 @@ func (fc *C67Compiler) emitSyscallPrintLiteral(str string) {
 	fc.stringCounter++
 	fc.eb.Define(labelName, str)
 
-	fc.out.MovImmToReg("rax", "1") // sys_write
-	fc.out.MovImmToReg("rdi", "1") // stdout
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+	fc.out.MovImmToReg("rdi", "1")                        // stdout
 	fc.out.LeaSymbolToReg("rsi", labelName)
 	fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", len(str)))
 	fc.out.Syscall()
@@ -646,8 +646,8 @@ func (fc *C67Compiler) emitSyscallPrintChar(ch rune) {
 	fc.out.SubImmFromReg("rsp", 8)
 	fc.out.MovImmToReg("rax", fmt.Sprintf("%d", ch))
 	fc.out.MovRegToMem("rax", "rsp", 0)
-	fc.out.MovImmToReg("rax", "1") // sys_write
-	fc.out.MovImmToReg("rdi", "1") // stdout
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
+	fc.out.MovImmToReg("rdi", "1")                        // stdout
 	fc.out.MovRegToReg("rsi", "rsp")
 	fc.out.MovImmToReg("rdx", "1")
 	fc.out.Syscall()
@@ -670,7 +670,7 @@ func (fc *C67Compiler) emitSyscallPrintInteger() {
 	fc.out.SubImmFromReg("rsp", 8)
 	fc.out.MovImmToReg("rax", "45") // '-'
 	fc.out.MovRegToMem("rax", "rsp", 0)
-	fc.out.MovImmToReg("rax", "1") // sys_write
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE")) // sys_write
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.MovRegToReg("rsi", "rsp")
 	fc.out.MovImmToReg("rdx", "1")
@@ -704,7 +704,7 @@ func (fc *C67Compiler) emitSyscallPrintInteger() {
 	fc.out.SubRegFromReg("rdx", "rbx")
 
 	// Write using syscall
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.MovRegToReg("rsi", "rbx")
 	fc.out.Syscall()
@@ -796,7 +796,7 @@ func (fc *C67Compiler) generatePrintString() {
 	// Write using syscall
 	fc.out.MovRegToReg("rsi", "rdi")
 	fc.out.MovImmToReg("rdi", "1")
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.Syscall()
 
 	fc.out.PopReg("rbx")
@@ -821,7 +821,7 @@ func (fc *C67Compiler) generatePrintInteger() {
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.LeaSymbolToReg("rsi", "_printf_minus")
 	fc.out.MovImmToReg("rdx", "1")
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.Syscall()
 	fc.out.PopReg("rax")
 	fc.out.NegReg("rax")
@@ -936,7 +936,7 @@ func (fc *C67Compiler) generatePrintFloat() {
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.LeaSymbolToReg("rsi", "_printf_minus")
 	fc.out.MovImmToReg("rdx", "1")
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.Syscall()
 	fc.out.PopReg("rax")
 	fc.out.NegReg("rax")
@@ -1015,7 +1015,7 @@ func (fc *C67Compiler) emitSyscallPrintFloatPrecise(precision int) {
 	fc.out.PushReg("rax")
 	fc.out.MovImmToReg("r15", "45") // '-'
 	fc.out.MovRegToMem("r15", "rsp", 8)
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.LeaMemToReg("rsi", "rsp", 8)
 	fc.out.MovImmToReg("rdx", "1")
@@ -1047,7 +1047,7 @@ func (fc *C67Compiler) emitSyscallPrintFloatPrecise(precision int) {
 	fc.out.SubRegFromReg("rdx", "rbx")
 
 	// Write
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.MovRegToReg("rsi", "rbx")
 	fc.out.Syscall()
@@ -1059,7 +1059,7 @@ func (fc *C67Compiler) emitSyscallPrintFloatPrecise(precision int) {
 	// ===== Print decimal point INLINE =====
 	fc.out.MovImmToReg("rax", "46") // '.'
 	fc.out.MovRegToMem("rax", "rsp", 0)
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.MovRegToReg("rsi", "rsp")
 	fc.out.MovImmToReg("rdx", "1")
@@ -1098,7 +1098,7 @@ func (fc *C67Compiler) emitSyscallPrintFloatPrecise(precision int) {
 	}
 
 	// Write
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.LeaMemToReg("rsi", "rsp", 64)
 	fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", precision))
@@ -1184,7 +1184,7 @@ func (fc *C67Compiler) emitSyscallPrintHex() {
 	fc.out.SubRegFromReg("rdx", "rbx")
 
 	// Write using syscall
-	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
 	fc.out.MovImmToReg("rdi", "1")
 	fc.out.MovRegToReg("rsi", "rbx")
 	fc.out.Syscall()
@@ -0,0 +1,421 @@
+// Completion: 75% - Profile-guided optimization (instrumentation on x86-64 Linux)
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// profile.go - Profile-guided optimization
+//
+// A -profile-generate build counts function entries, the arms taken by match
+// expressions and the trip counts of range loops, and writes the counters to
+// the profile file when the program exits. A -profile-use build reads them
+// back and uses them to
+//   - inline hot functions whose body is a match, and never inline functions
+//     that were not called,
+//   - test the arms of a match that can not both match in order of how often
+//     they were taken,
+//   - leave loops that run only a few iterations per entry scalar.
+//
+// Counters are named, so a profile still applies after the program changed:
+// counters that are missing from the profile simply carry no information.
+// Matches and loops are named after the file and the function they are in
+// and their position among the matches or loops of that function:
+//
+//	game.vibe67/update/match0:arm2    times arm 2 of the first match in update was taken
+//	game.vibe67/update/match0:default times no arm matched
+//	game.vibe67/loop1:entries         times the second top-level loop was entered
+//	game.vibe67/loop1:trips           iterations it was entered with, summed
+//	calls:update                      calls of update
+//
+// The profile file is the counter block of the instrumented program, as is:
+//
+//	magic  [8]byte  "V67PROF1"
+//	count  uint64   number of counters
+//	length uint64   length of the names, a multiple of 8
+//	names  []byte   counter names, each followed by a NUL, padded with NULs
+//	values []uint64 counter values, in the order of the names
+//
+// Only x86-64 Linux programs can be instrumented; profiles can be used for
+// every target.
+
+const (
+	profileMagic          = "V67PROF1"
+	profileHeaderLen      = 24
+	profileHotCalls       = 1000 // calls a function needs to be hot...
+	profileHotShare       = 100  // ...and at least 1/profileHotShare of all calls
+	profileMinVectorTrips = 16   // iterations per entry below which loops stay scalar
+)
+
+// ProfileGenerateFile is the profile an instrumented program writes (-profile-generate)
+var ProfileGenerateFile string
+
+// activeProfile is the profile the program is optimized with (-profile-use), or nil
+var activeProfile *Profile
+
+// Profile holds the counters of one or more runs of an instrumented program
+type Profile struct {
+	Counts     map[string]uint64
+	totalCalls uint64
+	hash       string // identifies the profile contents in build cache keys
+}
+
+// LoadProfile reads the profiles in a comma-separated list of files and sums their counters
+func LoadProfile(paths string) (*Profile, error) {
+	profile := &Profile{Counts: make(map[string]uint64)}
+	h := sha256.New()
+	for _, path := range strings.Split(paths, ",") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := profile.add(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		h.Write(data)
+	}
+	profile.hash = hex.EncodeToString(h.Sum(nil))
+	return profile, nil
+}
+
+// add adds the counters of a profile file
+func (p *Profile) add(data []byte) error {
+	if len(data) < profileHeaderLen || string(data[:8]) != profileMagic {
+		return fmt.Errorf("not a vibe67 profile")
+	}
+	count := binary.LittleEndian.Uint64(data[8:])
+	namesLen := binary.LittleEndian.Uint64(data[16:])
+	if namesLen > uint64(len(data)) || count > uint64(len(data))/8 ||
+		uint64(len(data)) != profileHeaderLen+namesLen+8*count {
+		return fmt.Errorf("truncated profile")
+	}
+	names := strings.Split(strings.TrimRight(string(data[profileHeaderLen:profileHeaderLen+namesLen]), "\x00"), "\x00")
+	if count == 0 {
+		names = nil
+	}
+	if uint64(len(names)) != count {
+		return fmt.Errorf("profile has %d names for %d counters", len(names), count)
+	}
+	values := data[profileHeaderLen+namesLen:]
+	for i, name := range names {
+		value := binary.LittleEndian.Uint64(values[8*i:])
+		p.Counts[name] += value
+		if strings.HasPrefix(name, "calls:") {
+			p.totalCalls += value
+		}
+	}
+	return nil
+}
+
+// count returns a counter, and whether the profile has it
+func (p *Profile) count(key string) (uint64, bool) {
+	if p == nil || key == "" {
+		return 0, false
+	}
+	value, ok := p.Counts[key]
+	return value, ok
+}
+
+// Calls returns how often a function was called, and whether the profile knows the function
+func (p *Profile) Calls(name string) (uint64, bool) {
+	return p.count(profileCallsKey(name))
+}
+
+// hotFunction reports whether a function is among the most called ones
+func (p *Profile) hotFunction(name string) bool {
+	calls, ok := p.Calls(name)
+	return ok && calls >= profileHotCalls && calls*profileHotShare >= p.totalCalls
+}
+
+// LoopTrips returns the average number of iterations a loop was entered
+// with, and whether the profile knows the loop. Loops that were never
+// entered average 0.
+func (p *Profile) LoopTrips(key string) (float64, bool) {
+	entries, ok := p.count(key + ":entries")
+	if !ok || key == "" {
+		return 0, false
+	}
+	if entries == 0 {
+		return 0, true
+	}
+	trips, _ := p.count(key + ":trips")
+	return float64(trips) / float64(entries), true
+}
+
+// profileCallsKey names the counter of a function's entries
+func profileCallsKey(name string) string {
+	return "calls:" + name
+}
+
+// profileArmKey names the counter of arm i of a match, or of its default for i < 0
+func profileArmKey(expr *MatchExpr, i int) string {
+	if expr.ProfileKey == "" {
+		return ""
+	}
+	if i < 0 {
+		return expr.ProfileKey + ":default"
+	}
+	return fmt.Sprintf("%s:arm%d", expr.ProfileKey, i)
+}
+
+// profileCacheKey identifies the profile flags in build cache keys, since
+// both change what is generated for the same source
+func profileCacheKey() string {
+	switch {
+	case ProfileGenerateFile != "":
+		return "profile-generate " + ProfileGenerateFile
+	case activeProfile != nil:
+		return "profile-use " + activeProfile.hash
+	}
+	return ""
+}
+
+// ===== Naming the counters =====
+
+// walkProfileSites calls visit for every node reachable from v, parents
+// before children and in source order. visit returns the scope of the
+// node's children.
+func walkProfileSites(v reflect.Value, scope string, visit func(node interface{}, scope string) string) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if v.Kind() == reflect.Ptr {
+			scope = visit(v.Interface(), scope)
+		}
+		walkProfileSites(v.Elem(), scope, visit)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				walkProfileSites(v.Field(i), scope, visit)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkProfileSites(v.Index(i), scope, visit)
+		}
+	}
+}
+
+// assignProfileKeys names the matches and loops of a file, before any
+// optimization changes the program, so that the names are the same in the
+// instrumented and the optimized build
+func assignProfileKeys(program *Program, source string) {
+	seen := make(map[string]int)
+	name := func(scope, kind string) string {
+		n := seen[scope+"/"+kind]
+		seen[scope+"/"+kind]++
+		return fmt.Sprintf("%s/%s%d", scope, kind, n)
+	}
+	walkProfileSites(reflect.ValueOf(program), filepath.Base(source), func(node interface{}, scope string) string {
+		switch n := node.(type) {
+		case *MatchExpr:
+			if n.ProfileKey == "" { // value matches share their subject between guards
+				n.ProfileKey = name(scope, "match")
+			}
+		case *LoopStmt:
+			if n.ProfileKey == "" {
+				n.ProfileKey = name(scope, "loop")
+			}
+		case *AssignStmt:
+			if _, ok := n.Value.(*LambdaExpr); ok {
+				return filepath.Base(source) + "/" + n.Name
+			}
+		}
+		return scope
+	})
+}
+
+// collectProfileCounters lists the counters of a program, in source order
+func collectProfileCounters(program *Program) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	add := func(key string) {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	walkProfileSites(reflect.ValueOf(program), "", func(node interface{}, scope string) string {
+		switch n := node.(type) {
+		case *AssignStmt:
+			if _, ok := n.Value.(*LambdaExpr); ok {
+				add(profileCallsKey(n.Name))
+			}
+		case *MatchExpr:
+			for i := range n.Clauses {
+				add(profileArmKey(n, i))
+			}
+			add(profileArmKey(n, -1))
+		case *LoopStmt:
+			if _, ok := n.Iterable.(*RangeExpr); ok && n.ProfileKey != "" && n.NumThreads == 0 {
+				add(n.ProfileKey + ":entries")
+				add(n.ProfileKey + ":trips")
+			}
+		}
+		return scope
+	})
+	return keys
+}
+
+// ===== Using the profile =====
+
+// matchArmsExclusive reports whether at most one arm of a match can match,
+// so that the arms can be tested in any order: every arm compares the same
+// side-effect free subject with a different number.
+func matchArmsExclusive(expr *MatchExpr) bool {
+	subject := ""
+	values := make(map[float64]bool)
+	for i, clause := range expr.Clauses {
+		eq, ok := clause.Guard.(*BinaryExpr)
+		if !ok || eq.Operator != "==" || hasSideEffects(eq.Left) {
+			return false
+		}
+		value, ok := eq.Right.(*NumberExpr)
+		if !ok || values[value.Value] {
+			return false
+		}
+		values[value.Value] = true
+		if i == 0 {
+			subject = eq.Left.String()
+		} else if eq.Left.String() != subject {
+			return false
+		}
+	}
+	return true
+}
+
+// profileClauseOrder returns the order in which the arms of a match are
+// tested: most taken first if the profile knows the match and the arms are
+// exclusive, source order otherwise
+func profileClauseOrder(expr *MatchExpr) []int {
+	order := make([]int, len(expr.Clauses))
+	for i := range order {
+		order[i] = i
+	}
+	if activeProfile == nil || len(order) < 2 || !matchArmsExclusive(expr) {
+		return order
+	}
+	counts := make([]uint64, len(order))
+	for i := range order {
+		count, ok := activeProfile.count(profileArmKey(expr, i))
+		if !ok {
+			return order
+		}
+		counts[i] = count
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return counts[order[a]] > counts[order[b]]
+	})
+	if VerboseMode && order[0] != 0 {
+		fmt.Fprintf(os.Stderr, "PGO: %s tests arms in order %v\n", expr.ProfileKey, order)
+	}
+	return order
+}
+
+// ===== Instrumentation (x86-64 Linux) =====
+
+// defineProfileCounters defines the counter block of a -profile-generate build
+func (fc *C67Compiler) defineProfileCounters(program *Program) {
+	if ProfileGenerateFile == "" || fc.eb.target.Arch() != ArchX86_64 || fc.eb.target.OS() != OSLinux {
+		return
+	}
+	keys := collectProfileCounters(program)
+	names := strings.Join(keys, "\x00") + "\x00"
+	names += strings.Repeat("\x00", (8-len(names)%8)%8)
+
+	header := make([]byte, profileHeaderLen)
+	copy(header, profileMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(len(keys)))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(names)))
+
+	fc.profileCounters = make(map[string]int, len(keys))
+	for i, key := range keys {
+		fc.profileCounters[key] = profileHeaderLen + len(names) + 8*i
+	}
+	fc.eb.DefineWritable("_vibe67_profile", string(header)+names+strings.Repeat("\x00", 8*len(keys)))
+	fc.eb.Define("_vibe67_profile_path", ProfileGenerateFile+"\x00")
+}
+
+// emitProfileCount increments a counter, preserving all registers
+func (fc *C67Compiler) emitProfileCount(key string) {
+	offset, ok := fc.profileCounters[key]
+	if !ok {
+		return
+	}
+	fc.out.PushReg("rax")
+	fc.out.LeaSymbolToReg("rax", "_vibe67_profile")
+	fc.out.Emit(binary.LittleEndian.AppendUint32([]byte{0x48, 0xff, 0x80}, uint32(offset))) // inc qword [rax+offset]
+	fc.out.PopReg("rax")
+}
+
+// emitProfileLoopEntry counts the entry of a range loop and the iterations
+// it will run, from the counter (in counterReg, or at rbp-counterOffset) to
+// the limit at rbp-limitOffset. Clobbers rax and rcx.
+func (fc *C67Compiler) emitProfileLoopEntry(key, counterReg string, counterOffset, limitOffset int) {
+	entries, ok := fc.profileCounters[key+":entries"]
+	if !ok {
+		return
+	}
+	trips := fc.profileCounters[key+":trips"]
+
+	fc.out.MovMemToReg("rax", "rbp", -limitOffset)
+	if counterReg != "" {
+		fc.out.MovRegToReg("rcx", counterReg)
+	} else {
+		fc.out.MovMemToReg("rcx", "rbp", -counterOffset)
+	}
+	fc.out.SubRegFromReg("rax", "rcx")
+	fc.out.XorRegWithReg("rcx", "rcx")
+	fc.out.CmpRegToReg("rax", "rcx")
+	fc.out.Emit([]byte{0x48, 0x0f, 0x4c, 0xc1}) // cmovl rax, rcx (empty range)
+	fc.out.LeaSymbolToReg("rcx", "_vibe67_profile")
+	fc.out.Emit(binary.LittleEndian.AppendUint32([]byte{0x48, 0x01, 0x81}, uint32(trips)))   // add [rcx+trips], rax
+	fc.out.Emit(binary.LittleEndian.AppendUint32([]byte{0x48, 0xff, 0x81}, uint32(entries))) // inc qword [rcx+entries]
+}
+
+// emitProfileFlush writes the counters to the profile, preserving the exit code in rdi
+func (fc *C67Compiler) emitProfileFlush() {
+	if len(fc.profileCounters) == 0 {
+		return
+	}
+	fc.out.CallSymbol("_vibe67_profile_flush")
+}
+
+// generateProfileRuntime emits _vibe67_profile_flush
+func (fc *C67Compiler) generateProfileRuntime() {
+	if len(fc.profileCounters) == 0 {
+		return
+	}
+	size := len(fc.eb.consts["_vibe67_profile"].value)
+
+	fc.eb.MarkLabel("_vibe67_profile_flush")
+	fc.out.PushReg("rdi")
+	fc.out.LeaSymbolToReg("rdi", "_vibe67_profile_path")
+	fc.out.MovImmToReg("rsi", fc.out.SysNum("O_WRONLY_CREAT_TRUNC"))
+	fc.out.MovImmToReg("rdx", "0x1a4") // 0644
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_OPEN"))
+	fc.out.Syscall()
+	fc.out.TestRegReg("rax", "rax")
+	failed := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpLess, 0)
+	fc.out.MovRegToReg("rdi", "rax")
+	fc.out.LeaSymbolToReg("rsi", "_vibe67_profile")
+	fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", size))
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_WRITE"))
+	fc.out.Syscall()
+	fc.out.MovImmToReg("rax", fc.out.SysNum("SYS_CLOSE"))
+	fc.out.Syscall()
+	fc.patchJumpImmediate(failed+2, int32(fc.eb.text.Len()-(failed+ConditionalJumpSize)))
+	fc.out.PopReg("rdi")
+	fc.out.Ret()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// profileTestProgram takes arm 2 of step's match most often, and has a
+// vectorizable loop of only 4 iterations
+const profileTestProgram = `step = s -> s {
+    0 -> 1
+    1 -> 2
+    2 -> 3
+    ~> 0
+}
+main = {
+    total := 0
+    @ i in 0..<2000 {
+        total <- total + step(i % 3) + step(2)
+    }
+    a := [1, 2, 3, 4]
+    b := [0, 0, 0, 0]
+    @ j in 0..<4 {
+        b[j] <- a[j] * 2
+    }
+    println(total)
+    println(b[3])
+}
+`
+
+func TestProfileGenerateAndUse(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("-profile-generate is only supported on x86-64 Linux")
+	}
+	defer func() {
+		ProfileGenerateFile = ""
+		activeProfile = nil
+	}()
+
+	ProfileGenerateFile = filepath.Join(t.TempDir(), "test.profile")
+	if got := compileAndRun(t, profileTestProgram); got != "9999\n8\n" {
+		t.Fatalf("instrumented build printed %q", got)
+	}
+	profile, err := LoadProfile(ProfileGenerateFile)
+	if err != nil {
+		t.Fatalf("LoadProfile: %v", err)
+	}
+	want := map[string]uint64{
+		"calls:step":                      4000,
+		"calls:main":                      1,
+		"test.vibe67/step/match0:arm0":    667,
+		"test.vibe67/step/match0:arm1":    667,
+		"test.vibe67/step/match0:arm2":    2666,
+		"test.vibe67/step/match0:default": 0,
+		"test.vibe67/main/loop0:entries":  1,
+		"test.vibe67/main/loop0:trips":    2000,
+		"test.vibe67/main/loop1:entries":  1,
+		"test.vibe67/main/loop1:trips":    4,
+	}
+	for key, count := range want {
+		if got, ok := profile.count(key); !ok || got != count {
+			t.Errorf("%s = %d (present %v), want %d", key, got, ok, count)
+		}
+	}
+
+	ProfileGenerateFile = ""
+	activeProfile = profile
+	if got := compileAndRun(t, profileTestProgram); got != "9999\n8\n" {
+		t.Fatalf("optimized build printed %q", got)
+	}
+
+	program := NewParserWithFilename(profileTestProgram, "test.vibe67").ParseProgram()
+	step := program.Statements[0].(*AssignStmt)
+	match := step.Value.(*LambdaExpr).Body.(*MatchExpr)
+	if order := profileClauseOrder(match); !reflect.DeepEqual(order, []int{2, 0, 1}) {
+		t.Errorf("arm order = %v, want [2 0 1]", order)
+	}
+	candidates := make(map[string]*LambdaExpr)
+	collectInlineCandidates(step, candidates)
+	if candidates["step"] == nil {
+		t.Errorf("hot match function step is not an inline candidate")
+	}
+
+	loop := &LoopStmt{Iterator: "j", Vectorized: true, ProfileKey: "test.vibe67/main/loop1"}
+	sv := NewSIMDVectorizer(NewSIMDAnalyzer(nil), nil)
+	if _, reason := sv.PlanKernel(loop, nil); !strings.Contains(reason, "4.0 iterations") {
+		t.Errorf("short loop planned with reason %q", reason)
+	}
+}
+
+// writeTestProfile writes a profile file with the given counters
+func writeTestProfile(t *testing.T, keys []string, values []uint64) string {
+	t.Helper()
+	names := strings.Join(keys, "\x00") + "\x00"
+	names += strings.Repeat("\x00", (8-len(names)%8)%8)
+	data := []byte(profileMagic)
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(keys)))
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(names)))
+	data = append(data, names...)
+	for _, v := range values {
+		data = binary.LittleEndian.AppendUint64(data, v)
+	}
+	path := filepath.Join(t.TempDir(), "test.profile")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadProfile(t *testing.T) {
+	a := writeTestProfile(t, []string{"calls:f", "calls:g"}, []uint64{3, 0})
+	b := writeTestProfile(t, []string{"calls:f", "x/loop0:entries", "x/loop0:trips"}, []uint64{4, 2, 10})
+	profile, err := LoadProfile(a + "," + b)
+	if err != nil {
+		t.Fatalf("LoadProfile: %v", err)
+	}
+	if calls, ok := profile.Calls("f"); !ok || calls != 7 {
+		t.Errorf("calls of f = %d, %v, want 7", calls, ok)
+	}
+	if calls, ok := profile.Calls("g"); !ok || calls != 0 {
+		t.Errorf("calls of g = %d, %v, want 0", calls, ok)
+	}
+	if _, ok := profile.Calls("h"); ok {
+		t.Errorf("profile knows h")
+	}
+	if trips, ok := profile.LoopTrips("x/loop0"); !ok || trips != 5 {
+		t.Errorf("trips = %v, %v, want 5", trips, ok)
+	}
+
+	data, _ := os.ReadFile(a)
+	for name, bad := range map[string][]byte{
+		"magic":     append([]byte("V67PROF0"), data[8:]...),
+		"truncated": data[:len(data)-1],
+		"empty":     nil,
+	} {
+		path := filepath.Join(t.TempDir(), name)
+		os.WriteFile(path, bad, 0644)
+		if _, err := LoadProfile(path); err == nil {
+			t.Errorf("%s profile loaded without error", name)
+		}
+	}
+}
+
+func TestMatchArmsExclusive(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"x { 0 -> 1\n 1 -> 2\n ~> 3 }", true},
+		{"x { 0 -> 1\n 0 -> 2 }", false},
+		{"x { | x > 0 -> 1\n | x > 1 -> 2 }", false},
+		{"f() { 0 -> 1\n 1 -> 2 }", false},
+	}
+	for _, tt := range tests {
+		program := NewParser("x := 1\nf := () -> 1\ny = " + tt.code).ParseProgram()
+		match, ok := program.Statements[2].(*AssignStmt).Value.(*MatchExpr)
+		if !ok {
+			t.Fatalf("%q is not a match", tt.code)
+		}
+		if got := matchArmsExclusive(match); got != tt.want {
+			t.Errorf("matchArmsExclusive(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
@@ -164,6 +164,40 @@ var arm64Registers = map[string]Register{
 	"w2": {Name: "w2", Size: 32, Encoding: 2},
 	"w3": {Name: "w3", Size: 32, Encoding: 3},
 
+	// 64-bit floating-point registers
+	"d0":  {Name: "d0", Size: 64, Encoding: 0},
+	"d1":  {Name: "d1", Size: 64, Encoding: 1},
+	"d2":  {Name: "d2", Size: 64, Encoding: 2},
+	"d3":  {Name: "d3", Size: 64, Encoding: 3},
+	"d4":  {Name: "d4", Size: 64, Encoding: 4},
+	"d5":  {Name: "d5", Size: 64, Encoding: 5},
+	"d6":  {Name: "d6", Size: 64, Encoding: 6},
+	"d7":  {Name: "d7", Size: 64, Encoding: 7},
+	"d8":  {Name: "d8", Size: 64, Encoding: 8},
+	"d9":  {Name: "d9", Size: 64, Encoding: 9},
+	"d10": {Name: "d10", Size: 64, Encoding: 10},
+	"d11": {Name: "d11", Size: 64, Encoding: 11},
+	"d12": {Name: "d12", Size: 64, Encoding: 12},
+	"d13": {Name: "d13", Size: 64, Encoding: 13},
+	"d14": {Name: "d14", Size: 64, Encoding: 14},
+	"d15": {Name: "d15", Size: 64, Encoding: 15},
+	"d16": {Name: "d16", Size: 64, Encoding: 16},
+	"d17": {Name: "d17", Size: 64, Encoding: 17},
+	"d18": {Name: "d18", Size: 64, Encoding: 18},
+	"d19": {Name: "d19", Size: 64, Encoding: 19},
+	"d20": {Name: "d20", Size: 64, Encoding: 20},
+	"d21": {Name: "d21", Size: 64, Encoding: 21},
+	"d22": {Name: "d22", Size: 64, Encoding: 22},
+	"d23": {Name: "d23", Size: 64, Encoding: 23},
+	"d24": {Name: "d24", Size: 64, Encoding: 24},
+	"d25": {Name: "d25", Size: 64, Encoding: 25},
+	"d26": {Name: "d26", Size: 64, Encoding: 26},
+	"d27": {Name: "d27", Size: 64, Encoding: 27},
+	"d28": {Name: "d28", Size: 64, Encoding: 28},
+	"d29": {Name: "d29", Size: 64, Encoding: 29},
+	"d30": {Name: "d30", Size: 64, Encoding: 30},
+	"d31": {Name: "d31", Size: 64, Encoding: 31},
+
 	// SVE scalable vector registers (128-2048 bits, implementation defined)
 	"z0":  {Name: "z0", Size: 512, Encoding: 0}, // Size shown as 512 for reference
 	"z1":  {Name: "z1", Size: 512, Encoding: 1},
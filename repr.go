@@ -0,0 +1,334 @@
+// Completion: 80% - Representation analysis: booleans that never need their map form
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Representation analysis
+//
+// Numbers are conceptually {0: value} but always live unboxed in xmm
+// registers. yes and no are real maps, {0: 1.0, 1: 1.0} and {0: 0.0, 1: 0.0},
+// and every evaluation of the literal costs a malloc. The map form is only
+// needed where the marker entry can be observed: in lists and maps, in == and
+// != (yes is not 1.0), in casts, in C calls, in the print functions, as a
+// function result and in functions whose parameter reaches any of those.
+//
+// A literal whose value only reaches conditions, logical and arithmetic
+// operators, and local variables and parameters that are used the same way,
+// is compiled to a plain 1.0 or 0.0 instead.
+
+// scalarOperators use their operands as plain numbers. + is missing because
+// it also concatenates, == and != because they tell yes from 1.0.
+var scalarOperators = map[string]bool{
+	"and": true, "or": true, "xor": true,
+	"<": true, "<=": true, ">": true, ">=": true,
+	"-": true, "*": true, "/": true, "%": true, "**": true,
+}
+
+// ScalarAnalysis records the boolean literals that can stay unboxed
+type ScalarAnalysis struct {
+	paramBoxed map[string][]bool // which parameters of top-level functions need the map form
+	boxed      map[*BooleanExpr]bool
+}
+
+// scalarFunc is the analysis of one function body. Values flow from nodes
+// (literals and local variables) into the local variables listed in into.
+type scalarFunc struct {
+	sa      *ScalarAnalysis
+	name    string
+	params  []string
+	locals  map[string]bool
+	into    map[string][]string
+	boxed   map[string]bool
+	siteIDs map[*BooleanExpr]string
+	sites   []*BooleanExpr
+	lambdas []*LambdaExpr // nested functions, analyzed on their own
+}
+
+// newScalarAnalysis decides the representation of every boolean literal in
+// the program
+func newScalarAnalysis(program *Program) *ScalarAnalysis {
+	sa := &ScalarAnalysis{
+		paramBoxed: make(map[string][]bool),
+		boxed:      make(map[*BooleanExpr]bool),
+	}
+	defined := make(map[string]int)
+	funcs := make(map[string]*LambdaExpr)
+	for _, stmt := range program.Statements {
+		assign, ok := stmt.(*AssignStmt)
+		if !ok {
+			continue
+		}
+		defined[assign.Name]++
+		lambda, ok := assign.Value.(*LambdaExpr)
+		if ok && !assign.Mutable && !assign.IsHot && lambda.VariadicParam == "" && len(lambda.CapturedVars) == 0 {
+			funcs[assign.Name] = lambda
+		}
+	}
+	var names []string
+	for name, lambda := range funcs {
+		if defined[name] == 1 {
+			names = append(names, name)
+			sa.paramBoxed[name] = make([]bool, len(lambda.Params))
+		}
+	}
+	sort.Strings(names)
+
+	// Add parameters that need the map form until no function changes
+	for changed := true; changed; {
+		changed = false
+		for _, name := range names {
+			lambda := funcs[name]
+			f := sa.analyze(name, lambda.Params, lambda.Body)
+			for i, param := range lambda.Params {
+				if !sa.paramBoxed[name][i] && f.needsBox(param) {
+					sa.paramBoxed[name][i] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	// Module-level variables are globals, so the top level has no locals
+	top := sa.newFunc("", nil)
+	for _, stmt := range program.Statements {
+		top.statement(stmt)
+	}
+	work := []*scalarFunc{top}
+	for len(work) > 0 {
+		f := work[0]
+		work = work[1:]
+		for _, site := range f.sites {
+			if f.needsBox(f.siteIDs[site]) {
+				sa.boxed[site] = true
+			} else if _, seen := sa.boxed[site]; !seen {
+				sa.boxed[site] = false
+			}
+		}
+		for _, lambda := range f.lambdas {
+			name := ""
+			for n, l := range funcs {
+				if l == lambda {
+					name = n
+				}
+			}
+			work = append(work, sa.analyze(name, lambda.Params, lambda.Body))
+		}
+	}
+	return sa
+}
+
+// Unboxed reports whether a boolean literal is compiled to a plain number
+func (sa *ScalarAnalysis) Unboxed(e *BooleanExpr) bool {
+	if sa == nil {
+		return false
+	}
+	boxed, ok := sa.boxed[e]
+	return ok && !boxed
+}
+
+func (sa *ScalarAnalysis) newFunc(name string, params []string) *scalarFunc {
+	f := &scalarFunc{
+		sa:      sa,
+		name:    name,
+		params:  params,
+		locals:  make(map[string]bool),
+		into:    make(map[string][]string),
+		boxed:   make(map[string]bool),
+		siteIDs: make(map[*BooleanExpr]string),
+	}
+	for _, param := range params {
+		f.locals[param] = true
+	}
+	return f
+}
+
+func (sa *ScalarAnalysis) analyze(name string, params []string, body Expression) *scalarFunc {
+	f := sa.newFunc(name, params)
+	f.box(f.value(body))
+	return f
+}
+
+// ===== Building the flow graph =====
+
+func (f *scalarFunc) ref(name string) []string {
+	if f.locals[name] {
+		return []string{name}
+	}
+	return nil
+}
+
+func (f *scalarFunc) box(ids []string) {
+	for _, id := range ids {
+		f.boxed[id] = true
+	}
+}
+
+func (f *scalarFunc) site(e *BooleanExpr) []string {
+	id, ok := f.siteIDs[e]
+	if !ok {
+		id = fmt.Sprintf("\x00bool%d", len(f.sites))
+		f.siteIDs[e] = id
+		f.sites = append(f.sites, e)
+	}
+	return []string{id}
+}
+
+// value analyzes an expression and returns the nodes its value may be
+func (f *scalarFunc) value(expr Expression) []string {
+	switch e := expr.(type) {
+	case nil:
+		return nil
+	case *NumberExpr, *StringExpr, *RandomExpr, *LoopStateExpr:
+		return nil
+	case *BooleanExpr:
+		return f.site(e)
+	case *IdentExpr:
+		return f.ref(e.Name)
+	case *BinaryExpr:
+		left, right := f.value(e.Left), f.value(e.Right)
+		if !scalarOperators[e.Operator] {
+			f.box(left)
+			f.box(right)
+		}
+	case *UnaryExpr:
+		if refs := f.value(e.Operand); e.Operator != "not" && e.Operator != "-" {
+			f.box(refs)
+		}
+	case *FMAExpr:
+		f.value(e.A)
+		f.value(e.B)
+		f.value(e.C)
+	case *BlockExpr:
+		return f.block(e.Statements)
+	case *MatchExpr:
+		// Without value matches the condition is only tested for zero
+		condition := f.value(e.Condition)
+		var result []string
+		for _, clause := range e.Clauses {
+			if guard, ok := clause.Guard.(*BinaryExpr); ok && guard.Left == e.Condition {
+				f.box(condition)
+				f.box(f.value(guard.Right))
+			} else {
+				f.value(clause.Guard)
+			}
+			result = append(result, f.value(clause.Result)...)
+		}
+		return append(result, f.value(e.DefaultExpr)...)
+	case *LambdaExpr:
+		for _, name := range e.CapturedVars {
+			f.box(f.ref(name))
+		}
+		f.lambdas = append(f.lambdas, e)
+	case *CallExpr:
+		f.call(e)
+	case *JumpExpr:
+		f.box(f.value(e.Value))
+	default:
+		f.boxAll(e)
+	}
+	return nil
+}
+
+func (f *scalarFunc) call(e *CallExpr) {
+	params := f.sa.paramBoxed[e.Function]
+	switch {
+	case f.name != "" && (e.Function == f.name || e.Function == "me") && len(e.Args) == len(f.params):
+		for i, arg := range e.Args {
+			for _, id := range f.value(arg) {
+				f.into[id] = append(f.into[id], f.params[i])
+			}
+		}
+	case !f.locals[e.Function] && !e.IsCFFI && params != nil && len(params) == len(e.Args):
+		for i, arg := range e.Args {
+			if refs := f.value(arg); params[i] {
+				f.box(refs)
+			}
+		}
+	default:
+		for _, arg := range e.Args {
+			f.box(f.value(arg))
+		}
+	}
+}
+
+// block analyzes statements and returns the nodes of the block's value
+func (f *scalarFunc) block(stmts []Statement) []string {
+	for i, stmt := range stmts {
+		if last, ok := stmt.(*ExpressionStmt); ok && i == len(stmts)-1 {
+			return f.value(last.Expr)
+		}
+		f.statement(stmt)
+	}
+	return nil
+}
+
+func (f *scalarFunc) statement(stmt Statement) {
+	switch s := stmt.(type) {
+	case *ExpressionStmt:
+		f.value(s.Expr)
+	case *AssignStmt:
+		refs := f.value(s.Value)
+		if f.name != "" && !s.IsUpdate && !s.IsReuseMutable {
+			f.locals[s.Name] = true
+		}
+		if f.locals[s.Name] {
+			for _, id := range refs {
+				f.into[id] = append(f.into[id], s.Name)
+			}
+		} else {
+			f.box(refs)
+		}
+	case *LoopStmt:
+		f.box(f.value(s.Iterable))
+		f.locals[s.Iterator] = f.name != ""
+		f.block(s.Body)
+	case *WhileStmt:
+		f.value(s.Condition)
+		f.block(s.Body)
+	case *JumpStmt:
+		f.box(f.value(s.Value))
+	default:
+		f.boxAll(s)
+	}
+}
+
+// boxAll gives everything in a node the map form, for code the analysis does
+// not model
+func (f *scalarFunc) boxAll(node Node) {
+	walkProfileSites(reflect.ValueOf(node), "", func(n interface{}, _ string) string {
+		switch n := n.(type) {
+		case *BooleanExpr:
+			f.box(f.site(n))
+		case *IdentExpr:
+			f.box(f.ref(n.Name))
+		case *AssignStmt:
+			f.box(f.ref(n.Name))
+		}
+		return ""
+	})
+}
+
+// needsBox reports whether a node's value reaches a place that needs the map
+// form
+func (f *scalarFunc) needsBox(id string) bool {
+	seen := map[string]bool{id: true}
+	work := []string{id}
+	for len(work) > 0 {
+		id := work[len(work)-1]
+		work = work[:len(work)-1]
+		if f.boxed[id] {
+			return true
+		}
+		for _, next := range f.into[id] {
+			if !seen[next] {
+				seen[next] = true
+				work = append(work, next)
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// allocationCalls compiles a program and returns the number of allocator
+// calls in the generated code
+func allocationCalls(t *testing.T, code string) int {
+	t.Helper()
+	// The allocations are those of the AST code generator
+	defer func(old bool) { NoIRFlag = old }(NoIRFlag)
+	NoIRFlag = true
+	osType, _ := ParseOS(runtime.GOOS)
+	archType, _ := ParseArch(runtime.GOARCH)
+	compiler, err := NewC67Compiler(Platform{OS: osType, Arch: archType}, false)
+	if err != nil {
+		t.Fatalf("NewC67Compiler: %v", err)
+	}
+	program := parseSource(code, "test.vibe67")
+	if err := compiler.Compile(program, filepath.Join(t.TempDir(), "test")); err != nil {
+		t.Fatalf("compilation failed: %v", err)
+	}
+	return compiler.allocationCalls()
+}
+
+func TestScalarAnalysis(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want []bool // unboxed, for each literal in source order
+	}{
+		{"condition", `f = (n) {
+    | yes and n > 2 => n
+    ~> 0
+}`, []bool{true}},
+		{"printed", `f = (n) -> {
+    println(yes)
+    n
+}`, []bool{false}},
+		{"compared", `f = (n) -> {
+    b := no
+    b == 0
+}`, []bool{false}},
+		{"local used as number", `f = (n) -> {
+    b := no
+    r := {
+        | not b => n
+        ~> 0
+    }
+    r
+}`, []bool{true}},
+		{"stored in list", `f = (n) -> {
+    b := yes
+    v := [b, n]
+    v[1]
+}`, []bool{false}},
+		{"returned", `f = (n) -> {
+    yes
+}`, []bool{false}},
+		{"argument used as number", `g = (flag, n) {
+    | flag => n
+    ~> 0
+}
+f = (n) -> g(yes, n)`, []bool{true}},
+		{"argument printed", `g = (flag, n) -> {
+    println(flag)
+    n
+}
+f = (n) -> g(yes, n)`, []bool{false}},
+		{"global", `b := yes
+f = (n) {
+    | b => n
+    ~> 0
+}`, []bool{false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program := NewParser(tt.code).ParseProgram()
+			sa := newScalarAnalysis(program)
+			var got []bool
+			walkProfileSites(reflect.ValueOf(program), "", func(n interface{}, _ string) string {
+				if b, ok := n.(*BooleanExpr); ok {
+					got = append(got, sa.Unboxed(b))
+				}
+				return ""
+			})
+			if len(got) != len(tt.want) {
+				t.Fatalf("found %d boolean literals, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("literal %d unboxed = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNumericProgramsDoNotAllocate(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("allocation counting is checked on the x86-64 backend")
+	}
+	fib, err := os.ReadFile("examples/fib.v67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := `pick = (flag, n) {
+    | flag and n > 2 => n * 2
+    ~> n
+}
+main = {
+    done := no
+    total := 0
+    @ i in 0..<10 {
+        total <- total + pick(yes, i)
+    }
+    r := {
+        | not done => total
+        ~> 0
+    }
+    println(r)
+}
+`
+	// fib has no booleans and never allocated; flags allocated a map for
+	// each of its two boolean literals before they were unboxed
+	for name, code := range map[string]string{"fib": string(fib), "flags": flags} {
+		if n := allocationCalls(t, code); n != 0 {
+			t.Errorf("%s: %d allocation calls, want none", name, n)
+		}
+	}
+	// Printing the flag needs the map form, so the same program allocates again
+	printed := strings.Replace(flags, "done := no\n", "done := no\n    println(done)\n", 1)
+	if n := allocationCalls(t, printed); n == 0 {
+		t.Errorf("printed flag does not allocate its boolean")
+	}
+	if n := allocationCalls(t, "main = {\n    println(yes)\n}\n"); n == 0 {
+		t.Errorf("println(yes) does not allocate its boolean")
+	}
+	if got := compileAndRun(t, flags); got != "87\n" {
+		t.Errorf("got %q", got)
+	}
+}
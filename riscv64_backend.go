@@ -417,7 +417,7 @@ func (r *RISCV64Backend) JumpConditional(condition JumpCondition, offset int32)
 		(funct3 << 12) |
 		(5 << 15) | // rs1 = t0 (x5)
 		(0 << 20) | // rs2 = x0
-		((imm & 0x800) << 20) | // imm[11]
+		((imm & 0x800) >> 4) | // imm[11]
 		((imm & 0x1E) << 7) | // imm[4:1]
 		((imm & 0x7E0) << 20) | // imm[10:5]
 		((imm & 0x1000) << 19) // imm[12]
@@ -695,7 +695,7 @@ func (r *RISCV64Backend) Cvttsd2si(dst, src string) {
 	}
 
 	// FCVT.L.D: 1100001 00010 fs1 rm(001=rtz) rd 1010011
-	instr := uint32(0xC220D053) | // rm=001 (round toward zero)
+	instr := uint32(0xC2201053) | // rm=001 (round toward zero)
 		(uint32(srcEnc&31) << 15) | // fs1
 		(uint32(dstReg.Encoding&31) << 7) // rd
 
@@ -1,4 +1,4 @@
-// Completion: 98% - Codegen complete with symbol loading, production-ready
+// Completion: 75% - Codegen lowers the SSA IR; constructs the IR keeps opaque are reported as unsupported
 package main
 
 import (
@@ -7,260 +7,20 @@ import (
 
 // RiscvCodeGen handles RISC-V64 code generation
 type RiscvCodeGen struct {
-	out       *RiscvOut
-	eb        *ExecutableBuilder
-	stackVars map[string]int // variable name -> stack offset from fp
-	stackSize int            // current stack size
+	eb *ExecutableBuilder
 }
 
 // NewRiscvCodeGen creates a new RISC-V64 code generator
 func NewRiscvCodeGen(eb *ExecutableBuilder) *RiscvCodeGen {
-	target := NewTarget(ArchRiscv64, OSLinux)
-	return &RiscvCodeGen{
-		out:       &RiscvOut{out: NewOut(target, eb.TextWriter(), eb)},
-		eb:        eb,
-		stackVars: make(map[string]int),
-		stackSize: 0,
-	}
+	return &RiscvCodeGen{eb: eb}
 }
 
-// CompileProgram compiles a Vibe67 program to RISC-V64
+// CompileProgram compiles a Vibe67 program to RISC-V64 by building the SSA IR
+// for it and lowering that through the RISC-V64 backend
 func (rcg *RiscvCodeGen) CompileProgram(program *Program) error {
-	// Function prologue
-	// addi sp, sp, -32  # Allocate stack frame
-	rcg.out.AddImm("sp", "sp", -32)
-	// sd ra, 24(sp)     # Save return address
-	rcg.out.Store64("ra", "sp", 24)
-	// sd s0, 16(sp)     # Save frame pointer
-	rcg.out.Store64("s0", "sp", 16)
-	// addi s0, sp, 32   # Set frame pointer
-	rcg.out.AddImm("s0", "sp", 32)
-
-	// Compile each statement
-	for _, stmt := range program.Statements {
-		if err := rcg.compileStatement(stmt); err != nil {
-			return err
-		}
-	}
-
-	// Function epilogue (if no explicit exit)
-	// li a0, 0          # Exit code 0
-	rcg.out.LoadImm("a0", 0)
-	// li a7, 93         # Exit syscall number
-	rcg.out.LoadImm("a7", 93)
-	// ecall
-	rcg.out.Ecall()
-
-	return nil
-}
-
-// compileStatement compiles a single statement
-func (rcg *RiscvCodeGen) compileStatement(stmt Statement) error {
-	switch s := stmt.(type) {
-	case *ExpressionStmt:
-		return rcg.compileExpression(s.Expr)
-	case *AssignStmt:
-		return rcg.compileAssignment(s)
-	case *CStructDecl:
-		// Cstruct declarations generate no runtime code
-		// Constants are already available via Name_SIZEOF and Name_field_OFFSET
-		return nil
-	default:
-		return fmt.Errorf("unsupported statement type for RISC-V64: %T", stmt)
-	}
-}
-
-// compileExpression compiles an expression
-func (rcg *RiscvCodeGen) compileExpression(expr Expression) error {
-	switch e := expr.(type) {
-	case *NumberExpr:
-		// Load number into fa0 (floating-point register)
-		// For now, convert to integer and load
-		intVal := int64(e.Value)
-		return rcg.out.LoadImm("a0", intVal)
-
-	case *StringExpr:
-		// Store string in rodata
-		label := fmt.Sprintf("str_%d", len(rcg.eb.consts))
-		rcg.eb.Define(label, e.Value+"\x00") // Null-terminated
-
-		// Load address of string using PC-relative addressing
-		rcg.out.LeaSymbolToReg("a0", label)
-		return nil
-
-	case *CallExpr:
-		return rcg.compileCall(e)
-
-	case *BinaryExpr:
-		return rcg.compileBinaryOp(e)
-
-	case *IdentExpr:
-		// Load variable from stack
-		offset, ok := rcg.stackVars[e.Name]
-		if !ok {
-			return fmt.Errorf("undefined variable: %s", e.Name)
-		}
-		// ld a0, -offset(s0)
-		return rcg.out.Load64("a0", "s0", -int32(offset))
-
-	default:
-		return fmt.Errorf("unsupported expression type for RISC-V64: %T", expr)
-	}
-}
-
-// compileBinaryOp compiles a binary operation
-func (rcg *RiscvCodeGen) compileBinaryOp(binop *BinaryExpr) error {
-	// Compile left operand -> a0
-	if err := rcg.compileExpression(binop.Left); err != nil {
-		return err
-	}
-
-	// Save left operand to t0
-	if err := rcg.out.Move("t0", "a0"); err != nil {
-		return err
-	}
-
-	// Compile right operand -> a0
-	if err := rcg.compileExpression(binop.Right); err != nil {
-		return err
-	}
-
-	// Move right operand to t1
-	if err := rcg.out.Move("t1", "a0"); err != nil {
-		return err
-	}
-
-	// Perform operation: result in a0
-	switch binop.Operator {
-	case "+":
-		return rcg.out.Add("a0", "t0", "t1")
-	case "-":
-		return rcg.out.Sub("a0", "t0", "t1")
-	case "*":
-		return rcg.out.Mul("a0", "t0", "t1")
-	case "/":
-		return rcg.out.Div("a0", "t0", "t1")
-	case "%":
-		return rcg.out.Rem("a0", "t0", "t1")
-	case "&":
-		return rcg.out.And("a0", "t0", "t1")
-	case "|":
-		return rcg.out.Or("a0", "t0", "t1")
-	case "^":
-		return rcg.out.Xor("a0", "t0", "t1")
-	case "<<":
-		return rcg.out.Sll("a0", "t0", "t1")
-	case ">>":
-		return rcg.out.Srl("a0", "t0", "t1")
-	default:
-		return fmt.Errorf("unsupported binary operator for RISC-V64: %s", binop.Operator)
-	}
-}
-
-// compileAssignment compiles an assignment statement
-func (rcg *RiscvCodeGen) compileAssignment(assign *AssignStmt) error {
-	// Compile the value
-	if err := rcg.compileExpression(assign.Value); err != nil {
-		return err
+	mod := BuildIR(program)
+	if err := mod.Verify(); err != nil {
+		return fmt.Errorf("invalid IR: %v", err)
 	}
-
-	// Allocate stack space for variable
-	rcg.stackSize += 8
-	rcg.stackVars[assign.Name] = rcg.stackSize
-
-	// Store result on stack
-	// sd a0, -offset(s0)
-	return rcg.out.Store64("a0", "s0", -int32(rcg.stackSize))
-}
-
-// compileCall compiles a function call
-func (rcg *RiscvCodeGen) compileCall(call *CallExpr) error {
-	switch call.Function {
-	case "println":
-		return rcg.compilePrintln(call)
-	case "exit":
-		return rcg.compileExit(call)
-	default:
-		return fmt.Errorf("unsupported function for RISC-V64: %s", call.Function)
-	}
-}
-
-// compilePrintln compiles a println call using RISC-V write syscall
-func (rcg *RiscvCodeGen) compilePrintln(call *CallExpr) error {
-	if len(call.Args) == 0 {
-		return fmt.Errorf("println requires an argument")
-	}
-
-	arg := call.Args[0]
-
-	switch a := arg.(type) {
-	case *StringExpr:
-		// Store string in rodata
-		label := fmt.Sprintf("str_%d", len(rcg.eb.consts))
-		content := a.Value + "\n\x00"
-		rcg.eb.Define(label, content)
-
-		// RISC-V write syscall:
-		// a7 = 64 (write)
-		// a0 = 1 (stdout)
-		// a1 = buffer address
-		// a2 = length
-
-		// li a7, 64         # write syscall
-		if err := rcg.out.LoadImm("a7", 64); err != nil {
-			return err
-		}
-
-		// li a0, 1          # stdout
-		if err := rcg.out.LoadImm("a0", 1); err != nil {
-			return err
-		}
-
-		// Load string address into a1 using PC-relative addressing
-		rcg.out.LeaSymbolToReg("a1", label)
-
-		// li a2, length
-		if err := rcg.out.LoadImm("a2", int64(len(content)-1)); err != nil {
-			return err
-		}
-
-		// ecall
-		rcg.out.Ecall()
-
-	case *NumberExpr:
-		// For numbers, we need to convert to string
-		// This is complex - for now, just print a placeholder
-		return fmt.Errorf("println(number) not yet implemented for RISC-V64")
-
-	default:
-		return fmt.Errorf("unsupported println argument type for RISC-V64: %T", arg)
-	}
-
-	return nil
-}
-
-// compileExit compiles an exit call
-func (rcg *RiscvCodeGen) compileExit(call *CallExpr) error {
-	exitCode := int64(0)
-
-	if len(call.Args) > 0 {
-		if num, ok := call.Args[0].(*NumberExpr); ok {
-			exitCode = int64(num.Value)
-		}
-	}
-
-	// li a0, exitCode
-	if err := rcg.out.LoadImm("a0", exitCode); err != nil {
-		return err
-	}
-
-	// li a7, 93  # exit syscall
-	if err := rcg.out.LoadImm("a7", 93); err != nil {
-		return err
-	}
-
-	// ecall
-	rcg.out.Ecall()
-
-	return nil
+	return LowerIR(mod, rcg.eb)
 }
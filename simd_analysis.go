@@ -142,6 +142,14 @@ func (sa *SIMDAnalyzer) findExprOps(expr Expression) []string {
 		ops = append(ops, sa.findExprOps(e.Operand)...)
 	case *CallExpr:
 		ops = append(ops, "call:"+e.Function)
+		for _, arg := range e.Args {
+			ops = append(ops, sa.findExprOps(arg)...)
+		}
+	case *FMAExpr:
+		ops = append(ops, "fma")
+		ops = append(ops, sa.findExprOps(e.A)...)
+		ops = append(ops, sa.findExprOps(e.B)...)
+		ops = append(ops, sa.findExprOps(e.C)...)
 	}
 
 	return ops
@@ -150,7 +158,7 @@ func (sa *SIMDAnalyzer) findExprOps(expr Expression) []string {
 // hasVectorizableOperations checks if operations can be vectorized
 func (sa *SIMDAnalyzer) hasVectorizableOperations(ops []string) bool {
 	vectorizableOps := map[string]bool{
-		"+": true, "-": true, "*": true, "/": true,
+		"+": true, "-": true, "*": true, "/": true, "fma": true,
 		"<": true, ">": true, "<=": true, ">=": true, "==": true, "!=": true,
 		"call:sqrt": true, "call:abs": true, "call:min": true, "call:max": true,
 	}
@@ -194,6 +194,19 @@ func (o *Out) subpdX86(dst, src string) {
 	fmt.Sscanf(src, "xmm%d", &srcNum)
 
 	o.Write(0x66) // prefix
+
+	// REX if needed
+	if dstNum >= 8 || srcNum >= 8 {
+		rex := uint8(0x40)
+		if dstNum >= 8 {
+			rex |= 0x04 // REX.R
+		}
+		if srcNum >= 8 {
+			rex |= 0x01 // REX.B
+		}
+		o.Write(rex)
+	}
+
 	o.Write(0x0F)
 	o.Write(0x5C) // SUBPD opcode
 
@@ -228,6 +241,19 @@ func (o *Out) mulpdX86(dst, src string) {
 	fmt.Sscanf(src, "xmm%d", &srcNum)
 
 	o.Write(0x66)
+
+	// REX if needed
+	if dstNum >= 8 || srcNum >= 8 {
+		rex := uint8(0x40)
+		if dstNum >= 8 {
+			rex |= 0x04 // REX.R
+		}
+		if srcNum >= 8 {
+			rex |= 0x01 // REX.B
+		}
+		o.Write(rex)
+	}
+
 	o.Write(0x0F)
 	o.Write(0x59) // MULPD opcode
 
@@ -262,6 +288,19 @@ func (o *Out) divpdX86(dst, src string) {
 	fmt.Sscanf(src, "xmm%d", &srcNum)
 
 	o.Write(0x66)
+
+	// REX if needed
+	if dstNum >= 8 || srcNum >= 8 {
+		rex := uint8(0x40)
+		if dstNum >= 8 {
+			rex |= 0x04 // REX.R
+		}
+		if srcNum >= 8 {
+			rex |= 0x01 // REX.B
+		}
+		o.Write(rex)
+	}
+
 	o.Write(0x0F)
 	o.Write(0x5E) // DIVPD opcode
 
@@ -463,6 +502,52 @@ func (o *Out) cvttsd2siX86(dst, src string) {
 	}
 }
 
+// Cvtss2sd - Widen the float32 in the low lane of src to a float64 in dst
+func (o *Out) Cvtss2sd(dst, src string) {
+	switch o.target.Arch() {
+	case ArchX86_64:
+		o.cvtFloatWidthX86(0xF3, "cvtss2sd", dst, src)
+	}
+}
+
+// Cvtsd2ss - Narrow the float64 in src to a float32 in the low lane of dst
+func (o *Out) Cvtsd2ss(dst, src string) {
+	switch o.target.Arch() {
+	case ArchX86_64:
+		o.cvtFloatWidthX86(0xF2, "cvtsd2ss", dst, src)
+	}
+}
+
+// cvtFloatWidthX86 emits F3/F2 [REX] 0F 5A /r; the prefix picks the direction
+func (o *Out) cvtFloatWidthX86(prefix uint8, name, dst, src string) {
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "%s %s, %s: ", name, dst, src)
+	}
+
+	var dstNum, srcNum int
+	fmt.Sscanf(dst, "xmm%d", &dstNum)
+	fmt.Sscanf(src, "xmm%d", &srcNum)
+
+	o.Write(prefix)
+	if dstNum >= 8 || srcNum >= 8 {
+		rex := uint8(0x40)
+		if dstNum >= 8 {
+			rex |= 0x04 // REX.R
+		}
+		if srcNum >= 8 {
+			rex |= 0x01 // REX.B
+		}
+		o.Write(rex)
+	}
+	o.Write(0x0F)
+	o.Write(0x5A)
+	o.Write(uint8(0xC0) | uint8((dstNum&7)<<3) | uint8(srcNum&7))
+
+	if VerboseMode {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
 // Ucomisd - Compare scalar double-precision floating-point values and set EFLAGS
 // ucomisd xmm1, xmm2
 func (o *Out) Ucomisd(xmm1, xmm2 string) {
@@ -1,6 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -204,3 +212,267 @@ printf("\n")
 		t.Errorf("Vectorized with cleanup failed\nExpected: %s\nGot: %s", expected, output)
 	}
 }
+
+// hostHasCPUFlag reports whether /proc/cpuinfo lists a CPU feature flag
+func hostHasCPUFlag(flag string) bool {
+	data, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "flags") {
+			for _, f := range strings.Fields(line) {
+				if f == flag {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// TestVectorizedLoopWidths runs vectorized loops with every x86-64 vector
+// width and with runtime dispatch, and compares against the scalar results
+func TestVectorizedLoopWidths(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.Skip("vector widths are selected for x86-64 Linux")
+	}
+
+	code := `
+a := [1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19]
+b := [10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 110, 120, 130, 140, 150, 160, 170, 180, 190]
+c := [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]
+short := [4, 9, 16, 25, 36, 49, 64, 81, 100, 121]
+k := 3
+@ i in 0..<19 {
+    c[i] <- a[i] * k + b[i]
+}
+@ i in 2..<17 {
+    b[i] <- sqrt(b[i] * b[i] * 4) / 2 - a[i]
+}
+@ i in 0..<19 {
+    a[i] <- short[i] + c[i]
+}
+@ i in 0..<19 {
+    printf("%v %v %v\n", a[i], b[i], c[i])
+}
+`
+	var want strings.Builder
+	av := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+	bv := []float64{10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 110, 120, 130, 140, 150, 160, 170, 180, 190}
+	short := []float64{4, 9, 16, 25, 36, 49, 64, 81, 100, 121}
+	cv := make([]float64, 19)
+	for i := range cv {
+		cv[i] = av[i]*3 + bv[i]
+	}
+	for i := 2; i < 17; i++ {
+		bv[i] = math.Sqrt(bv[i]*bv[i]*4)/2 - av[i]
+	}
+	for i := range av {
+		s := 0.0
+		if i < len(short) {
+			s = short[i]
+		}
+		av[i] = s + cv[i]
+	}
+	for i := range av {
+		fmt.Fprintf(&want, "%f %f %f\n", av[i], bv[i], cv[i])
+	}
+
+	defer func() { forcedVectorWidth = 0 }()
+	for _, tt := range []struct {
+		name  string
+		width int
+		flag  string
+	}{
+		{"dispatch", 0, ""},
+		{"sse2", 2, ""}, // without FMA3, whatever the CPU has
+		{"avx2", 4, "avx2"},
+		{"avx512", 8, "avx512f"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.flag != "" && !hostHasCPUFlag(tt.flag) {
+				t.Skipf("CPU does not support %s", tt.flag)
+			}
+			forcedVectorWidth = tt.width
+			if got := compileAndRun(t, code); got != want.String() {
+				t.Errorf("width %d:\nexpected:\n%s\ngot:\n%s", tt.width, want.String(), got)
+			}
+		})
+	}
+}
+
+// TestVectorKernelPlanning checks which loop bodies become vector kernels
+func TestVectorKernelPlanning(t *testing.T) {
+	types := map[string]string{"a": "list", "b": "list", "c": "list", "m": "map", "s": "string"}
+	typeOf := func(e Expression) string {
+		if ident, ok := e.(*IdentExpr); ok && types[ident.Name] != "" {
+			return types[ident.Name]
+		}
+		return "number"
+	}
+	idx := func(list string) Expression {
+		return &IndexExpr{List: &IdentExpr{Name: list}, Index: &IdentExpr{Name: "i"}}
+	}
+	loop := func(dest string, value Expression) *LoopStmt {
+		return &LoopStmt{
+			Iterator:   "i",
+			Iterable:   &RangeExpr{Start: &NumberExpr{Value: 0}, End: &NumberExpr{Value: 10}},
+			Body:       []Statement{&MapUpdateStmt{MapName: dest, Index: &IdentExpr{Name: "i"}, Value: value}},
+			Vectorized: true,
+		}
+	}
+	sv := NewSIMDVectorizer(NewSIMDAnalyzer(NewTarget(ArchX86_64, OSLinux)), NewTarget(ArchX86_64, OSLinux))
+
+	fma := loop("c", &FMAExpr{A: idx("a"), B: &IdentExpr{Name: "k"}, C: idx("b")})
+	kernel, reason := sv.PlanKernel(fma, typeOf)
+	if kernel == nil {
+		t.Fatalf("c[i] <- a[i]*k + b[i] was not vectorized: %s", reason)
+	}
+	wantOps := []vectorOpKind{vectorLoad, vectorLoad, vectorScalar, vectorFma}
+	if len(kernel.ops) != len(wantOps) {
+		t.Fatalf("expected %d operations, got %v", len(wantOps), kernel.ops)
+	}
+	for i, op := range kernel.ops {
+		if op.kind != wantOps[i] {
+			t.Errorf("operation %d: expected %d, got %d", i, wantOps[i], op.kind)
+		}
+	}
+	if kernel.lists[kernel.dest] != "c" || len(kernel.lists) != 3 || len(kernel.scalars) != 1 {
+		t.Errorf("unexpected kernel lists %v (dest %d), scalars %v", kernel.lists, kernel.dest, kernel.scalars)
+	}
+
+	rejected := map[string]*LoopStmt{
+		"map destination":   loop("m", idx("a")),
+		"map source":        loop("c", &BinaryExpr{Left: idx("m"), Operator: "+", Right: idx("a")}),
+		"string operand":    loop("c", &BinaryExpr{Left: idx("a"), Operator: "+", Right: &IdentExpr{Name: "s"}}),
+		"iterator as value": loop("c", &BinaryExpr{Left: idx("a"), Operator: "+", Right: &IdentExpr{Name: "i"}}),
+		"variable divisor":  loop("c", &BinaryExpr{Left: idx("a"), Operator: "/", Right: idx("b")}),
+		"zero divisor":      loop("c", &BinaryExpr{Left: idx("a"), Operator: "/", Right: &NumberExpr{Value: 0}}),
+		"shifted index": loop("c", &IndexExpr{List: &IdentExpr{Name: "a"},
+			Index: &BinaryExpr{Left: &IdentExpr{Name: "i"}, Operator: "+", Right: &NumberExpr{Value: 1}}}),
+		"negated multiply": loop("c", &FMAExpr{A: idx("a"), B: idx("b"), C: idx("c"), IsNegMul: true}),
+	}
+	for name, l := range rejected {
+		if kernel, _ := sv.PlanKernel(l, typeOf); kernel != nil {
+			t.Errorf("%s: expected scalar code, got a kernel", name)
+		}
+	}
+}
+
+// TestVectorFMAFallback checks that the AVX2 and SSE2 loops of kernels with
+// fused multiply-adds only use FMA3 when cpu_has_fma is set
+func TestVectorFMAFallback(t *testing.T) {
+	typeOf := func(e Expression) string {
+		if ident, ok := e.(*IdentExpr); ok && ident.Name != "k" {
+			return "list"
+		}
+		return "number"
+	}
+	idx := func(list string) Expression {
+		return &IndexExpr{List: &IdentExpr{Name: list}, Index: &IdentExpr{Name: "i"}}
+	}
+	sv := NewSIMDVectorizer(NewSIMDAnalyzer(NewTarget(ArchX86_64, OSLinux)), NewTarget(ArchX86_64, OSLinux))
+
+	// The stack holds b[i] in xmm0, a[i] in xmm1 and k in xmm2
+	mulpd := []byte{0x66, 0x0f, 0x59, 0xca} // mulpd xmm1, xmm2
+	tests := []struct {
+		name    string
+		isSub   bool
+		unfused [][]byte
+	}{
+		{"fma", false, [][]byte{mulpd, {0x66, 0x0f, 0x58, 0xc1}}}, // addpd xmm0, xmm1
+		{"fms", true, [][]byte{mulpd, {0x66, 0x0f, 0x5c, 0xc8}, // subpd xmm1, xmm0
+			{0x66, 0x0f, 0x57, 0xc0}, {0x66, 0x0f, 0x56, 0xc1}}}, // xorpd xmm0, xmm0; orpd xmm0, xmm1
+	}
+	for _, tt := range tests {
+		loop := &LoopStmt{
+			Iterator: "i",
+			Iterable: &RangeExpr{Start: &NumberExpr{Value: 0}, End: &NumberExpr{Value: 10}},
+			Body: []Statement{&MapUpdateStmt{MapName: "c", Index: &IdentExpr{Name: "i"},
+				Value: &FMAExpr{A: idx("a"), B: &IdentExpr{Name: "k"}, C: idx("b"), IsSub: tt.isSub}}},
+			Vectorized: true,
+		}
+		kernel, reason := sv.PlanKernel(loop, typeOf)
+		if kernel == nil {
+			t.Fatalf("%s: not vectorized: %s", tt.name, reason)
+		}
+
+		emit := func(f func(fc *C67Compiler)) (*C67Compiler, []byte) {
+			fc, err := NewC67Compiler(Platform{OS: OSLinux, Arch: ArchX86_64}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f(fc)
+			return fc, fc.eb.text.Bytes()
+		}
+		_, unfused := emit(func(fc *C67Compiler) { fc.emitVectorizedBody(kernel, 2, false) })
+		for _, instr := range tt.unfused {
+			if !bytes.Contains(unfused, instr) {
+				t.Errorf("%s: SSE2 loop lacks % x", tt.name, instr)
+			}
+		}
+		_, fused := emit(func(fc *C67Compiler) { fc.emitVectorizedBody(kernel, 2, true) })
+		if bytes.Contains(fused, mulpd) {
+			t.Errorf("%s: fused loop multiplies separately", tt.name)
+		}
+
+		for _, width := range []int{2, 4} {
+			fc, code := emit(func(fc *C67Compiler) { fc.emitFMADispatch(kernel, width) })
+			checked := false
+			for _, reloc := range fc.eb.pcRelocations {
+				checked = checked || reloc.symbolName == "cpu_has_fma"
+			}
+			if !checked {
+				t.Errorf("%s: width %d does not check cpu_has_fma", tt.name, width)
+			}
+			if width == 2 && !bytes.Contains(code, unfused[:len(unfused)-5]) {
+				t.Errorf("%s: width 2 has no loop without FMA3", tt.name)
+			}
+		}
+	}
+}
+
+// TestNEONLoopEncoding compiles a vectorizable loop for ARM64 Linux and checks
+// the NEON instructions in the output
+func TestNEONLoopEncoding(t *testing.T) {
+	code := `main = {
+a := [1, 2, 3, 4, 5]
+b := [5, 4, 3, 2, 1]
+c := [0, 0, 0, 0, 0]
+@ i in 0..<5 {
+    c[i] <- a[i] * 2 - b[i] / 4
+}
+println(c[4])
+}
+`
+	dir := t.TempDir()
+	src := filepath.Join(dir, "neon.vibe67")
+	exe := filepath.Join(dir, "neon")
+	if err := os.WriteFile(src, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompileC67(src, exe, Platform{Arch: ArchARM64, OS: OSLinux}); err != nil {
+		t.Fatalf("compilation failed: %v", err)
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, instr := range map[string]uint32{
+		"ld1 {v16.2d}, [x12]":         0x4c407d90,
+		"mov v17.16b, v24.16b":        0x4eb81f11,
+		"fmul v16.2d, v16.2d, v17.2d": 0x6e71de10,
+		"ld1 {v17.2d}, [x13]":         0x4c407db1,
+		"mov v18.16b, v25.16b":        0x4eb91f32,
+		"fdiv v17.2d, v17.2d, v18.2d": 0x6e72fe31,
+		"fsub v16.2d, v16.2d, v17.2d": 0x4ef1d610,
+		"st1 {v16.2d}, [x11]":         0x4c007d70,
+	} {
+		var word [4]byte
+		binary.LittleEndian.PutUint32(word[:], instr)
+		if !bytes.Contains(data, word[:]) {
+			t.Errorf("missing %s (%08x)", name, instr)
+		}
+	}
+}
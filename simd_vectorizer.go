@@ -1,6 +1,11 @@
-// Completion: 5% - SIMD code generation in progress
+// Completion: 80% - AVX-512/AVX2/SSE2 and NEON loops for element-wise list updates
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
 // SIMDVectorizer generates SIMD code for vectorizable loops
 type SIMDVectorizer struct {
 	analyzer *SIMDAnalyzer
@@ -15,6 +20,50 @@ func NewSIMDVectorizer(analyzer *SIMDAnalyzer, target Target) *SIMDVectorizer {
 	}
 }
 
+// forcedVectorWidth pins the x86-64 vector loop to 8 (AVX-512), 4 (AVX2) or
+// 2 (SSE2) elements instead of choosing at runtime. Zero means CPUID dispatch.
+// SSE2 has no fused multiply-add, so a pinned width of 2 never uses FMA3.
+var forcedVectorWidth int
+
+// Limits of the kernels the code generators can emit
+const (
+	maxVectorLists   = 5 // List pointers live in registers during the loop
+	maxVectorScalars = 8 // Broadcast scalars (v24-v31 on ARM64)
+	maxVectorDepth   = 5 // Vector registers used for intermediate values
+)
+
+// vectorOpKind is an instruction of a vector kernel
+type vectorOpKind int
+
+const (
+	vectorLoad   vectorOpKind = iota // Push lists[index][i]
+	vectorScalar                     // Push scalars[index] broadcast to every lane
+	vectorAdd                        // Pop b, a; push a + b
+	vectorSub                        // Pop b, a; push a - b
+	vectorMul                        // Pop b, a; push a * b
+	vectorDiv                        // Pop b, a; push a / b
+	vectorSqrt                       // Pop a; push sqrt(a)
+	vectorFma                        // Pop b, a, c; push a * b + c (fused)
+	vectorFms                        // Pop b, a, c; push a * b - c (fused)
+)
+
+// vectorOp is one step of a kernel's stack program
+type vectorOp struct {
+	kind  vectorOpKind
+	index int // List or scalar index for loads
+}
+
+// vectorKernel is the body of a loop of the form dest[i] <- f(a[i], b[i], ..., scalars)
+// compiled to a stack program. The stack maps directly onto vector registers.
+type vectorKernel struct {
+	dest     int          // Index of the written list in lists
+	lists    []string     // Lists read or written, by variable name
+	scalars  []Expression // Loop-invariant operands, evaluated once before the loop
+	ops      []vectorOp   // Stack program computing the new value of dest[i]
+	depth    int          // Current stack depth while planning
+	maxDepth int          // Registers needed for intermediate values
+}
+
 // VectorizeLoop generates SIMD code for a loop if possible
 // Returns true if loop was vectorized, false if emitted as scalar
 func (sv *SIMDVectorizer) VectorizeLoop(loop *LoopStmt) bool {
@@ -27,13 +76,8 @@ func (sv *SIMDVectorizer) VectorizeLoop(loop *LoopStmt) bool {
 	}
 
 	// Currently only vectorize simple array operations
-	// Pattern: @ i in range(n) { result[i] = a[i] OP b[i] }
-	if !sv.isSimpleArrayLoop(loop) {
-		return false
-	}
-
-	// Loop can be vectorized (actual code generation deferred)
-	return true
+	// Pattern: @ i in range(n) { result[i] <- a[i] OP b[i] }
+	return sv.isSimpleArrayLoop(loop)
 }
 
 // isSimpleArrayLoop checks if loop follows the simple array pattern
@@ -43,46 +87,185 @@ func (sv *SIMDVectorizer) isSimpleArrayLoop(loop *LoopStmt) bool {
 		return false
 	}
 
-	// Must be an assignment
-	assign, ok := loop.Body[0].(*AssignStmt)
+	// Must be an element update: result[i] <- value
+	update, ok := loop.Body[0].(*MapUpdateStmt)
 	if !ok {
 		return false
 	}
 
-	// Left side must be array access: result[i]
-	if !sv.isArrayAccessWithIterator(assign.Name, loop.Iterator) {
+	// Left side must be indexed by the iterator
+	if !sv.isArrayAccessWithIterator(update.Index, loop.Iterator) {
 		return false
 	}
 
 	// Right side must be simple operation on array elements
-	return sv.isVectorizableExpr(assign.Value, loop.Iterator)
+	return sv.isVectorizableExpr(update.Value, loop.Iterator)
 }
 
-// isArrayAccessWithIterator checks if expression is arr[iterator]
-func (sv *SIMDVectorizer) isArrayAccessWithIterator(name, iterator string) bool {
-	// This is simplified - in real implementation would parse name
-	// For now, just check if it looks like an array access
-	return true
+// isArrayAccessWithIterator checks if an index expression is the loop iterator itself
+func (sv *SIMDVectorizer) isArrayAccessWithIterator(index Expression, iterator string) bool {
+	ident, ok := index.(*IdentExpr)
+	return ok && ident.Name == iterator
 }
 
 // isVectorizableExpr checks if expression can be vectorized
 func (sv *SIMDVectorizer) isVectorizableExpr(expr Expression, iterator string) bool {
 	switch e := expr.(type) {
 	case *BinaryExpr:
+		switch e.Operator {
+		case "+", "-", "*":
+		case "/":
+			// Division by zero produces a tagged error value in scalar code,
+			// so only constant nonzero divisors are computed lane-wise
+			divisor, ok := e.Right.(*NumberExpr)
+			if !ok || divisor.Value == 0 {
+				return false
+			}
+		default:
+			return false
+		}
 		// Both sides must be vectorizable
 		return sv.isVectorizableExpr(e.Left, iterator) &&
 			sv.isVectorizableExpr(e.Right, iterator)
+	case *FMAExpr:
+		return !e.IsNegMul &&
+			sv.isVectorizableExpr(e.A, iterator) &&
+			sv.isVectorizableExpr(e.B, iterator) &&
+			sv.isVectorizableExpr(e.C, iterator)
+	case *CallExpr:
+		return e.Function == "sqrt" && len(e.Args) == 1 &&
+			sv.isVectorizableExpr(e.Args[0], iterator)
 	case *IndexExpr:
-		// Array access with iterator is vectorizable
-		return true
+		// Array access with the iterator is vectorizable
+		_, isIdent := e.List.(*IdentExpr)
+		return isIdent && sv.isArrayAccessWithIterator(e.Index, iterator)
 	case *IdentExpr:
-		// Scalars/constants are vectorizable (broadcast)
+		// Scalars are vectorizable (broadcast), the iterator itself is not
+		return e.Name != iterator
+	case *NumberExpr:
 		return true
 	default:
 		return false
 	}
 }
 
+// PlanKernel turns a vectorizable loop into a vector kernel. typeOf reports
+// the type of an expression in the code generator's scope, so lists can be
+// told apart from maps and strings. Returns nil and a reason if the loop
+// cannot be emitted as a kernel.
+func (sv *SIMDVectorizer) PlanKernel(loop *LoopStmt, typeOf func(Expression) string) (*vectorKernel, string) {
+	if !loop.Vectorized {
+		return nil, "loop not marked as vectorizable by optimizer"
+	}
+	if loop.NumThreads != 0 || loop.NeedsMaxCheck {
+		return nil, "parallel or iteration-checked loop"
+	}
+	if trips, ok := activeProfile.LoopTrips(loop.ProfileKey); ok && trips < profileMinVectorTrips {
+		return nil, fmt.Sprintf("profile shows %.1f iterations per entry", trips)
+	}
+	if !sv.isSimpleArrayLoop(loop) {
+		return nil, "body is not dest[i] <- f(a[i], ...)"
+	}
+
+	update := loop.Body[0].(*MapUpdateStmt)
+	k := &vectorKernel{}
+	dest, ok := k.list(update.MapName, typeOf)
+	if !ok {
+		return nil, fmt.Sprintf("'%s' is not a list", update.MapName)
+	}
+	k.dest = dest
+	if reason := k.plan(update.Value, typeOf); reason != "" {
+		return nil, reason
+	}
+	if len(k.lists) > maxVectorLists {
+		return nil, fmt.Sprintf("%d lists, at most %d fit in registers", len(k.lists), maxVectorLists)
+	}
+	if len(k.scalars) > maxVectorScalars {
+		return nil, fmt.Sprintf("%d scalars, at most %d are supported", len(k.scalars), maxVectorScalars)
+	}
+	if k.maxDepth > maxVectorDepth {
+		return nil, fmt.Sprintf("expression needs %d vector registers", k.maxDepth)
+	}
+	return k, ""
+}
+
+// list returns the index of a list in the kernel, adding it if needed
+func (k *vectorKernel) list(name string, typeOf func(Expression) string) (int, bool) {
+	if typeOf(&IdentExpr{Name: name}) != "list" {
+		return 0, false
+	}
+	for i, existing := range k.lists {
+		if existing == name {
+			return i, true
+		}
+	}
+	k.lists = append(k.lists, name)
+	return len(k.lists) - 1, true
+}
+
+// emit appends an operation and tracks how many registers the stack needs
+func (k *vectorKernel) emit(kind vectorOpKind, index int) {
+	k.ops = append(k.ops, vectorOp{kind: kind, index: index})
+	switch kind {
+	case vectorLoad, vectorScalar:
+		k.depth++
+	case vectorAdd, vectorSub, vectorMul, vectorDiv:
+		k.depth--
+	case vectorFma, vectorFms:
+		k.depth -= 2
+	}
+	if k.depth > k.maxDepth {
+		k.maxDepth = k.depth
+	}
+}
+
+// plan compiles an expression already checked by isVectorizableExpr
+func (k *vectorKernel) plan(expr Expression, typeOf func(Expression) string) string {
+	switch e := expr.(type) {
+	case *IndexExpr:
+		name := e.List.(*IdentExpr).Name
+		index, ok := k.list(name, typeOf)
+		if !ok {
+			return fmt.Sprintf("'%s' is not a list", name)
+		}
+		k.emit(vectorLoad, index)
+	case *IdentExpr, *NumberExpr:
+		if typeOf(e) != "number" {
+			return fmt.Sprintf("operand %s is not a number", e.String())
+		}
+		k.scalars = append(k.scalars, e)
+		k.emit(vectorScalar, len(k.scalars)-1)
+	case *BinaryExpr:
+		if reason := k.plan(e.Left, typeOf); reason != "" {
+			return reason
+		}
+		if reason := k.plan(e.Right, typeOf); reason != "" {
+			return reason
+		}
+		k.emit(map[string]vectorOpKind{"+": vectorAdd, "-": vectorSub, "*": vectorMul, "/": vectorDiv}[e.Operator], 0)
+	case *FMAExpr:
+		// The accumulator goes first so the result lands in its register
+		for _, operand := range []Expression{e.C, e.A, e.B} {
+			if reason := k.plan(operand, typeOf); reason != "" {
+				return reason
+			}
+		}
+		if e.IsSub {
+			k.emit(vectorFms, 0)
+		} else {
+			k.emit(vectorFma, 0)
+		}
+	case *CallExpr:
+		if reason := k.plan(e.Args[0], typeOf); reason != "" {
+			return reason
+		}
+		k.emit(vectorSqrt, 0)
+	default:
+		return fmt.Sprintf("unsupported expression %T", expr)
+	}
+	return ""
+}
+
 // GetVectorizationPlan returns a plan for vectorizing the loop
 func (sv *SIMDVectorizer) GetVectorizationPlan(loop *LoopStmt) *VectorizationPlan {
 	info := sv.analyzer.AnalyzeLoop(loop)
@@ -93,7 +276,7 @@ func (sv *SIMDVectorizer) GetVectorizationPlan(loop *LoopStmt) *VectorizationPla
 
 	return &VectorizationPlan{
 		VectorWidth:  info.VectorWidth,
-		NeedsCleanup: true,     // Usually need cleanup for remaining elements
+		NeedsCleanup: true,     // The scalar loop finishes the remaining elements
 		Strategy:     "unroll", // or "masked" for AVX-512
 		Info:         info,
 	}
@@ -107,64 +290,266 @@ type VectorizationPlan struct {
 	Info         *LoopVectorizationInfo // Analysis info
 }
 
-// Example pseudocode for what vectorized loop would look like:
-// emitVectorizedLoop generates SIMD code for a simple array loop
-func (sv *SIMDVectorizer) emitVectorizedLoop(loop *LoopStmt, info *LoopVectorizationInfo) {
-	// This is a simplified implementation that demonstrates the concept
-	// Full implementation would:
-	// 1. Determine trip count
-	// 2. Generate vectorized body (process VectorWidth elements at once)
-	// 3. Generate scalar cleanup loop (remaining elements)
-	// 4. Handle alignment and masked operations
-
-	// For now, just emit a comment indicating vectorization happened
-	// Real implementation would integrate with codegen
-
-	// Example of what we'd generate for:
-	//   @ i in range(100) { c[i] = a[i] + b[i] }
-	//
-	// Vectorized code (x86-64 AVX, 4 elements at a time):
-	//   mov rcx, 0              ; i = 0
-	// .vector_loop:
-	//   cmp rcx, 96             ; if i >= 96, goto cleanup
-	//   jge .cleanup
-	//
-	//   vmovupd ymm0, [a + rcx*8]    ; Load 4 doubles from a
-	//   vmovupd ymm1, [b + rcx*8]    ; Load 4 doubles from b
-	//   vaddpd ymm0, ymm0, ymm1      ; Add them
-	//   vmovupd [c + rcx*8], ymm0    ; Store result
-	//
-	//   add rcx, 4                   ; i += 4
-	//   jmp .vector_loop
-	//
-	// .cleanup:                      ; Process remaining 0-3 elements
-	//   cmp rcx, 100
-	//   jge .done
-	//   ; Scalar code for c[i] = a[i] + b[i]
-	//   inc rcx
-	//   jmp .cleanup
-	// .done:
-}
-
-// emitVectorizedBody generates SIMD operations for loop body
-func (sv *SIMDVectorizer) emitVectorizedBody(loop *LoopStmt, vectorWidth int) {
-	// This would emit actual SIMD instructions
-	// Using existing infrastructure from vaddpd.go, vmulpd.go, etc.
-}
-
-// emitCleanupLoop generates scalar code for remaining iterations
-func (sv *SIMDVectorizer) emitCleanupLoop(loop *LoopStmt, vectorWidth int) {
-	// This emits scalar version for the last few iterations
-	// that don't fit into a full vector
+// Register assignment for the x86-64 vector loop:
+//
+//	rax = counter, rcx = vector limit, rdx = scratch
+//	rsi, rdi, r8, r9, r10 = pointers to the current element of each list
+//	vec0-vec4 = expression stack, vec5-vec7 = load/store scratch
+//
+// Callee-saved registers hold outer loop counters and r11/r15 hold the
+// parent frame and environment, so none of them are touched.
+var x86VectorListRegs = []string{"rsi", "rdi", "r8", "r9", "r10"}
+
+// emitVectorizedLoop emits the vector part of a range loop. It runs after the
+// counter and limit are initialized and advances the counter past every full
+// vector; the scalar loop that follows handles the remaining elements.
+//
+// Lists are laid out as [count][key0][val0][key1][val1]..., so element i
+// lives at ptr + 16 + 16*i. Each iteration processes W elements:
+//
+//	lo = [p], hi = [p + 8W]           ; keys and values interleaved
+//	x  = unpckhpd(lo, hi)             ; the W values (permuted within lanes)
+//	...                               ; lane-wise arithmetic
+//	k  = unpcklpd(lo, hi)             ; the W keys in the same order
+//	[p] = unpcklpd(k, x), [p + 8W] = unpckhpd(k, x)
+//
+// The iteration range is clamped to the length of every list, so the vector
+// loop never touches memory the bounds-checked scalar loop would not.
+func (fc *C67Compiler) emitVectorizedLoop(kernel *vectorKernel, counterReg string, counterOffset, limitOffset int) {
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "SIMD: Vectorizing %s[i] update over lists %v with %d scalars\n",
+			kernel.lists[kernel.dest], kernel.lists, len(kernel.scalars))
+	}
+
+	// Scratch frame: one pointer per list, then each scalar broadcast to 8 lanes
+	scalarBase := 8 * len(kernel.lists)
+	frameSize := int64(scalarBase + 64*len(kernel.scalars))
+	if frameSize%16 != 0 {
+		frameSize += 8
+	}
+	fc.out.SubImmFromReg("rsp", frameSize)
+	fc.runtimeStack += int(frameSize)
+
+	for i, name := range kernel.lists {
+		fc.compileExpression(&IdentExpr{Name: name})
+		fc.out.MovXmmToMem("xmm0", "rsp", 8*i)
+	}
+	for i, scalar := range kernel.scalars {
+		fc.compileExpression(scalar)
+		for lane := 0; lane < 8; lane++ {
+			fc.out.MovXmmToMem("xmm0", "rsp", scalarBase+64*i+8*lane)
+		}
+	}
+
+	// rax = counter, rcx = limit
+	if counterReg != "" {
+		fc.out.MovRegToReg("rax", counterReg)
+	} else {
+		fc.out.MovMemToReg("rax", "rbp", -counterOffset)
+	}
+	fc.out.MovMemToReg("rcx", "rbp", -limitOffset)
+
+	// Negative indexes read as 0.0 in the scalar loop, leave them to it
+	fc.out.CmpRegToImm("rax", 0)
+	negativeJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpLess, 0)
+
+	// Clamp the limit to the shortest list
+	for i, reg := range x86VectorListRegs[:len(kernel.lists)] {
+		fc.out.MovMemToReg(reg, "rsp", 8*i)
+		fc.out.MovMemToXmm("xmm0", reg, 0)
+		fc.out.Cvttsd2si("rdx", "xmm0") // rdx = count
+		fc.out.CmpRegToReg("rdx", "rcx")
+		fc.out.Emit([]byte{0x48, 0x0f, 0x4c, 0xca}) // cmovl rcx, rdx
+	}
+
+	// Point each register at element[counter]
+	fc.out.MovRegToReg("rdx", "rax")
+	fc.out.ShlImmReg("rdx", 4) // rdx = counter * 16
+	for _, reg := range x86VectorListRegs[:len(kernel.lists)] {
+		fc.out.AddImmToReg(reg, 8)
+		fc.out.AddRegToReg(reg, "rdx")
+	}
+
+	var doneJumps []int
+	if forcedVectorWidth == 0 && fc.eb.target.OS() != OSWindows {
+		// Runtime dispatch on the flags set by emitCPUFeatureDetection
+		for _, width := range []int{8, 4} {
+			flag := "cpu_has_avx512"
+			if width == 4 {
+				flag = "cpu_has_avx2"
+			}
+			fc.out.LeaSymbolToReg("rdx", flag)
+			fc.out.Emit([]byte{0x80, 0x3a, 0x00}) // cmp byte [rdx], 0
+			skipJump := fc.eb.text.Len()
+			fc.out.JumpConditional(JumpEqual, 0)
+
+			if width == 8 {
+				fc.emitVectorizedBody(kernel, width, true) // AVX-512F has its own FMA
+			} else {
+				fc.emitFMADispatch(kernel, width)
+			}
+			doneJumps = append(doneJumps, fc.eb.text.Len())
+			fc.out.JumpUnconditional(0)
+			fc.patchJumpImmediate(skipJump+2, int32(fc.eb.text.Len()-(skipJump+ConditionalJumpSize)))
+		}
+		fc.emitFMADispatch(kernel, 2)
+	} else if forcedVectorWidth == 2 {
+		fc.emitVectorizedBody(kernel, 2, false)
+	} else if forcedVectorWidth != 0 {
+		fc.emitFMADispatch(kernel, forcedVectorWidth)
+	} else {
+		// cpu_has_* flags are not defined on Windows; SSE2 is always there
+		fc.emitVectorizedBody(kernel, 2, false)
+	}
+	for _, pos := range doneJumps {
+		fc.patchJumpImmediate(pos+1, int32(fc.eb.text.Len()-(pos+UnconditionalJumpSize)))
+	}
+
+	fc.emitCleanupLoop(counterReg, counterOffset)
+
+	fc.patchJumpImmediate(negativeJump+2, int32(fc.eb.text.Len()-(negativeJump+ConditionalJumpSize)))
+	fc.out.AddImmToReg("rsp", frameSize)
+	fc.runtimeStack -= int(frameSize)
+}
+
+// usesFMA reports whether the kernel has fused multiply-add operations
+func (k *vectorKernel) usesFMA() bool {
+	for _, op := range k.ops {
+		if op.kind == vectorFma || op.kind == vectorFms {
+			return true
+		}
+	}
+	return false
+}
+
+// emitFMADispatch emits the loop for an AVX2 or SSE2 width. The fused
+// multiply-adds are VEX encoded FMA3, which CPUs without it (every SSE2-only
+// machine, and some with AVX2) do not have, so a kernel that uses them gets a
+// second loop with separate multiplies and adds, chosen by cpu_has_fma.
+func (fc *C67Compiler) emitFMADispatch(kernel *vectorKernel, width int) {
+	if !kernel.usesFMA() {
+		fc.emitVectorizedBody(kernel, width, false)
+		return
+	}
+	fc.out.LeaSymbolToReg("rdx", "cpu_has_fma")
+	fc.out.Emit([]byte{0x80, 0x3a, 0x00}) // cmp byte [rdx], 0
+	unfusedJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpEqual, 0)
+	fc.emitVectorizedBody(kernel, width, true)
+	doneJump := fc.eb.text.Len()
+	fc.out.JumpUnconditional(0)
+	fc.patchJumpImmediate(unfusedJump+2, int32(fc.eb.text.Len()-(unfusedJump+ConditionalJumpSize)))
+	fc.emitVectorizedBody(kernel, width, false)
+	fc.patchJumpImmediate(doneJump+1, int32(fc.eb.text.Len()-(doneJump+UnconditionalJumpSize)))
+}
+
+// emitVectorizedBody emits the loop processing width elements per iteration
+// while counter + width <= limit. Without fused, multiply-adds are computed
+// with a multiply and an add, which is all SSE2 has.
+func (fc *C67Compiler) emitVectorizedBody(kernel *vectorKernel, width int, fused bool) {
+	prefix := map[int]string{2: "xmm", 4: "ymm", 8: "zmm"}[width]
+	vec := func(n int) string { return fmt.Sprintf("%s%d", prefix, n) }
+	half := int32(8 * width) // Offset of the second load
+	scalarBase := int32(8 * len(kernel.lists))
+
+	loopStart := fc.eb.text.Len()
+	fc.out.LeaMemToReg("rdx", "rax", width)
+	fc.out.CmpRegToReg("rdx", "rcx")
+	exitJump := fc.eb.text.Len()
+	fc.out.JumpConditional(JumpGreater, 0)
+
+	depth := 0
+	for _, op := range kernel.ops {
+		switch op.kind {
+		case vectorLoad:
+			reg := x86VectorListRegs[op.index]
+			fc.out.VMovupdLoadFromMem(vec(depth), reg, 0)
+			fc.out.VMovupdLoadFromMem(vec(5), reg, half)
+			fc.out.VUnpckHiPDVectorToVector(vec(depth), vec(depth), vec(5))
+			depth++
+		case vectorScalar:
+			fc.out.VMovupdLoadFromMem(vec(depth), "rsp", scalarBase+64*int32(op.index))
+			depth++
+		case vectorAdd:
+			depth--
+			fc.out.VAddPDVectorToVector(vec(depth-1), vec(depth-1), vec(depth))
+		case vectorSub:
+			depth--
+			fc.out.VSubPDVectorToVector(vec(depth-1), vec(depth-1), vec(depth))
+		case vectorMul:
+			depth--
+			fc.out.VMulPDVectorToVector(vec(depth-1), vec(depth-1), vec(depth))
+		case vectorDiv:
+			depth--
+			fc.out.VDivPDVectorToVector(vec(depth-1), vec(depth-1), vec(depth))
+		case vectorSqrt:
+			fc.out.VSqrtPDVectorToVector(vec(depth-1), vec(depth-1))
+		case vectorFma:
+			depth -= 2
+			if fused {
+				fc.out.VFmaddPDVectorToVector(vec(depth-1), vec(depth), vec(depth+1), vec(depth-1))
+				break
+			}
+			fc.out.VMulPDVectorToVector(vec(depth), vec(depth), vec(depth+1))
+			fc.out.VAddPDVectorToVector(vec(depth-1), vec(depth-1), vec(depth))
+		case vectorFms:
+			depth -= 2
+			if fused {
+				fc.out.VFmsubPDVectorToVector(vec(depth-1), vec(depth), vec(depth+1), vec(depth-1))
+				break
+			}
+			fc.out.VMulPDVectorToVector(vec(depth), vec(depth), vec(depth+1))
+			fc.out.VSubPDVectorToVector(vec(depth), vec(depth), vec(depth-1))
+			// Move the result to the accumulator; SSE2 has only two operands
+			fc.out.VXorPDVectorToVector(vec(depth-1), vec(depth-1), vec(depth-1))
+			fc.out.VOrPDVectorToVector(vec(depth-1), vec(depth-1), vec(depth))
+		}
+	}
+
+	// Interleave the unchanged keys with the results and store both halves
+	dest := x86VectorListRegs[kernel.dest]
+	for i, unpck := range []func(dst, src1, src2 string){fc.out.VUnpckLoPDVectorToVector, fc.out.VUnpckHiPDVectorToVector} {
+		fc.out.VMovupdLoadFromMem(vec(6+i), dest, 0)
+		fc.out.VMovupdLoadFromMem(vec(5), dest, half)
+		fc.out.VUnpckLoPDVectorToVector(vec(6+i), vec(6+i), vec(5))
+		unpck(vec(6+i), vec(6+i), vec(0))
+	}
+	fc.out.VMovupdStoreToMem(vec(6), dest, 0)
+	fc.out.VMovupdStoreToMem(vec(7), dest, half)
+
+	// Advance the counter and every element pointer
+	fc.out.AddImmToReg("rax", int64(width))
+	for _, reg := range x86VectorListRegs[:len(kernel.lists)] {
+		fc.out.AddImmToReg(reg, int64(16*width))
+	}
+	fc.out.JumpUnconditional(int32(loopStart - (fc.eb.text.Len() + UnconditionalJumpSize)))
+
+	fc.patchJumpImmediate(exitJump+2, int32(fc.eb.text.Len()-(exitJump+ConditionalJumpSize)))
+	if width > 2 {
+		// Avoid AVX-SSE transition penalties in the scalar code that follows
+		fc.out.VZeroUpper()
+	}
+}
+
+// emitCleanupLoop hands the counter back to the scalar loop, which then runs
+// the remaining iterations (fewer than one vector) with the original body
+func (fc *C67Compiler) emitCleanupLoop(counterReg string, counterOffset int) {
+	if counterReg != "" {
+		fc.out.MovRegToReg(counterReg, "rax")
+	} else {
+		fc.out.MovRegToMem("rax", "rbp", -counterOffset)
+	}
 }
 
 // vectorizeLoops is the entry point for the vectorization optimization pass
-// It walks the AST and transforms vectorizable loops
+// It walks the AST and marks vectorizable loops, including loops inside
+// function bodies and blocks
 func vectorizeLoops(stmt Statement) Statement {
 	switch s := stmt.(type) {
 	case *LoopStmt:
 		// Check if this loop can be vectorized
-		// Default to x86_64 target for now
+		// The width is refined per target at code generation time
 		target := NewTarget(ArchX86_64, OSLinux)
 		analyzer := NewSIMDAnalyzer(target)
 		info := analyzer.AnalyzeLoop(s)
@@ -182,7 +567,246 @@ func vectorizeLoops(stmt Statement) Statement {
 		}
 		return s
 
+	case *WhileStmt:
+		for i, bodyStmt := range s.Body {
+			s.Body[i] = vectorizeLoops(bodyStmt)
+		}
+		return s
+
+	case *AssignStmt:
+		vectorizeBlockLoops(s.Value)
+		return s
+
+	case *ExpressionStmt:
+		vectorizeBlockLoops(s.Expr)
+		return s
+
 	default:
 		return stmt
 	}
 }
+
+// vectorizeBlockLoops runs vectorizeLoops over the blocks in an expression,
+// such as the bodies of functions
+func vectorizeBlockLoops(expr Expression) {
+	switch e := expr.(type) {
+	case *BlockExpr:
+		for i, stmt := range e.Statements {
+			e.Statements[i] = vectorizeLoops(stmt)
+		}
+	case *LambdaExpr:
+		vectorizeBlockLoops(e.Body)
+	case *MatchExpr:
+		for _, clause := range e.Clauses {
+			vectorizeBlockLoops(clause.Result)
+		}
+		vectorizeBlockLoops(e.DefaultExpr)
+	}
+}
+
+// Register assignment for the ARM64 NEON loop:
+//
+//	x9 = counter, x10 = vector limit, x0 = scratch
+//	x11-x15 = pointers to the current element of each list
+//	v16-v20 = expression stack, v24-v31 = broadcast scalars
+//
+// Lists are [count][elem0][elem1]... on ARM64, so element i is at ptr + 8 + 8*i
+// and two elements load with a single LD1.
+var arm64VectorListRegs = []string{"x11", "x12", "x13", "x14", "x15"}
+
+// planNEONKernel returns the vector kernel for a range loop, or nil if the
+// loop has to run as scalar code
+func (acg *ARM64CodeGen) planNEONKernel(stmt *LoopStmt) *vectorKernel {
+	if !stmt.Vectorized {
+		return nil
+	}
+	sv := NewSIMDVectorizer(NewSIMDAnalyzer(acg.eb.target), acg.eb.target)
+	kernel, reason := sv.PlanKernel(stmt, acg.getExprType)
+	if kernel != nil {
+		for _, op := range kernel.ops {
+			if op.kind == vectorFms {
+				// The scalar ARM64 FMAExpr computes c - a*b for IsSub, keep
+				// every iteration on the same code path
+				kernel, reason = nil, "fused multiply-subtract"
+				break
+			}
+		}
+	}
+	if kernel == nil && VerboseMode {
+		fmt.Fprintf(os.Stderr, "SIMD: Not vectorizing loop over '%s': %s\n", stmt.Iterator, reason)
+	}
+	return kernel
+}
+
+// emitNEONLoop emits the vector part of a range loop, two elements per
+// iteration. It runs after the iterator is initialized from the start value
+// and leaves the iterator at the first element it did not process, so the
+// scalar loop that follows handles the remaining element.
+func (acg *ARM64CodeGen) emitNEONLoop(kernel *vectorKernel, startOffset, limitOffset, iterOffset int) error {
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "SIMD: Vectorizing %s[i] update over lists %v with %d scalars (NEON)\n",
+			kernel.lists[kernel.dest], kernel.lists, len(kernel.scalars))
+	}
+	out := acg.out
+
+	// Scratch frame: one pointer per list, then one slot per scalar
+	scalarBase := 8 * len(kernel.lists)
+	frameSize := uint32(scalarBase+8*len(kernel.scalars)+15) &^ 15
+	if err := out.SubImm64("sp", "sp", frameSize); err != nil {
+		return err
+	}
+	for i, name := range kernel.lists {
+		if err := acg.compileExpression(&IdentExpr{Name: name}); err != nil {
+			return err
+		}
+		if err := out.FcvtzsDoubleToInt64("x0", "d0"); err != nil {
+			return err
+		}
+		if err := out.StrImm64("x0", "sp", int32(8*i)); err != nil {
+			return err
+		}
+	}
+	for i, scalar := range kernel.scalars {
+		if err := acg.compileExpression(scalar); err != nil {
+			return err
+		}
+		if err := out.StrImm64Double("d0", "sp", int32(scalarBase+8*i)); err != nil {
+			return err
+		}
+	}
+
+	// x9 = counter, x10 = limit
+	if err := out.LdrImm64("x9", "x29", int32(16+startOffset-8)); err != nil {
+		return err
+	}
+	if err := out.LdrImm64("x10", "x29", int32(16+limitOffset-8)); err != nil {
+		return err
+	}
+
+	// Negative indexes are left to the scalar loop
+	if err := out.CmpImm64("x9", 0); err != nil {
+		return err
+	}
+	negativeBranch := acg.eb.text.Len()
+	if err := out.BranchCond("lt", 0); err != nil {
+		return err
+	}
+
+	// Clamp the limit to the shortest list and point each register at element[counter]
+	for i, reg := range arm64VectorListRegs[:len(kernel.lists)] {
+		if err := out.LdrImm64(reg, "sp", int32(8*i)); err != nil {
+			return err
+		}
+		if err := out.LdrImm64Double("d0", reg, 0); err != nil {
+			return err
+		}
+		if err := out.FcvtzsDoubleToInt64("x0", "d0"); err != nil {
+			return err
+		}
+		if err := out.CmpReg64("x0", "x10"); err != nil {
+			return err
+		}
+		out.encodeInstr(0x9a8ab00a) // csel x10, x0, x10, lt
+		rn := arm64GPRegs[reg]
+		out.encodeInstr(0x8b090c00 | (rn << 5) | rn) // add reg, reg, x9, lsl #3
+		if err := out.AddImm64(reg, reg, 8); err != nil {
+			return err
+		}
+	}
+	for i := range kernel.scalars {
+		if err := out.LdrImm64Double("d0", "sp", int32(scalarBase+8*i)); err != nil {
+			return err
+		}
+		if err := out.DupVec2D(fmt.Sprintf("v%d", 24+i), "v0"); err != nil {
+			return err
+		}
+	}
+
+	if err := acg.emitNEONBody(kernel); err != nil {
+		return err
+	}
+
+	// Hand the counter back to the scalar loop through the iterator
+	if err := out.ScvtfInt64ToDouble("d0", "x9"); err != nil {
+		return err
+	}
+	if err := out.StrImm64Double("d0", "x29", int32(16+iterOffset-8)); err != nil {
+		return err
+	}
+
+	acg.patchJumpOffset(negativeBranch, int32(acg.eb.text.Len()-negativeBranch))
+	return out.AddImm64("sp", "sp", frameSize)
+}
+
+// emitNEONBody emits the loop processing two elements per iteration while
+// counter + 2 <= limit
+func (acg *ARM64CodeGen) emitNEONBody(kernel *vectorKernel) error {
+	out := acg.out
+	vec := func(n int) string { return fmt.Sprintf("v%d", 16+n) }
+
+	loopStart := acg.eb.text.Len()
+	if err := out.AddImm64("x0", "x9", 2); err != nil {
+		return err
+	}
+	if err := out.CmpReg64("x0", "x10"); err != nil {
+		return err
+	}
+	exitBranch := acg.eb.text.Len()
+	if err := out.BranchCond("gt", 0); err != nil {
+		return err
+	}
+
+	depth := 0
+	var err error
+	for _, op := range kernel.ops {
+		switch op.kind {
+		case vectorLoad:
+			err = out.Ld1Vec2D(vec(depth), arm64VectorListRegs[op.index])
+			depth++
+		case vectorScalar:
+			err = out.MovVec(vec(depth), fmt.Sprintf("v%d", 24+op.index))
+			depth++
+		case vectorAdd:
+			depth--
+			err = out.FaddVec2D(vec(depth-1), vec(depth-1), vec(depth))
+		case vectorSub:
+			depth--
+			err = out.FsubVec2D(vec(depth-1), vec(depth-1), vec(depth))
+		case vectorMul:
+			depth--
+			err = out.FmulVec2D(vec(depth-1), vec(depth-1), vec(depth))
+		case vectorDiv:
+			depth--
+			err = out.FdivVec2D(vec(depth-1), vec(depth-1), vec(depth))
+		case vectorSqrt:
+			err = out.FsqrtVec2D(vec(depth-1), vec(depth-1))
+		case vectorFma:
+			depth -= 2
+			err = out.FmlaVec2D(vec(depth-1), vec(depth), vec(depth+1))
+		default:
+			err = fmt.Errorf("unsupported NEON kernel operation %d", op.kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := out.St1Vec2D(vec(0), arm64VectorListRegs[kernel.dest]); err != nil {
+		return err
+	}
+
+	// Advance the counter and every element pointer
+	if err := out.AddImm64("x9", "x9", 2); err != nil {
+		return err
+	}
+	for _, reg := range arm64VectorListRegs[:len(kernel.lists)] {
+		if err := out.AddImm64(reg, reg, 16); err != nil {
+			return err
+		}
+	}
+	if err := out.Branch(int32(loopStart - acg.eb.text.Len())); err != nil {
+		return err
+	}
+
+	acg.patchJumpOffset(exitBranch, int32(acg.eb.text.Len()-exitBranch))
+	return nil
+}
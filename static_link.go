@@ -0,0 +1,769 @@
+// Completion: 75% - Static linking of C archives (.a) into executables
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// static_link.go - links the members of C archives into the executable
+//
+// `import "./libfoo.a" as foo` links the archive instead of loading a
+// shared library at run time. Like ld, linkStaticArchives pulls only the
+// members that define the functions the program calls, and then the
+// members those need. Their allocated sections are laid out as one block
+// that is appended to .text (the dynamic ELF maps everything RWX, so code
+// and data can share it), and the relocations are applied once the final
+// addresses are known. Symbols that no member defines are taken to be
+// functions of the C library and reached through the PLT.
+
+// archiveMember is one file stored in an ar archive
+type archiveMember struct {
+	name string
+	data []byte
+}
+
+// readArchive reads the members of an ar archive, in the GNU or BSD variant
+func readArchive(path string) ([]archiveMember, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(content, []byte("!<arch>\n")) {
+		return nil, fmt.Errorf("%s is not an ar archive", path)
+	}
+
+	var members []archiveMember
+	var longNames []byte
+	for pos := 8; pos+60 <= len(content); {
+		header := content[pos : pos+60]
+		size, err := strconv.Atoi(strings.TrimSpace(string(header[48:58])))
+		if err != nil || size < 0 || string(header[58:60]) != "`\n" {
+			return nil, fmt.Errorf("%s: bad member header at offset %d", path, pos)
+		}
+		start := pos + 60
+		if start+size > len(content) {
+			return nil, fmt.Errorf("%s: member at offset %d is truncated", path, pos)
+		}
+		data := content[start : start+size]
+		pos = start + size + size%2 // members are 2-byte aligned
+
+		name := strings.TrimRight(string(header[:16]), " ")
+		switch {
+		case name == "/" || name == "/SYM64/":
+			continue // GNU symbol index; the members' symbol tables are read instead
+		case name == "//":
+			longNames = data
+			continue
+		case strings.HasPrefix(name, "#1/"):
+			// BSD: the name is stored in front of the data
+			length, err := strconv.Atoi(name[3:])
+			if err != nil || length > len(data) {
+				return nil, fmt.Errorf("%s: bad member name %q", path, name)
+			}
+			name = strings.TrimRight(string(data[:length]), "\x00")
+			data = data[length:]
+		case strings.HasPrefix(name, "/"):
+			// GNU: an offset into the long name table
+			offset, err := strconv.Atoi(name[1:])
+			if err != nil || offset >= len(longNames) {
+				return nil, fmt.Errorf("%s: bad member name %q", path, name)
+			}
+			name = string(longNames[offset:])
+			if end := strings.Index(name, "/\n"); end >= 0 {
+				name = name[:end]
+			}
+		default:
+			name = strings.TrimSuffix(name, "/")
+		}
+		if strings.HasPrefix(name, "__.SYMDEF") {
+			continue // BSD symbol index
+		}
+		members = append(members, archiveMember{name: name, data: data})
+	}
+	return members, nil
+}
+
+// relocObject is an ELF relocatable object (ET_REL), such as an archive member
+type relocObject struct {
+	name     string
+	machine  elf.Machine
+	sections []*relocSection // by section index
+	symbols  []relocSymbol   // by symbol table index; 0 is the null symbol
+}
+
+// relocSection is a section of a relocatable object
+type relocSection struct {
+	name   string
+	flags  elf.SectionFlag
+	nobits bool // .bss: takes no space in the file
+	size   uint64
+	align  uint64
+	data   []byte
+	relocs []relocEntry
+	offset int // position in the linked block, -1 when not linked
+}
+
+// relocSymbol is a symbol table entry of a relocatable object
+type relocSymbol struct {
+	name    string
+	bind    elf.SymBind
+	typ     elf.SymType
+	section elf.SectionIndex
+	value   uint64
+	size    uint64
+}
+
+// relocEntry is one RELA relocation: the place, its type, the symbol and the addend
+type relocEntry struct {
+	offset uint64
+	typ    uint32
+	symbol uint32
+	addend int64
+}
+
+// readRelocObject reads the sections, symbols and relocations of an ELF
+// relocatable object
+func readRelocObject(name string, data []byte) (*relocObject, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if f.Type != elf.ET_REL {
+		return nil, fmt.Errorf("%s is not a relocatable object", name)
+	}
+	if f.Class != elf.ELFCLASS64 || f.Data != elf.ELFDATA2LSB {
+		return nil, fmt.Errorf("%s is not a 64-bit little-endian object", name)
+	}
+
+	obj := &relocObject{name: name, machine: f.Machine}
+	for _, s := range f.Sections {
+		sec := &relocSection{
+			name:   s.Name,
+			flags:  s.Flags,
+			nobits: s.Type == elf.SHT_NOBITS,
+			size:   s.Size,
+			align:  s.Addralign,
+			offset: -1,
+		}
+		if s.Flags&elf.SHF_ALLOC != 0 && !sec.nobits {
+			if sec.data, err = s.Data(); err != nil {
+				return nil, fmt.Errorf("%s: section %s: %v", name, s.Name, err)
+			}
+		}
+		obj.sections = append(obj.sections, sec)
+	}
+
+	symbols, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	obj.symbols = make([]relocSymbol, 1, len(symbols)+1)
+	for _, s := range symbols {
+		obj.symbols = append(obj.symbols, relocSymbol{
+			name:    s.Name,
+			bind:    elf.ST_BIND(s.Info),
+			typ:     elf.ST_TYPE(s.Info),
+			section: s.Section,
+			value:   s.Value,
+			size:    s.Size,
+		})
+	}
+
+	for _, s := range f.Sections {
+		if s.Type == elf.SHT_REL {
+			return nil, fmt.Errorf("%s: REL relocations are not supported", name)
+		}
+		if s.Type != elf.SHT_RELA || int(s.Info) >= len(obj.sections) {
+			continue
+		}
+		target := obj.sections[s.Info]
+		if target.flags&elf.SHF_ALLOC == 0 {
+			continue // debug info
+		}
+		raw, err := s.Data()
+		if err != nil {
+			return nil, fmt.Errorf("%s: section %s: %v", name, s.Name, err)
+		}
+		for i := 0; i+24 <= len(raw); i += 24 {
+			info := binary.LittleEndian.Uint64(raw[i+8:])
+			target.relocs = append(target.relocs, relocEntry{
+				offset: binary.LittleEndian.Uint64(raw[i:]),
+				typ:    uint32(info),
+				symbol: uint32(info >> 32),
+				addend: int64(binary.LittleEndian.Uint64(raw[i+16:])),
+			})
+		}
+	}
+	return obj, nil
+}
+
+// symbolRef names a symbol of one object
+type symbolRef struct {
+	obj   *relocObject
+	index uint32
+}
+
+// staticLinker holds the archive members a program needs, laid out as one block
+type staticLinker struct {
+	arch      Arch
+	objects   []*relocObject      // the members linked, in the order they were pulled
+	block     []byte              // their code and data, not yet relocated
+	align     int                 // the alignment the block needs
+	symbols   map[string]int      // global symbol -> offset in block
+	commons   map[string]int      // common symbol -> offset of its storage in block
+	gotSlots  map[symbolRef]int   // symbol -> offset of its GOT slot in block
+	externals []string            // undefined symbols, left to the C library
+	weak      map[string]bool     // undefined weak symbols no member defines, which are 0
+	defined   map[string]struct{} // every global a linked member defines
+}
+
+// newStaticLinker pulls the members of the archives at paths that
+// define the wanted symbols, and transitively the members those need, and
+// lays them out. Wanted symbols that no member defines are ignored.
+func newStaticLinker(arch Arch, paths []string, wanted []string) (*staticLinker, error) {
+	var machine elf.Machine
+	switch arch {
+	case ArchX86_64:
+		machine = elf.EM_X86_64
+	case ArchARM64:
+		machine = elf.EM_AARCH64
+	default:
+		return nil, fmt.Errorf("static linking is not supported on %v", arch)
+	}
+
+	// The first member defining a symbol provides it, as with ld
+	providers := make(map[string]*relocObject)
+	for _, path := range paths {
+		members, err := readArchive(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			obj, err := readRelocObject(filepath.Base(path)+"("+member.name+")", member.data)
+			if err != nil {
+				return nil, err
+			}
+			if obj.machine != machine {
+				return nil, fmt.Errorf("%s is built for %v, not %v", obj.name, obj.machine, machine)
+			}
+			for _, sym := range obj.symbols[1:] {
+				if sym.section == elf.SHN_UNDEF || sym.name == "" || sym.bind == elf.STB_LOCAL {
+					continue
+				}
+				if _, ok := providers[sym.name]; !ok {
+					providers[sym.name] = obj
+				}
+			}
+		}
+	}
+
+	l := &staticLinker{
+		arch:     arch,
+		symbols:  make(map[string]int),
+		commons:  make(map[string]int),
+		gotSlots: make(map[symbolRef]int),
+		weak:     make(map[string]bool),
+		defined:  make(map[string]struct{}),
+	}
+	pulled := make(map[*relocObject]bool)
+	queue := append([]string(nil), wanted...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		obj := providers[name]
+		if obj == nil || pulled[obj] {
+			continue
+		}
+		pulled[obj] = true
+		l.objects = append(l.objects, obj)
+		for _, sym := range obj.symbols[1:] {
+			if sym.section == elf.SHN_UNDEF && sym.name != "" {
+				queue = append(queue, sym.name)
+			}
+		}
+	}
+	for _, obj := range l.objects {
+		for _, sym := range obj.symbols[1:] {
+			if sym.section != elf.SHN_UNDEF && sym.name != "" && sym.bind != elf.STB_LOCAL {
+				l.defined[sym.name] = struct{}{}
+			}
+		}
+	}
+
+	// Undefined symbols that no linked member defines come from the C library
+	external := make(map[string]bool)
+	for _, obj := range l.objects {
+		for _, sym := range obj.symbols[1:] {
+			if sym.section != elf.SHN_UNDEF || sym.name == "" {
+				continue
+			}
+			if _, ok := l.defined[sym.name]; ok || sym.name == globalOffsetTable {
+				continue
+			}
+			if sym.bind == elf.STB_WEAK {
+				l.weak[sym.name] = true
+			} else {
+				external[sym.name] = true
+			}
+		}
+	}
+	for name := range external {
+		delete(l.weak, name)
+		l.externals = append(l.externals, name)
+	}
+	sort.Strings(l.externals)
+
+	if err := l.layout(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// globalOffsetTable is the symbol compilers reference for the GOT base,
+// which the linker defines rather than any object
+const globalOffsetTable = "_GLOBAL_OFFSET_TABLE_"
+
+// layout places the allocated sections of the linked members in the
+// block: code, then read-only data, then data, then zeroed data and the
+// GOT slots
+func (l *staticLinker) layout() error {
+	const (
+		kindCode = iota
+		kindReadOnly
+		kindData
+		kindZero
+	)
+	kind := func(sec *relocSection) int {
+		switch {
+		case sec.nobits:
+			return kindZero
+		case sec.flags&elf.SHF_EXECINSTR != 0:
+			return kindCode
+		case sec.flags&elf.SHF_WRITE != 0:
+			return kindData
+		}
+		return kindReadOnly
+	}
+
+	l.align = 16
+	place := func(size, align uint64) int {
+		if align > uint64(l.align) && align <= pageSize {
+			l.align = int(align)
+		}
+		for align > 1 && uint64(len(l.block))%align != 0 {
+			l.block = append(l.block, 0)
+		}
+		offset := len(l.block)
+		l.block = append(l.block, make([]byte, size)...)
+		return offset
+	}
+
+	for pass := kindCode; pass <= kindZero; pass++ {
+		for _, obj := range l.objects {
+			for _, sec := range obj.sections {
+				if sec.flags&elf.SHF_ALLOC == 0 || sec.size == 0 || kind(sec) != pass {
+					continue
+				}
+				switch {
+				case sec.name == ".eh_frame" || strings.HasPrefix(sec.name, ".note"):
+					continue // unwind tables and notes are not needed to run
+				case sec.flags&elf.SHF_TLS != 0:
+					return fmt.Errorf("%s: thread-local storage is not supported", obj.name)
+				case sec.name == ".init_array" || sec.name == ".fini_array" ||
+					sec.name == ".ctors" || sec.name == ".dtors" ||
+					strings.HasPrefix(sec.name, ".init_array.") || strings.HasPrefix(sec.name, ".fini_array."):
+					return fmt.Errorf("%s: constructors and destructors are not supported", obj.name)
+				}
+				sec.offset = place(sec.size, sec.align)
+				copy(l.block[sec.offset:], sec.data)
+			}
+		}
+		if pass != kindZero {
+			continue
+		}
+		// Common symbols (tentative definitions in C) get zeroed storage too
+		for _, obj := range l.objects {
+			for _, sym := range obj.symbols[1:] {
+				if sym.section != elf.SHN_COMMON {
+					continue
+				}
+				if _, ok := l.commons[sym.name]; !ok {
+					l.commons[sym.name] = place(sym.size, sym.value)
+				}
+			}
+		}
+	}
+
+	// Global symbols: strong definitions win over weak ones, and both
+	// over common storage
+	for _, bind := range []elf.SymBind{elf.STB_GLOBAL, elf.STB_WEAK} {
+		for _, obj := range l.objects {
+			for _, sym := range obj.symbols[1:] {
+				if sym.bind != bind || sym.name == "" || int(sym.section) >= len(obj.sections) {
+					continue
+				}
+				sec := obj.sections[sym.section]
+				if _, ok := l.symbols[sym.name]; !ok && sec.offset >= 0 && sym.section != elf.SHN_UNDEF {
+					l.symbols[sym.name] = sec.offset + int(sym.value)
+				}
+			}
+		}
+	}
+	for name, offset := range l.commons {
+		if _, ok := l.symbols[name]; !ok {
+			l.symbols[name] = offset
+		}
+	}
+
+	// One GOT slot for every symbol that is loaded through the GOT; the
+	// linker-defined _GLOBAL_OFFSET_TABLE_ marks where they start
+	l.symbols[globalOffsetTable] = place(0, 8)
+	for _, obj := range l.objects {
+		for _, sec := range obj.sections {
+			if sec.offset < 0 {
+				continue
+			}
+			for _, r := range sec.relocs {
+				ref := symbolRef{obj, r.symbol}
+				if _, ok := l.gotSlots[ref]; !ok && l.usesGOT(r.typ) {
+					l.gotSlots[ref] = place(8, 8)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// usesGOT reports whether a relocation type refers to the symbol's GOT slot
+func (l *staticLinker) usesGOT(typ uint32) bool {
+	if l.arch == ArchARM64 {
+		switch elf.R_AARCH64(typ) {
+		case elf.R_AARCH64_ADR_GOT_PAGE, elf.R_AARCH64_LD64_GOT_LO12_NC:
+			return true
+		}
+		return false
+	}
+	switch elf.R_X86_64(typ) {
+	case elf.R_X86_64_GOTPCREL, elf.R_X86_64_GOTPCRELX, elf.R_X86_64_REX_GOTPCRELX:
+		return true
+	}
+	return false
+}
+
+// address resolves a symbol of a linked member, given the block's address
+// and the address through which each external function is called
+func (l *staticLinker) address(ref symbolRef, blockAddr uint64, external func(string) (uint64, bool)) (uint64, error) {
+	sym := ref.obj.symbols[ref.index]
+	switch {
+	case sym.section == elf.SHN_ABS:
+		return sym.value, nil
+	case sym.section == elf.SHN_UNDEF || sym.section == elf.SHN_COMMON || sym.bind != elf.STB_LOCAL:
+		if offset, ok := l.symbols[sym.name]; ok {
+			return blockAddr + uint64(offset), nil
+		}
+		if l.weak[sym.name] {
+			return 0, nil
+		}
+		if addr, ok := external(sym.name); ok {
+			return addr, nil
+		}
+		return 0, fmt.Errorf("%s: undefined symbol %s", ref.obj.name, sym.name)
+	case int(sym.section) < len(ref.obj.sections) && ref.obj.sections[sym.section].offset >= 0:
+		return blockAddr + uint64(ref.obj.sections[sym.section].offset) + sym.value, nil
+	}
+	return 0, fmt.Errorf("%s: symbol %q is in a section that is not linked", ref.obj.name, sym.name)
+}
+
+// relocate returns the block with every relocation applied, for the block
+// placed at blockAddr. external gives the PLT entry of a C library function.
+func (l *staticLinker) relocate(blockAddr uint64, external func(string) (uint64, bool)) ([]byte, error) {
+	block := append([]byte(nil), l.block...)
+	for ref, slot := range l.gotSlots {
+		addr, err := l.address(ref, blockAddr, external)
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(block[slot:], addr)
+	}
+	for _, obj := range l.objects {
+		for _, sec := range obj.sections {
+			if sec.offset < 0 {
+				continue
+			}
+			for _, r := range sec.relocs {
+				ref := symbolRef{obj, r.symbol}
+				s, err := l.address(ref, blockAddr, external)
+				if err != nil {
+					return nil, err
+				}
+				if r.offset+4 > sec.size {
+					return nil, fmt.Errorf("%s: relocation outside section %s", obj.name, sec.name)
+				}
+				place := sec.offset + int(r.offset)
+				b := block[place : sec.offset+int(sec.size)]
+				got := blockAddr + uint64(l.gotSlots[ref])
+				p := blockAddr + uint64(place)
+				if l.arch == ArchARM64 {
+					err = applyARM64Relocation(b, elf.R_AARCH64(r.typ), s, r.addend, p, got)
+				} else {
+					err = applyX86Relocation(b, elf.R_X86_64(r.typ), s, r.addend, p, got)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s against %s: %v", obj.name, sec.name, obj.symbols[r.symbol].name, err)
+				}
+			}
+		}
+	}
+	return block, nil
+}
+
+// applyX86Relocation patches one x86-64 relocation at the start of b.
+// s is the symbol's address, p the address of the place and got the
+// address of the symbol's GOT slot.
+func applyX86Relocation(b []byte, typ elf.R_X86_64, s uint64, a int64, p, got uint64) error {
+	value := int64(s) + a
+	switch typ {
+	case elf.R_X86_64_NONE:
+	case elf.R_X86_64_64:
+		return putUint64(b, uint64(value))
+	case elf.R_X86_64_PC64:
+		return putUint64(b, uint64(value-int64(p)))
+	case elf.R_X86_64_PC32, elf.R_X86_64_PLT32:
+		return putInt32(b, value-int64(p))
+	case elf.R_X86_64_GOTPCREL, elf.R_X86_64_GOTPCRELX, elf.R_X86_64_REX_GOTPCRELX:
+		return putInt32(b, int64(got)+a-int64(p))
+	case elf.R_X86_64_32:
+		if value < 0 || value > 0xFFFFFFFF {
+			return fmt.Errorf("%v value 0x%x out of range", typ, value)
+		}
+		binary.LittleEndian.PutUint32(b, uint32(value))
+	case elf.R_X86_64_32S:
+		return putInt32(b, value)
+	default:
+		return fmt.Errorf("unsupported relocation %v", typ)
+	}
+	return nil
+}
+
+// putInt32 stores a value that must fit in a signed 32-bit field
+func putInt32(b []byte, value int64) error {
+	if value < -0x80000000 || value > 0x7FFFFFFF {
+		return fmt.Errorf("value 0x%x does not fit in 32 bits", value)
+	}
+	binary.LittleEndian.PutUint32(b, uint32(int32(value)))
+	return nil
+}
+
+// putUint64 stores a 64-bit value, which must fit in b
+func putUint64(b []byte, value uint64) error {
+	if len(b) < 8 {
+		return fmt.Errorf("64-bit relocation at the end of its section")
+	}
+	binary.LittleEndian.PutUint64(b, value)
+	return nil
+}
+
+// applyARM64Relocation patches one AArch64 relocation at the start of b,
+// with the same arguments as applyX86Relocation
+func applyARM64Relocation(b []byte, typ elf.R_AARCH64, s uint64, a int64, p, got uint64) error {
+	value := int64(s) + a
+	page := func(addr int64) int64 { return addr &^ 0xFFF }
+	ins := binary.LittleEndian.Uint32(b)
+	branch := func(bits uint, shift uint) error {
+		offset := value - int64(p)
+		limit := int64(1) << (bits + 1) // bits of words, signed
+		if offset&3 != 0 || offset < -limit || offset >= limit {
+			return fmt.Errorf("%v branch offset %d out of range", typ, offset)
+		}
+		mask := uint32(1)<<bits - 1
+		ins = ins&^(mask<<shift) | (uint32(offset>>2)&mask)<<shift
+		binary.LittleEndian.PutUint32(b, ins)
+		return nil
+	}
+	adrp := func(target int64) error {
+		offset := page(target) - page(int64(p))
+		if offset < -(1<<32) || offset >= 1<<32 {
+			return fmt.Errorf("%v page offset %d out of range", typ, offset)
+		}
+		imm := uint32(offset >> 12)
+		ins = ins&^(3<<29|0x7FFFF<<5) | (imm&3)<<29 | (imm>>2&0x7FFFF)<<5
+		binary.LittleEndian.PutUint32(b, ins)
+		return nil
+	}
+	low12 := func(target int64, shift uint) error {
+		if target&(1<<shift-1) != 0 {
+			return fmt.Errorf("%v target 0x%x is not %d-byte aligned", typ, target, 1<<shift)
+		}
+		ins = ins&^(0xFFF<<10) | uint32(target&0xFFF)>>shift<<10
+		binary.LittleEndian.PutUint32(b, ins)
+		return nil
+	}
+
+	switch typ {
+	case elf.R_AARCH64_NONE:
+	case elf.R_AARCH64_ABS64:
+		return putUint64(b, uint64(value))
+	case elf.R_AARCH64_ABS32:
+		if value < -0x80000000 || value > 0xFFFFFFFF {
+			return fmt.Errorf("%v value 0x%x out of range", typ, value)
+		}
+		binary.LittleEndian.PutUint32(b, uint32(value))
+	case elf.R_AARCH64_PREL64:
+		return putUint64(b, uint64(value-int64(p)))
+	case elf.R_AARCH64_PREL32:
+		return putInt32(b, value-int64(p))
+	case elf.R_AARCH64_CALL26, elf.R_AARCH64_JUMP26:
+		return branch(26, 0)
+	case elf.R_AARCH64_CONDBR19:
+		return branch(19, 5)
+	case elf.R_AARCH64_TSTBR14:
+		return branch(14, 5)
+	case elf.R_AARCH64_ADR_PREL_PG_HI21:
+		return adrp(value)
+	case elf.R_AARCH64_ADR_GOT_PAGE:
+		return adrp(int64(got) + a)
+	case elf.R_AARCH64_ADD_ABS_LO12_NC, elf.R_AARCH64_LDST8_ABS_LO12_NC:
+		return low12(value, 0)
+	case elf.R_AARCH64_LDST16_ABS_LO12_NC:
+		return low12(value, 1)
+	case elf.R_AARCH64_LDST32_ABS_LO12_NC:
+		return low12(value, 2)
+	case elf.R_AARCH64_LDST64_ABS_LO12_NC:
+		return low12(value, 3)
+	case elf.R_AARCH64_LDST128_ABS_LO12_NC:
+		return low12(value, 4)
+	case elf.R_AARCH64_LD64_GOT_LO12_NC:
+		return low12(int64(got)+a, 3)
+	default:
+		return fmt.Errorf("unsupported relocation %v", typ)
+	}
+	return nil
+}
+
+// ArchiveFunctionSignatures reads function signatures from the DWARF debug
+// info of the members of an archive built with -g
+func ArchiveFunctionSignatures(path string) (map[string]*CFunctionSignature, error) {
+	members, err := readArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	signatures := make(map[string]*CFunctionSignature)
+	for _, member := range members {
+		f, err := elf.NewFile(bytes.NewReader(member.data))
+		if err != nil {
+			continue
+		}
+		found, err := dwarfFunctionSignatures(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s(%s): %v", filepath.Base(path), member.name, err)
+		}
+		for name, sig := range found {
+			signatures[name] = sig
+		}
+	}
+	return signatures, nil
+}
+
+// linkStaticArchives links the archives the program imports, pulling the
+// members that define the C functions it calls
+func (fc *C67Compiler) linkStaticArchives(called []string) error {
+	if len(fc.staticArchives) == 0 {
+		return nil
+	}
+	var paths []string
+	for _, path := range fc.staticArchives {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	sort.Strings(called)
+
+	linker, err := newStaticLinker(fc.eb.target.Arch(), paths, called)
+	if err != nil {
+		return err
+	}
+	// A function called through an archive's namespace must be in the archive
+	for _, funcName := range called {
+		if _, ok := fc.staticArchives[fc.cFunctionLibs[funcName]]; !ok {
+			continue
+		}
+		if _, ok := linker.symbols[funcName]; !ok {
+			return fmt.Errorf("no member of %s defines %s", fc.staticArchives[fc.cFunctionLibs[funcName]], funcName)
+		}
+	}
+	fc.staticLink = linker
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "Statically linked %d archive members (%d bytes), external symbols: %v\n",
+			len(linker.objects), len(linker.block), linker.externals)
+	}
+	return nil
+}
+
+// staticallyLinked reports whether a linked archive member defines funcName
+func (fc *C67Compiler) staticallyLinked(funcName string) bool {
+	if fc.staticLink == nil {
+		return false
+	}
+	_, ok := fc.staticLink.defined[funcName]
+	return ok
+}
+
+// emitStaticArchives appends the linked archive members to .text
+func (fc *C67Compiler) emitStaticArchives() {
+	if fc.staticLink == nil {
+		return
+	}
+	for fc.eb.text.Len()%fc.staticLink.align != 0 {
+		fc.eb.text.WriteByte(0)
+	}
+	fc.staticLinkOffset = fc.eb.text.Len()
+	fc.eb.text.Write(fc.staticLink.block)
+}
+
+// relocateStaticArchives applies the relocations of the linked archive
+// members and points the program's C calls into them, once .text is at
+// textAddr and the PLT at pltBase
+func (fc *C67Compiler) relocateStaticArchives(ds *DynamicSections, textAddr, pltBase uint64) error {
+	if fc.staticLink == nil {
+		return nil
+	}
+	blockAddr := textAddr + uint64(fc.staticLinkOffset)
+	block, err := fc.staticLink.relocate(blockAddr, func(name string) (uint64, bool) {
+		offset := ds.GetPLTOffset(name)
+		return pltBase + uint64(offset), offset >= 0
+	})
+	if err != nil {
+		return err
+	}
+	text := fc.eb.text.Bytes()
+	copy(text[fc.staticLinkOffset:], block)
+
+	// C calls are emitted against name$stub; a lambda of the same name
+	// (a bindgen wrapper) is called without the suffix
+	for _, patch := range fc.eb.callPatches {
+		if !strings.HasSuffix(patch.targetName, "$stub") {
+			continue
+		}
+		offset, ok := fc.staticLink.symbols[strings.TrimSuffix(patch.targetName, "$stub")]
+		if !ok {
+			continue
+		}
+		target := int64(blockAddr) + int64(offset)
+		if fc.eb.target.Arch() == ArchARM64 {
+			err = applyARM64Relocation(text[patch.position:], elf.R_AARCH64_CALL26, uint64(target), 0, textAddr+uint64(patch.position), 0)
+		} else {
+			err = putInt32(text[patch.position:], target-int64(textAddr)-int64(patch.position)-4)
+		}
+		if err != nil {
+			return fmt.Errorf("call to %s: %v", patch.targetName, err)
+		}
+	}
+	return nil
+}
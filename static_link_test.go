@@ -0,0 +1,167 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestStaticLink(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.Skip("needs x86-64 Linux objects")
+	}
+	for _, tool := range []string{"gcc", "ar"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"geo.c": `#include <string.h>
+static const double weights[4] = {0.5, 1.5, 2.5, 3.5};
+int geo_calls;
+static int counter = 10;
+int geo_neg(int x) { geo_calls++; return -x; }
+double geo_weight(int i) { geo_calls++; return weights[i & 3]; }
+int geo_len(const char *s) { geo_calls++; return strlen(s); }
+int geo_count(void) { return ++counter; }
+`,
+		"ops.c": `#include <stdio.h>
+extern int geo_calls;
+int geo_neg(int);
+static int twice(int x) { return 2 * x; }
+static int add1(int x) { return x + 1; }
+static int (*const table[])(int) = {twice, add1, geo_neg};
+int geo_apply(int op, int x) { return table[op](x); }
+int geo_total(void) { return geo_calls; }
+char *geo_format(double v) { static char buf[64]; snprintf(buf, sizeof buf, "<%.1f>", v); return buf; }
+`,
+		// Never called, and needs a symbol nothing defines
+		"unused_member_with_a_long_name.c": `extern int nowhere(void);
+int geo_unused(void) { return nowhere(); }
+`,
+	}
+	var objects []string
+	for name, content := range files {
+		src := filepath.Join(dir, name)
+		if err := os.WriteFile(src, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		obj := strings.TrimSuffix(src, ".c") + ".o"
+		if out, err := exec.Command("gcc", "-O2", "-g", "-fPIC", "-c", "-o", obj, src).CombinedOutput(); err != nil {
+			t.Fatalf("gcc: %v\n%s", err, out)
+		}
+		objects = append(objects, obj)
+	}
+	lib := filepath.Join(dir, "libgeo.a")
+	if out, err := exec.Command("ar", append([]string{"rcs", lib}, objects...)...).CombinedOutput(); err != nil {
+		t.Fatalf("ar: %v\n%s", err, out)
+	}
+
+	members, err := readArchive(lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range members {
+		names = append(names, m.name)
+	}
+	if got := strings.Join(names, " "); !strings.Contains(got, "unused_member_with_a_long_name.o") {
+		t.Errorf("archive members = %s, want the long name resolved", got)
+	}
+
+	src := filepath.Join(dir, "main", "main.v67")
+	if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+		t.Fatal(err)
+	}
+	code := `import "` + lib + `" as geo
+import "c" as c
+printf("%v %v %v\n", geo.geo_neg(5), geo.geo_weight(2), geo.geo_len("hello"))
+printf("%v %v %v\n", geo.geo_count(), geo.geo_count(), geo.geo_apply(0, 21))
+printf("%v %v\n", geo.geo_apply(2, 7), geo.geo_total())
+printf("%v\n", c.strlen(geo.geo_format(12.75) as cptr))
+`
+	if err := os.WriteFile(src, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exe := filepath.Join(dir, "main", "main")
+	if err := CompileC67WithOptions(src, exe, Platform{OS: OSLinux, Arch: ArchX86_64}, 0, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	libs, err := f.ImportedLibraries()
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range libs {
+		if strings.Contains(l, "geo") {
+			t.Errorf("executable still needs %s", l)
+		}
+	}
+
+	out, err := exec.Command(exe).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run: %v\n%s", err, out)
+	}
+	want := strings.Join([]string{
+		"-5.000000 2.500000 5.000000",
+		"11.000000 12.000000 42.000000",
+		"-7.000000 4.000000",
+		"6.000000",
+	}, "\n") + "\n"
+	if string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestARM64Relocations(t *testing.T) {
+	tests := []struct {
+		typ  elf.R_AARCH64
+		ins  uint32
+		s    uint64
+		p    uint64
+		want uint32
+	}{
+		{elf.R_AARCH64_CALL26, 0x94000000, 0x10100, 0x10000, 0x94000040},              // bl +0x100
+		{elf.R_AARCH64_CALL26, 0x94000000, 0x10000, 0x10008, 0x97FFFFFE},              // bl -8
+		{elf.R_AARCH64_CONDBR19, 0x54000000, 0x10040, 0x10000, 0x54000200},            // b.eq +0x40
+		{elf.R_AARCH64_ADR_PREL_PG_HI21, 0x90000000, 0x25123, 0x10ABC, 0xB00000A0},    // adrp x0, +0x15000
+		{elf.R_AARCH64_ADR_PREL_PG_HI21, 0x90000000, 0x0F000, 0x10ABC, 0xF0FFFFE0},    // adrp x0, -0x1000
+		{elf.R_AARCH64_ADD_ABS_LO12_NC, 0x91000000, 0x25123, 0x10AC0, 0x91048C00},     // add x0, x0, #0x123
+		{elf.R_AARCH64_LDST64_ABS_LO12_NC, 0xF9400000, 0x25128, 0x10AC0, 0xF9409400},  // ldr x0, [x0, #0x128]
+		{elf.R_AARCH64_LDST128_ABS_LO12_NC, 0x3DC00000, 0x25120, 0x10AC0, 0x3DC04800}, // ldr q0, [x0, #0x120]
+	}
+	for _, tt := range tests {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, tt.ins)
+		if err := applyARM64Relocation(b, tt.typ, tt.s, 0, tt.p, 0); err != nil {
+			t.Errorf("%v: %v", tt.typ, err)
+			continue
+		}
+		if got := binary.LittleEndian.Uint32(b); got != tt.want {
+			t.Errorf("%v at %#x to %#x = %#08x, want %#08x", tt.typ, tt.p, tt.s, got, tt.want)
+		}
+	}
+
+	// Misaligned low bits are an error for scaled loads, as are
+	// branches out of range
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, 0xF9400000)
+	if err := applyARM64Relocation(b, elf.R_AARCH64_LDST64_ABS_LO12_NC, 0x25124, 0, 0x10AC0, 0); err == nil {
+		t.Error("misaligned LDST64 relocation accepted")
+	}
+	binary.LittleEndian.PutUint32(b, 0x94000000)
+	if err := applyARM64Relocation(b, elf.R_AARCH64_CALL26, 0x10000000, 0, 0, 0); err == nil {
+		t.Error("out of range CALL26 relocation accepted")
+	}
+}
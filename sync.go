@@ -0,0 +1,568 @@
+// Completion: 90% - Futex-based on Linux, spin fallback on other targets
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// sync.go - Mutexes, read/write locks, condition variables and bounded queues
+//
+// The primitives are emitted as machine code runtime functions. On Linux they
+// live in MAP_SHARED memory and sleep in the kernel with (non-private) futex(2),
+// so they also synchronize the processes created by spawn. On other targets they
+// are heap allocated and spin with PAUSE (x86_64) or YIELD (ARM64).
+// All state is kept in 8-byte slots so that the x86_64 and ARM64 runtimes share
+// one memory layout:
+//
+//	mutex   [state]                   0=free, 1=locked, 2=locked with waiters
+//	rwlock  [state][waiters]          state: 0=free, n=n readers, -1=writer
+//	condvar [sequence]
+//	queue   [mutex][not_empty][not_full][capacity][head][count][closed][slots...]
+//
+// Handles are raw pointers carried as float64 bits (see pointer_helpers.go).
+// The runtime functions take their arguments in rdi/rsi (x0/x1 on ARM64) on every
+// OS and preserve all general purpose registers except rax (x0-x17 on ARM64),
+// so they are safe to call from parallel loop bodies that keep state in r11.
+
+const (
+	futexWait    = 0 // FUTEX_WAIT (shared, works across spawn)
+	futexWake    = 1 // FUTEX_WAKE
+	futexWakeAll = 0x7fffffff
+
+	mmapSharedAnonymous = 0x21 // MAP_SHARED | MAP_ANONYMOUS
+
+	syncMutexSize   = 8
+	syncRWLockSize  = 16
+	syncCondvarSize = 8
+
+	rwlockWaitersOffset = 8
+
+	queueMutexOffset    = 0
+	queueNotEmptyOffset = 8
+	queueNotFullOffset  = 16
+	queueCapOffset      = 24
+	queueHeadOffset     = 32
+	queueCountOffset    = 40
+	queueClosedOffset   = 48
+	queueSlotsOffset    = 56
+
+	// queueClosedError is the error NaN returned by queue_pop on a closed, empty queue ("cls")
+	queueClosedError uint64 = 0x7FF8_0000_636C_7300
+)
+
+// syncResult describes how a sync builtin's return value in rax/x0 becomes a Vibe67 value
+type syncResult int
+
+const (
+	syncResultZero    syncResult = iota // Always 0.0
+	syncResultNumber                    // Integer in rax converted to float64
+	syncResultPointer                   // Raw bits in rax (handles and queue values)
+)
+
+// syncBuiltin describes a builtin function backed by a sync runtime function
+type syncBuiltin struct {
+	symbol      string     // Runtime function to call
+	argc        int        // Number of arguments
+	allocSize   int        // For constructors: bytes to allocate (passed as first argument)
+	numericArg  bool       // First argument is a number (capacity) rather than a handle
+	optionalArg bool       // The numeric argument may be omitted (defaults to 1)
+	result      syncResult // How to convert the return value
+}
+
+var syncBuiltins = map[string]syncBuiltin{
+	"mutex":               {symbol: "_vibe67_sync_new", allocSize: syncMutexSize, result: syncResultPointer},
+	"rwlock":              {symbol: "_vibe67_sync_new", allocSize: syncRWLockSize, result: syncResultPointer},
+	"condvar":             {symbol: "_vibe67_sync_new", allocSize: syncCondvarSize, result: syncResultPointer},
+	"queue":               {symbol: "_vibe67_queue_new", argc: 1, numericArg: true, result: syncResultPointer},
+	"chan":                {symbol: "_vibe67_queue_new", argc: 1, numericArg: true, optionalArg: true, result: syncResultPointer},
+	"mutex_lock":          {symbol: "_vibe67_mutex_lock", argc: 1},
+	"mutex_unlock":        {symbol: "_vibe67_mutex_unlock", argc: 1},
+	"rwlock_read":         {symbol: "_vibe67_rwlock_rlock", argc: 1},
+	"rwlock_read_unlock":  {symbol: "_vibe67_rwlock_runlock", argc: 1},
+	"rwlock_write":        {symbol: "_vibe67_rwlock_wlock", argc: 1},
+	"rwlock_write_unlock": {symbol: "_vibe67_rwlock_wunlock", argc: 1},
+	"condvar_wait":        {symbol: "_vibe67_condvar_wait", argc: 2},
+	"condvar_signal":      {symbol: "_vibe67_condvar_signal", argc: 1},
+	"condvar_broadcast":   {symbol: "_vibe67_condvar_broadcast", argc: 1},
+	"queue_push":          {symbol: "_vibe67_queue_push", argc: 2, result: syncResultNumber},
+	"queue_pop":           {symbol: "_vibe67_queue_pop", argc: 1, result: syncResultPointer},
+	"queue_close":         {symbol: "_vibe67_queue_close", argc: 1},
+	"close":               {symbol: "_vibe67_queue_close", argc: 1},
+}
+
+// syncBuiltinNames returns the names of all sync builtins in sorted order
+func syncBuiltinNames() []string {
+	names := make([]string, 0, len(syncBuiltins))
+	for name := range syncBuiltins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkSyncArgs validates the argument count of a sync builtin call
+func checkSyncArgs(call *CallExpr, b syncBuiltin) error {
+	if len(call.Args) == b.argc || (b.optionalArg && len(call.Args) == 0) {
+		return nil
+	}
+	if b.argc == 1 {
+		return fmt.Errorf("%s() requires exactly 1 argument", call.Function)
+	}
+	return fmt.Errorf("%s() requires exactly %d arguments", call.Function, b.argc)
+}
+
+// heldLock records a mutex acquired by a lock statement that is still being compiled
+type heldLock struct {
+	mutex     Expression // Mutex expression (re-evaluated on release, like defer)
+	loopDepth int        // Number of active loops when the lock was taken
+}
+
+// compileSyncBuiltin compiles a call to one of the syncBuiltins
+func (fc *C67Compiler) compileSyncBuiltin(call *CallExpr) {
+	b := syncBuiltins[call.Function]
+	if err := checkSyncArgs(call, b); err != nil {
+		compilerError("%v", err)
+	}
+	fc.usesSync = true
+
+	// Evaluate arguments left to right, keeping the raw bits on the stack
+	for _, arg := range call.Args {
+		fc.compileExpression(arg)
+		fc.out.SubImmFromReg("rsp", StackSlotSize)
+		fc.out.MovXmmToMem("xmm0", "rsp", 0)
+	}
+	argRegs := []string{"rdi", "rsi"}
+	for i := len(call.Args) - 1; i >= 0; i-- {
+		fc.out.PopReg(argRegs[i])
+	}
+
+	if b.numericArg {
+		if len(call.Args) == 0 {
+			fc.out.MovImmToReg("rdi", "1")
+		} else {
+			fc.out.MovqRegToXmm("xmm0", "rdi")
+			fc.out.Cvttsd2si("rdi", "xmm0")
+		}
+	}
+	if b.allocSize > 0 {
+		fc.out.MovImmToReg("rdi", fmt.Sprintf("%d", b.allocSize))
+	}
+
+	fc.callFunction(b.symbol, "")
+
+	switch b.result {
+	case syncResultZero:
+		fc.out.XorpdXmm("xmm0", "xmm0")
+	case syncResultNumber:
+		fc.out.Cvtsi2sd("xmm0", "rax")
+	case syncResultPointer:
+		EmitPointerToFloat64(fc.out, "xmm0", "rax")
+	}
+}
+
+// compileLockStmt compiles lock m { ... }
+// The mutex is released at the end of the block, and by ret, ret @N and @N
+// statements that leave the block early.
+func (fc *C67Compiler) compileLockStmt(stmt *LockStmt) {
+	fc.compileSyncBuiltin(&CallExpr{Function: "mutex_lock", Args: []Expression{stmt.Mutex}})
+	fc.heldLocks = append(fc.heldLocks, heldLock{mutex: stmt.Mutex, loopDepth: len(fc.activeLoops)})
+
+	fc.pushDeferScope()
+	for _, bodyStmt := range stmt.Body {
+		fc.compileStatement(bodyStmt)
+	}
+	fc.popDeferScope()
+
+	fc.heldLocks = fc.heldLocks[:len(fc.heldLocks)-1]
+	fc.compileSyncBuiltin(&CallExpr{Function: "mutex_unlock", Args: []Expression{stmt.Mutex}})
+}
+
+// releaseHeldLocks unlocks, innermost first, every held lock taken inside more
+// than minLoopDepth active loops. Pass -1 to release all locks (function return).
+// xmm0 is preserved so that return values survive the unlock calls.
+func (fc *C67Compiler) releaseHeldLocks(minLoopDepth int) {
+	if len(fc.heldLocks) == 0 {
+		return
+	}
+	fc.out.SubImmFromReg("rsp", 16)
+	fc.out.MovXmmToMem("xmm0", "rsp", 0)
+	for i := len(fc.heldLocks) - 1; i >= 0; i-- {
+		if fc.heldLocks[i].loopDepth > minLoopDepth {
+			fc.compileSyncBuiltin(&CallExpr{Function: "mutex_unlock", Args: []Expression{fc.heldLocks[i].mutex}})
+		}
+	}
+	fc.out.MovMemToXmm("xmm0", "rsp", 0)
+	fc.out.AddImmToReg("rsp", 16)
+}
+
+// syncJumpForward emits a conditional jump with a placeholder offset and returns its position
+func (fc *C67Compiler) syncJumpForward(cond JumpCondition) int {
+	pos := fc.eb.text.Len()
+	fc.out.JumpConditional(cond, 0)
+	return pos
+}
+
+// syncJumpBack emits a conditional jump to an earlier position
+func (fc *C67Compiler) syncJumpBack(cond JumpCondition, target int) {
+	pos := fc.eb.text.Len()
+	fc.out.JumpConditional(cond, int32(target-(pos+ConditionalJumpSize)))
+}
+
+// syncJmpBack emits an unconditional jump to an earlier position
+func (fc *C67Compiler) syncJmpBack(target int) {
+	pos := fc.eb.text.Len()
+	fc.out.JumpUnconditional(int32(target - (pos + UnconditionalJumpSize)))
+}
+
+// syncPatchHere points a conditional jump emitted by syncJumpForward at the current position
+func (fc *C67Compiler) syncPatchHere(pos int) {
+	fc.patchJumpImmediate(pos+2, int32(fc.eb.text.Len()-(pos+ConditionalJumpSize)))
+}
+
+// syncSavedRegs are preserved by every sync runtime function
+var syncSavedRegs = []string{"rbx", "rcx", "rdx", "rsi", "rdi", "r8", "r9", "r10", "r11", "r12"}
+
+func (fc *C67Compiler) syncPrologue(label string) {
+	fc.eb.MarkLabel(label)
+	for _, reg := range syncSavedRegs {
+		fc.out.PushReg(reg)
+	}
+}
+
+func (fc *C67Compiler) syncEpilogue() {
+	for i := len(syncSavedRegs) - 1; i >= 0; i-- {
+		fc.out.PopReg(syncSavedRegs[i])
+	}
+	fc.out.Ret()
+}
+
+// emitFutexWait sleeps while the 32-bit word at [base+offset] equals edx
+// Clobbers rax, rcx, rdi, rsi, r10, r11
+func (fc *C67Compiler) emitFutexWait(base string, offset int) {
+	if fc.eb.target.OS() != OSLinux {
+		fc.out.Emit([]byte{0xf3, 0x90}) // pause
+		return
+	}
+	fc.out.LeaMemToReg("rdi", base, offset)
+	fc.out.MovImmToReg("rsi", fmt.Sprintf("%d", futexWait))
+	fc.out.XorRegWithReg("r10", "r10") // no timeout
+	fc.out.MovImmToReg("rax", "202")   // sys_futex
+	fc.out.Syscall()
+}
+
+// emitFutexWake wakes up to count threads sleeping on [base+offset]
+// Clobbers rax, rcx, rdx, rdi, rsi, r11
+func (fc *C67Compiler) emitFutexWake(base string, offset int, count int) {
+	if fc.eb.target.OS() != OSLinux {
+		return
+	}
+	fc.out.LeaMemToReg("rdi", base, offset)
+	fc.out.MovImmToReg("rsi", fmt.Sprintf("%d", futexWake))
+	fc.out.MovImmToReg("rdx", fmt.Sprintf("%d", count))
+	fc.out.MovImmToReg("rax", "202") // sys_futex
+	fc.out.Syscall()
+}
+
+// emitMutexAcquire locks the mutex at [base+offset]
+// With contended=true the fast path is skipped and the state is always set to 2,
+// which is required after waking from a condition variable.
+func (fc *C67Compiler) emitMutexAcquire(base string, offset int, contended bool) {
+	var fastJump int
+	if !contended {
+		// Fast path: cmpxchg 0 -> 1
+		fc.out.MovImmToReg("rcx", "1")
+		fc.out.XorRegWithReg("rax", "rax")
+		fc.out.LockCmpxchgMemReg(base, offset, "rcx")
+		fastJump = fc.syncJumpForward(JumpEqual)
+	}
+
+	// Slow path: mark contended with xchg 2 until the old state was 0
+	loopStart := fc.eb.text.Len()
+	fc.out.MovImmToReg("rax", "2")
+	fc.out.XchgMemReg(base, offset, "rax")
+	fc.out.TestRegReg("rax", "rax")
+	doneJump := fc.syncJumpForward(JumpEqual)
+	fc.out.MovImmToReg("rdx", "2")
+	fc.emitFutexWait(base, offset)
+	fc.syncJmpBack(loopStart)
+
+	fc.syncPatchHere(doneJump)
+	if !contended {
+		fc.syncPatchHere(fastJump)
+	}
+}
+
+// emitMutexRelease unlocks the mutex at [base+offset], waking one waiter if contended
+func (fc *C67Compiler) emitMutexRelease(base string, offset int) {
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.out.XchgMemReg(base, offset, "rax")
+	fc.out.CmpRegToImm("rax", 2)
+	doneJump := fc.syncJumpForward(JumpNotEqual)
+	fc.emitFutexWake(base, offset, 1)
+	fc.syncPatchHere(doneJump)
+}
+
+// emitCondvarWait atomically releases the mutex and waits for a notification, then relocks
+// Clobbers r8 in addition to the futex registers
+func (fc *C67Compiler) emitCondvarWait(cvBase string, cvOffset int, mBase string, mOffset int) {
+	fc.out.MovMemToReg("r8", cvBase, cvOffset) // sequence snapshot
+	fc.emitMutexRelease(mBase, mOffset)
+	fc.out.MovRegToReg("rdx", "r8")
+	fc.emitFutexWait(cvBase, cvOffset)
+	fc.emitMutexAcquire(mBase, mOffset, true)
+}
+
+// emitCondvarNotify bumps the sequence and wakes up to count waiters
+func (fc *C67Compiler) emitCondvarNotify(base string, offset int, count int) {
+	fc.out.MovImmToReg("rax", "1")
+	fc.out.LockXaddMemReg(base, offset, "rax")
+	fc.emitFutexWake(base, offset, count)
+}
+
+// emitRWLockWaiters adds delta to the waiter count of the rwlock in rbx
+func (fc *C67Compiler) emitRWLockWaiters(delta int) {
+	fc.out.MovImmToReg("rcx", fmt.Sprintf("%d", delta))
+	fc.out.LockXaddMemReg("rbx", rwlockWaitersOffset, "rcx")
+}
+
+// emitRWLockWakeWaiters wakes all threads blocked on the rwlock in rbx, if any
+func (fc *C67Compiler) emitRWLockWakeWaiters() {
+	fc.out.MovMemToReg("rax", "rbx", rwlockWaitersOffset)
+	fc.out.TestRegReg("rax", "rax")
+	doneJump := fc.syncJumpForward(JumpEqual)
+	fc.emitFutexWake("rbx", 0, futexWakeAll)
+	fc.syncPatchHere(doneJump)
+}
+
+// generateSyncRuntime emits the x86_64 sync runtime functions
+func (fc *C67Compiler) generateSyncRuntime() {
+	// _vibe67_sync_new(rdi=size) -> rax = zeroed memory with a stable address
+	fc.syncPrologue("_vibe67_sync_new")
+	if fc.eb.target.OS() == OSLinux {
+		// mmap(NULL, size, PROT_READ|PROT_WRITE, MAP_SHARED|MAP_ANONYMOUS, -1, 0)
+		fc.out.MovRegToReg("rsi", "rdi")
+		fc.out.XorRegWithReg("rdi", "rdi")
+		fc.out.MovImmToReg("rdx", "3")
+		fc.out.MovImmToReg("r10", fmt.Sprintf("%d", mmapSharedAnonymous))
+		fc.out.MovImmToReg("r8", "-1")
+		fc.out.XorRegWithReg("r9", "r9")
+		fc.out.MovImmToReg("rax", "9") // sys_mmap
+		fc.out.Syscall()
+	} else {
+		// malloc + zero fill
+		fc.out.MovRegToReg("rbx", "rdi")
+		fc.out.PushReg("rbp")
+		fc.out.MovRegToReg("rbp", "rsp")
+		fc.out.AndRegWithImm("rsp", -16)
+		if fc.eb.target.OS() == OSWindows {
+			fc.out.MovRegToReg("rcx", "rbx")
+		}
+		shadowSpace := fc.allocateShadowSpace()
+		fc.callFunction("malloc", "")
+		fc.deallocateShadowSpace(shadowSpace)
+		fc.out.MovRegToReg("rsp", "rbp")
+		fc.out.PopReg("rbp")
+		fc.out.MovRegToReg("r8", "rax")
+		fc.out.MovRegToReg("rdi", "rax")
+		fc.out.MovRegToReg("rcx", "rbx")
+		fc.out.XorRegWithReg("rax", "rax")
+		fc.out.Emit([]byte{0xf3, 0xaa}) // rep stosb
+		fc.out.MovRegToReg("rax", "r8")
+	}
+	fc.syncEpilogue()
+
+	// _vibe67_queue_new(rdi=capacity) -> rax = queue
+	fc.syncPrologue("_vibe67_queue_new")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.out.CmpRegToImm("rbx", 0)
+	capOK := fc.syncJumpForward(JumpGreater)
+	fc.out.MovImmToReg("rbx", "1") // unbuffered channels get one slot
+	fc.syncPatchHere(capOK)
+	fc.out.MovRegToReg("rdi", "rbx")
+	fc.out.ShlImmReg("rdi", 3)
+	fc.out.AddImmToReg("rdi", queueSlotsOffset)
+	fc.callFunction("_vibe67_sync_new", "")
+	fc.out.MovRegToMem("rbx", "rax", queueCapOffset)
+	fc.syncEpilogue()
+
+	// _vibe67_mutex_lock(rdi=mutex)
+	fc.syncPrologue("_vibe67_mutex_lock")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.emitMutexAcquire("rbx", 0, false)
+	fc.syncEpilogue()
+
+	// _vibe67_mutex_unlock(rdi=mutex)
+	fc.syncPrologue("_vibe67_mutex_unlock")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.emitMutexRelease("rbx", 0)
+	fc.syncEpilogue()
+
+	// _vibe67_rwlock_rlock(rdi=rwlock): cmpxchg n -> n+1 while no writer holds it
+	fc.syncPrologue("_vibe67_rwlock_rlock")
+	fc.out.MovRegToReg("rbx", "rdi")
+	loopStart := fc.eb.text.Len()
+	fc.out.MovMemToReg("rax", "rbx", 0)
+	fc.out.TestRegReg("rax", "rax")
+	waitJump := fc.syncJumpForward(JumpLess)
+	fc.out.MovRegToReg("rcx", "rax")
+	fc.out.IncReg("rcx")
+	fc.out.LockCmpxchgMemReg("rbx", 0, "rcx")
+	doneJump := fc.syncJumpForward(JumpEqual)
+	fc.syncJmpBack(loopStart)
+	fc.syncPatchHere(waitJump)
+	fc.out.MovRegToReg("rdx", "rax")
+	fc.emitRWLockWaiters(1)
+	fc.emitFutexWait("rbx", 0)
+	fc.emitRWLockWaiters(-1)
+	fc.syncJmpBack(loopStart)
+	fc.syncPatchHere(doneJump)
+	fc.syncEpilogue()
+
+	// _vibe67_rwlock_runlock(rdi=rwlock): the last reader wakes blocked writers
+	fc.syncPrologue("_vibe67_rwlock_runlock")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.out.MovImmToReg("rax", "-1")
+	fc.out.LockXaddMemReg("rbx", 0, "rax")
+	fc.out.CmpRegToImm("rax", 1)
+	doneJump = fc.syncJumpForward(JumpNotEqual)
+	fc.emitRWLockWakeWaiters()
+	fc.syncPatchHere(doneJump)
+	fc.syncEpilogue()
+
+	// _vibe67_rwlock_wlock(rdi=rwlock): cmpxchg 0 -> -1
+	fc.syncPrologue("_vibe67_rwlock_wlock")
+	fc.out.MovRegToReg("rbx", "rdi")
+	loopStart = fc.eb.text.Len()
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.out.MovImmToReg("rcx", "-1")
+	fc.out.LockCmpxchgMemReg("rbx", 0, "rcx")
+	doneJump = fc.syncJumpForward(JumpEqual)
+	fc.out.MovRegToReg("rdx", "rax")
+	fc.emitRWLockWaiters(1)
+	fc.emitFutexWait("rbx", 0)
+	fc.emitRWLockWaiters(-1)
+	fc.syncJmpBack(loopStart)
+	fc.syncPatchHere(doneJump)
+	fc.syncEpilogue()
+
+	// _vibe67_rwlock_wunlock(rdi=rwlock)
+	fc.syncPrologue("_vibe67_rwlock_wunlock")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.out.XchgMemReg("rbx", 0, "rax")
+	fc.emitRWLockWakeWaiters()
+	fc.syncEpilogue()
+
+	// _vibe67_condvar_wait(rdi=condvar, rsi=mutex)
+	fc.syncPrologue("_vibe67_condvar_wait")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.out.MovRegToReg("r12", "rsi")
+	fc.emitCondvarWait("rbx", 0, "r12", 0)
+	fc.syncEpilogue()
+
+	// _vibe67_condvar_signal(rdi=condvar)
+	fc.syncPrologue("_vibe67_condvar_signal")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.emitCondvarNotify("rbx", 0, 1)
+	fc.syncEpilogue()
+
+	// _vibe67_condvar_broadcast(rdi=condvar)
+	fc.syncPrologue("_vibe67_condvar_broadcast")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.emitCondvarNotify("rbx", 0, futexWakeAll)
+	fc.syncEpilogue()
+
+	// _vibe67_queue_push(rdi=queue, rsi=value) -> rax = 1 if pushed, 0 if the queue is closed
+	fc.syncPrologue("_vibe67_queue_push")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.out.MovRegToReg("r12", "rsi")
+	fc.emitMutexAcquire("rbx", queueMutexOffset, false)
+	loopStart = fc.eb.text.Len()
+	fc.out.MovMemToReg("rax", "rbx", queueClosedOffset)
+	fc.out.TestRegReg("rax", "rax")
+	closedJump := fc.syncJumpForward(JumpNotEqual)
+	fc.out.MovMemToReg("rax", "rbx", queueCountOffset)
+	fc.out.MovMemToReg("rcx", "rbx", queueCapOffset)
+	fc.out.CmpRegToReg("rax", "rcx")
+	spaceJump := fc.syncJumpForward(JumpLess)
+	fc.emitCondvarWait("rbx", queueNotFullOffset, "rbx", queueMutexOffset)
+	fc.syncJmpBack(loopStart)
+	fc.syncPatchHere(spaceJump)
+	// slots[(head + count) % capacity] = value
+	fc.out.MovMemToReg("rax", "rbx", queueHeadOffset)
+	fc.out.MovMemToReg("rcx", "rbx", queueCountOffset)
+	fc.out.AddRegToReg("rax", "rcx")
+	fc.out.XorRegWithReg("rdx", "rdx")
+	fc.out.MovMemToReg("rcx", "rbx", queueCapOffset)
+	fc.out.Emit([]byte{0x48, 0xf7, 0xf1}) // div rcx
+	fc.out.ShlImmReg("rdx", 3)
+	fc.out.AddRegToReg("rdx", "rbx")
+	fc.out.MovRegToMem("r12", "rdx", queueSlotsOffset)
+	fc.out.MovMemToReg("rax", "rbx", queueCountOffset)
+	fc.out.IncReg("rax")
+	fc.out.MovRegToMem("rax", "rbx", queueCountOffset)
+	fc.emitMutexRelease("rbx", queueMutexOffset)
+	fc.emitCondvarNotify("rbx", queueNotEmptyOffset, 1)
+	fc.out.MovImmToReg("rax", "1")
+	outJump := fc.eb.text.Len()
+	fc.out.JumpUnconditional(0)
+	fc.syncPatchHere(closedJump)
+	fc.emitMutexRelease("rbx", queueMutexOffset)
+	fc.out.XorRegWithReg("rax", "rax")
+	fc.patchJumpImmediate(outJump+1, int32(fc.eb.text.Len()-(outJump+UnconditionalJumpSize)))
+	fc.syncEpilogue()
+
+	// _vibe67_queue_pop(rdi=queue) -> rax = value, or the "cls" error NaN once closed and drained
+	fc.syncPrologue("_vibe67_queue_pop")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.emitMutexAcquire("rbx", queueMutexOffset, false)
+	loopStart = fc.eb.text.Len()
+	fc.out.MovMemToReg("rax", "rbx", queueCountOffset)
+	fc.out.TestRegReg("rax", "rax")
+	itemJump := fc.syncJumpForward(JumpNotEqual)
+	fc.out.MovMemToReg("rax", "rbx", queueClosedOffset)
+	fc.out.TestRegReg("rax", "rax")
+	closedJump = fc.syncJumpForward(JumpNotEqual)
+	fc.emitCondvarWait("rbx", queueNotEmptyOffset, "rbx", queueMutexOffset)
+	fc.syncJmpBack(loopStart)
+	fc.syncPatchHere(itemJump)
+	// value = slots[head]; head = (head + 1) % capacity; count--
+	fc.out.MovMemToReg("rax", "rbx", queueHeadOffset)
+	fc.out.MovRegToReg("rdx", "rax")
+	fc.out.ShlImmReg("rdx", 3)
+	fc.out.AddRegToReg("rdx", "rbx")
+	fc.out.MovMemToReg("r12", "rdx", queueSlotsOffset)
+	fc.out.IncReg("rax")
+	fc.out.XorRegWithReg("rdx", "rdx")
+	fc.out.MovMemToReg("rcx", "rbx", queueCapOffset)
+	fc.out.Emit([]byte{0x48, 0xf7, 0xf1}) // div rcx
+	fc.out.MovRegToMem("rdx", "rbx", queueHeadOffset)
+	fc.out.MovMemToReg("rax", "rbx", queueCountOffset)
+	fc.out.DecReg("rax")
+	fc.out.MovRegToMem("rax", "rbx", queueCountOffset)
+	fc.emitMutexRelease("rbx", queueMutexOffset)
+	fc.emitCondvarNotify("rbx", queueNotFullOffset, 1)
+	fc.out.MovRegToReg("rax", "r12")
+	outJump = fc.eb.text.Len()
+	fc.out.JumpUnconditional(0)
+	fc.syncPatchHere(closedJump)
+	fc.emitMutexRelease("rbx", queueMutexOffset)
+	fc.out.Emit([]byte{0x48, 0xb8}) // mov rax, imm64
+	for i := 0; i < 8; i++ {
+		fc.out.Write(byte(queueClosedError >> (8 * i)))
+	}
+	fc.patchJumpImmediate(outJump+1, int32(fc.eb.text.Len()-(outJump+UnconditionalJumpSize)))
+	fc.syncEpilogue()
+
+	// _vibe67_queue_close(rdi=queue): wakes every blocked producer and consumer
+	fc.syncPrologue("_vibe67_queue_close")
+	fc.out.MovRegToReg("rbx", "rdi")
+	fc.emitMutexAcquire("rbx", queueMutexOffset, false)
+	fc.out.MovImmToReg("rax", "1")
+	fc.out.MovRegToMem("rax", "rbx", queueClosedOffset)
+	fc.emitMutexRelease("rbx", queueMutexOffset)
+	fc.emitCondvarNotify("rbx", queueNotEmptyOffset, futexWakeAll)
+	fc.emitCondvarNotify("rbx", queueNotFullOffset, futexWakeAll)
+	fc.syncEpilogue()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestQueueFIFOWraparound(t *testing.T) {
+	code := `
+q := queue(3)
+@ i in 0..<7 {
+    queue_push(q, i * 10)
+    i > 1 {
+        println(queue_pop(q))
+    }
+}
+println(queue_pop(q))
+println(queue_pop(q))
+`
+	result := compileAndRun(t, code)
+	expected := "0\n10\n20\n30\n40\n50\n60\n"
+	if result != expected {
+		t.Fatalf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestQueueClose(t *testing.T) {
+	code := `
+q := chan(2)
+queue_push(q, 7)
+close(q)
+println(queue_push(q, 8))
+println(queue_pop(q))
+v := queue_pop(q)
+println(is_nan(v))
+`
+	result := compileAndRun(t, code)
+	expected := "0\n7\n1\n"
+	if result != expected {
+		t.Fatalf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestLockReleasedOnExit(t *testing.T) {
+	code := `
+m := mutex()
+f := n -> {
+    lock m {
+        n > 2 {
+            ret 99
+        }
+    }
+    ret n
+}
+println(f(5))
+println(f(1))
+@ i in 0..<5 {
+    lock m {
+        i == 1 {
+            ret @
+        }
+    }
+}
+lock m {
+    println("OK")
+}
+`
+	result := compileAndRun(t, code)
+	expected := "99\n1\nOK\n"
+	if result != expected {
+		t.Fatalf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestRWLockAndCondvar(t *testing.T) {
+	code := `
+rw := rwlock()
+rwlock_read(rw)
+rwlock_read(rw)
+rwlock_read_unlock(rw)
+rwlock_read_unlock(rw)
+rwlock_write(rw)
+rwlock_write_unlock(rw)
+cv := condvar()
+condvar_signal(cv)
+condvar_broadcast(cv)
+println("OK")
+`
+	result := compileAndRun(t, code)
+	if result != "OK\n" {
+		t.Fatalf("Expected 'OK', got %q", result)
+	}
+}
+
+// TestContendedSync runs the primitives from four threads at once, so that
+// waiters go to sleep in futex and have to be woken. The programs stay at the
+// top level, since compileAndRun would wrap them in main.
+func TestContendedSync(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("parallel loops run on x86-64 Linux")
+	}
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"mutex", `
+m := mutex()
+total := 0
+4 @ i in 0..<4 {
+    @ j in 0..<20000 {
+        lock m {
+            total <- total + 1
+        }
+    }
+}
+println(total)
+`, "80000\n"},
+		{"rwlock", `
+rw := rwlock()
+m := mutex()
+a := 0
+b := 0
+bad := 0
+reads := 0
+4 @ i in 0..<4 {
+    @ j in 0..<20000 {
+        j % 4 == 0 {
+            rwlock_write(rw)
+            a <- a + 1
+            b <- b + 1
+            rwlock_write_unlock(rw)
+        }
+        j % 4 != 0 {
+            rwlock_read(rw)
+            lock m {
+                bad <- bad + (a - b) * (a - b)
+                reads <- reads + 1
+            }
+            rwlock_read_unlock(rw)
+        }
+    }
+}
+printf("%v %v %v\n", a, reads, bad)
+`, "20000.000000 60000.000000 0.000000\n"},
+		{"condvar turns", `
+m := mutex()
+cv := condvar()
+turn := 0
+4 @ i in 0..<4 {
+    @ j in 0..<2000 {
+        lock m {
+            @ turn % 4 != i max inf {
+                condvar_wait(cv, m)
+            }
+            turn <- turn + 1
+            condvar_broadcast(cv)
+        }
+    }
+}
+println(turn)
+`, "8000\n"},
+		{"queue", `
+q := queue(2)
+m := mutex()
+sum := 0
+4 @ i in 0..<4 {
+    i < 2 {
+        @ j in 0..<5000 {
+            queue_push(q, j)
+        }
+    }
+    i >= 2 {
+        @ j in 0..<5000 {
+            v := queue_pop(q)
+            lock m {
+                sum <- sum + v
+            }
+        }
+    }
+}
+println(sum)
+`, "24995000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exePath := compileTestCode(t, tt.code)
+			out, err := exec.Command("timeout", "20s", exePath).Output()
+			if err != nil {
+				t.Fatalf("running: %v\nOutput: %s", err, out)
+			}
+			if string(out) != tt.want {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncCompilesForARM64(t *testing.T) {
+	code := `
+m := mutex()
+q := queue(4)
+lock m {
+    queue_push(q, 1)
+}
+exit(queue_pop(q))
+`
+	tmpDir := t.TempDir()
+	srcPath := filepath.Join(tmpDir, "sync_arm64.vibe67")
+	exePath := filepath.Join(tmpDir, "sync_arm64")
+	if err := os.WriteFile(srcPath, []byte(code), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	platform := Platform{Arch: ArchARM64, OS: OSDarwin}
+	if err := CompileC67(srcPath, exePath, platform); err != nil {
+		t.Fatalf("Compilation failed: %v", err)
+	}
+}
@@ -4,18 +4,49 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 )
 
 // Syscall generates a raw syscall instruction for unsafe blocks
+// On FreeBSD, a failed system call sets the carry flag and returns the
+// positive errno; that is turned into -errno, which is what Linux returns.
 func (o *Out) Syscall() {
 	if o.backend != nil {
 		o.backend.Syscall()
-		return
+	} else {
+		// Fallback for x86_64 (uses methods in this file)
+		switch o.target.Arch() {
+		case ArchX86_64:
+			o.syscallX86()
+		}
 	}
-	// Fallback for x86_64 (uses methods in this file)
+	if o.target.OS() == OSFreeBSD {
+		o.syscallErrno()
+	}
+}
+
+// SysNum returns the number of a system call on the target as an immediate,
+// given its name (see getSyscallNumbers)
+func (o *Out) SysNum(name string) string {
+	return strconv.FormatUint(sysNum(o.target, name), 10)
+}
+
+// syscallErrno negates the result of a system call if the carry flag is set
+func (o *Out) syscallErrno() {
 	switch o.target.Arch() {
 	case ArchX86_64:
-		o.syscallX86()
+		o.Write(0x73) // jnc +3
+		o.Write(0x03)
+		o.Write(0x48) // neg rax
+		o.Write(0xF7)
+		o.Write(0xD8)
+	case ArchARM64:
+		// cneg x0, x0, cs
+		instr := uint32(0xDA803400)
+		o.Write(uint8(instr & 0xFF))
+		o.Write(uint8((instr >> 8) & 0xFF))
+		o.Write(uint8((instr >> 16) & 0xFF))
+		o.Write(uint8((instr >> 24) & 0xFF))
 	}
 }
 
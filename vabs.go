@@ -80,7 +80,7 @@ func (o *Out) vabspdX86VectorToVector(dst, src string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81)
+		p2 := uint8(0x85)
 		p2 |= uint8((^srcReg.Encoding & 0x0F) << 3)
 
 		p3 := uint8(0x40)
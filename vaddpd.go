@@ -92,7 +92,7 @@ func (o *Out) vaddpdX86VectorToVector(dst, src1, src2 string) {
 		// W: 1 (64-bit element size for float64)
 		// vvvv: ~src1 encoding (inverted bits 0-3)
 		// pp: 01 (66 prefix)
-		p2 := uint8(0x81)                            // W=1, pp=01
+		p2 := uint8(0x85)                            // W=1, pp=01
 		p2 |= uint8((^src1Reg.Encoding & 0x0F) << 3) // vvvv
 
 		// P3: [z L'L b V' aaa]
@@ -73,7 +73,7 @@ func (o *Out) vblendmpdX86WithMask(dst, src1, src2, mask string) {
 		}
 
 		// P2: W=1, vvvv=~src1, pp=01
-		p2 := uint8(0x81)
+		p2 := uint8(0x85)
 		p2 |= uint8((^src1Reg.Encoding & 0x0F) << 3)
 
 		// P3: L'L=10 (512-bit), with masking
@@ -84,7 +84,7 @@ func (o *Out) vbroadcastsdX86ScalarToVector(dst, src string) {
 		}
 
 		// P2: W=1, vvvv=1111 (unused), pp=01
-		p2 := uint8(0x81) | (0x0F << 3)
+		p2 := uint8(0x85) | (0x0F << 3)
 
 		// P3: L'L=10 (512-bit)
 		p3 := uint8(0x40)
@@ -187,7 +187,7 @@ func (o *Out) vbroadcastsdX86MemToVector(dst, base string, offset int32) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81) | (0x0F << 3)
+		p2 := uint8(0x85) | (0x0F << 3)
 		p3 := uint8(0x40)
 
 		o.Write(p0)
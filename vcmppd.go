@@ -91,7 +91,7 @@ func (o *Out) vcmppdX86VectorToVector(dstMask, src1, src2 string, predicate Comp
 		// R' not used for k registers
 
 		// P2: W=1, vvvv=~src1, pp=01
-		p2 := uint8(0x81)
+		p2 := uint8(0x85)
 		p2 |= uint8((^src1Reg.Encoding & 0x0F) << 3)
 
 		// P3: L'L=10 (512-bit)
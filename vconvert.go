@@ -86,7 +86,7 @@ func (o *Out) vcvtqq2pdX86VectorToVector(dst, src string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x82) | (0x0F << 3) // vvvv=1111 (unused), W=1
+		p2 := uint8(0x86) | (0x0F << 3) // vvvv=1111 (unused), W=1
 
 		p3 := uint8(0x40)
 		if (srcReg.Encoding & 16) == 0 {
@@ -121,7 +121,7 @@ func (o *Out) vcvtqq2pdX86VectorToVector(dst, src string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x82) | (0x0F << 3)
+		p2 := uint8(0x86) | (0x0F << 3)
 
 		p3 := uint8(0x20) // L'L=01 (256-bit)
 		if (srcReg.Encoding & 16) == 0 {
@@ -187,7 +187,7 @@ func (o *Out) vcvttpd2qqX86VectorToVector(dst, src string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81) | (0x0F << 3) // vvvv=1111, W=1
+		p2 := uint8(0x85) | (0x0F << 3) // vvvv=1111, W=1
 
 		p3 := uint8(0x40)
 		if (srcReg.Encoding & 16) == 0 {
@@ -222,7 +222,7 @@ func (o *Out) vcvttpd2qqX86VectorToVector(dst, src string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81) | (0x0F << 3)
+		p2 := uint8(0x85) | (0x0F << 3)
 
 		p3 := uint8(0x20)
 		if (srcReg.Encoding & 16) == 0 {
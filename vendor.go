@@ -0,0 +1,223 @@
+// Completion: 90% - mod vendor and offline dependency resolution
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// vendor.go - Vendored and offline dependencies
+//
+// 'vibe67 mod vendor' copies every resolved Git dependency, at the commit
+// pinned in vibe67.lock, into vendor_v67/ next to the main source file:
+//
+//	vendor_v67/modules.txt
+//	vendor_v67/github.com/xyproto/vibe67_math/*.vibe67
+//
+// Vendored modules take precedence over the dependency cache. With -offline,
+// nothing is ever cloned or fetched: dependencies come from vendor_v67/ or
+// the cache, and all missing modules are reported together.
+
+// VendorDirName is the name of the directory that holds vendored modules
+const VendorDirName = "vendor_v67"
+
+// vendorModulesFile lists the vendored modules and their commits
+const vendorModulesFile = "modules.txt"
+
+// activeVendorDir is the vendor directory of the program currently being compiled ("" if none)
+var activeVendorDir string
+
+// MissingModulesError is returned in offline mode when dependencies are
+// neither vendored nor cached
+type MissingModulesError struct {
+	Modules []string
+}
+
+func (e *MissingModulesError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "offline mode: %d module(s) not found in %s or the dependency cache:\n", len(e.Modules), VendorDirName)
+	for _, module := range e.Modules {
+		fmt.Fprintf(&sb, "    %s\n", module)
+	}
+	sb.WriteString("run 'vibe67 mod vendor' on a machine with network access and commit " + VendorDirName + "/")
+	return sb.String()
+}
+
+// vendoredRepoPath returns the vendored copy of a repository, if there is one
+func vendoredRepoPath(repoURL string) (string, bool) {
+	if activeVendorDir == "" {
+		return "", false
+	}
+	path := filepath.Join(activeVendorDir, filepath.FromSlash(normalizeRepoURL(repoURL)))
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return path, true
+	}
+	return "", false
+}
+
+// ResolveModule returns the directory holding a Git dependency: the vendored
+// copy if there is one, otherwise the (pinned) checkout in the cache
+func ResolveModule(repoURL, version string) (string, error) {
+	if path, ok := vendoredRepoPath(repoURL); ok {
+		if VerboseMode {
+			fmt.Fprintf(os.Stderr, "Using vendored %s\n", path)
+		}
+		return path, nil
+	}
+	return EnsureRepoLocked(repoURL, version, UpdateDepsFlag)
+}
+
+// ensureRepoOffline is EnsureRepoLocked without network access
+func ensureRepoOffline(repoURL, version string) (string, error) {
+	repoPath, err := GetRepoCachePath(repoURL)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(repoPath, ".git")); err != nil {
+		return "", &MissingModulesError{Modules: []string{normalizeRepoURL(repoURL)}}
+	}
+
+	lock := activeLockFile
+	if lock == nil {
+		return repoPath, nil
+	}
+	if entry, ok := lock.Lookup(repoURL, version); ok {
+		if !gitHasCommit(repoPath, entry.Commit) {
+			return "", fmt.Errorf("offline mode: %s: locked commit %s is not in the dependency cache", entry.Repo, entry.Commit)
+		}
+		if err := gitCheckoutCommit(repoPath, entry.Commit); err != nil {
+			return "", fmt.Errorf("%s: %w", repoURL, err)
+		}
+		if err := verifyLockEntry(repoPath, entry); err != nil {
+			return "", err
+		}
+		return repoPath, nil
+	}
+
+	// Not pinned yet: use whatever is cached and pin it
+	commit, err := gitHeadCommit(repoPath)
+	if err != nil {
+		return "", err
+	}
+	lock.Pin(repoURL, version, commit)
+	return repoPath, nil
+}
+
+// checkOfflineModules returns a MissingModulesError listing every Git
+// dependency of the programs that is neither vendored nor cached
+func checkOfflineModules(programs []*Program) error {
+	var missing []string
+	for repoURL := range collectModuleDeps(programs) {
+		if _, ok := vendoredRepoPath(repoURL); ok {
+			continue
+		}
+		repoPath, err := GetRepoCachePath(repoURL)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(repoPath, ".git")); err != nil {
+			missing = append(missing, normalizeRepoURL(repoURL))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return &MissingModulesError{Modules: missing}
+}
+
+// VendorModules pins every transitive Git dependency of the .vibe67 files in
+// dir (like TidyLockFile) and copies them into dir/vendor_v67, replacing any
+// previously vendored modules
+func VendorModules(dir string, updateDeps bool) (*LockFile, error) {
+	lock, err := TidyLockFile(dir, updateDeps)
+	if err != nil {
+		return nil, err
+	}
+
+	vendorDir := filepath.Join(dir, VendorDirName)
+	if err := os.RemoveAll(vendorDir); err != nil {
+		return nil, fmt.Errorf("failed to remove old %s: %w", vendorDir, err)
+	}
+	if err := os.MkdirAll(vendorDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", vendorDir, err)
+	}
+
+	repos := make([]string, 0, len(lock.Entries))
+	for repo := range lock.Entries {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	var sb strings.Builder
+	sb.WriteString("# " + VendorDirName + "/" + vendorModulesFile + " - generated by 'vibe67 mod vendor', do not edit by hand\n")
+	sb.WriteString("# <repository> <requested version> <commit>\n")
+	for _, repo := range repos {
+		entry := lock.Entries[repo]
+		repoPath, err := GetRepoCachePath(repo)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyLockEntry(repoPath, entry); err != nil {
+			return nil, err
+		}
+		if err := copyModuleTree(repoPath, filepath.Join(vendorDir, filepath.FromSlash(repo))); err != nil {
+			return nil, fmt.Errorf("failed to vendor %s: %w", repo, err)
+		}
+		fmt.Fprintf(&sb, "%s %s %s\n", entry.Repo, entry.Version, entry.Commit)
+	}
+
+	modulesPath := filepath.Join(vendorDir, vendorModulesFile)
+	if err := os.WriteFile(modulesPath, []byte(sb.String()), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", modulesPath, err)
+	}
+	return lock, nil
+}
+
+// copyModuleTree copies the regular files of a checkout to dst, leaving out .git
+func copyModuleTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil // symlinks and special files are not vendored
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVendorModulesAndOfflineBuild(t *testing.T) {
+	const repo = "github.com/test/dep"
+	_, _, second := setupCachedRepo(t, repo)
+
+	dir := t.TempDir()
+	mainSrc := "import \"" + repo + "\" as dep\nprintln(answer())\n"
+	if err := os.WriteFile(filepath.Join(dir, "main.vibe67"), []byte(mainSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := VendorModules(dir, false); err != nil {
+		t.Fatalf("VendorModules failed: %v", err)
+	}
+	vendored := filepath.Join(dir, VendorDirName, "github.com", "test", "dep")
+	if _, err := os.Stat(filepath.Join(vendored, "dep.vibe67")); err != nil {
+		t.Fatalf("expected vendored source file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(vendored, ".git")); !os.IsNotExist(err) {
+		t.Fatal(".git should not be vendored")
+	}
+	modules, err := os.ReadFile(filepath.Join(dir, VendorDirName, vendorModulesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(modules), repo+" latest "+second) {
+		t.Fatalf("modules.txt does not pin %s at %s:\n%s", repo, second, modules)
+	}
+
+	// With an empty cache, offline resolution must use the vendored copy
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	oldOffline, oldVendorDir := OfflineFlag, activeVendorDir
+	defer func() { OfflineFlag, activeVendorDir = oldOffline, oldVendorDir }()
+	OfflineFlag = true
+	activeVendorDir = filepath.Join(dir, VendorDirName)
+
+	path, err := ResolveModule("https://"+repo, "")
+	if err != nil {
+		t.Fatalf("ResolveModule failed offline: %v", err)
+	}
+	if path != vendored {
+		t.Fatalf("expected vendored path %s, got %s", vendored, path)
+	}
+
+	exePath := filepath.Join(dir, "main")
+	if err := CompileC67(filepath.Join(dir, "main.vibe67"), exePath, GetDefaultPlatform()); err != nil {
+		t.Fatalf("offline build from %s failed: %v", VendorDirName, err)
+	}
+}
+
+func TestOfflineReportsAllMissingModules(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	oldOffline, oldVendorDir := OfflineFlag, activeVendorDir
+	defer func() { OfflineFlag, activeVendorDir = oldOffline, oldVendorDir }()
+	OfflineFlag = true
+	activeVendorDir = filepath.Join(t.TempDir(), VendorDirName)
+
+	code := `import "github.com/test/zeta" as z
+import "github.com/test/alpha@v1.0.0" as a
+println(1)
+`
+	parser := NewParserWithFilename(code, "main.vibe67")
+	program := parser.ParseProgram()
+
+	err := checkOfflineModules([]*Program{program})
+	var missing *MissingModulesError
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected MissingModulesError, got %v", err)
+	}
+	expected := []string{"github.com/test/alpha", "github.com/test/zeta"}
+	if strings.Join(missing.Modules, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected missing modules %v, got %v", expected, missing.Modules)
+	}
+
+	// Nothing may be cloned in offline mode
+	if _, err := EnsureRepoLocked("https://github.com/test/alpha", "v1.0.0", false); !errors.As(err, &missing) {
+		t.Fatalf("expected MissingModulesError from EnsureRepoLocked, got %v", err)
+	}
+}
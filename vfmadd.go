@@ -88,7 +88,7 @@ func (o *Out) vfmaddX86VectorToVector(dst, src1, src2, src3 string) {
 		}
 
 		// P2: W=1, vvvv=~src1 (src1 is the multiplier), pp=01
-		p2 := uint8(0x81)
+		p2 := uint8(0x85)
 		p2 |= uint8((^src1Reg.Encoding & 0x0F) << 3)
 
 		// P3: L'L=10 (512-bit)
@@ -158,7 +158,7 @@ func (o *Out) vfmaddX86VectorToVector(dst, src1, src2, src3 string) {
 		o.Write(vex1)
 
 		// L=0 for 128-bit
-		vex2 := uint8(0x85) // W=1, L=0, pp=01
+		vex2 := uint8(0x81) // W=1, L=0, pp=01
 		vex2 |= uint8((^src1Reg.Encoding & 0x0F) << 3)
 		o.Write(vex2)
 
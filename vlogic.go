@@ -96,7 +96,7 @@ func (o *Out) vandpdX86VectorToVector(dst, src1, src2 string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81)
+		p2 := uint8(0x85)
 		p2 |= uint8((^src1Reg.Encoding & 0x0F) << 3)
 
 		p3 := uint8(0x40)
@@ -185,7 +185,7 @@ func (o *Out) vorpdX86VectorToVector(dst, src1, src2 string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81)
+		p2 := uint8(0x85)
 		p2 |= uint8((^src1Reg.Encoding & 0x0F) << 3)
 
 		p3 := uint8(0x40)
@@ -274,7 +274,7 @@ func (o *Out) vxorpdX86VectorToVector(dst, src1, src2 string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81)
+		p2 := uint8(0x85)
 		p2 |= uint8((^src1Reg.Encoding & 0x0F) << 3)
 
 		p3 := uint8(0x40)
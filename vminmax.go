@@ -83,7 +83,7 @@ func (o *Out) vminpdX86VectorToVector(dst, src1, src2 string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81)
+		p2 := uint8(0x85)
 		p2 |= uint8((^src1Reg.Encoding & 0x0F) << 3)
 
 		p3 := uint8(0x40)
@@ -183,7 +183,7 @@ func (o *Out) vmaxpdX86VectorToVector(dst, src1, src2 string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81)
+		p2 := uint8(0x85)
 		p2 |= uint8((^src1Reg.Encoding & 0x0F) << 3)
 
 		p3 := uint8(0x40)
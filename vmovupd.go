@@ -49,243 +49,109 @@ func (o *Out) VMovupdStoreToMem(src, base string, offset int32) {
 // x86-64 VMOVUPD zmm, [mem] (load)
 // EVEX.512.66.0F.W1 10 /r
 func (o *Out) vmovupdX86LoadFromMem(dst, base string, offset int32) {
-	dstReg, dstOk := GetRegister(o.target.Arch(), dst)
-	baseReg, baseOk := GetRegister(o.target.Arch(), base)
-	if !dstOk || !baseOk {
-		return
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "vmovupd %s, [%s + %d]\n", dst, base, offset)
 	}
+	o.vmovupdX86Mem(0x10, dst, base, offset)
+}
 
+// x86-64 VMOVUPD [mem], zmm (store)
+// EVEX.512.66.0F.W1 11 /r
+func (o *Out) vmovupdX86StoreToMem(src, base string, offset int32) {
 	if VerboseMode {
-		fmt.Fprintf(os.Stderr, "vmovupd %s, [%s + %d]:", dst, base, offset)
+		fmt.Fprintf(os.Stderr, "vmovupd [%s + %d], %s\n", base, offset, src)
 	}
+	o.vmovupdX86Mem(0x11, src, base, offset)
+}
 
-	if dstReg.Size == 512 {
-		// AVX-512 VMOVUPD zmm, m512
-		// EVEX prefix
-		p0 := uint8(0x62)
+// vmovupdX86Mem encodes MOVUPD/VMOVUPD between a vector register and
+// [base + offset]. The register size picks SSE2 (xmm), VEX.256 (ymm) or
+// EVEX.512 (zmm).
+func (o *Out) vmovupdX86Mem(opcode uint8, vec, base string, offset int32) {
+	vecReg, vecOk := GetRegister(o.target.Arch(), vec)
+	baseReg, baseOk := GetRegister(o.target.Arch(), base)
+	if !vecOk || !baseOk {
+		return
+	}
+
+	// EVEX compresses 8-bit displacements by the size of the memory operand
+	dispScale := int32(1)
 
+	switch vecReg.Size {
+	case 512:
+		// EVEX prefix: 62 [R X B R' 0 0 m m] [W vvvv 1 pp] [z L'L b V' aaa]
 		p1 := uint8(0x01) // mm=01 (0F map)
-		if (dstReg.Encoding & 8) == 0 {
+		if (vecReg.Encoding & 8) == 0 {
 			p1 |= 0x80 // R
 		}
 		p1 |= 0x40 // X
 		if (baseReg.Encoding & 8) == 0 {
 			p1 |= 0x20 // B
 		}
-		if (dstReg.Encoding & 16) == 0 {
+		if (vecReg.Encoding & 16) == 0 {
 			p1 |= 0x10 // R'
 		}
-
-		// P2: W=1, vvvv=1111 (not used), pp=01
-		p2 := uint8(0x81) | (0x0F << 3) // vvvv=1111
-
-		// P3: L'L=10 (512-bit)
-		p3 := uint8(0x40)
-
-		o.Write(p0)
+		p2 := uint8(0x85) | (0x0F << 3) // W=1, vvvv=1111, pp=01
+		p3 := uint8(0x48)               // L'L=10 (512-bit), V'=1
+		o.Write(0x62)
 		o.Write(p1)
 		o.Write(p2)
 		o.Write(p3)
-
-		// Opcode: 0x10 (VMOVUPD load)
-		o.Write(0x10)
-
-		// ModR/M and displacement (similar to regular MOV)
-		if offset == 0 && (baseReg.Encoding&7) != 5 {
-			modrm := uint8(0x00) | ((dstReg.Encoding & 7) << 3) | (baseReg.Encoding & 7)
-			o.Write(modrm)
-			if (baseReg.Encoding & 7) == 4 { // SIB for RSP/R12
-				o.Write(0x24)
-			}
-		} else if offset >= -128 && offset <= 127 {
-			modrm := uint8(0x40) | ((dstReg.Encoding & 7) << 3) | (baseReg.Encoding & 7)
-			o.Write(modrm)
-			if (baseReg.Encoding & 7) == 4 {
-				o.Write(0x24)
-			}
-			o.Write(uint8(offset & 0xFF))
-		} else {
-			modrm := uint8(0x80) | ((dstReg.Encoding & 7) << 3) | (baseReg.Encoding & 7)
-			o.Write(modrm)
-			if (baseReg.Encoding & 7) == 4 {
-				o.Write(0x24)
-			}
-			o.Write(uint8(offset & 0xFF))
-			o.Write(uint8((offset >> 8) & 0xFF))
-			o.Write(uint8((offset >> 16) & 0xFF))
-			o.Write(uint8((offset >> 24) & 0xFF))
+		dispScale = 64
+	case 256:
+		// VEX 3-byte prefix: C4 [R X B m-mmmm] [W vvvv L pp]
+		vex1 := uint8(0x01) // map=0F
+		if (vecReg.Encoding & 8) == 0 {
+			vex1 |= 0x80 // ~R
 		}
-	} else if dstReg.Size == 256 {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, " (AVX2)")
-		}
-		// VEX VMOVUPD ymm, m256
-		o.Write(0xC5)
-		vex := uint8(0xFD) // vvvv=1111, L=1, pp=01
-		if (dstReg.Encoding & 8) == 0 {
-			vex |= 0x80
-		}
-		o.Write(vex)
-		o.Write(0x10)
-
-		// ModR/M
-		modrm := uint8(0x00) | ((dstReg.Encoding & 7) << 3) | (baseReg.Encoding & 7)
-		if offset != 0 {
-			modrm |= 0x40 // disp8
-		}
-		o.Write(modrm)
-		if offset != 0 {
-			o.Write(uint8(offset & 0xFF))
-		}
-	} else {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, " (SSE2)")
+		vex1 |= 0x40 // ~X
+		if (baseReg.Encoding & 8) == 0 {
+			vex1 |= 0x20 // ~B
 		}
-		// SSE2 MOVUPD xmm, m128
+		o.Write(0xC4)
+		o.Write(vex1)
+		o.Write(0x7D) // W=0, vvvv=1111, L=1, pp=01
+	default:
+		// SSE2 MOVUPD: 66 [REX] 0F op
 		o.Write(0x66)
-		if (dstReg.Encoding&8) != 0 || (baseReg.Encoding&8) != 0 {
+		if (vecReg.Encoding&8) != 0 || (baseReg.Encoding&8) != 0 {
 			rex := uint8(0x40)
-			if (dstReg.Encoding & 8) != 0 {
-				rex |= 0x04
+			if (vecReg.Encoding & 8) != 0 {
+				rex |= 0x04 // REX.R
 			}
 			if (baseReg.Encoding & 8) != 0 {
-				rex |= 0x01
+				rex |= 0x01 // REX.B
 			}
 			o.Write(rex)
 		}
 		o.Write(0x0F)
-		o.Write(0x10)
-
-		modrm := uint8(0x00) | ((dstReg.Encoding & 7) << 3) | (baseReg.Encoding & 7)
-		if offset != 0 {
-			modrm |= 0x40
-		}
-		o.Write(modrm)
-		if offset != 0 {
-			o.Write(uint8(offset & 0xFF))
-		}
-	}
-
-	if VerboseMode {
-		fmt.Fprintln(os.Stderr)
-	}
-}
-
-// x86-64 VMOVUPD [mem], zmm (store)
-// EVEX.512.66.0F.W1 11 /r
-func (o *Out) vmovupdX86StoreToMem(src, base string, offset int32) {
-	srcReg, srcOk := GetRegister(o.target.Arch(), src)
-	baseReg, baseOk := GetRegister(o.target.Arch(), base)
-	if !srcOk || !baseOk {
-		return
 	}
-
-	if VerboseMode {
-		fmt.Fprintf(os.Stderr, "vmovupd [%s + %d], %s:", base, offset, src)
+	o.Write(opcode)
+
+	// ModR/M, SIB for rsp/r12 and the displacement. rbp/r13 always need one.
+	reg := (vecReg.Encoding & 7) << 3
+	rm := baseReg.Encoding & 7
+	var mod uint8
+	switch {
+	case offset == 0 && rm != 5:
+		mod = 0x00
+	case offset%dispScale == 0 && offset/dispScale >= -128 && offset/dispScale <= 127:
+		mod = 0x40
+	default:
+		mod = 0x80
 	}
-
-	if srcReg.Size == 512 {
-		// AVX-512 VMOVUPD m512, zmm
-		p0 := uint8(0x62)
-
-		p1 := uint8(0x01)
-		if (srcReg.Encoding & 8) == 0 {
-			p1 |= 0x80
-		}
-		p1 |= 0x40
-		if (baseReg.Encoding & 8) == 0 {
-			p1 |= 0x20
-		}
-		if (srcReg.Encoding & 16) == 0 {
-			p1 |= 0x10
-		}
-
-		p2 := uint8(0x81) | (0x0F << 3)
-		p3 := uint8(0x40)
-
-		o.Write(p0)
-		o.Write(p1)
-		o.Write(p2)
-		o.Write(p3)
-
-		// Opcode: 0x11 (VMOVUPD store)
-		o.Write(0x11)
-
-		// ModR/M
-		if offset == 0 && (baseReg.Encoding&7) != 5 {
-			modrm := uint8(0x00) | ((srcReg.Encoding & 7) << 3) | (baseReg.Encoding & 7)
-			o.Write(modrm)
-			if (baseReg.Encoding & 7) == 4 {
-				o.Write(0x24)
-			}
-		} else if offset >= -128 && offset <= 127 {
-			modrm := uint8(0x40) | ((srcReg.Encoding & 7) << 3) | (baseReg.Encoding & 7)
-			o.Write(modrm)
-			if (baseReg.Encoding & 7) == 4 {
-				o.Write(0x24)
-			}
-			o.Write(uint8(offset & 0xFF))
-		} else {
-			modrm := uint8(0x80) | ((srcReg.Encoding & 7) << 3) | (baseReg.Encoding & 7)
-			o.Write(modrm)
-			if (baseReg.Encoding & 7) == 4 {
-				o.Write(0x24)
-			}
-			o.Write(uint8(offset & 0xFF))
-			o.Write(uint8((offset >> 8) & 0xFF))
-			o.Write(uint8((offset >> 16) & 0xFF))
-			o.Write(uint8((offset >> 24) & 0xFF))
-		}
-	} else if srcReg.Size == 256 {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, " (AVX2)")
-		}
-		o.Write(0xC5)
-		vex := uint8(0xFD)
-		if (srcReg.Encoding & 8) == 0 {
-			vex |= 0x80
-		}
-		o.Write(vex)
-		o.Write(0x11)
-
-		modrm := uint8(0x00) | ((srcReg.Encoding & 7) << 3) | (baseReg.Encoding & 7)
-		if offset != 0 {
-			modrm |= 0x40
-		}
-		o.Write(modrm)
-		if offset != 0 {
-			o.Write(uint8(offset & 0xFF))
-		}
-	} else {
-		if VerboseMode {
-			fmt.Fprintf(os.Stderr, " (SSE2)")
-		}
-		o.Write(0x66)
-		if (srcReg.Encoding&8) != 0 || (baseReg.Encoding&8) != 0 {
-			rex := uint8(0x40)
-			if (srcReg.Encoding & 8) != 0 {
-				rex |= 0x04
-			}
-			if (baseReg.Encoding & 8) != 0 {
-				rex |= 0x01
-			}
-			o.Write(rex)
-		}
-		o.Write(0x0F)
-		o.Write(0x11)
-
-		modrm := uint8(0x00) | ((srcReg.Encoding & 7) << 3) | (baseReg.Encoding & 7)
-		if offset != 0 {
-			modrm |= 0x40
-		}
-		o.Write(modrm)
-		if offset != 0 {
-			o.Write(uint8(offset & 0xFF))
-		}
+	o.Write(mod | reg | rm)
+	if rm == 4 {
+		o.Write(0x24) // SIB: base only
 	}
-
-	if VerboseMode {
-		fmt.Fprintln(os.Stderr)
+	switch mod {
+	case 0x40:
+		o.Write(uint8(offset / dispScale))
+	case 0x80:
+		o.Write(uint8(offset & 0xFF))
+		o.Write(uint8((offset >> 8) & 0xFF))
+		o.Write(uint8((offset >> 16) & 0xFF))
+		o.Write(uint8((offset >> 24) & 0xFF))
 	}
 }
 
@@ -74,7 +74,7 @@ func (o *Out) vmulpdX86VectorToVector(dst, src1, src2 string) {
 		}
 
 		// P2: [W vvvv 1 pp]
-		p2 := uint8(0x81)                            // W=1, pp=01
+		p2 := uint8(0x85)                            // W=1, pp=01
 		p2 |= uint8((^src1Reg.Encoding & 0x0F) << 3) // vvvv
 
 		// P3: [z L'L b V' aaa]
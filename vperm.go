@@ -88,7 +88,7 @@ func (o *Out) vpermpdX86VectorWithImm(dst, src string, imm8 uint8) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81) | (0x0F << 3) // vvvv=1111
+		p2 := uint8(0x85) | (0x0F << 3) // vvvv=1111
 
 		p3 := uint8(0x40)
 		if (srcReg.Encoding & 16) == 0 {
@@ -177,7 +177,7 @@ func (o *Out) vpermpdX86VectorWithIndex(dst, src, indices string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81)
+		p2 := uint8(0x85)
 		p2 |= uint8((^indicesReg.Encoding & 0x0F) << 3) // vvvv=~indices
 
 		p3 := uint8(0x40)
@@ -85,7 +85,7 @@ func (o *Out) vrcppdX86VectorToVector(dst, src string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81) | (0x0F << 3) // vvvv=1111 (unused)
+		p2 := uint8(0x85) | (0x0F << 3) // vvvv=1111 (unused)
 
 		p3 := uint8(0x40)
 		if (srcReg.Encoding & 16) == 0 {
@@ -149,7 +149,7 @@ func (o *Out) vrsqrtpdX86VectorToVector(dst, src string) {
 			p1 |= 0x10
 		}
 
-		p2 := uint8(0x81) | (0x0F << 3)
+		p2 := uint8(0x85) | (0x0F << 3)
 
 		p3 := uint8(0x40)
 		if (srcReg.Encoding & 16) == 0 {
@@ -96,7 +96,7 @@ func (o *Out) vscatterqpdX86ToMem(src, base, indices string, scale int32, mask s
 		}
 
 		// P2: W=1, vvvv=1111 (not used for scatter), pp=01
-		p2 := uint8(0x81) | (0x0F << 3)
+		p2 := uint8(0x85) | (0x0F << 3)
 
 		// P3: L'L=10 (512-bit), with masking (aaa = mask register)
 		p3 := uint8(0x40) | (maskReg.Encoding & 7) // aaa = k register
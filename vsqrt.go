@@ -71,7 +71,7 @@ func (o *Out) vsqrtpdX86VectorToVector(dst, src string) {
 		}
 
 		// P2: W=1, vvvv=1111 (unused for unary op), pp=01
-		p2 := uint8(0x81) | (0x0F << 3)
+		p2 := uint8(0x85) | (0x0F << 3)
 
 		// P3: L'L=10 (512-bit)
 		p3 := uint8(0x40)
@@ -108,7 +108,7 @@ func (o *Out) vsqrtpdX86VectorToVector(dst, src string) {
 		}
 		o.Write(vex1)
 
-		vex2 := uint8(0xC5) // W=1, L=1, pp=01, vvvv=1111
+		vex2 := uint8(0x7D) // W=0, vvvv=1111, L=1, pp=01
 		o.Write(vex2)
 
 		o.Write(0x51)
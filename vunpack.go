@@ -0,0 +1,158 @@
+// Completion: 90% - x86-64 and ARM64 complete, RISC-V has no single-instruction equivalent
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// VUNPCKLPD/VUNPCKHPD - Interleave the low or high float64 of each 128-bit lane
+// Essential for Vibe67's list layout:
+//   - Lists and maps store [count][key0][val0][key1][val1]...
+//   - Two vector loads followed by VUNPCKHPD give a vector of values
+//   - VUNPCKLPD/VUNPCKHPD of keys and values write the pairs back
+//
+// Within every 128-bit lane:
+//   unpcklpd: dst = (src1[0], src2[0])
+//   unpckhpd: dst = (src1[1], src2[1])
+//
+// Architecture details:
+//   x86-64: VUNPCKLPD/VUNPCKHPD zmm/ymm (AVX-512/AVX), UNPCKLPD/UNPCKHPD xmm (SSE2, dst = src1)
+//   ARM64:  ZIP1/ZIP2 Vd.2D, Vn.2D, Vm.2D (NEON)
+//   RISC-V: No single instruction (vrgather or strided loads instead)
+
+// VUnpckLoPDVectorToVector interleaves the low float64 of each lane: dst = (src1[0], src2[0])
+func (o *Out) VUnpckLoPDVectorToVector(dst, src1, src2 string) {
+	o.vunpckPD(0x14, dst, src1, src2)
+}
+
+// VUnpckHiPDVectorToVector interleaves the high float64 of each lane: dst = (src1[1], src2[1])
+func (o *Out) VUnpckHiPDVectorToVector(dst, src1, src2 string) {
+	o.vunpckPD(0x15, dst, src1, src2)
+}
+
+func (o *Out) vunpckPD(opcode uint8, dst, src1, src2 string) {
+	switch o.target.Arch() {
+	case ArchX86_64:
+		o.vunpckpdX86VectorToVector(opcode, dst, src1, src2)
+	case ArchARM64:
+		o.vunpckARM64VectorToVector(opcode, dst, src1, src2)
+	case ArchRiscv64:
+		if VerboseMode {
+			fmt.Fprintf(os.Stderr, "# RVV has no unpck/zip instruction for %s\n", dst)
+		}
+	}
+}
+
+// ============================================================================
+// x86-64 AVX-512/AVX/SSE2 implementation
+// ============================================================================
+
+// x86-64 VUNPCKLPD/VUNPCKHPD zmm1, zmm2, zmm3
+// EVEX.NDS.512.66.0F.W1 14/15 /r
+func (o *Out) vunpckpdX86VectorToVector(opcode uint8, dst, src1, src2 string) {
+	dstReg, dstOk := GetRegister(o.target.Arch(), dst)
+	src1Reg, src1Ok := GetRegister(o.target.Arch(), src1)
+	src2Reg, src2Ok := GetRegister(o.target.Arch(), src2)
+	if !dstOk || !src1Ok || !src2Ok {
+		return
+	}
+
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "vunpck%spd %s, %s, %s\n", map[uint8]string{0x14: "l", 0x15: "h"}[opcode], dst, src1, src2)
+	}
+
+	modrm := uint8(0xC0) | ((dstReg.Encoding & 7) << 3) | (src2Reg.Encoding & 7)
+
+	switch dstReg.Size {
+	case 512:
+		// EVEX prefix: 62 [R X B R' 0 0 m m] [W vvvv 1 pp] [z L'L b V' aaa]
+		p1 := uint8(0x01) // mm=01 (0F map)
+		if (dstReg.Encoding & 8) == 0 {
+			p1 |= 0x80 // R
+		}
+		if (src2Reg.Encoding & 16) == 0 {
+			p1 |= 0x40 // X (bit 4 of ModRM.r/m)
+		}
+		if (src2Reg.Encoding & 8) == 0 {
+			p1 |= 0x20 // B
+		}
+		if (dstReg.Encoding & 16) == 0 {
+			p1 |= 0x10 // R'
+		}
+		p2 := uint8(0x85) | uint8((^src1Reg.Encoding&0x0F)<<3) // W=1, vvvv=~src1, pp=01
+		p3 := uint8(0x40)                                      // L'L=10 (512-bit)
+		if (src1Reg.Encoding & 16) == 0 {
+			p3 |= 0x08 // V'
+		}
+		o.Write(0x62)
+		o.Write(p1)
+		o.Write(p2)
+		o.Write(p3)
+		o.Write(opcode)
+		o.Write(modrm)
+	case 256:
+		// VEX 3-byte prefix: C4 [R X B m-mmmm] [W vvvv L pp]
+		vex1 := uint8(0x01) // map=0F
+		if (dstReg.Encoding & 8) == 0 {
+			vex1 |= 0x80 // ~R
+		}
+		vex1 |= 0x40 // ~X
+		if (src2Reg.Encoding & 8) == 0 {
+			vex1 |= 0x20 // ~B
+		}
+		vex2 := uint8(0x05) | uint8((^src1Reg.Encoding&0x0F)<<3) // W=0, vvvv=~src1, L=1, pp=01
+		o.Write(0xC4)
+		o.Write(vex1)
+		o.Write(vex2)
+		o.Write(opcode)
+		o.Write(modrm)
+	default:
+		// SSE2 UNPCKLPD/UNPCKHPD xmm1, xmm2: 66 [REX] 0F 14/15 /r (xmm1 is also src1)
+		o.Write(0x66)
+		if (dstReg.Encoding&8) != 0 || (src2Reg.Encoding&8) != 0 {
+			rex := uint8(0x40)
+			if (dstReg.Encoding & 8) != 0 {
+				rex |= 0x04 // REX.R
+			}
+			if (src2Reg.Encoding & 8) != 0 {
+				rex |= 0x01 // REX.B
+			}
+			o.Write(rex)
+		}
+		o.Write(0x0F)
+		o.Write(opcode)
+		o.Write(modrm)
+	}
+}
+
+// ============================================================================
+// ARM64 NEON implementation
+// ============================================================================
+
+// ARM64 ZIP1/ZIP2 Vd.2D, Vn.2D, Vm.2D
+func (o *Out) vunpckARM64VectorToVector(opcode uint8, dst, src1, src2 string) {
+	dstReg, dstOk := GetRegister(o.target.Arch(), dst)
+	src1Reg, src1Ok := GetRegister(o.target.Arch(), src1)
+	src2Reg, src2Ok := GetRegister(o.target.Arch(), src2)
+	if !dstOk || !src1Ok || !src2Ok {
+		return
+	}
+
+	if VerboseMode {
+		fmt.Fprintf(os.Stderr, "zip%d %s.2d, %s.2d, %s.2d\n", opcode-0x13, dst, src1, src2)
+	}
+
+	instr := uint32(0x4ec03800) // ZIP1 .2D
+	if opcode == 0x15 {
+		instr = 0x4ec07800 // ZIP2 .2D
+	}
+	instr |= uint32(src2Reg.Encoding&31) << 16
+	instr |= uint32(src1Reg.Encoding&31) << 5
+	instr |= uint32(dstReg.Encoding & 31)
+
+	o.Write(uint8(instr & 0xFF))
+	o.Write(uint8((instr >> 8) & 0xFF))
+	o.Write(uint8((instr >> 16) & 0xFF))
+	o.Write(uint8((instr >> 24) & 0xFF))
+}
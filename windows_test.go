@@ -1,7 +1,11 @@
 package main
 
 import (
+	"debug/pe"
+	"encoding/binary"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -74,3 +78,180 @@ c.printf("C FFI works: %d\n", 42)
 		t.Errorf("Invalid PE header: expected 'MZ', got %c%c", data[0], data[1])
 	}
 }
+
+// TestPEImages parses every PE the compiler writes in these programs with
+// debug/pe and checks the layout, the imports and the base relocations
+func TestPEImages(t *testing.T) {
+	sdl3, err := filepath.Abs("SDL3.dll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	programs := map[string]struct {
+		code    string
+		imports []string // symbol:DLL, as debug/pe lists them
+	}{
+		"hello": {`println("Hello Windows")
+`, []string{"ExitProcess:kernel32.dll"}},
+		"dlls": {`import "kernel32" as k
+import "user32" as u
+printf("%v\n", k.GetTickCount())
+u.MessageBeep(0)
+`, []string{"GetTickCount:kernel32.dll", "ExitProcess:kernel32.dll", "printf:msvcrt.dll", "MessageBeep:user32.dll"}},
+		"dllpath": {`import "` + filepath.ToSlash(sdl3) + `" as sdl
+import "user32" as u
+printf("%v\n", sdl.SDL_GetTicks())
+sdl.ordinal_5()
+u.MessageBeep(0)
+`, []string{"SDL_GetTicks:SDL3.dll", "printf:msvcrt.dll", "MessageBeep:user32.dll"}},
+	}
+	if _, err := os.Stat(sdl3); err != nil {
+		delete(programs, "dllpath")
+	}
+
+	for name, prog := range programs {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, name+".v67")
+			if err := os.WriteFile(src, []byte(prog.code), 0644); err != nil {
+				t.Fatal(err)
+			}
+			exe := filepath.Join(dir, name+".exe")
+			if err := CompileC67(src, exe, Platform{Arch: ArchX86_64, OS: OSWindows}); err != nil {
+				t.Fatal(err)
+			}
+			content, err := os.ReadFile(exe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := pe.Open(exe)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			oh, ok := f.OptionalHeader.(*pe.OptionalHeader64)
+			if !ok {
+				t.Fatalf("optional header is %T, want PE32+", f.OptionalHeader)
+			}
+			if oh.DllCharacteristics&pe.IMAGE_DLLCHARACTERISTICS_DYNAMIC_BASE == 0 {
+				t.Errorf("DllCharacteristics = %#x, want DYNAMIC_BASE", oh.DllCharacteristics)
+			}
+			if f.Characteristics&pe.IMAGE_FILE_RELOCS_STRIPPED != 0 {
+				t.Error("relocations are marked as stripped")
+			}
+
+			// Sections follow each other in the file and in memory
+			end := oh.SizeOfHeaders
+			for _, sec := range f.Sections {
+				if sec.VirtualAddress%oh.SectionAlignment != 0 || sec.Offset%oh.FileAlignment != 0 {
+					t.Errorf("%s at RVA %#x, offset %#x is misaligned", sec.Name, sec.VirtualAddress, sec.Offset)
+				}
+				if sec.VirtualAddress < end {
+					t.Errorf("%s at RVA %#x overlaps what comes before it", sec.Name, sec.VirtualAddress)
+				}
+				if int(sec.Offset+sec.Size) > len(content) {
+					t.Errorf("%s ends past the end of the file", sec.Name)
+				}
+				end = sec.VirtualAddress + sec.VirtualSize
+			}
+			if want := (end + oh.SectionAlignment - 1) &^ (oh.SectionAlignment - 1); oh.SizeOfImage != want {
+				t.Errorf("SizeOfImage = %#x, want %#x", oh.SizeOfImage, want)
+			}
+
+			syms, err := f.ImportedSymbols()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.Join(syms, " ")
+			for _, want := range prog.imports {
+				if !strings.Contains(" "+got+" ", " "+want+" ") {
+					t.Errorf("imports %s, want %s among them", got, want)
+				}
+			}
+
+			// The loader writes the IATs, which are 8-byte aligned
+			rvaBytes := func(rva, size uint32) []byte {
+				for _, sec := range f.Sections {
+					if rva >= sec.VirtualAddress && rva+size <= sec.VirtualAddress+sec.Size {
+						return content[sec.Offset+rva-sec.VirtualAddress:][:size]
+					}
+				}
+				t.Fatalf("RVA %#x is in no section", rva)
+				return nil
+			}
+			iat := oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_IAT]
+			if iat.Size == 0 {
+				t.Error("no IAT directory")
+			}
+			imports := oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_IMPORT]
+			idt := rvaBytes(imports.VirtualAddress, imports.Size)
+			var ordinals []uint64
+			for off := 0; binary.LittleEndian.Uint32(idt[off:]) != 0; off += 20 {
+				ilt := binary.LittleEndian.Uint32(idt[off:])
+				first := binary.LittleEndian.Uint32(idt[off+16:])
+				if ilt%8 != 0 || first%8 != 0 || first < iat.VirtualAddress || first >= iat.VirtualAddress+iat.Size {
+					t.Errorf("import descriptor %d: ILT %#x, IAT %#x", off/20, ilt, first)
+				}
+				for entry := ilt; ; entry += 8 {
+					v := binary.LittleEndian.Uint64(rvaBytes(entry, 8))
+					if v == 0 {
+						break
+					}
+					if v&(1<<63) != 0 {
+						ordinals = append(ordinals, v&0xFFFF)
+					}
+				}
+			}
+			if name == "dllpath" && (len(ordinals) != 1 || ordinals[0] != 5) {
+				t.Errorf("imports by ordinal = %v, want [5]", ordinals)
+			}
+
+			// The base relocation table is a list of well-formed blocks
+			reloc := oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_BASERELOC]
+			if reloc.Size == 0 {
+				t.Fatal("no base relocation directory")
+			}
+			table := rvaBytes(reloc.VirtualAddress, reloc.Size)
+			for len(table) > 0 {
+				size := binary.LittleEndian.Uint32(table[4:])
+				if size < 8 || size%4 != 0 || int(size) > len(table) {
+					t.Fatalf("base relocation block of %d bytes in %d", size, len(table))
+				}
+				table = table[size:]
+			}
+		})
+	}
+}
+
+func TestPEImportsAndRelocations(t *testing.T) {
+	// Two DLLs give an import directory of 60 bytes, after which the
+	// lookup tables must still be 8-byte aligned
+	imports, err := BuildPEImportData(map[string][]string{
+		"a.dll": {"f", "ordinal_7"},
+		"b.dll": {"g"},
+	}, map[string]uint16{"g": 3}, 0x3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, rva := range imports.iat {
+		if rva%8 != 0 || rva < imports.iatRVA || rva >= imports.iatRVA+imports.iatSize {
+			t.Errorf("IAT slot of %s at %#x, IATs at %#x+%#x", name, rva, imports.iatRVA, imports.iatSize)
+		}
+	}
+	if v := binary.LittleEndian.Uint64(imports.data[imports.iat["ordinal_7"]-0x3000:]); v != 1<<63|7 {
+		t.Errorf("ordinal_7 is imported as %#x", v)
+	}
+	hintName := binary.LittleEndian.Uint64(imports.data[imports.iat["g"]-0x3000:]) - 0x3000
+	if hint := binary.LittleEndian.Uint16(imports.data[hintName:]); hint != 3 {
+		t.Errorf("hint of g = %d, want 3", hint)
+	}
+
+	relocs := BuildPERelocations([]uint32{0x2010, 0x1008, 0x1000})
+	want := []byte{
+		0x00, 0x10, 0x00, 0x00, 12, 0, 0, 0, 0x00, 0xA0, 0x08, 0xA0, // page 0x1000: two DIR64
+		0x00, 0x20, 0x00, 0x00, 12, 0, 0, 0, 0x10, 0xA0, 0x00, 0x00, // page 0x2000: one DIR64, padded
+	}
+	if string(relocs) != string(want) {
+		t.Errorf("relocations = % x, want % x", relocs, want)
+	}
+}
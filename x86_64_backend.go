@@ -0,0 +1,98 @@
+// Completion: 90% - CodeGenerator for x86-64 on top of the encoders of Out
+package main
+
+// X86_64Backend implements the CodeGenerator interface for x86-64 with the
+// encoders the AST code generator uses through Out.
+//
+// Jump and call offsets are counted from the start of the instruction, as on
+// the ARM64 and RISC-V backends, and not from its end as x86-64 encodes them.
+type X86_64Backend struct {
+	out *Out
+}
+
+// Sizes of the rel32 forms that Out emits
+const (
+	x86JccSize  = 6 // 0F 8x rel32
+	x86JmpSize  = 5 // E9 rel32
+	x86CallSize = 5 // E8 rel32
+)
+
+// NewX86_64Backend creates a new x86-64 code generator backend
+func NewX86_64Backend(writer Writer, eb *ExecutableBuilder) *X86_64Backend {
+	// Out has no backend on x86-64, so it encodes the instructions itself
+	return &X86_64Backend{out: &Out{
+		target:         eb.target,
+		writer:         writer,
+		eb:             eb,
+		stackValidator: NewStackValidator(),
+	}}
+}
+
+// ===== Data Movement =====
+
+func (x *X86_64Backend) MovRegToReg(dst, src string)       { x.out.MovRegToReg(dst, src) }
+func (x *X86_64Backend) MovImmToReg(dst, imm string)       { x.out.MovImmToReg(dst, imm) }
+func (x *X86_64Backend) MovRegToXmm(dst, src string)       { x.out.MovRegToXmm(dst, src) }
+func (x *X86_64Backend) MovXmmToReg(dst, src string)       { x.out.MovqXmmToReg(dst, src) }
+func (x *X86_64Backend) LeaSymbolToReg(dst, symbol string) { x.out.LeaSymbolToReg(dst, symbol) }
+
+func (x *X86_64Backend) MovXmmToMem(src, base string, offset int32) {
+	x.out.MovXmmToMem(src, base, int(offset))
+}
+
+func (x *X86_64Backend) MovMemToXmm(dst, base string, offset int32) {
+	x.out.MovMemToXmm(dst, base, int(offset))
+}
+
+// ===== Arithmetic =====
+
+func (x *X86_64Backend) AddRegToReg(dst, src string)         { x.out.AddRegToReg(dst, src) }
+func (x *X86_64Backend) AddImmToReg(dst string, imm int64)   { x.out.AddImmToReg(dst, imm) }
+func (x *X86_64Backend) SubRegToReg(dst, src string)         { x.out.SubRegFromReg(dst, src) }
+func (x *X86_64Backend) SubImmFromReg(dst string, imm int64) { x.out.SubImmFromReg(dst, imm) }
+func (x *X86_64Backend) MulRegToReg(dst, src string)         { x.out.ImulRegWithReg(dst, src) }
+func (x *X86_64Backend) DivRegToReg(dst, src string)         { x.out.DivRegByReg(dst, src) }
+func (x *X86_64Backend) NegReg(dst string)                   { x.out.NegReg(dst) }
+
+// ===== Logic =====
+
+func (x *X86_64Backend) AndRegWithReg(dst, src string) { x.out.AndRegWithReg(dst, src) }
+func (x *X86_64Backend) OrRegWithReg(dst, src string)  { x.out.OrRegWithReg(dst, src) }
+func (x *X86_64Backend) XorRegWithReg(dst, src string) { x.out.XorRegWithReg(dst, src) }
+func (x *X86_64Backend) NotReg(dst string)             { x.out.NotReg(dst) }
+
+func (x *X86_64Backend) XorRegWithImm(dst string, imm int64) {
+	x.out.XorRegWithImm(dst, int32(imm))
+}
+
+// ===== Comparisons and jumps =====
+
+func (x *X86_64Backend) CmpRegToReg(src1, src2 string)     { x.out.CmpRegToReg(src1, src2) }
+func (x *X86_64Backend) CmpRegToImm(reg string, imm int64) { x.out.CmpRegToImm(reg, imm) }
+
+func (x *X86_64Backend) JumpConditional(condition JumpCondition, offset int32) {
+	x.out.JumpConditional(condition, offset-x86JccSize)
+}
+
+func (x *X86_64Backend) JumpUnconditional(offset int32) {
+	x.out.JumpUnconditional(offset - x86JmpSize)
+}
+
+// ===== Floating point =====
+
+func (x *X86_64Backend) AddpdXmm(dst, src string)  { x.out.AddpdXmm(dst, src) }
+func (x *X86_64Backend) SubpdXmm(dst, src string)  { x.out.SubpdXmm(dst, src) }
+func (x *X86_64Backend) MulpdXmm(dst, src string)  { x.out.MulpdXmm(dst, src) }
+func (x *X86_64Backend) DivpdXmm(dst, src string)  { x.out.DivpdXmm(dst, src) }
+func (x *X86_64Backend) Ucomisd(dst, src string)   { x.out.Ucomisd(dst, src) }
+func (x *X86_64Backend) Cvtsi2sd(dst, src string)  { x.out.Cvtsi2sd(dst, src) }
+func (x *X86_64Backend) Cvttsd2si(dst, src string) { x.out.Cvttsd2si(dst, src) }
+
+// ===== Calls and system operations =====
+
+func (x *X86_64Backend) CallRelative(offset int32) {
+	x.out.CallRelative(offset - x86CallSize)
+}
+
+func (x *X86_64Backend) Ret()     { x.out.Ret() }
+func (x *X86_64Backend) Syscall() { x.out.Syscall() }